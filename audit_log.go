@@ -0,0 +1,85 @@
+package veneur
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// auditRecord is one line of the flush audit log, describing what a single
+// sink was given to flush.
+type auditRecord struct {
+	Timestamp     time.Time `json:"timestamp"`
+	Sink          string    `json:"sink"`
+	Metrics       int       `json:"metrics"`
+	Distributions int       `json:"distributions,omitempty"`
+	Spans         int       `json:"spans,omitempty"`
+	// the size of the JSON posted to Datadog or forwarded, before
+	// compression, or of what a plugin wrote or sent; only known for
+	// plugins that report it
+	Bytes   int    `json:"bytes,omitempty"`
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+}
+
+// auditLog appends a JSON auditRecord for each sink to a file at every
+// flush, as a record of what was sent where, separate from the operational
+// log.
+type auditLog struct {
+	mtx    sync.Mutex
+	file   *os.File
+	closed bool
+}
+
+// newAuditLog opens the audit log at path for appending, creating it if it
+// doesn't exist.
+func newAuditLog(path string) (*auditLog, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{file: file}, nil
+}
+
+// Record appends record, of a flush that completed now with err. It does
+// nothing if the audit log is nil or closed.
+func (a *auditLog) Record(record auditRecord, err error) {
+	if a == nil {
+		return
+	}
+	record.Timestamp = time.Now().UTC()
+	record.Success = err == nil
+	if err != nil {
+		record.Error = err.Error()
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		log.WithError(err).Error("Could not render audit record")
+		return
+	}
+
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	if a.closed {
+		return
+	}
+	if _, err := a.file.Write(append(line, '\n')); err != nil {
+		log.WithError(err).WithField("path", a.file.Name()).Error("Could not write audit record")
+	}
+}
+
+// Close closes the audit log's file. Flushes that complete later aren't
+// recorded.
+func (a *auditLog) Close() error {
+	if a == nil {
+		return nil
+	}
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	if a.closed {
+		return nil
+	}
+	a.closed = true
+	return a.file.Close()
+}
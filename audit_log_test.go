@@ -0,0 +1,180 @@
+package veneur
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stripe/veneur/samplers"
+)
+
+func TestFlushAuditLog(t *testing.T) {
+	file, err := ioutil.TempFile("", "veneur-audit")
+	assert.NoError(t, err)
+	file.Close()
+	defer os.Remove(file.Name())
+
+	config := globalConfig()
+	config.FlushAuditLog = file.Name()
+	f := newFixture(t, config)
+	defer f.Close()
+
+	f.server.registerPlugin(&dummyPlugin{name: "good", flush: func(metrics []samplers.DDMetric, hostname string) error {
+		return nil
+	}})
+	f.server.registerPlugin(&dummyPlugin{name: "bad", flush: func(metrics []samplers.DDMetric, hostname string) error {
+		return errors.New("boom")
+	}})
+	f.server.registerPlugin(&sizedPlugin{dummyPlugin{name: "sized"}, 42})
+
+	for _, name := range []string{"a.b.c", "d.e.f"} {
+		f.server.Workers[0].ProcessMetric(&samplers.UDPMetric{
+			MetricKey:  samplers.MetricKey{Name: name, Type: "gauge"},
+			Value:      1.0,
+			SampleRate: 1.0,
+			Scope:      samplers.MixedScope,
+		})
+	}
+	f.server.Flush()
+	posted, err := marshalSeries(receiveFlush(t, f).Series, 1)
+	assert.NoError(t, err)
+
+	// the plugins finish flushing in the background
+	var records []auditRecord
+	deadline := time.Now().Add(5 * time.Second)
+	for len(records) < 4 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		contents, err := ioutil.ReadFile(file.Name())
+		assert.NoError(t, err)
+		records = nil
+		for _, line := range strings.Split(strings.TrimSpace(string(contents)), "\n") {
+			if line == "" {
+				continue
+			}
+			var record auditRecord
+			assert.NoError(t, json.Unmarshal([]byte(line), &record))
+			records = append(records, record)
+		}
+	}
+	if !assert.Len(t, records, 4, "there should be a record for each sink") {
+		return
+	}
+	sort.Sort(bySink(records))
+
+	assert.Equal(t, "bad", records[0].Sink)
+	assert.Equal(t, 2, records[0].Metrics)
+	assert.False(t, records[0].Success)
+	assert.Equal(t, "boom", records[0].Error)
+
+	// Datadog also gets the heartbeat
+	assert.Equal(t, "datadog", records[1].Sink)
+	assert.Equal(t, 3, records[1].Metrics)
+	assert.Equal(t, len(posted), records[1].Bytes, "the bytes posted to Datadog should be recorded")
+	assert.True(t, records[1].Success)
+
+	assert.Equal(t, "good", records[2].Sink)
+	assert.Equal(t, 2, records[2].Metrics)
+	assert.Equal(t, 0, records[2].Bytes, "plugins that don't report their size have no bytes")
+	assert.True(t, records[2].Success)
+
+	assert.Equal(t, "sized", records[3].Sink)
+	assert.Equal(t, 42, records[3].Bytes, "the size reported by the plugin should be recorded")
+
+	for _, record := range records {
+		assert.WithinDuration(t, time.Now(), record.Timestamp, 10*time.Second)
+	}
+}
+
+// TestFlushAuditLogRefused tests that distributions and forwards that
+// Datadog or the global Veneur refuse are recorded as failures.
+func TestFlushAuditLogRefused(t *testing.T) {
+	file, err := ioutil.TempFile("", "veneur-audit")
+	assert.NoError(t, err)
+	file.Close()
+	defer os.Remove(file.Name())
+
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer api.Close()
+
+	config := localConfig()
+	config.FlushAuditLog = file.Name()
+	config.ForwardAddress = api.URL
+	config.DistributionAPIAddress = api.URL
+	server, err := NewFromConfig(config)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer server.auditLog.Close()
+
+	server.flushDistributions([]samplers.DDDistribution{{Name: "a.b.c"}})
+	wm := NewWorkerMetrics()
+	key := samplers.MetricKey{Name: "d.e.f", Type: "histogram"}
+	wm.histograms[key] = samplers.NewHist(key.Name, nil)
+	wm.histograms[key].Sample(1.0, 1.0)
+	server.flushForward(context.Background(), []WorkerMetrics{wm})
+
+	contents, err := ioutil.ReadFile(file.Name())
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(contents)), "\n")
+	if !assert.Len(t, lines, 2, "there should be a record for each POST") {
+		return
+	}
+	for i, sink := range []string{"datadog", "forward"} {
+		var record auditRecord
+		assert.NoError(t, json.Unmarshal([]byte(lines[i]), &record))
+		assert.Equal(t, sink, record.Sink)
+		assert.False(t, record.Success, "a refused POST to %s should be a failure", sink)
+		assert.Contains(t, record.Error, "500")
+	}
+}
+
+func TestAuditLogClose(t *testing.T) {
+	file, err := ioutil.TempFile("", "veneur-audit")
+	assert.NoError(t, err)
+	file.Close()
+	defer os.Remove(file.Name())
+
+	a, err := newAuditLog(file.Name())
+	assert.NoError(t, err)
+	a.Record(auditRecord{Sink: "before", Spans: 2}, nil)
+	assert.NoError(t, a.Close())
+	a.Record(auditRecord{Sink: "after"}, nil)
+	assert.NoError(t, a.Close(), "closing twice should be harmless")
+
+	contents, err := ioutil.ReadFile(file.Name())
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(contents)), "\n")
+	if assert.Len(t, lines, 1, "nothing should be recorded once the log is closed") {
+		var record auditRecord
+		assert.NoError(t, json.Unmarshal([]byte(lines[0]), &record))
+		assert.Equal(t, "before", record.Sink)
+		assert.Equal(t, 2, record.Spans)
+	}
+}
+
+// sizedPlugin is a plugins.SizedPlugin that reports it flushed size bytes.
+type sizedPlugin struct {
+	dummyPlugin
+	size int
+}
+
+func (sp *sizedPlugin) FlushSized(metrics []samplers.DDMetric, hostname string) (int, error) {
+	return sp.size, nil
+}
+
+type bySink []auditRecord
+
+func (r bySink) Len() int           { return len(r) }
+func (r bySink) Less(i, j int) bool { return r[i].Sink < r[j].Sink }
+func (r bySink) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
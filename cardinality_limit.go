@@ -0,0 +1,63 @@
+package veneur
+
+// cardinalityLimiter caps the number of distinct tag sets each metric name
+// can have in a flush interval, so one client tagging a metric with a
+// request ID can't flood the backend with series. Each worker has its own,
+// since every series of a name is aggregated by the same worker, and it is
+// only consulted under the worker's mutex when the worker is about to create
+// a series it doesn't already have.
+type cardinalityLimiter struct {
+	limit int
+
+	tagSets map[string]map[string]struct{}
+	dropped map[string]int64
+}
+
+// newCardinalityLimiter returns a limiter allowing limit tag sets per
+// metric name, or nil if limit is 0.
+func newCardinalityLimiter(limit int) *cardinalityLimiter {
+	if limit == 0 {
+		return nil
+	}
+	return &cardinalityLimiter{
+		limit:   limit,
+		tagSets: make(map[string]map[string]struct{}),
+		dropped: make(map[string]int64),
+	}
+}
+
+// Allow reports whether the metric called name, with tags joinedTags, can
+// start a new series this interval. Tag sets already allowed are always
+// allowed again, so a metric whose series have several types only counts
+// once. A nil limiter allows everything.
+func (cl *cardinalityLimiter) Allow(name, joinedTags string) bool {
+	if cl == nil {
+		return true
+	}
+	tagSets, ok := cl.tagSets[name]
+	if !ok {
+		tagSets = make(map[string]struct{})
+		cl.tagSets[name] = tagSets
+	}
+	if _, ok := tagSets[joinedTags]; ok {
+		return true
+	}
+	if len(tagSets) >= cl.limit {
+		cl.dropped[name]++
+		return false
+	}
+	tagSets[joinedTags] = struct{}{}
+	return true
+}
+
+// Reset starts a new interval, and returns the number of samples dropped
+// during the last one, by metric name.
+func (cl *cardinalityLimiter) Reset() map[string]int64 {
+	if cl == nil {
+		return nil
+	}
+	dropped := cl.dropped
+	cl.tagSets = make(map[string]map[string]struct{})
+	cl.dropped = make(map[string]int64)
+	return dropped
+}
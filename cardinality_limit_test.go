@@ -0,0 +1,33 @@
+package veneur
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCardinalityLimiter(t *testing.T) {
+	cl := newCardinalityLimiter(2)
+	assert.True(t, cl.Allow("a.b.c", "x:1"))
+	assert.True(t, cl.Allow("a.b.c", "x:2"))
+	assert.False(t, cl.Allow("a.b.c", "x:3"))
+	assert.False(t, cl.Allow("a.b.c", "x:4"))
+	assert.True(t, cl.Allow("a.b.c", "x:1"), "tag sets already allowed should stay allowed")
+	assert.True(t, cl.Allow("d.e.f", "x:3"), "each name should have its own limit")
+
+	assert.Equal(t, map[string]int64{"a.b.c": 2}, cl.Reset())
+	assert.True(t, cl.Allow("a.b.c", "x:3"), "the limit should reset each interval")
+	assert.Empty(t, cl.Reset())
+}
+
+func TestCardinalityLimiterDisabled(t *testing.T) {
+	cl := newCardinalityLimiter(0)
+	assert.Nil(t, cl)
+	assert.True(t, cl.Allow("a.b.c", "x:1"))
+	assert.Nil(t, cl.Reset())
+
+	config := localConfig()
+	config.MaxTagSetsPerMetric = -1
+	_, err := NewFromConfig(config)
+	assert.Error(t, err)
+}
@@ -31,6 +31,7 @@ func main() {
 	if err != nil {
 		logrus.WithError(err).Fatal("Could not initialize server")
 	}
+	server.ConfigFile = *configFile
 	defer func() {
 		veneur.ConsumePanic(server.Sentry, server.Statsd, server.Hostname, recover())
 	}()
@@ -38,6 +39,11 @@ func main() {
 
 	if conf.HTTPAddress != "" {
 		server.HTTPServe()
+		// HTTPServe returns once a signal has shut it down, so close the
+		// listeners and flush what's left
+		if err := server.Shutdown(); err != nil {
+			logrus.WithError(err).Error("Could not flush everything before shutting down")
+		}
 	} else {
 		select {}
 	}
@@ -1,39 +1,193 @@
 package veneur
 
 type Config struct {
-	Aggregates              []string  `yaml:"aggregates"`
-	APIHostname             string    `yaml:"api_hostname"`
-	AwsAccessKeyID          string    `yaml:"aws_access_key_id"`
-	AwsRegion               string    `yaml:"aws_region"`
-	AwsS3Bucket             string    `yaml:"aws_s3_bucket"`
-	AwsSecretAccessKey      string    `yaml:"aws_secret_access_key"`
-	Debug                   bool      `yaml:"debug"`
-	EnableProfiling         bool      `yaml:"enable_profiling"`
-	FlushFile               string    `yaml:"flush_file"`
-	FlushMaxPerBody         int       `yaml:"flush_max_per_body"`
-	ForwardAddress          string    `yaml:"forward_address"`
-	Hostname                string    `yaml:"hostname"`
-	HTTPAddress             string    `yaml:"http_address"`
-	InfluxAddress           string    `yaml:"influx_address"`
-	InfluxConsistency       string    `yaml:"influx_consistency"`
-	InfluxDBName            string    `yaml:"influx_db_name"`
-	Interval                string    `yaml:"interval"`
-	Key                     string    `yaml:"key"`
-	MetricMaxLength         int       `yaml:"metric_max_length"`
-	NumReaders              int       `yaml:"num_readers"`
-	NumWorkers              int       `yaml:"num_workers"`
-	OmitEmptyHostname       bool      `yaml:"omit_empty_hostname"`
-	Percentiles             []float64 `yaml:"percentiles"`
-	ReadBufferSizeBytes     int       `yaml:"read_buffer_size_bytes"`
-	SentryDsn               string    `yaml:"sentry_dsn"`
-	StatsAddress            string    `yaml:"stats_address"`
-	Tags                    []string  `yaml:"tags"`
-	TcpAddress              string    `yaml:"tcp_address"`
-	TLSAuthorityCertificate string    `yaml:"tls_authority_certificate"`
-	TLSCertificate          string    `yaml:"tls_certificate"`
-	TLSKey                  string    `yaml:"tls_key"`
-	TraceAddress            string    `yaml:"trace_address"`
-	TraceAPIAddress         string    `yaml:"trace_api_address"`
-	TraceMaxLengthBytes     int       `yaml:"trace_max_length_bytes"`
-	UdpAddress              string    `yaml:"udp_address"`
+	Aggregates                    []string                `yaml:"aggregates"`
+	APIHostname                   string                  `yaml:"api_hostname"`
+	AwsAccessKeyID                string                  `yaml:"aws_access_key_id"`
+	AwsRegion                     string                  `yaml:"aws_region"`
+	AwsS3Bucket                   string                  `yaml:"aws_s3_bucket"`
+	AwsSecretAccessKey            string                  `yaml:"aws_secret_access_key"`
+	CarbonAddress                 string                  `yaml:"carbon_address"`
+	CarbonMaxBufferedLines        int                     `yaml:"carbon_max_buffered_lines"`
+	CarbonTemplate                string                  `yaml:"carbon_template"`
+	CloudWatchNamespace           string                  `yaml:"cloudwatch_namespace"`
+	DatadogAPIVersion             string                  `yaml:"datadog_api_version"`
+	DatadogFlushCompress          bool                    `yaml:"datadog_flush_compress"`
+	Debug                         bool                    `yaml:"debug"`
+	DebugFlushFile                string                  `yaml:"debug_flush_file"`
+	DebugFlushFileMaxBytes        int64                   `yaml:"debug_flush_file_max_bytes"`
+	DistributionAPIAddress        string                  `yaml:"distribution_api_address"`
+	EmitCounterCounts             bool                    `yaml:"emit_counter_counts"`
+	EnableAggregationEstimate     bool                    `yaml:"enable_aggregation_estimate"`
+	EnableProfiling               bool                    `yaml:"enable_profiling"`
+	EnableUnitSuffixes            bool                    `yaml:"enable_unit_suffixes"`
+	FlushAuditLog                 string                  `yaml:"flush_audit_log"`
+	FlushFile                     string                  `yaml:"flush_file"`
+	FlushMaxPerBody               int                     `yaml:"flush_max_per_body"`
+	FlushMaxRetries               int                     `yaml:"flush_max_retries"`
+	FlushMergeOnSkip              bool                    `yaml:"flush_merge_on_skip"`
+	FlushSerializationParallelism int                     `yaml:"flush_serialization_parallelism"`
+	ForwardAddress                string                  `yaml:"forward_address"`
+	ForwardAddresses              []string                `yaml:"forward_addresses"`
+	ForwardAuthToken              string                  `yaml:"forward_auth_token"`
+	ForwardMinSamples             int                     `yaml:"forward_min_samples"`
+	GcpCredentialsFile            string                  `yaml:"gcp_credentials_file"`
+	GcpProject                    string                  `yaml:"gcp_project"`
+	GRPCAddress                   string                  `yaml:"grpc_address"`
+	HistogramCompression          float64                 `yaml:"histogram_compression"`
+	HistogramsAsDistributions     []string                `yaml:"histograms_as_distributions"`
+	Hostname                      string                  `yaml:"hostname"`
+	HTTPAddress                   string                  `yaml:"http_address"`
+	HTTPAuthExemptHealthcheck     bool                    `yaml:"http_auth_exempt_healthcheck"`
+	HTTPAuthToken                 string                  `yaml:"http_auth_token"`
+	HTTPTLSAuthorityCertificate   string                  `yaml:"http_tls_authority_certificate"`
+	HTTPTLSCertificate            string                  `yaml:"http_tls_certificate"`
+	HTTPTLSKey                    string                  `yaml:"http_tls_key"`
+	ImportMaxAge                  string                  `yaml:"import_max_age"`
+	ImportMaxFuture               string                  `yaml:"import_max_future"`
+	InfluxAddress                 string                  `yaml:"influx_address"`
+	InfluxConsistency             string                  `yaml:"influx_consistency"`
+	InfluxDBName                  string                  `yaml:"influx_db_name"`
+	InfluxFlushMaxPerBody         int                     `yaml:"influx_flush_max_per_body"`
+	InputScaleFactors             map[string]float64      `yaml:"input_scale_factors"`
+	Interval                      string                  `yaml:"interval"`
+	JaegerCollectorAddress        string                  `yaml:"jaeger_collector_address"`
+	KafkaAcks                     string                  `yaml:"kafka_acks"`
+	KafkaAsync                    bool                    `yaml:"kafka_async"`
+	KafkaBroker                   string                  `yaml:"kafka_broker"`
+	KafkaMetricTopic              string                  `yaml:"kafka_metric_topic"`
+	KafkaSpanTopic                string                  `yaml:"kafka_span_topic"`
+	Key                           string                  `yaml:"key"`
+	MaxPacketsPerSecond           int                     `yaml:"max_packets_per_second"`
+	MaxPacketsPerSecondPerSource  bool                    `yaml:"max_packets_per_second_per_source"`
+	MaxTagSetsPerMetric           int                     `yaml:"max_tag_sets_per_metric"`
+	MaxTagsPerMetric              int                     `yaml:"max_tags_per_metric"`
+	MetadataTagsFile              string                  `yaml:"metadata_tags_file"`
+	MetricMaxLength               int                     `yaml:"metric_max_length"`
+	MetricMaxTagLength            int                     `yaml:"metric_max_tag_length"`
+	MetricPrefix                  string                  `yaml:"metric_prefix"`
+	NormalizeMetricNames          MetricNameNormalization `yaml:"normalize_metric_names"`
+	NumReaders                    int                     `yaml:"num_readers"`
+	NumWorkers                    int                     `yaml:"num_workers"`
+	OmitEmptyHostname             bool                    `yaml:"omit_empty_hostname"`
+	OpentsdbAddress               string                  `yaml:"opentsdb_address"`
+	OriginTags                    []OriginTagRule         `yaml:"origin_tags"`
+	ParseErrorLogMaxPerSecond     int                     `yaml:"parse_error_log_max_per_second"`
+	PercentileCarryForward        []CarryForwardRule      `yaml:"percentile_carry_forward"`
+	Percentiles                   []float64               `yaml:"percentiles"`
+	PercentilesAsSummaries        bool                    `yaml:"percentiles_as_summaries"`
+	PluginFlushConcurrency        int                     `yaml:"plugin_flush_concurrency"`
+	PrometheusRemoteWriteAddress  string                  `yaml:"prometheus_remote_write_address"`
+	ReadBufferSizeBytes           int                     `yaml:"read_buffer_size_bytes"`
+	ReloadOnSighup                bool                    `yaml:"reload_on_sighup"`
+	RollupInterval                string                  `yaml:"rollup_interval"`
+	RollupSink                    string                  `yaml:"rollup_sink"`
+	SentryDsn                     string                  `yaml:"sentry_dsn"`
+	SetPrecision                  int                     `yaml:"set_precision"`
+	ShutdownTimeout               string                  `yaml:"shutdown_timeout"`
+	SignalfxAPIKey                string                  `yaml:"signalfx_api_key"`
+	SignalfxEndpointBase          string                  `yaml:"signalfx_endpoint_base"`
+	SignalfxFlushMaxPerBody       int                     `yaml:"signalfx_flush_max_per_body"`
+	SmoothedRateCounters          []string                `yaml:"smoothed_rate_counters"`
+	SmoothedRateWindow            string                  `yaml:"smoothed_rate_window"`
+	SocketAddress                 string                  `yaml:"socket_address"`
+	SocketPermissions             string                  `yaml:"socket_permissions"`
+	SpanBufferBackend             string                  `yaml:"span_buffer_backend"`
+	SpanBufferMaxAge              string                  `yaml:"span_buffer_max_age"`
+	SpanBufferMaxSpans            int                     `yaml:"span_buffer_max_spans"`
+	SpanBufferPath                string                  `yaml:"span_buffer_path"`
+	SpanIdempotencyWindow         string                  `yaml:"span_idempotency_window"`
+	SpanTagRedactionPatterns      []string                `yaml:"span_tag_redaction_patterns"`
+	SsfMaxFrameLength             int                     `yaml:"ssf_max_frame_length"`
+	SsfTcpAddress                 string                  `yaml:"ssf_tcp_address"`
+	StatsdCompat                  bool                    `yaml:"statsd_compat"`
+	StatsAddress                  string                  `yaml:"stats_address"`
+	TagMaxLength                  int                     `yaml:"tag_max_length"`
+	TagSanitization               string                  `yaml:"tag_sanitization"`
+	TagSanitizationLowercase      bool                    `yaml:"tag_sanitization_lowercase"`
+	Tags                          []string                `yaml:"tags"`
+	TailSampleLatencyThreshold    string                  `yaml:"tail_sample_latency_threshold"`
+	TailSampleMaxSpans            int                     `yaml:"tail_sample_max_spans"`
+	TailSampleWindow              string                  `yaml:"tail_sample_window"`
+	TcpAddress                    string                  `yaml:"tcp_address"`
+	TcpReadTimeout                string                  `yaml:"tcp_read_timeout"`
+	TLSAuthorityCertificate       string                  `yaml:"tls_authority_certificate"`
+	TLSCertificate                string                  `yaml:"tls_certificate"`
+	TLSKey                        string                  `yaml:"tls_key"`
+	TooManyTagsAction             string                  `yaml:"too_many_tags_action"`
+	TopkCounters                  map[string]int          `yaml:"topk_counters"`
+	TraceAddress                  string                  `yaml:"trace_address"`
+	TraceAPIAddress               string                  `yaml:"trace_api_address"`
+	TraceDefaultService           string                  `yaml:"trace_default_service"`
+	TraceDropMissingService       bool                    `yaml:"trace_drop_missing_service"`
+	TraceKeepDurationRules        []TraceKeepDurationRule `yaml:"trace_keep_duration_rules"`
+	TraceKeepErrorsMissingService bool                    `yaml:"trace_keep_errors_missing_service"`
+	TraceMaxLengthBytes           int                     `yaml:"trace_max_length_bytes"`
+	TraceSampleAuditMaxPerSecond  int                     `yaml:"trace_sample_audit_max_per_second"`
+	TraceSampleKeepErrors         bool                    `yaml:"trace_sample_keep_errors"`
+	TraceSampleRate               *float64                `yaml:"trace_sample_rate"`
+	TraceSampleRules              []TraceSampleRule       `yaml:"trace_sample_rules"`
+	TraceServiceWhitelist         []string                `yaml:"trace_service_whitelist"`
+	TraceStdoutSink               string                  `yaml:"trace_stdout_sink"`
+	UdpAddress                    string                  `yaml:"udp_address"`
+	UdpAddresses                  []string                `yaml:"udp_addresses"`
+	UnitSuffixOverrides           map[string]string       `yaml:"unit_suffix_overrides"`
+	UnitSuffixes                  map[string]string       `yaml:"unit_suffixes"`
+	ValueTransforms               []ValueTransformRule    `yaml:"value_transforms"`
+	WebhookHeaders                map[string]string       `yaml:"webhook_headers"`
+	WebhookTemplate               string                  `yaml:"webhook_template"`
+	WebhookURL                    string                  `yaml:"webhook_url"`
+	WorkerBlockTimeout            string                  `yaml:"worker_block_timeout"`
+	WorkerChannelSize             int                     `yaml:"worker_channel_size"`
+	WorkerOverflowPolicy          string                  `yaml:"worker_overflow_policy"`
+	ZipkinAPIAddress              string                  `yaml:"zipkin_api_address"`
+}
+
+// MetricNameNormalization rewrites metric names at ingestion so that
+// equivalent names are aggregated as one series.
+type MetricNameNormalization struct {
+	CharacterMap map[string]string `yaml:"character_map"`
+	Lowercase    bool              `yaml:"lowercase"`
+}
+
+// OriginTagRule attaches trusted tags to the metrics received from a source:
+// an IP address or CIDR block, or "uid:<uid>" for the user sending to the
+// unixgram socket.
+type OriginTagRule struct {
+	Override bool     `yaml:"override"`
+	Source   string   `yaml:"source"`
+	Tags     []string `yaml:"tags"`
+}
+
+// CarryForwardRule carries forward the last good percentiles of a
+// histogram or timer through intervals where it received fewer than
+// MinSamples samples, for up to MaxIntervals intervals.
+type CarryForwardRule struct {
+	MaxIntervals int    `yaml:"max_intervals"`
+	MinSamples   int    `yaml:"min_samples"`
+	Name         string `yaml:"name"`
+}
+
+// ValueTransformRule transforms the value of the metric called Name as it's
+// flushed to Sink, or to every sink if Sink is empty. Operation is
+// "multiply" or "add", by Value, or "log" for the natural logarithm.
+type ValueTransformRule struct {
+	Name      string  `yaml:"name"`
+	Operation string  `yaml:"operation"`
+	Sink      string  `yaml:"sink"`
+	Value     float64 `yaml:"value"`
+}
+
+// TraceKeepDurationRule keeps every span that took at least MinDuration,
+// optionally only those of Service, regardless of the sample rate.
+type TraceKeepDurationRule struct {
+	MinDuration string `yaml:"min_duration"`
+	Service     string `yaml:"service"`
+}
+
+// TraceSampleRule sets the sample rate for spans with a particular tag value.
+type TraceSampleRule struct {
+	Rate  float64 `yaml:"rate"`
+	Tag   string  `yaml:"tag"`
+	Value string  `yaml:"value"`
 }
@@ -1,9 +1,13 @@
 package veneur
 
 import (
+	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
 	"gopkg.in/yaml.v2"
@@ -70,3 +74,103 @@ func readConfig(r io.Reader) (c Config, err error) {
 func (c Config) ParseInterval() (time.Duration, error) {
 	return time.ParseDuration(c.Interval)
 }
+
+// listenAddress is an address that Veneur binds, and the option that
+// configures it.
+type listenAddress struct {
+	option  string
+	network string
+	address string
+}
+
+// tracingEnabled reports whether any span sink is configured, since spans
+// are only accepted if they can be sent on.
+func (c Config) tracingEnabled() bool {
+	return c.TraceAPIAddress != "" || c.JaegerCollectorAddress != "" || c.ZipkinAPIAddress != "" ||
+		(c.KafkaBroker != "" && c.KafkaSpanTopic != "")
+}
+
+// checkListenAddresses returns an error naming any address that is
+// configured for more than one listener on the same network, which would
+// otherwise only fail when the second listener binds. Addresses on the same
+// port conflict if they have the same host, or if either binds every host.
+// The socket_address path conflicts with any file Veneur writes to the same
+// path.
+func (c Config) checkListenAddresses() error {
+	addrs := []listenAddress{
+		{"udp_address", "udp", c.UdpAddress},
+		{"tcp_address", "tcp", c.TcpAddress},
+		{"ssf_tcp_address", "tcp", c.SsfTcpAddress},
+		{"http_address", "tcp", c.HTTPAddress},
+	}
+	for _, addr := range c.UdpAddresses {
+		addrs = append(addrs, listenAddress{"udp_addresses", "udp", addr})
+	}
+	if c.tracingEnabled() {
+		// the trace listener is only started if traces can be sent on
+		addrs = append(addrs, listenAddress{"trace_address", "udp", c.TraceAddress})
+	}
+	if addr, err := parseSocketAddress(c.SocketAddress); err == nil {
+		// the socket file can't share a path with a file Veneur writes,
+		// which would either stop it binding or be renamed over it
+		addrs = append(addrs,
+			listenAddress{"socket_address", "unix", addr.Name},
+			listenAddress{"span_buffer_path", "unix", c.SpanBufferPath},
+			listenAddress{"flush_file", "unix", c.FlushFile},
+			listenAddress{"debug_flush_file", "unix", c.DebugFlushFile},
+			listenAddress{"flush_audit_log", "unix", c.FlushAuditLog},
+		)
+	}
+
+	for i, a := range addrs {
+		if a.network == "unix" {
+			if a.option == "socket_address" {
+				if err := checkSocketPath(a, addrs[i+1:]); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		aHost, aPort, err := net.SplitHostPort(a.address)
+		if err != nil || aPort == "0" {
+			// unset, ephemeral or not a host:port, eg einhorn@0
+			continue
+		}
+		for _, b := range addrs[i+1:] {
+			if b.network != a.network {
+				continue
+			}
+			bHost, bPort, err := net.SplitHostPort(b.address)
+			if err != nil || bPort != aPort {
+				continue
+			}
+			if aHost == bHost || isWildcardHost(aHost) || isWildcardHost(bHost) {
+				return fmt.Errorf("%s %q and %s %q are the same %s address; each listener needs its own", a.option, a.address, b.option, b.address, strings.ToUpper(a.network))
+			}
+		}
+	}
+	return nil
+}
+
+// checkSocketPath returns an error if any of others is the same path as the
+// unix socket address a.
+func checkSocketPath(a listenAddress, others []listenAddress) error {
+	if a.address == "" {
+		return nil
+	}
+	for _, b := range others {
+		if b.network == a.network && b.address != "" && filepath.Clean(a.address) == filepath.Clean(b.address) {
+			return fmt.Errorf("%s %q and %s %q are the same path; each needs its own", a.option, a.address, b.option, b.address)
+		}
+	}
+	return nil
+}
+
+// isWildcardHost reports whether binding host listens on every interface.
+func isWildcardHost(host string) bool {
+	if host == "" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsUnspecified()
+}
@@ -30,6 +30,48 @@ func TestReadConfig(t *testing.T) {
 
 }
 
+func TestDuplicateListenAddresses(t *testing.T) {
+	config := globalConfig()
+	config.TcpAddress = "127.0.0.1:8200"
+	config.SsfTcpAddress = "127.0.0.1:8200"
+	_, err := NewFromConfig(config)
+	if assert.Error(t, err) {
+		assert.Equal(t, `tcp_address "127.0.0.1:8200" and ssf_tcp_address "127.0.0.1:8200" are the same TCP address; each listener needs its own`, err.Error())
+	}
+
+	config = globalConfig()
+	config.UdpAddress = "0.0.0.0:8201"
+	config.TraceAPIAddress = "http://localhost:7777"
+	config.TraceAddress = "127.0.0.1:8201"
+	_, err = NewFromConfig(config)
+	assert.Error(t, err, "a wildcard address should conflict with any host on the same port")
+
+	config = globalConfig()
+	config.UdpAddress = "127.0.0.1:8203"
+	config.UdpAddresses = []string{"127.0.0.1:8204", "127.0.0.1:8203"}
+	assert.Error(t, config.checkListenAddresses(), "udp_addresses should not repeat the udp_address")
+
+	config.UdpAddresses = []string{"127.0.0.1:8204"}
+	server, err := NewFromConfig(config)
+	if assert.NoError(t, err) && assert.Len(t, server.UDPAddrs, 2) {
+		assert.Equal(t, "127.0.0.1:8203", server.UDPAddr.String(), "UDPAddr should still be the udp_address")
+		assert.Equal(t, server.UDPAddr, server.UDPAddrs[0])
+	}
+
+	config = globalConfig()
+	config.UdpAddress = "127.0.0.1:8202"
+	config.TcpAddress = "127.0.0.1:8202"
+	assert.NoError(t, config.checkListenAddresses(), "UDP and TCP can share a port")
+
+	config = globalConfig()
+	config.SocketAddress = "unixgram:///tmp/veneur.sock"
+	config.SpanBufferPath = "/tmp/../tmp/veneur.sock"
+	_, err = NewFromConfig(config)
+	if assert.Error(t, err) {
+		assert.Equal(t, `socket_address "/tmp/veneur.sock" and span_buffer_path "/tmp/../tmp/veneur.sock" are the same path; each needs its own`, err.Error())
+	}
+}
+
 func TestReadBadConfig(t *testing.T) {
 	const exampleConfig = `--- api_hostname: :bad`
 	r := strings.NewReader(exampleConfig)
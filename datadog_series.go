@@ -0,0 +1,81 @@
+package veneur
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/stripe/veneur/samplers"
+)
+
+// Versions of the Datadog series payload format, for datadog_api_version.
+const (
+	datadogAPIVersion1 = "v1"
+	datadogAPIVersion2 = "v2"
+)
+
+// datadogSeriesV2 is a metric in the v2 series payload format.
+type datadogSeriesV2 struct {
+	Metric    string              `json:"metric"`
+	Type      int                 `json:"type"`
+	Interval  int32               `json:"interval,omitempty"`
+	Points    []datadogPointV2    `json:"points"`
+	Tags      []string            `json:"tags,omitempty"`
+	Resources []datadogResourceV2 `json:"resources,omitempty"`
+}
+
+type datadogPointV2 struct {
+	Timestamp int64   `json:"timestamp"`
+	Value     float64 `json:"value"`
+}
+
+type datadogResourceV2 struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+// datadogMetricTypesV2 maps DDMetric types to the v2 format's enum. Other
+// types are sent as 0, unspecified.
+var datadogMetricTypesV2 = map[string]int{
+	"count": 1,
+	"rate":  2,
+	"gauge": 3,
+}
+
+// seriesV2 converts metrics to the v2 series format. The v2 format has no
+// device field, so the device is sent as a "device" tag.
+func seriesV2(metrics []samplers.DDMetric) []datadogSeriesV2 {
+	series := make([]datadogSeriesV2, len(metrics))
+	for i, m := range metrics {
+		series[i] = datadogSeriesV2{
+			Metric:   m.Name,
+			Type:     datadogMetricTypesV2[m.MetricType],
+			Interval: m.Interval,
+			Points: []datadogPointV2{{
+				Timestamp: int64(m.Value[0][0]),
+				Value:     m.Value[0][1],
+			}},
+			Tags: m.Tags,
+		}
+		if m.DeviceName != "" {
+			series[i].Tags = append(series[i].Tags[:len(series[i].Tags):len(series[i].Tags)], "device:"+m.DeviceName)
+		}
+		if m.Hostname != "" {
+			series[i].Resources = []datadogResourceV2{{Name: m.Hostname, Type: "host"}}
+		}
+	}
+	return series
+}
+
+// marshalSeriesV2 renders metrics as a v2 {"series": [...]} body, splitting
+// the work across up to parallelism goroutines like marshalSeries.
+func marshalSeriesV2(metrics []samplers.DDMetric, parallelism int) (json.RawMessage, error) {
+	series := seriesV2(metrics)
+	if len(series) == 0 || parallelism < 2 {
+		var buf bytes.Buffer
+		err := json.NewEncoder(&buf).Encode(map[string][]datadogSeriesV2{"series": series})
+		return buf.Bytes(), err
+	}
+	return marshalSeriesChunks(len(series), parallelism, func(start, end int) ([]byte, error) {
+		return json.Marshal(series[start:end])
+	})
+}
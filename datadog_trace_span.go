@@ -16,3 +16,26 @@ type DatadogTraceSpan struct {
 	TraceID  int64              `json:"trace_id"`
 	Type     string             `json:"type"`
 }
+
+// spanEventsMetaKey is the meta key under which Datadog takes the
+// events logged within a span, as JSON.
+const spanEventsMetaKey = "events"
+
+// datadogSpanEvent represents an event logged within a span, as
+// JSON in the span's events meta.
+type datadogSpanEvent struct {
+	Name         string            `json:"name"`
+	TimeUnixNano int64             `json:"time_unix_nano"`
+	Attributes   map[string]string `json:"attributes,omitempty"`
+}
+
+// datadogMetaKeys maps the names of span tags that Datadog knows by other
+// names, like the error message set by trace.Error, to Datadog's, so that
+// it renders them.
+var datadogMetaKeys = map[string]string{
+	"error.msg": "error.message",
+}
+
+// datadogSamplingPriorityKey is the metric under which Datadog takes a
+// trace's sampling priority, on its root span.
+const datadogSamplingPriorityKey = "_sampling_priority_v1"
@@ -0,0 +1,25 @@
+package veneur
+
+import (
+	"context"
+
+	"github.com/stripe/veneur/ssf"
+	"github.com/stripe/veneur/trace"
+)
+
+// defaultDebugFileMaxBytes is the size at which debug_flush_file is rotated
+// when debug_flush_file_max_bytes is not set.
+const defaultDebugFileMaxBytes = 100 << 20
+
+// flushSpansDebugFile writes each span to debug_flush_file as a line of
+// JSON, converted as for Datadog.
+func (s *Server) flushSpansDebugFile(ctx context.Context, samples []ssf.SSFSample) error {
+	span, _ := trace.StartSpanFromContext(ctx, "flush", trace.NameTag("veneur.opentracing.flush.flushSpansDebugFile"))
+	defer span.Finish()
+
+	spans := make([]interface{}, len(samples))
+	for i, sample := range samples {
+		spans[i] = s.datadogTraceSpan(sample)
+	}
+	return s.debugFile.WriteJSON(spans)
+}
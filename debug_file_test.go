@@ -0,0 +1,34 @@
+package veneur
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	localfilep "github.com/stripe/veneur/plugins/localfile"
+	"github.com/stripe/veneur/ssf"
+)
+
+func TestDebugFileSpans(t *testing.T) {
+	dir, err := ioutil.TempDir("", "veneur-debug-file")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "flushes.json")
+
+	s := &Server{debugFile: &localfilep.Plugin{FilePath: path, JSON: true}}
+	sample := ssf.SSFSample{
+		Name:      "veneur.trace.test",
+		Service:   "veneur",
+		Timestamp: 1476119058000000000,
+		Trace:     &ssf.SSFTrace{TraceId: 1, Id: 2, Duration: 1000},
+		Tags:      []*ssf.SSFTag{{Name: "route", Value: "/cart"}},
+	}
+	assert.NoError(t, s.flushSpansDebugFile(context.Background(), []ssf.SSFSample{sample}))
+
+	contents, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"duration":1000,"error":0,"meta":{"route":"/cart"},"metrics":null,"name":"veneur.trace.test","service":"veneur","span_id":2,"start":1476119058000000000,"trace_id":1,"type":"http"}`+"\n", string(contents))
+}
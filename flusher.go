@@ -2,20 +2,28 @@ package veneur
 
 import (
 	"bytes"
+	"compress/gzip"
 	"compress/zlib"
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
+	"math/rand"
 	"net"
 	"net/http"
 	"net/url"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/DataDog/datadog-go/statsd"
 	"github.com/Sirupsen/logrus"
+	"github.com/stripe/veneur/plugins"
 	"github.com/stripe/veneur/samplers"
 	"github.com/stripe/veneur/ssf"
 	"github.com/stripe/veneur/trace"
@@ -42,12 +50,17 @@ func (s *Server) FlushGlobal(ctx context.Context) {
 	span, _ := trace.StartSpanFromContext(ctx, "flush", trace.NameTag("veneur.opentracing.flush.FlushGlobal"))
 	defer span.Finish()
 
-	go s.flushEventsChecks()           // we can do all of this separately
-	go s.flushTraces(span.Attach(ctx)) // this too!
+	// we can do all of this separately
+	s.goFlush("events_checks", s.flushEventsChecks)
+	tracesCtx := span.Attach(ctx)
+	s.goFlush("traces", func() { s.flushTraces(tracesCtx) })
 
-	percentiles := s.HistogramPercentiles
+	percentiles := s.HistogramPercentiles()
 
 	tempMetrics, ms := s.tallyMetrics(percentiles)
+	if s.enableAggregationBytesEstimate {
+		s.reportAggregationBytes(tempMetrics)
+	}
 
 	// the global veneur instance is also responsible for reporting the sets
 	// and global counters
@@ -55,25 +68,61 @@ func (s *Server) FlushGlobal(ctx context.Context) {
 	ms.totalLength += ms.totalGlobalCounters
 
 	finalMetrics := s.generateDDMetrics(span.Attach(ctx), percentiles, tempMetrics, ms)
+	distributions := s.generateDistributions(tempMetrics)
+	s.goFlush("distributions", func() { s.flushDistributions(distributions) })
+	if s.rollup != nil {
+		s.flushRollup(tempMetrics, 1+ms.skippedIntervals)
+	}
 
 	s.reportMetricsFlushCounts(ms)
 
 	s.reportGlobalMetricsFlushCounts(ms)
 
+	done := s.sinkFlushStarted()
+	s.goFlush("plugins", func() {
+		defer done()
+		if err := s.flushPlugins(finalMetrics, distributions); err != nil {
+			log.WithError(err).Warn("Could not flush to some plugins")
+		}
+	})
+
+	s.flushRemote(finalMetrics)
+}
+
+// flushOrSkip starts a flush in the background, unless the previous one
+// (including its plugin flushes) is still running. In that case the interval
+// is skipped: the workers keep their data, so it is merged into the next
+// flush instead of being dropped or stacking up another flush. It reports
+// whether a flush was started.
+func (s *Server) flushOrSkip() bool {
+	if !atomic.CompareAndSwapInt32(&s.flushing, 0, 1) {
+		log.Warn("Previous flush is still running, merging this interval into the next flush")
+		s.Statsd.Count("flush.skipped_total", 1, nil, 1.0)
+		atomic.AddInt32(&s.skippedIntervals, 1)
+		return false
+	}
 	go func() {
-		for _, p := range s.getPlugins() {
-			start := time.Now()
-			err := p.Flush(finalMetrics, s.Hostname)
-			s.Statsd.TimeInMilliseconds(fmt.Sprintf("flush.plugins.%s.total_duration_ns", p.Name()), float64(time.Since(start).Nanoseconds()), []string{"part:post"}, 1.0)
-			if err != nil {
-				countName := fmt.Sprintf("flush.plugins.%s.error_total", p.Name())
-				s.Statsd.Count(countName, 1, []string{}, 1.0)
-			}
-			s.Statsd.Gauge(fmt.Sprintf("flush.plugins.%s.post_metrics_total", p.Name()), float64(len(finalMetrics)), nil, 1.0)
+		defer atomic.StoreInt32(&s.flushing, 0)
+		defer func() {
+			ConsumePanic(s.Sentry, s.Statsd, s.Hostname, recover())
+		}()
+		s.Flush()
+		if s.sinkFlushes != nil {
+			s.sinkFlushes.Wait()
 		}
 	}()
+	return true
+}
 
-	s.flushRemote(finalMetrics)
+// sinkFlushStarted records a plugin flush that outlives the call to Flush, so
+// that flushOrSkip can wait for it. The returned function must be called when
+// it completes.
+func (s *Server) sinkFlushStarted() func() {
+	if s.sinkFlushes == nil {
+		return func() {}
+	}
+	s.sinkFlushes.Add(1)
+	return s.sinkFlushes.Done
 }
 
 // FlushLocal takes the slices of metrics, combines then and marshals them to json
@@ -82,37 +131,48 @@ func (s *Server) FlushLocal(ctx context.Context) {
 	span, _ := trace.StartSpanFromContext(ctx, "flush", trace.NameTag("veneur.opentracing.flush.FlushLocal"))
 	defer span.Finish()
 
-	go s.flushEventsChecks()           // we can do all of this separately
-	go s.flushTraces(span.Attach(ctx)) // this too!
+	// we can do all of this separately
+	s.goFlush("events_checks", s.flushEventsChecks)
+	tracesCtx := span.Attach(ctx)
+	s.goFlush("traces", func() { s.flushTraces(tracesCtx) })
 
 	// don't publish percentiles if we're a local veneur; that's the global
 	// veneur's job
 	var percentiles []float64
 
 	tempMetrics, ms := s.tallyMetrics(percentiles)
+	if s.enableAggregationBytesEstimate {
+		s.reportAggregationBytes(tempMetrics)
+	}
+
+	if s.forwardMinSamples > 0 {
+		s.withholdSparseHistograms(tempMetrics, &ms)
+	}
 
 	finalMetrics := s.generateDDMetrics(span.Attach(ctx), percentiles, tempMetrics, ms)
+	distributions := s.generateDistributions(tempMetrics)
 
 	s.reportMetricsFlushCounts(ms)
 
 	// we don't report totalHistograms, totalSets, or totalTimers for local veneur instances
 
+	s.goFlush("distributions", func() { s.flushDistributions(distributions) })
+
+	if s.rollup != nil {
+		s.flushRollup(tempMetrics, 1+ms.skippedIntervals)
+	}
+
 	// we cannot do this until we're done using tempMetrics within this function,
 	// since not everything in tempMetrics is safe for sharing
-	go s.flushForward(tempMetrics)
+	s.goFlush("forward", func() { s.flushForward(context.TODO(), tempMetrics) })
 
-	go func() {
-		for _, p := range s.getPlugins() {
-			start := time.Now()
-			err := p.Flush(finalMetrics, s.Hostname)
-			s.Statsd.TimeInMilliseconds(fmt.Sprintf("flush.plugins.%s.total_duration_ns", p.Name()), float64(time.Since(start).Nanoseconds()), []string{"part:post"}, 1.0)
-			if err != nil {
-				countName := fmt.Sprintf("flush.plugins.%s.error_total", p.Name())
-				s.Statsd.Count(countName, 1, []string{}, 1.0)
-			}
-			s.Statsd.Gauge(fmt.Sprintf("flush.plugins.%s.post_metrics_total", p.Name()), float64(len(finalMetrics)), nil, 1.0)
+	done := s.sinkFlushStarted()
+	s.goFlush("plugins", func() {
+		defer done()
+		if err := s.flushPlugins(finalMetrics, distributions); err != nil {
+			log.WithError(err).Warn("Could not flush to some plugins")
 		}
-	}()
+	})
 
 	s.flushRemote(finalMetrics)
 }
@@ -126,11 +186,17 @@ type metricsSummary struct {
 
 	totalGlobalCounters int
 
+	totalDistributions int
+
 	totalLocalHistograms int
 	totalLocalSets       int
 	totalLocalTimers     int
 
 	totalLength int
+
+	// the number of intervals whose data was merged into this flush because
+	// their own flushes were skipped; see flush_merge_on_skip
+	skippedIntervals int
 }
 
 // tallyMetrics gives a slight overestimate of the number
@@ -143,12 +209,20 @@ func (s *Server) tallyMetrics(percentiles []float64) ([]WorkerMetrics, metricsSu
 	tempMetrics := make([]WorkerMetrics, 0, len(s.Workers))
 
 	gatherStart := time.Now()
-	ms := metricsSummary{}
+	ms := metricsSummary{
+		skippedIntervals: int(atomic.SwapInt32(&s.skippedIntervals, 0)),
+	}
 
+	// each worker limits the names it aggregates, so their drops are merged
+	// to report them
+	tagSetsDropped := map[string]int64{}
 	for i, w := range s.Workers {
 		log.WithField("worker", i).Debug("Flushing")
 		wm := w.Flush()
 		tempMetrics = append(tempMetrics, wm)
+		for name, count := range wm.tagSetsDropped {
+			tagSetsDropped[name] += count
+		}
 
 		ms.totalCounters += len(wm.counters)
 		ms.totalGauges += len(wm.gauges)
@@ -158,11 +232,22 @@ func (s *Server) tallyMetrics(percentiles []float64) ([]WorkerMetrics, metricsSu
 
 		ms.totalGlobalCounters += len(wm.globalCounters)
 
+		ms.totalDistributions += len(wm.distributions)
+
 		ms.totalLocalHistograms += len(wm.localHistograms)
 		ms.totalLocalSets += len(wm.localSets)
 		ms.totalLocalTimers += len(wm.localTimers)
 	}
 
+	s.reportCardinalityDrops(tagSetsDropped)
+	if dropped := s.ingestLimiter.Dropped(); dropped > 0 {
+		s.Statsd.Count("packet.dropped_total", dropped, []string{"reason:rate_limited"}, 1.0)
+		log.WithFields(logrus.Fields{
+			"dropped": dropped,
+			"limit":   s.ingestLimiter.perSecond,
+		}).Warn("Dropped packets over max_packets_per_second")
+	}
+
 	s.Statsd.TimeInMilliseconds("flush.total_duration_ns", float64(time.Since(gatherStart).Nanoseconds()), []string{"part:gather"}, 1.0)
 
 	ms.totalLength = ms.totalCounters + ms.totalGauges +
@@ -173,11 +258,130 @@ func (s *Server) tallyMetrics(percentiles []float64) ([]WorkerMetrics, metricsSu
 		// use the original percentile list here.
 		// remember that both the global veneur and the local instances have
 		// 'local-only' histograms.
-		ms.totalLocalSets + (ms.totalLocalTimers+ms.totalLocalHistograms)*(s.HistogramAggregates.Count+len(s.HistogramPercentiles))
+		ms.totalLocalSets + (ms.totalLocalTimers+ms.totalLocalHistograms)*(s.HistogramAggregates.Count+len(s.HistogramPercentiles()))
 
 	return tempMetrics, ms
 }
 
+// reportCardinalityDrops reports the samples dropped by
+// max_tag_sets_per_metric as a single count. The names of the metrics they
+// belonged to are only logged, since tagging the count with them would let
+// the metrics that are over the limit inflate Veneur's own cardinality.
+func (s *Server) reportCardinalityDrops(dropped map[string]int64) {
+	if len(dropped) == 0 {
+		return
+	}
+	var total int64
+	for name, count := range dropped {
+		total += count
+		log.WithFields(logrus.Fields{
+			"metric":  name,
+			"dropped": count,
+			"limit":   s.maxTagSetsPerMetric,
+		}).Warn("Dropped samples over max_tag_sets_per_metric")
+	}
+	s.Statsd.Count("metric.tag_sets_dropped", total, nil, 1.0)
+}
+
+// withholdSparseHistograms moves histograms and timers that received fewer
+// than forwardMinSamples (weighted) samples into the local-only maps, so that
+// they are flushed in their entirety by this instance instead of being
+// forwarded. This trades some global accuracy for less forwarding traffic.
+func (s *Server) withholdSparseHistograms(wms []WorkerMetrics, ms *metricsSummary) {
+	threshold := float64(s.forwardMinSamples)
+	withheld := 0
+	for _, wm := range wms {
+		for key, h := range wm.histograms {
+			// don't clobber a local-only histogram that happens to share the key
+			if _, ok := wm.localHistograms[key]; !ok && h.LocalWeight < threshold {
+				wm.localHistograms[key] = h
+				delete(wm.histograms, key)
+				ms.totalHistograms--
+				ms.totalLocalHistograms++
+				withheld++
+			}
+		}
+		for key, t := range wm.timers {
+			if _, ok := wm.localTimers[key]; !ok && t.LocalWeight < threshold {
+				wm.localTimers[key] = t
+				delete(wm.timers, key)
+				ms.totalTimers--
+				ms.totalLocalTimers++
+				withheld++
+			}
+		}
+	}
+	// withheld samplers are flushed with percentiles, so account for the
+	// extra points
+	ms.totalLength += withheld * len(s.HistogramPercentiles())
+	s.Statsd.Count("forward.withheld_total", int64(withheld), nil, 1.0)
+}
+
+// perSeriesOverheadBytes approximates the fixed cost of one series in a
+// worker's maps: the map entry, its MetricKey and the sampler struct.
+const perSeriesOverheadBytes = 200
+
+// seriesBytes estimates the memory used by a series' name and tags.
+func seriesBytes(name string, tags []string) int64 {
+	size := int64(perSeriesOverheadBytes + 2*len(name))
+	for _, tag := range tags {
+		// once in the sampler, once in the key's joined tags
+		size += int64(2*len(tag) + 16)
+	}
+	return size
+}
+
+// estimateAggregationBytes approximates the memory held by each type of
+// sampler across the workers' maps. It is not exact, but it tracks the
+// growth in series and in digest sizes.
+func estimateAggregationBytes(wms []WorkerMetrics) map[string]int64 {
+	estimates := map[string]int64{}
+	for _, wm := range wms {
+		for _, c := range wm.counters {
+			estimates["counter"] += seriesBytes(c.Name, c.Tags)
+		}
+		for _, c := range wm.globalCounters {
+			estimates["counter"] += seriesBytes(c.Name, c.Tags)
+		}
+		for _, g := range wm.gauges {
+			estimates["gauge"] += seriesBytes(g.Name, g.Tags)
+		}
+		for _, hs := range []map[samplers.MetricKey]*samplers.Histo{wm.histograms, wm.localHistograms} {
+			for _, h := range hs {
+				estimates["histogram"] += seriesBytes(h.Name, h.Tags) + int64(h.Value.SizeBytes())
+			}
+		}
+		for _, ts := range []map[samplers.MetricKey]*samplers.Histo{wm.timers, wm.localTimers} {
+			for _, t := range ts {
+				estimates["timer"] += seriesBytes(t.Name, t.Tags) + int64(t.Value.SizeBytes())
+			}
+		}
+		for _, ss := range []map[samplers.MetricKey]*samplers.Set{wm.sets, wm.localSets} {
+			for _, set := range ss {
+				// sparse HLLs use about 4 bytes per element, up to the size of
+				// the dense representation
+				hll := 4 * int64(set.Hll.Count())
+				if dense := set.DenseBytes(); hll > dense {
+					hll = dense
+				}
+				estimates["set"] += seriesBytes(set.Name, set.Tags) + hll
+			}
+		}
+		for _, d := range wm.distributions {
+			estimates["distribution"] += seriesBytes(d.Name, d.Tags) + 8*int64(cap(d.Values)+cap(d.Weights))
+		}
+	}
+	return estimates
+}
+
+// reportAggregationBytes emits the estimated memory held by the aggregation
+// state that was just flushed, by metric type.
+func (s *Server) reportAggregationBytes(wms []WorkerMetrics) {
+	for metricType, estimate := range estimateAggregationBytes(wms) {
+		s.Statsd.Gauge("aggregation.bytes_estimate", float64(estimate), []string{"metric_type:" + metricType}, 1.0)
+	}
+}
+
 // generateDDMetrics calls the Flush method on each
 // counter/gauge/histogram/timer/set in order to
 // generate a DDMetric corresponding to that value
@@ -186,21 +390,33 @@ func (s *Server) generateDDMetrics(ctx context.Context, percentiles []float64, t
 	span, _ := trace.StartSpanFromContext(ctx, "flush", trace.NameTag("veneur.opentracing.flush.generateDDMetrics"))
 	defer span.Finish()
 
+	// rates and intervals must reflect the time the data actually covers,
+	// which is longer than one interval if flushes were skipped
+	interval := s.flushInterval() * time.Duration(1+ms.skippedIntervals)
+
 	finalMetrics := make([]samplers.DDMetric, 0, ms.totalLength)
 	for _, wm := range tempMetrics {
 		for _, c := range wm.counters {
-			finalMetrics = append(finalMetrics, c.Flush(s.interval)...)
+			finalMetrics = append(finalMetrics, s.flushCounter(c, interval)...)
+		}
+		for _, tk := range wm.topKCounters {
+			finalMetrics = append(finalMetrics, s.suffixUnit("c", tk.Name, tk.Flush(interval))...)
 		}
 		for _, g := range wm.gauges {
-			finalMetrics = append(finalMetrics, g.Flush()...)
+			finalMetrics = append(finalMetrics, s.suffixUnit("g", g.Name, g.Flush())...)
 		}
 		// if we're a local veneur, then percentiles=nil, and only the local
 		// parts (count, min, max) will be flushed
 		for _, h := range wm.histograms {
-			finalMetrics = append(finalMetrics, h.Flush(s.interval, percentiles, s.HistogramAggregates)...)
+			hp := percentiles
+			if !s.IsLocal() && s.flushAsDistribution(h.Name) {
+				// the distribution intake computes the percentiles instead
+				hp = nil
+			}
+			finalMetrics = append(finalMetrics, s.flushHistogram("h", h, interval, hp)...)
 		}
 		for _, t := range wm.timers {
-			finalMetrics = append(finalMetrics, t.Flush(s.interval, percentiles, s.HistogramAggregates)...)
+			finalMetrics = append(finalMetrics, s.flushHistogram("ms", t, interval, percentiles)...)
 		}
 
 		// local-only samplers should be flushed in their entirety, since they
@@ -208,13 +424,17 @@ func (s *Server) generateDDMetrics(ctx context.Context, percentiles []float64, t
 		// we still want percentiles for these, even if we're a local veneur, so
 		// we use the original percentile list when flushing them
 		for _, h := range wm.localHistograms {
-			finalMetrics = append(finalMetrics, h.Flush(s.interval, s.HistogramPercentiles, s.HistogramAggregates)...)
+			hp := s.HistogramPercentiles()
+			if s.flushAsDistribution(h.Name) {
+				hp = nil
+			}
+			finalMetrics = append(finalMetrics, s.flushHistogram("h", h, interval, hp)...)
 		}
-		for _, s := range wm.localSets {
-			finalMetrics = append(finalMetrics, s.Flush()...)
+		for _, set := range wm.localSets {
+			finalMetrics = append(finalMetrics, s.suffixUnit("s", set.Name, set.Flush())...)
 		}
 		for _, t := range wm.localTimers {
-			finalMetrics = append(finalMetrics, t.Flush(s.interval, s.HistogramPercentiles, s.HistogramAggregates)...)
+			finalMetrics = append(finalMetrics, s.flushHistogram("ms", t, interval, s.HistogramPercentiles())...)
 		}
 
 		// TODO (aditya) refactor this out so we don't
@@ -222,25 +442,418 @@ func (s *Server) generateDDMetrics(ctx context.Context, percentiles []float64, t
 		if !s.IsLocal() {
 			// sets have no local parts, so if we're a local veneur, there's
 			// nothing to flush at all
-			for _, s := range wm.sets {
-				finalMetrics = append(finalMetrics, s.Flush()...)
+			for _, set := range wm.sets {
+				finalMetrics = append(finalMetrics, s.suffixUnit("s", set.Name, set.Flush())...)
 			}
 
 			// also do this for global counters
 			// global counters have no local parts, so if we're a local veneur,
 			// there's nothing to flush
 			for _, gc := range wm.globalCounters {
-				finalMetrics = append(finalMetrics, gc.Flush(s.interval)...)
+				finalMetrics = append(finalMetrics, s.flushCounter(gc, interval)...)
 			}
 		}
 	}
 
-	finalizeMetrics(s.Hostname, s.Tags, finalMetrics)
+	if s.rateSmoother != nil {
+		for _, m := range s.rateSmoother.Flush(interval) {
+			name := strings.TrimSuffix(m.Name, smoothedRateSuffix)
+			finalMetrics = append(finalMetrics, s.suffixUnit("c", name, []samplers.DDMetric{m})...)
+		}
+	}
+
+	if s.percentileCarrier != nil {
+		s.percentileCarrier.Expire()
+	}
+
+	// before finalizing, so that the magic tags are clean too
+	s.tagSanitizer.SanitizeTags(finalMetrics)
+	finalizeMetrics(s.Hostname, s.Tags(), s.metadataTags, s.metricPrefix, finalMetrics)
+	finalMetrics = s.checkSinks(finalMetrics)
 	s.Statsd.TimeInMilliseconds("flush.total_duration_ns", float64(time.Since(span.Start).Nanoseconds()), []string{"part:combine"}, 1.0)
 
 	return finalMetrics
 }
 
+// flushCounter flushes the rate of c over interval, followed by its raw count
+// if emit_counter_counts is set.
+func (s *Server) flushCounter(c *samplers.Counter, interval time.Duration) []samplers.DDMetric {
+	metrics := c.Flush(interval)
+	if s.rateSmoother != nil && s.rateSmoother.Smooths(c.Name) {
+		s.rateSmoother.Record(c.Name, c.Tags, metrics[0].Value[0][1]*interval.Seconds())
+	}
+	if s.emitCounterCounts {
+		metrics = append(metrics, c.FlushCount(interval))
+	}
+	return s.suffixUnit("c", c.Name, metrics)
+}
+
+// flushHistogram flushes a histogram or timer with percentiles. If its
+// percentiles are carried forward, they are replaced with the last good ones
+// when it received too few samples.
+func (s *Server) flushHistogram(statsdType string, h *samplers.Histo, interval time.Duration, percentiles []float64) []samplers.DDMetric {
+	if len(percentiles) > 0 && s.percentileCarrier.Carries(h.Name) {
+		return s.suffixUnit(statsdType, h.Name, s.percentileCarrier.Flush(h, interval, percentiles, s.HistogramAggregates))
+	}
+	return s.suffixUnit(statsdType, h.Name, h.Flush(interval, percentiles, s.HistogramAggregates))
+}
+
+// flushAsDistribution reports whether the histogram with this name should be
+// sent to the Datadog distribution intake instead of being flushed with
+// percentiles.
+func (s *Server) flushAsDistribution(name string) bool {
+	if s.allHistogramsAsDistributions {
+		return true
+	}
+	_, ok := s.histogramsAsDistributions[name]
+	return ok
+}
+
+// generateDistributions collects the distributions, and the histograms that
+// should be sent to the Datadog distribution intake. Like percentiles, these
+// histograms are only generated for forwarded histograms by the global
+// veneur, but for local-only histograms by every veneur. Distributions are
+// never forwarded, so every veneur sends them.
+func (s *Server) generateDistributions(tempMetrics []WorkerMetrics) []samplers.DDDistribution {
+	histogramsAsDistributions := s.allHistogramsAsDistributions || len(s.histogramsAsDistributions) > 0
+
+	var distributions []samplers.DDDistribution
+	for _, wm := range tempMetrics {
+		for _, d := range wm.distributions {
+			distributions = append(distributions, d.Flush())
+		}
+		if !histogramsAsDistributions {
+			continue
+		}
+		if !s.IsLocal() {
+			for _, h := range wm.histograms {
+				if s.flushAsDistribution(h.Name) {
+					distributions = append(distributions, h.FlushDistribution())
+				}
+			}
+		}
+		for _, h := range wm.localHistograms {
+			if s.flushAsDistribution(h.Name) {
+				distributions = append(distributions, h.FlushDistribution())
+			}
+		}
+	}
+
+	// before extracting the sink tags, so that they are clean too
+	s.tagSanitizer.SanitizeDistributionTags(distributions)
+	for i := range distributions {
+		extractDistributionSinks(&distributions[i])
+		distributions[i].Name = prefixName(s.metricPrefix, distributions[i].Name)
+		distributions[i].Hostname = s.Hostname
+		distributions[i].Tags = append(distributions[i].Tags, s.Tags()...)
+	}
+	return s.checkDistributionSinks(distributions)
+}
+
+// ddEncoding returns the Content-Encoding for a POST of series, distributions
+// or spans to Datadog: gzip if datadog_flush_compress is set, or else the
+// endpoint's usual encoding. Events and service checks are small, and their
+// endpoints aren't documented to accept gzip, so they don't use it.
+func (s *Server) ddEncoding(usual string) string {
+	if s.ddFlushCompress {
+		return encodingGzip
+	}
+	return usual
+}
+
+// ddRetryContext returns the context for a POST to Datadog, which is retried
+// up to flush_max_retries times. Retries are given one interval to succeed,
+// so that they don't run into the next flush.
+func (s *Server) ddRetryContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	interval := s.flushInterval()
+	if s.flushMaxRetries == 0 || interval <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, interval)
+}
+
+// flushDistributions POSTs distributions to the Datadog distribution intake.
+func (s *Server) flushDistributions(distributions []samplers.DDDistribution) {
+	distributions = distributionsForSink(distributions, datadogSinkName)
+	s.Statsd.Gauge("flush.post_distributions_total", float64(len(distributions)), nil, 1.0)
+	if len(distributions) == 0 {
+		return
+	}
+	body, err := json.Marshal(map[string][]samplers.DDDistribution{
+		"series": distributions,
+	})
+	if err != nil {
+		s.Statsd.Count("flush_distributions.error_total", 1, []string{"cause:json"}, 1.0)
+		log.WithError(err).Error("Could not render JSON")
+		s.auditLog.Record(auditRecord{Sink: datadogSinkName, Distributions: len(distributions)}, err)
+		return
+	}
+	// a refused POST is a failure in the audit log, so don't use postHelper,
+	// which doesn't return it
+	err = postHelperWithRetries(context.TODO(), s.HTTPClient, s.Statsd, fmt.Sprintf("%s/api/v1/distribution_points?api_key=%s", s.ddDistributionAddress, s.DDAPIKey), nil, json.RawMessage(body), "flush_distributions", s.ddEncoding(encodingDeflate), 0)
+	s.auditLog.Record(auditRecord{Sink: datadogSinkName, Distributions: len(distributions), Bytes: len(body)}, err)
+}
+
+// flushPlugins passes the flushed metrics and distributions to every plugin,
+// except for metrics routed to other sinks by sink tags, and with the values
+// of metrics transformed by value_transforms. The rollup sink only receives
+// rollups, so it is skipped.
+// If percentiles_as_summaries is set, plugins that support summaries get the
+// percentiles of each histogram as one summary instead of separate gauges.
+// The plugins are flushed concurrently, up to plugin_flush_concurrency at a
+// time, each with its own copy of the data. It returns a pluginErrors if any
+// of them failed.
+func (s *Server) flushPlugins(finalMetrics []samplers.DDMetric, distributions []samplers.DDDistribution) error {
+	ps := s.getPlugins()
+	if s.rollup != nil {
+		primary := ps[:0]
+		for _, p := range ps {
+			if p.Name() != s.rollup.sink {
+				primary = append(primary, p)
+			}
+		}
+		ps = primary
+	}
+	concurrency := s.pluginFlushConcurrency
+	if concurrency == 0 || concurrency > len(ps) {
+		concurrency = len(ps)
+	}
+	slots := make(chan struct{}, concurrency)
+	errs := make([]error, len(ps))
+	wg := sync.WaitGroup{}
+	for i, p := range ps {
+		metrics := metricsForSink(finalMetrics, p.Name())
+		metrics = s.transformValues(metrics, p.Name())
+		var pluginSummaries []samplers.DDSummary
+		if _, ok := p.(plugins.SummaryPlugin); ok && s.percentilesAsSummaries {
+			metrics, pluginSummaries = summarizePercentiles(metrics)
+			pluginSummaries = copySummaries(pluginSummaries)
+		}
+		metrics = copyMetrics(metrics)
+		pluginDistributions := copyDistributions(distributionsForSink(distributions, p.Name()))
+
+		done := s.inFlight.start("plugin:" + p.Name())
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(i int, p plugins.Plugin) {
+			defer func() {
+				<-slots
+				done()
+				wg.Done()
+			}()
+			errs[i] = s.flushPlugin(p, metrics, pluginDistributions, pluginSummaries)
+		}(i, p)
+	}
+	wg.Wait()
+
+	failed := pluginErrors{}
+	for i, err := range errs {
+		if err != nil {
+			failed[ps[i].Name()] = err
+		}
+	}
+	if len(failed) > 0 {
+		return failed
+	}
+	return nil
+}
+
+// flushPlugin passes metrics, distributions and summaries to p, if it can
+// flush them. It returns the first error.
+func (s *Server) flushPlugin(p plugins.Plugin, metrics []samplers.DDMetric, distributions []samplers.DDDistribution, summaries []samplers.DDSummary) error {
+	start := time.Now()
+	var (
+		size int
+		err  error
+	)
+	if sp, ok := p.(plugins.SizedPlugin); ok {
+		size, err = sp.FlushSized(metrics, s.Hostname)
+	} else {
+		err = p.Flush(metrics, s.Hostname)
+	}
+	s.Statsd.TimeInMilliseconds(fmt.Sprintf("flush.plugins.%s.total_duration_ns", p.Name()), float64(time.Since(start).Nanoseconds()), []string{"part:post"}, 1.0)
+	if err != nil {
+		countName := fmt.Sprintf("flush.plugins.%s.error_total", p.Name())
+		s.Statsd.Count(countName, 1, []string{}, 1.0)
+	}
+	s.Statsd.Gauge(fmt.Sprintf("flush.plugins.%s.post_metrics_total", p.Name()), float64(len(metrics)), nil, 1.0)
+	if distErr := s.flushPluginDistributions(p, distributions); err == nil {
+		err = distErr
+	}
+	if sp, ok := p.(plugins.SummaryPlugin); ok && len(summaries) > 0 {
+		if summaryErr := s.flushPluginSummaries(sp, summaries); err == nil {
+			err = summaryErr
+		}
+	}
+	record := auditRecord{Sink: p.Name(), Metrics: len(metrics), Bytes: size}
+	if _, ok := p.(plugins.DistributionPlugin); ok {
+		record.Distributions = len(distributions)
+	}
+	s.auditLog.Record(record, err)
+	s.health.FlushFinished(p.Name(), err, time.Now())
+	return err
+}
+
+// pluginErrors holds the error of each plugin that failed to flush, by name.
+type pluginErrors map[string]error
+
+func (e pluginErrors) Error() string {
+	names := make([]string, 0, len(e))
+	for name := range e {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	msgs := make([]string, len(names))
+	for i, name := range names {
+		msgs[i] = fmt.Sprintf("%s: %v", name, e[name])
+	}
+	return fmt.Sprintf("%d plugins failed to flush: %s", len(e), strings.Join(msgs, "; "))
+}
+
+// copyMetrics copies metrics, including their tags, so that a plugin can't
+// affect the metrics passed to other plugins.
+func copyMetrics(metrics []samplers.DDMetric) []samplers.DDMetric {
+	copied := make([]samplers.DDMetric, len(metrics))
+	copy(copied, metrics)
+	for i := range copied {
+		copied[i].Tags = copyTags(copied[i].Tags)
+	}
+	return copied
+}
+
+// copyDistributions copies distributions like copyMetrics.
+func copyDistributions(distributions []samplers.DDDistribution) []samplers.DDDistribution {
+	if distributions == nil {
+		return nil
+	}
+	copied := make([]samplers.DDDistribution, len(distributions))
+	copy(copied, distributions)
+	for i := range copied {
+		copied[i].Tags = copyTags(copied[i].Tags)
+		point := &copied[i].Points[0]
+		point.Values = append([]float64(nil), point.Values...)
+		if point.Weights != nil {
+			point.Weights = append([]float64(nil), point.Weights...)
+		}
+	}
+	return copied
+}
+
+// copySummaries copies summaries like copyMetrics.
+func copySummaries(summaries []samplers.DDSummary) []samplers.DDSummary {
+	if summaries == nil {
+		return nil
+	}
+	copied := make([]samplers.DDSummary, len(summaries))
+	copy(copied, summaries)
+	for i := range copied {
+		copied[i].Tags = copyTags(copied[i].Tags)
+		quantiles := make([]samplers.SummaryQuantile, len(copied[i].Quantiles))
+		copy(quantiles, copied[i].Quantiles)
+		copied[i].Quantiles = quantiles
+	}
+	return copied
+}
+
+func copyTags(tags []string) []string {
+	if tags == nil {
+		return nil
+	}
+	copied := make([]string, len(tags))
+	copy(copied, tags)
+	return copied
+}
+
+// flushPluginDistributions passes distributions to p, if it can flush them.
+func (s *Server) flushPluginDistributions(p plugins.Plugin, distributions []samplers.DDDistribution) error {
+	dp, ok := p.(plugins.DistributionPlugin)
+	if !ok || len(distributions) == 0 {
+		return nil
+	}
+	start := time.Now()
+	err := dp.FlushDistributions(distributions, s.Hostname)
+	s.Statsd.TimeInMilliseconds(fmt.Sprintf("flush.plugins.%s.total_duration_ns", p.Name()), float64(time.Since(start).Nanoseconds()), []string{"part:post_distributions"}, 1.0)
+	if err != nil {
+		s.Statsd.Count(fmt.Sprintf("flush.plugins.%s.error_total", p.Name()), 1, []string{}, 1.0)
+	}
+	return err
+}
+
+// flushPluginSummaries passes summaries to p.
+func (s *Server) flushPluginSummaries(p plugins.SummaryPlugin, summaries []samplers.DDSummary) error {
+	start := time.Now()
+	err := p.FlushSummaries(summaries, s.Hostname)
+	s.Statsd.TimeInMilliseconds(fmt.Sprintf("flush.plugins.%s.total_duration_ns", p.Name()), float64(time.Since(start).Nanoseconds()), []string{"part:post_summaries"}, 1.0)
+	if err != nil {
+		s.Statsd.Count(fmt.Sprintf("flush.plugins.%s.error_total", p.Name()), 1, []string{}, 1.0)
+	}
+	return err
+}
+
+// summarizePercentiles combines the percentile gauges of each histogram in
+// metrics, ie those with the same base name, tags and host, into one summary.
+// It returns the remaining metrics, and the summaries in the order their
+// histograms first appear.
+func summarizePercentiles(metrics []samplers.DDMetric) ([]samplers.DDMetric, []samplers.DDSummary) {
+	rest := make([]samplers.DDMetric, 0, len(metrics))
+	var summaries []samplers.DDSummary
+	index := map[string]int{}
+	for _, m := range metrics {
+		name, quantile, ok := samplers.ParsePercentileName(m.Name)
+		if !ok || m.MetricType != "gauge" {
+			rest = append(rest, m)
+			continue
+		}
+		key := name + "|" + strings.Join(m.Tags, ",") + "|" + m.Hostname
+		i, ok := index[key]
+		if !ok {
+			i = len(summaries)
+			index[key] = i
+			summaries = append(summaries, samplers.DDSummary{
+				Name:      name,
+				Timestamp: m.Value[0][0],
+				Tags:      m.Tags,
+				Hostname:  m.Hostname,
+			})
+		}
+		summaries[i].Quantiles = append(summaries[i].Quantiles, samplers.SummaryQuantile{
+			Quantile: quantile,
+			Value:    m.Value[0][1],
+		})
+	}
+	return rest, summaries
+}
+
+// defaultUnitSuffixes are used when unit suffixing is enabled but no
+// suffixes are configured.
+var defaultUnitSuffixes = map[string]string{
+	"ms": "milliseconds",
+}
+
+// suffixUnit inserts a unit suffix after the base name of each of the metrics
+// flushed from a single sampler, eg a timer "foo" with the suffix
+// "milliseconds" flushes "foo.milliseconds.max". The suffix is chosen by the
+// sampler's DogStatsD type, unless the sampler's name has an override. Names
+// that already end in the suffix are left alone.
+func (s *Server) suffixUnit(metricType, name string, metrics []samplers.DDMetric) []samplers.DDMetric {
+	if s.unitSuffixes == nil {
+		return metrics
+	}
+	suffix, ok := s.unitSuffixOverrides[name]
+	if !ok {
+		suffix = s.unitSuffixes[metricType]
+	}
+	if suffix == "" || strings.HasSuffix(name, "."+suffix) {
+		return metrics
+	}
+	for i := range metrics {
+		if strings.HasPrefix(metrics[i].Name, name) {
+			metrics[i].Name = name + "." + suffix + metrics[i].Name[len(name):]
+		}
+	}
+	return metrics
+}
+
 // reportMetricsFlushCounts reports the counts of
 // Counters, Gauges, LocalHistograms, LocalSets, and LocalTimers
 // as metrics. These are shared by both global and local flush operations.
@@ -254,6 +867,7 @@ func (s *Server) reportMetricsFlushCounts(ms metricsSummary) {
 	s.Statsd.Count("worker.metrics_flushed_total", int64(ms.totalLocalHistograms), []string{"metric_type:local_histogram"}, 1.0)
 	s.Statsd.Count("worker.metrics_flushed_total", int64(ms.totalLocalSets), []string{"metric_type:local_set"}, 1.0)
 	s.Statsd.Count("worker.metrics_flushed_total", int64(ms.totalLocalTimers), []string{"metric_type:local_timer"}, 1.0)
+	s.Statsd.Count("worker.metrics_flushed_total", int64(ms.totalDistributions), []string{"metric_type:distribution"}, 1.0)
 }
 
 // reportGlobalMetricsFlushCounts reports the counts of
@@ -275,12 +889,11 @@ func (s *Server) reportGlobalMetricsFlushCounts(ms metricsSummary) {
 // flushRemote breaks up the final metrics into chunks
 // (to avoid hitting the size cap) and POSTs them to the remote API
 func (s *Server) flushRemote(finalMetrics []samplers.DDMetric) {
+	finalMetrics = metricsForSink(finalMetrics, datadogSinkName)
+	finalMetrics = s.transformValues(finalMetrics, datadogSinkName)
+	// there is always the heartbeat to flush, even if nothing else arrived
+	finalMetrics = append(finalMetrics, s.heartbeat())
 	s.Statsd.Gauge("flush.post_metrics_total", float64(len(finalMetrics)), nil, 1.0)
-	// Check to see if we have anything to do
-	if len(finalMetrics) == 0 {
-		log.Info("Nothing to flush, skipping.")
-		return
-	}
 
 	// break the metrics into chunks of approximately equal size, such that
 	// each chunk is less than the limit
@@ -290,6 +903,8 @@ func (s *Server) flushRemote(finalMetrics []samplers.DDMetric) {
 	log.WithField("workers", workers).Debug("Worker count chosen")
 	log.WithField("chunkSize", chunkSize).Debug("Chunk size chosen")
 	var wg sync.WaitGroup
+	sizes := make([]int, workers)
+	errs := make([]error, workers)
 	flushStart := time.Now()
 	for i := 0; i < workers; i++ {
 		chunk := finalMetrics[i*chunkSize:]
@@ -298,16 +913,57 @@ func (s *Server) flushRemote(finalMetrics []samplers.DDMetric) {
 			chunk = chunk[:chunkSize]
 		}
 		wg.Add(1)
-		go s.flushPart(chunk, &wg)
+		go func(i int, chunk []samplers.DDMetric) {
+			defer wg.Done()
+			sizes[i], errs[i] = s.flushPart(chunk)
+		}(i, chunk)
 	}
 	wg.Wait()
 	s.Statsd.TimeInMilliseconds("flush.total_duration_ns", float64(time.Since(flushStart).Nanoseconds()), []string{"part:post"}, 1.0)
 
+	var size int
+	var err error
+	for i := range sizes {
+		size += sizes[i]
+		if err == nil {
+			err = errs[i]
+		}
+	}
+	s.auditLog.Record(auditRecord{Sink: datadogSinkName, Metrics: len(finalMetrics), Bytes: size}, err)
+	s.health.FlushFinished(datadogSinkName, err, time.Now())
+
 	log.WithField("metrics", len(finalMetrics)).Info("Completed flush to Datadog")
 }
 
-func finalizeMetrics(hostname string, tags []string, finalMetrics []samplers.DDMetric) {
+// heartbeatMetricName is the name of the gauge flushed every interval.
+const heartbeatMetricName = "veneur.heartbeat"
+
+// heartbeat returns the veneur.heartbeat gauge, which is flushed every
+// interval whether or not any metrics were received, so that monitoring can
+// tell a Veneur that has gone silent from one with nothing to report.
+func (s *Server) heartbeat() samplers.DDMetric {
+	var tags []string
+	if s.Hostname != "" {
+		tags = []string{"veneur_instance:" + s.Hostname}
+	}
+	heartbeat := []samplers.DDMetric{{
+		Name:       heartbeatMetricName,
+		Value:      [1][2]float64{{float64(time.Now().Unix()), 1}},
+		Tags:       tags,
+		MetricType: "gauge",
+	}}
+	// the heartbeat is Veneur's own, so it isn't prefixed
+	finalizeMetrics(s.Hostname, s.Tags(), nil, "", heartbeat)
+	return heartbeat[0]
+}
+
+// finalizeMetrics applies the "magic" host, device and sink tags, and adds
+// the metadata tags registered for each metric, if any, and the server's tags.
+// Finally it prepends prefix to each name, after the metadata tags have been
+// looked up by the name the metric was sent with.
+func finalizeMetrics(hostname string, tags []string, metadata *metadataTags, prefix string, finalMetrics []samplers.DDMetric) {
 	for i := range finalMetrics {
+		extractSinks(&finalMetrics[i])
 		// Let's look for "magic tags" that override metric fields host and device.
 		for j, tag := range finalMetrics[i].Tags {
 			// This overrides hostname
@@ -327,19 +983,134 @@ func finalizeMetrics(hostname string, tags []string, finalMetrics []samplers.DDM
 			finalMetrics[i].Hostname = hostname
 		}
 
+		if metadata != nil {
+			finalMetrics[i].Tags = append(finalMetrics[i].Tags, metadata.Lookup(finalMetrics[i].Name)...)
+		}
 		finalMetrics[i].Tags = append(finalMetrics[i].Tags, tags...)
+		finalMetrics[i].Name = prefixName(prefix, finalMetrics[i].Name)
 	}
 }
 
-// flushPart flushes a set of metrics to the remote API server
-func (s *Server) flushPart(metricSlice []samplers.DDMetric, wg *sync.WaitGroup) {
-	defer wg.Done()
-	postHelper(context.TODO(), s.HTTPClient, s.Statsd, fmt.Sprintf("%s/api/v1/series?api_key=%s", s.DDHostname, s.DDAPIKey), map[string][]samplers.DDMetric{
-		"series": metricSlice,
-	}, "flush", true)
+// prefixName prepends prefix, as normalized by metric_prefix, to name,
+// unless name already starts with it.
+func prefixName(prefix, name string) string {
+	if prefix == "" || strings.HasPrefix(name, prefix) {
+		return name
+	}
+	return prefix + name
+}
+
+// flushPart flushes a set of metrics to the remote API server. It returns
+// the size of the JSON body, before compression.
+func (s *Server) flushPart(metricSlice []samplers.DDMetric) (int, error) {
+	if s.ddAPIVersion == datadogAPIVersion2 {
+		return s.flushPartV2(metricSlice)
+	}
+	marshalStart := time.Now()
+	body, err := marshalSeries(metricSlice, s.serializationParallelism)
+	if err != nil {
+		s.Statsd.Count("flush.error_total", 1, []string{"cause:json"}, 1.0)
+		log.WithError(err).Error("Could not render JSON")
+		return 0, err
+	}
+	if s.serializationParallelism > 1 {
+		s.Statsd.TimeInMilliseconds("flush.duration_ns", float64(time.Since(marshalStart).Nanoseconds()), []string{"part:parallel_json"}, 1.0)
+	}
+	ctx, cancel := s.ddRetryContext(context.TODO())
+	defer cancel()
+	return len(body), postHelperWithRetries(ctx, s.HTTPClient, s.Statsd, fmt.Sprintf("%s/api/v1/series?api_key=%s", s.DDHostname, s.DDAPIKey), nil, body, "flush", s.ddEncoding(encodingDeflate), s.flushMaxRetries)
+}
+
+// flushPartV2 flushes a set of metrics to the remote API server in the v2
+// series format. It returns the size of the JSON body, before compression.
+func (s *Server) flushPartV2(metricSlice []samplers.DDMetric) (int, error) {
+	marshalStart := time.Now()
+	body, err := marshalSeriesV2(metricSlice, s.serializationParallelism)
+	if err != nil {
+		s.Statsd.Count("flush.error_total", 1, []string{"cause:json"}, 1.0)
+		log.WithError(err).Error("Could not render JSON")
+		return 0, err
+	}
+	s.Statsd.TimeInMilliseconds("flush.duration_ns", float64(time.Since(marshalStart).Nanoseconds()), []string{"part:v2_json"}, 1.0)
+	headers := http.Header{"DD-API-KEY": []string{s.DDAPIKey}}
+	ctx, cancel := s.ddRetryContext(context.TODO())
+	defer cancel()
+	return len(body), postHelperWithRetries(ctx, s.HTTPClient, s.Statsd, fmt.Sprintf("%s/api/v2/series", s.DDHostname), headers, body, "flush", s.ddEncoding(encodingDeflate), s.flushMaxRetries)
+}
+
+// marshalSeries renders metrics as a {"series": [...]} body, splitting the
+// work across up to parallelism goroutines. The output is byte-for-byte
+// identical to encoding the body with a json.Encoder.
+func marshalSeries(metrics []samplers.DDMetric, parallelism int) (json.RawMessage, error) {
+	if len(metrics) == 0 || parallelism < 2 {
+		// nothing to gain; this also keeps the encoding of an empty series
+		// consistent with the serial path
+		var buf bytes.Buffer
+		err := json.NewEncoder(&buf).Encode(map[string][]samplers.DDMetric{"series": metrics})
+		return buf.Bytes(), err
+	}
+	return marshalSeriesChunks(len(metrics), parallelism, func(start, end int) ([]byte, error) {
+		return json.Marshal(metrics[start:end])
+	})
+}
+
+// marshalSeriesChunks renders n series as a {"series": [...]} body, calling
+// marshalChunk with up to parallelism ranges of them concurrently.
+// marshalChunk must render its range as a JSON array.
+func marshalSeriesChunks(n, parallelism int, marshalChunk func(start, end int) ([]byte, error)) (json.RawMessage, error) {
+	if parallelism > n {
+		parallelism = n
+	}
+
+	chunkSize := ((n - 1) / parallelism) + 1
+	parts := make([][]byte, parallelism)
+	errs := make([]error, parallelism)
+	var wg sync.WaitGroup
+	for i := 0; i < parallelism; i++ {
+		start := i * chunkSize
+		if start >= n {
+			break
+		}
+		end := start + chunkSize
+		if end > n {
+			end = n
+		}
+		wg.Add(1)
+		go func(i, start, end int) {
+			defer wg.Done()
+			parts[i], errs[i] = marshalChunk(start, end)
+		}(i, start, end)
+	}
+	wg.Wait()
+
+	size := len(`{"series":[]}`) + 1
+	for _, part := range parts {
+		size += len(part)
+	}
+	var buf bytes.Buffer
+	buf.Grow(size)
+	buf.WriteString(`{"series":[`)
+	first := true
+	for i, part := range parts {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		if len(part) == 0 {
+			continue
+		}
+		if !first {
+			buf.WriteByte(',')
+		}
+		first = false
+		// strip the brackets from each chunk's array
+		buf.Write(part[1 : len(part)-1])
+	}
+	// json.Encoder terminates each value with a newline
+	buf.WriteString("]}\n")
+	return buf.Bytes(), nil
 }
 
-func (s *Server) flushForward(wms []WorkerMetrics) {
+func (s *Server) flushForward(ctx context.Context, wms []WorkerMetrics) {
 	jmLength := 0
 	for _, wm := range wms {
 		jmLength += len(wm.histograms)
@@ -401,6 +1172,11 @@ func (s *Server) flushForward(wms []WorkerMetrics) {
 			jsonMetrics = append(jsonMetrics, jm)
 		}
 	}
+	// stamp the metrics so the upstream Veneur can reject them if they are
+	// delayed, or our clock is off
+	for i := range jsonMetrics {
+		jsonMetrics[i].Timestamp = exportStart.Unix()
+	}
 	s.Statsd.TimeInMilliseconds("forward.duration_ns", float64(time.Since(exportStart).Nanoseconds()), []string{"part:export"}, 1.0)
 
 	s.Statsd.Gauge("forward.post_metrics_total", float64(len(jsonMetrics)), nil, 1.0)
@@ -422,11 +1198,143 @@ func (s *Server) flushForward(wms []WorkerMetrics) {
 
 	// the error has already been logged (if there was one), so we only care
 	// about the success case
-	if postHelper(context.TODO(), s.HTTPClient, s.Statsd, endpoint, jsonMetrics, "forward", true) == nil {
+	var headers http.Header
+	if s.forwardAuthToken != "" {
+		headers = http.Header{"Authorization": []string{"Bearer " + s.forwardAuthToken}}
+	}
+	body, err := json.Marshal(jsonMetrics)
+	if err != nil {
+		s.Statsd.Count("forward.error_total", 1, []string{"cause:json"}, 1.0)
+		log.WithError(err).Error("Could not render JSON")
+		s.auditLog.Record(auditRecord{Sink: "forward", Metrics: len(jsonMetrics)}, err)
+		return
+	}
+	// as for distributions, the audit log needs refused POSTs as errors
+	err = postHelperWithRetries(ctx, s.HTTPClient, s.Statsd, endpoint, headers, json.RawMessage(body), "forward", encodingDeflate, 0)
+	s.auditLog.Record(auditRecord{Sink: "forward", Metrics: len(jsonMetrics), Bytes: len(body)}, err)
+	if err == nil {
 		log.WithField("metrics", len(jsonMetrics)).Info("Completed forward to upstream Veneur")
 	}
 }
 
+// flushRemaining flushes everything received since the last flush, and the
+// incomplete rollup window, if any, and waits for it to reach every sink,
+// giving up after the shutdown timeout. If
+// it gives up, the error names the parts of the flush that hadn't finished.
+func (s *Server) flushRemaining() error {
+	log.WithField("timeout", s.shutdownTimeout).Info("Flushing remaining data before shutting down")
+
+	s.goFlush("flush", func() {
+		s.Flush()
+		if s.rollup != nil {
+			// the window won't be completed, so flush what there is of it
+			s.flushRollupWindow()
+		}
+	})
+	if running := s.inFlight.wait(s.shutdownTimeout); len(running) > 0 {
+		return fmt.Errorf("final flush timed out after %v, still flushing: %s", s.shutdownTimeout, strings.Join(running, ", "))
+	}
+	return nil
+}
+
+// goFlush runs part of a flush in the background, recording it as running
+// under name until it returns.
+func (s *Server) goFlush(name string, flush func()) {
+	done := s.inFlight.start(name)
+	go func() {
+		defer done()
+		flush()
+	}()
+}
+
+// flushTracker counts the parts of flushes that are running in the
+// background, by name.
+type flushTracker struct {
+	mtx     sync.Mutex
+	running map[string]int
+	idle    *sync.Cond
+}
+
+func newFlushTracker() *flushTracker {
+	f := &flushTracker{running: map[string]int{}}
+	f.idle = sync.NewCond(&f.mtx)
+	return f
+}
+
+// start records that name is running. The returned function must be called
+// when it completes. A nil flushTracker records nothing.
+func (f *flushTracker) start(name string) func() {
+	if f == nil {
+		return func() {}
+	}
+	f.mtx.Lock()
+	f.running[name]++
+	f.mtx.Unlock()
+	return f.finisher(name)
+}
+
+// tryStart is like start, unless name is already running, in which case it
+// records nothing and returns false.
+func (f *flushTracker) tryStart(name string) (func(), bool) {
+	if f == nil {
+		return func() {}, true
+	}
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if f.running[name] > 0 {
+		return nil, false
+	}
+	f.running[name]++
+	return f.finisher(name), true
+}
+
+// finisher returns the function that records that one run of name
+// completed.
+func (f *flushTracker) finisher(name string) func() {
+	return func() {
+		f.mtx.Lock()
+		defer f.mtx.Unlock()
+		f.running[name]--
+		if f.running[name] == 0 {
+			delete(f.running, name)
+		}
+		if len(f.running) == 0 {
+			f.idle.Broadcast()
+		}
+	}
+}
+
+// wait waits up to timeout for everything to complete, and returns the
+// sorted names of what is still running.
+func (f *flushTracker) wait(timeout time.Duration) []string {
+	if f == nil {
+		return nil
+	}
+	idle := make(chan struct{})
+	go func() {
+		f.mtx.Lock()
+		for len(f.running) > 0 {
+			f.idle.Wait()
+		}
+		f.mtx.Unlock()
+		close(idle)
+	}()
+	select {
+	case <-idle:
+		return nil
+	case <-time.After(timeout):
+	}
+
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	running := make([]string, 0, len(f.running))
+	for name := range f.running {
+		running = append(running, name)
+	}
+	sort.Strings(running)
+	return running
+}
+
 // given a url, extract the host and port
 // on failure, it returns the argument, nil and the resulting error
 func extractHostPort(endpoint string) (string, string, error) {
@@ -491,9 +1399,15 @@ func (s *Server) flushTraces(ctx context.Context) {
 	span, _ := trace.StartSpanFromContext(ctx, "flush", trace.NameTag("veneur.opentracing.flush.flushTraces"))
 	defer span.Finish()
 
+	if s.tailSampler != nil {
+		if dropped := s.tailSampler.Expire(time.Now()); dropped > 0 {
+			s.Statsd.Count("spans.dropped_total", int64(dropped), []string{"reason:tail_sampled"}, 1.0)
+		}
+	}
+
 	traces := s.TraceWorker.Flush()
 
-	var finalTraces []*DatadogTraceSpan
+	var samples []ssf.SSFSample
 	traces.Do(func(t interface{}) {
 		if t != nil {
 			span, ok := t.(ssf.SSFSample)
@@ -501,61 +1415,274 @@ func (s *Server) flushTraces(ctx context.Context) {
 				log.Error("Got an unknown object in tracing ring!")
 				return
 			}
-			// -1 is a canonical way of passing in invalid info in Go
-			// so we should support that too
-			parentID := span.Trace.ParentId
-
-			// check if this is the root span
-			if parentID <= 0 {
-				// we need parentId to be zero for json:omitempty to work
-				parentID = 0
-			}
+			samples = append(samples, span)
+		}
+	})
+
+	var sinks []spanSink
+	if s.DDTraceAddress != "" {
+		// always flushed, to retry any spans buffered by a failed flush
+		sinks = append(sinks, spanSink{"datadog", s.flushSpansDatadog})
+	}
+	if s.jaegerCollectorAddress != "" && len(samples) != 0 {
+		sinks = append(sinks, spanSink{"jaeger", s.flushSpansJaeger})
+	}
+	if s.zipkinAPIAddress != "" && len(samples) != 0 {
+		sinks = append(sinks, spanSink{"zipkin", s.flushSpansZipkin})
+	}
+	if s.kafkaSpans != nil && len(samples) != 0 {
+		sinks = append(sinks, spanSink{"kafka", s.flushSpansKafka})
+	}
+	if s.debugFile != nil && len(samples) != 0 {
+		sinks = append(sinks, spanSink{"debug_file", s.flushSpansDebugFile})
+	}
+	if s.spanWriter != nil && len(samples) != 0 {
+		sinks = append(sinks, spanSink{s.spanWriterName, s.flushSpansStdout})
+	}
+	s.flushSpanSinks(span.Attach(ctx), sinks, samples)
+}
 
-			resource := span.Trace.Resource
+// spanSink is a destination that flushTraces sends spans to. Its flush
+// returns an error if any of the spans failed to send.
+type spanSink struct {
+	name  string
+	flush func(ctx context.Context, samples []ssf.SSFSample) error
+}
 
-			tags := map[string]string{}
-			for _, tag := range span.Tags {
-				tags[tag.Name] = tag.Value
+// flushSpanSinks flushes samples to every sink concurrently, so that a slow
+// sink doesn't hold up the others. The samples are shared by the sinks, which
+// must not modify them. Each sink is given one interval: if it hasn't
+// finished by then, its context is cancelled and it is left to finish in the
+// background, so that a hung sink can't stall the flush. Until it does, the
+// sink is skipped, so that a sink that ignores its context leaks at most one
+// goroutine rather than one every interval. The duration of each sink's
+// flush, and whether it failed, timed out or was skipped, are reported
+// tagged by sink.
+func (s *Server) flushSpanSinks(ctx context.Context, sinks []spanSink, samples []ssf.SSFSample) {
+	wg := sync.WaitGroup{}
+	for _, sink := range sinks {
+		wg.Add(1)
+		go func(sink spanSink) {
+			defer wg.Done()
+			// a sink that times out is left running, so it's tracked on its own
+			finished, ok := s.inFlight.tryStart("traces:" + sink.name)
+			if !ok {
+				s.Statsd.Count("flush_traces.sink_skipped_total", 1, []string{"sink:" + sink.name}, 1.0)
+				log.WithField("sink", sink.name).Warn("Skipping the traces flush, the last one hasn't finished")
+				return
+			}
+			var (
+				sinkCtx context.Context
+				cancel  context.CancelFunc
+			)
+			if interval := s.flushInterval(); interval > 0 {
+				sinkCtx, cancel = context.WithTimeout(ctx, interval)
+			} else {
+				sinkCtx, cancel = context.WithCancel(ctx)
 			}
+			defer cancel()
 
-			// TODO implement additional metrics
-			var metrics map[string]float64
-
-			ddspan := &DatadogTraceSpan{
-				TraceID:  span.Trace.TraceId,
-				SpanID:   span.Trace.Id,
-				ParentID: parentID,
-				Service:  span.Service,
-				Name:     span.Name,
-				Resource: resource,
-				Start:    span.Timestamp,
-				Duration: span.Trace.Duration,
-				// TODO don't hardcode
-				Type:    "http",
-				Error:   int64(span.Status),
-				Metrics: metrics,
-				Meta:    tags,
+			start := time.Now()
+			done := make(chan struct{})
+			var err error
+			go func() {
+				defer finished()
+				defer close(done)
+				err = sink.flush(sinkCtx, samples)
+				// recorded even if the flush timed out, when it completes
+				s.auditLog.Record(auditRecord{Sink: "traces:" + sink.name, Spans: len(samples)}, err)
+			}()
+			select {
+			case <-done:
+				s.Statsd.TimeInMilliseconds("flush_traces.sink_duration_ns", float64(time.Since(start).Nanoseconds()), []string{"sink:" + sink.name}, 1.0)
+				if err != nil {
+					s.Statsd.Count("flush_traces.sink_error_total", 1, []string{"sink:" + sink.name}, 1.0)
+				}
+			case <-sinkCtx.Done():
+				s.Statsd.Count("flush_traces.sink_timeout_total", 1, []string{"sink:" + sink.name}, 1.0)
+				log.WithField("sink", sink.name).Warn("Timed out flushing traces, continuing without waiting")
 			}
-			finalTraces = append(finalTraces, ddspan)
+		}(sink)
+	}
+	wg.Wait()
+}
+
+// flushSpansDatadog sends spans to the Datadog trace API at
+// trace_api_address, buffering them to retry if they fail to send.
+func (s *Server) flushSpansDatadog(ctx context.Context, samples []ssf.SSFSample) error {
+	span, _ := trace.StartSpanFromContext(ctx, "flush", trace.NameTag("veneur.opentracing.flush.flushSpansDatadog"))
+	defer span.Finish()
+
+	var finalTraces []*DatadogTraceSpan
+	for _, sample := range samples {
+		finalTraces = append(finalTraces, s.datadogTraceSpan(sample))
+	}
+
+	if s.spanBuffer != nil {
+		// retry anything that failed to flush last time, unless it's too old
+		// to be useful
+		retried, stale := s.spanBuffer.Take(time.Now())
+		if stale > 0 {
+			s.Statsd.Count("spans.dropped_total", int64(stale), []string{"reason:stale"}, 1.0)
+			log.WithField("traces", stale).Warn("Dropping stale buffered traces")
 		}
-	})
+		finalTraces = append(retried, finalTraces...)
+		if len(finalTraces) == 0 && stale > 0 {
+			// there's nothing to send, but the stale spans should be
+			// removed from the buffer's file
+			s.spanBuffer.Delivered()
+		}
+	}
+
 	if len(finalTraces) != 0 {
 		// this endpoint is not documented to take an array... but it does
 		// another curious constraint of this endpoint is that it does not
 		// support "Content-Encoding: deflate"
 
-		err := postHelper(span.Attach(ctx), s.HTTPClient, s.Statsd, fmt.Sprintf("%s/spans", s.DDTraceAddress), finalTraces, "flush_traces", false)
+		postCtx, cancel := s.ddRetryContext(span.Attach(ctx))
+		err := postHelperWithRetries(postCtx, s.HTTPClient, s.Statsd, fmt.Sprintf("%s/spans", s.DDTraceAddress), nil, finalTraces, "flush_traces", s.ddEncoding(encodingIdentity), s.flushMaxRetries)
+		cancel()
 
 		if err == nil {
 			log.WithField("traces", len(finalTraces)).Info("Completed flushing traces to Datadog")
+			if s.spanBuffer != nil {
+				s.spanBuffer.Delivered()
+			}
 		} else {
 			log.WithFields(logrus.Fields{
 				"traces":        len(finalTraces),
 				logrus.ErrorKey: err}).Warn("Error flushing traces to Datadog")
+			if s.spanBuffer != nil {
+				if overflow := s.spanBuffer.Add(finalTraces); overflow > 0 {
+					s.Statsd.Count("spans.dropped_total", int64(overflow), []string{"reason:buffer_full"}, 1.0)
+				}
+			}
+			return err
 		}
 	} else {
 		log.Info("No traces to flush, skipping.")
 	}
+	return nil
+}
+
+// datadogTraceSpan converts a span for the Datadog trace API. Its tags are
+// redacted, numeric tags become metrics, and its logs become events.
+func (s *Server) datadogTraceSpan(sample ssf.SSFSample) *DatadogTraceSpan {
+	// -1 is a canonical way of passing in invalid info in Go
+	// so we should support that too
+	parentID := sample.Trace.ParentId
+
+	// check if this is the root span
+	if parentID <= 0 {
+		// we need parentId to be zero for json:omitempty to work
+		parentID = 0
+	}
+
+	resource := sample.Trace.Resource
+
+	tags := map[string]string{}
+	var metrics map[string]float64
+	for _, tag := range sample.Tags {
+		value := s.redactSpanTag(tag.Value)
+		if number, ok := numericSpanTag(tag, value); ok {
+			if metrics == nil {
+				metrics = map[string]float64{}
+			}
+			if tag.Name == samplingPriorityTag && parentID == 0 {
+				metrics[datadogSamplingPriorityKey] = number
+				continue
+			}
+			metrics[tag.Name] = number
+			continue
+		}
+		tags[tag.Name] = value
+	}
+	for name, ddName := range datadogMetaKeys {
+		if value, ok := tags[name]; ok {
+			// a tag already using Datadog's name wins
+			if _, ok := tags[ddName]; !ok {
+				tags[ddName] = value
+			}
+			delete(tags, name)
+		}
+	}
+	if logs := sample.Trace.GetLogs(); len(logs) > 0 {
+		events, err := s.spanEventsJSON(logs)
+		if err != nil {
+			log.WithError(err).WithField("name", sample.Name).Warn("Could not render span events")
+		} else {
+			tags[spanEventsMetaKey] = events
+		}
+	}
+
+	// Datadog only knows whether a span failed
+	var spanErr int64
+	if sample.Status != ssf.SSFSample_OK {
+		spanErr = 1
+	}
+
+	return &DatadogTraceSpan{
+		TraceID:  sample.Trace.TraceId,
+		SpanID:   sample.Trace.Id,
+		ParentID: parentID,
+		Service:  sample.Service,
+		Name:     sample.Name,
+		Resource: resource,
+		Start:    sample.Timestamp,
+		Duration: sample.Trace.Duration,
+		// TODO don't hardcode
+		Type:    "http",
+		Error:   spanErr,
+		Metrics: metrics,
+		Meta:    tags,
+	}
+}
+
+// redactedValue replaces the parts of span tag values that match
+// span_tag_redaction_patterns.
+const redactedValue = "[REDACTED]"
+
+// spanEventsJSON renders the events logged within a span for the span's
+// events meta. Their field values are redacted like tags.
+func (s *Server) spanEventsJSON(logs []*ssf.SSFLog) (string, error) {
+	events := make([]datadogSpanEvent, len(logs))
+	for i, l := range logs {
+		events[i] = datadogSpanEvent{
+			Name:         l.Event,
+			TimeUnixNano: l.Timestamp,
+		}
+		for _, field := range l.Fields {
+			if events[i].Attributes == nil {
+				events[i].Attributes = map[string]string{}
+			}
+			events[i].Attributes[field.Name] = s.redactSpanTag(field.Value)
+		}
+	}
+	rendered, err := json.Marshal(events)
+	return string(rendered), err
+}
+
+// numericSpanTag returns the value of an integer or float span tag,
+// which Datadog takes in a span's metrics rather than its meta. Tags
+// whose value was redacted, or doesn't parse, stay strings.
+func numericSpanTag(tag *ssf.SSFTag, redacted string) (float64, bool) {
+	if tag.Type != ssf.SSFTag_INT && tag.Type != ssf.SSFTag_FLOAT || redacted != tag.Value {
+		return 0, false
+	}
+	number, err := strconv.ParseFloat(tag.Value, 64)
+	if err != nil || math.IsNaN(number) || math.IsInf(number, 0) {
+		return 0, false
+	}
+	return number, true
+}
+
+// redactSpanTag replaces every match of span_tag_redaction_patterns in value,
+// so that it never leaves Veneur.
+func (s *Server) redactSpanTag(value string) string {
+	for _, re := range s.spanTagRedactions {
+		value = re.ReplaceAllLiteralString(value, redactedValue)
+	}
+	return value
 }
 
 func (s *Server) flushEventsChecks() {
@@ -568,13 +1695,13 @@ func (s *Server) flushEventsChecks() {
 		if events[i].Hostname == "" {
 			events[i].Hostname = s.Hostname
 		}
-		events[i].Tags = append(events[i].Tags, s.Tags...)
+		events[i].Tags = append(events[i].Tags, s.Tags()...)
 	}
 	for i := range checks {
 		if checks[i].Hostname == "" {
 			checks[i].Hostname = s.Hostname
 		}
-		checks[i].Tags = append(checks[i].Tags, s.Tags...)
+		checks[i].Tags = append(checks[i].Tags, s.Tags()...)
 	}
 
 	if len(events) != 0 {
@@ -586,7 +1713,7 @@ func (s *Server) flushEventsChecks() {
 			"events": {
 				"api": events,
 			},
-		}, "flush_events", true)
+		}, "flush_events", encodingDeflate)
 		if err == nil {
 			log.WithField("events", len(events)).Info("Completed flushing events to Datadog")
 		} else {
@@ -600,7 +1727,7 @@ func (s *Server) flushEventsChecks() {
 		// this endpoint is not documented to take an array... but it does
 		// another curious constraint of this endpoint is that it does not
 		// support "Content-Encoding: deflate"
-		err := postHelper(context.TODO(), s.HTTPClient, s.Statsd, fmt.Sprintf("%s/api/v1/check_run?api_key=%s", s.DDHostname, s.DDAPIKey), checks, "flush_checks", false)
+		err := postHelper(context.TODO(), s.HTTPClient, s.Statsd, fmt.Sprintf("%s/api/v1/check_run?api_key=%s", s.DDHostname, s.DDAPIKey), checks, "flush_checks", encodingIdentity)
 		if err == nil {
 			log.WithField("checks", len(checks)).Info("Completed flushing service checks to Datadog")
 		} else {
@@ -611,13 +1738,76 @@ func (s *Server) flushEventsChecks() {
 	}
 }
 
-// shared code for POSTing to an endpoint, that consumes JSON, that is zlib-
-// compressed, that returns 202 on success, that has a small response
+// The Content-Encodings that postHelper can compress request bodies with
+const (
+	encodingIdentity = ""
+	encodingDeflate  = "deflate"
+	encodingGzip     = "gzip"
+)
+
+// shared code for POSTing to an endpoint, that consumes JSON, that is
+// compressed with the given encoding, that returns 202 on success, that has a
+// small response
 // action is a string used for statsd metric names and log messages emitted from
 // this function - probably a static string for each callsite
-// you can disable compression with compress=false for endpoints that don't
+// you can disable compression with encodingIdentity for endpoints that don't
 // support it
-func postHelper(ctx context.Context, httpClient *http.Client, stats *statsd.Client, endpoint string, bodyObject interface{}, action string, compress bool) error {
+func postHelper(ctx context.Context, httpClient *http.Client, stats *statsd.Client, endpoint string, bodyObject interface{}, action string, encoding string) error {
+	return postHelperWithHeaders(ctx, httpClient, stats, endpoint, nil, bodyObject, action, encoding)
+}
+
+// postHelperWithHeaders is postHelper, with extra headers set on the request.
+// A response other than 200 or 202 is logged and counted, but not returned as
+// an error.
+func postHelperWithHeaders(ctx context.Context, httpClient *http.Client, stats *statsd.Client, endpoint string, headers http.Header, bodyObject interface{}, action string, encoding string) error {
+	err := postHelperWithRetries(ctx, httpClient, stats, endpoint, headers, bodyObject, action, encoding, 0)
+	if _, ok := err.(postStatusError); ok {
+		return nil
+	}
+	return err
+}
+
+// postStatusError is the error for a POST that got a response other than
+// 200 or 202.
+type postStatusError struct {
+	action string
+	status string
+}
+
+func (e postStatusError) Error() string {
+	return fmt.Sprintf("%s received status %s", e.action, e.status)
+}
+
+// flushRetryBaseDelay is the delay before the first retry of a failed POST.
+// Each retry waits twice as long as the one before, with jitter, up to
+// flushRetryMaxDelay.
+const (
+	flushRetryBaseDelay = 100 * time.Millisecond
+	flushRetryMaxDelay  = time.Minute
+)
+
+// flushRetryDelay returns how long to wait before the retry after attempt,
+// counting from 0: between half and all of the exponential backoff, so
+// that Veneurs that failed together don't retry together.
+func flushRetryDelay(attempt int) time.Duration {
+	// double step by step, since shifting by a large attempt would overflow
+	backoff := flushRetryBaseDelay
+	for i := 0; i < attempt && backoff < flushRetryMaxDelay; i++ {
+		backoff *= 2
+	}
+	if backoff > flushRetryMaxDelay {
+		backoff = flushRetryMaxDelay
+	}
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)))
+}
+
+// postHelperWithRetries is postHelperWithHeaders, retrying up to retries
+// times if the request fails with an I/O error, a 5xx or a 429. It gives up
+// early rather than wait past ctx's deadline. Giving up on a request after
+// retrying it is counted in action.retries_exhausted_total.
+// Unlike postHelper, it returns a postStatusError for a response other than
+// 200 or 202, so that callers can keep what failed to send.
+func postHelperWithRetries(ctx context.Context, httpClient *http.Client, stats *statsd.Client, endpoint string, headers http.Header, bodyObject interface{}, action string, encoding string, retries int) error {
 	span, _ := trace.StartSpanFromContext(ctx, action, trace.NameTag("veneur.opentracing.flush.postHelper"))
 	defer span.Finish()
 
@@ -628,15 +1818,33 @@ func postHelper(ctx context.Context, httpClient *http.Client, stats *statsd.Clie
 	var (
 		bodyBuffer bytes.Buffer
 		encoder    *json.Encoder
-		compressor *zlib.Writer
+		compressor io.WriteCloser
 	)
-	if compress {
+	switch encoding {
+	case encodingDeflate:
 		compressor = zlib.NewWriter(&bodyBuffer)
+	case encodingGzip:
+		compressor = gzip.NewWriter(&bodyBuffer)
+	}
+	compress := compressor != nil
+	if compress {
 		encoder = json.NewEncoder(compressor)
 	} else {
 		encoder = json.NewEncoder(&bodyBuffer)
 	}
-	if err := encoder.Encode(bodyObject); err != nil {
+	if raw, ok := bodyObject.(json.RawMessage); ok {
+		// already rendered by the caller
+		if compress {
+			_, err := compressor.Write(raw)
+			if err != nil {
+				stats.Count(action+".error_total", 1, []string{"cause:compress"}, 1.0)
+				innerLogger.WithError(err).Error("Could not compress JSON")
+				return err
+			}
+		} else {
+			bodyBuffer.Write(raw)
+		}
+	} else if err := encoder.Encode(bodyObject); err != nil {
 		stats.Count(action+".error_total", 1, []string{"cause:json"}, 1.0)
 		innerLogger.WithError(err).Error("Could not render JSON")
 		return err
@@ -656,26 +1864,64 @@ func postHelper(ctx context.Context, httpClient *http.Client, stats *statsd.Clie
 	bodyLength := bodyBuffer.Len()
 	stats.Histogram(action+".content_length_bytes", float64(bodyLength), nil, 1.0)
 
-	req, err := http.NewRequest(http.MethodPost, endpoint, &bodyBuffer)
+	hostUrl, hostPort, err := extractHostPort(endpoint)
 
 	if err != nil {
-		stats.Count(action+".error_total", 1, []string{"cause:construct"}, 1.0)
-		innerLogger.WithError(err).Error("Could not construct request")
+		stats.Count(action+".error_total", 1, []string{"cause:extract"}, 1.0)
+		innerLogger.WithError(err).Error("Could not extract host and port from forwarded address")
 		return err
 	}
 
-	hostUrl, hostPort, err := extractHostPort(endpoint)
+	body := bodyBuffer.Bytes()
+	for attempt := 0; ; attempt++ {
+		retryable, err := postOnce(ctx, span, httpClient, stats, innerLogger, endpoint, hostUrl+":"+hostPort, headers, body, action, encoding)
+		if err == nil || !retryable {
+			return err
+		}
+		delay := flushRetryDelay(attempt)
+		deadline, hasDeadline := ctx.Deadline()
+		if attempt >= retries || hasDeadline && time.Now().Add(delay).After(deadline) {
+			if attempt > 0 {
+				stats.Count(action+".retries_exhausted_total", 1, nil, 1.0)
+			}
+			return err
+		}
+		stats.Count(action+".retry_total", 1, nil, 1.0)
+		innerLogger.WithFields(logrus.Fields{
+			"attempt": attempt + 1,
+			"delay":   delay,
+		}).Info("Retrying POST")
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			stats.Count(action+".retries_exhausted_total", 1, nil, 1.0)
+			return err
+		}
+	}
+}
+
+// postOnce makes one attempt at the POST for postHelperWithRetries. It
+// reports whether a failure may succeed if retried.
+func postOnce(ctx context.Context, span *trace.Span, httpClient *http.Client, stats *statsd.Client, innerLogger *logrus.Entry, endpoint, host string, headers http.Header, body []byte, action string, encoding string) (bool, error) {
+	bodyLength := len(body)
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
 
 	if err != nil {
-		stats.Count(action+".error_total", 1, []string{"cause:extract"}, 1.0)
-		innerLogger.WithError(err).Error("Could not extract host and port from forwarded address")
-		return err
+		stats.Count(action+".error_total", 1, []string{"cause:construct"}, 1.0)
+		innerLogger.WithError(err).Error("Could not construct request")
+		return false, err
 	}
 
-	req.Host = hostUrl + ":" + hostPort
+	req = req.WithContext(ctx)
+	req.Host = host
 	req.Header.Set("Content-Type", "application/json")
-	if compress {
-		req.Header.Set("Content-Encoding", "deflate")
+	if encoding != encodingIdentity {
+		req.Header.Set("Content-Encoding", encoding)
+	}
+	for name, values := range headers {
+		for _, value := range values {
+			req.Header.Add(name, value)
+		}
 	}
 	// we only make http requests at flush time, so keepalive is not a big win
 	req.Close = true
@@ -696,7 +1942,7 @@ func postHelper(ctx context.Context, httpClient *http.Client, stats *statsd.Clie
 		}
 		stats.Count(action+".error_total", 1, []string{"cause:io"}, 1.0)
 		innerLogger.WithError(err).Error("Could not execute request")
-		return err
+		return true, err
 	}
 	stats.TimeInMilliseconds(action+".duration_ns", float64(time.Since(requestStart).Nanoseconds()), []string{"part:post"}, 1.0)
 	defer resp.Body.Close()
@@ -720,11 +1966,12 @@ func postHelper(ctx context.Context, httpClient *http.Client, stats *statsd.Clie
 	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
 		stats.Count(action+".error_total", 1, []string{fmt.Sprintf("cause:%d", resp.StatusCode)}, 1.0)
 		resultLogger.Error("Could not POST")
-		return err
+		retryable := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+		return retryable, postStatusError{action, resp.Status}
 	}
 
 	// make sure the error metric isn't sparse
 	stats.Count(action+".error_total", 0, nil, 1.0)
 	resultLogger.Debug("POSTed successfully")
-	return nil
+	return false, nil
 }
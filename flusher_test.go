@@ -1,18 +1,31 @@
 package veneur
 
 import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
 	"encoding/json"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/Sirupsen/logrus"
+	"github.com/golang/protobuf/proto"
 	"github.com/stretchr/testify/assert"
+	"github.com/stripe/veneur/plugins/kafka"
 	"github.com/stripe/veneur/samplers"
+	"github.com/stripe/veneur/ssf"
+	"github.com/stripe/veneur/trace"
 )
 
 func TestServerTags(t *testing.T) {
@@ -24,11 +37,140 @@ func TestServerTags(t *testing.T) {
 		Interval:   10,
 	}}
 
-	finalizeMetrics("somehostname", []string{"a:b", "c:d"}, metrics)
+	finalizeMetrics("somehostname", []string{"a:b", "c:d"}, nil, "", metrics)
 	assert.Equal(t, "somehostname", metrics[0].Hostname, "Metric hostname uses argument")
 	assert.Contains(t, metrics[0].Tags, "a:b", "Tags should contain server tags")
 }
 
+func TestUnitSuffixes(t *testing.T) {
+	s := &Server{
+		interval:            10 * time.Second,
+		HistogramAggregates: samplers.HistogramAggregates{Value: samplers.AggregateMax, Count: 1},
+		unitSuffixes:        defaultUnitSuffixes,
+		unitSuffixOverrides: map[string]string{"already.seconds": "seconds"},
+	}
+
+	wm := NewWorkerMetrics()
+	for _, name := range []string{"a.b.c", "already.seconds"} {
+		timer := samplers.NewHist(name, nil)
+		timer.Sample(1.0, 1.0)
+		wm.localTimers[samplers.MetricKey{Name: name, Type: "timer"}] = timer
+	}
+	histo := samplers.NewHist("d.e.f", nil)
+	histo.Sample(1.0, 1.0)
+	wm.localHistograms[samplers.MetricKey{Name: "d.e.f", Type: "histogram"}] = histo
+
+	names := make(map[string]bool)
+	for _, m := range s.generateDDMetrics(context.Background(), nil, []WorkerMetrics{wm}, metricsSummary{}) {
+		names[m.Name] = true
+	}
+	assert.True(t, names["a.b.c.milliseconds.max"], "timers should get the default suffix")
+	assert.True(t, names["already.seconds.max"], "names already ending in the suffix should not change")
+	assert.True(t, names["d.e.f.max"], "histograms have no default suffix")
+
+	s.unitSuffixes = nil
+	names = make(map[string]bool)
+	for _, m := range s.generateDDMetrics(context.Background(), nil, []WorkerMetrics{wm}, metricsSummary{}) {
+		names[m.Name] = true
+	}
+	assert.True(t, names["a.b.c.max"], "suffixes should only be added when enabled")
+}
+
+func TestFlushIntervalAfterSkips(t *testing.T) {
+	s := &Server{
+		interval:            10 * time.Second,
+		HistogramAggregates: samplers.HistogramAggregates{Value: samplers.AggregateCount, Count: 1},
+		Workers:             []*Worker{NewWorker(1, nil, logrus.New())},
+	}
+	for _, m := range []samplers.UDPMetric{
+		{MetricKey: samplers.MetricKey{Name: "a.b.c", Type: "counter"}, Value: 120.0, SampleRate: 1.0},
+		{MetricKey: samplers.MetricKey{Name: "d.e.f", Type: "timer"}, Value: 1.0, SampleRate: 1.0, Scope: samplers.LocalOnly},
+	} {
+		s.Workers[0].ProcessMetric(&m)
+	}
+
+	// five intervals were skipped, so this flush covers 60s of data
+	s.skippedIntervals = 5
+	tempMetrics, ms := s.tallyMetrics(nil)
+	assert.Equal(t, int32(0), s.skippedIntervals, "the skipped intervals should be reset")
+
+	flushed := map[string]samplers.DDMetric{}
+	for _, m := range s.generateDDMetrics(context.Background(), nil, tempMetrics, ms) {
+		flushed[m.Name] = m
+	}
+	assert.Equal(t, int32(60), flushed["a.b.c"].Interval, "Interval should be the time the data covers")
+	assert.Equal(t, 2.0, flushed["a.b.c"].Value[0][1], "the rate should be over the time the data covers")
+	assert.Equal(t, int32(60), flushed["d.e.f.count"].Interval)
+
+	s.Workers[0].ProcessMetric(&samplers.UDPMetric{MetricKey: samplers.MetricKey{Name: "a.b.c", Type: "counter"}, Value: 120.0, SampleRate: 1.0})
+	tempMetrics, ms = s.tallyMetrics(nil)
+	for _, m := range s.generateDDMetrics(context.Background(), nil, tempMetrics, ms) {
+		assert.Equal(t, int32(10), m.Interval, "the next flush should cover one interval again")
+	}
+}
+
+func TestHistogramsAsDistributions(t *testing.T) {
+	type distributionsRequest struct {
+		Series []struct {
+			Name   string          `json:"metric"`
+			Points [][]interface{} `json:"points"`
+			Host   string          `json:"host"`
+		} `json:"series"`
+	}
+	received := make(chan distributionsRequest, 1)
+	remoteServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/v1/distribution_points", r.URL.Path)
+		zr, err := zlib.NewReader(r.Body)
+		assert.NoError(t, err)
+		var req distributionsRequest
+		assert.NoError(t, json.NewDecoder(zr).Decode(&req))
+		received <- req
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer remoteServer.Close()
+
+	s := &Server{
+		Workers:                   []*Worker{NewWorker(0, nil, logrus.New())},
+		Hostname:                  "globalstats",
+		HTTPClient:                &http.Client{},
+		DDHostname:                remoteServer.URL,
+		ddDistributionAddress:     remoteServer.URL,
+		interval:                  10 * time.Second,
+		histogramPercentiles:      []float64{0.5},
+		HistogramAggregates:       samplers.HistogramAggregates{Value: samplers.AggregateMax, Count: 1},
+		histogramsAsDistributions: map[string]struct{}{"a.b.c": struct{}{}},
+	}
+	for _, packet := range []string{"a.b.c:1|h", "a.b.c:2|h", "d.e.f:1|h"} {
+		m, err := samplers.ParseMetric([]byte(packet))
+		assert.NoError(t, err)
+		s.Workers[0].ProcessMetric(m)
+	}
+
+	tempMetrics, ms := s.tallyMetrics(s.histogramPercentiles)
+	names := make(map[string]bool)
+	for _, m := range s.generateDDMetrics(context.Background(), s.histogramPercentiles, tempMetrics, ms) {
+		names[m.Name] = true
+	}
+	assert.False(t, names["a.b.c.50percentile"], "distribution histograms should not flush percentiles")
+	assert.True(t, names["a.b.c.max"], "distribution histograms should still flush aggregates")
+	assert.True(t, names["d.e.f.50percentile"], "other histograms should flush percentiles")
+
+	s.flushDistributions(s.generateDistributions(tempMetrics))
+	req := <-received
+	if assert.Len(t, req.Series, 1) {
+		assert.Equal(t, "a.b.c", req.Series[0].Name)
+		assert.Equal(t, "globalstats", req.Series[0].Host)
+		assert.Equal(t, []interface{}{1.0, 2.0}, req.Series[0].Points[0][1])
+	}
+}
+
+func TestPrefixName(t *testing.T) {
+	assert.Equal(t, "a.b.c", prefixName("", "a.b.c"))
+	assert.Equal(t, "team.a.b.c", prefixName("team.", "a.b.c"))
+	assert.Equal(t, "team.a.b.c", prefixName("team.", "team.a.b.c"), "names should only be prefixed once")
+	assert.Equal(t, "team.teamwork.a", prefixName("team.", "teamwork.a"), "the prefix should match whole components")
+}
+
 func TestHostPortExtract(t *testing.T) {
 	h, p, _ := extractHostPort("https://github.com/stripe/veneur")
 
@@ -45,7 +187,7 @@ func TestHostMagicTag(t *testing.T) {
 		Interval:   10,
 	}}
 
-	finalizeMetrics("badhostname", []string{"a:b", "c:d"}, metrics)
+	finalizeMetrics("badhostname", []string{"a:b", "c:d"}, nil, "", metrics)
 	assert.Equal(t, "abc123", metrics[0].Hostname, "Metric hostname should be from tag")
 	assert.NotContains(t, metrics[0].Tags, "host:abc123", "Host tag should be removed")
 	assert.Contains(t, metrics[0].Tags, "x:e", "Last tag is still around")
@@ -60,7 +202,7 @@ func TestDeviceMagicTag(t *testing.T) {
 		Interval:   10,
 	}}
 
-	finalizeMetrics("badhostname", []string{"a:b", "c:d"}, metrics)
+	finalizeMetrics("badhostname", []string{"a:b", "c:d"}, nil, "", metrics)
 	assert.Equal(t, "abc123", metrics[0].DeviceName, "Metric devicename should be from tag")
 	assert.NotContains(t, metrics[0].Tags, "device:abc123", "Host tag should be removed")
 	assert.Contains(t, metrics[0].Tags, "x:e", "Last tag is still around")
@@ -71,6 +213,7 @@ func TestFlushTraces(t *testing.T) {
 		Name         string
 		ProtobufFile string
 		JSONFile     string
+		Compress     bool
 	}
 
 	cases := []TestCase{
@@ -84,6 +227,12 @@ func TestFlushTraces(t *testing.T) {
 			ProtobufFile: filepath.Join("fixtures", "protobuf", "trace_critical.pb"),
 			JSONFile:     filepath.Join("fixtures", "tracing_agent", "spans", "trace_critical.pb.json"),
 		},
+		{
+			Name:         "Compressed",
+			ProtobufFile: filepath.Join("fixtures", "protobuf", "trace.pb"),
+			JSONFile:     filepath.Join("fixtures", "tracing_agent", "spans", "trace.pb.json"),
+			Compress:     true,
+		},
 	}
 
 	for _, tc := range cases {
@@ -96,20 +245,28 @@ func TestFlushTraces(t *testing.T) {
 			assert.NoError(t, err)
 			defer js.Close()
 
-			testFlushTrace(t, pb, js)
+			testFlushTrace(t, pb, js, tc.Compress)
 		})
 	}
 }
 
-func testFlushTrace(t *testing.T, protobuf, jsn io.Reader) {
+func testFlushTrace(t *testing.T, protobuf, jsn io.Reader, compress bool) {
 	remoteResponseChan := make(chan struct{}, 1)
 	remoteServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		var expected []*DatadogTraceSpan
 		err := json.NewDecoder(jsn).Decode(&expected)
 		assert.NoError(t, err)
 
+		body := io.Reader(r.Body)
+		if compress {
+			assert.Equal(t, "gzip", r.Header.Get("Content-Encoding"))
+			body, err = gzip.NewReader(r.Body)
+			assert.NoError(t, err)
+		} else {
+			assert.Empty(t, r.Header.Get("Content-Encoding"))
+		}
 		var actual []*DatadogTraceSpan
-		err = json.NewDecoder(r.Body).Decode(&actual)
+		err = json.NewDecoder(body).Decode(&actual)
 		assert.NoError(t, err)
 
 		assert.Equal(t, expected, actual)
@@ -122,6 +279,7 @@ func testFlushTrace(t *testing.T, protobuf, jsn io.Reader) {
 
 	config := globalConfig()
 	config.TraceAPIAddress = remoteServer.URL
+	config.DatadogFlushCompress = compress
 
 	server := setupVeneurServer(t, config, nil)
 	defer server.Shutdown()
@@ -145,3 +303,890 @@ func testFlushTrace(t *testing.T, protobuf, jsn io.Reader) {
 		assert.Fail(t, "Global server did not complete all responses before test terminated!")
 	}
 }
+
+func TestFlushEventsChecksNotGzipped(t *testing.T) {
+	encodings := make(chan [2]string, 2)
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/intake" || r.URL.Path == "/api/v1/check_run" {
+			encodings <- [2]string{r.URL.Path, r.Header.Get("Content-Encoding")}
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer api.Close()
+
+	config := globalConfig()
+	config.APIHostname = api.URL
+	config.DatadogFlushCompress = true
+	server := setupVeneurServer(t, config, nil)
+	defer server.Shutdown()
+
+	server.EventWorker.mutex.Lock()
+	server.EventWorker.events = append(server.EventWorker.events, samplers.UDPEvent{Title: "an event"})
+	server.EventWorker.checks = append(server.EventWorker.checks, samplers.UDPServiceCheck{Name: "a.check"})
+	server.EventWorker.mutex.Unlock()
+	server.flushEventsChecks()
+
+	got := map[string]string{}
+	for len(got) < 2 {
+		select {
+		case request := <-encodings:
+			got[request[0]] = request[1]
+		case <-time.After(10 * time.Second):
+			t.Fatal("Timed out waiting for the events and checks")
+		}
+	}
+	assert.Equal(t, map[string]string{
+		"/intake":           "deflate",
+		"/api/v1/check_run": "",
+	}, got, "events and checks should keep their usual encoding")
+}
+
+func TestFlushTracesZipkin(t *testing.T) {
+	type TestCase struct {
+		Name         string
+		ProtobufFile string
+		JSONFile     string
+	}
+
+	cases := []TestCase{
+		{
+			Name:         "Success",
+			ProtobufFile: filepath.Join("fixtures", "protobuf", "trace.pb"),
+			JSONFile:     filepath.Join("fixtures", "zipkin", "spans", "trace.pb.json"),
+		},
+		{
+			Name:         "Critical",
+			ProtobufFile: filepath.Join("fixtures", "protobuf", "trace_critical.pb"),
+			JSONFile:     filepath.Join("fixtures", "zipkin", "spans", "trace_critical.pb.json"),
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			pb, err := os.Open(tc.ProtobufFile)
+			assert.NoError(t, err)
+			defer pb.Close()
+
+			js, err := os.Open(tc.JSONFile)
+			assert.NoError(t, err)
+			defer js.Close()
+
+			testFlushTraceZipkin(t, pb, js)
+		})
+	}
+}
+
+func testFlushTraceZipkin(t *testing.T, protobuf, jsn io.Reader) {
+	remoteResponseChan := make(chan struct{}, 1)
+	remoteServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/v2/spans", r.URL.Path)
+
+		var expected []zipkinSpan
+		err := json.NewDecoder(jsn).Decode(&expected)
+		assert.NoError(t, err)
+
+		var actual []zipkinSpan
+		err = json.NewDecoder(r.Body).Decode(&actual)
+		assert.NoError(t, err)
+
+		assert.Equal(t, expected, actual)
+
+		w.WriteHeader(http.StatusAccepted)
+
+		remoteResponseChan <- struct{}{}
+	}))
+	defer remoteServer.Close()
+
+	config := globalConfig()
+	config.TraceAPIAddress = ""
+	config.ZipkinAPIAddress = remoteServer.URL
+
+	server := setupVeneurServer(t, config, nil)
+	defer server.Shutdown()
+
+	packet, err := ioutil.ReadAll(protobuf)
+	assert.NoError(t, err)
+
+	server.HandleTracePacket(packet)
+	server.Flush()
+
+	// wait for remoteServer to process the POST
+	select {
+	case <-remoteResponseChan:
+	case <-time.After(10 * time.Second):
+		assert.Fail(t, "Global server did not complete all responses before test terminated!")
+	}
+}
+
+func TestZipkinSpan(t *testing.T) {
+	s := &Server{}
+	span := trace.StartTrace("GET /cart")
+	span.ParentID = 0x1234
+	span.Log("retry", map[string]string{"attempt": "2"})
+	sample := span.SSFSample()
+	sample.Trace.Duration = int64(1500 * time.Microsecond)
+
+	zipkin := s.zipkinSpanFor(*sample)
+	assert.Equal(t, "0000000000001234", zipkin.ParentID, "IDs should be 16 hex digits")
+	assert.Equal(t, int64(1500), zipkin.Duration, "the duration should be in microseconds")
+	assert.Equal(t, []zipkinAnnotation{{
+		Timestamp: span.Logs[0].Timestamp.UnixNano() / 1000,
+		Value:     "retry attempt=2",
+	}}, zipkin.Annotations)
+	_, isError := zipkin.Tags["error"]
+	assert.False(t, isError, "only critical spans should be tagged error")
+}
+
+func TestFlushTracesBufferMaxAge(t *testing.T) {
+	// set by the test, read by the server's goroutines
+	fail := int32(1)
+	received := make(chan []*DatadogTraceSpan, 1)
+	remoteServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&fail) != 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var spans []*DatadogTraceSpan
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&spans))
+		received <- spans
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer remoteServer.Close()
+
+	const maxAge = 50 * time.Millisecond
+	s := &Server{
+		TraceWorker:    NewTraceWorker(nil),
+		HTTPClient:     &http.Client{},
+		DDTraceAddress: remoteServer.URL,
+		spanBuffer:     newSpanBuffer(defaultSpanBufferSize, maxAge),
+	}
+	addSpan := func(name string) {
+		s.TraceWorker.traces.Value = ssf.SSFSample{
+			Name:      name,
+			Timestamp: time.Now().UnixNano(),
+			Trace:     &ssf.SSFTrace{TraceId: 1, Id: 1},
+		}
+		s.TraceWorker.traces = s.TraceWorker.traces.Next()
+	}
+
+	// the first flush fails, so its span is buffered for retry
+	addSpan("stale")
+	s.flushTraces(context.Background())
+	assert.Len(t, s.spanBuffer.spans, 1, "failed span should be buffered")
+
+	// by the time the next flush succeeds, the buffered span is too old
+	time.Sleep(2 * maxAge)
+	atomic.StoreInt32(&fail, 0)
+	addSpan("fresh")
+	s.flushTraces(context.Background())
+
+	spans := <-received
+	if assert.Len(t, spans, 1, "stale span should have been dropped") {
+		assert.Equal(t, "fresh", spans[0].Name)
+	}
+	assert.Len(t, s.spanBuffer.spans, 0)
+}
+
+// retryServer returns a server that fails with each of statuses in turn,
+// then accepts, and counts the POSTs it receives.
+func retryServer(statuses ...int) (*httptest.Server, *int32) {
+	var posts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&posts, 1)
+		if int(n) <= len(statuses) {
+			w.WriteHeader(statuses[n-1])
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	return server, &posts
+}
+
+func TestFlushTracesRetry(t *testing.T) {
+	remoteServer, posts := retryServer(http.StatusServiceUnavailable)
+	defer remoteServer.Close()
+
+	s := &Server{
+		TraceWorker:     NewTraceWorker(nil),
+		HTTPClient:      &http.Client{},
+		DDTraceAddress:  remoteServer.URL,
+		interval:        10 * time.Second,
+		flushMaxRetries: 3,
+		spanBuffer:      newSpanBuffer(defaultSpanBufferSize, 0),
+	}
+	s.TraceWorker.traces.Value = ssf.SSFSample{
+		Name:      "retried",
+		Timestamp: time.Now().UnixNano(),
+		Trace:     &ssf.SSFTrace{TraceId: 1, Id: 1},
+	}
+	s.TraceWorker.traces = s.TraceWorker.traces.Next()
+	s.flushTraces(context.Background())
+
+	assert.Equal(t, int32(2), atomic.LoadInt32(posts), "the 503 should be retried once")
+	assert.Len(t, s.spanBuffer.spans, 0, "a span that was sent on retry shouldn't be buffered")
+}
+
+func TestFlushRetryClientError(t *testing.T) {
+	remoteServer, posts := retryServer(http.StatusBadRequest)
+	defer remoteServer.Close()
+
+	err := postHelperWithRetries(context.Background(), &http.Client{}, nil, remoteServer.URL, nil, []string{"x"}, "flush", encodingIdentity, 3)
+	assert.Error(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(posts), "a 4xx shouldn't be retried")
+}
+
+// TestPostHelperStatus tests that an unsuccessful status is only returned as
+// an error by postHelperWithRetries.
+func TestPostHelperStatus(t *testing.T) {
+	remoteServer, _ := retryServer(http.StatusBadRequest, http.StatusBadRequest)
+	defer remoteServer.Close()
+
+	assert.NoError(t, postHelper(context.Background(), &http.Client{}, nil, remoteServer.URL, []string{"x"}, "forward", encodingIdentity))
+	err := postHelperWithRetries(context.Background(), &http.Client{}, nil, remoteServer.URL, nil, []string{"x"}, "flush_traces", encodingIdentity, 0)
+	assert.Equal(t, postStatusError{"flush_traces", "400 Bad Request"}, err)
+}
+
+func TestFlushRetryDeadline(t *testing.T) {
+	remoteServer, posts := retryServer(http.StatusInternalServerError, http.StatusInternalServerError)
+	defer remoteServer.Close()
+
+	// the deadline leaves no time for a retry
+	ctx, cancel := context.WithTimeout(context.Background(), flushRetryBaseDelay/4)
+	defer cancel()
+	err := postHelperWithRetries(ctx, &http.Client{}, nil, remoteServer.URL, nil, []string{"x"}, "flush", encodingIdentity, 3)
+	assert.Error(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(posts), "retries shouldn't wait past the deadline")
+}
+
+func TestFlushRetriesExhausted(t *testing.T) {
+	remoteServer, _ := retryServer(http.StatusInternalServerError, http.StatusInternalServerError, http.StatusInternalServerError)
+	defer remoteServer.Close()
+	stats, packets := newStatsdCapture(t)
+
+	postHelperWithRetries(context.Background(), &http.Client{}, stats, remoteServer.URL, nil, []string{"x"}, "unretried", encodingIdentity, 0)
+	postHelperWithRetries(context.Background(), &http.Client{}, stats, remoteServer.URL, nil, []string{"x"}, "retried", encodingIdentity, 1)
+	for packet := range packets {
+		assert.NotEqual(t, "veneur.unretried.retries_exhausted_total:1|c", packet, "a POST that wasn't retried shouldn't exhaust its retries")
+		if packet == "veneur.retried.retries_exhausted_total:1|c" {
+			return
+		}
+	}
+	t.Error("the retried POST should exhaust its retries")
+}
+
+func TestFlushRetryDelay(t *testing.T) {
+	assert.InDelta(t, float64(flushRetryBaseDelay), float64(flushRetryDelay(0)), float64(flushRetryBaseDelay/2))
+	for _, attempt := range []int{20, 64, 1000} {
+		delay := flushRetryDelay(attempt)
+		assert.True(t, delay >= flushRetryMaxDelay/2 && delay <= flushRetryMaxDelay, "attempt %d should wait at most the maximum, got %v", attempt, delay)
+	}
+}
+
+// blockingSpanSink returns a sink that reports its name on started when it
+// begins to flush, and then waits for release, ignoring its context, before
+// it records that it received samples.
+func blockingSpanSink(name string, started chan<- string, release <-chan struct{}, flushed *int32) spanSink {
+	return spanSink{name, func(ctx context.Context, samples []ssf.SSFSample) error {
+		started <- name
+		<-release
+		atomic.AddInt32(flushed, int32(len(samples)))
+		return nil
+	}}
+}
+
+// flushSpanSinksAsync runs flushSpanSinks, and returns a channel that is
+// closed when it returns.
+func flushSpanSinksAsync(s *Server, sinks []spanSink) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.flushSpanSinks(context.Background(), sinks, []ssf.SSFSample{{Name: "a"}})
+	}()
+	return done
+}
+
+func waitForChannel(t *testing.T, c <-chan struct{}, msg string) {
+	select {
+	case <-c:
+	case <-time.After(5 * time.Second):
+		t.Fatal(msg)
+	}
+}
+
+func TestFlushSpanSinksConcurrently(t *testing.T) {
+	s := &Server{}
+	var flushed int32
+	started := make(chan string, 2)
+	release := make(chan struct{})
+	sinks := []spanSink{
+		blockingSpanSink("slow", started, release, &flushed),
+		blockingSpanSink("fast", started, release, &flushed),
+	}
+
+	done := flushSpanSinksAsync(s, sinks)
+	var names []string
+	for len(names) < 2 {
+		select {
+		case name := <-started:
+			names = append(names, name)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("the sinks should flush at the same time, but only %v started", names)
+		}
+	}
+	close(release)
+	waitForChannel(t, done, "the flush should finish once the sinks have")
+	assert.Equal(t, int32(2), atomic.LoadInt32(&flushed), "both sinks should get the samples")
+}
+
+func TestFlushSpanSinksTimeout(t *testing.T) {
+	s := &Server{interval: 50 * time.Millisecond, inFlight: newFlushTracker()}
+	var flushed int32
+	started := make(chan string, 10)
+	hung := make(chan struct{})
+	released := make(chan struct{})
+	close(released)
+	sinks := []spanSink{
+		blockingSpanSink("hung", started, hung, &flushed),
+		blockingSpanSink("fast", started, released, &flushed),
+	}
+
+	waitForChannel(t, flushSpanSinksAsync(s, sinks), "a hung sink shouldn't stall the flush")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&flushed), "only the fast sink should have finished")
+	assert.Len(t, started, 2)
+	<-started
+	<-started
+
+	// until it finishes, the hung sink isn't flushed again
+	waitForChannel(t, flushSpanSinksAsync(s, sinks), "a hung sink shouldn't stall the flush")
+	assert.Equal(t, []string{"fast"}, []string{<-started}, "only the fast sink should be flushed")
+	assert.Len(t, started, 0, "the hung sink should be skipped")
+
+	close(hung)
+	assert.Empty(t, s.inFlight.wait(5*time.Second), "the hung sink should finish once released")
+	waitForChannel(t, flushSpanSinksAsync(s, sinks), "the flush should finish")
+	assert.Len(t, started, 2, "the sink should be flushed again once it has finished")
+	assert.Equal(t, int32(5), atomic.LoadInt32(&flushed))
+}
+
+// TestFlushSpanSinksTelemetry tests that a span sink's flush duration and
+// errors are reported through the server's own metrics, with its tags.
+func TestFlushSpanSinksTelemetry(t *testing.T) {
+	remoteServer, _ := retryServer(http.StatusBadRequest)
+	defer remoteServer.Close()
+	statsAddr, packets := listenStatsd(t)
+
+	config := localConfig()
+	config.Interval = "60s" // only flush when the test does
+	config.StatsAddress = statsAddr
+	config.Tags = []string{"env:test"}
+	config.TraceAPIAddress = remoteServer.URL
+	server := setupVeneurServer(t, config, nil)
+	defer server.Shutdown()
+
+	sample := ssf.SSFSample{
+		Name:      "failed",
+		Timestamp: time.Now().UnixNano(),
+		Trace:     &ssf.SSFTrace{TraceId: 1, Id: 1},
+	}
+	// the second send can't complete until the first is in the ring
+	server.TraceWorker.TraceChan <- sample
+	server.TraceWorker.TraceChan <- sample
+	server.flushTraces(context.Background())
+
+	var duration, errors bool
+	for packet := range packets {
+		if strings.HasPrefix(packet, "veneur.flush_traces.sink_duration_ns:") &&
+			strings.HasSuffix(packet, "|ms|#env:test,veneurlocalonly,sink:datadog") {
+			duration = true
+		}
+		if packet == "veneur.flush_traces.sink_error_total:1|c|#env:test,veneurlocalonly,sink:datadog" {
+			errors = true
+		}
+		if duration && errors {
+			return
+		}
+	}
+	t.Errorf("never received the sink's duration (%v) and error count (%v)", duration, errors)
+}
+
+// TestFlushSpansZipkinRefused tests that spans Zipkin refuses are counted
+// as the Zipkin sink's errors.
+func TestFlushSpansZipkinRefused(t *testing.T) {
+	remoteServer, _ := retryServer(http.StatusInternalServerError)
+	defer remoteServer.Close()
+	statsAddr, packets := listenStatsd(t)
+
+	config := localConfig()
+	config.Interval = "60s" // only flush when the test does
+	config.StatsAddress = statsAddr
+	config.Tags = []string{"env:test"}
+	config.ZipkinAPIAddress = remoteServer.URL
+	server := setupVeneurServer(t, config, nil)
+	defer server.Shutdown()
+
+	server.TraceWorker.TraceChan <- ssf.SSFSample{
+		Name:      "refused",
+		Timestamp: time.Now().UnixNano(),
+		Trace:     &ssf.SSFTrace{TraceId: 1, Id: 1},
+	}
+	waitForSpans(t, 1, server.TraceWorker)
+	server.flushTraces(context.Background())
+
+	waitForStat(t, packets, "veneur.flush_traces.sink_error_total:1|c|#env:test,veneurlocalonly,sink:zipkin")
+}
+
+func TestFlushTracesRedaction(t *testing.T) {
+	received := make(chan []*DatadogTraceSpan, 1)
+	remoteServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var spans []*DatadogTraceSpan
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&spans))
+		received <- spans
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer remoteServer.Close()
+
+	config := globalConfig()
+	config.TraceAPIAddress = remoteServer.URL
+	config.SpanTagRedactionPatterns = []string{`\b\d{4}(-?\d{4}){3}\b`, `token=\w+`}
+	s, err := NewFromConfig(config)
+	assert.NoError(t, err)
+
+	s.TraceWorker.traces.Value = ssf.SSFSample{
+		Name:      "checkout",
+		Timestamp: time.Now().UnixNano(),
+		Trace:     &ssf.SSFTrace{TraceId: 1, Id: 1},
+		Tags: []*ssf.SSFTag{
+			{Name: "card", Value: "paid with 4242-4242-4242-4242"},
+			{Name: "url", Value: "/callback?token=abc123&page=2"},
+			{Name: "order", Value: "12345"},
+		},
+	}
+	s.TraceWorker.traces = s.TraceWorker.traces.Next()
+	s.flushTraces(context.Background())
+
+	spans := <-received
+	if assert.Len(t, spans, 1) {
+		assert.Equal(t, map[string]string{
+			"card":  "paid with [REDACTED]",
+			"url":   "/callback?[REDACTED]&page=2",
+			"order": "12345",
+		}, spans[0].Meta, "only the values matching a pattern should be redacted")
+	}
+}
+
+func TestFlushTracesTypedTags(t *testing.T) {
+	received := make(chan []*DatadogTraceSpan, 1)
+	remoteServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var spans []*DatadogTraceSpan
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&spans))
+		received <- spans
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer remoteServer.Close()
+
+	config := globalConfig()
+	config.TraceAPIAddress = remoteServer.URL
+	config.SpanTagRedactionPatterns = []string{`^4242\d+$`}
+	s, err := NewFromConfig(config)
+	assert.NoError(t, err)
+
+	span := trace.StartTrace("checkout")
+	tracerSpan := &trace.Span{Trace: span}
+	tracerSpan.SetTag("name", "checkout")
+	tracerSpan.SetIntTag("http.status_code", 200)
+	tracerSpan.SetFloatTag("cart.total", 12.5)
+	tracerSpan.SetBoolTag("cache.hit", true)
+	tracerSpan.SetIntTag("card", 4242424242424242)
+	span.Log("charge", map[string]string{"card": "4242424242424242", "attempt": "1"})
+	sample := span.SSFSample()
+	sample.Timestamp = time.Now().UnixNano()
+	s.TraceWorker.traces.Value = *sample
+	s.TraceWorker.traces = s.TraceWorker.traces.Next()
+	s.flushTraces(context.Background())
+
+	spans := <-received
+	if assert.Len(t, spans, 1) {
+		assert.Equal(t, map[string]float64{
+			"http.status_code": 200,
+			"cart.total":       12.5,
+		}, spans[0].Metrics, "numeric tags should be flushed as metrics")
+		assert.Equal(t, map[string]string{
+			"name":      "checkout",
+			"cache.hit": "true",
+			"card":      "[REDACTED]",
+			"events":    fmt.Sprintf(`[{"name":"charge","time_unix_nano":%d,"attributes":{"attempt":"1","card":"[REDACTED]"}}]`, span.Logs[0].Timestamp.UnixNano()),
+		}, spans[0].Meta, "string, boolean and redacted tags, and events, should be flushed as meta")
+	}
+}
+
+func TestFlushTracesSamplingPriority(t *testing.T) {
+	received := make(chan []*DatadogTraceSpan, 1)
+	remoteServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var spans []*DatadogTraceSpan
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&spans))
+		received <- spans
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer remoteServer.Close()
+
+	config := globalConfig()
+	config.TraceAPIAddress = remoteServer.URL
+	s, err := NewFromConfig(config)
+	assert.NoError(t, err)
+
+	root := trace.StartTrace("checkout")
+	root.SetSamplingPriority(2)
+	child := trace.StartChildSpan(root)
+	for _, span := range []*trace.Trace{root, child} {
+		sample := span.SSFSample()
+		sample.Timestamp = time.Now().UnixNano()
+		s.TraceWorker.traces.Value = *sample
+		s.TraceWorker.traces = s.TraceWorker.traces.Next()
+	}
+	s.flushTraces(context.Background())
+
+	spans := <-received
+	if assert.Len(t, spans, 2) {
+		for _, span := range spans {
+			if span.ParentID == 0 {
+				assert.Equal(t, map[string]float64{"_sampling_priority_v1": 2}, span.Metrics, "the root span should carry the priority for Datadog")
+			} else {
+				assert.Equal(t, map[string]float64{"sampling.priority": 2}, span.Metrics, "only the root span's priority counts")
+			}
+		}
+	}
+}
+
+func TestDatadogTraceSpanErrors(t *testing.T) {
+	s := &Server{}
+	sample := ssf.SSFSample{
+		Status: ssf.SSFSample_WARNING,
+		Trace:  &ssf.SSFTrace{TraceId: 1, Id: 1},
+		Tags: []*ssf.SSFTag{
+			{Name: "error.msg", Value: "from trace.Error"},
+			{Name: "error.message", Value: "set by hand"},
+		},
+	}
+	span := s.datadogTraceSpan(sample)
+	assert.Equal(t, int64(1), span.Error, "any span that isn't OK is an error to Datadog")
+	assert.Equal(t, map[string]string{"error.message": "set by hand"}, span.Meta, "a tag with Datadog's name should win")
+
+	sample.Status = ssf.SSFSample_OK
+	sample.Tags = sample.Tags[:1]
+	span = s.datadogTraceSpan(sample)
+	assert.Equal(t, int64(0), span.Error)
+	assert.Equal(t, map[string]string{"error.message": "from trace.Error"}, span.Meta)
+}
+
+func TestSpanTagRedactionValidation(t *testing.T) {
+	config := globalConfig()
+	config.TraceAPIAddress = "http://localhost:7777"
+	config.SpanTagRedactionPatterns = []string{"("}
+	_, err := NewFromConfig(config)
+	assert.Error(t, err)
+}
+
+func TestFlushTracesDiskBuffer(t *testing.T) {
+	// set by the test, read by the server's goroutines
+	fail := int32(1)
+	received := make(chan []*DatadogTraceSpan, 1)
+	remoteServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&fail) != 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var spans []*DatadogTraceSpan
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&spans))
+		received <- spans
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer remoteServer.Close()
+
+	dir, err := ioutil.TempDir("", "veneur-span-buffer")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "spans")
+
+	newServer := func() *Server {
+		buffer, err := newDiskSpanBuffer(path, defaultSpanBufferSize, 0)
+		assert.NoError(t, err)
+		return &Server{
+			TraceWorker:    NewTraceWorker(nil),
+			HTTPClient:     &http.Client{},
+			DDTraceAddress: remoteServer.URL,
+			spanBuffer:     buffer,
+		}
+	}
+
+	// the sink is down, so the span is buffered on disk
+	s := newServer()
+	s.TraceWorker.traces.Value = ssf.SSFSample{
+		Name:      "buffered",
+		Timestamp: time.Now().UnixNano(),
+		Trace:     &ssf.SSFTrace{TraceId: 1, Id: 2},
+	}
+	s.flushTraces(context.Background())
+	s.spanBuffer.Close()
+
+	// a crash after the span is taken for retry, but before it is sent,
+	// doesn't lose it
+	s = newServer()
+	assert.Len(t, s.spanBuffer.spans, 1, "buffered span should be loaded from disk")
+	s.spanBuffer.Take(time.Now())
+	s.spanBuffer.Close()
+
+	// after a restart, the span is replayed once the sink is back
+	s = newServer()
+	assert.Len(t, s.spanBuffer.spans, 1, "a span that wasn't sent should still be on disk")
+	atomic.StoreInt32(&fail, 0)
+	s.flushTraces(context.Background())
+	s.spanBuffer.Close()
+
+	spans := <-received
+	if assert.Len(t, spans, 1) {
+		assert.Equal(t, "buffered", spans[0].Name)
+		assert.Equal(t, int64(1), spans[0].TraceID)
+		assert.Equal(t, int64(2), spans[0].SpanID)
+	}
+
+	s = newServer()
+	assert.Len(t, s.spanBuffer.spans, 0, "delivered spans should not be replayed again")
+}
+
+func TestDatadogAPIVersions(t *testing.T) {
+	type request struct {
+		path   string
+		apiKey string
+		body   map[string][]map[string]interface{}
+	}
+	received := make(chan request, 1)
+	remoteServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		zr, err := zlib.NewReader(r.Body)
+		assert.NoError(t, err)
+		req := request{path: r.URL.Path, apiKey: r.Header.Get("DD-API-KEY")}
+		if r.URL.Query().Get("api_key") != "" {
+			req.apiKey = r.URL.Query().Get("api_key")
+		}
+		assert.NoError(t, json.NewDecoder(zr).Decode(&req.body))
+		received <- req
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer remoteServer.Close()
+
+	metrics := []samplers.DDMetric{{
+		Name:       "a.b.c",
+		Value:      [1][2]float64{{1476119058, 2.5}},
+		Tags:       []string{"foo:bar"},
+		MetricType: "rate",
+		Hostname:   "globalstats",
+		DeviceName: "sda",
+		Interval:   10,
+	}}
+
+	for _, parallelism := range []int{1, 2} {
+		s := &Server{
+			HTTPClient:               &http.Client{},
+			DDHostname:               remoteServer.URL,
+			DDAPIKey:                 "secret",
+			FlushMaxPerBody:          10,
+			serializationParallelism: parallelism,
+		}
+
+		s.ddAPIVersion = datadogAPIVersion1
+		s.flushRemote(metrics)
+		req := <-received
+		assert.Equal(t, "/api/v1/series", req.path)
+		assert.Equal(t, "secret", req.apiKey)
+		if assert.Len(t, req.body["series"], 2, "should send the metric and the heartbeat") {
+			series := req.body["series"][0]
+			assert.Equal(t, "a.b.c", series["metric"])
+			assert.Equal(t, "rate", series["type"])
+			assert.Equal(t, []interface{}{[]interface{}{1476119058.0, 2.5}}, series["points"])
+			assert.Equal(t, "globalstats", series["host"])
+			assert.Equal(t, "sda", series["device_name"])
+		}
+
+		s.ddAPIVersion = datadogAPIVersion2
+		s.flushRemote(metrics)
+		req = <-received
+		assert.Equal(t, "/api/v2/series", req.path)
+		assert.Equal(t, "secret", req.apiKey, "v2 should authenticate with a header")
+		if assert.Len(t, req.body["series"], 2, "should send the metric and the heartbeat") {
+			series := req.body["series"][0]
+			assert.Equal(t, "a.b.c", series["metric"])
+			assert.Equal(t, 2.0, series["type"], "rates are type 2 in v2")
+			assert.Equal(t, 10.0, series["interval"])
+			assert.Equal(t, []interface{}{map[string]interface{}{"timestamp": 1476119058.0, "value": 2.5}}, series["points"])
+			assert.Equal(t, []interface{}{"foo:bar", "device:sda"}, series["tags"])
+			assert.Equal(t, []interface{}{map[string]interface{}{"name": "globalstats", "type": "host"}}, series["resources"])
+		}
+	}
+	assert.Equal(t, []string{"foo:bar"}, metrics[0].Tags, "converting to v2 should not modify the metrics")
+}
+
+func TestHeartbeat(t *testing.T) {
+	received := make(chan DDMetricsRequest, 1)
+	remoteServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		zr, err := zlib.NewReader(r.Body)
+		assert.NoError(t, err)
+		var ddmetrics DDMetricsRequest
+		assert.NoError(t, json.NewDecoder(zr).Decode(&ddmetrics))
+		received <- ddmetrics
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer remoteServer.Close()
+
+	config := localConfig()
+	config.APIHostname = remoteServer.URL
+	s, err := NewFromConfig(config)
+	assert.NoError(t, err)
+
+	// nothing was received, but the flush should still post the heartbeat
+	s.Flush()
+	select {
+	case ddmetrics := <-received:
+		if !assert.Len(t, ddmetrics.Series, 1) {
+			return
+		}
+		heartbeat := ddmetrics.Series[0]
+		assert.Equal(t, "veneur.heartbeat", heartbeat.Name)
+		assert.Equal(t, "gauge", heartbeat.MetricType)
+		assert.Equal(t, 1.0, heartbeat.Value[0][1])
+		assert.Equal(t, s.Hostname, heartbeat.Hostname)
+		assert.Contains(t, heartbeat.Tags, "veneur_instance:"+s.Hostname)
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the heartbeat")
+	}
+}
+
+func TestDatadogAPIVersionValidation(t *testing.T) {
+	config := globalConfig()
+	config.DatadogAPIVersion = "v3"
+	_, err := NewFromConfig(config)
+	assert.Error(t, err, "unsupported versions should be rejected")
+}
+
+func generateDDMetrics(n int) []samplers.DDMetric {
+	metrics := make([]samplers.DDMetric, n)
+	for i := range metrics {
+		metrics[i] = samplers.DDMetric{
+			Name:       fmt.Sprintf("a.b.c.%d", i),
+			Value:      [1][2]float64{{1476119058, float64(i) / 3}},
+			Tags:       []string{"foo:bar", "<html>&escaped"},
+			MetricType: "gauge",
+			Hostname:   "globalstats",
+			Interval:   10,
+		}
+	}
+	return metrics
+}
+
+func TestMarshalSeriesParallel(t *testing.T) {
+	for _, n := range []int{0, 1, 2, 7, 1000} {
+		metrics := generateDDMetrics(n)
+		var serial bytes.Buffer
+		err := json.NewEncoder(&serial).Encode(map[string][]samplers.DDMetric{"series": metrics})
+		assert.NoError(t, err)
+
+		for _, parallelism := range []int{1, 2, 3, 8, 2000} {
+			parallel, err := marshalSeries(metrics, parallelism)
+			assert.NoError(t, err)
+			assert.Equal(t, serial.String(), string(parallel), "%d metrics with parallelism %d", n, parallelism)
+		}
+	}
+}
+
+func BenchmarkMarshalSeries(b *testing.B) {
+	metrics := generateDDMetrics(50000)
+	for _, parallelism := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("parallelism=%d", parallelism), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := marshalSeries(metrics, parallelism); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestAggregationBytesEstimate(t *testing.T) {
+	stats, packets := newStatsdCapture(t)
+	s := &Server{Statsd: stats, Workers: []*Worker{NewWorker(0, nil, logrus.New())}}
+
+	// reads the next reported estimate for counters
+	nextEstimate := func() float64 {
+		const prefix = "veneur.aggregation.bytes_estimate:"
+		for packet := range packets {
+			if strings.HasPrefix(packet, prefix) && strings.HasSuffix(packet, "|g|#metric_type:counter") {
+				value, err := strconv.ParseFloat(strings.SplitN(packet[len(prefix):], "|", 2)[0], 64)
+				assert.NoError(t, err)
+				return value
+			}
+		}
+		t.Fatal("no estimate was reported")
+		return 0
+	}
+	ingest := func(n int) {
+		for i := 0; i < n; i++ {
+			m, err := samplers.ParseMetric([]byte(fmt.Sprintf("a.b.c:1|c|#series:%d", i)))
+			assert.NoError(t, err)
+			s.Workers[0].ProcessMetric(m)
+		}
+		tempMetrics, _ := s.tallyMetrics(nil)
+		s.reportAggregationBytes(tempMetrics)
+	}
+
+	ingest(10)
+	small := nextEstimate()
+	ingest(100)
+	large := nextEstimate()
+	assert.True(t, small > 0, "estimate should be positive")
+	assert.True(t, large > 5*small, "estimate should grow with the number of series: %v vs %v", small, large)
+}
+
+// kafkaProducer is a Kafka producer that sends what it's given on a channel.
+type kafkaProducer chan []kafka.Message
+
+func (kp kafkaProducer) Produce(messages []kafka.Message) error {
+	kp <- messages
+	return nil
+}
+
+func TestFlushTracesKafka(t *testing.T) {
+	config := globalConfig()
+	config.TraceAPIAddress = ""
+	config.KafkaBroker = "localhost:9092"
+	config.KafkaSpanTopic = "spans"
+	config.SpanTagRedactionPatterns = []string{`\d{4}-\d{4}`}
+
+	server := setupVeneurServer(t, config, nil)
+	defer server.Shutdown()
+	assert.True(t, server.TracingEnabled(), "a span topic should enable tracing")
+	for _, p := range server.getPlugins() {
+		assert.NotEqual(t, "kafka", p.Name(), "metrics should only be published with a metric topic")
+	}
+	produced := make(kafkaProducer, 1)
+	server.kafkaSpans.Producer = produced
+
+	sample := trace.StartTrace("GET /cart").SSFSample()
+	sample.Tags = []*ssf.SSFTag{{Name: "card", Value: "1234-5678"}}
+	packet, err := proto.Marshal(sample)
+	assert.NoError(t, err)
+	server.HandleTracePacket(packet)
+	server.Flush()
+
+	select {
+	case messages := <-produced:
+		if assert.Len(t, messages, 1) {
+			assert.Equal(t, "spans", messages[0].Topic)
+			assert.Equal(t, strconv.FormatInt(sample.Trace.TraceId, 10), string(messages[0].Key))
+			published := &ssf.SSFSample{}
+			assert.NoError(t, proto.Unmarshal(messages[0].Value, published))
+			if assert.Len(t, published.Tags, 1) {
+				assert.Equal(t, redactedValue, published.Tags[0].Value, "span tags should be redacted before they're published")
+			}
+		}
+	case <-time.After(10 * time.Second):
+		assert.Fail(t, "no spans were published to Kafka")
+	}
+}
@@ -0,0 +1,61 @@
+package veneur
+
+import (
+	"io"
+	"net"
+	"sync"
+
+	"github.com/stripe/veneur/ssf"
+	"google.golang.org/grpc/peer"
+)
+
+// grpcLogOnce sends gRPC's own logging to Veneur's log, once, since
+// grpclog.SetLogger can't be called while gRPC is running.
+var grpcLogOnce sync.Once
+
+// grpcSpanServer receives spans on grpc_address, and sends them down the same
+// path as HandleTracePacket.
+type grpcSpanServer struct {
+	server *Server
+}
+
+// SendSpans reads the spans of one stream until the client closes it, then
+// replies with how many were accepted and how many were rejected. Spans are
+// rejected if tracing is disabled or they're over max_packets_per_second;
+// accepted spans can still be dropped by sampling or for their service, as
+// they would be over UDP.
+func (g grpcSpanServer) SendSpans(stream ssf.SpanIngest_SendSpansServer) error {
+	s := g.server
+	defer func() {
+		ConsumePanic(s.Sentry, s.Statsd, s.Hostname, recover())
+	}()
+	s.Statsd.Count("grpc.streams_total", 1, nil, 1.0)
+
+	var addr net.Addr
+	if p, ok := peer.FromContext(stream.Context()); ok {
+		addr = p.Addr
+	}
+	counts := &ssf.SSFSpanCounts{}
+	for {
+		sample, err := stream.Recv()
+		if err == io.EOF {
+			return stream.SendAndClose(counts)
+		}
+		if err != nil {
+			// usually the client went away, or the server is shutting down
+			log.WithError(err).WithField("peer", addr).Info("Error reading from gRPC span stream")
+			return err
+		}
+		if !s.TracingEnabled() {
+			s.Statsd.Count("packet.error_total", 1, []string{"packet_type:trace", "reason:tracing_disabled"}, 1.0)
+			counts.Rejected++
+			continue
+		}
+		if !s.ingestLimiter.Allow(addr) {
+			counts.Rejected++
+			continue
+		}
+		s.handleSpan(sample)
+		counts.Accepted++
+	}
+}
@@ -0,0 +1,85 @@
+package veneur
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stripe/veneur/ssf"
+	"google.golang.org/grpc"
+)
+
+// sendSpansGRPC streams n spans to addr over gRPC, and returns the counts
+// that the server replied with.
+func sendSpansGRPC(t *testing.T, addr string, n int64) *ssf.SSFSpanCounts {
+	conn, err := grpc.Dial(addr, grpc.WithInsecure(), grpc.WithBlock(), grpc.WithTimeout(5*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	stream, err := ssf.NewSpanIngestClient(conn).SendSpans(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id := int64(1); id <= n; id++ {
+		assert.NoError(t, stream.Send(&ssf.SSFSample{
+			Metric:  ssf.SSFSample_TRACE,
+			Name:    "veneur.trace.test",
+			Service: "veneur",
+			Trace:   &ssf.SSFTrace{TraceId: 1, Id: id},
+		}))
+	}
+	counts, err := stream.CloseAndRecv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return counts
+}
+
+// TestGRPCSpans streams spans to a running server's grpc_address, and checks
+// that they reach the trace worker, and that Shutdown stops the listener.
+func TestGRPCSpans(t *testing.T) {
+	config := localConfig()
+	config.GRPCAddress = fmt.Sprintf("127.0.0.1:%d", HTTPAddrPort)
+	HTTPAddrPort++
+	f := newFixture(t, config)
+	defer f.Close()
+
+	counts := sendSpansGRPC(t, config.GRPCAddress, 3)
+	assert.Equal(t, &ssf.SSFSpanCounts{Accepted: 3}, counts)
+	waitForSpans(t, 3, f.server.TraceWorker)
+
+	f.Close()
+	_, err := net.Dial("tcp", config.GRPCAddress)
+	assert.Error(t, err, "Shutdown should stop the gRPC listener")
+}
+
+func TestGRPCSpansRejected(t *testing.T) {
+	s := &Server{
+		TraceWorker:   &TraceWorker{TraceChan: make(chan ssf.SSFSample, 10)},
+		ingestLimiter: newIngestLimiter(2, false),
+	}
+	now := time.Now()
+	s.ingestLimiter.now = func() time.Time { return now }
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	ssf.RegisterSpanIngestServer(server, grpcSpanServer{s})
+	go server.Serve(listener)
+	defer server.Stop()
+
+	counts := sendSpansGRPC(t, listener.Addr().String(), 3)
+	assert.Equal(t, &ssf.SSFSpanCounts{Accepted: 2, Rejected: 1}, counts, "spans over max_packets_per_second should be rejected")
+	assert.Len(t, s.TraceWorker.TraceChan, 2)
+
+	s.TraceWorker = nil
+	counts = sendSpansGRPC(t, listener.Addr().String(), 1)
+	assert.Equal(t, &ssf.SSFSpanCounts{Rejected: 1}, counts, "spans should be rejected while tracing is disabled")
+}
@@ -12,6 +12,7 @@ import (
 	"time"
 
 	"github.com/DataDog/datadog-go/statsd"
+	"github.com/Sirupsen/logrus"
 	"github.com/stripe/veneur/samplers"
 	"github.com/stripe/veneur/trace"
 )
@@ -25,7 +26,7 @@ func (ch contextHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 func handleProxy(p *Proxy) http.Handler {
 	return contextHandler(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
-		span, jsonMetrics, err := unmarshalMetricsFromHTTP(ctx, p.Statsd, w, r)
+		span, jsonMetrics, err := unmarshalMetricsFromHTTP(ctx, p.Statsd, nil, w, r)
 		if err != nil {
 			return
 		}
@@ -52,7 +53,7 @@ func handleSpans(p *Proxy) http.Handler {
 // metrics to the global veneur instance.
 func handleImport(s *Server) http.Handler {
 	return contextHandler(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
-		span, jsonMetrics, err := unmarshalMetricsFromHTTP(ctx, s.Statsd, w, r)
+		span, jsonMetrics, err := unmarshalMetricsFromHTTP(ctx, s.Statsd, s.importWindow, w, r)
 		if err != nil {
 			return
 		}
@@ -107,7 +108,9 @@ func handleTraceRequest(ctx context.Context, stats *statsd.Client, w http.Respon
 
 // unmarshalMetricsFromHTTP takes care of the common need to unmarshal a slice of metrics from a request body,
 // dealing with error handling, decoding, tracing, and the associated metrics.
-func unmarshalMetricsFromHTTP(ctx context.Context, stats *statsd.Client, w http.ResponseWriter, r *http.Request) (*trace.Span, []samplers.JSONMetric, error) {
+// Metrics outside window are rejected with a 400 that lists them, and the
+// rest are returned; a nil window accepts every metric.
+func unmarshalMetricsFromHTTP(ctx context.Context, stats *statsd.Client, window *importWindow, w http.ResponseWriter, r *http.Request) (*trace.Span, []samplers.JSONMetric, error) {
 	var (
 		jsonMetrics []samplers.JSONMetric
 		body        io.ReadCloser
@@ -178,7 +181,27 @@ func unmarshalMetricsFromHTTP(ctx context.Context, stats *statsd.Client, w http.
 		return nil, nil, err
 	}
 
-	w.WriteHeader(http.StatusAccepted)
+	jsonMetrics, rejected := window.Filter(jsonMetrics, time.Now())
+	if len(rejected) > 0 {
+		for _, rejection := range rejected {
+			stats.Count("import.rejected_total", 1, []string{"cause:" + rejection.cause}, 1.0)
+		}
+		innerLogger.WithFields(logrus.Fields{
+			"rejected": len(rejected),
+			"accepted": len(jsonMetrics),
+		}).Warn("Rejected imported metrics with timestamps outside the import window")
+		// the rest are still imported, so the request only fails if
+		// nothing was; either way the body says what was rejected
+		status := http.StatusAccepted
+		if len(jsonMetrics) == 0 {
+			status = http.StatusBadRequest
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(importResponse{Accepted: len(jsonMetrics), Rejected: rejected})
+	} else {
+		w.WriteHeader(http.StatusAccepted)
+	}
 	stats.TimeInMilliseconds("import.response_duration_ns",
 		float64(time.Since(span.Start).Nanoseconds()),
 		[]string{"part:request", fmt.Sprintf("encoding:%s", encoding)},
@@ -187,6 +210,98 @@ func unmarshalMetricsFromHTTP(ctx context.Context, stats *statsd.Client, w http.
 	return span, jsonMetrics, nil
 }
 
+// importWindow bounds how far the timestamps of imported metrics may be
+// from the current time. A zero bound is not checked, and neither are
+// metrics without a timestamp.
+type importWindow struct {
+	maxAge    time.Duration
+	maxFuture time.Duration
+}
+
+// importRejection is an imported metric that was not accepted. index is its
+// position in the request.
+type importRejection struct {
+	Index  int    `json:"index"`
+	Name   string `json:"name"`
+	Status int    `json:"status"`
+	Error  string `json:"error"`
+	cause  string
+}
+
+// importResponse is the body of an /import response that rejected metrics.
+type importResponse struct {
+	Accepted int               `json:"accepted"`
+	Rejected []importRejection `json:"rejected"`
+}
+
+// newImportWindow parses import_max_age and import_max_future. It returns
+// nil if neither is set.
+func newImportWindow(maxAge, maxFuture string) (*importWindow, error) {
+	if maxAge == "" && maxFuture == "" {
+		return nil, nil
+	}
+	window := &importWindow{}
+	for _, bound := range []struct {
+		option string
+		value  string
+		dest   *time.Duration
+	}{
+		{"import_max_age", maxAge, &window.maxAge},
+		{"import_max_future", maxFuture, &window.maxFuture},
+	} {
+		if bound.value == "" {
+			continue
+		}
+		d, err := time.ParseDuration(bound.value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %v", bound.option, err)
+		}
+		if d < 0 {
+			return nil, fmt.Errorf("%s must not be negative, got %v", bound.option, d)
+		}
+		*bound.dest = d
+	}
+	return window, nil
+}
+
+// Filter splits metrics into those whose timestamps are within the window
+// of now, which are returned in place, and those that are not.
+func (iw *importWindow) Filter(metrics []samplers.JSONMetric, now time.Time) ([]samplers.JSONMetric, []importRejection) {
+	if iw == nil {
+		return metrics, nil
+	}
+	var rejected []importRejection
+	accepted := metrics[:0]
+	for i, metric := range metrics {
+		if metric.Timestamp == 0 {
+			accepted = append(accepted, metric)
+			continue
+		}
+		offset := time.Unix(metric.Timestamp, 0).Sub(now)
+		switch {
+		case iw.maxAge > 0 && -offset > iw.maxAge:
+			rejected = append(rejected, importRejection{
+				Index:  i,
+				Name:   metric.Name,
+				Status: http.StatusBadRequest,
+				Error:  fmt.Sprintf("timestamp %d is more than %v old", metric.Timestamp, iw.maxAge),
+				cause:  "too_old",
+			})
+		case iw.maxFuture > 0 && offset > iw.maxFuture:
+			rejected = append(rejected, importRejection{
+				Index:  i,
+				Name:   metric.Name,
+				Status: http.StatusBadRequest,
+				Error:  fmt.Sprintf("timestamp %d is more than %v in the future", metric.Timestamp, iw.maxFuture),
+				cause:  "too_new",
+			})
+		default:
+			accepted = append(accepted, metric)
+		}
+	}
+	return accepted, rejected
+}
+
 // nonEmpty returns true if there is at least one non-empty
 // metric
 func nonEmpty(ctx context.Context, jsonMetrics []samplers.JSONMetric) bool {
@@ -0,0 +1,164 @@
+package veneur
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// healthState is what /healthcheck reports: whether the listeners are bound,
+// and how the last flush to each sink went. The listeners record themselves
+// as they bind, and the flush path records each sink's result.
+type healthState struct {
+	mutex sync.Mutex
+	// the primary sink must have flushed successfully within maxAge
+	primary string
+	maxAge  time.Duration
+	started time.Time
+
+	// configured listeners, by config key, and whether they're bound
+	listeners map[string]bool
+	sinks     map[string]*sinkHealth
+}
+
+// sinkHealth is the result of the last flush to a sink.
+type sinkHealth struct {
+	lastSuccess time.Time
+	lastError   error
+}
+
+// healthReport is the body of an unhealthy /healthcheck response.
+type healthReport struct {
+	Healthy   bool                        `json:"healthy"`
+	Listeners map[string]bool             `json:"listeners"`
+	Sinks     map[string]sinkHealthReport `json:"sinks"`
+	Problems  []string                    `json:"problems"`
+}
+
+type sinkHealthReport struct {
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+}
+
+// newHealthState returns a healthState requiring primary to have flushed
+// within maxAge. The primary sink is given maxAge from now to flush for the
+// first time.
+func newHealthState(primary string, maxAge time.Duration, now time.Time) *healthState {
+	return &healthState{
+		primary:   primary,
+		maxAge:    maxAge,
+		started:   now,
+		listeners: make(map[string]bool),
+		sinks:     make(map[string]*sinkHealth),
+	}
+}
+
+// ExpectListener records that the listener for the config key name is
+// configured, and unhealthy until ListenerBound is called.
+func (h *healthState) ExpectListener(name string) {
+	if h == nil {
+		return
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if _, ok := h.listeners[name]; !ok {
+		h.listeners[name] = false
+	}
+}
+
+// ListenerBound records that the listener for the config key name is bound.
+func (h *healthState) ListenerBound(name string) {
+	if h == nil {
+		return
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.listeners[name] = true
+}
+
+// ListenerFailed records that the listener for the config key name can't
+// receive anything, until ListenerBound is called again.
+func (h *healthState) ListenerFailed(name string) {
+	if h == nil {
+		return
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.listeners[name] = false
+}
+
+// SetMaxAge changes how recently the primary sink must have flushed.
+func (h *healthState) SetMaxAge(maxAge time.Duration) {
+	if h == nil {
+		return
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.maxAge = maxAge
+}
+
+// FlushFinished records the result of a flush to sink.
+func (h *healthState) FlushFinished(sink string, err error, now time.Time) {
+	if h == nil {
+		return
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	sh, ok := h.sinks[sink]
+	if !ok {
+		sh = &sinkHealth{}
+		h.sinks[sink] = sh
+	}
+	sh.lastError = err
+	if err == nil {
+		sh.lastSuccess = now
+	}
+}
+
+// Check reports whether every expected listener is bound and the last flush
+// to the primary sink succeeded within maxAge of now. Other sinks are
+// included in the report, but don't make Veneur unhealthy.
+func (h *healthState) Check(now time.Time) healthReport {
+	if h == nil {
+		return healthReport{Healthy: true}
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	report := healthReport{
+		Listeners: make(map[string]bool, len(h.listeners)),
+		Sinks:     make(map[string]sinkHealthReport, len(h.sinks)),
+	}
+	for name, bound := range h.listeners {
+		report.Listeners[name] = bound
+		if !bound {
+			report.Problems = append(report.Problems, fmt.Sprintf("%s is not bound", name))
+		}
+	}
+	for name, sh := range h.sinks {
+		var sr sinkHealthReport
+		if !sh.lastSuccess.IsZero() {
+			lastSuccess := sh.lastSuccess
+			sr.LastSuccess = &lastSuccess
+		}
+		if sh.lastError != nil {
+			sr.LastError = sh.lastError.Error()
+		}
+		report.Sinks[name] = sr
+	}
+
+	primary, ok := h.sinks[h.primary]
+	switch {
+	case ok && primary.lastError != nil:
+		report.Problems = append(report.Problems, fmt.Sprintf("the last flush to %s failed: %v", h.primary, primary.lastError))
+	case ok && now.Sub(primary.lastSuccess) > h.maxAge:
+		report.Problems = append(report.Problems, fmt.Sprintf("%s has not flushed since %s", h.primary, primary.lastSuccess.Format(time.RFC3339)))
+	case !ok && now.Sub(h.started) > h.maxAge:
+		report.Problems = append(report.Problems, fmt.Sprintf("%s has never flushed", h.primary))
+	}
+
+	sort.Strings(report.Problems)
+	report.Healthy = len(report.Problems) == 0
+	return report
+}
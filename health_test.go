@@ -0,0 +1,49 @@
+package veneur
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealthStateListeners(t *testing.T) {
+	start := time.Now()
+	h := newHealthState("datadog", 20*time.Second, start)
+	h.ExpectListener("udp_address")
+	assert.False(t, h.Check(start).Healthy, "a listener that isn't bound should be unhealthy")
+
+	h.ListenerBound("udp_address")
+	assert.True(t, h.Check(start).Healthy)
+	h.ExpectListener("udp_address")
+	assert.True(t, h.Check(start).Healthy, "expecting a bound listener again shouldn't unbind it")
+}
+
+func TestHealthStateFlushAge(t *testing.T) {
+	start := time.Now()
+	h := newHealthState("datadog", 20*time.Second, start)
+	assert.True(t, h.Check(start.Add(10*time.Second)).Healthy, "the primary sink should have time to flush")
+	assert.False(t, h.Check(start.Add(30*time.Second)).Healthy, "the primary sink should have flushed by now")
+
+	h.FlushFinished("datadog", nil, start.Add(30*time.Second))
+	assert.True(t, h.Check(start.Add(40*time.Second)).Healthy)
+	assert.False(t, h.Check(start.Add(60*time.Second)).Healthy, "the last flush is too old")
+
+	h.FlushFinished("kafka", errors.New("broker down"), start.Add(40*time.Second))
+	report := h.Check(start.Add(40 * time.Second))
+	assert.True(t, report.Healthy, "only the primary sink should make Veneur unhealthy")
+	assert.Equal(t, "broker down", report.Sinks["kafka"].LastError)
+
+	h.FlushFinished("datadog", errors.New("503"), start.Add(45*time.Second))
+	report = h.Check(start.Add(45 * time.Second))
+	assert.False(t, report.Healthy, "the last flush to the primary sink failed")
+	assert.Len(t, report.Problems, 1)
+}
+
+func TestHealthStateNil(t *testing.T) {
+	var h *healthState
+	h.ExpectListener("udp_address")
+	h.FlushFinished("datadog", errors.New("503"), time.Now())
+	assert.True(t, h.Check(time.Now()).Healthy)
+}
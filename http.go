@@ -1,7 +1,7 @@
 package veneur
 
 import (
-	"hash/fnv"
+	"encoding/json"
 	"net/http"
 	"net/http/pprof"
 	"sort"
@@ -27,9 +27,19 @@ func (s *Server) Handler() http.Handler {
 		}
 		return http.HandlerFunc(mw)
 	})
+	if s.httpAuth != nil {
+		mux.Use(s.httpAuth.Middleware)
+	}
 
 	mux.HandleFuncC(pat.Get("/healthcheck"), func(c context.Context, w http.ResponseWriter, r *http.Request) {
-		w.Write([]byte("ok\n"))
+		report := s.health.Check(time.Now())
+		if report.Healthy {
+			w.Write([]byte("ok\n"))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(report)
 	})
 
 	mux.HandleFuncC(pat.Get("/healthcheck/tracing"), func(c context.Context, w http.ResponseWriter, r *http.Request) {
@@ -41,6 +51,20 @@ func (s *Server) Handler() http.Handler {
 		}
 	})
 
+	mux.HandleFuncC(pat.Post("/reload"), func(c context.Context, w http.ResponseWriter, r *http.Request) {
+		if s.ConfigFile == "" {
+			http.Error(w, "no config file to reload", http.StatusForbidden)
+			return
+		}
+		if err := s.reloadConfigFile(); err != nil {
+			s.Statsd.Count("config.reload_error_total", 1, nil, 1.0)
+			log.WithError(err).Error("Could not reload the config, keeping the previous one")
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("ok\n"))
+	})
+
 	mux.Handle(pat.Post("/import"), handleImport(s))
 
 	mux.Handle(pat.Get("/debug/pprof/cmdline"), http.HandlerFunc(pprof.Cmdline))
@@ -58,13 +82,17 @@ func (s *Server) ImportMetrics(ctx context.Context, jsonMetrics []samplers.JSONM
 	span, _ := trace.StartSpanFromContext(ctx, "veneur.opentracing.import.import_metrics")
 	defer span.Finish()
 
+	for i := range jsonMetrics {
+		jsonMetrics[i].Name = s.normalizedName(jsonMetrics[i].Name)
+	}
+
 	// we have a slice of json metrics that we need to divide up across the workers
 	// we don't want to push one metric at a time (too much channel contention
 	// and goroutine switching) and we also don't want to allocate a temp
 	// slice for each worker (which we'll have to append to, therefore lots
 	// of allocations)
-	// instead, we'll compute the fnv hash of every metric in the array,
-	// and sort the array by the hashes
+	// instead, we'll compute the worker of every metric in the array, from
+	// the hash of its name, and sort the array by worker
 	sortedIter := newJSONMetricsByWorker(jsonMetrics, len(s.Workers))
 	for sortedIter.Next() {
 		nextChunk, workerIndex := sortedIter.Chunk()
@@ -85,11 +113,7 @@ func newSortableJSONMetrics(metrics []samplers.JSONMetric, numWorkers int) *sort
 		workerIndices: make([]uint32, 0, len(metrics)),
 	}
 	for _, j := range metrics {
-		h := fnv.New32a()
-		h.Write([]byte(j.Name))
-		h.Write([]byte(j.Type))
-		h.Write([]byte(j.JoinedTags))
-		ret.workerIndices = append(ret.workerIndices, h.Sum32()%uint32(numWorkers))
+		ret.workerIndices = append(ret.workerIndices, workerIndex(j.Name, numWorkers))
 	}
 	return &ret
 }
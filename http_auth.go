@@ -0,0 +1,63 @@
+package veneur
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/DataDog/datadog-go/statsd"
+)
+
+// httpAuth rejects requests to the HTTP server that present neither the
+// bearer token nor, when client certificates are accepted, a certificate
+// verified against http_tls_authority_certificate.
+type httpAuth struct {
+	// the expected Authorization header; empty if tokens aren't accepted
+	header string
+	// whether requests with a verified client certificate are accepted
+	clientCerts bool
+	// whether the healthchecks can be requested without authenticating, eg
+	// by load balancers
+	exemptHealthcheck bool
+
+	stats *statsd.Client
+}
+
+func newHTTPAuth(token string, clientCerts, exemptHealthcheck bool, stats *statsd.Client) *httpAuth {
+	a := &httpAuth{
+		clientCerts:       clientCerts,
+		exemptHealthcheck: exemptHealthcheck,
+		stats:             stats,
+	}
+	if token != "" {
+		a.header = "Bearer " + token
+	}
+	return a
+}
+
+// Authorized reports whether r may be served.
+func (a *httpAuth) Authorized(r *http.Request) bool {
+	if a.exemptHealthcheck && (r.URL.Path == "/healthcheck" || strings.HasPrefix(r.URL.Path, "/healthcheck/")) {
+		return true
+	}
+	if a.clientCerts && r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		return true
+	}
+	return a.header != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(a.header)) == 1
+}
+
+// Middleware responds to unauthorized requests with a 401, and passes the
+// rest on to h.
+func (a *httpAuth) Middleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !a.Authorized(r) {
+			a.stats.Count("http.unauthorized_total", 1, nil, 1.0)
+			if a.header != "" {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="veneur"`)
+			}
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
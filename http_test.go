@@ -3,15 +3,30 @@ package veneur
 import (
 	"bytes"
 	"compress/gzip"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"sort"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/Sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	"github.com/stripe/veneur/samplers"
 )
@@ -25,13 +40,13 @@ func TestSortableJSONMetrics(t *testing.T) {
 	}
 
 	sortable := newSortableJSONMetrics(testList, 96)
-	assert.EqualValues(t, []uint32{0x4f, 0x3a, 0x2, 0x3c}, sortable.workerIndices, "should have hashed correctly")
+	assert.EqualValues(t, []uint32{0x57, 0x1a, 0x22, 0x9}, sortable.workerIndices, "should have hashed correctly")
 
 	sort.Sort(sortable)
 	assert.EqualValues(t, []samplers.JSONMetric{
-		samplers.JSONMetric{MetricKey: samplers.MetricKey{Name: "baz", Type: "counter"}},
-		samplers.JSONMetric{MetricKey: samplers.MetricKey{Name: "bar", Type: "set"}},
 		samplers.JSONMetric{MetricKey: samplers.MetricKey{Name: "qux", Type: "gauge"}},
+		samplers.JSONMetric{MetricKey: samplers.MetricKey{Name: "bar", Type: "set"}},
+		samplers.JSONMetric{MetricKey: samplers.MetricKey{Name: "baz", Type: "counter"}},
 		samplers.JSONMetric{MetricKey: samplers.MetricKey{Name: "foo", Type: "histogram"}},
 	}, testList, "should have sorted the metrics by hashes")
 }
@@ -47,9 +62,13 @@ func TestSortableJSONMetricHashing(t *testing.T) {
 		},
 	}
 
-	sortable := newSortableJSONMetrics(testList, 96)
+	s := &Server{Workers: make([]*Worker, 96)}
+	for i := range s.Workers {
+		s.Workers[i] = NewWorker(i+1, nil, logrus.New())
+	}
+	sortable := newSortableJSONMetrics(testList, len(s.Workers))
 	assert.Equal(t, 1, sortable.Len(), "should have exactly 1 metric")
-	assert.Equal(t, packet.Digest%96, sortable.workerIndices[0], "should have had the same hash")
+	assert.Equal(t, s.workerFor(packet), s.Workers[sortable.workerIndices[0]], "should have been imported by the worker that aggregates it")
 }
 
 func TestIteratingByWorker(t *testing.T) {
@@ -77,16 +96,16 @@ func TestIteratingByWorker(t *testing.T) {
 
 	assert.EqualValues(t, [][]samplers.JSONMetric{
 		[]samplers.JSONMetric{
-			samplers.JSONMetric{MetricKey: samplers.MetricKey{Name: "baz", Type: "counter"}},
-			samplers.JSONMetric{MetricKey: samplers.MetricKey{Name: "baz", Type: "counter"}},
+			samplers.JSONMetric{MetricKey: samplers.MetricKey{Name: "qux", Type: "gauge"}},
+			samplers.JSONMetric{MetricKey: samplers.MetricKey{Name: "qux", Type: "gauge"}},
 		},
 		[]samplers.JSONMetric{
 			samplers.JSONMetric{MetricKey: samplers.MetricKey{Name: "bar", Type: "set"}},
 			samplers.JSONMetric{MetricKey: samplers.MetricKey{Name: "bar", Type: "set"}},
 		},
 		[]samplers.JSONMetric{
-			samplers.JSONMetric{MetricKey: samplers.MetricKey{Name: "qux", Type: "gauge"}},
-			samplers.JSONMetric{MetricKey: samplers.MetricKey{Name: "qux", Type: "gauge"}},
+			samplers.JSONMetric{MetricKey: samplers.MetricKey{Name: "baz", Type: "counter"}},
+			samplers.JSONMetric{MetricKey: samplers.MetricKey{Name: "baz", Type: "counter"}},
 		},
 		[]samplers.JSONMetric{
 			samplers.JSONMetric{MetricKey: samplers.MetricKey{Name: "foo", Type: "histogram"}},
@@ -110,7 +129,7 @@ func testServerImport(t *testing.T, filename string, contentEncoding string) {
 	s := setupVeneurServer(t, config, nil)
 	defer s.Shutdown()
 
-	handler := handleImport(&s)
+	handler := handleImport(s)
 	handler.ServeHTTP(w, r)
 
 	assert.Equal(t, http.StatusAccepted, w.Code, "Test server returned wrong HTTP response code")
@@ -151,7 +170,7 @@ func TestServerImportGzip(t *testing.T) {
 	s := setupVeneurServer(t, config, nil)
 	defer s.Shutdown()
 
-	handler := handleImport(&s)
+	handler := handleImport(s)
 	handler.ServeHTTP(w, r)
 
 	assert.Equal(t, http.StatusUnsupportedMediaType, w.Code, "Test server returned wrong HTTP response code")
@@ -176,7 +195,7 @@ func TestServerImportCompressedInvalid(t *testing.T) {
 	s := setupVeneurServer(t, config, nil)
 	defer s.Shutdown()
 
-	handler := handleImport(&s)
+	handler := handleImport(s)
 	handler.ServeHTTP(w, r)
 
 	assert.Equal(t, http.StatusBadRequest, w.Code, "Test server returned wrong HTTP response code")
@@ -201,7 +220,7 @@ func TestServerImportUncompressedInvalid(t *testing.T) {
 	s := setupVeneurServer(t, config, nil)
 	defer s.Shutdown()
 
-	handler := handleImport(&s)
+	handler := handleImport(s)
 	handler.ServeHTTP(w, r)
 
 	assert.Equal(t, http.StatusBadRequest, w.Code, "Test server returned wrong HTTP response code")
@@ -248,19 +267,99 @@ func TestServerImportEmptyListError(t *testing.T) {
 	testServerImportHelper(t, data)
 }
 
-func TestGeneralHealthCheck(t *testing.T) {
-	r := httptest.NewRequest(http.MethodGet, "/healthcheck", nil)
+// TestServerImportOutOfWindow tests that the global veneur instance rejects
+// imported metrics whose timestamps are outside import_max_age and
+// import_max_future, and imports the rest.
+func TestServerImportOutOfWindow(t *testing.T) {
+	counter := samplers.NewCounter("a.b.c", nil)
+	counter.Sample(5, 1.0)
+	jm, err := counter.Export()
+	assert.NoError(t, err)
+
+	now := time.Now().Unix()
+	data := make([]samplers.JSONMetric, 4)
+	for i, timestamp := range []int64{now, now - 3600, now + 3600, 0} {
+		data[i] = jm
+		data[i].Timestamp = timestamp
+	}
+	var b bytes.Buffer
+	assert.NoError(t, json.NewEncoder(&b).Encode(data))
+
+	r := httptest.NewRequest(http.MethodPost, "/import", &b)
+	w := httptest.NewRecorder()
 
 	config := localConfig()
+	config.ImportMaxAge = "10m"
+	config.ImportMaxFuture = "1m"
 	s := setupVeneurServer(t, config, nil)
 	defer s.Shutdown()
+	HTTPAddrPort++
 
-	w := httptest.NewRecorder()
+	handler := handleImport(s)
+	handler.ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusAccepted, w.Code, "a partly rejected import should still be accepted")
+	var response struct {
+		Accepted int `json:"accepted"`
+		Rejected []struct {
+			Index  int    `json:"index"`
+			Name   string `json:"name"`
+			Status int    `json:"status"`
+		} `json:"rejected"`
+	}
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+	assert.Equal(t, 2, response.Accepted)
+	if assert.Len(t, response.Rejected, 2) {
+		assert.Equal(t, 1, response.Rejected[0].Index)
+		assert.Equal(t, 2, response.Rejected[1].Index)
+		assert.Equal(t, "a.b.c", response.Rejected[0].Name)
+		assert.Equal(t, http.StatusBadRequest, response.Rejected[0].Status)
+	}
+
+	// the metrics in the window, and the one without a timestamp, are
+	// still imported
+	window, err := newImportWindow("10m", "1m")
+	assert.NoError(t, err)
+	accepted, rejected := window.Filter(data, time.Now())
+	assert.Len(t, accepted, 2)
+	assert.Len(t, rejected, 2)
+	assert.Equal(t, "too_old", rejected[0].cause)
+	assert.Equal(t, "too_new", rejected[1].cause)
+
+	// a request with nothing to import fails
+	jm.Timestamp = now - 3600
+	b.Reset()
+	assert.NoError(t, json.NewEncoder(&b).Encode([]samplers.JSONMetric{jm}))
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/import", &b))
+	assert.Equal(t, http.StatusBadRequest, w.Code, "an import with every metric rejected should fail")
+
+	_, err = newImportWindow("-1m", "")
+	assert.Error(t, err)
+}
+
+func TestGeneralHealthCheck(t *testing.T) {
+	config := localConfig()
+	s := setupVeneurServer(t, config, nil)
+	defer s.Shutdown()
 
 	handler := s.Handler()
-	handler.ServeHTTP(w, r)
 
-	assert.Equal(t, http.StatusOK, w.Code, "Healthcheck did not succeed")
+	// the healthcheck fails until the UDP listener, which binds in the
+	// background, is ready
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/healthcheck", nil))
+		if w.Code == http.StatusOK {
+			return
+		}
+		if time.Now().After(deadline) {
+			assert.Equal(t, http.StatusOK, w.Code, "Healthcheck did not succeed: %s", w.Body)
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
 }
 
 func TestOkTraceHealthCheck(t *testing.T) {
@@ -296,6 +395,61 @@ func TestNokTraceHealthCheck(t *testing.T) {
 	assert.Equal(t, http.StatusForbidden, w.Code, "Trace healthcheck succeeded when disabled")
 }
 
+// failingTransport fails every request while failing is set, and otherwise
+// accepts it.
+type failingTransport struct {
+	failing int32
+}
+
+func (ft *failingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if atomic.LoadInt32(&ft.failing) == 1 {
+		return nil, errors.New("sink unavailable")
+	}
+	return &http.Response{
+		StatusCode: http.StatusAccepted,
+		Body:       ioutil.NopCloser(strings.NewReader("")),
+		Request:    req,
+	}, nil
+}
+
+func TestHealthCheckSinkFailure(t *testing.T) {
+	config := localConfig()
+	config.Interval = "60s" // only flush when the test does
+	transport := &failingTransport{}
+	s := setupVeneurServer(t, config, transport)
+	defer s.Shutdown()
+	handler := s.Handler()
+
+	healthcheck := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/healthcheck", nil))
+		return w
+	}
+
+	// the UDP listener binds in the background
+	deadline := time.Now().Add(5 * time.Second)
+	for healthcheck().Code != http.StatusOK {
+		if time.Now().After(deadline) {
+			t.Fatalf("never became healthy: %s", healthcheck().Body)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	atomic.StoreInt32(&transport.failing, 1)
+	s.Flush()
+	w := healthcheck()
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code, "a failed flush should be unhealthy")
+	var report healthReport
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&report))
+	assert.False(t, report.Healthy)
+	assert.True(t, report.Listeners["udp_address"])
+	assert.Contains(t, report.Sinks[datadogSinkName].LastError, "sink unavailable")
+
+	atomic.StoreInt32(&transport.failing, 0)
+	s.Flush()
+	assert.Equal(t, http.StatusOK, healthcheck().Code, "a successful flush should be healthy again")
+}
+
 func testServerImportHelper(t *testing.T, data interface{}) {
 	var b bytes.Buffer
 	err := json.NewEncoder(&b).Encode(data)
@@ -311,8 +465,162 @@ func testServerImportHelper(t *testing.T, data interface{}) {
 	defer s.Shutdown()
 	HTTPAddrPort++
 
-	handler := handleImport(&s)
+	handler := handleImport(s)
 	handler.ServeHTTP(w, r)
 
 	assert.Equal(t, http.StatusBadRequest, w.Code, "Test server returned wrong HTTP response code")
 }
+
+func TestHTTPAuthToken(t *testing.T) {
+	config := localConfig()
+	config.HTTPAuthToken = "secret"
+	s, err := NewFromConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := s.Handler()
+
+	request := func(method, path, authorization string) int {
+		r := httptest.NewRequest(method, path, nil)
+		if authorization != "" {
+			r.Header.Set("Authorization", authorization)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+	assert.Equal(t, http.StatusOK, request(http.MethodGet, "/healthcheck", "Bearer secret"))
+	assert.Equal(t, http.StatusUnauthorized, request(http.MethodGet, "/healthcheck", ""))
+	assert.Equal(t, http.StatusUnauthorized, request(http.MethodGet, "/healthcheck", "Bearer wrong"))
+	assert.Equal(t, http.StatusUnauthorized, request(http.MethodGet, "/healthcheck", "secret"))
+	assert.Equal(t, http.StatusUnauthorized, request(http.MethodPost, "/import", ""))
+	assert.Equal(t, http.StatusUnauthorized, request(http.MethodGet, "/debug/pprof/cmdline", ""))
+	assert.Equal(t, http.StatusOK, request(http.MethodGet, "/debug/pprof/cmdline", "Bearer secret"))
+
+	s.httpAuth.exemptHealthcheck = true
+	assert.Equal(t, http.StatusOK, request(http.MethodGet, "/healthcheck", ""))
+	assert.Equal(t, http.StatusOK, request(http.MethodGet, "/healthcheck/tracing", ""))
+	assert.Equal(t, http.StatusUnauthorized, request(http.MethodPost, "/import", ""), "only the healthchecks are exempt")
+}
+
+// testCertificate issues a certificate for localhost, signed by parent, or
+// a self-signed authority if parent is nil. It returns the certificate, and
+// its certificate and key as PEM.
+func testCertificate(t *testing.T, name string, parent *tls.Certificate) (tls.Certificate, string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{Organization: []string{"Example Inc"}, CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := template, interface{}(key)
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	keyPEM := string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+	cert, err := tls.X509KeyPair([]byte(certPEM), []byte(keyPEM))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert.Leaf, err = x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, certPEM, keyPEM
+}
+
+func TestHTTPAuthClientCertificate(t *testing.T) {
+	authority, authorityPEM, _ := testCertificate(t, "Example Certificate Authority", nil)
+	_, serverPEM, serverKeyPEM := testCertificate(t, "localhost", &authority)
+	client, _, _ := testCertificate(t, "Veneur client", &authority)
+	wrongAuthority, _, _ := testCertificate(t, "Wrong Certificate Authority", nil)
+	wrongClient, _, _ := testCertificate(t, "Veneur client", &wrongAuthority)
+
+	config := localConfig()
+	config.HTTPTLSCertificate = serverPEM
+	config.HTTPTLSKey = serverKeyPEM
+	config.HTTPTLSAuthorityCertificate = authorityPEM
+	config.HTTPAuthToken = "secret"
+	s, err := NewFromConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(s.Handler())
+	server.TLS = s.httpTLSConfig
+	server.StartTLS()
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(authority.Leaf)
+	get := func(cert *tls.Certificate, authorization string) (int, error) {
+		tlsConfig := &tls.Config{RootCAs: roots}
+		if cert != nil {
+			tlsConfig.Certificates = []tls.Certificate{*cert}
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+		r, err := http.NewRequest(http.MethodGet, server.URL+"/healthcheck", nil)
+		if err != nil {
+			return 0, err
+		}
+		if authorization != "" {
+			r.Header.Set("Authorization", authorization)
+		}
+		resp, err := client.Do(r)
+		if err != nil {
+			return 0, err
+		}
+		resp.Body.Close()
+		return resp.StatusCode, nil
+	}
+
+	code, err := get(&client, "")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, code, "a verified client certificate should be accepted")
+
+	code, err = get(nil, "")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, code, "requests without a certificate or token should be rejected")
+
+	code, err = get(nil, "Bearer secret")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, code, "the token should still be accepted without a certificate")
+
+	// the client doesn't offer a certificate the server's authority didn't
+	// issue, so either the handshake fails or the request is rejected
+	code, err = get(&wrongClient, "")
+	if err == nil {
+		assert.Equal(t, http.StatusUnauthorized, code, "certificates from another authority should be rejected")
+	}
+}
+
+func TestHTTPTLSConfig(t *testing.T) {
+	config := localConfig()
+	config.HTTPTLSKey = "somekey"
+	_, err := NewFromConfig(config)
+	assert.Error(t, err, "key without certificate is a config error")
+
+	config = localConfig()
+	config.HTTPTLSAuthorityCertificate = "someauthority"
+	_, err = NewFromConfig(config)
+	assert.Error(t, err, "an authority without a key and certificate is a config error")
+}
@@ -0,0 +1,174 @@
+package veneur
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ingestLimitShards is how many parts the per-source buckets are split
+// into, each with its own lock, so that readers handling different sources
+// rarely contend.
+const ingestLimitShards = 32
+
+// ingestLimiter drops packets over max_packets_per_second, so that a flood
+// from a misbehaving client can't exhaust veneur's memory. It is a token
+// bucket holding up to one second of packets, either shared by every sender
+// or, with max_packets_per_second_per_source, one per source IP. It is
+// shared by every read loop, so buckets are updated atomically, and the
+// per-source buckets are sharded rather than guarded by one mutex.
+type ingestLimiter struct {
+	perSecond float64
+	perSource bool
+	// the time a packet uses up, and the time a full bucket holds, in
+	// nanoseconds
+	cost, capacity int64
+	// the clock, replaced in tests
+	now func() time.Time
+
+	// the bucket shared by every source, unless perSource
+	global tokenBucket
+	shards [ingestLimitShards]ingestLimitShard
+	// when idle buckets were last removed, in Unix nanoseconds; updated
+	// atomically
+	swept int64
+
+	// updated atomically
+	dropped int64
+}
+
+// ingestLimitShard holds the buckets of the sources that hash to it.
+type ingestLimitShard struct {
+	mtx     sync.RWMutex
+	buckets map[string]*tokenBucket
+}
+
+// tokenBucket is a token bucket stored as the time at which it will be full
+// again, in Unix nanoseconds, so that it can be updated with a single
+// compare-and-swap. Each packet pushes that time back by its cost, and a
+// packet is allowed if the bucket would then be full within capacity.
+type tokenBucket struct {
+	full int64
+}
+
+// take uses up a packet's worth of the bucket at now, unless it's empty.
+func (b *tokenBucket) take(now, cost, capacity int64) bool {
+	for {
+		full := atomic.LoadInt64(&b.full)
+		next := full
+		if next < now {
+			next = now
+		}
+		next += cost
+		if next-now > capacity {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&b.full, full, next) {
+			return true
+		}
+	}
+}
+
+// newIngestLimiter returns a limiter allowing perSecond packets a second, or
+// nil if perSecond is 0.
+func newIngestLimiter(perSecond int, perSource bool) *ingestLimiter {
+	if perSecond == 0 {
+		return nil
+	}
+	cost := int64(time.Second) / int64(perSecond)
+	if cost == 0 {
+		cost = 1
+	}
+	il := &ingestLimiter{
+		perSecond: float64(perSecond),
+		perSource: perSource,
+		cost:      cost,
+		capacity:  cost * int64(perSecond),
+		now:       time.Now,
+	}
+	for i := range il.shards {
+		il.shards[i].buckets = make(map[string]*tokenBucket)
+	}
+	return il
+}
+
+// Allow reports whether a packet from source can be processed, and counts
+// it as dropped if not. Sources without an IP, like the unixgram socket,
+// share a bucket. A nil limiter allows everything.
+func (il *ingestLimiter) Allow(source net.Addr) bool {
+	if il == nil {
+		return true
+	}
+	now := il.now().UnixNano()
+	b := &il.global
+	if il.perSource {
+		key := ""
+		switch a := source.(type) {
+		case *net.UDPAddr:
+			key = a.IP.String()
+		case *net.TCPAddr:
+			key = a.IP.String()
+		}
+		il.sweep(now)
+		b = il.bucket(key)
+	}
+	if !b.take(now, il.cost, il.capacity) {
+		atomic.AddInt64(&il.dropped, 1)
+		return false
+	}
+	return true
+}
+
+// bucket returns the bucket for the source key, creating it if needed.
+func (il *ingestLimiter) bucket(key string) *tokenBucket {
+	// FNV-1a, inline so that looking up a bucket doesn't allocate
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	shard := &il.shards[h%ingestLimitShards]
+
+	shard.mtx.RLock()
+	b, ok := shard.buckets[key]
+	shard.mtx.RUnlock()
+	if ok {
+		return b
+	}
+	shard.mtx.Lock()
+	defer shard.mtx.Unlock()
+	if b, ok = shard.buckets[key]; !ok {
+		b = &tokenBucket{}
+		shard.buckets[key] = b
+	}
+	return b
+}
+
+// sweep removes the buckets that are full again, once a second, since a
+// full bucket is the same as a new one. Only the caller that claims the
+// sweep does it.
+func (il *ingestLimiter) sweep(now int64) {
+	swept := atomic.LoadInt64(&il.swept)
+	if now-swept < int64(time.Second) || !atomic.CompareAndSwapInt64(&il.swept, swept, now) {
+		return
+	}
+	for i := range il.shards {
+		shard := &il.shards[i]
+		shard.mtx.Lock()
+		for k, b := range shard.buckets {
+			if atomic.LoadInt64(&b.full) <= now {
+				delete(shard.buckets, k)
+			}
+		}
+		shard.mtx.Unlock()
+	}
+}
+
+// Dropped returns the number of packets dropped since it was last called.
+func (il *ingestLimiter) Dropped() int64 {
+	if il == nil {
+		return 0
+	}
+	return atomic.SwapInt64(&il.dropped, 0)
+}
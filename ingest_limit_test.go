@@ -0,0 +1,98 @@
+package veneur
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIngestLimiter(t *testing.T) {
+	now := time.Unix(1476119058, 0)
+	il := newIngestLimiter(100, false)
+	il.now = func() time.Time { return now }
+	web1 := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234}
+	web2 := &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 1234}
+
+	for i := 0; i < 100; i++ {
+		assert.True(t, il.Allow(web1), "packet %d should be allowed", i+1)
+	}
+	assert.False(t, il.Allow(web1), "the 101st packet should be dropped")
+	assert.False(t, il.Allow(web2), "the limit should be shared by every source")
+	assert.Equal(t, int64(2), il.Dropped())
+	assert.Equal(t, int64(0), il.Dropped(), "the count should reset once reported")
+
+	now = now.Add(10 * time.Millisecond)
+	assert.True(t, il.Allow(web1), "a packet's worth of time should allow one more")
+	assert.False(t, il.Allow(web1))
+
+	now = now.Add(time.Minute)
+	for i := 0; i < 100; i++ {
+		assert.True(t, il.Allow(web1), "an idle limiter should only allow a second's worth")
+	}
+	assert.False(t, il.Allow(web1))
+}
+
+func TestIngestLimiterPerSource(t *testing.T) {
+	now := time.Unix(1476119058, 0)
+	il := newIngestLimiter(100, true)
+	il.now = func() time.Time { return now }
+	web1 := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234}
+
+	for i := 0; i < 100; i++ {
+		assert.True(t, il.Allow(&net.UDPAddr{IP: web1.IP, Port: 1000 + i}))
+	}
+	assert.False(t, il.Allow(web1), "each IP should have one limit, whatever its port")
+	assert.True(t, il.Allow(&net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 1234}), "each IP should have its own limit")
+	assert.True(t, il.Allow(nil), "sources without an IP should have their own limit")
+	assert.Equal(t, int64(1), il.Dropped())
+
+	now = now.Add(time.Second)
+	il.Allow(nil)
+	buckets := 0
+	for i := range il.shards {
+		buckets += len(il.shards[i].buckets)
+	}
+	assert.Equal(t, 1, buckets, "idle buckets should be removed")
+}
+
+func TestIngestLimiterConcurrent(t *testing.T) {
+	now := time.Unix(1476119058, 0)
+	for _, perSource := range []bool{false, true} {
+		il := newIngestLimiter(100, perSource)
+		il.now = func() time.Time { return now }
+		source := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234}
+
+		var allowed int64
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 50; j++ {
+					if il.Allow(source) {
+						atomic.AddInt64(&allowed, 1)
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		assert.Equal(t, int64(100), allowed, "readers sharing a limit should allow exactly the limit between them, per source: %t", perSource)
+		assert.Equal(t, int64(300), il.Dropped())
+	}
+}
+
+func TestIngestLimiterDisabled(t *testing.T) {
+	il := newIngestLimiter(0, false)
+	assert.Nil(t, il)
+	assert.True(t, il.Allow(nil))
+	assert.Equal(t, int64(0), il.Dropped())
+
+	config := localConfig()
+	config.MaxPacketsPerSecond = -1
+	_, err := NewFromConfig(config)
+	assert.Error(t, err)
+}
@@ -0,0 +1,360 @@
+package veneur
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/stripe/veneur/ssf"
+	"github.com/stripe/veneur/trace"
+)
+
+// jaegerTracesPath is where a Jaeger collector takes batches of spans, in
+// Thrift's binary protocol.
+const jaegerTracesPath = "/api/traces?format=jaeger.thrift"
+
+// The types of Jaeger tag values
+const (
+	jaegerTagString int32 = 0
+	jaegerTagDouble int32 = 1
+	jaegerTagBool   int32 = 2
+	jaegerTagLong   int32 = 3
+)
+
+// jaegerBatch and the types below are the parts of Jaeger's Thrift model
+// (jaeger.thrift in jaeger-idl) that Veneur sends. Veneur encodes them
+// itself rather than depend on a Thrift library for a handful of structs.
+type jaegerBatch struct {
+	Process jaegerProcess
+	Spans   []jaegerSpan
+}
+
+type jaegerProcess struct {
+	ServiceName string
+	Tags        []jaegerTag
+}
+
+type jaegerSpan struct {
+	TraceIDLow    int64
+	TraceIDHigh   int64
+	SpanID        int64
+	ParentSpanID  int64
+	OperationName string
+	Flags         int32
+	// microseconds since the epoch
+	StartTime int64
+	// microseconds
+	Duration int64
+	Tags     []jaegerTag
+	Logs     []jaegerLog
+}
+
+// jaegerTag is a key and a value of one of the jaegerTag types; only the
+// field for its type is sent.
+type jaegerTag struct {
+	Key     string
+	VType   int32
+	VStr    string
+	VDouble float64
+	VBool   bool
+	VLong   int64
+}
+
+type jaegerLog struct {
+	// microseconds since the epoch
+	Timestamp int64
+	Fields    []jaegerTag
+}
+
+// The Thrift types used by Jaeger's model
+const (
+	thriftBool   byte = 2
+	thriftDouble byte = 4
+	thriftI32    byte = 8
+	thriftI64    byte = 10
+	thriftString byte = 11
+	thriftStruct byte = 12
+	thriftList   byte = 15
+)
+
+// thriftWriter encodes values with Thrift's binary protocol.
+type thriftWriter struct {
+	bytes.Buffer
+}
+
+func (w *thriftWriter) field(typ byte, id int16) {
+	w.WriteByte(typ)
+	binary.Write(w, binary.BigEndian, id)
+}
+
+func (w *thriftWriter) stop() {
+	w.WriteByte(0)
+}
+
+func (w *thriftWriter) i32(id int16, v int32) {
+	w.field(thriftI32, id)
+	binary.Write(w, binary.BigEndian, v)
+}
+
+func (w *thriftWriter) i64(id int16, v int64) {
+	w.field(thriftI64, id)
+	binary.Write(w, binary.BigEndian, v)
+}
+
+func (w *thriftWriter) double(id int16, v float64) {
+	w.field(thriftDouble, id)
+	binary.Write(w, binary.BigEndian, math.Float64bits(v))
+}
+
+func (w *thriftWriter) bool(id int16, v bool) {
+	w.field(thriftBool, id)
+	if v {
+		w.WriteByte(1)
+	} else {
+		w.WriteByte(0)
+	}
+}
+
+func (w *thriftWriter) string(id int16, v string) {
+	w.field(thriftString, id)
+	binary.Write(w, binary.BigEndian, int32(len(v)))
+	w.WriteString(v)
+}
+
+// list begins a list field of n elements of type elem, which the caller
+// then writes.
+func (w *thriftWriter) list(id int16, elem byte, n int) {
+	w.field(thriftList, id)
+	w.WriteByte(elem)
+	binary.Write(w, binary.BigEndian, int32(n))
+}
+
+func (b *jaegerBatch) write(w *thriftWriter) {
+	w.field(thriftStruct, 1)
+	b.Process.write(w)
+	w.list(2, thriftStruct, len(b.Spans))
+	for i := range b.Spans {
+		b.Spans[i].write(w)
+	}
+	w.stop()
+}
+
+func (p *jaegerProcess) write(w *thriftWriter) {
+	w.string(1, p.ServiceName)
+	if len(p.Tags) > 0 {
+		writeJaegerTags(w, 2, p.Tags)
+	}
+	w.stop()
+}
+
+func (s *jaegerSpan) write(w *thriftWriter) {
+	w.i64(1, s.TraceIDLow)
+	w.i64(2, s.TraceIDHigh)
+	w.i64(3, s.SpanID)
+	w.i64(4, s.ParentSpanID)
+	w.string(5, s.OperationName)
+	w.i32(7, s.Flags)
+	w.i64(8, s.StartTime)
+	w.i64(9, s.Duration)
+	if len(s.Tags) > 0 {
+		writeJaegerTags(w, 10, s.Tags)
+	}
+	if len(s.Logs) > 0 {
+		w.list(11, thriftStruct, len(s.Logs))
+		for _, l := range s.Logs {
+			w.i64(1, l.Timestamp)
+			writeJaegerTags(w, 2, l.Fields)
+			w.stop()
+		}
+	}
+	w.stop()
+}
+
+func writeJaegerTags(w *thriftWriter, id int16, tags []jaegerTag) {
+	w.list(id, thriftStruct, len(tags))
+	for _, t := range tags {
+		w.string(1, t.Key)
+		w.i32(2, t.VType)
+		switch t.VType {
+		case jaegerTagDouble:
+			w.double(4, t.VDouble)
+		case jaegerTagBool:
+			w.bool(5, t.VBool)
+		case jaegerTagLong:
+			w.i64(6, t.VLong)
+		default:
+			w.string(3, t.VStr)
+		}
+		w.stop()
+	}
+}
+
+// jaegerBatches converts spans to Jaeger spans, in one batch per service,
+// since a Jaeger batch's spans all come from the same process.
+func (s *Server) jaegerBatches(samples []ssf.SSFSample) []*jaegerBatch {
+	byService := map[string]*jaegerBatch{}
+	var services []string
+	for _, sample := range samples {
+		batch, ok := byService[sample.Service]
+		if !ok {
+			batch = &jaegerBatch{Process: jaegerProcess{ServiceName: sample.Service}}
+			if s.Hostname != "" {
+				batch.Process.Tags = []jaegerTag{{Key: "hostname", VStr: s.Hostname}}
+			}
+			byService[sample.Service] = batch
+			services = append(services, sample.Service)
+		}
+		batch.Spans = append(batch.Spans, s.jaegerSpan(sample))
+	}
+	sort.Strings(services)
+	batches := make([]*jaegerBatch, len(services))
+	for i, service := range services {
+		batches[i] = byService[service]
+	}
+	return batches
+}
+
+// jaegerSpan converts a span to a Jaeger span. Its resource is the
+// operation name, its name is tagged unless a tag already has the key, and
+// spans that aren't OK are tagged error, as Jaeger expects.
+func (s *Server) jaegerSpan(sample ssf.SSFSample) jaegerSpan {
+	parentID := sample.Trace.ParentId
+	if parentID < 0 {
+		parentID = 0
+	}
+	operation := sample.Trace.Resource
+	if operation == "" {
+		operation = sample.Name
+	}
+	span := jaegerSpan{
+		TraceIDLow:    sample.Trace.TraceId,
+		SpanID:        sample.Trace.Id,
+		ParentSpanID:  parentID,
+		OperationName: operation,
+		// sampled
+		Flags:     1,
+		StartTime: sample.Timestamp / int64(time.Microsecond),
+		Duration:  sample.Trace.Duration / int64(time.Microsecond),
+	}
+
+	named := false
+	for _, tag := range sample.Tags {
+		span.Tags = append(span.Tags, jaegerTagFor(tag, s.redactSpanTag(tag.Value)))
+		named = named || tag.Name == "name"
+	}
+	if !named && sample.Name != "" {
+		span.Tags = append(span.Tags, jaegerTag{Key: "name", VStr: sample.Name})
+	}
+	if sample.Status != ssf.SSFSample_OK {
+		span.Tags = append(span.Tags,
+			jaegerTag{Key: "error", VType: jaegerTagBool, VBool: true},
+			jaegerTag{Key: "status", VStr: strings.ToLower(sample.Status.String())})
+	}
+
+	for _, l := range sample.Trace.GetLogs() {
+		fields := []jaegerTag{{Key: "event", VStr: l.Event}}
+		for _, field := range l.Fields {
+			fields = append(fields, jaegerTag{Key: field.Name, VStr: s.redactSpanTag(field.Value)})
+		}
+		span.Logs = append(span.Logs, jaegerLog{
+			Timestamp: l.Timestamp / int64(time.Microsecond),
+			Fields:    fields,
+		})
+	}
+	return span
+}
+
+// jaegerTagFor converts a span tag with its type. Tags whose value was
+// redacted, or doesn't parse as their type, are strings.
+func jaegerTagFor(tag *ssf.SSFTag, redacted string) jaegerTag {
+	t := jaegerTag{Key: tag.Name, VStr: redacted}
+	if redacted != tag.Value {
+		return t
+	}
+	switch tag.Type {
+	case ssf.SSFTag_INT:
+		if v, err := strconv.ParseInt(tag.Value, 10, 64); err == nil {
+			t.VType, t.VLong = jaegerTagLong, v
+		}
+	case ssf.SSFTag_FLOAT:
+		if v, err := strconv.ParseFloat(tag.Value, 64); err == nil {
+			t.VType, t.VDouble = jaegerTagDouble, v
+		}
+	case ssf.SSFTag_BOOL:
+		if v, err := strconv.ParseBool(tag.Value); err == nil {
+			t.VType, t.VBool = jaegerTagBool, v
+		}
+	}
+	return t
+}
+
+// flushSpansJaeger sends spans to the Jaeger collector at
+// jaeger_collector_address, one batch per service. Unlike spans sent to
+// Datadog, spans that fail to send are not buffered.
+func (s *Server) flushSpansJaeger(ctx context.Context, samples []ssf.SSFSample) error {
+	span, _ := trace.StartSpanFromContext(ctx, "flush", trace.NameTag("veneur.opentracing.flush.flushSpansJaeger"))
+	defer span.Finish()
+
+	sent := 0
+	var firstErr error
+	for _, batch := range s.jaegerBatches(samples) {
+		if err := s.postJaegerBatch(span.Attach(ctx), batch); err != nil {
+			log.WithFields(logrus.Fields{
+				"service":       batch.Process.ServiceName,
+				"traces":        len(batch.Spans),
+				logrus.ErrorKey: err}).Warn("Error flushing traces to Jaeger")
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		sent += len(batch.Spans)
+	}
+	log.WithField("traces", sent).Info("Completed flushing traces to Jaeger")
+	return firstErr
+}
+
+func (s *Server) postJaegerBatch(ctx context.Context, batch *jaegerBatch) error {
+	const action = "flush_traces_jaeger"
+	var body thriftWriter
+	batch.write(&body)
+	s.Statsd.Histogram(action+".content_length_bytes", float64(body.Len()), nil, 1.0)
+
+	req, err := http.NewRequest(http.MethodPost, s.jaegerCollectorAddress+jaegerTracesPath, &body.Buffer)
+	if err != nil {
+		s.Statsd.Count(action+".error_total", 1, []string{"cause:construct"}, 1.0)
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-thrift")
+	// we only make http requests at flush time, so keepalive is not a big win
+	req.Close = true
+
+	requestStart := time.Now()
+	resp, err := s.HTTPClient.Do(req)
+	if err != nil {
+		if urlErr, ok := err.(*url.Error); ok {
+			// ditch the url, which might contain secrets
+			err = urlErr.Err
+		}
+		s.Statsd.Count(action+".error_total", 1, []string{"cause:io"}, 1.0)
+		return err
+	}
+	s.Statsd.TimeInMilliseconds(action+".duration_ns", float64(time.Since(requestStart).Nanoseconds()), []string{"part:post"}, 1.0)
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		s.Statsd.Count(action+".error_total", 1, []string{fmt.Sprintf("cause:%d", resp.StatusCode)}, 1.0)
+		return fmt.Errorf("%s received status %s", action, resp.Status)
+	}
+	return nil
+}
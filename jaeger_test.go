@@ -0,0 +1,182 @@
+package veneur
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stripe/veneur/ssf"
+	"github.com/stripe/veneur/trace"
+)
+
+// readThrift decodes a value of the Thrift type typ from r. Structs are
+// decoded to maps from field IDs to values, and lists to slices.
+func readThrift(t *testing.T, r io.Reader, typ byte) interface{} {
+	read := func(v interface{}) {
+		assert.NoError(t, binary.Read(r, binary.BigEndian, v))
+	}
+	switch typ {
+	case thriftBool:
+		var v byte
+		read(&v)
+		return v != 0
+	case thriftDouble:
+		var v uint64
+		read(&v)
+		return math.Float64frombits(v)
+	case thriftI32:
+		var v int32
+		read(&v)
+		return v
+	case thriftI64:
+		var v int64
+		read(&v)
+		return v
+	case thriftString:
+		var n int32
+		read(&n)
+		v := make([]byte, n)
+		_, err := io.ReadFull(r, v)
+		assert.NoError(t, err)
+		return string(v)
+	case thriftList:
+		var elem byte
+		var n int32
+		read(&elem)
+		read(&n)
+		v := make([]interface{}, n)
+		for i := range v {
+			v[i] = readThrift(t, r, elem)
+		}
+		return v
+	case thriftStruct:
+		v := map[int16]interface{}{}
+		for {
+			var fieldType byte
+			read(&fieldType)
+			if fieldType == 0 {
+				return v
+			}
+			var id int16
+			read(&id)
+			v[id] = readThrift(t, r, fieldType)
+		}
+	}
+	t.Fatalf("unexpected Thrift type %d", typ)
+	return nil
+}
+
+// jaegerTags decodes a list of Jaeger tags to a map of their values.
+func jaegerTags(list interface{}) map[string]interface{} {
+	tags := map[string]interface{}{}
+	for _, t := range list.([]interface{}) {
+		tag := t.(map[int16]interface{})
+		switch tag[2].(int32) {
+		case jaegerTagDouble:
+			tags[tag[1].(string)] = tag[4]
+		case jaegerTagBool:
+			tags[tag[1].(string)] = tag[5]
+		case jaegerTagLong:
+			tags[tag[1].(string)] = tag[6]
+		default:
+			tags[tag[1].(string)] = tag[3]
+		}
+	}
+	return tags
+}
+
+func TestFlushTracesJaeger(t *testing.T) {
+	received := make(chan map[int16]interface{}, 2)
+	remoteServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/traces", r.URL.Path)
+		assert.Equal(t, "jaeger.thrift", r.URL.Query().Get("format"))
+		assert.Equal(t, "application/x-thrift", r.Header.Get("Content-Type"))
+		body, err := ioutil.ReadAll(r.Body)
+		assert.NoError(t, err)
+		received <- readThrift(t, bytes.NewReader(body), thriftStruct).(map[int16]interface{})
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer remoteServer.Close()
+
+	config := globalConfig()
+	config.TraceAPIAddress = ""
+	config.JaegerCollectorAddress = remoteServer.URL
+	config.SpanTagRedactionPatterns = []string{`^4242\d+$`}
+	s, err := NewFromConfig(config)
+	assert.NoError(t, err)
+	assert.True(t, s.TracingEnabled(), "tracing should be enabled with only a Jaeger collector")
+
+	start := time.Unix(1500000000, 123456789)
+	record := func(span *trace.Trace, service string) {
+		sample := span.SSFSample()
+		sample.Service = service
+		sample.Timestamp = start.UnixNano()
+		sample.Trace.Duration = int64(1500 * time.Microsecond)
+		s.TraceWorker.traces.Value = *sample
+		s.TraceWorker.traces = s.TraceWorker.traces.Next()
+	}
+	checkout := trace.StartTrace("POST /checkout")
+	checkout.Name = "http.request"
+	checkoutSpan := &trace.Span{Trace: checkout}
+	checkoutSpan.SetIntTag("http.status_code", 500)
+	checkoutSpan.SetFloatTag("cart.total", 12.5)
+	checkoutSpan.SetBoolTag("cache.hit", false)
+	checkoutSpan.SetIntTag("card", 4242424242424242)
+	checkout.Status = ssf.SSFSample_CRITICAL
+	checkout.Log("retry", map[string]string{"attempt": "2"})
+	record(checkout, "checkout")
+	db := trace.StartChildSpan(checkout)
+	db.Name = "db.query"
+	db.Resource = ""
+	record(db, "accounts")
+	s.flushTraces(context.Background())
+
+	// batches are sent in order of their service
+	accounts := <-received
+	batch := <-received
+	assert.Equal(t, "accounts", accounts[1].(map[int16]interface{})[1])
+	process := batch[1].(map[int16]interface{})
+	assert.Equal(t, "checkout", process[1])
+	assert.Equal(t, map[string]interface{}{"hostname": s.Hostname}, jaegerTags(process[2]))
+
+	spans := batch[2].([]interface{})
+	if !assert.Len(t, spans, 1) {
+		return
+	}
+	span := spans[0].(map[int16]interface{})
+	assert.Equal(t, checkout.TraceID, span[1], "traceIdLow")
+	assert.Equal(t, checkout.SpanID, span[3], "spanId")
+	assert.Equal(t, int64(0), span[4], "root spans should have no parent")
+	assert.Equal(t, "POST /checkout", span[5], "the resource should be the operation name")
+	assert.Equal(t, start.UnixNano()/1000, span[8], "startTime should be in microseconds")
+	assert.Equal(t, int64(1500), span[9], "duration should be in microseconds")
+	assert.Equal(t, map[string]interface{}{
+		"name":             "http.request",
+		"http.status_code": int64(500),
+		"cart.total":       12.5,
+		"cache.hit":        false,
+		"card":             "[REDACTED]",
+		"error":            true,
+		"status":           "critical",
+	}, jaegerTags(span[10]))
+	logs := span[11].([]interface{})
+	if assert.Len(t, logs, 1) {
+		l := logs[0].(map[int16]interface{})
+		assert.Equal(t, checkout.Logs[0].Timestamp.UnixNano()/1000, l[1])
+		assert.Equal(t, map[string]interface{}{"event": "retry", "attempt": "2"}, jaegerTags(l[2]))
+	}
+
+	dbSpan := accounts[2].([]interface{})[0].(map[int16]interface{})
+	assert.Equal(t, checkout.SpanID, dbSpan[4], "parentSpanId")
+	assert.Equal(t, "db.query", dbSpan[5], "the name should be the operation name without a resource")
+	_, hasLogs := dbSpan[11]
+	assert.False(t, hasLogs, "spans without logs shouldn't send any")
+}
@@ -0,0 +1,68 @@
+package veneur
+
+import (
+	"context"
+
+	"github.com/stripe/veneur/ssf"
+	"github.com/stripe/veneur/trace"
+)
+
+// flushSpansKafka publishes spans to kafka_span_topic, each keyed by its
+// trace ID. Unlike spans sent to Datadog, spans that fail to send are not
+// buffered.
+func (s *Server) flushSpansKafka(ctx context.Context, samples []ssf.SSFSample) error {
+	span, _ := trace.StartSpanFromContext(ctx, "flush", trace.NameTag("veneur.opentracing.flush.flushSpansKafka"))
+	defer span.Finish()
+
+	if len(s.spanTagRedactions) > 0 {
+		redacted := make([]ssf.SSFSample, len(samples))
+		for i, sample := range samples {
+			redacted[i] = s.redactSpan(sample)
+		}
+		samples = redacted
+	}
+	if err := s.kafkaSpans.FlushSpans(samples); err != nil {
+		return err
+	}
+	log.WithField("traces", len(samples)).Info("Completed flushing traces to Kafka")
+	return nil
+}
+
+// redactSpan returns a copy of the span with its tag and log field values
+// redacted. The span itself is shared with the other sinks, so it isn't
+// changed.
+func (s *Server) redactSpan(sample ssf.SSFSample) ssf.SSFSample {
+	sample.Tags = s.redactSpanTags(sample.Tags)
+	if sample.Trace == nil || len(sample.Trace.Logs) == 0 {
+		return sample
+	}
+	spanTrace := *sample.Trace
+	spanTrace.Logs = make([]*ssf.SSFLog, len(sample.Trace.Logs))
+	for i, l := range sample.Trace.Logs {
+		if l == nil {
+			continue
+		}
+		redactedLog := *l
+		redactedLog.Fields = s.redactSpanTags(l.Fields)
+		spanTrace.Logs[i] = &redactedLog
+	}
+	sample.Trace = &spanTrace
+	return sample
+}
+
+// redactSpanTags returns a copy of tags with their values redacted.
+func (s *Server) redactSpanTags(tags []*ssf.SSFTag) []*ssf.SSFTag {
+	if tags == nil {
+		return nil
+	}
+	redacted := make([]*ssf.SSFTag, len(tags))
+	for i, tag := range tags {
+		if tag == nil {
+			continue
+		}
+		redactedTag := *tag
+		redactedTag.Value = s.redactSpanTag(tag.Value)
+		redacted[i] = &redactedTag
+	}
+	return redacted
+}
@@ -0,0 +1,68 @@
+package veneur
+
+import (
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v2"
+)
+
+// metadataTags attaches tags, eg ownership tags, to metrics at flush time,
+// based on a mapping file from metric name to a list of tags:
+//
+//	api.requests:
+//	  - team:payments
+//
+// An entry matches the metric with that name and every metric beneath it,
+// eg "api.requests.max" or "api.requests.errors". The longest match wins.
+type metadataTags struct {
+	path string
+
+	mtx  sync.RWMutex
+	tags map[string][]string
+}
+
+// newMetadataTags loads the mapping file at path.
+func newMetadataTags(path string) (*metadataTags, error) {
+	m := &metadataTags{path: path}
+	if err := m.Reload(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Reload reads the mapping file again. If it cannot be read or parsed, the
+// previous mapping is kept.
+func (m *metadataTags) Reload() error {
+	bts, err := ioutil.ReadFile(m.path)
+	if err != nil {
+		return err
+	}
+	var tags map[string][]string
+	if err := yaml.Unmarshal(bts, &tags); err != nil {
+		return err
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.tags = tags
+	return nil
+}
+
+// Lookup returns the tags for the metric with this name, or nil if it has no
+// entry.
+func (m *metadataTags) Lookup(name string) []string {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	for {
+		if tags, ok := m.tags[name]; ok {
+			return tags
+		}
+		i := strings.LastIndexByte(name, '.')
+		if i < 0 {
+			return nil
+		}
+		name = name[:i]
+	}
+}
@@ -0,0 +1,176 @@
+package veneur
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/stripe/veneur/samplers"
+)
+
+// originTagger attaches trusted tags to metrics based on where they were
+// received from, so that tenants on a shared host cannot impersonate each
+// other by setting tags themselves. Rules are tried in order, and the first
+// one matching the source applies.
+type originTagger struct {
+	rules []originRule
+}
+
+// originRule is a parsed OriginTagRule. It matches either network or uid.
+type originRule struct {
+	network *net.IPNet
+	uid     int
+	tags    []string
+	// the keys of tags, whose client-supplied values are removed if the rule
+	// overrides client tags
+	keys     map[string]struct{}
+	override bool
+}
+
+// newOriginTagger parses the origin_tags rules.
+func newOriginTagger(rules []OriginTagRule) (*originTagger, error) {
+	o := &originTagger{rules: make([]originRule, len(rules))}
+	for i, rule := range rules {
+		r := originRule{uid: -1, override: rule.Override}
+		switch {
+		case strings.HasPrefix(rule.Source, "uid:"):
+			uid, err := strconv.ParseUint(strings.TrimPrefix(rule.Source, "uid:"), 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid origin_tags uid %q: %v", rule.Source, err)
+			}
+			r.uid = int(uid)
+		case strings.Contains(rule.Source, "/"):
+			_, network, err := net.ParseCIDR(rule.Source)
+			if err != nil {
+				return nil, fmt.Errorf("invalid origin_tags source %q: %v", rule.Source, err)
+			}
+			r.network = network
+		default:
+			ip := net.ParseIP(rule.Source)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid origin_tags source %q", rule.Source)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			r.network = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		}
+		if len(rule.Tags) == 0 {
+			return nil, fmt.Errorf("origin_tags source %q has no tags", rule.Source)
+		}
+		r.tags = rule.Tags
+		r.keys = make(map[string]struct{}, len(rule.Tags))
+		for _, tag := range rule.Tags {
+			r.keys[tagKey(tag)] = struct{}{}
+		}
+		o.rules[i] = r
+	}
+	return o, nil
+}
+
+// tagKey returns the part of a tag before its first colon.
+func tagKey(tag string) string {
+	if i := strings.IndexByte(tag, ':'); i >= 0 {
+		return tag[:i]
+	}
+	return tag
+}
+
+// HasUIDRules reports whether any rule matches unixgram peers by uid.
+func (o *originTagger) HasUIDRules() bool {
+	if o == nil {
+		return false
+	}
+	for _, r := range o.rules {
+		if r.uid >= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// ForAddr returns the rule for metrics received from addr, or nil if there
+// is none.
+func (o *originTagger) ForAddr(addr net.Addr) *originRule {
+	if o == nil {
+		return nil
+	}
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		ip = a.IP
+	case *net.TCPAddr:
+		ip = a.IP
+	default:
+		return nil
+	}
+	for i := range o.rules {
+		if n := o.rules[i].network; n != nil && n.Contains(ip) {
+			return &o.rules[i]
+		}
+	}
+	return nil
+}
+
+// ForUID returns the rule for metrics received on the unixgram socket from
+// a process running as uid, or nil if there is none.
+func (o *originTagger) ForUID(uid int) *originRule {
+	if o == nil || uid < 0 {
+		return nil
+	}
+	for i := range o.rules {
+		if o.rules[i].uid == uid {
+			return &o.rules[i]
+		}
+	}
+	return nil
+}
+
+// Apply adds the rule's tags to metric. If the rule overrides client tags,
+// any tags the client sent with the same keys are removed first.
+func (r *originRule) Apply(metric *samplers.UDPMetric) {
+	tags := make([]string, 0, len(metric.Tags)+len(r.tags))
+	for _, tag := range metric.Tags {
+		if r.override {
+			if _, ok := r.keys[tagKey(tag)]; ok {
+				continue
+			}
+		}
+		tags = append(tags, tag)
+	}
+	metric.SetTags(append(tags, r.tags...))
+}
+
+// TrimTags trims metric, which the rule has been applied to, to n tags. It
+// drops the client's tags before the rule's, so that a client can't push
+// the trusted tags out by sending too many of its own.
+func (r *originRule) TrimTags(metric *samplers.UDPMetric, n int) {
+	if len(metric.Tags) <= n {
+		return
+	}
+	trusted := make(map[string]struct{}, len(r.tags))
+	for _, tag := range r.tags {
+		trusted[tag] = struct{}{}
+	}
+	clientTags := make([]string, 0, len(metric.Tags))
+	for _, tag := range metric.Tags {
+		if _, ok := trusted[tag]; !ok {
+			clientTags = append(clientTags, tag)
+		}
+	}
+	keep := n - len(r.tags)
+	if keep < 0 {
+		keep = 0
+	}
+	if keep < len(clientTags) {
+		clientTags = clientTags[:keep]
+	}
+	tags := append(clientTags, r.tags...)
+	if len(tags) > n {
+		tags = tags[:n]
+	}
+	metric.SetTags(tags)
+}
@@ -0,0 +1,69 @@
+package veneur
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/stripe/veneur/samplers"
+	"stathat.com/c/consistent"
+)
+
+// packetForwarder sends metrics as DogStatsD lines, unaggregated, to the
+// aggregators in forward_addresses. Every line goes to the aggregator that
+// owns its metric key on a consistent hash ring, so all the samples of a
+// timeseries are aggregated in one place, and adding or removing an
+// aggregator only moves the timeseries it gains or loses.
+type packetForwarder struct {
+	ring  *consistent.Consistent
+	conns map[string]net.Conn
+}
+
+// newPacketForwarder dials each of addresses over UDP and puts them on a
+// hash ring.
+func newPacketForwarder(addresses []string) (*packetForwarder, error) {
+	f := &packetForwarder{
+		ring:  consistent.New(),
+		conns: make(map[string]net.Conn, len(addresses)),
+	}
+	for _, addr := range addresses {
+		if _, ok := f.conns[addr]; ok {
+			f.Close()
+			return nil, fmt.Errorf("forward_addresses lists %q more than once", addr)
+		}
+		conn, err := net.Dial("udp", addr)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		f.conns[addr] = conn
+	}
+	f.ring.Set(addresses)
+	return f, nil
+}
+
+// forwardDestination returns the member of ring that owns the timeseries
+// identified by key. It depends only on the ring's members, so every Veneur
+// with the same forward_addresses picks the same destination.
+func forwardDestination(ring *consistent.Consistent, key samplers.MetricKey) (string, error) {
+	return ring.Get(key.String())
+}
+
+// Forward sends line, a single DogStatsD metric line, to the destination for
+// key, and returns that destination.
+func (f *packetForwarder) Forward(line []byte, key samplers.MetricKey) (string, error) {
+	dest, err := forwardDestination(f.ring, key)
+	if err != nil {
+		return "", err
+	}
+	_, err = f.conns[dest].Write(line)
+	return dest, err
+}
+
+// Close closes the connections to every destination.
+func (f *packetForwarder) Close() {
+	for addr, conn := range f.conns {
+		if err := conn.Close(); err != nil {
+			log.WithError(err).WithField("destination", addr).Warn("Ignoring error closing forwarding connection")
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package veneur
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stripe/veneur/samplers"
+	"github.com/stripe/veneur/ssf"
+	"stathat.com/c/consistent"
+)
+
+func testRing(members ...string) *consistent.Consistent {
+	ring := consistent.New()
+	ring.Set(members)
+	return ring
+}
+
+func testMetricKeys(n int) []samplers.MetricKey {
+	keys := make([]samplers.MetricKey, n)
+	for i := range keys {
+		keys[i] = samplers.MetricKey{
+			Name:       fmt.Sprintf("a.b.c%d", i),
+			Type:       "histogram",
+			JoinedTags: fmt.Sprintf("shard:%d", i%7),
+		}
+	}
+	return keys
+}
+
+func TestForwardDestinationDeterministic(t *testing.T) {
+	ring := testRing("10.0.0.1:8126", "10.0.0.2:8126", "10.0.0.3:8126")
+	reordered := testRing("10.0.0.3:8126", "10.0.0.1:8126", "10.0.0.2:8126")
+
+	seen := map[string]bool{}
+	for _, key := range testMetricKeys(100) {
+		dest, err := forwardDestination(ring, key)
+		assert.NoError(t, err)
+		again, _ := forwardDestination(ring, key)
+		assert.Equal(t, dest, again, "same key went to different destinations")
+		other, _ := forwardDestination(reordered, key)
+		assert.Equal(t, dest, other, "destination depended on the order of forward_addresses")
+		seen[dest] = true
+	}
+	assert.Len(t, seen, 3, "expected every destination to get some keys")
+}
+
+func TestForwardDestinationEmptyRing(t *testing.T) {
+	_, err := forwardDestination(consistent.New(), samplers.MetricKey{Name: "a.b.c"})
+	assert.Error(t, err)
+}
+
+func TestForwardDestinationRebalance(t *testing.T) {
+	members := []string{"10.0.0.1:8126", "10.0.0.2:8126", "10.0.0.3:8126"}
+	keys := testMetricKeys(3000)
+	before := make([]string, len(keys))
+	for i, key := range keys {
+		before[i], _ = forwardDestination(testRing(members...), key)
+	}
+
+	// adding a destination only moves keys onto it, about a quarter of them
+	grown := testRing(append(members, "10.0.0.4:8126")...)
+	moved := 0
+	for i, key := range keys {
+		dest, _ := forwardDestination(grown, key)
+		if dest != before[i] {
+			assert.Equal(t, "10.0.0.4:8126", dest, "key moved between existing destinations")
+			moved++
+		}
+	}
+	assert.True(t, moved > 0, "no keys moved to the new destination")
+	assert.True(t, moved < len(keys)/2, "%d of %d keys moved", moved, len(keys))
+
+	// removing a destination only moves the keys it had
+	shrunk := testRing("10.0.0.1:8126", "10.0.0.3:8126")
+	for i, key := range keys {
+		dest, _ := forwardDestination(shrunk, key)
+		if before[i] != "10.0.0.2:8126" {
+			assert.Equal(t, before[i], dest, "key moved off a remaining destination")
+		}
+	}
+}
+
+func TestNewPacketForwarderDuplicate(t *testing.T) {
+	_, err := newPacketForwarder([]string{"127.0.0.1:8126", "127.0.0.1:8126"})
+	assert.Error(t, err)
+}
+
+func TestForwardAddressesExclusive(t *testing.T) {
+	config := localConfig()
+	config.ForwardAddress = "http://localhost:8127"
+	config.ForwardAddresses = []string{"127.0.0.1:8126"}
+	_, err := NewFromConfig(config)
+	assert.Error(t, err)
+}
+
+func TestForwardPackets(t *testing.T) {
+	backends := make(map[string]*net.UDPConn)
+	var addresses []string
+	for i := 0; i < 3; i++ {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer conn.Close()
+		addr := conn.LocalAddr().String()
+		backends[addr] = conn
+		addresses = append(addresses, addr)
+	}
+
+	config := localConfig()
+	config.ForwardAddress = ""
+	config.ForwardAddresses = addresses
+	f := newFixture(t, config)
+	defer f.Close()
+
+	lines := []string{
+		"a.b.c:1|h|#x:1",
+		"a.b.c:2|h|#x:1",
+		"a.b.c:3|h|#x:2",
+		"d.e.f:1|c",
+		"g.h.i:4|ms|@0.5|#y:1,z:2",
+	}
+	for _, line := range lines {
+		assert.NoError(t, f.server.handleMetricPacket([]byte(line), nil))
+	}
+
+	ring := testRing(addresses...)
+	want := map[string][]string{}
+	for _, line := range lines {
+		metric, err := samplers.ParseMetric([]byte(line))
+		if !assert.NoError(t, err) {
+			return
+		}
+		dest, _ := forwardDestination(ring, metric.MetricKey)
+		want[dest] = append(want[dest], line)
+	}
+
+	buf := make([]byte, 1024)
+	for addr, conn := range backends {
+		var got []string
+		for range want[addr] {
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			n, err := conn.Read(buf)
+			if !assert.NoError(t, err, "%s did not receive its packets", addr) {
+				break
+			}
+			got = append(got, string(buf[:n]))
+		}
+		assert.Equal(t, want[addr], got, "wrong packets forwarded to %s", addr)
+	}
+
+	// nothing is aggregated locally
+	for _, w := range f.server.Workers {
+		assert.Equal(t, int64(0), w.MetricsProcessedCount())
+	}
+}
+
+// TestForwardNormalizedMetrics checks that metrics are forwarded as they'd
+// be aggregated here, from DogStatsD and SSF, and that distributions aren't
+// forwarded.
+func TestForwardNormalizedMetrics(t *testing.T) {
+	backend, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer backend.Close()
+
+	config := localConfig()
+	config.NumWorkers = 1
+	config.ForwardAddress = ""
+	config.ForwardAddresses = []string{backend.LocalAddr().String()}
+	config.NormalizeMetricNames.Lowercase = true
+	config.OriginTags = []OriginTagRule{
+		{Source: "127.0.0.0/8", Tags: []string{"service:trusted"}, Override: true},
+	}
+	f := newFixture(t, config)
+	defer f.Close()
+
+	origin := f.server.originTags.ForAddr(&net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	assert.NoError(t, f.server.handleMetricPacket([]byte("A.B.C:1|c|#service:impostor,x:1"), origin))
+	assert.NoError(t, f.server.handleMetricPacket([]byte("d.e.f:2|d"), origin))
+	assert.NoError(t, f.server.HandleSSFMetric(&ssf.SSFSample{
+		Metric: ssf.SSFSample_GAUGE,
+		Name:   "SSF.Gauge",
+		Value:  3,
+		Tags:   []*ssf.SSFTag{{Name: "y", Value: "2"}},
+	}))
+
+	buf := make([]byte, 1024)
+	var got []string
+	for i := 0; i < 2; i++ {
+		backend.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := backend.Read(buf)
+		if !assert.NoError(t, err, "the backend did not receive its packets") {
+			break
+		}
+		got = append(got, string(buf[:n]))
+	}
+	assert.Equal(t, []string{
+		"a.b.c:1|c|#service:trusted,x:1",
+		"ssf.gauge:3|g|#y:2",
+	}, got, "the normalized, origin-tagged metrics should be forwarded")
+
+	// the distribution is aggregated here instead
+	waitForProcessed(t, 1, f.server.Workers[0])
+}
@@ -0,0 +1,50 @@
+package veneur
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/stripe/veneur/samplers"
+)
+
+// checkTagLengths returns a ParseError with the reason oversized_tag if one
+// of metric's tags is longer than metric_max_tag_length.
+func (s *Server) checkTagLengths(metric *samplers.UDPMetric) error {
+	if s.metricMaxTagLength == 0 {
+		return nil
+	}
+	for _, tag := range metric.Tags {
+		if len(tag) > s.metricMaxTagLength {
+			return &samplers.ParseError{
+				Reason:  "oversized_tag",
+				Message: fmt.Sprintf("Invalid metric, tag of %d bytes is longer than metric_max_tag_length %d", len(tag), s.metricMaxTagLength),
+			}
+		}
+	}
+	return nil
+}
+
+// countParseError counts a packet that couldn't be parsed in
+// packet.error_total, by the reason it was rejected, and also in
+// packet.empty_name if its name was empty. It logs it with the offending
+// payload in fields, unless parse_error_log_max_per_second has been reached
+// this second.
+func (s *Server) countParseError(err error, packetType string, fields logrus.Fields, msg string) {
+	reason := samplers.ParseErrorReason(err)
+	if err == samplers.ErrEmptyName {
+		reason = "empty_name"
+		s.Statsd.Count("packet.empty_name", 1, []string{"packet_type:" + packetType}, 1.0)
+	}
+	s.Statsd.Count("packet.error_total", 1, []string{"packet_type:" + packetType, "reason:" + reason}, 1.0)
+
+	ok, suppressed := s.parseErrorLog.allow(time.Now().Unix())
+	if suppressed > 0 {
+		log.WithField("suppressed", suppressed).Warn("Packets that could not be parsed were not logged because of the rate limit")
+	}
+	if !ok {
+		return
+	}
+	fields[logrus.ErrorKey] = err
+	log.WithFields(fields).Warn(msg)
+}
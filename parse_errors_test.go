@@ -0,0 +1,80 @@
+package veneur
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stripe/veneur/samplers"
+	"github.com/stripe/veneur/ssf"
+)
+
+func TestParseErrorReasons(t *testing.T) {
+	table := map[string]string{
+		"foo|c":             "missing_value",
+		"foo:|c":            "missing_value",
+		"foo:bar|c":         "bad_value",
+		"foo:nan|g":         "bad_value",
+		"foo:1":             "missing_type",
+		"foo:1||":           "missing_type",
+		"foo:1|x":           "bad_type",
+		"foo:1|c|@2":        "bad_sample_rate",
+		"foo:1|c|@0.5|@0.2": "bad_sample_rate",
+		"foo:1|c|foo":       "malformed",
+	}
+	for packet, reason := range table {
+		_, err := samplers.ParseMetric([]byte(packet))
+		assert.Equal(t, reason, samplers.ParseErrorReason(err), "%q", packet)
+	}
+	_, err := samplers.ParseMetricStatsD([]byte("foo:1|x"))
+	assert.Equal(t, "bad_type", samplers.ParseErrorReason(err))
+	_, err = samplers.ParseMetricSSF(&ssf.SSFSample{Metric: ssf.SSFSample_TRACE, Name: "foo"})
+	assert.Equal(t, "bad_type", samplers.ParseErrorReason(err))
+	_, err = samplers.ParseEvent([]byte("_e{"))
+	assert.Equal(t, "parse", samplers.ParseErrorReason(err), "unclassified errors should have a generic reason")
+}
+
+func TestParseErrorCounts(t *testing.T) {
+	stats, packets := newStatsdCapture(t)
+	s := &Server{Statsd: stats, metricMaxTagLength: 10, parseErrorLog: &logLimit{maxPerSecond: 1}}
+
+	table := []struct {
+		packet string
+		stat   string
+	}{
+		{"foo:1|x", "veneur.packet.error_total:1|c|#packet_type:metric,reason:bad_type"},
+		{"foo|c", "veneur.packet.error_total:1|c|#packet_type:metric,reason:missing_value"},
+		{"foo:bar|c", "veneur.packet.error_total:1|c|#packet_type:metric,reason:bad_value"},
+		{" :1|c", "veneur.packet.error_total:1|c|#packet_type:metric,reason:empty_name"},
+		{"foo:1|c|#" + strings.Repeat("x", 11), "veneur.packet.error_total:1|c|#packet_type:metric,reason:oversized_tag"},
+		{"_e{", "veneur.packet.error_total:1|c|#packet_type:event,reason:parse"},
+	}
+	for _, c := range table {
+		assert.Error(t, s.HandleMetricPacket([]byte(c.packet)), "%q should be rejected", c.packet)
+		waitForStat(t, packets, c.stat)
+	}
+
+	err := s.HandleSSFMetric(&ssf.SSFSample{Metric: ssf.SSFSample_COUNTER, Name: "foo", Value: 1, Tags: []*ssf.SSFTag{{Name: "tag", Value: "too long a value"}}})
+	assert.Error(t, err)
+	waitForStat(t, packets, "veneur.packet.error_total:1|c|#packet_type:ssf_metric,reason:oversized_tag")
+
+	s.HandleTracePacket([]byte("not a protobuf"))
+	waitForStat(t, packets, "veneur.packet.error_total:1|c|#packet_type:trace,reason:unmarshal")
+
+	config := localConfig()
+	config.ParseErrorLogMaxPerSecond = -1
+	_, err = NewFromConfig(config)
+	assert.Error(t, err)
+}
+
+func TestCheckTagLengths(t *testing.T) {
+	s := &Server{}
+	metric, err := samplers.ParseMetric([]byte("foo:1|c|#" + strings.Repeat("x", 300)))
+	assert.NoError(t, err)
+	assert.NoError(t, s.checkTagLengths(metric), "tags should be unlimited by default")
+
+	s.metricMaxTagLength = 300
+	assert.NoError(t, s.checkTagLengths(metric), "a tag at the limit should be allowed")
+	s.metricMaxTagLength = 299
+	assert.Equal(t, "oversized_tag", samplers.ParseErrorReason(s.checkTagLengths(metric)))
+}
@@ -5,6 +5,7 @@ import (
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stripe/veneur/samplers"
+	"github.com/stripe/veneur/ssf"
 )
 
 func TestParser(t *testing.T) {
@@ -31,6 +32,17 @@ func TestParserHistogram(t *testing.T) {
 	assert.Equal(t, "histogram", m.Type, "Type")
 }
 
+func TestParserDistribution(t *testing.T) {
+	m, _ := samplers.ParseMetric([]byte("a.b.c:1.5|d"))
+	assert.NotNil(t, m, "Got nil metric!")
+	assert.Equal(t, "a.b.c", m.Name, "Name")
+	assert.Equal(t, float64(1.5), m.Value, "Value")
+	assert.Equal(t, "distribution", m.Type, "Type")
+
+	h, _ := samplers.ParseMetric([]byte("a.b.c:1.5|h"))
+	assert.NotEqual(t, h.Digest, m.Digest, "distributions and histograms of the same name should not collide")
+}
+
 func TestParserTimer(t *testing.T) {
 	m, _ := samplers.ParseMetric([]byte("a.b.c:1|ms"))
 	assert.NotNil(t, m, "Got nil metric!")
@@ -116,6 +128,22 @@ func TestInvalidPackets(t *testing.T) {
 	}
 }
 
+func TestEmptyNames(t *testing.T) {
+	for _, packet := range []string{":1|c", "   :1|c|#foo:bar", "\t:1|g"} {
+		_, err := samplers.ParseMetric([]byte(packet))
+		assert.Equal(t, samplers.ErrEmptyName, err, "%q should be rejected", packet)
+		_, err = samplers.ParseMetricStatsD([]byte(packet))
+		assert.Equal(t, samplers.ErrEmptyName, err, "%q should be rejected in StatsD mode", packet)
+	}
+	_, err := samplers.ParseMetricSSF(&ssf.SSFSample{Metric: ssf.SSFSample_COUNTER, Name: " ", Value: 1})
+	assert.Equal(t, samplers.ErrEmptyName, err)
+
+	stats, packets := newStatsdCapture(t)
+	s := &Server{Statsd: stats}
+	assert.Equal(t, samplers.ErrEmptyName, s.HandleMetricPacket([]byte(" :1|c")))
+	waitForStat(t, packets, "veneur.packet.empty_name:1|c|#packet_type:metric")
+}
+
 func TestLocalOnlyEscape(t *testing.T) {
 	m, err := samplers.ParseMetric([]byte("a.b.c:1|h|#veneurlocalonly,tag2:quacks"))
 	assert.NoError(t, err, "should have no error parsing")
@@ -203,3 +231,108 @@ func TestServiceCheckMessageUnescape(t *testing.T) {
 	assert.NoError(t, err, "Should have parsed correctly")
 	assert.Equal(t, "foo\nbar\nbaz\n", svcheck.Message, "Should contain newline")
 }
+
+func TestParserSSF(t *testing.T) {
+	m, err := samplers.ParseMetricSSF(&ssf.SSFSample{
+		Metric:     ssf.SSFSample_HISTOGRAM,
+		Name:       "a.b.c",
+		Value:      2,
+		SampleRate: 0.5,
+		Tags: []*ssf.SSFTag{
+			{Name: "foo", Value: "bar"},
+			{Name: "baz"},
+			{Name: "veneurlocalonly"},
+		},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "a.b.c", m.Name, "Name")
+	assert.Equal(t, float64(2), m.Value, "Value")
+	assert.Equal(t, "histogram", m.Type, "Type")
+	assert.Equal(t, float32(0.5), m.SampleRate, "Sample Rate")
+	assert.Equal(t, []string{"baz", "foo:bar"}, m.Tags, "Tags")
+	assert.Equal(t, samplers.LocalOnly, m.Scope, "Scope")
+
+	text, _ := samplers.ParseMetric([]byte("a.b.c:2|h|@0.5|#foo:bar,baz"))
+	assert.Equal(t, text.Digest, m.Digest, "SSF and text metrics should hash the same")
+
+	m, err = samplers.ParseMetricSSF(&ssf.SSFSample{Metric: ssf.SSFSample_SET, Name: "a.b.c", Message: "member"})
+	assert.NoError(t, err)
+	assert.Equal(t, "member", m.Value, "Value")
+
+	_, err = samplers.ParseMetricSSF(&ssf.SSFSample{Metric: ssf.SSFSample_TRACE, Name: "a.b.c"})
+	assert.Error(t, err, "traces are not metrics")
+	_, err = samplers.ParseMetricSSF(&ssf.SSFSample{Metric: ssf.SSFSample_COUNTER})
+	assert.Error(t, err, "metrics need a name")
+}
+
+func TestParserTrimTags(t *testing.T) {
+	m, _ := samplers.ParseMetric([]byte("a.b.c:1|c|#foo:bar,baz:qux,abc:def"))
+	m.TrimTags(2)
+	assert.Equal(t, []string{"abc:def", "baz:qux"}, m.Tags, "Tags")
+	assert.Equal(t, "abc:def,baz:qux", m.JoinedTags, "JoinedTags")
+
+	trimmed, _ := samplers.ParseMetric([]byte("a.b.c:1|c|#baz:qux,abc:def"))
+	assert.Equal(t, trimmed.Digest, m.Digest, "trimmed metrics should hash like the same metric sent with fewer tags")
+}
+
+func TestParserStatsD(t *testing.T) {
+	m, err := samplers.ParseMetricStatsD([]byte("a.b.c:1|c|@0.5"))
+	assert.NoError(t, err)
+	assert.Equal(t, "a.b.c", m.Name, "Name")
+	assert.Equal(t, float64(1), m.Value, "Value")
+	assert.Equal(t, "counter", m.Type, "Type")
+	assert.Equal(t, float32(0.5), m.SampleRate, "Sample Rate")
+	assert.Nil(t, m.Tags, "Tags")
+
+	strict, _ := samplers.ParseMetric([]byte("a.b.c:1|c|@0.5"))
+	assert.Equal(t, strict.Digest, m.Digest, "tagless lines should hash the same as in DogStatsD")
+
+	// a colon in the name and a trailing pipe are rejected by the strict
+	// parser, but legacy clients send them
+	packet := []byte("web01:8080.requests:3|ms|\n")
+	_, err = samplers.ParseMetric(packet)
+	assert.Error(t, err, "the DogStatsD parser should reject this line")
+	m, err = samplers.ParseMetricStatsD(packet)
+	assert.NoError(t, err)
+	assert.Equal(t, "web01:8080.requests", m.Name, "Name")
+	assert.Equal(t, float64(3), m.Value, "Value")
+	assert.Equal(t, "timer", m.Type, "Type")
+
+	m, err = samplers.ParseMetricStatsD([]byte("a.b.c:1|g|#foo:bar"))
+	assert.NoError(t, err)
+	assert.Nil(t, m.Tags, "tags should be ignored")
+
+	_, err = samplers.ParseMetricStatsD([]byte("a.b.c:1"))
+	assert.Error(t, err, "a type is still required")
+	_, err = samplers.ParseMetricStatsD([]byte("a.b.c:foo|c"))
+	assert.Error(t, err, "values must still be numbers")
+}
+
+func TestDogStatsDRoundTrip(t *testing.T) {
+	for _, line := range []string{
+		"a.b.c:1|c",
+		"a.b.c:-2.5|g|#foo:bar",
+		"a.b.c:0.001|h|@0.1|#a:1,b:2",
+		"a.b.c:3|d",
+		"a.b.c:40|ms|#veneurlocalonly",
+		"a.b.c:http://example.com|s|#veneurglobalonly,z:1",
+	} {
+		m, err := samplers.ParseMetric([]byte(line))
+		if !assert.NoError(t, err, line) {
+			continue
+		}
+		encoded, err := m.DogStatsD()
+		if !assert.NoError(t, err, line) {
+			continue
+		}
+		again, err := samplers.ParseMetric(encoded)
+		if assert.NoError(t, err, "%s encoded as %s", line, encoded) {
+			assert.Equal(t, m, again, "%s encoded as %s", line, encoded)
+		}
+	}
+
+	m, err := samplers.ParseMetricSSF(&ssf.SSFSample{Metric: ssf.SSFSample_SET, Name: "a.b.c", Message: "x|y"})
+	assert.NoError(t, err)
+	_, err = m.DogStatsD()
+	assert.Error(t, err, "a pipe in an SSF set member can't be encoded")
+}
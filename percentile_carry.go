@@ -0,0 +1,136 @@
+package veneur
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stripe/veneur/samplers"
+)
+
+// defaultCarryForwardIntervals is how many intervals percentiles are carried
+// forward for when a percentile_carry_forward rule has no max_intervals.
+const defaultCarryForwardIntervals = 5
+
+// percentileCarrier replaces the percentiles of selected histograms and
+// timers with their last known good values in intervals where they received
+// too few samples for the percentiles to be meaningful.
+type percentileCarrier struct {
+	rules map[string]carryForwardRule
+
+	mtx    sync.Mutex
+	series map[string]*carriedPercentiles
+}
+
+type carryForwardRule struct {
+	minSamples   float64
+	maxIntervals int
+}
+
+// carriedPercentiles holds the last good percentiles of one series, ie one
+// name and set of tags.
+type carriedPercentiles struct {
+	metrics []samplers.DDMetric
+	// the number of flushes since the percentiles were computed, and how
+	// many they may be carried forward for
+	age, maxIntervals int
+	// whether the series had good percentiles in the flush in progress
+	fresh bool
+}
+
+// newPercentileCarrier parses the percentile_carry_forward rules. Rules
+// without min_samples use defaultMinSamples, which is forward_min_samples.
+func newPercentileCarrier(rules []CarryForwardRule, defaultMinSamples int) (*percentileCarrier, error) {
+	c := &percentileCarrier{
+		rules:  make(map[string]carryForwardRule, len(rules)),
+		series: make(map[string]*carriedPercentiles),
+	}
+	for _, rule := range rules {
+		if rule.Name == "" {
+			return nil, fmt.Errorf("percentile_carry_forward rule has no name")
+		}
+		r := carryForwardRule{
+			minSamples:   float64(rule.MinSamples),
+			maxIntervals: rule.MaxIntervals,
+		}
+		if r.minSamples == 0 {
+			r.minSamples = float64(defaultMinSamples)
+		}
+		if r.minSamples <= 0 {
+			return nil, fmt.Errorf("percentile_carry_forward rule for %q needs min_samples, or forward_min_samples to be set", rule.Name)
+		}
+		if r.maxIntervals == 0 {
+			r.maxIntervals = defaultCarryForwardIntervals
+		}
+		if r.maxIntervals < 0 {
+			return nil, fmt.Errorf("percentile_carry_forward max_intervals for %q must be positive, got %d", rule.Name, rule.MaxIntervals)
+		}
+		c.rules[rule.Name] = r
+	}
+	return c, nil
+}
+
+// Carries reports whether the histogram or timer with this name has its
+// percentiles carried forward.
+func (c *percentileCarrier) Carries(name string) bool {
+	if c == nil {
+		return false
+	}
+	_, ok := c.rules[name]
+	return ok
+}
+
+// Flush flushes h with percentiles if it received at least the rule's
+// min_samples, remembering them. Otherwise it flushes h without them, and
+// appends the last good percentiles of the series instead, if there are any.
+func (c *percentileCarrier) Flush(h *samplers.Histo, interval time.Duration, percentiles []float64, aggregates samplers.HistogramAggregates) []samplers.DDMetric {
+	key := h.Name + "|" + strings.Join(h.Tags, ",")
+	rule := c.rules[h.Name]
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if h.Value.Count() >= rule.minSamples {
+		metrics := h.Flush(interval, percentiles, aggregates)
+		// the percentiles are always flushed last
+		carried := make([]samplers.DDMetric, len(percentiles))
+		copy(carried, metrics[len(metrics)-len(percentiles):])
+		c.series[key] = &carriedPercentiles{metrics: carried, maxIntervals: rule.maxIntervals, fresh: true}
+		return metrics
+	}
+
+	metrics := h.Flush(interval, nil, aggregates)
+	s, ok := c.series[key]
+	if !ok {
+		return metrics
+	}
+	now := float64(time.Now().Unix())
+	for _, m := range s.metrics {
+		tags := make([]string, len(m.Tags))
+		copy(tags, m.Tags)
+		m.Tags = tags
+		m.Value[0][0] = now
+		metrics = append(metrics, m)
+	}
+	return metrics
+}
+
+// Expire completes a flush, ageing every series that did not have good
+// percentiles in it, whether it was sparse or received nothing at all. Series
+// that have gone max_intervals flushes without good percentiles are
+// forgotten.
+func (c *percentileCarrier) Expire() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for key, s := range c.series {
+		if s.fresh {
+			s.fresh = false
+			continue
+		}
+		s.age++
+		if s.age >= s.maxIntervals {
+			delete(c.series, key)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package veneur
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stripe/veneur/samplers"
+)
+
+func TestPercentileCarryForward(t *testing.T) {
+	carrier, err := newPercentileCarrier([]CarryForwardRule{{Name: "a.b.c", MaxIntervals: 2}}, 3)
+	assert.NoError(t, err)
+	s := &Server{
+		interval:             10 * time.Second,
+		Workers:              []*Worker{NewWorker(1, nil, nil)},
+		histogramPercentiles: []float64{0.5},
+		HistogramAggregates:  samplers.HistogramAggregates{Value: samplers.AggregateMax, Count: 1},
+		percentileCarrier:    carrier,
+	}
+	flushed := func(samples ...float64) map[string]float64 {
+		for _, sample := range samples {
+			s.Workers[0].ProcessMetric(&samplers.UDPMetric{
+				MetricKey:  samplers.MetricKey{Name: "a.b.c", Type: "histogram"},
+				Value:      sample,
+				SampleRate: 1.0,
+			})
+		}
+		tempMetrics, ms := s.tallyMetrics(s.histogramPercentiles)
+		values := map[string]float64{}
+		for _, m := range s.generateDDMetrics(context.Background(), s.histogramPercentiles, tempMetrics, ms) {
+			values[m.Name] = m.Value[0][1]
+		}
+		return values
+	}
+
+	values := flushed(10, 20, 30)
+	assert.Equal(t, 20.0, values["a.b.c.50percentile"])
+	assert.Equal(t, 30.0, values["a.b.c.max"])
+
+	// a sparse interval gets the last good percentiles, but its own aggregates
+	values = flushed(1000)
+	assert.Equal(t, 20.0, values["a.b.c.50percentile"], "percentiles should be carried forward")
+	assert.Equal(t, 1000.0, values["a.b.c.max"])
+
+	// an interval without any samples flushes nothing, but counts towards
+	// max_intervals, after which the percentiles are no longer carried
+	assert.Len(t, flushed(), 0)
+	values = flushed(1000)
+	assert.NotContains(t, values, "a.b.c.50percentile", "carried percentiles should expire")
+	assert.Equal(t, 1000.0, values["a.b.c.max"])
+	assert.Len(t, carrier.series, 0)
+
+	// enough samples refresh them
+	values = flushed(1, 2, 3, 4, 5)
+	assert.Equal(t, 3.0, values["a.b.c.50percentile"])
+	values = flushed(1000)
+	assert.Equal(t, 3.0, values["a.b.c.50percentile"])
+}
+
+func TestPercentileCarryForwardValidation(t *testing.T) {
+	_, err := newPercentileCarrier([]CarryForwardRule{{Name: "a.b.c"}}, 0)
+	assert.Error(t, err, "min_samples is required without forward_min_samples")
+	_, err = newPercentileCarrier([]CarryForwardRule{{MinSamples: 3}}, 0)
+	assert.Error(t, err, "rules need a name")
+	_, err = newPercentileCarrier([]CarryForwardRule{{Name: "a.b.c", MinSamples: 3, MaxIntervals: -1}}, 0)
+	assert.Error(t, err)
+
+	carrier, err := newPercentileCarrier([]CarryForwardRule{{Name: "a.b.c"}}, 4)
+	assert.NoError(t, err)
+	assert.Equal(t, carryForwardRule{minSamples: 4, maxIntervals: defaultCarryForwardIntervals}, carrier.rules["a.b.c"])
+}
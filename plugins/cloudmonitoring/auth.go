@@ -0,0 +1,171 @@
+package cloudmonitoring
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MonitoringWriteScope is the OAuth scope needed to write time series.
+const MonitoringWriteScope = "https://www.googleapis.com/auth/monitoring.write"
+
+// DefaultMetadataTokenURL is the GCE metadata server endpoint for the
+// instance's default service account.
+const DefaultMetadataTokenURL = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+
+// tokens are refreshed this long before they expire
+const tokenExpiryMargin = time.Minute
+
+// A TokenSource returns OAuth2 access tokens for the Cloud Monitoring API.
+type TokenSource interface {
+	Token() (string, error)
+}
+
+// tokenResponse is the body returned by both the metadata server and the
+// OAuth2 token endpoint.
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+// cachedToken reuses a token until shortly before it expires.
+type cachedToken struct {
+	mtx     sync.Mutex
+	token   string
+	expires time.Time
+	fetch   func() (tokenResponse, error)
+}
+
+func (c *cachedToken) Token() (string, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.token != "" && time.Now().Before(c.expires) {
+		return c.token, nil
+	}
+	resp, err := c.fetch()
+	if err != nil {
+		return "", err
+	}
+	if resp.AccessToken == "" {
+		return "", errors.New("token response did not include an access token")
+	}
+	c.token = resp.AccessToken
+	c.expires = time.Now().Add(time.Duration(resp.ExpiresIn)*time.Second - tokenExpiryMargin)
+	return c.token, nil
+}
+
+func decodeTokenResponse(resp *http.Response) (tokenResponse, error) {
+	defer resp.Body.Close()
+	var tr tokenResponse
+	if resp.StatusCode != http.StatusOK {
+		return tr, fmt.Errorf("token request returned status %s", resp.Status)
+	}
+	err := json.NewDecoder(resp.Body).Decode(&tr)
+	return tr, err
+}
+
+// NewMetadataTokenSource returns a TokenSource that fetches tokens for the
+// instance's default service account from the GCE metadata server.
+func NewMetadataTokenSource(client *http.Client) TokenSource {
+	return &cachedToken{fetch: func() (tokenResponse, error) {
+		req, err := http.NewRequest(http.MethodGet, DefaultMetadataTokenURL, nil)
+		if err != nil {
+			return tokenResponse{}, err
+		}
+		req.Header.Set("Metadata-Flavor", "Google")
+		resp, err := client.Do(req)
+		if err != nil {
+			return tokenResponse{}, err
+		}
+		return decodeTokenResponse(resp)
+	}}
+}
+
+// serviceAccountKey is the subset of a service account key file that is
+// needed to request tokens.
+type serviceAccountKey struct {
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+}
+
+// NewServiceAccountTokenSource returns a TokenSource that exchanges a JWT
+// signed with the service account's private key for access tokens. keyJSON
+// is the contents of a service account key file.
+func NewServiceAccountTokenSource(client *http.Client, keyJSON []byte) (TokenSource, error) {
+	var key serviceAccountKey
+	if err := json.Unmarshal(keyJSON, &key); err != nil {
+		return nil, err
+	}
+	if key.ClientEmail == "" || key.TokenURI == "" {
+		return nil, errors.New("service account key must include client_email and token_uri")
+	}
+	block, _ := pem.Decode([]byte(key.PrivateKey))
+	if block == nil {
+		return nil, errors.New("service account key has no PEM private key")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	privateKey, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("service account private key is not an RSA key")
+	}
+
+	return &cachedToken{fetch: func() (tokenResponse, error) {
+		assertion, err := signJWT(privateKey, key.ClientEmail, key.TokenURI, time.Now())
+		if err != nil {
+			return tokenResponse{}, err
+		}
+		resp, err := client.PostForm(key.TokenURI, url.Values{
+			"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+			"assertion":  {assertion},
+		})
+		if err != nil {
+			return tokenResponse{}, err
+		}
+		return decodeTokenResponse(resp)
+	}}, nil
+}
+
+// signJWT creates the RS256-signed assertion used in the OAuth2 JWT bearer
+// grant.
+func signJWT(key *rsa.PrivateKey, email, audience string, now time.Time) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss":   email,
+		"scope": MonitoringWriteScope,
+		"aud":   audience,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	signingInput := strings.Join([]string{
+		base64.RawURLEncoding.EncodeToString(header),
+		base64.RawURLEncoding.EncodeToString(claims),
+	}, ".")
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
@@ -0,0 +1,389 @@
+package cloudmonitoring
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/Sirupsen/logrus"
+	"github.com/stripe/veneur/plugins"
+	"github.com/stripe/veneur/samplers"
+)
+
+var _ plugins.DistributionPlugin = &CloudMonitoringPlugin{}
+
+// DefaultEndpoint is the Cloud Monitoring API.
+const DefaultEndpoint = "https://monitoring.googleapis.com"
+
+// MaxSeriesPerRequest is the most time series that projects.timeSeries.create
+// accepts in a single request.
+const MaxSeriesPerRequest = 200
+
+// MetricTypePrefix is prepended to every metric name to form a custom
+// metric type.
+const MetricTypePrefix = "custom.googleapis.com/"
+
+// Distributions are bucketed exponentially: the first finite bucket starts
+// at bucketScale, and each bucket is bucketGrowthFactor times wider than the
+// last. This covers values from 0.001 to about 1e9.
+const (
+	bucketScale            = 0.001
+	bucketGrowthFactor     = 2
+	bucketNumFiniteBuckets = 40
+)
+
+// CloudMonitoringPlugin is a plugin for emitting metrics to Google Cloud
+// Monitoring as custom metrics.
+type CloudMonitoringPlugin struct {
+	Logger      *logrus.Logger
+	Project     string
+	Endpoint    string
+	HTTPClient  *http.Client
+	Statsd      *statsd.Client
+	TokenSource TokenSource
+}
+
+// NewCloudMonitoringPlugin creates a new Cloud Monitoring plugin that writes
+// to project. If credentialsFile is empty, access tokens are fetched from
+// the GCE metadata server; otherwise it must be a service account key file.
+func NewCloudMonitoringPlugin(logger *logrus.Logger, project string, credentialsFile string, client *http.Client, stats *statsd.Client) (*CloudMonitoringPlugin, error) {
+	if project == "" {
+		return nil, fmt.Errorf("a GCP project is required")
+	}
+	var tokens TokenSource
+	if credentialsFile == "" {
+		tokens = NewMetadataTokenSource(client)
+	} else {
+		key, err := ioutil.ReadFile(credentialsFile)
+		if err != nil {
+			return nil, err
+		}
+		tokens, err = NewServiceAccountTokenSource(client, key)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &CloudMonitoringPlugin{
+		Logger:      logger,
+		Project:     project,
+		Endpoint:    DefaultEndpoint,
+		HTTPClient:  client,
+		Statsd:      stats,
+		TokenSource: tokens,
+	}, nil
+}
+
+// TimeSeries is a subset of the Cloud Monitoring TimeSeries resource.
+// See https://cloud.google.com/monitoring/api/ref_v3/rest/v3/TimeSeries
+type TimeSeries struct {
+	Metric     Metric            `json:"metric"`
+	Resource   MonitoredResource `json:"resource"`
+	MetricKind string            `json:"metricKind"`
+	ValueType  string            `json:"valueType"`
+	Points     []Point           `json:"points"`
+}
+
+// Metric identifies a custom metric by its type and labels.
+type Metric struct {
+	Type   string            `json:"type"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// MonitoredResource is the resource that a time series is written against.
+type MonitoredResource struct {
+	Type   string            `json:"type"`
+	Labels map[string]string `json:"labels"`
+}
+
+// Point is a single value of a time series.
+type Point struct {
+	Interval TimeInterval `json:"interval"`
+	Value    TypedValue   `json:"value"`
+}
+
+// TimeInterval is the time a point applies to. Gauges only need an end time.
+type TimeInterval struct {
+	EndTime string `json:"endTime"`
+}
+
+// TypedValue holds exactly one of its fields.
+type TypedValue struct {
+	DoubleValue       *float64      `json:"doubleValue,omitempty"`
+	DistributionValue *Distribution `json:"distributionValue,omitempty"`
+}
+
+// Distribution is a bucketed summary of a histogram. int64 fields are
+// encoded as strings, as the API requires.
+type Distribution struct {
+	Count                 int64         `json:"count,string"`
+	Mean                  float64       `json:"mean"`
+	SumOfSquaredDeviation float64       `json:"sumOfSquaredDeviation"`
+	BucketOptions         BucketOptions `json:"bucketOptions"`
+	BucketCounts          []string      `json:"bucketCounts"`
+}
+
+// BucketOptions describes the bucket boundaries of a Distribution.
+type BucketOptions struct {
+	ExponentialBuckets ExponentialBuckets `json:"exponentialBuckets"`
+}
+
+// ExponentialBuckets are buckets whose widths grow by a constant factor.
+type ExponentialBuckets struct {
+	NumFiniteBuckets int     `json:"numFiniteBuckets"`
+	GrowthFactor     float64 `json:"growthFactor"`
+	Scale            float64 `json:"scale"`
+}
+
+type createTimeSeriesRequest struct {
+	TimeSeries []TimeSeries `json:"timeSeries"`
+}
+
+// Flush sends a slice of metrics to Cloud Monitoring.
+func (p *CloudMonitoringPlugin) Flush(metrics []samplers.DDMetric, hostname string) error {
+	series := make([]TimeSeries, 0, len(metrics))
+	for _, metric := range metrics {
+		series = append(series, p.metricTimeSeries(metric, hostname))
+	}
+	return p.writeTimeSeries(series)
+}
+
+// FlushDistributions sends histograms to Cloud Monitoring using the
+// DISTRIBUTION value type.
+func (p *CloudMonitoringPlugin) FlushDistributions(distributions []samplers.DDDistribution, hostname string) error {
+	series := make([]TimeSeries, 0, len(distributions))
+	for _, d := range distributions {
+		series = append(series, p.distributionTimeSeries(d, hostname))
+	}
+	return p.writeTimeSeries(series)
+}
+
+// Name returns the name of the plugin.
+func (p *CloudMonitoringPlugin) Name() string {
+	return "cloud_monitoring"
+}
+
+func (p *CloudMonitoringPlugin) metricTimeSeries(metric samplers.DDMetric, hostname string) TimeSeries {
+	value := metric.Value[0][1]
+	return p.timeSeries(metric.Name, metric.Tags, metric.Hostname, hostname, "DOUBLE", Point{
+		Interval: timeInterval(metric.Value[0][0]),
+		Value:    TypedValue{DoubleValue: &value},
+	})
+}
+
+func (p *CloudMonitoringPlugin) distributionTimeSeries(d samplers.DDDistribution, hostname string) TimeSeries {
+	return p.timeSeries(d.Name, d.Tags, d.Hostname, hostname, "DISTRIBUTION", Point{
+		Interval: timeInterval(d.Points[0].Timestamp),
+		Value:    TypedValue{DistributionValue: newDistribution(d.Points[0])},
+	})
+}
+
+func (p *CloudMonitoringPlugin) timeSeries(name string, tags []string, metricHost, hostname, valueType string, point Point) TimeSeries {
+	labels := tagLabels(tags)
+	if metricHost == "" {
+		metricHost = hostname
+	}
+	if metricHost != "" {
+		labels["host"] = metricHost
+	}
+	return TimeSeries{
+		Metric: Metric{
+			Type:   MetricTypePrefix + strings.Replace(name, ".", "/", -1),
+			Labels: labels,
+		},
+		Resource: MonitoredResource{
+			Type:   "global",
+			Labels: map[string]string{"project_id": p.Project},
+		},
+		MetricKind: "GAUGE",
+		ValueType:  valueType,
+		Points:     []Point{point},
+	}
+}
+
+func timeInterval(timestamp float64) TimeInterval {
+	return TimeInterval{
+		EndTime: time.Unix(int64(timestamp), 0).UTC().Format(time.RFC3339),
+	}
+}
+
+// tagLabels converts Veneur's "key:value" tags to metric labels. Tags without
+// a value become labels with the value "true". Label keys may only contain
+// lowercase letters, digits and underscores, so anything else is replaced.
+func tagLabels(tags []string) map[string]string {
+	labels := make(map[string]string, len(tags)+1)
+	for _, tag := range tags {
+		key, value := tag, "true"
+		if i := strings.IndexByte(tag, ':'); i >= 0 {
+			key, value = tag[:i], tag[i+1:]
+		}
+		labels[labelKey(key)] = value
+	}
+	return labels
+}
+
+func labelKey(key string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '_':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r - 'A' + 'a'
+		}
+		return '_'
+	}, key)
+}
+
+// newDistribution buckets the values of a histogram, by weight.
+func newDistribution(point samplers.DDDistributionPoint) *Distribution {
+	values := point.Values
+	weight := func(i int) float64 {
+		if point.Weights == nil {
+			return 1
+		}
+		return point.Weights[i]
+	}
+	count := point.Count()
+	d := &Distribution{
+		Count: int64(count + 0.5),
+		BucketOptions: BucketOptions{ExponentialBuckets: ExponentialBuckets{
+			NumFiniteBuckets: bucketNumFiniteBuckets,
+			GrowthFactor:     bucketGrowthFactor,
+			Scale:            bucketScale,
+		}},
+	}
+	if len(values) == 0 {
+		return d
+	}
+
+	var sum float64
+	for i, v := range values {
+		sum += v * weight(i)
+	}
+	d.Mean = sum / count
+
+	// bucket 0 is the underflow bucket and the last is the overflow bucket
+	weights := make([]float64, bucketNumFiniteBuckets+2)
+	for i, v := range values {
+		d.SumOfSquaredDeviation += (v - d.Mean) * (v - d.Mean) * weight(i)
+		weights[bucketIndex(v)] += weight(i)
+	}
+	counts := make([]int64, len(weights))
+	for i, w := range weights {
+		counts[i] = int64(w + 0.5)
+	}
+	// trailing empty buckets may be omitted
+	last := len(counts) - 1
+	for last > 0 && counts[last] == 0 {
+		last--
+	}
+	for _, c := range counts[:last+1] {
+		d.BucketCounts = append(d.BucketCounts, fmt.Sprint(c))
+	}
+	return d
+}
+
+// bucketIndex returns the exponential bucket that v falls into. Finite bucket
+// i, for 1 <= i <= N, holds values in [scale * growth^(i-1), scale * growth^i).
+func bucketIndex(v float64) int {
+	if v < bucketScale {
+		return 0
+	}
+	i := int(math.Floor(math.Log(v/bucketScale)/math.Log(bucketGrowthFactor))) + 1
+	if i > bucketNumFiniteBuckets+1 {
+		i = bucketNumFiniteBuckets + 1
+	}
+	return i
+}
+
+// writeTimeSeries calls projects.timeSeries.create, in batches of at most
+// MaxSeriesPerRequest series.
+func (p *CloudMonitoringPlugin) writeTimeSeries(series []TimeSeries) error {
+	p.Statsd.Gauge("flush.post_metrics_total", float64(len(series)), nil, 1.0)
+	if len(series) == 0 {
+		p.Logger.Info("Nothing to flush, skipping.")
+		return nil
+	}
+
+	var lastErr error
+	for start := 0; start < len(series); start += MaxSeriesPerRequest {
+		end := start + MaxSeriesPerRequest
+		if end > len(series) {
+			end = len(series)
+		}
+		if err := p.postHelper(series[start:end]); err != nil {
+			// keep going, a bad batch shouldn't lose the others
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+func (p *CloudMonitoringPlugin) postHelper(series []TimeSeries) error {
+	// attach this field to all the logs we generate
+	innerLogger := p.Logger.WithField("action", "cloud_monitoring_post")
+
+	body, err := json.Marshal(createTimeSeriesRequest{TimeSeries: series})
+	if err != nil {
+		p.Statsd.Count("cloud_monitoring_post.error_total", 1, []string{"cause:json"}, 1.0)
+		innerLogger.WithError(err).Error("Could not render JSON")
+		return err
+	}
+	p.Statsd.Histogram("cloud_monitoring_post.content_length_bytes", float64(len(body)), nil, 1.0)
+
+	token, err := p.TokenSource.Token()
+	if err != nil {
+		p.Statsd.Count("cloud_monitoring_post.error_total", 1, []string{"cause:auth"}, 1.0)
+		innerLogger.WithError(err).Error("Could not get an access token")
+		return err
+	}
+
+	endpoint := fmt.Sprintf("%s/v3/projects/%s/timeSeries", p.Endpoint, url.PathEscape(p.Project))
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		p.Statsd.Count("cloud_monitoring_post.error_total", 1, []string{"cause:construct"}, 1.0)
+		innerLogger.WithError(err).Error("Could not construct request")
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	requestStart := time.Now()
+	resp, err := p.HTTPClient.Do(req)
+	if err != nil {
+		p.Statsd.Count("cloud_monitoring_post.error_total", 1, []string{"cause:io"}, 1.0)
+		innerLogger.WithError(err).Error("Could not execute request")
+		return err
+	}
+	p.Statsd.TimeInMilliseconds("cloud_monitoring_post.duration_ns", float64(time.Since(requestStart).Nanoseconds()), []string{"part:post"}, 1.0)
+	defer resp.Body.Close()
+
+	responseBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		// this error is not fatal, since we only need the body for reporting
+		// purposes
+		p.Statsd.Count("cloud_monitoring_post.error_total", 1, []string{"cause:readresponse"}, 1.0)
+		innerLogger.WithError(err).Error("Could not read response body")
+	}
+	resultLogger := innerLogger.WithFields(logrus.Fields{
+		"status":   resp.Status,
+		"response": string(responseBody),
+	})
+
+	if resp.StatusCode != http.StatusOK {
+		p.Statsd.Count("cloud_monitoring_post.error_total", 1, []string{fmt.Sprintf("cause:%d", resp.StatusCode)}, 1.0)
+		resultLogger.Error("Could not POST")
+		return fmt.Errorf("cloud monitoring returned status %s", resp.Status)
+	}
+
+	// make sure the error metric isn't sparse
+	p.Statsd.Count("cloud_monitoring_post.error_total", 0, nil, 1.0)
+	resultLogger.Debug("POSTed successfully")
+	return nil
+}
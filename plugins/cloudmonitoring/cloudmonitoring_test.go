@@ -0,0 +1,197 @@
+package cloudmonitoring
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stripe/veneur/samplers"
+)
+
+type staticToken string
+
+func (t staticToken) Token() (string, error) {
+	return string(t), nil
+}
+
+// newTestPlugin returns a plugin that writes to a mock API, and a channel
+// that receives every request body the mock API accepts.
+func newTestPlugin(t *testing.T) (*CloudMonitoringPlugin, <-chan createTimeSeriesRequest, func()) {
+	received := make(chan createTimeSeriesRequest, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v3/projects/my-project/timeSeries", r.URL.Path)
+		assert.Equal(t, "Bearer test-token", r.Header.Get("Authorization"))
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		var body createTimeSeriesRequest
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		received <- body
+		w.Write([]byte("{}"))
+	}))
+	plugin := &CloudMonitoringPlugin{
+		Logger:      logrus.New(),
+		Project:     "my-project",
+		Endpoint:    server.URL,
+		HTTPClient:  http.DefaultClient,
+		TokenSource: staticToken("test-token"),
+	}
+	return plugin, received, server.Close
+}
+
+func TestName(t *testing.T) {
+	plugin := &CloudMonitoringPlugin{}
+	assert.Equal(t, "cloud_monitoring", plugin.Name())
+}
+
+func TestNewRequiresProject(t *testing.T) {
+	_, err := NewCloudMonitoringPlugin(logrus.New(), "", "", http.DefaultClient, nil)
+	assert.Error(t, err)
+}
+
+func TestFlushBatches(t *testing.T) {
+	plugin, received, closeServer := newTestPlugin(t)
+	defer closeServer()
+
+	metrics := make([]samplers.DDMetric, 450)
+	for i := range metrics {
+		metrics[i] = samplers.DDMetric{
+			Name:       fmt.Sprintf("a.b.c%d", i),
+			Value:      [1][2]float64{{1476119058, float64(i)}},
+			Tags:       []string{"foo:bar", "Peer.Host:example", "canary"},
+			MetricType: "gauge",
+		}
+	}
+	assert.NoError(t, plugin.Flush(metrics, "globalstats"))
+
+	var sizes []int
+	for len(sizes) < 3 {
+		sizes = append(sizes, len((<-received).TimeSeries))
+	}
+	assert.Equal(t, []int{200, 200, 50}, sizes, "should respect the per-request series limit")
+
+	series := plugin.metricTimeSeries(metrics[1], "globalstats")
+	value := 1.0
+	assert.Equal(t, TimeSeries{
+		Metric: Metric{
+			Type: "custom.googleapis.com/a/b/c1",
+			Labels: map[string]string{
+				"foo":       "bar",
+				"peer_host": "example",
+				"canary":    "true",
+				"host":      "globalstats",
+			},
+		},
+		Resource: MonitoredResource{
+			Type:   "global",
+			Labels: map[string]string{"project_id": "my-project"},
+		},
+		MetricKind: "GAUGE",
+		ValueType:  "DOUBLE",
+		Points: []Point{{
+			Interval: TimeInterval{EndTime: "2016-10-10T17:04:18Z"},
+			Value:    TypedValue{DoubleValue: &value},
+		}},
+	}, series)
+}
+
+func TestFlushDistributions(t *testing.T) {
+	plugin, received, closeServer := newTestPlugin(t)
+	defer closeServer()
+
+	distributions := []samplers.DDDistribution{{
+		Name:     "a.b.c",
+		Points:   [1]samplers.DDDistributionPoint{{Timestamp: 1476119058, Values: []float64{0.0005, 0.0015, 3, 3}}},
+		Tags:     []string{"foo:bar"},
+		Hostname: "host1",
+	}}
+	assert.NoError(t, plugin.FlushDistributions(distributions, "globalstats"))
+
+	body := <-received
+	assert.Len(t, body.TimeSeries, 1)
+	series := body.TimeSeries[0]
+	assert.Equal(t, "custom.googleapis.com/a/b/c", series.Metric.Type)
+	assert.Equal(t, "host1", series.Metric.Labels["host"], "the metric's own host takes precedence")
+	assert.Equal(t, "DISTRIBUTION", series.ValueType)
+
+	d := series.Points[0].Value.DistributionValue
+	if !assert.NotNil(t, d) {
+		return
+	}
+	assert.Nil(t, series.Points[0].Value.DoubleValue)
+	assert.Equal(t, int64(4), d.Count)
+	assert.InEpsilon(t, 1.5005, d.Mean, 1e-9)
+	// 0.0005 underflows, 0.0015 is in [0.001, 0.002), 3 is in [2.048, 4.096)
+	expected := make([]string, 13)
+	for i := range expected {
+		expected[i] = "0"
+	}
+	expected[0], expected[1], expected[12] = "1", "1", "2"
+	assert.Equal(t, expected, d.BucketCounts)
+}
+
+func TestNewDistributionWeights(t *testing.T) {
+	d := newDistribution(samplers.DDDistributionPoint{Values: []float64{1, 3}, Weights: []float64{1, 3}})
+	assert.Equal(t, int64(4), d.Count)
+	assert.InEpsilon(t, 2.5, d.Mean, 1e-9)
+	assert.InEpsilon(t, 3, d.SumOfSquaredDeviation, 1e-9)
+}
+
+func TestServiceAccountToken(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	assert.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	assert.NoError(t, err)
+
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		assert.NoError(t, r.ParseForm())
+		assert.Equal(t, "urn:ietf:params:oauth:grant-type:jwt-bearer", r.PostForm.Get("grant_type"))
+
+		parts := strings.Split(r.PostForm.Get("assertion"), ".")
+		if !assert.Len(t, parts, 3) {
+			return
+		}
+		digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+		assert.NoError(t, err)
+		assert.NoError(t, rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], signature))
+
+		claimsJSON, err := base64.RawURLEncoding.DecodeString(parts[1])
+		assert.NoError(t, err)
+		var claims map[string]interface{}
+		assert.NoError(t, json.Unmarshal(claimsJSON, &claims))
+		assert.Equal(t, "veneur@my-project.iam.gserviceaccount.com", claims["iss"])
+		assert.Equal(t, MonitoringWriteScope, claims["scope"])
+
+		w.Write([]byte(`{"access_token": "sa-token", "expires_in": 3600}`))
+	}))
+	defer server.Close()
+
+	keyJSON, err := json.Marshal(serviceAccountKey{
+		ClientEmail: "veneur@my-project.iam.gserviceaccount.com",
+		PrivateKey:  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		TokenURI:    server.URL,
+	})
+	assert.NoError(t, err)
+
+	tokens, err := NewServiceAccountTokenSource(http.DefaultClient, keyJSON)
+	assert.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		token, err := tokens.Token()
+		assert.NoError(t, err)
+		assert.Equal(t, "sa-token", token)
+	}
+	assert.Equal(t, 1, requests, "tokens should be reused until they expire")
+}
@@ -0,0 +1,116 @@
+package cloudwatch
+
+import (
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/client/metadata"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/aws/aws-sdk-go/private/protocol"
+	"github.com/aws/aws-sdk-go/private/protocol/query"
+)
+
+// The vendored AWS SDK doesn't include CloudWatch, so this is the part of
+// its client that PutMetricData needs, in the style of the generated
+// service clients.
+
+// ServiceName is the name of the CloudWatch service in endpoints and
+// request signatures.
+const ServiceName = "monitoring"
+
+const opPutMetricData = "PutMetricData"
+
+// CloudWatchAPI is the part of the CloudWatch API used by the plugin, so
+// that it can be replaced in tests.
+type CloudWatchAPI interface {
+	PutMetricData(*PutMetricDataInput) (*PutMetricDataOutput, error)
+}
+
+var _ CloudWatchAPI = &Client{}
+
+// Client is a CloudWatch client that can only call PutMetricData.
+type Client struct {
+	*client.Client
+}
+
+// NewClient creates a CloudWatch client from a session, eg
+// session.NewSession.
+func NewClient(p client.ConfigProvider, cfgs ...*aws.Config) *Client {
+	c := p.ClientConfig(ServiceName, cfgs...)
+	svc := &Client{
+		Client: client.New(
+			*c.Config,
+			metadata.ClientInfo{
+				ServiceName:   ServiceName,
+				SigningRegion: c.SigningRegion,
+				Endpoint:      c.Endpoint,
+				APIVersion:    "2010-08-01",
+			},
+			c.Handlers,
+		),
+	}
+	svc.Handlers.Sign.PushBackNamed(v4.SignRequestHandler)
+	svc.Handlers.Build.PushBackNamed(query.BuildHandler)
+	svc.Handlers.Unmarshal.PushBackNamed(query.UnmarshalHandler)
+	svc.Handlers.UnmarshalMeta.PushBackNamed(query.UnmarshalMetaHandler)
+	svc.Handlers.UnmarshalError.PushBackNamed(query.UnmarshalErrorHandler)
+	return svc
+}
+
+// PutMetricData publishes datapoints to CloudWatch.
+func (c *Client) PutMetricData(input *PutMetricDataInput) (*PutMetricDataOutput, error) {
+	op := &request.Operation{
+		Name:       opPutMetricData,
+		HTTPMethod: "POST",
+		HTTPPath:   "/",
+	}
+	output := &PutMetricDataOutput{}
+	req := c.NewRequest(op, input, output)
+	// the response has no result to unmarshal
+	req.Handlers.Unmarshal.Remove(query.UnmarshalHandler)
+	req.Handlers.Unmarshal.PushBackNamed(protocol.UnmarshalDiscardBodyHandler)
+	return output, req.Send()
+}
+
+// PutMetricDataInput is the request of PutMetricData.
+type PutMetricDataInput struct {
+	_ struct{} `type:"structure"`
+
+	// At most MaxDatumsPerRequest datapoints.
+	MetricData []*MetricDatum `type:"list" required:"true"`
+
+	Namespace *string `min:"1" type:"string" required:"true"`
+}
+
+// PutMetricDataOutput is the empty response of PutMetricData.
+type PutMetricDataOutput struct {
+	_ struct{} `type:"structure"`
+}
+
+// MetricDatum is one datapoint of a metric.
+type MetricDatum struct {
+	_ struct{} `type:"structure"`
+
+	// At most MaxDimensions dimensions.
+	Dimensions []*Dimension `type:"list"`
+
+	MetricName *string `min:"1" type:"string" required:"true"`
+
+	Timestamp *time.Time `type:"timestamp" timestampFormat:"iso8601"`
+
+	Unit *string `type:"string" enum:"StandardUnit"`
+
+	Value *float64 `type:"double"`
+}
+
+// Dimension is a name and value that, with the metric name, identify a
+// CloudWatch metric.
+type Dimension struct {
+	_ struct{} `type:"structure"`
+
+	Name *string `min:"1" type:"string" required:"true"`
+
+	Value *string `min:"1" type:"string" required:"true"`
+}
@@ -0,0 +1,202 @@
+package cloudwatch
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/Sirupsen/logrus"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/stripe/veneur/plugins"
+	"github.com/stripe/veneur/samplers"
+)
+
+var _ plugins.Plugin = &CloudWatchPlugin{}
+
+// MaxDatumsPerRequest is the most datapoints that PutMetricData accepts in
+// a single request.
+const MaxDatumsPerRequest = 20
+
+// MaxDimensions is the most dimensions a CloudWatch metric can have.
+const MaxDimensions = 10
+
+// maxDimensionLength is the longest a dimension's name or value can be.
+const maxDimensionLength = 255
+
+// CloudWatchPlugin is a plugin for emitting metrics to Amazon CloudWatch.
+type CloudWatchPlugin struct {
+	Logger    *logrus.Logger
+	Namespace string
+	Svc       CloudWatchAPI
+	Statsd    *statsd.Client
+}
+
+// NewCloudWatchPlugin creates a plugin that publishes metrics to namespace
+// with svc, usually a Client.
+func NewCloudWatchPlugin(logger *logrus.Logger, namespace string, svc CloudWatchAPI, stats *statsd.Client) (*CloudWatchPlugin, error) {
+	if namespace == "" {
+		return nil, errors.New("a CloudWatch namespace is required")
+	}
+	if strings.HasPrefix(namespace, "AWS/") {
+		return nil, fmt.Errorf("cloudwatch_namespace %q must not start with AWS/, which is reserved for AWS services", namespace)
+	}
+	return &CloudWatchPlugin{
+		Logger:    logger,
+		Namespace: namespace,
+		Svc:       svc,
+		Statsd:    stats,
+	}, nil
+}
+
+// Name returns the name of the plugin.
+func (p *CloudWatchPlugin) Name() string {
+	return "cloudwatch"
+}
+
+// Flush publishes the metrics to CloudWatch, in requests of at most
+// MaxDatumsPerRequest datapoints. Metrics with more than MaxDimensions
+// dimensions lose the rest, with a warning. It returns the first error, but
+// still sends every batch.
+func (p *CloudWatchPlugin) Flush(metrics []samplers.DDMetric, hostname string) error {
+	p.Statsd.Gauge("cloudwatch.post_metrics_total", float64(len(metrics)), nil, 1.0)
+
+	datums := make([]*MetricDatum, 0, len(metrics))
+	truncated := 0
+	for _, metric := range metrics {
+		if math.IsNaN(metric.Value[0][1]) || math.IsInf(metric.Value[0][1], 0) {
+			// CloudWatch rejects the whole request for one of these
+			p.Statsd.Count("cloudwatch.error_total", 1, []string{"cause:invalid_value"}, 1.0)
+			continue
+		}
+		datum, dropped := Datum(metric, hostname)
+		if dropped > 0 {
+			truncated++
+			p.Logger.WithFields(logrus.Fields{
+				"metric":     metric.Name,
+				"dimensions": dropped,
+			}).Warn("Dropping dimensions over CloudWatch's limit")
+		}
+		datums = append(datums, datum)
+	}
+	if truncated > 0 {
+		p.Statsd.Count("cloudwatch.truncated_dimensions_total", int64(truncated), nil, 1.0)
+	}
+	if len(datums) == 0 {
+		p.Logger.Info("Nothing to flush, skipping.")
+		return nil
+	}
+
+	var firstErr error
+	for start := 0; start < len(datums); start += MaxDatumsPerRequest {
+		end := start + MaxDatumsPerRequest
+		if end > len(datums) {
+			end = len(datums)
+		}
+		requestStart := time.Now()
+		_, err := p.Svc.PutMetricData(&PutMetricDataInput{
+			Namespace:  aws.String(p.Namespace),
+			MetricData: datums[start:end],
+		})
+		if err != nil {
+			p.Statsd.Count("cloudwatch.error_total", 1, []string{"cause:io"}, 1.0)
+			p.Logger.WithError(err).WithField("datapoints", end-start).Error("Could not put metric data to CloudWatch")
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		p.Statsd.TimeInMilliseconds("cloudwatch.duration_ns", float64(time.Since(requestStart).Nanoseconds()), []string{"part:post"}, 1.0)
+	}
+	return firstErr
+}
+
+// Datum converts a metric to a CloudWatch datapoint, and returns how many
+// dimensions were dropped over MaxDimensions. A histogram's percentiles, eg
+// a.b.c.99percentile, are named like a.b.c.p99, so that each is its own
+// metric. Veneur's "key:value" tags become dimensions, split on the first
+// colon, and tags without a value get the value "true". The metric's host,
+// or else hostname, and device are the dimensions "host" and "device".
+// Since dimensions are ordered the same way before any are dropped, a
+// metric is always published with the same ones.
+func Datum(metric samplers.DDMetric, hostname string) (*MetricDatum, int) {
+	name := metric.Name
+	if histogram, _, ok := samplers.ParsePercentileName(name); ok {
+		name = histogram + ".p" + strings.TrimSuffix(name[len(histogram)+1:], "percentile")
+	}
+	host := metric.Hostname
+	if host == "" {
+		host = hostname
+	}
+
+	dimensions := Dimensions(metric.Tags, host, metric.DeviceName)
+	dropped := 0
+	if len(dimensions) > MaxDimensions {
+		dropped = len(dimensions) - MaxDimensions
+		dimensions = dimensions[:MaxDimensions]
+	}
+
+	unit := "None"
+	if metric.MetricType == "rate" {
+		unit = "Count/Second"
+	}
+	return &MetricDatum{
+		MetricName: aws.String(name),
+		Dimensions: dimensions,
+		Timestamp:  aws.Time(time.Unix(int64(metric.Value[0][0]), 0)),
+		Unit:       aws.String(unit),
+		Value:      aws.Float64(metric.Value[0][1]),
+	}, dropped
+}
+
+// Dimensions converts host, device and tags to dimensions. The host and
+// device come first, so that they are never dropped, followed by the tags
+// sorted by key. Tags that repeat the host or device, or an earlier tag, are
+// dropped, as are tags with an empty key or value.
+func Dimensions(tags []string, host, device string) []*Dimension {
+	var dimensions []*Dimension
+	pairs := map[string]string{}
+	for _, fixed := range [][2]string{{"host", host}, {"device", device}} {
+		if fixed[1] != "" {
+			pairs[fixed[0]] = fixed[1]
+			dimensions = append(dimensions, dimension(fixed[0], fixed[1]))
+		}
+	}
+
+	var keys []string
+	for _, tag := range tags {
+		key, value := tag, "true"
+		if i := strings.IndexByte(tag, ':'); i >= 0 {
+			key, value = tag[:i], tag[i+1:]
+		}
+		if _, ok := pairs[key]; ok || key == "" || value == "" {
+			continue
+		}
+		pairs[key] = value
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		dimensions = append(dimensions, dimension(key, pairs[key]))
+	}
+	return dimensions
+}
+
+// dimension creates a dimension, truncating its name and value to the
+// longest CloudWatch allows.
+func dimension(name, value string) *Dimension {
+	return &Dimension{
+		Name:  aws.String(truncate(name)),
+		Value: aws.String(truncate(value)),
+	}
+}
+
+func truncate(s string) string {
+	if len(s) > maxDimensionLength {
+		return s[:maxDimensionLength]
+	}
+	return s
+}
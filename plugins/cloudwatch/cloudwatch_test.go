@@ -0,0 +1,144 @@
+package cloudwatch
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/stretchr/testify/assert"
+	"github.com/stripe/veneur/samplers"
+)
+
+// fakeCloudWatch records every request, and fails those in fail.
+type fakeCloudWatch struct {
+	inputs []*PutMetricDataInput
+	fail   map[int]bool
+}
+
+func (f *fakeCloudWatch) PutMetricData(input *PutMetricDataInput) (*PutMetricDataOutput, error) {
+	f.inputs = append(f.inputs, input)
+	if f.fail[len(f.inputs)-1] {
+		return nil, errors.New("throttled")
+	}
+	return &PutMetricDataOutput{}, nil
+}
+
+func dimensionMap(dimensions []*Dimension) map[string]string {
+	ret := map[string]string{}
+	for _, d := range dimensions {
+		ret[*d.Name] = *d.Value
+	}
+	return ret
+}
+
+func TestNewCloudWatchPlugin(t *testing.T) {
+	plugin, err := NewCloudWatchPlugin(logrus.New(), "Veneur", &fakeCloudWatch{}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "cloudwatch", plugin.Name())
+
+	_, err = NewCloudWatchPlugin(logrus.New(), "", &fakeCloudWatch{}, nil)
+	assert.Error(t, err)
+	_, err = NewCloudWatchPlugin(logrus.New(), "AWS/EC2", &fakeCloudWatch{}, nil)
+	assert.Error(t, err, "AWS namespaces are reserved")
+}
+
+func TestDatum(t *testing.T) {
+	datum, dropped := Datum(samplers.DDMetric{
+		Name:       "a.b.c.99percentile",
+		Value:      [1][2]float64{{1476119058, 0.25}},
+		Tags:       []string{"region:us-west", "canary", "empty:"},
+		MetricType: "gauge",
+		DeviceName: "sda",
+	}, "globalstats")
+	assert.Equal(t, 0, dropped)
+	assert.Equal(t, "a.b.c.p99", *datum.MetricName, "percentiles should be distinct metrics")
+	assert.Equal(t, 0.25, *datum.Value)
+	assert.Equal(t, int64(1476119058), datum.Timestamp.Unix())
+	assert.Equal(t, "None", *datum.Unit)
+	assert.Equal(t, map[string]string{
+		"canary": "true",
+		"device": "sda",
+		"host":   "globalstats",
+		"region": "us-west",
+	}, dimensionMap(datum.Dimensions))
+	assert.Equal(t, "host", *datum.Dimensions[0].Name, "the host should come first")
+	assert.Equal(t, "canary", *datum.Dimensions[2].Name, "tags should be sorted")
+
+	datum, _ = Datum(samplers.DDMetric{Name: "a.b.c", MetricType: "rate", Hostname: "web1"}, "globalstats")
+	assert.Equal(t, "Count/Second", *datum.Unit)
+	assert.Equal(t, map[string]string{"host": "web1"}, dimensionMap(datum.Dimensions))
+}
+
+func TestDatumTruncatesDimensions(t *testing.T) {
+	var tags []string
+	for i := 0; i < 12; i++ {
+		tags = append(tags, fmt.Sprintf("tag%02d:value", i))
+	}
+	datum, dropped := Datum(samplers.DDMetric{Name: "a.b.c", Tags: tags}, "globalstats")
+	assert.Equal(t, 3, dropped, "the host is a dimension too")
+	assert.Len(t, datum.Dimensions, MaxDimensions)
+	assert.Equal(t, "host", *datum.Dimensions[0].Name, "the host should be kept")
+	assert.Equal(t, "tag08", *datum.Dimensions[MaxDimensions-1].Name, "the last tags by key should be dropped")
+}
+
+func TestFlushBatches(t *testing.T) {
+	svc := &fakeCloudWatch{fail: map[int]bool{1: true}}
+	plugin, err := NewCloudWatchPlugin(logrus.New(), "Veneur", svc, nil)
+	assert.NoError(t, err)
+
+	metrics := make([]samplers.DDMetric, 45)
+	for i := range metrics {
+		metrics[i] = samplers.DDMetric{Name: fmt.Sprintf("a.b.c%d", i), Value: [1][2]float64{{1476119058, 1}}, MetricType: "gauge"}
+	}
+	err = plugin.Flush(metrics, "globalstats")
+	assert.Error(t, err, "a failed batch should be reported")
+	if assert.Len(t, svc.inputs, 3, "every batch should be sent, even after a failure") {
+		assert.Len(t, svc.inputs[0].MetricData, 20)
+		assert.Len(t, svc.inputs[1].MetricData, 20)
+		assert.Len(t, svc.inputs[2].MetricData, 5)
+		assert.Equal(t, "Veneur", *svc.inputs[2].Namespace)
+		assert.Equal(t, "a.b.c44", *svc.inputs[2].MetricData[4].MetricName)
+	}
+}
+
+func TestClientPutMetricData(t *testing.T) {
+	var form url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		form, _ = url.ParseQuery(string(body))
+		w.Write([]byte(`<PutMetricDataResponse xmlns="http://monitoring.amazonaws.com/doc/2010-08-01/"><ResponseMetadata><RequestId>1</RequestId></ResponseMetadata></PutMetricDataResponse>`))
+	}))
+	defer server.Close()
+
+	sess, err := session.NewSession(&aws.Config{
+		Region:      aws.String("us-west-2"),
+		Endpoint:    aws.String(server.URL),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+	})
+	assert.NoError(t, err)
+	plugin, err := NewCloudWatchPlugin(logrus.New(), "Veneur", NewClient(sess), nil)
+	assert.NoError(t, err)
+
+	assert.NoError(t, plugin.Flush([]samplers.DDMetric{{
+		Name:       "a.b.c",
+		Value:      [1][2]float64{{1476119058, 0.5}},
+		Tags:       []string{"region:us-west"},
+		MetricType: "gauge",
+	}}, "globalstats"))
+	assert.Equal(t, "PutMetricData", form.Get("Action"))
+	assert.Equal(t, "Veneur", form.Get("Namespace"))
+	assert.Equal(t, "a.b.c", form.Get("MetricData.member.1.MetricName"))
+	assert.Equal(t, "0.5", form.Get("MetricData.member.1.Value"))
+	assert.Equal(t, "2016-10-10T17:04:18Z", form.Get("MetricData.member.1.Timestamp"))
+	assert.Equal(t, "host", form.Get("MetricData.member.1.Dimensions.member.1.Name"))
+	assert.Equal(t, "region", form.Get("MetricData.member.1.Dimensions.member.2.Name"))
+	assert.Equal(t, "us-west", form.Get("MetricData.member.1.Dimensions.member.2.Value"))
+}
@@ -0,0 +1,204 @@
+package graphite
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/Sirupsen/logrus"
+	"github.com/stripe/veneur/plugins"
+	"github.com/stripe/veneur/samplers"
+)
+
+var _ plugins.Plugin = &GraphitePlugin{}
+
+// DefaultTemplate names each metric's path after the metric alone.
+const DefaultTemplate = "{name}"
+
+// DefaultMaxBufferedLines is the most lines held while Carbon is
+// unreachable.
+const DefaultMaxBufferedLines = 10000
+
+// DefaultTimeout is how long connecting to Carbon, and each write, may take.
+const DefaultTimeout = 10 * time.Second
+
+// placeholder matches a {field} in a template.
+var placeholder = regexp.MustCompile(`\{([^{}]+)\}`)
+
+// unsafe matches the characters that are replaced in a path. Dots are only
+// allowed in metric names, where they separate the levels of the path.
+var unsafe = regexp.MustCompile(`[^A-Za-z0-9_\-:.]`)
+
+// GraphitePlugin is a plugin for writing flushed metrics to Carbon, the
+// Graphite daemon, in its plaintext protocol.
+type GraphitePlugin struct {
+	Logger           *logrus.Logger
+	Address          string
+	Template         string
+	MaxBufferedLines int
+	Timeout          time.Duration
+	Statsd           *statsd.Client
+
+	mtx  sync.Mutex
+	conn net.Conn
+	// lines that haven't been written yet, oldest first
+	buffered [][]byte
+}
+
+// NewGraphitePlugin creates a plugin that writes to the Carbon at addr, a
+// host:port, naming each metric by tmpl; see Path. If tmpl is empty, it is
+// DefaultTemplate, and if maxBuffered is 0 it is DefaultMaxBufferedLines.
+func NewGraphitePlugin(logger *logrus.Logger, addr, tmpl string, maxBuffered int, stats *statsd.Client) (*GraphitePlugin, error) {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return nil, fmt.Errorf("carbon_address %q must be a host:port: %s", addr, err)
+	}
+	if tmpl == "" {
+		tmpl = DefaultTemplate
+	}
+	if !strings.Contains(tmpl, "{name}") {
+		return nil, fmt.Errorf("carbon_template %q must contain {name}", tmpl)
+	}
+	if maxBuffered < 0 {
+		return nil, fmt.Errorf("carbon_max_buffered_lines %d must not be negative", maxBuffered)
+	}
+	if maxBuffered == 0 {
+		maxBuffered = DefaultMaxBufferedLines
+	}
+	return &GraphitePlugin{
+		Logger:           logger,
+		Address:          addr,
+		Template:         tmpl,
+		MaxBufferedLines: maxBuffered,
+		Timeout:          DefaultTimeout,
+		Statsd:           stats,
+	}, nil
+}
+
+// Name returns the name of the plugin.
+func (p *GraphitePlugin) Name() string {
+	return "graphite"
+}
+
+// Flush writes the metrics to Carbon, one line each, along with any lines
+// that earlier flushes failed to write. If the write fails, the connection
+// is closed and the lines are kept to retry on the next flush, dropping the
+// oldest beyond MaxBufferedLines. Since it isn't known how many of them
+// Carbon received, some may be written twice, which Graphite tolerates as
+// the second replaces the first.
+func (p *GraphitePlugin) Flush(metrics []samplers.DDMetric, hostname string) error {
+	p.Statsd.Gauge("graphite.post_metrics_total", float64(len(metrics)), nil, 1.0)
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	for _, metric := range metrics {
+		p.buffered = append(p.buffered, Line(metric, p.Template, hostname))
+	}
+	if overflow := len(p.buffered) - p.MaxBufferedLines; overflow > 0 {
+		p.Statsd.Count("graphite.dropped_lines_total", int64(overflow), nil, 1.0)
+		p.Logger.WithField("lines", overflow).Warn("Dropping the oldest lines buffered for Carbon")
+		p.buffered = append([][]byte(nil), p.buffered[overflow:]...)
+	}
+	if len(p.buffered) == 0 {
+		p.Logger.Info("Nothing to flush, skipping.")
+		return nil
+	}
+
+	start := time.Now()
+	if err := p.write(bytes.Join(p.buffered, nil)); err != nil {
+		p.Statsd.Count("graphite.error_total", 1, []string{"cause:io"}, 1.0)
+		p.Logger.WithError(err).WithField("lines", len(p.buffered)).Error("Could not write to Carbon, will retry")
+		return err
+	}
+	p.Statsd.TimeInMilliseconds("graphite.duration_ns", float64(time.Since(start).Nanoseconds()), []string{"part:write"}, 1.0)
+	p.buffered = nil
+	return nil
+}
+
+// write writes the lines to the connection, connecting first if need be.
+func (p *GraphitePlugin) write(lines []byte) error {
+	if p.conn == nil {
+		conn, err := net.DialTimeout("tcp", p.Address, p.Timeout)
+		if err != nil {
+			return err
+		}
+		p.conn = conn
+	}
+	p.conn.SetWriteDeadline(time.Now().Add(p.Timeout))
+	if _, err := p.conn.Write(lines); err != nil {
+		p.conn.Close()
+		p.conn = nil
+		return err
+	}
+	return nil
+}
+
+// Line renders a metric as a line of Carbon's plaintext protocol: its path,
+// value and timestamp, separated by spaces.
+func Line(metric samplers.DDMetric, tmpl, hostname string) []byte {
+	return []byte(fmt.Sprintf("%s %s %d\n",
+		Path(metric, tmpl, hostname),
+		strconv.FormatFloat(metric.Value[0][1], 'f', -1, 64),
+		int64(metric.Value[0][0]),
+	))
+}
+
+// Path renders the dotted path of a metric from a template such as
+// "{env}.{host}.{name}". {name} is the metric's name, {host} its host or
+// else hostname, and any other {field} is the value of the metric's tag
+// field, eg "env:prod". Levels whose fields are missing are left out, as
+// are tags that the template doesn't use. A histogram's percentiles, eg
+// a.b.c.99percentile, are named like a.b.c.p99. Characters that Graphite
+// doesn't allow are replaced with underscores, as are dots in the values of
+// other fields, so that they don't add levels.
+func Path(metric samplers.DDMetric, tmpl, hostname string) string {
+	name := metric.Name
+	if histogram, _, ok := samplers.ParsePercentileName(name); ok {
+		suffix := strings.TrimSuffix(name[len(histogram)+1:], "percentile")
+		name = histogram + ".p" + suffix
+	}
+	host := metric.Hostname
+	if host == "" {
+		host = hostname
+	}
+
+	var levels []string
+	for _, level := range strings.Split(tmpl, ".") {
+		missing := false
+		level = placeholder.ReplaceAllStringFunc(level, func(field string) string {
+			field = field[1 : len(field)-1]
+			var value string
+			switch field {
+			case "name":
+				return unsafe.ReplaceAllString(name, "_")
+			case "host":
+				value = host
+			default:
+				value = tagValue(metric.Tags, field)
+			}
+			if value == "" {
+				missing = true
+			}
+			return strings.Replace(unsafe.ReplaceAllString(value, "_"), ".", "_", -1)
+		})
+		if !missing && level != "" {
+			levels = append(levels, level)
+		}
+	}
+	return strings.Join(levels, ".")
+}
+
+// tagValue returns the value of the tag key:value, or "" if there is none.
+func tagValue(tags []string, key string) string {
+	for _, tag := range tags {
+		if strings.HasPrefix(tag, key+":") {
+			return tag[len(key)+1:]
+		}
+	}
+	return ""
+}
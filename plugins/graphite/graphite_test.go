@@ -0,0 +1,127 @@
+package graphite
+
+import (
+	"bufio"
+	"net"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stripe/veneur/samplers"
+)
+
+// carbonServer accepts connections and sends every line it reads on lines.
+func carbonServer(listener net.Listener) chan string {
+	lines := make(chan string, 100)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					lines <- scanner.Text()
+				}
+			}()
+		}
+	}()
+	return lines
+}
+
+func TestName(t *testing.T) {
+	plugin, err := NewGraphitePlugin(logrus.New(), "localhost:2003", "", 0, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "graphite", plugin.Name())
+	assert.Equal(t, DefaultTemplate, plugin.Template)
+	assert.Equal(t, DefaultMaxBufferedLines, plugin.MaxBufferedLines)
+}
+
+func TestNewGraphitePluginErrors(t *testing.T) {
+	_, err := NewGraphitePlugin(logrus.New(), "localhost", "", 0, nil)
+	assert.Error(t, err, "the address needs a port")
+	_, err = NewGraphitePlugin(logrus.New(), "localhost:2003", "{env}.{host}", 0, nil)
+	assert.Error(t, err, "the template needs the name")
+	_, err = NewGraphitePlugin(logrus.New(), "localhost:2003", "", -1, nil)
+	assert.Error(t, err)
+}
+
+func TestPath(t *testing.T) {
+	metric := samplers.DDMetric{
+		Name:     "a.b.c",
+		Tags:     []string{"env:prod", "region:us-west.2", "unused:tag"},
+		Hostname: "",
+	}
+	tmpl := "veneur.{env}.{region}.{host}.{name}"
+	assert.Equal(t, "veneur.prod.us-west_2.globalstats.a.b.c", Path(metric, tmpl, "globalstats"),
+		"dots in tag values should not add levels")
+
+	metric.Hostname = "web 1"
+	metric.Tags = []string{"region:eu"}
+	assert.Equal(t, "veneur.eu.web_1.a.b.c", Path(metric, tmpl, "globalstats"),
+		"levels with missing tags should be left out")
+
+	metric.Name = "a.b.c.99percentile"
+	assert.Equal(t, "a.b.c.p99", Path(metric, DefaultTemplate, ""))
+	metric.Name = "a.b.c.99_9percentile"
+	assert.Equal(t, "a.b.c.p99_9", Path(metric, DefaultTemplate, ""))
+	metric.Name = "a.b.c.max"
+	assert.Equal(t, "a.b.c.max", Path(metric, DefaultTemplate, ""))
+}
+
+func TestFlush(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+	lines := carbonServer(listener)
+
+	plugin, err := NewGraphitePlugin(logrus.New(), listener.Addr().String(), "{env}.{name}", 0, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, plugin.Flush([]samplers.DDMetric{
+		{
+			Name:       "a.b.c",
+			Value:      [1][2]float64{{1476119058, 100}},
+			Tags:       []string{"env:prod"},
+			MetricType: "gauge",
+		},
+		{
+			Name:       "a.b.c.95percentile",
+			Value:      [1][2]float64{{1476119058, 0.25}},
+			MetricType: "gauge",
+		},
+	}, "globalstats"))
+
+	assert.Equal(t, "prod.a.b.c 100 1476119058", <-lines)
+	assert.Equal(t, "a.b.c.p95 0.25 1476119058", <-lines)
+}
+
+func TestFlushReconnects(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	addr := listener.Addr().String()
+	listener.Close()
+
+	plugin, err := NewGraphitePlugin(logrus.New(), addr, "", 2, nil)
+	assert.NoError(t, err)
+	metric := func(name string) []samplers.DDMetric {
+		return []samplers.DDMetric{{Name: name, Value: [1][2]float64{{1476119058, 1}}}}
+	}
+	assert.Error(t, plugin.Flush(metric("first"), "globalstats"), "Carbon is down")
+	assert.Error(t, plugin.Flush(metric("second"), "globalstats"), "Carbon is still down")
+	assert.Error(t, plugin.Flush(metric("third"), "globalstats"), "Carbon is still down")
+	assert.Len(t, plugin.buffered, 2, "the buffer should be bounded")
+
+	listener, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Skipf("could not listen on %s again: %s", addr, err)
+	}
+	defer listener.Close()
+	lines := carbonServer(listener)
+
+	assert.NoError(t, plugin.Flush(metric("fourth"), "globalstats"))
+	assert.Equal(t, "third 1 1476119058", <-lines, "the oldest line should have been dropped")
+	assert.Equal(t, "fourth 1 1476119058", <-lines)
+	assert.Empty(t, plugin.buffered)
+}
@@ -2,12 +2,14 @@ package influxdb
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
-	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -17,7 +19,11 @@ import (
 	"github.com/stripe/veneur/samplers"
 )
 
-var _ plugins.Plugin = &InfluxDBPlugin{}
+var _ plugins.SummaryPlugin = &InfluxDBPlugin{}
+
+// DefaultMaxPerBody is the most points written in one request when
+// influx_flush_max_per_body is not set.
+const DefaultMaxPerBody = 5000
 
 // A helper type that we use to allow a `Len()` call
 // on an io.Reader
@@ -29,21 +35,28 @@ type lengther interface {
 type InfluxDBPlugin struct {
 	Logger     *logrus.Logger
 	InfluxURL  string
+	MaxPerBody int
 	HTTPClient *http.Client
 	Statsd     *statsd.Client
 }
 
-// NewInfluxDBPlugin creates a new Influx Plugin.
-func NewInfluxDBPlugin(logger *logrus.Logger, addr string, consistency string, db string, client *http.Client, stats *statsd.Client) *InfluxDBPlugin {
-	plugin := &InfluxDBPlugin{
-		Logger:     logger,
-		HTTPClient: client,
-		Statsd:     stats,
-	}
-
+// NewInfluxDBPlugin creates a new Influx Plugin, which writes to database db
+// of the InfluxDB at addr, eg http://localhost:8086, with the write
+// consistency, if set, and at most maxPerBody points per request. If
+// maxPerBody is 0 it is DefaultMaxPerBody.
+func NewInfluxDBPlugin(logger *logrus.Logger, addr string, consistency string, db string, maxPerBody int, client *http.Client, stats *statsd.Client) (*InfluxDBPlugin, error) {
 	inurl, err := url.Parse(addr)
 	if err != nil {
-		logger.Fatalf("Error parsing URL for InfluxDB: %q", err)
+		return nil, err
+	}
+	if inurl.Scheme == "" || inurl.Host == "" {
+		return nil, fmt.Errorf("influx_address %q must be a URL like http://localhost:8086", addr)
+	}
+	if maxPerBody < 0 {
+		return nil, fmt.Errorf("influx_flush_max_per_body %d must not be negative", maxPerBody)
+	}
+	if maxPerBody == 0 {
+		maxPerBody = DefaultMaxPerBody
 	}
 
 	// Construct a path we will be using later.
@@ -51,13 +64,22 @@ func NewInfluxDBPlugin(logger *logrus.Logger, addr string, consistency string, d
 	q := inurl.Query()
 	q.Set("db", db)
 	q.Set("precision", "s")
+	if consistency != "" {
+		q.Set("consistency", consistency)
+	}
 	inurl.RawQuery = q.Encode()
-	plugin.InfluxURL = inurl.String()
 
-	return plugin
+	return &InfluxDBPlugin{
+		Logger:     logger,
+		InfluxURL:  inurl.String(),
+		MaxPerBody: maxPerBody,
+		HTTPClient: client,
+		Statsd:     stats,
+	}, nil
 }
 
-// Flush sends a slice of metrics to InfluxDB
+// Flush sends a slice of metrics to InfluxDB, in requests of at most
+// MaxPerBody points. It returns an error if any request failed.
 func (p *InfluxDBPlugin) Flush(metrics []samplers.DDMetric, hostname string) error {
 	p.Statsd.Gauge("flush.post_metrics_total", float64(len(metrics)), nil, 1.0)
 	// Check to see if we have anything to do
@@ -66,21 +88,30 @@ func (p *InfluxDBPlugin) Flush(metrics []samplers.DDMetric, hostname string) err
 		return nil
 	}
 
-	buff := bytes.Buffer{}
-	colons := regexp.MustCompile(":")
-	for _, metric := range metrics {
-		tags := strings.Join(metric.Tags, ",")
-		// This is messy and we shouldn't have to do it this way, but since Veneur treats tags as arbitrary strings
-		// rather than name value pairs, we have to do this ugly conversion
-		cleanTags := colons.ReplaceAllLiteralString(tags, "=")
-		buff.WriteString(
-			fmt.Sprintf("%s,%s value=%f %d\n", metric.Name, cleanTags, metric.Value[0][1], int64(metric.Value[0][0])),
-		)
+	lines := make([]string, len(metrics))
+	for i, metric := range metrics {
+		lines[i] = Line(metric, hostname)
 	}
+	return p.postLines(lines)
+}
 
-	p.postHelper(p.InfluxURL, &buff)
-
-	return nil
+// FlushSummaries sends each summary to InfluxDB as one point, with a field
+// for each quantile, eg p99.
+func (p *InfluxDBPlugin) FlushSummaries(summaries []samplers.DDSummary, hostname string) error {
+	lines := make([]string, len(summaries))
+	for i, summary := range summaries {
+		fields := make([]string, len(summary.Quantiles))
+		for j, q := range summary.Quantiles {
+			fields[j] = fmt.Sprintf("p%g=%s", q.Quantile*100, formatFloat(q.Value))
+		}
+		host := summary.Hostname
+		if host == "" {
+			host = hostname
+		}
+		lines[i] = fmt.Sprintf("%s%s %s %d\n",
+			escapeMeasurement(summary.Name), tagSet(summary.Tags, host, ""), strings.Join(fields, ","), int64(summary.Timestamp))
+	}
+	return p.postLines(lines)
 }
 
 // Name returns the name of the plugin.
@@ -88,7 +119,103 @@ func (p *InfluxDBPlugin) Name() string {
 	return "influxdb"
 }
 
-// Common for POSTing to an endpoint, that consumes JSON.
+// Line renders a metric as a point in InfluxDB's line protocol. Its name is
+// the measurement and its value is the value field. Veneur's "key:value"
+// tags become tags, split on the first colon, and tags without a value get
+// the value "true". Points are tagged with their host, or else hostname,
+// and device if they have one. Rates also have an integer interval field,
+// the number of seconds the rate was computed over, so that the count can
+// be recovered.
+func Line(metric samplers.DDMetric, hostname string) string {
+	host := metric.Hostname
+	if host == "" {
+		host = hostname
+	}
+	fields := "value=" + formatFloat(metric.Value[0][1])
+	if metric.MetricType == "rate" && metric.Interval > 0 {
+		fields += fmt.Sprintf(",interval=%di", metric.Interval)
+	}
+	return fmt.Sprintf("%s%s %s %d\n",
+		escapeMeasurement(metric.Name), tagSet(metric.Tags, host, metric.DeviceName), fields, int64(metric.Value[0][0]))
+}
+
+// tagSet renders the tags of a point, sorted by key as InfluxDB recommends,
+// with a leading comma, or "" if there are none. Tags that repeat the host
+// or device, or an earlier tag, are dropped, as are tags with an empty key
+// or value.
+func tagSet(tags []string, host, device string) string {
+	pairs := map[string]string{}
+	if host != "" {
+		pairs["host"] = host
+	}
+	if device != "" {
+		pairs["device"] = device
+	}
+	for _, tag := range tags {
+		key, value := tag, "true"
+		if i := strings.IndexByte(tag, ':'); i >= 0 {
+			key, value = tag[:i], tag[i+1:]
+		}
+		if _, ok := pairs[key]; ok || key == "" || value == "" {
+			continue
+		}
+		pairs[key] = value
+	}
+
+	keys := make([]string, 0, len(pairs))
+	for key := range pairs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	buf := bytes.Buffer{}
+	for _, key := range keys {
+		buf.WriteByte(',')
+		buf.WriteString(tagEscaper.Replace(key))
+		buf.WriteByte('=')
+		buf.WriteString(tagEscaper.Replace(pairs[key]))
+	}
+	return buf.String()
+}
+
+// measurementEscaper escapes the characters that are special in a
+// measurement.
+var measurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+
+// tagEscaper escapes the characters that are special in tag keys and
+// values.
+var tagEscaper = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+
+func escapeMeasurement(name string) string {
+	return measurementEscaper.Replace(name)
+}
+
+// formatFloat formats a float field value without an exponent or any
+// rounding.
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// postLines POSTs the lines in batches of at most MaxPerBody, and returns
+// the first error.
+func (p *InfluxDBPlugin) postLines(lines []string) error {
+	var firstErr error
+	for start := 0; start < len(lines); start += p.MaxPerBody {
+		end := start + p.MaxPerBody
+		if end > len(lines) {
+			end = len(lines)
+		}
+		err := p.postHelper(p.InfluxURL, strings.NewReader(strings.Join(lines[start:end], "")))
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Common for POSTing to an endpoint, that consumes line protocol. InfluxDB
+// responds 204 if every point was written, and 4xx if it rejected some or
+// all of them, eg for a syntax error, in which case the points aren't worth
+// retrying, and its error is logged.
 func (p *InfluxDBPlugin) postHelper(endpoint string, bodyBuffer io.Reader) error {
 
 	// attach this field to all the logs we generate
@@ -107,6 +234,7 @@ func (p *InfluxDBPlugin) postHelper(endpoint string, bodyBuffer io.Reader) error
 		innerLogger.WithError(err).Error("Could not construct request")
 		return err
 	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
 
 	// we only make http requests at flush time, so keepalive is not a big win
 	req.Close = true
@@ -134,16 +262,25 @@ func (p *InfluxDBPlugin) postHelper(endpoint string, bodyBuffer io.Reader) error
 		innerLogger.WithError(err).Error("Could not read response body")
 	}
 	resultLogger := innerLogger.WithFields(logrus.Fields{
-		"request_headers":  req.Header,
-		"status":           resp.Status,
-		"response_headers": resp.Header,
-		"response":         string(responseBody),
+		"status":   resp.Status,
+		"response": string(responseBody),
 	})
 
-	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+	case resp.StatusCode >= 400 && resp.StatusCode < 500:
+		// InfluxDB explains what it rejected, eg a partial write
+		var rejection struct {
+			Error string `json:"error"`
+		}
+		json.Unmarshal(responseBody, &rejection)
+		p.Statsd.Count("influxdb_post.error_total", 1, []string{"cause:rejected"}, 1.0)
+		resultLogger.WithField("reason", rejection.Error).Error("InfluxDB rejected points")
+		return fmt.Errorf("influxdb rejected points with %s: %s", resp.Status, rejection.Error)
+	default:
 		p.Statsd.Count("influxdb_post.error_total", 1, []string{fmt.Sprintf("cause:%d", resp.StatusCode)}, 1.0)
 		resultLogger.Error("Could not POST")
-		return err
+		return fmt.Errorf("influxdb returned %s", resp.Status)
 	}
 
 	// make sure the error metric isn't sparse
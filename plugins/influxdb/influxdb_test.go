@@ -0,0 +1,100 @@
+package influxdb
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stripe/veneur/samplers"
+)
+
+func TestName(t *testing.T) {
+	plugin, err := NewInfluxDBPlugin(logrus.New(), "http://localhost:8086", "", "mydb", 0, http.DefaultClient, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "influxdb", plugin.Name())
+	assert.Equal(t, DefaultMaxPerBody, plugin.MaxPerBody)
+}
+
+func TestNewInfluxDBPlugin(t *testing.T) {
+	plugin, err := NewInfluxDBPlugin(logrus.New(), "http://localhost:8086", "one", "mydb", 0, http.DefaultClient, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "http://localhost:8086/write?consistency=one&db=mydb&precision=s", plugin.InfluxURL)
+
+	_, err = NewInfluxDBPlugin(logrus.New(), "localhost:8086", "", "mydb", 0, http.DefaultClient, nil)
+	assert.Error(t, err, "the address should need a scheme")
+}
+
+func TestLineGauge(t *testing.T) {
+	line := Line(samplers.DDMetric{
+		Name:       "a.b.c",
+		Value:      [1][2]float64{{1476119058, 0.25}},
+		Tags:       []string{"region:us-west", "foo:bar"},
+		MetricType: "gauge",
+	}, "globalstats")
+	assert.Equal(t, "a.b.c,foo=bar,host=globalstats,region=us-west value=0.25 1476119058\n", line)
+}
+
+func TestLineEscaping(t *testing.T) {
+	line := Line(samplers.DDMetric{
+		Name:       "a b,c",
+		Value:      [1][2]float64{{1476119058, 3}},
+		Tags:       []string{"url:http://example.com/?a=b,c", "flag", "host:ignored", "empty:"},
+		MetricType: "rate",
+		Hostname:   "web 1",
+		DeviceName: "sda",
+		Interval:   10,
+	}, "globalstats")
+	assert.Equal(t, `a\ b\,c,device=sda,flag=true,host=web\ 1,url=http://example.com/?a\=b\,c value=3,interval=10i 1476119058`+"\n", line)
+}
+
+func TestFlushBatches(t *testing.T) {
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/write", r.URL.Path)
+		assert.Equal(t, "mydb", r.URL.Query().Get("db"))
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	plugin, err := NewInfluxDBPlugin(logrus.New(), server.URL, "", "mydb", 2, http.DefaultClient, nil)
+	assert.NoError(t, err)
+	metrics := make([]samplers.DDMetric, 5)
+	for i := range metrics {
+		metrics[i] = samplers.DDMetric{Name: "a.b.c", MetricType: "gauge"}
+	}
+	assert.NoError(t, plugin.Flush(metrics, "globalstats"), "a 204 should succeed")
+	if assert.Len(t, bodies, 3) {
+		assert.Equal(t, 2, strings.Count(bodies[0], "\n"))
+		assert.Equal(t, 1, strings.Count(bodies[2], "\n"))
+	}
+}
+
+func TestFlushErrors(t *testing.T) {
+	status := http.StatusBadRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		w.Write([]byte(`{"error":"partial write: field type conflict"}`))
+	}))
+	defer server.Close()
+
+	plugin, err := NewInfluxDBPlugin(logrus.New(), server.URL, "", "mydb", 0, http.DefaultClient, nil)
+	assert.NoError(t, err)
+	metrics := []samplers.DDMetric{{Name: "a.b.c", MetricType: "gauge"}}
+
+	err = plugin.Flush(metrics, "globalstats")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "field type conflict", "a rejection should say why")
+	}
+
+	status = http.StatusServiceUnavailable
+	err = plugin.Flush(metrics, "globalstats")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "503")
+	}
+}
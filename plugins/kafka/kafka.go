@@ -0,0 +1,239 @@
+package kafka
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/Sirupsen/logrus"
+	"github.com/golang/protobuf/proto"
+	"github.com/stripe/veneur/plugins"
+	"github.com/stripe/veneur/samplers"
+	"github.com/stripe/veneur/ssf"
+)
+
+var _ plugins.Plugin = &KafkaPlugin{}
+
+// The acks a produce waits for, as sent to the brokers.
+const (
+	// AcksNone doesn't wait for the leader to write the messages.
+	AcksNone int16 = 0
+	// AcksLeader waits for the leader to write the messages.
+	AcksLeader int16 = 1
+	// AcksAll waits for every in-sync replica to write the messages.
+	AcksAll int16 = -1
+)
+
+// DefaultTimeout is how long a produce, and each request it makes, may take.
+const DefaultTimeout = 10 * time.Second
+
+// DefaultQueueSize is how many flushes an async producer holds while an
+// earlier one is being sent.
+const DefaultQueueSize = 16
+
+// Message is a message to publish to a Kafka topic.
+type Message struct {
+	Topic string
+	Key   []byte
+	Value []byte
+}
+
+// Producer publishes messages to Kafka. Messages with the same key are
+// sent to the same partition of their topic.
+type Producer interface {
+	Produce(messages []Message) error
+}
+
+// KafkaPlugin is a plugin for publishing spans, as SSF protobufs, and
+// flushed metrics, as JSON, to Kafka topics. It is a metrics plugin only if
+// it has a metric topic; the server sends it spans with FlushSpans.
+type KafkaPlugin struct {
+	Logger      *logrus.Logger
+	Producer    Producer
+	SpanTopic   string
+	MetricTopic string
+	Statsd      *statsd.Client
+}
+
+// NewKafkaPlugin creates a plugin that publishes to the comma-separated
+// brokers, each host:port, waiting for acks, which is "none", "leader" or
+// "all". If async is set, flushes are queued and sent in the background, and
+// failures are only logged.
+func NewKafkaPlugin(logger *logrus.Logger, brokers, spanTopic, metricTopic, acks string, async bool, stats *statsd.Client) (*KafkaPlugin, error) {
+	var addrs []string
+	for _, broker := range strings.Split(brokers, ",") {
+		if broker = strings.TrimSpace(broker); broker != "" {
+			addrs = append(addrs, broker)
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("kafka_broker %q must list at least one host:port", brokers)
+	}
+	if spanTopic == "" && metricTopic == "" {
+		return nil, fmt.Errorf("kafka_span_topic or kafka_metric_topic must be set to publish to Kafka")
+	}
+	required, err := ParseAcks(acks)
+	if err != nil {
+		return nil, err
+	}
+
+	plugin := &KafkaPlugin{
+		Logger:      logger,
+		SpanTopic:   spanTopic,
+		MetricTopic: metricTopic,
+		Statsd:      stats,
+	}
+	var producer Producer = NewBrokerProducer(addrs, required, DefaultTimeout)
+	if async {
+		producer = NewAsyncProducer(producer, DefaultQueueSize, func(err error, messages int) {
+			stats.Count("kafka.error_total", 1, []string{"cause:async"}, 1.0)
+			logger.WithError(err).WithField("messages", messages).Error("Could not publish to Kafka")
+		})
+	}
+	plugin.Producer = producer
+	return plugin, nil
+}
+
+// ParseAcks parses the acks a produce waits for: "none", "leader" or "all".
+// The default, "", is "leader".
+func ParseAcks(acks string) (int16, error) {
+	switch acks {
+	case "none":
+		return AcksNone, nil
+	case "", "leader":
+		return AcksLeader, nil
+	case "all":
+		return AcksAll, nil
+	}
+	return 0, fmt.Errorf("kafka_acks %q must be none, leader or all", acks)
+}
+
+// Name returns the name of the plugin.
+func (p *KafkaPlugin) Name() string {
+	return "kafka"
+}
+
+// Flush publishes each metric to the metric topic, if there is one.
+func (p *KafkaPlugin) Flush(metrics []samplers.DDMetric, hostname string) error {
+	if p.MetricTopic == "" {
+		return nil
+	}
+	p.Statsd.Gauge("kafka.post_metrics_total", float64(len(metrics)), nil, 1.0)
+	if len(metrics) == 0 {
+		p.Logger.Info("Nothing to flush, skipping.")
+		return nil
+	}
+
+	messages := make([]Message, 0, len(metrics))
+	for _, metric := range metrics {
+		message, err := MetricMessage(p.MetricTopic, metric, hostname)
+		if err != nil {
+			p.Statsd.Count("kafka.error_total", 1, []string{"cause:json"}, 1.0)
+			p.Logger.WithError(err).WithField("metric", metric.Name).Error("Could not render metric")
+			continue
+		}
+		messages = append(messages, message)
+	}
+	return p.produce(messages, "metrics")
+}
+
+// FlushSpans publishes each span to the span topic.
+func (p *KafkaPlugin) FlushSpans(samples []ssf.SSFSample) error {
+	p.Statsd.Gauge("kafka.post_spans_total", float64(len(samples)), nil, 1.0)
+	messages := make([]Message, 0, len(samples))
+	for _, sample := range samples {
+		message, err := SpanMessage(p.SpanTopic, sample)
+		if err != nil {
+			p.Statsd.Count("kafka.error_total", 1, []string{"cause:protobuf"}, 1.0)
+			p.Logger.WithError(err).Error("Could not render span")
+			continue
+		}
+		messages = append(messages, message)
+	}
+	return p.produce(messages, "spans")
+}
+
+func (p *KafkaPlugin) produce(messages []Message, kind string) error {
+	if len(messages) == 0 {
+		return nil
+	}
+	start := time.Now()
+	if err := p.Producer.Produce(messages); err != nil {
+		p.Statsd.Count("kafka.error_total", 1, []string{"cause:produce"}, 1.0)
+		p.Logger.WithError(err).WithField(kind, len(messages)).Error("Could not publish to Kafka")
+		return err
+	}
+	p.Statsd.TimeInMilliseconds("kafka.duration_ns", float64(time.Since(start).Nanoseconds()), []string{"part:" + kind}, 1.0)
+	return nil
+}
+
+// SpanMessage encodes a span as an SSF protobuf, keyed by its trace ID in
+// decimal, so that every span of a trace is sent to the same partition.
+// Spans without a trace have no key.
+func SpanMessage(topic string, sample ssf.SSFSample) (Message, error) {
+	value, err := proto.Marshal(&sample)
+	if err != nil {
+		return Message{}, err
+	}
+	message := Message{Topic: topic, Value: value}
+	if sample.Trace != nil {
+		message.Key = []byte(strconv.FormatInt(sample.Trace.TraceId, 10))
+	}
+	return message, nil
+}
+
+// MetricMessage encodes a metric as JSON, keyed by its name, so that every
+// flush of a metric is sent to the same partition. Metrics without a host
+// are given hostname.
+func MetricMessage(topic string, metric samplers.DDMetric, hostname string) (Message, error) {
+	if metric.Hostname == "" {
+		metric.Hostname = hostname
+	}
+	value, err := json.Marshal(metric)
+	if err != nil {
+		return Message{}, err
+	}
+	return Message{Topic: topic, Key: []byte(metric.Name), Value: value}, nil
+}
+
+// AsyncProducer is a Producer that queues messages and sends them in the
+// background, so that a flush doesn't wait for Kafka.
+type AsyncProducer struct {
+	producer Producer
+	queue    chan []Message
+	onError  func(err error, messages int)
+}
+
+// NewAsyncProducer creates a producer that queues up to size calls to
+// Produce and sends them with producer in order. If sending fails, onError
+// is called with the error and the number of messages lost.
+func NewAsyncProducer(producer Producer, size int, onError func(err error, messages int)) *AsyncProducer {
+	ap := &AsyncProducer{
+		producer: producer,
+		queue:    make(chan []Message, size),
+		onError:  onError,
+	}
+	go ap.run()
+	return ap
+}
+
+// Produce queues the messages, returning an error only if the queue is full.
+func (ap *AsyncProducer) Produce(messages []Message) error {
+	select {
+	case ap.queue <- messages:
+		return nil
+	default:
+		return fmt.Errorf("kafka queue is full, dropping %d messages", len(messages))
+	}
+}
+
+func (ap *AsyncProducer) run() {
+	for messages := range ap.queue {
+		if err := ap.producer.Produce(messages); err != nil {
+			ap.onError(err, len(messages))
+		}
+	}
+}
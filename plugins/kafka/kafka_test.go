@@ -0,0 +1,337 @@
+package kafka
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stripe/veneur/samplers"
+	"github.com/stripe/veneur/ssf"
+)
+
+// fakeProducer records the messages it is given.
+type fakeProducer struct {
+	messages []Message
+	err      error
+}
+
+func (fp *fakeProducer) Produce(messages []Message) error {
+	fp.messages = append(fp.messages, messages...)
+	return fp.err
+}
+
+func testSpan(traceID, id int64) ssf.SSFSample {
+	return ssf.SSFSample{
+		Metric:    ssf.SSFSample_TRACE,
+		Name:      "veneur.trace.test",
+		Service:   "veneur",
+		Timestamp: 1476119058000000000,
+		Trace: &ssf.SSFTrace{
+			TraceId:  traceID,
+			Id:       id,
+			Duration: 1000,
+			Resource: "GET /",
+		},
+	}
+}
+
+func TestName(t *testing.T) {
+	plugin, err := NewKafkaPlugin(logrus.New(), "localhost:9092", "spans", "", "", false, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "kafka", plugin.Name())
+}
+
+func TestNewKafkaPluginErrors(t *testing.T) {
+	_, err := NewKafkaPlugin(logrus.New(), " , ", "spans", "", "", false, nil)
+	assert.Error(t, err, "no brokers")
+	_, err = NewKafkaPlugin(logrus.New(), "localhost:9092", "", "", "", false, nil)
+	assert.Error(t, err, "no topics")
+	_, err = NewKafkaPlugin(logrus.New(), "localhost:9092", "spans", "", "some", false, nil)
+	assert.Error(t, err, "bad acks")
+}
+
+func TestParseAcks(t *testing.T) {
+	for acks, expected := range map[string]int16{
+		"":       AcksLeader,
+		"none":   AcksNone,
+		"leader": AcksLeader,
+		"all":    AcksAll,
+	} {
+		required, err := ParseAcks(acks)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, required, "acks %q", acks)
+	}
+	_, err := ParseAcks("1")
+	assert.Error(t, err)
+}
+
+func TestSpanMessage(t *testing.T) {
+	span := testSpan(12345, 1)
+	message, err := SpanMessage("spans", span)
+	assert.NoError(t, err)
+	assert.Equal(t, "spans", message.Topic)
+	assert.Equal(t, []byte("12345"), message.Key)
+
+	decoded := ssf.SSFSample{}
+	assert.NoError(t, proto.Unmarshal(message.Value, &decoded))
+	assert.Equal(t, span, decoded)
+
+	message, err = SpanMessage("spans", ssf.SSFSample{Name: "not.a.span"})
+	assert.NoError(t, err)
+	assert.Nil(t, message.Key, "a sample without a trace should have no key")
+}
+
+func TestMetricMessage(t *testing.T) {
+	metric := samplers.DDMetric{
+		Name:       "a.b.c",
+		Value:      [1][2]float64{[2]float64{1476119058, 100}},
+		Tags:       []string{"foo:bar"},
+		MetricType: "gauge",
+	}
+	message, err := MetricMessage("metrics", metric, "globalstats")
+	assert.NoError(t, err)
+	assert.Equal(t, "metrics", message.Topic)
+	assert.Equal(t, []byte("a.b.c"), message.Key)
+
+	var decoded samplers.DDMetric
+	assert.NoError(t, json.Unmarshal(message.Value, &decoded))
+	assert.Equal(t, "globalstats", decoded.Hostname)
+	assert.Equal(t, metric.Value, decoded.Value)
+	assert.Equal(t, "", metric.Hostname, "the metric itself should not be modified")
+}
+
+func TestPartition(t *testing.T) {
+	// the FNV-1a hash of "12345" is 0x43c2c0d8, as Sarama would compute it
+	assert.Equal(t, int32(0x43c2c0d8%7), Partition([]byte("12345"), 7))
+	// the hash of "c", 0xe60c2c52, is negative as an int32, and Sarama
+	// takes the absolute value of the remainder
+	assert.Equal(t, int32(2), Partition([]byte("c"), 3))
+
+	spread := map[int32]bool{}
+	for id := int64(0); id < 100; id++ {
+		message, err := SpanMessage("spans", testSpan(id, 1))
+		assert.NoError(t, err)
+		partition := Partition(message.Key, 8)
+		assert.True(t, partition >= 0 && partition < 8)
+		spread[partition] = true
+
+		message, err = SpanMessage("spans", testSpan(id, 2))
+		assert.NoError(t, err)
+		assert.Equal(t, partition, Partition(message.Key, 8), "spans of a trace should share a partition")
+	}
+	assert.Len(t, spread, 8, "traces should be spread across every partition")
+}
+
+func TestFlushSpans(t *testing.T) {
+	producer := &fakeProducer{}
+	plugin := &KafkaPlugin{Logger: logrus.New(), Producer: producer, SpanTopic: "spans"}
+	assert.NoError(t, plugin.FlushSpans([]ssf.SSFSample{testSpan(1, 1), testSpan(2, 1)}))
+	if !assert.Len(t, producer.messages, 2) {
+		return
+	}
+	assert.Equal(t, []byte("1"), producer.messages[0].Key)
+	assert.Equal(t, []byte("2"), producer.messages[1].Key)
+
+	producer.err = io.EOF
+	assert.Equal(t, io.EOF, plugin.FlushSpans([]ssf.SSFSample{testSpan(1, 1)}))
+}
+
+func TestFlushMetrics(t *testing.T) {
+	metrics := []samplers.DDMetric{{Name: "a.b.c", MetricType: "gauge"}}
+	producer := &fakeProducer{}
+	plugin := &KafkaPlugin{Logger: logrus.New(), Producer: producer, SpanTopic: "spans"}
+	assert.NoError(t, plugin.Flush(metrics, "globalstats"))
+	assert.Empty(t, producer.messages, "metrics should only be published with a metric topic")
+
+	plugin.MetricTopic = "metrics"
+	assert.NoError(t, plugin.Flush(metrics, "globalstats"))
+	if !assert.Len(t, producer.messages, 1) {
+		return
+	}
+	assert.Equal(t, "metrics", producer.messages[0].Topic)
+}
+
+func TestAsyncProducer(t *testing.T) {
+	blocked := make(chan struct{})
+	failed := make(chan int, 1)
+	producer := NewAsyncProducer(producerFunc(func(messages []Message) error {
+		<-blocked
+		return io.EOF
+	}), 1, func(err error, messages int) {
+		assert.Equal(t, io.EOF, err)
+		failed <- messages
+	})
+
+	// one is being sent and one is queued, so the third doesn't fit
+	assert.NoError(t, producer.Produce(make([]Message, 2)))
+	time.Sleep(10 * time.Millisecond)
+	assert.NoError(t, producer.Produce(make([]Message, 3)))
+	assert.Error(t, producer.Produce(make([]Message, 4)), "a full queue should drop messages")
+
+	close(blocked)
+	assert.Equal(t, 2, <-failed)
+	assert.Equal(t, 3, <-failed)
+}
+
+type producerFunc func(messages []Message) error
+
+func (f producerFunc) Produce(messages []Message) error {
+	return f(messages)
+}
+
+// fakeBroker is a Kafka broker that leads every partition of its one topic,
+// and sends the messages it is given on received.
+type fakeBroker struct {
+	t          *testing.T
+	listener   net.Listener
+	topic      string
+	partitions int32
+	received   chan map[int32][]Message
+}
+
+func newFakeBroker(t *testing.T, topic string, partitions int32) *fakeBroker {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fb := &fakeBroker{
+		t:          t,
+		listener:   listener,
+		topic:      topic,
+		partitions: partitions,
+		received:   make(chan map[int32][]Message, 10),
+	}
+	go fb.serve()
+	return fb
+}
+
+func (fb *fakeBroker) serve() {
+	for {
+		conn, err := fb.listener.Accept()
+		if err != nil {
+			return
+		}
+		go fb.handle(conn)
+	}
+}
+
+func (fb *fakeBroker) handle(conn net.Conn) {
+	defer conn.Close()
+	var size int32
+	if binary.Read(conn, binary.BigEndian, &size) != nil {
+		return
+	}
+	req := make([]byte, size)
+	if _, err := io.ReadFull(conn, req); err != nil {
+		return
+	}
+	d := decoder{buf: req}
+	apiKey := d.int16()
+	assert.Equal(fb.t, int16(0), d.int16(), "requests should be version 0")
+	correlationID := d.int32()
+	assert.Equal(fb.t, clientID, d.string())
+
+	resp := encoder{}
+	resp.int32(correlationID)
+	switch apiKey {
+	case apiMetadata:
+		host, port, _ := net.SplitHostPort(fb.listener.Addr().String())
+		portNum, _ := strconv.Atoi(port)
+		resp.arrayLen(1)
+		resp.int32(7)
+		resp.string(host)
+		resp.int32(int32(portNum))
+		resp.arrayLen(1)
+		resp.int16(0)
+		resp.string(fb.topic)
+		resp.arrayLen(int(fb.partitions))
+		// listed in reverse, which the producer should sort
+		for p := fb.partitions - 1; p >= 0; p-- {
+			resp.int16(0)
+			resp.int32(p)
+			resp.int32(7)
+			resp.arrayLen(1)
+			resp.int32(7)
+			resp.arrayLen(1)
+			resp.int32(7)
+		}
+	case apiProduce:
+		acks := d.int16()
+		d.int32()
+		received := map[int32][]Message{}
+		resp.arrayLen(d.arrayLen())
+		topic := d.string()
+		resp.string(topic)
+		n := d.arrayLen()
+		resp.arrayLen(n)
+		for ; n > 0; n-- {
+			partition := d.int32()
+			set := decoder{buf: d.bytes()}
+			for len(set.buf) > 0 && set.err == nil {
+				set.int64()
+				message := decoder{buf: set.next(int(set.int32()))}
+				crc := uint32(message.int32())
+				assert.Equal(fb.t, crc32.ChecksumIEEE(message.buf), crc, "the CRC should cover the rest of the message")
+				assert.Equal(fb.t, int8(0), message.int8(), "magic")
+				assert.Equal(fb.t, int8(0), message.int8(), "attributes")
+				received[partition] = append(received[partition], Message{
+					Topic: topic,
+					Key:   message.bytes(),
+					Value: message.bytes(),
+				})
+				assert.NoError(fb.t, message.err)
+			}
+			assert.NoError(fb.t, set.err)
+			resp.int32(partition)
+			resp.int16(0)
+			resp.int64(0)
+		}
+		assert.NoError(fb.t, d.err)
+		fb.received <- received
+		if acks == AcksNone {
+			return
+		}
+	}
+
+	out := encoder{}
+	out.int32(int32(resp.Len()))
+	out.Write(resp.Bytes())
+	conn.Write(out.Bytes())
+}
+
+func TestBrokerProducer(t *testing.T) {
+	broker := newFakeBroker(t, "spans", 4)
+	defer broker.listener.Close()
+
+	for _, acks := range []int16{AcksNone, AcksLeader, AcksAll} {
+		producer := NewBrokerProducer([]string{"127.0.0.1:1", broker.listener.Addr().String()}, acks, time.Second)
+		var messages []Message
+		for id := int64(1); id <= 20; id++ {
+			message, err := SpanMessage("spans", testSpan(id%5, id))
+			assert.NoError(t, err)
+			messages = append(messages, message)
+		}
+		assert.NoError(t, producer.Produce(messages), "the unreachable broker should be skipped")
+
+		received := <-broker.received
+		count := 0
+		for partition, ms := range received {
+			for _, m := range ms {
+				assert.Equal(t, Partition(m.Key, 4), partition, "each message should be sent to its key's partition")
+				count++
+			}
+		}
+		assert.Equal(t, 20, count)
+	}
+
+	producer := NewBrokerProducer([]string{broker.listener.Addr().String()}, AcksLeader, time.Second)
+	assert.Error(t, producer.Produce([]Message{{Topic: "metrics"}}), "an unknown topic should fail")
+}
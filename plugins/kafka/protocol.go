@@ -0,0 +1,417 @@
+package kafka
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"hash/fnv"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The Kafka API keys of the requests the producer sends. Both are sent as
+// version 0, with version 0 message sets, which brokers from 0.8 through 3.x
+// understand. Kafka 4.0 removed them, so it rejects these requests.
+const (
+	apiProduce  int16 = 0
+	apiMetadata int16 = 3
+)
+
+// clientID identifies Veneur to the brokers.
+const clientID = "veneur"
+
+// errTruncated is returned when a response ends before it should.
+var errTruncated = errors.New("kafka response is truncated")
+
+// BrokerProducer is a Producer that speaks the Kafka protocol to the
+// brokers directly. Every Produce looks up the partitions of its topics from
+// the first bootstrap broker that answers, then sends each leader one
+// produce request with all of its messages, using a new connection each
+// time, since produces only happen at flush time.
+type BrokerProducer struct {
+	Brokers []string
+	Acks    int16
+	Timeout time.Duration
+
+	mtx           sync.Mutex
+	correlationID int32
+}
+
+// NewBrokerProducer creates a producer that bootstraps from brokers, each
+// host:port, and waits for acks, as returned by ParseAcks.
+func NewBrokerProducer(brokers []string, acks int16, timeout time.Duration) *BrokerProducer {
+	return &BrokerProducer{
+		Brokers: brokers,
+		Acks:    acks,
+		Timeout: timeout,
+	}
+}
+
+// topicMetadata is the partition IDs of a topic, sorted, and the address of
+// the leader of each.
+type topicMetadata struct {
+	partitions []int32
+	leaders    map[int32]string
+}
+
+// Produce sends the messages, partitioned by key, and returns an error if
+// any of them could not be sent.
+func (bp *BrokerProducer) Produce(messages []Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+	bp.mtx.Lock()
+	defer bp.mtx.Unlock()
+
+	var topics []string
+	seen := map[string]bool{}
+	for _, m := range messages {
+		if !seen[m.Topic] {
+			seen[m.Topic] = true
+			topics = append(topics, m.Topic)
+		}
+	}
+	metadata, err := bp.metadata(topics)
+	if err != nil {
+		return err
+	}
+
+	// leader address -> topic -> partition -> messages
+	batches := map[string]map[string]map[int32][]Message{}
+	for _, m := range messages {
+		tm, ok := metadata[m.Topic]
+		if !ok {
+			return fmt.Errorf("kafka has no metadata for topic %q", m.Topic)
+		}
+		partition := tm.partitions[Partition(m.Key, int32(len(tm.partitions)))]
+		leader, ok := tm.leaders[partition]
+		if !ok {
+			return fmt.Errorf("partition %d of topic %q has no leader", partition, m.Topic)
+		}
+		if batches[leader] == nil {
+			batches[leader] = map[string]map[int32][]Message{}
+		}
+		if batches[leader][m.Topic] == nil {
+			batches[leader][m.Topic] = map[int32][]Message{}
+		}
+		batches[leader][m.Topic][partition] = append(batches[leader][m.Topic][partition], m)
+	}
+
+	var firstErr error
+	for leader, batch := range batches {
+		if err := bp.produce(leader, batch); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// metadata looks up the partitions of topics from the first bootstrap
+// broker that answers.
+func (bp *BrokerProducer) metadata(topics []string) (map[string]topicMetadata, error) {
+	req := encoder{}
+	req.arrayLen(len(topics))
+	for _, topic := range topics {
+		req.string(topic)
+	}
+
+	var err error
+	for _, broker := range bp.Brokers {
+		var resp []byte
+		resp, err = bp.roundTrip(broker, apiMetadata, req.Bytes(), true)
+		if err != nil {
+			continue
+		}
+		return decodeMetadata(resp)
+	}
+	if err == nil {
+		err = errors.New("no kafka brokers configured")
+	}
+	return nil, err
+}
+
+// decodeMetadata decodes a metadata response, returning an error if any
+// topic has an error or no partitions.
+func decodeMetadata(resp []byte) (map[string]topicMetadata, error) {
+	d := decoder{buf: resp}
+	brokers := map[int32]string{}
+	for n := d.arrayLen(); n > 0; n-- {
+		id := d.int32()
+		host := d.string()
+		port := d.int32()
+		brokers[id] = net.JoinHostPort(host, fmt.Sprint(port))
+	}
+
+	metadata := map[string]topicMetadata{}
+	for n := d.arrayLen(); n > 0; n-- {
+		code := d.int16()
+		topic := d.string()
+		tm := topicMetadata{leaders: map[int32]string{}}
+		for p := d.arrayLen(); p > 0; p-- {
+			d.int16()
+			partition := d.int32()
+			leader := d.int32()
+			for r := d.arrayLen(); r > 0; r-- {
+				d.int32()
+			}
+			for r := d.arrayLen(); r > 0; r-- {
+				d.int32()
+			}
+			tm.partitions = append(tm.partitions, partition)
+			if address, ok := brokers[leader]; ok {
+				tm.leaders[partition] = address
+			}
+		}
+		if d.err != nil {
+			break
+		}
+		if code != 0 {
+			return nil, fmt.Errorf("kafka returned error %d for the metadata of topic %q", code, topic)
+		}
+		if len(tm.partitions) == 0 {
+			return nil, fmt.Errorf("topic %q has no partitions", topic)
+		}
+		sort.Sort(partitionIDs(tm.partitions))
+		metadata[topic] = tm
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	return metadata, nil
+}
+
+type partitionIDs []int32
+
+func (p partitionIDs) Len() int           { return len(p) }
+func (p partitionIDs) Less(i, j int) bool { return p[i] < p[j] }
+func (p partitionIDs) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// produce sends one produce request to the leader, and checks the response
+// if acks are required.
+func (bp *BrokerProducer) produce(leader string, batch map[string]map[int32][]Message) error {
+	req := encoder{}
+	req.int16(bp.Acks)
+	req.int32(int32(bp.Timeout / time.Millisecond))
+	req.arrayLen(len(batch))
+	for topic, partitions := range batch {
+		req.string(topic)
+		req.arrayLen(len(partitions))
+		for partition, messages := range partitions {
+			req.int32(partition)
+			req.bytes(encodeMessageSet(messages))
+		}
+	}
+
+	// brokers don't respond at all when no acks are required
+	resp, err := bp.roundTrip(leader, apiProduce, req.Bytes(), bp.Acks != AcksNone)
+	if err != nil || bp.Acks == AcksNone {
+		return err
+	}
+
+	d := decoder{buf: resp}
+	for n := d.arrayLen(); n > 0; n-- {
+		topic := d.string()
+		for p := d.arrayLen(); p > 0; p-- {
+			partition := d.int32()
+			code := d.int16()
+			d.int64()
+			if d.err == nil && code != 0 {
+				return fmt.Errorf("kafka returned error %d producing to partition %d of topic %q", code, partition, topic)
+			}
+		}
+	}
+	return d.err
+}
+
+// roundTrip sends a request to the broker at address and, if wantResponse,
+// returns the body of its response.
+func (bp *BrokerProducer) roundTrip(address string, apiKey int16, body []byte, wantResponse bool) ([]byte, error) {
+	conn, err := net.DialTimeout("tcp", address, bp.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(bp.Timeout))
+
+	bp.correlationID++
+	header := encoder{}
+	header.int16(apiKey)
+	header.int16(0)
+	header.int32(bp.correlationID)
+	header.string(clientID)
+
+	req := encoder{}
+	req.int32(int32(header.Len() + len(body)))
+	req.Write(header.Bytes())
+	req.Write(body)
+	if _, err := conn.Write(req.Bytes()); err != nil {
+		return nil, err
+	}
+	if !wantResponse {
+		return nil, nil
+	}
+
+	var size int32
+	if err := binary.Read(conn, binary.BigEndian, &size); err != nil {
+		return nil, err
+	}
+	if size < 4 {
+		return nil, errTruncated
+	}
+	resp := make([]byte, size)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	if id := int32(binary.BigEndian.Uint32(resp)); id != bp.correlationID {
+		return nil, fmt.Errorf("kafka response has correlation ID %d, expected %d", id, bp.correlationID)
+	}
+	return resp[4:], nil
+}
+
+// encodeMessageSet encodes messages as a version 0 message set.
+func encodeMessageSet(messages []Message) []byte {
+	set := encoder{}
+	for _, m := range messages {
+		message := encoder{}
+		message.int8(0) // magic
+		message.int8(0) // attributes: no compression
+		message.bytes(m.Key)
+		message.bytes(m.Value)
+
+		set.int64(0) // the offset is assigned by the broker
+		set.int32(int32(4 + message.Len()))
+		set.int32(int32(crc32.ChecksumIEEE(message.Bytes())))
+		set.Write(message.Bytes())
+	}
+	return set.Bytes()
+}
+
+// Partition returns the index of the partition, of n, that messages with
+// this key are sent to. Like the hash partitioner of Sarama, the Go client,
+// it's the FNV-1a hash of the key modulo n, so that consumers can tell where
+// a key's messages are.
+func Partition(key []byte, n int32) int32 {
+	h := fnv.New32a()
+	h.Write(key)
+	partition := int32(h.Sum32()) % n
+	if partition < 0 {
+		partition = -partition
+	}
+	return partition
+}
+
+// encoder writes the big-endian primitives of the Kafka protocol.
+type encoder struct {
+	bytes.Buffer
+}
+
+func (e *encoder) int8(v int8) {
+	e.WriteByte(byte(v))
+}
+
+func (e *encoder) int16(v int16) {
+	binary.Write(e, binary.BigEndian, v)
+}
+
+func (e *encoder) int32(v int32) {
+	binary.Write(e, binary.BigEndian, v)
+}
+
+func (e *encoder) int64(v int64) {
+	binary.Write(e, binary.BigEndian, v)
+}
+
+func (e *encoder) arrayLen(n int) {
+	e.int32(int32(n))
+}
+
+func (e *encoder) string(s string) {
+	e.int16(int16(len(s)))
+	e.WriteString(s)
+}
+
+// bytes writes b, or -1 for a null if b is nil.
+func (e *encoder) bytes(b []byte) {
+	if b == nil {
+		e.int32(-1)
+		return
+	}
+	e.int32(int32(len(b)))
+	e.Write(b)
+}
+
+// decoder reads the big-endian primitives of the Kafka protocol. Once it
+// runs out of input, err is set and every read returns zero.
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil || n < 0 || len(d.buf) < n {
+		d.err = errTruncated
+		return nil
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *decoder) int8() int8 {
+	if b := d.next(1); b != nil {
+		return int8(b[0])
+	}
+	return 0
+}
+
+func (d *decoder) int16() int16 {
+	if b := d.next(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (d *decoder) int32() int32 {
+	if b := d.next(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (d *decoder) int64() int64 {
+	if b := d.next(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+func (d *decoder) arrayLen() int {
+	n := d.int32()
+	if n < 0 {
+		// a null array
+		return 0
+	}
+	return int(n)
+}
+
+func (d *decoder) string() string {
+	n := d.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(d.next(int(n)))
+}
+
+// bytes reads a byte string, which is nil if it is null.
+func (d *decoder) bytes() []byte {
+	n := d.int32()
+	if n < 0 {
+		return nil
+	}
+	return d.next(int(n))
+}
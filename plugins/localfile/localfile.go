@@ -1,11 +1,14 @@
 package localfile
 
 import (
+	"bytes"
 	"compress/gzip"
 	"encoding/csv"
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/Sirupsen/logrus"
@@ -14,12 +17,28 @@ import (
 	"github.com/stripe/veneur/samplers"
 )
 
-var _ plugins.Plugin = &Plugin{}
+var _ plugins.SizedPlugin = &Plugin{}
+
+// Stdout is the FilePath that writes to stdout instead of a file.
+const Stdout = "-"
 
 // Plugin is the LocalFile plugin that we'll use in Veneur
 type Plugin struct {
 	FilePath string
 	Logger   *logrus.Logger
+
+	// JSON writes each metric as a line of JSON, in the form sent to
+	// Datadog, instead of as gzipped TSV.
+	JSON bool
+	// MaxBytes, if positive, is the size the file may grow to. A write
+	// that would make it bigger first renames it with a .1 suffix,
+	// replacing any earlier one, and starts a new file.
+	MaxBytes int64
+	// PluginName is the name of the plugin, if it isn't "localfile".
+	PluginName string
+
+	// serializes writes, so that they don't interleave or race rotation
+	mtx sync.Mutex
 }
 
 // Delimiter defines what kind of delimiter we'll use in the CSV format -- in this case, we want TSV
@@ -27,16 +46,80 @@ const Delimiter = '\t'
 
 // Flush the metrics from the LocalFilePlugin
 func (p *Plugin) Flush(metrics []samplers.DDMetric, hostname string) error {
-	f, err := os.OpenFile(p.FilePath, os.O_RDWR|os.O_APPEND|os.O_CREATE, os.ModePerm)
-	defer f.Close()
+	_, err := p.FlushSized(metrics, hostname)
+	return err
+}
 
-	if err != nil {
-		return fmt.Errorf("couldn't open %s for appending: %s", p.FilePath, err)
+// FlushSized flushes the metrics like Flush, and returns the number of
+// bytes appended to the file, compressed unless JSON is set.
+func (p *Plugin) FlushSized(metrics []samplers.DDMetric, hostname string) (int, error) {
+	buf := &bytes.Buffer{}
+	if p.JSON {
+		values := make([]interface{}, len(metrics))
+		for i, metric := range metrics {
+			values[i] = metric
+		}
+		if err := encodeJSON(buf, values); err != nil {
+			return 0, err
+		}
+	} else if err := appendToWriter(buf, metrics, hostname); err != nil {
+		return 0, err
+	}
+	return p.write(buf.Bytes())
+}
+
+// WriteJSON appends each value to the file as a line of JSON, so that
+// other things Veneur flushes, like spans, can be written alongside the
+// metrics.
+func (p *Plugin) WriteJSON(values []interface{}) error {
+	buf := &bytes.Buffer{}
+	if err := encodeJSON(buf, values); err != nil {
+		return err
+	}
+	_, err := p.write(buf.Bytes())
+	return err
+}
+
+// encodeJSON writes each value to w as a line of JSON.
+func encodeJSON(w io.Writer, values []interface{}) error {
+	enc := json.NewEncoder(w)
+	for _, v := range values {
+		if err := enc.Encode(v); err != nil {
+			return err
+		}
 	}
-	appendToWriter(f, metrics, hostname)
 	return nil
 }
 
+// write appends b to the file in one write, rotating it first if MaxBytes
+// is set and b would make it too big.
+func (p *Plugin) write(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if p.FilePath == Stdout {
+		return os.Stdout.Write(b)
+	}
+	if p.MaxBytes > 0 {
+		info, err := os.Stat(p.FilePath)
+		if err == nil && info.Size() > 0 && info.Size()+int64(len(b)) > p.MaxBytes {
+			if err := os.Rename(p.FilePath, p.FilePath+".1"); err != nil {
+				return 0, fmt.Errorf("couldn't rotate %s: %s", p.FilePath, err)
+			}
+		}
+	}
+
+	f, err := os.OpenFile(p.FilePath, os.O_RDWR|os.O_APPEND|os.O_CREATE, os.ModePerm)
+	if err != nil {
+		return 0, fmt.Errorf("couldn't open %s for appending: %s", p.FilePath, err)
+	}
+	defer f.Close()
+	return f.Write(b)
+}
+
 func appendToWriter(appender io.Writer, metrics []samplers.DDMetric, hostname string) error {
 	gzW := gzip.NewWriter(appender)
 	csvW := csv.NewWriter(gzW)
@@ -51,7 +134,11 @@ func appendToWriter(appender io.Writer, metrics []samplers.DDMetric, hostname st
 	return csvW.Error()
 }
 
-// Name is the name of the LocalFilePlugin, i.e., "localfile"
+// Name is the name of the LocalFilePlugin, i.e., "localfile", unless
+// PluginName is set.
 func (p *Plugin) Name() string {
+	if p.PluginName != "" {
+		return p.PluginName
+	}
 	return "localfile"
 }
@@ -3,6 +3,10 @@ package localfile
 import (
 	"bytes"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/Sirupsen/logrus"
@@ -98,3 +102,71 @@ func TestFailsWritingToInvalidPath(t *testing.T) {
 	}, "globblestoots")
 	assert.Error(t, err)
 }
+
+func TestFlushSized(t *testing.T) {
+	file, err := ioutil.TempFile("", "veneur-localfile")
+	assert.NoError(t, err)
+	file.Close()
+	defer os.Remove(file.Name())
+
+	plugin := Plugin{FilePath: file.Name(), Logger: logrus.New()}
+	metrics := []samplers.DDMetric{{
+		Name:       "a.b.c",
+		Value:      [1][2]float64{{1476119058, 100}},
+		MetricType: "gauge",
+	}}
+	first, err := plugin.FlushSized(metrics, "localhost")
+	assert.NoError(t, err)
+	second, err := plugin.FlushSized(metrics, "localhost")
+	assert.NoError(t, err)
+
+	info, err := os.Stat(file.Name())
+	assert.NoError(t, err)
+	assert.NotZero(t, first)
+	assert.Equal(t, info.Size(), int64(first+second), "the sizes should add up to what was written")
+}
+
+func TestFlushJSON(t *testing.T) {
+	dir, err := ioutil.TempDir("", "veneur-localfile")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "flushes.json")
+
+	plugin := Plugin{FilePath: path, Logger: logrus.New(), JSON: true}
+	assert.NoError(t, plugin.Flush([]samplers.DDMetric{{
+		Name:       "a.b.c",
+		Value:      [1][2]float64{{1476119058, 100}},
+		Tags:       []string{"foo:bar"},
+		MetricType: "gauge",
+		Hostname:   "globalstats",
+	}}, "globalstats"))
+	assert.NoError(t, plugin.WriteJSON([]interface{}{map[string]int{"span_id": 2}}))
+
+	contents, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"metric":"a.b.c","points":[[1476119058,100]],"tags":["foo:bar"],"type":"gauge","host":"globalstats"}`+"\n"+
+		`{"span_id":2}`+"\n", string(contents))
+}
+
+func TestRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "veneur-localfile")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "flushes.json")
+
+	plugin := Plugin{FilePath: path, Logger: logrus.New(), JSON: true, MaxBytes: 80}
+	metric := samplers.DDMetric{Name: "a.b.c", MetricType: "gauge"}
+	for _, name := range []string{"first", "second", "third"} {
+		metric.Name = name
+		assert.NoError(t, plugin.Flush([]samplers.DDMetric{metric}, "globalstats"))
+	}
+
+	contents, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Contains(t, string(contents), `"third"`)
+	assert.Equal(t, 1, strings.Count(string(contents), "\n"), "the file should have been started again")
+	rotated, err := ioutil.ReadFile(path + ".1")
+	assert.NoError(t, err)
+	assert.Contains(t, string(rotated), `"second"`)
+	assert.NotContains(t, string(rotated), `"first"`, "only one rotated file should be kept")
+}
@@ -0,0 +1,208 @@
+package opentsdb
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/Sirupsen/logrus"
+	"github.com/stripe/veneur/plugins"
+	"github.com/stripe/veneur/samplers"
+)
+
+var _ plugins.Plugin = &OpenTSDBPlugin{}
+
+// Datapoint is a metric in the JSON format of OpenTSDB's /api/put.
+type Datapoint struct {
+	Metric    string            `json:"metric"`
+	Timestamp int64             `json:"timestamp"`
+	Value     float64           `json:"value"`
+	Tags      map[string]string `json:"tags"`
+}
+
+// putDetails is the response to /api/put?details, listing the datapoints
+// that OpenTSDB rejected.
+type putDetails struct {
+	Success int `json:"success"`
+	Failed  int `json:"failed"`
+	Errors  []struct {
+		Datapoint Datapoint `json:"datapoint"`
+		Error     string    `json:"error"`
+	} `json:"errors"`
+}
+
+// OpenTSDBPlugin is a plugin for writing flushed metrics to OpenTSDB.
+type OpenTSDBPlugin struct {
+	Logger     *logrus.Logger
+	URL        string
+	HTTPClient *http.Client
+	Statsd     *statsd.Client
+}
+
+// NewOpenTSDBPlugin creates a plugin that writes to the OpenTSDB at addr, eg
+// http://localhost:4242.
+func NewOpenTSDBPlugin(logger *logrus.Logger, addr string, client *http.Client, stats *statsd.Client) (*OpenTSDBPlugin, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("opentsdb_address %q must be a URL like http://localhost:4242", addr)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/api/put"
+	u.RawQuery = "details"
+	return &OpenTSDBPlugin{
+		Logger:     logger,
+		URL:        u.String(),
+		HTTPClient: client,
+		Statsd:     stats,
+	}, nil
+}
+
+// Flush writes the metrics to OpenTSDB in one request. Datapoints that
+// OpenTSDB rejects are counted and logged, and reported as an error.
+func (p *OpenTSDBPlugin) Flush(metrics []samplers.DDMetric, hostname string) error {
+	p.Statsd.Gauge("opentsdb.post_metrics_total", float64(len(metrics)), nil, 1.0)
+	if len(metrics) == 0 {
+		p.Logger.Info("Nothing to flush, skipping.")
+		return nil
+	}
+
+	datapoints := make([]Datapoint, len(metrics))
+	for i, metric := range metrics {
+		datapoints[i] = NewDatapoint(metric, hostname)
+	}
+	body, err := json.Marshal(datapoints)
+	if err != nil {
+		p.Statsd.Count("opentsdb.error_total", 1, []string{"cause:json"}, 1.0)
+		p.Logger.WithError(err).Error("Could not render OpenTSDB datapoints")
+		return err
+	}
+	p.Statsd.Histogram("opentsdb.content_length_bytes", float64(len(body)), nil, 1.0)
+	return p.post(body)
+}
+
+// Name returns the name of the plugin.
+func (p *OpenTSDBPlugin) Name() string {
+	return "opentsdb"
+}
+
+// NewDatapoint converts a metric to an OpenTSDB datapoint. Veneur's
+// "key:value" tags become tag pairs, and tags without a value get the value
+// "true". OpenTSDB requires at least one tag, so every datapoint is tagged
+// with its host. Characters that OpenTSDB does not allow in names are
+// replaced with underscores.
+func NewDatapoint(metric samplers.DDMetric, hostname string) Datapoint {
+	tags := make(map[string]string, len(metric.Tags)+1)
+	host := metric.Hostname
+	if host == "" {
+		host = hostname
+	}
+	if host != "" {
+		tags["host"] = Sanitize(host)
+	}
+	if metric.DeviceName != "" {
+		tags["device"] = Sanitize(metric.DeviceName)
+	}
+	for _, tag := range metric.Tags {
+		key, value := tag, "true"
+		if i := strings.IndexByte(tag, ':'); i >= 0 {
+			key, value = tag[:i], tag[i+1:]
+		}
+		if key == "" || value == "" {
+			// OpenTSDB rejects empty tag keys and values
+			continue
+		}
+		tags[Sanitize(key)] = Sanitize(value)
+	}
+	return Datapoint{
+		Metric:    Sanitize(metric.Name),
+		Timestamp: int64(metric.Value[0][0]),
+		Value:     metric.Value[0][1],
+		Tags:      tags,
+	}
+}
+
+// Sanitize replaces the characters that OpenTSDB does not allow in metric
+// names, tag keys and tag values. Letters, digits, "-", "_", "." and "/" are
+// allowed.
+func Sanitize(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case unicode.IsLetter(r), unicode.IsDigit(r), r == '-', r == '_', r == '.', r == '/':
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+func (p *OpenTSDBPlugin) post(body []byte) error {
+	innerLogger := p.Logger.WithField("action", "opentsdb_post")
+
+	req, err := http.NewRequest(http.MethodPost, p.URL, bytes.NewReader(body))
+	if err != nil {
+		p.Statsd.Count("opentsdb.error_total", 1, []string{"cause:construct"}, 1.0)
+		innerLogger.WithError(err).Error("Could not construct request")
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	// we only make http requests at flush time, so keepalive is not a big win
+	req.Close = true
+
+	requestStart := time.Now()
+	resp, err := p.HTTPClient.Do(req)
+	if err != nil {
+		if urlErr, ok := err.(*url.Error); ok {
+			// if the error has the url in it, then retrieve the inner error
+			// and ditch the url (which might contain secrets)
+			err = urlErr.Err
+		}
+		p.Statsd.Count("opentsdb.error_total", 1, []string{"cause:io"}, 1.0)
+		innerLogger.WithError(err).Error("Could not execute request")
+		return err
+	}
+	p.Statsd.TimeInMilliseconds("opentsdb.duration_ns", float64(time.Since(requestStart).Nanoseconds()), []string{"part:post"}, 1.0)
+	defer resp.Body.Close()
+
+	responseBody, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+		// make sure the error metrics aren't sparse
+		p.Statsd.Count("opentsdb.error_total", 0, nil, 1.0)
+		p.Statsd.Count("opentsdb.rejected_total", 0, nil, 1.0)
+		innerLogger.Debug("POSTed successfully")
+		return nil
+	}
+
+	// with ?details, OpenTSDB lists the datapoints it rejected, and stores
+	// the rest
+	var details putDetails
+	if err := json.Unmarshal(responseBody, &details); err == nil && details.Failed > 0 {
+		p.Statsd.Count("opentsdb.rejected_total", int64(details.Failed), nil, 1.0)
+		fields := logrus.Fields{
+			"status":   resp.Status,
+			"success":  details.Success,
+			"rejected": details.Failed,
+		}
+		if len(details.Errors) > 0 {
+			fields["metric"] = details.Errors[0].Datapoint.Metric
+			fields["reason"] = details.Errors[0].Error
+		}
+		innerLogger.WithFields(fields).Error("OpenTSDB rejected datapoints")
+		return fmt.Errorf("OpenTSDB rejected %d of %d datapoints", details.Failed, details.Failed+details.Success)
+	}
+
+	p.Statsd.Count("opentsdb.error_total", 1, []string{fmt.Sprintf("cause:%d", resp.StatusCode)}, 1.0)
+	innerLogger.WithFields(logrus.Fields{
+		"status":   resp.Status,
+		"response": string(responseBody),
+	}).Error("Could not POST")
+	return fmt.Errorf("OpenTSDB returned %s", resp.Status)
+}
@@ -0,0 +1,99 @@
+package opentsdb
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stripe/veneur/samplers"
+)
+
+var testMetrics = []samplers.DDMetric{
+	samplers.DDMetric{
+		Name:       "a.b c",
+		Value:      [1][2]float64{[2]float64{1476119058, 100}},
+		Tags:       []string{"foo:bar baz", "flag", "weird#key:x=y"},
+		MetricType: "gauge",
+	},
+	samplers.DDMetric{
+		Name:       "d.e/f",
+		Value:      [1][2]float64{[2]float64{1476119058, 2.5}},
+		MetricType: "rate",
+		Hostname:   "other-host",
+		DeviceName: "sda1",
+	},
+}
+
+func TestName(t *testing.T) {
+	plugin, err := NewOpenTSDBPlugin(logrus.New(), "http://localhost:4242", http.DefaultClient, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "opentsdb", plugin.Name())
+	assert.Equal(t, "http://localhost:4242/api/put?details", plugin.URL)
+}
+
+func TestBadAddress(t *testing.T) {
+	_, err := NewOpenTSDBPlugin(logrus.New(), "localhost:4242", http.DefaultClient, nil)
+	assert.Error(t, err)
+}
+
+func TestFlush(t *testing.T) {
+	received := make(chan []byte, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/put", r.URL.Path)
+		assert.Equal(t, "details", r.URL.RawQuery)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		var body json.RawMessage
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		received <- body
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	plugin, err := NewOpenTSDBPlugin(logrus.New(), server.URL, http.DefaultClient, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, plugin.Flush(testMetrics, "my host"))
+
+	assert.JSONEq(t, `[
+		{
+			"metric": "a.b_c",
+			"timestamp": 1476119058,
+			"value": 100,
+			"tags": {"host": "my_host", "foo": "bar_baz", "flag": "true", "weird_key": "x_y"}
+		},
+		{
+			"metric": "d.e/f",
+			"timestamp": 1476119058,
+			"value": 2.5,
+			"tags": {"host": "other-host", "device": "sda1"}
+		}
+	]`, string(<-received))
+}
+
+func TestFlushRejected(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"success": 1, "failed": 1, "errors": [{"datapoint": {"metric": "a.b_c"}, "error": "Unable to parse value to a number"}]}`))
+	}))
+	defer server.Close()
+
+	plugin, err := NewOpenTSDBPlugin(logrus.New(), server.URL, http.DefaultClient, nil)
+	assert.NoError(t, err)
+	err = plugin.Flush(testMetrics, "globalstats")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "rejected 1 of 2 datapoints")
+	}
+}
+
+func TestFlushServerError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	plugin, err := NewOpenTSDBPlugin(logrus.New(), server.URL, http.DefaultClient, nil)
+	assert.NoError(t, err)
+	assert.Error(t, plugin.Flush(testMetrics, "globalstats"))
+}
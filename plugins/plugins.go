@@ -13,3 +13,27 @@ type Plugin interface {
 	Flush(metrics []samplers.DDMetric, hostname string) error
 	Name() string
 }
+
+// A DistributionPlugin is a Plugin that can also flush histograms whole,
+// rather than as percentiles. Histograms named in histograms_as_distributions
+// are passed to FlushDistributions in addition to the usual Flush.
+type DistributionPlugin interface {
+	Plugin
+	FlushDistributions(distributions []samplers.DDDistribution, hostname string) error
+}
+
+// A SummaryPlugin is a Plugin with a native summary type. If
+// percentiles_as_summaries is set, the percentiles of each histogram are
+// passed to FlushSummaries as one summary, and left out of Flush.
+type SummaryPlugin interface {
+	Plugin
+	FlushSummaries(summaries []samplers.DDSummary, hostname string) error
+}
+
+// A SizedPlugin is a Plugin that reports the size of what it flushes, for
+// the flush audit log. FlushSized is called instead of Flush, and returns
+// the number of bytes the plugin wrote or sent.
+type SizedPlugin interface {
+	Plugin
+	FlushSized(metrics []samplers.DDMetric, hostname string) (int, error)
+}
@@ -0,0 +1,254 @@
+package prometheus
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/Sirupsen/logrus"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/stripe/veneur/plugins"
+	"github.com/stripe/veneur/samplers"
+)
+
+var _ plugins.Plugin = &RemoteWritePlugin{}
+
+// RemoteWritePlugin is a plugin for writing flushed metrics to a
+// Prometheus remote-write endpoint, such as Prometheus itself, Thanos
+// Receive or Cortex.
+type RemoteWritePlugin struct {
+	Logger     *logrus.Logger
+	URL        string
+	HTTPClient *http.Client
+	Statsd     *statsd.Client
+}
+
+// NewRemoteWritePlugin creates a plugin that writes to the remote-write
+// endpoint at addr, eg http://localhost:9090/api/v1/write.
+func NewRemoteWritePlugin(logger *logrus.Logger, addr string, client *http.Client, stats *statsd.Client) (*RemoteWritePlugin, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("prometheus_remote_write_address %q must be a URL like http://localhost:9090/api/v1/write", addr)
+	}
+	return &RemoteWritePlugin{
+		Logger:     logger,
+		URL:        u.String(),
+		HTTPClient: client,
+		Statsd:     stats,
+	}, nil
+}
+
+// Name returns the name of the plugin.
+func (p *RemoteWritePlugin) Name() string {
+	return "prometheus"
+}
+
+// Flush writes the metrics to the remote-write endpoint in one request.
+func (p *RemoteWritePlugin) Flush(metrics []samplers.DDMetric, hostname string) error {
+	p.Statsd.Gauge("prometheus.post_metrics_total", float64(len(metrics)), nil, 1.0)
+	if len(metrics) == 0 {
+		p.Logger.Info("Nothing to flush, skipping.")
+		return nil
+	}
+
+	req, collisions := NewWriteRequest(metrics, hostname)
+	if len(collisions) > 0 {
+		p.Statsd.Count("prometheus.error_total", int64(len(collisions)), []string{"cause:collision"}, 1.0)
+		p.Logger.WithFields(logrus.Fields{
+			"dropped": len(collisions),
+			"metrics": collisions,
+		}).Warn("Dropped metrics whose names collide once converted for Prometheus")
+	}
+	body, err := proto.Marshal(req)
+	if err != nil {
+		p.Statsd.Count("prometheus.error_total", 1, []string{"cause:protobuf"}, 1.0)
+		p.Logger.WithError(err).Error("Could not render remote-write request")
+		return err
+	}
+	body = snappy.Encode(nil, body)
+	p.Statsd.Histogram("prometheus.content_length_bytes", float64(len(body)), nil, 1.0)
+	return p.post(body)
+}
+
+// NewWriteRequest converts metrics to a remote-write request, with one
+// series per metric. Veneur's "key:value" tags become labels, split on the
+// first colon so that values may contain colons, and tags without a value
+// get the value "true". Metrics are labelled with their host and device.
+// Rates and counts are counters and the rest are gauges, except that a
+// histogram's percentiles, eg a.b.c.99percentile, are series of a.b.c with
+// a quantile label, eg 0.99. Names are sanitized for Prometheus.
+//
+// Since sanitizing can map different names to the same one, a metric is
+// dropped if its series was already written, or if its family was already
+// described with another type; the names of the dropped metrics are
+// returned as collisions.
+func NewWriteRequest(metrics []samplers.DDMetric, hostname string) (req *WriteRequest, collisions []string) {
+	req = &WriteRequest{Timeseries: make([]*TimeSeries, 0, len(metrics))}
+	families := map[string]MetricType{}
+	seen := map[string]struct{}{}
+	for _, metric := range metrics {
+		name, metricType := metric.Name, MetricTypeGauge
+		if metric.MetricType == "rate" || metric.MetricType == "count" {
+			metricType = MetricTypeCounter
+		}
+		labels := map[string]string{}
+		if histogram, quantile, ok := samplers.ParsePercentileName(name); ok {
+			name = histogram
+			labels["quantile"] = strconv.FormatFloat(quantile, 'f', -1, 64)
+		}
+		name = SanitizeName(name)
+
+		host := metric.Hostname
+		if host == "" {
+			host = hostname
+		}
+		if host != "" {
+			labels["host"] = host
+		}
+		if metric.DeviceName != "" {
+			labels["device"] = metric.DeviceName
+		}
+		for _, tag := range metric.Tags {
+			key, value := tag, "true"
+			if i := strings.IndexByte(tag, ':'); i >= 0 {
+				key, value = tag[:i], tag[i+1:]
+			}
+			key = SanitizeLabel(key)
+			if _, ok := labels[key]; ok || key == "" || value == "" || strings.HasPrefix(key, "__") {
+				// Prometheus rejects repeated and reserved labels, and
+				// ignores empty ones
+				continue
+			}
+			labels[key] = value
+		}
+
+		if familyType, ok := families[name]; ok && familyType != metricType {
+			collisions = append(collisions, metric.Name)
+			continue
+		}
+
+		series := &TimeSeries{
+			Labels: []*Label{{Name: "__name__", Value: name}},
+			Samples: []*Sample{{
+				Value:     metric.Value[0][1],
+				Timestamp: int64(metric.Value[0][0] * 1000),
+			}},
+		}
+		keys := make([]string, 0, len(labels))
+		for key := range labels {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		// the series is identified by its name and labels, separated by a
+		// byte that never appears in UTF-8
+		id := []byte(name)
+		for _, key := range keys {
+			series.Labels = append(series.Labels, &Label{Name: key, Value: labels[key]})
+			id = append(id, 0xff)
+			id = append(id, key...)
+			id = append(id, 0xff)
+			id = append(id, labels[key]...)
+		}
+		if _, ok := seen[string(id)]; ok {
+			collisions = append(collisions, metric.Name)
+			continue
+		}
+		seen[string(id)] = struct{}{}
+		req.Timeseries = append(req.Timeseries, series)
+
+		if _, ok := families[name]; !ok {
+			families[name] = metricType
+			req.Metadata = append(req.Metadata, &MetricMetadata{Type: metricType, MetricFamilyName: name})
+		}
+	}
+	return req, collisions
+}
+
+// SanitizeName replaces the characters that Prometheus doesn't allow in
+// metric names with underscores, so a.b-c becomes a_b_c.
+func SanitizeName(name string) string {
+	return sanitize(name, true)
+}
+
+// SanitizeLabel replaces the characters that Prometheus doesn't allow in
+// label names with underscores.
+func SanitizeLabel(name string) string {
+	return sanitize(name, false)
+}
+
+// sanitize keeps ASCII letters, digits, underscores and, in metric names,
+// colons. Names may not start with a digit, so those are prefixed with an
+// underscore.
+func sanitize(name string, colons bool) string {
+	sanitized := []byte(name)
+	for i, c := range sanitized {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '_':
+		case c == ':' && colons:
+		default:
+			sanitized[i] = '_'
+		}
+	}
+	if len(sanitized) > 0 && sanitized[0] >= '0' && sanitized[0] <= '9' {
+		return "_" + string(sanitized)
+	}
+	return string(sanitized)
+}
+
+func (p *RemoteWritePlugin) post(body []byte) error {
+	innerLogger := p.Logger.WithField("action", "prometheus_post")
+
+	req, err := http.NewRequest(http.MethodPost, p.URL, bytes.NewReader(body))
+	if err != nil {
+		p.Statsd.Count("prometheus.error_total", 1, []string{"cause:construct"}, 1.0)
+		innerLogger.WithError(err).Error("Could not construct request")
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+
+	// we only make http requests at flush time, so keepalive is not a big win
+	req.Close = true
+
+	requestStart := time.Now()
+	resp, err := p.HTTPClient.Do(req)
+	if err != nil {
+		if urlErr, ok := err.(*url.Error); ok {
+			// if the error has the url in it, then retrieve the inner error
+			// and ditch the url (which might contain secrets)
+			err = urlErr.Err
+		}
+		p.Statsd.Count("prometheus.error_total", 1, []string{"cause:io"}, 1.0)
+		innerLogger.WithError(err).Error("Could not execute request")
+		return err
+	}
+	p.Statsd.TimeInMilliseconds("prometheus.duration_ns", float64(time.Since(requestStart).Nanoseconds()), []string{"part:post"}, 1.0)
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+		// make sure the error metrics aren't sparse
+		p.Statsd.Count("prometheus.error_total", 0, nil, 1.0)
+		innerLogger.Debug("POSTed successfully")
+		return nil
+	}
+
+	responseBody, _ := ioutil.ReadAll(resp.Body)
+	p.Statsd.Count("prometheus.error_total", 1, []string{fmt.Sprintf("cause:%d", resp.StatusCode)}, 1.0)
+	innerLogger.WithFields(logrus.Fields{
+		"status":   resp.Status,
+		"response": string(responseBody),
+	}).Error("Could not POST")
+	return fmt.Errorf("Prometheus remote write returned %s", resp.Status)
+}
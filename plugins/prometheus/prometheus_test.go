@@ -0,0 +1,155 @@
+package prometheus
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stripe/veneur/samplers"
+)
+
+var testMetrics = []samplers.DDMetric{
+	samplers.DDMetric{
+		Name:       "a.b-c",
+		Value:      [1][2]float64{[2]float64{1476119058, 100}},
+		Tags:       []string{"url:http://example.com:80/", "flag", "weird#key:x", "__name__:nope"},
+		MetricType: "gauge",
+	},
+	samplers.DDMetric{
+		Name:       "d.e",
+		Value:      [1][2]float64{[2]float64{1476119058, 2.5}},
+		MetricType: "rate",
+		Hostname:   "other-host",
+		DeviceName: "sda1",
+	},
+	samplers.DDMetric{
+		Name:       "lat.99percentile",
+		Value:      [1][2]float64{[2]float64{1476119058, 0.3}},
+		MetricType: "gauge",
+	},
+	samplers.DDMetric{
+		Name:       "lat.50percentile",
+		Value:      [1][2]float64{[2]float64{1476119058, 0.1}},
+		MetricType: "gauge",
+	},
+	samplers.DDMetric{
+		Name:       "lat.99_9percentile",
+		Value:      [1][2]float64{[2]float64{1476119058, 0.5}},
+		MetricType: "gauge",
+	},
+}
+
+func TestName(t *testing.T) {
+	plugin, err := NewRemoteWritePlugin(logrus.New(), "http://localhost:9090/api/v1/write", http.DefaultClient, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "prometheus", plugin.Name())
+}
+
+func TestBadAddress(t *testing.T) {
+	_, err := NewRemoteWritePlugin(logrus.New(), "localhost:9090", http.DefaultClient, nil)
+	assert.Error(t, err)
+}
+
+func TestFlush(t *testing.T) {
+	received := make(chan *WriteRequest, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/v1/write", r.URL.Path)
+		assert.Equal(t, "application/x-protobuf", r.Header.Get("Content-Type"))
+		assert.Equal(t, "snappy", r.Header.Get("Content-Encoding"))
+		body, err := ioutil.ReadAll(r.Body)
+		assert.NoError(t, err)
+		body, err = snappy.Decode(nil, body)
+		assert.NoError(t, err)
+		req := &WriteRequest{}
+		assert.NoError(t, proto.Unmarshal(body, req))
+		received <- req
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	plugin, err := NewRemoteWritePlugin(logrus.New(), server.URL+"/api/v1/write", http.DefaultClient, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, plugin.Flush(testMetrics, "my-host"))
+
+	req := <-received
+	labels := func(series *TimeSeries) map[string]string {
+		byName := map[string]string{}
+		for _, l := range series.Labels {
+			byName[l.Name] = l.Value
+		}
+		return byName
+	}
+	if assert.Len(t, req.Timeseries, 5) {
+		assert.Equal(t, map[string]string{
+			"__name__":  "a_b_c",
+			"host":      "my-host",
+			"url":       "http://example.com:80/",
+			"flag":      "true",
+			"weird_key": "x",
+		}, labels(req.Timeseries[0]), "tag values may contain colons")
+		assert.Equal(t, []*Sample{{Value: 100, Timestamp: 1476119058000}}, req.Timeseries[0].Samples)
+		assert.Equal(t, "__name__", req.Timeseries[0].Labels[0].Name)
+		assert.Equal(t, "flag", req.Timeseries[0].Labels[1].Name, "labels should be sorted")
+
+		assert.Equal(t, map[string]string{
+			"__name__": "d_e",
+			"host":     "other-host",
+			"device":   "sda1",
+		}, labels(req.Timeseries[1]))
+		assert.Equal(t, map[string]string{
+			"__name__": "lat",
+			"host":     "my-host",
+			"quantile": "0.99",
+		}, labels(req.Timeseries[2]))
+		assert.Equal(t, "0.5", labels(req.Timeseries[3])["quantile"])
+		assert.Equal(t, "0.999", labels(req.Timeseries[4])["quantile"])
+	}
+	assert.Equal(t, []*MetricMetadata{
+		{Type: MetricTypeGauge, MetricFamilyName: "a_b_c"},
+		{Type: MetricTypeCounter, MetricFamilyName: "d_e"},
+		{Type: MetricTypeGauge, MetricFamilyName: "lat"},
+	}, req.Metadata, "each family should be described once")
+}
+
+func TestCollisions(t *testing.T) {
+	req, collisions := NewWriteRequest([]samplers.DDMetric{
+		{Name: "a.b", Value: [1][2]float64{{1476119058, 1}}, Tags: []string{"x.y:1"}, MetricType: "gauge"},
+		{Name: "a-b", Value: [1][2]float64{{1476119058, 2}}, Tags: []string{"x_y:1"}, MetricType: "gauge"},
+		{Name: "a_b", Value: [1][2]float64{{1476119058, 3}}, Tags: []string{"x_y:2"}, MetricType: "gauge"},
+		{Name: "a:b", Value: [1][2]float64{{1476119058, 4}}, MetricType: "gauge"},
+		{Name: "a.b", Value: [1][2]float64{{1476119058, 5}}, MetricType: "rate"},
+	}, "my-host")
+
+	assert.Equal(t, []string{"a-b", "a.b"}, collisions, "the repeated series and the counter should be dropped")
+	if assert.Len(t, req.Timeseries, 3) {
+		assert.Equal(t, 1.0, req.Timeseries[0].Samples[0].Value, "the first metric of a series should be kept")
+		assert.Equal(t, 3.0, req.Timeseries[1].Samples[0].Value)
+		assert.Equal(t, 4.0, req.Timeseries[2].Samples[0].Value)
+	}
+	assert.Equal(t, []*MetricMetadata{
+		{Type: MetricTypeGauge, MetricFamilyName: "a_b"},
+		{Type: MetricTypeGauge, MetricFamilyName: "a:b"},
+	}, req.Metadata)
+}
+
+func TestFlushError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	plugin, err := NewRemoteWritePlugin(logrus.New(), server.URL, http.DefaultClient, nil)
+	assert.NoError(t, err)
+	assert.Error(t, plugin.Flush(testMetrics, "my-host"))
+}
+
+func TestSanitize(t *testing.T) {
+	assert.Equal(t, "a_b:c_d", SanitizeName("a.b:c-d"))
+	assert.Equal(t, "_9lives", SanitizeName("9lives"))
+	assert.Equal(t, "a_b_c", SanitizeLabel("a:b.c"))
+}
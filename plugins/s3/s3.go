@@ -21,7 +21,7 @@ import (
 
 // TODO set log level
 
-var _ plugins.Plugin = &S3Plugin{}
+var _ plugins.SizedPlugin = &S3Plugin{}
 
 type S3Plugin struct {
 	Logger   *logrus.Logger
@@ -31,6 +31,13 @@ type S3Plugin struct {
 }
 
 func (p *S3Plugin) Flush(metrics []samplers.DDMetric, hostname string) error {
+	_, err := p.FlushSized(metrics, hostname)
+	return err
+}
+
+// FlushSized flushes the metrics like Flush, and returns the number of
+// compressed bytes posted to S3.
+func (p *S3Plugin) FlushSized(metrics []samplers.DDMetric, hostname string) (int, error) {
 	const Delimiter = '\t'
 	const IncludeHeaders = false
 
@@ -40,7 +47,14 @@ func (p *S3Plugin) Flush(metrics []samplers.DDMetric, hostname string) error {
 			logrus.ErrorKey: err,
 			"metrics":       len(metrics),
 		}).Error("Could not marshal metrics before posting to s3")
-		return err
+		return 0, err
+	}
+	size, err := csv.Seek(0, io.SeekEnd)
+	if err == nil {
+		_, err = csv.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		return 0, err
 	}
 
 	err = p.S3Post(hostname, csv, tsvGzFt)
@@ -49,11 +63,11 @@ func (p *S3Plugin) Flush(metrics []samplers.DDMetric, hostname string) error {
 			logrus.ErrorKey: err,
 			"metrics":       len(metrics),
 		}).Error("Error posting to s3")
-		return err
+		return 0, err
 	}
 
 	p.Logger.WithField("metrics", len(metrics)).Debug("Completed flush to s3")
-	return nil
+	return int(size), nil
 }
 
 func (p *S3Plugin) Name() string {
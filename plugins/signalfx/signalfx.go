@@ -0,0 +1,247 @@
+package signalfx
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/Sirupsen/logrus"
+	"github.com/stripe/veneur/plugins"
+	"github.com/stripe/veneur/samplers"
+)
+
+var _ plugins.Plugin = &SignalFxPlugin{}
+
+// DefaultEndpoint is SignalFx's ingest API, used if no endpoint is set.
+const DefaultEndpoint = "https://ingest.signalfx.com"
+
+// DefaultMaxPerBody is how many datapoints are sent in each request if no
+// limit is set.
+const DefaultMaxPerBody = 5000
+
+// datapointPath is where SignalFx takes datapoints, as JSON.
+const datapointPath = "/v2/datapoint"
+
+// Datapoint is a metric in the JSON format of SignalFx's /v2/datapoint.
+// The timestamp is in milliseconds since the epoch.
+type Datapoint struct {
+	Metric     string            `json:"metric"`
+	Value      float64           `json:"value"`
+	Dimensions map[string]string `json:"dimensions,omitempty"`
+	Timestamp  int64             `json:"timestamp"`
+}
+
+// Body is a request to /v2/datapoint, with the datapoints of each type.
+// Veneur doesn't keep running totals, so it never sends cumulative counters.
+type Body struct {
+	Gauge   []Datapoint `json:"gauge,omitempty"`
+	Counter []Datapoint `json:"counter,omitempty"`
+}
+
+// SignalFxPlugin is a plugin for writing flushed metrics to SignalFx.
+type SignalFxPlugin struct {
+	Logger     *logrus.Logger
+	URL        string
+	APIKey     string
+	MaxPerBody int
+	HTTPClient *http.Client
+	Statsd     *statsd.Client
+}
+
+// NewSignalFxPlugin creates a plugin that writes to the SignalFx ingest API
+// at endpoint, or DefaultEndpoint if it is empty, authenticated with apiKey.
+// Each request has at most maxPerBody datapoints, or DefaultMaxPerBody if
+// it isn't positive.
+func NewSignalFxPlugin(logger *logrus.Logger, endpoint string, apiKey string, maxPerBody int, client *http.Client, stats *statsd.Client) (*SignalFxPlugin, error) {
+	if endpoint == "" {
+		endpoint = DefaultEndpoint
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("signalfx_endpoint_base %q must be a URL like %s", endpoint, DefaultEndpoint)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + datapointPath
+	if maxPerBody <= 0 {
+		maxPerBody = DefaultMaxPerBody
+	}
+	return &SignalFxPlugin{
+		Logger:     logger,
+		URL:        u.String(),
+		APIKey:     apiKey,
+		MaxPerBody: maxPerBody,
+		HTTPClient: client,
+		Statsd:     stats,
+	}, nil
+}
+
+// Name returns the name of the plugin.
+func (p *SignalFxPlugin) Name() string {
+	return "signalfx"
+}
+
+// Flush writes the metrics to SignalFx, in requests of up to MaxPerBody
+// datapoints. If a request fails, the rest are still sent, and the first
+// error is returned.
+func (p *SignalFxPlugin) Flush(metrics []samplers.DDMetric, hostname string) error {
+	p.Statsd.Gauge("signalfx.post_metrics_total", float64(len(metrics)), nil, 1.0)
+	if len(metrics) == 0 {
+		p.Logger.Info("Nothing to flush, skipping.")
+		return nil
+	}
+
+	var firstErr error
+	for start := 0; start < len(metrics); start += p.MaxPerBody {
+		end := start + p.MaxPerBody
+		if end > len(metrics) {
+			end = len(metrics)
+		}
+		if err := p.flushPart(metrics[start:end], hostname); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (p *SignalFxPlugin) flushPart(metrics []samplers.DDMetric, hostname string) error {
+	body, err := json.Marshal(NewBody(metrics, hostname))
+	if err != nil {
+		p.Statsd.Count("signalfx.error_total", 1, []string{"cause:json"}, 1.0)
+		p.Logger.WithError(err).Error("Could not render SignalFx datapoints")
+		return err
+	}
+	p.Statsd.Histogram("signalfx.content_length_bytes", float64(len(body)), nil, 1.0)
+	return p.post(body)
+}
+
+// NewBody converts metrics to SignalFx datapoints. Rates and counts are
+// counters, and the rest are gauges. Since a SignalFx counter is the count
+// since the last report, a rate is multiplied back out by its interval.
+func NewBody(metrics []samplers.DDMetric, hostname string) Body {
+	var body Body
+	for _, metric := range metrics {
+		datapoint := NewDatapoint(metric, hostname)
+		switch metric.MetricType {
+		case "rate":
+			if metric.Interval > 0 {
+				datapoint.Value *= float64(metric.Interval)
+			}
+			body.Counter = append(body.Counter, datapoint)
+		case "count":
+			body.Counter = append(body.Counter, datapoint)
+		default:
+			body.Gauge = append(body.Gauge, datapoint)
+		}
+	}
+	return body
+}
+
+// NewDatapoint converts a metric to a SignalFx datapoint. Veneur's
+// "key:value" tags become dimensions, split on the first colon, and tags
+// without a value get the value "true". The metric's host and device, which
+// Veneur has already taken from any host: and device: tags, are the host and
+// device dimensions.
+func NewDatapoint(metric samplers.DDMetric, hostname string) Datapoint {
+	dimensions := make(map[string]string, len(metric.Tags)+2)
+	for _, tag := range metric.Tags {
+		key, value := tag, "true"
+		if i := strings.IndexByte(tag, ':'); i >= 0 {
+			key, value = tag[:i], tag[i+1:]
+		}
+		if key == "" || value == "" {
+			// SignalFx ignores empty dimensions
+			continue
+		}
+		dimensions[SanitizeDimension(key)] = value
+	}
+	host := metric.Hostname
+	if host == "" {
+		host = hostname
+	}
+	if host != "" {
+		dimensions["host"] = host
+	}
+	if metric.DeviceName != "" {
+		dimensions["device"] = metric.DeviceName
+	}
+	return Datapoint{
+		Metric:     metric.Name,
+		Value:      metric.Value[0][1],
+		Dimensions: dimensions,
+		Timestamp:  int64(metric.Value[0][0] * 1000),
+	}
+}
+
+// SanitizeDimension makes name a valid SignalFx dimension name. Letters,
+// digits, "_" and "-" are allowed, and anything else is replaced with "_".
+// Names must start with a letter and may not start with "sf_", which
+// SignalFx reserves, so any other name is prefixed with "tag_".
+func SanitizeDimension(name string) string {
+	sanitized := []byte(name)
+	for i, c := range sanitized {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '_', c == '-':
+		default:
+			sanitized[i] = '_'
+		}
+	}
+	name = string(sanitized)
+	if name == "" || !(name[0] >= 'a' && name[0] <= 'z' || name[0] >= 'A' && name[0] <= 'Z') || strings.HasPrefix(name, "sf_") {
+		return "tag_" + name
+	}
+	return name
+}
+
+func (p *SignalFxPlugin) post(body []byte) error {
+	innerLogger := p.Logger.WithField("action", "signalfx_post")
+
+	req, err := http.NewRequest(http.MethodPost, p.URL, bytes.NewReader(body))
+	if err != nil {
+		p.Statsd.Count("signalfx.error_total", 1, []string{"cause:construct"}, 1.0)
+		innerLogger.WithError(err).Error("Could not construct request")
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-SF-Token", p.APIKey)
+
+	// we only make http requests at flush time, so keepalive is not a big win
+	req.Close = true
+
+	requestStart := time.Now()
+	resp, err := p.HTTPClient.Do(req)
+	if err != nil {
+		if urlErr, ok := err.(*url.Error); ok {
+			// if the error has the url in it, then retrieve the inner error
+			// and ditch the url (which might contain secrets)
+			err = urlErr.Err
+		}
+		p.Statsd.Count("signalfx.error_total", 1, []string{"cause:io"}, 1.0)
+		innerLogger.WithError(err).Error("Could not execute request")
+		return err
+	}
+	p.Statsd.TimeInMilliseconds("signalfx.duration_ns", float64(time.Since(requestStart).Nanoseconds()), []string{"part:post"}, 1.0)
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+		// make sure the error metrics aren't sparse
+		p.Statsd.Count("signalfx.error_total", 0, nil, 1.0)
+		innerLogger.Debug("POSTed successfully")
+		return nil
+	}
+
+	responseBody, _ := ioutil.ReadAll(resp.Body)
+	p.Statsd.Count("signalfx.error_total", 1, []string{fmt.Sprintf("cause:%d", resp.StatusCode)}, 1.0)
+	innerLogger.WithFields(logrus.Fields{
+		"status":   resp.Status,
+		"response": string(responseBody),
+	}).Error("Could not POST")
+	return fmt.Errorf("SignalFx returned %s", resp.Status)
+}
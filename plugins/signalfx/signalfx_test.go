@@ -0,0 +1,124 @@
+package signalfx
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stripe/veneur/samplers"
+)
+
+var testMetrics = []samplers.DDMetric{
+	samplers.DDMetric{
+		Name:       "a.b.c",
+		Value:      [1][2]float64{[2]float64{1476119058, 100}},
+		Tags:       []string{"url:http://example.com:80/", "flag", "weird#key:x", "9lives:yes"},
+		MetricType: "gauge",
+	},
+	samplers.DDMetric{
+		Name:       "d.e",
+		Value:      [1][2]float64{[2]float64{1476119058, 2.5}},
+		MetricType: "rate",
+		Hostname:   "other-host",
+		DeviceName: "sda1",
+		Interval:   10,
+	},
+	samplers.DDMetric{
+		Name:       "d.e.count",
+		Value:      [1][2]float64{[2]float64{1476119058, 25}},
+		MetricType: "count",
+		Interval:   10,
+	},
+}
+
+func TestName(t *testing.T) {
+	plugin, err := NewSignalFxPlugin(logrus.New(), "", "secret", 0, http.DefaultClient, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "signalfx", plugin.Name())
+	assert.Equal(t, "https://ingest.signalfx.com/v2/datapoint", plugin.URL)
+	assert.Equal(t, DefaultMaxPerBody, plugin.MaxPerBody)
+}
+
+func TestBadAddress(t *testing.T) {
+	_, err := NewSignalFxPlugin(logrus.New(), "ingest.signalfx.com", "secret", 0, http.DefaultClient, nil)
+	assert.Error(t, err)
+}
+
+func TestFlush(t *testing.T) {
+	received := make(chan []byte, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v2/datapoint", r.URL.Path)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		assert.Equal(t, "secret", r.Header.Get("X-SF-Token"))
+		var body json.RawMessage
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		received <- body
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	plugin, err := NewSignalFxPlugin(logrus.New(), server.URL, "secret", 0, http.DefaultClient, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, plugin.Flush(testMetrics, "my-host"))
+
+	assert.JSONEq(t, `{
+		"gauge": [{
+			"metric": "a.b.c",
+			"value": 100,
+			"timestamp": 1476119058000,
+			"dimensions": {"host": "my-host", "url": "http://example.com:80/", "flag": "true", "weird_key": "x", "tag_9lives": "yes"}
+		}],
+		"counter": [{
+			"metric": "d.e",
+			"value": 25,
+			"timestamp": 1476119058000,
+			"dimensions": {"host": "other-host", "device": "sda1"}
+		}, {
+			"metric": "d.e.count",
+			"value": 25,
+			"timestamp": 1476119058000,
+			"dimensions": {"host": "my-host"}
+		}]
+	}`, string(<-received))
+}
+
+func TestFlushBatches(t *testing.T) {
+	received := make(chan Body, len(testMetrics))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body Body
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		received <- body
+	}))
+	defer server.Close()
+
+	plugin, err := NewSignalFxPlugin(logrus.New(), server.URL, "secret", 2, http.DefaultClient, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, plugin.Flush(testMetrics, "my-host"))
+	close(received)
+
+	var sizes []int
+	for body := range received {
+		sizes = append(sizes, len(body.Gauge)+len(body.Counter))
+	}
+	assert.Equal(t, []int{2, 1}, sizes)
+}
+
+func TestFlushError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	plugin, err := NewSignalFxPlugin(logrus.New(), server.URL, "wrong", 0, http.DefaultClient, nil)
+	assert.NoError(t, err)
+	assert.Error(t, plugin.Flush(testMetrics, "my-host"))
+}
+
+func TestSanitizeDimension(t *testing.T) {
+	assert.Equal(t, "a_b-c", SanitizeDimension("a.b-c"))
+	assert.Equal(t, "tag_9lives", SanitizeDimension("9lives"))
+	assert.Equal(t, "tag_sf_metric", SanitizeDimension("sf_metric"))
+}
@@ -0,0 +1,177 @@
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"text/template"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/Sirupsen/logrus"
+	"github.com/stripe/veneur/plugins"
+	"github.com/stripe/veneur/samplers"
+)
+
+var _ plugins.SizedPlugin = &WebhookPlugin{}
+
+// DefaultAttempts is the number of times a flush is POSTed before giving up.
+const DefaultAttempts = 3
+
+// DefaultBackoff is the delay before the first retry. It doubles on every
+// subsequent attempt.
+const DefaultBackoff = 500 * time.Millisecond
+
+// payload is the data passed to a user-supplied template.
+type payload struct {
+	Hostname string
+	Metrics  []samplers.DDMetric
+}
+
+// WebhookPlugin is a plugin for POSTing each flush to an arbitrary URL.
+type WebhookPlugin struct {
+	Logger     *logrus.Logger
+	URL        string
+	Headers    map[string]string
+	Template   *template.Template
+	HTTPClient *http.Client
+	Statsd     *statsd.Client
+	Attempts   int
+	Backoff    time.Duration
+}
+
+// NewWebhookPlugin creates a new webhook plugin. If tmpl is empty, each flush
+// is sent as a JSON array of metrics; otherwise tmpl is parsed as a
+// text/template and rendered with the fields Hostname and Metrics. Templates
+// may use the `json` function to encode any value as JSON.
+func NewWebhookPlugin(logger *logrus.Logger, addr string, headers map[string]string, tmpl string, client *http.Client, stats *statsd.Client) (*WebhookPlugin, error) {
+	if _, err := url.Parse(addr); err != nil {
+		return nil, err
+	}
+	plugin := &WebhookPlugin{
+		Logger:     logger,
+		URL:        addr,
+		Headers:    headers,
+		HTTPClient: client,
+		Statsd:     stats,
+		Attempts:   DefaultAttempts,
+		Backoff:    DefaultBackoff,
+	}
+	if tmpl != "" {
+		t, err := template.New("webhook").Funcs(template.FuncMap{
+			"json": func(v interface{}) (string, error) {
+				b, err := json.Marshal(v)
+				return string(b), err
+			},
+		}).Parse(tmpl)
+		if err != nil {
+			return nil, err
+		}
+		plugin.Template = t
+	}
+	return plugin, nil
+}
+
+// Flush renders the metrics and POSTs them to the webhook, retrying on
+// failure.
+func (p *WebhookPlugin) Flush(metrics []samplers.DDMetric, hostname string) error {
+	_, err := p.FlushSized(metrics, hostname)
+	return err
+}
+
+// FlushSized flushes the metrics like Flush, and returns the size of the
+// body posted.
+func (p *WebhookPlugin) FlushSized(metrics []samplers.DDMetric, hostname string) (int, error) {
+	p.Statsd.Gauge("webhook.post_metrics_total", float64(len(metrics)), nil, 1.0)
+	if len(metrics) == 0 {
+		p.Logger.Info("Nothing to flush, skipping.")
+		return 0, nil
+	}
+
+	body, err := p.render(metrics, hostname)
+	if err != nil {
+		p.Statsd.Count("webhook.error_total", 1, []string{"cause:render"}, 1.0)
+		p.Logger.WithError(err).Error("Could not render webhook body")
+		return 0, err
+	}
+	p.Statsd.Histogram("webhook.content_length_bytes", float64(len(body)), nil, 1.0)
+
+	backoff := p.Backoff
+	for attempt := 1; ; attempt++ {
+		err = p.post(body)
+		if err == nil || attempt >= p.Attempts {
+			break
+		}
+		p.Logger.WithError(err).WithField("attempt", attempt).Warn("Retrying webhook POST")
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+	return len(body), err
+}
+
+// Name returns the name of the plugin.
+func (p *WebhookPlugin) Name() string {
+	return "webhook"
+}
+
+func (p *WebhookPlugin) render(metrics []samplers.DDMetric, hostname string) ([]byte, error) {
+	if p.Template == nil {
+		return json.Marshal(metrics)
+	}
+	buf := bytes.Buffer{}
+	err := p.Template.Execute(&buf, payload{Hostname: hostname, Metrics: metrics})
+	return buf.Bytes(), err
+}
+
+func (p *WebhookPlugin) post(body []byte) error {
+	innerLogger := p.Logger.WithField("action", "webhook_post")
+
+	req, err := http.NewRequest(http.MethodPost, p.URL, bytes.NewReader(body))
+	if err != nil {
+		p.Statsd.Count("webhook.error_total", 1, []string{"cause:construct"}, 1.0)
+		innerLogger.WithError(err).Error("Could not construct request")
+		return err
+	}
+	if p.Template == nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for k, v := range p.Headers {
+		req.Header.Set(k, v)
+	}
+
+	// we only make http requests at flush time, so keepalive is not a big win
+	req.Close = true
+
+	requestStart := time.Now()
+	resp, err := p.HTTPClient.Do(req)
+	if err != nil {
+		if urlErr, ok := err.(*url.Error); ok {
+			// if the error has the url in it, then retrieve the inner error
+			// and ditch the url (which might contain secrets)
+			err = urlErr.Err
+		}
+		p.Statsd.Count("webhook.error_total", 1, []string{"cause:io"}, 1.0)
+		innerLogger.WithError(err).Error("Could not execute request")
+		return err
+	}
+	p.Statsd.TimeInMilliseconds("webhook.duration_ns", float64(time.Since(requestStart).Nanoseconds()), []string{"part:post"}, 1.0)
+	defer resp.Body.Close()
+
+	responseBody, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		p.Statsd.Count("webhook.error_total", 1, []string{fmt.Sprintf("cause:%d", resp.StatusCode)}, 1.0)
+		innerLogger.WithFields(logrus.Fields{
+			"status":   resp.Status,
+			"response": string(responseBody),
+		}).Error("Could not POST")
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+
+	// make sure the error metric isn't sparse
+	p.Statsd.Count("webhook.error_total", 0, nil, 1.0)
+	innerLogger.Debug("POSTed successfully")
+	return nil
+}
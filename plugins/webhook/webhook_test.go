@@ -0,0 +1,89 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stripe/veneur/samplers"
+)
+
+var testMetrics = []samplers.DDMetric{
+	samplers.DDMetric{
+		Name:       "a.b.c",
+		Value:      [1][2]float64{[2]float64{1476119058, 100}},
+		Tags:       []string{"foo:bar"},
+		MetricType: "gauge",
+		Hostname:   "globalstats",
+	},
+}
+
+func TestName(t *testing.T) {
+	plugin, err := NewWebhookPlugin(logrus.New(), "http://localhost", nil, "", http.DefaultClient, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "webhook", plugin.Name())
+}
+
+func TestBadTemplate(t *testing.T) {
+	_, err := NewWebhookPlugin(logrus.New(), "http://localhost", nil, "{{ .Hostname", http.DefaultClient, nil)
+	assert.Error(t, err)
+}
+
+func TestFlushDefaultJSON(t *testing.T) {
+	received := make(chan []samplers.DDMetric, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		assert.Equal(t, "secret", r.Header.Get("X-Api-Key"))
+		var metrics []samplers.DDMetric
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&metrics))
+		received <- metrics
+	}))
+	defer server.Close()
+
+	plugin, err := NewWebhookPlugin(logrus.New(), server.URL, map[string]string{"X-Api-Key": "secret"}, "", http.DefaultClient, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, plugin.Flush(testMetrics, "globalstats"))
+	assert.Equal(t, testMetrics, <-received)
+}
+
+func TestFlushTemplate(t *testing.T) {
+	received := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "text/plain", r.Header.Get("Content-Type"))
+		body, _ := ioutil.ReadAll(r.Body)
+		received <- string(body)
+	}))
+	defer server.Close()
+
+	tmpl := `{{ .Hostname }}{{ range .Metrics }} {{ .Name }}={{ index .Value 0 1 }} {{ json .Tags }}{{ end }}`
+	plugin, err := NewWebhookPlugin(logrus.New(), server.URL, map[string]string{"Content-Type": "text/plain"}, tmpl, http.DefaultClient, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, plugin.Flush(testMetrics, "globalstats"))
+	assert.Equal(t, `globalstats a.b.c=100 ["foo:bar"]`, <-received)
+}
+
+func TestFlushRetries(t *testing.T) {
+	// the handler runs on the server's goroutines
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	plugin, err := NewWebhookPlugin(logrus.New(), server.URL, nil, "", http.DefaultClient, nil)
+	assert.NoError(t, err)
+	plugin.Backoff = 0
+	assert.NoError(t, plugin.Flush(testMetrics, "globalstats"))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&attempts))
+
+	atomic.StoreInt32(&attempts, -10)
+	assert.Error(t, plugin.Flush(testMetrics, "globalstats"), "should give up after the configured attempts")
+	assert.Equal(t, int32(-7), atomic.LoadInt32(&attempts))
+}
@@ -43,6 +43,8 @@ type Proxy struct {
 	Statsd                 *statsd.Client
 
 	enableProfiling bool
+	// sent as a bearer token when forwarding to the global Veneurs, if set
+	forwardAuthToken string
 }
 
 func NewProxyFromConfig(conf ProxyConfig) (p Proxy, err error) {
@@ -76,6 +78,7 @@ func NewProxyFromConfig(conf ProxyConfig) (p Proxy, err error) {
 	p.Statsd.Namespace = "veneur_proxy."
 
 	p.enableProfiling = conf.EnableProfiling
+	p.forwardAuthToken = conf.ForwardAuthToken
 
 	p.ConsulForwardService = conf.ConsulForwardServiceName
 	p.ConsulTraceService = conf.ConsulTraceServiceName
@@ -171,7 +174,8 @@ func (p *Proxy) HTTPServe() {
 	})
 
 	// Ensure that the server responds to SIGUSR2 even
-	// when *not* running under einhorn.
+	// when *not* running under einhorn. The proxy has nothing to reload, so
+	// SIGHUP always restarts it, as it does veneur without reload_on_sighup.
 	graceful.AddSignal(syscall.SIGUSR2, syscall.SIGHUP)
 	graceful.HandleSignals()
 	log.WithField("address", p.HTTPAddr).Info("HTTP server listening")
@@ -260,7 +264,7 @@ func (p *Proxy) ProxyTraces(ctx context.Context, traces []DatadogTraceSpan) {
 			// this endpoint is not documented to take an array... but it does
 			// another curious constraint of this endpoint is that it does not
 			// support "Content-Encoding: deflate"
-			err = postHelper(span.Attach(ctx), p.HTTPClient, p.Statsd, endpoint, batch, "flush_traces", false)
+			err = postHelper(span.Attach(ctx), p.HTTPClient, p.Statsd, endpoint, batch, "flush_traces", encodingIdentity)
 
 			if err == nil {
 				log.WithFields(logrus.Fields{
@@ -325,7 +329,11 @@ func (p *Proxy) doPost(wg *sync.WaitGroup, destination string, batch []samplers.
 		return
 	}
 
-	err = postHelper(context.TODO(), p.HTTPClient, p.Statsd, endpoint, batch, "forward", true)
+	var headers http.Header
+	if p.forwardAuthToken != "" {
+		headers = http.Header{"Authorization": []string{"Bearer " + p.forwardAuthToken}}
+	}
+	err = postHelperWithHeaders(context.TODO(), p.HTTPClient, p.Statsd, endpoint, headers, batch, "forward", encodingDeflate)
 	if err == nil {
 		log.WithField("metrics", batchSize).Info("Completed forward to upstream Veneur")
 	} else {
@@ -18,8 +18,9 @@ import (
 // On the CI server, we can't be guaranteed that the port will be
 // released immediately after the server is shut down. Instead, use
 // a unique port for each test. As long as we don't have an insane number
-// of integration tests, we should be fine.
-var ProxyHTTPAddrPort = 8229
+// of integration tests, we should be fine. This range must not overlap the
+// ports handed out by HTTPAddrPort in server_test.go.
+var ProxyHTTPAddrPort = 9229
 
 func generateProxyConfig() ProxyConfig {
 	port := ProxyHTTPAddrPort
@@ -153,3 +154,31 @@ func TestConsistentForward(t *testing.T) {
 		assert.Fail(t, "Failed to receive all metrics before timeout")
 	}
 }
+
+func TestProxyForwardAuthToken(t *testing.T) {
+	authorization := make(chan string, 1)
+	global := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization <- r.Header.Get("Authorization")
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer global.Close()
+
+	proxyConfig := generateProxyConfig()
+	proxyConfig.ForwardAuthToken = "hunter2"
+	server, err := NewProxyFromConfig(proxyConfig)
+	assert.NoError(t, err)
+
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	server.doPost(&wg, global.URL, []samplers.JSONMetric{{
+		MetricKey: samplers.MetricKey{Name: "a.b.c", Type: "histogram"},
+	}})
+	wg.Wait()
+
+	select {
+	case got := <-authorization:
+		assert.Equal(t, "Bearer hunter2", got, "Proxy should forward with the bearer token")
+	case <-time.After(time.Second):
+		t.Fatal("Global Veneur did not receive the forward")
+	}
+}
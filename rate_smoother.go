@@ -0,0 +1,115 @@
+package veneur
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stripe/veneur/samplers"
+)
+
+// smoothedRateSuffix is appended to the name of a counter to name its
+// smoothed rate.
+const smoothedRateSuffix = ".rate_smoothed"
+
+// defaultSmoothedRateWindow is the sliding window used when
+// smoothed_rate_window is not set.
+const defaultSmoothedRateWindow = time.Minute
+
+// rateSmoother computes the rates of selected counters over a sliding window
+// of recent flushes, which is less noisy than the per-interval rate for
+// counters that only see a few events per interval.
+type rateSmoother struct {
+	window time.Duration
+	names  map[string]struct{}
+
+	mtx    sync.Mutex
+	series map[string]*smoothedSeries
+}
+
+// smoothedSeries holds the counts of one counter, ie one name and set of
+// tags, in the flushes that make up the window, oldest first.
+type smoothedSeries struct {
+	name      string
+	tags      []string
+	counts    []float64
+	durations []time.Duration
+	// the count recorded for the flush in progress
+	current float64
+}
+
+func newRateSmoother(names []string, window time.Duration) *rateSmoother {
+	r := &rateSmoother{
+		window: window,
+		names:  make(map[string]struct{}, len(names)),
+		series: make(map[string]*smoothedSeries),
+	}
+	for _, name := range names {
+		r.names[name] = struct{}{}
+	}
+	return r
+}
+
+// Smooths reports whether the counter with this name has a smoothed rate.
+func (r *rateSmoother) Smooths(name string) bool {
+	_, ok := r.names[name]
+	return ok
+}
+
+// Record adds the count of a counter in the flush in progress.
+func (r *rateSmoother) Record(name string, tags []string, count float64) {
+	key := name + "|" + strings.Join(tags, ",")
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	s, ok := r.series[key]
+	if !ok {
+		s = &smoothedSeries{name: name, tags: tags}
+		r.series[key] = s
+	}
+	s.current += count
+}
+
+// Flush completes a flush that covered interval, returning the smoothed rate
+// of every counter seen in the window. Counters that were not recorded in
+// this flush count as 0. Until a counter has been seen for a whole window,
+// its rate is over the time since it was first seen.
+func (r *rateSmoother) Flush(interval time.Duration) []samplers.DDMetric {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	now := float64(time.Now().Unix())
+	metrics := make([]samplers.DDMetric, 0, len(r.series))
+	for key, s := range r.series {
+		s.counts = append(s.counts, s.current)
+		s.durations = append(s.durations, interval)
+		s.current = 0
+
+		var total float64
+		var elapsed time.Duration
+		for i := len(s.counts) - 1; i >= 0; i-- {
+			if elapsed+s.durations[i] > r.window && elapsed > 0 {
+				// everything before this flush is outside the window
+				s.counts = s.counts[i+1:]
+				s.durations = s.durations[i+1:]
+				break
+			}
+			total += s.counts[i]
+			elapsed += s.durations[i]
+		}
+		if total == 0 {
+			// idle for the whole window, so stop tracking it
+			delete(r.series, key)
+			continue
+		}
+
+		tags := make([]string, len(s.tags))
+		copy(tags, s.tags)
+		metrics = append(metrics, samplers.DDMetric{
+			Name:       s.name + smoothedRateSuffix,
+			Value:      [1][2]float64{{now, total / elapsed.Seconds()}},
+			Tags:       tags,
+			MetricType: "gauge",
+		})
+	}
+	return metrics
+}
@@ -0,0 +1,74 @@
+package veneur
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stripe/veneur/samplers"
+)
+
+func TestRateSmoother(t *testing.T) {
+	r := newRateSmoother([]string{"a.b.c"}, 30*time.Second)
+	assert.True(t, r.Smooths("a.b.c"))
+	assert.False(t, r.Smooths("d.e.f"))
+
+	smoothed := func() float64 {
+		metrics := r.Flush(10 * time.Second)
+		if !assert.Len(t, metrics, 1) {
+			t.FailNow()
+		}
+		assert.Equal(t, "a.b.c.rate_smoothed", metrics[0].Name)
+		assert.Equal(t, []string{"foo:bar"}, metrics[0].Tags)
+		return metrics[0].Value[0][1]
+	}
+
+	// until the window is full, the rate is over the time seen so far
+	r.Record("a.b.c", []string{"foo:bar"}, 10)
+	assert.InEpsilon(t, 1.0, smoothed(), 1e-9)
+	r.Record("a.b.c", []string{"foo:bar"}, 20)
+	assert.InEpsilon(t, 1.5, smoothed(), 1e-9)
+	r.Record("a.b.c", []string{"foo:bar"}, 30)
+	assert.InEpsilon(t, 2.0, smoothed(), 1e-9)
+
+	// then the oldest interval slides out of the window
+	r.Record("a.b.c", []string{"foo:bar"}, 60)
+	assert.InEpsilon(t, (20.0+30+60)/30, smoothed(), 1e-9)
+
+	// intervals without any counts still count towards the window
+	assert.InEpsilon(t, (30.0+60)/30, smoothed(), 1e-9)
+	assert.InEpsilon(t, 60.0/30, smoothed(), 1e-9)
+
+	// and once the window is empty, the counter is forgotten
+	assert.Len(t, r.Flush(10*time.Second), 0)
+	assert.Len(t, r.series, 0)
+}
+
+func TestSmoothedRateCounters(t *testing.T) {
+	s := &Server{
+		interval:     10 * time.Second,
+		Workers:      []*Worker{NewWorker(1, nil, nil)},
+		rateSmoother: newRateSmoother([]string{"a.b.c"}, time.Minute),
+	}
+	flushed := func(count float64) map[string]float64 {
+		s.Workers[0].ProcessMetric(&samplers.UDPMetric{
+			MetricKey:  samplers.MetricKey{Name: "a.b.c", Type: "counter"},
+			Value:      count,
+			SampleRate: 1.0,
+		})
+		tempMetrics, ms := s.tallyMetrics(nil)
+		values := map[string]float64{}
+		for _, m := range s.generateDDMetrics(context.Background(), nil, tempMetrics, ms) {
+			values[m.Name] = m.Value[0][1]
+		}
+		return values
+	}
+
+	values := flushed(10)
+	assert.InEpsilon(t, 1.0, values["a.b.c"], 1e-9)
+	assert.InEpsilon(t, 1.0, values["a.b.c.rate_smoothed"], 1e-9)
+	values = flushed(30)
+	assert.InEpsilon(t, 3.0, values["a.b.c"], 1e-9, "the per-interval rate should be unchanged")
+	assert.InEpsilon(t, 2.0, values["a.b.c.rate_smoothed"], 1e-9)
+}
@@ -0,0 +1,212 @@
+package veneur
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/stripe/veneur/samplers"
+)
+
+// ReloadConfig applies the hot-reloadable parts of conf to the running
+// server: the flush interval, percentiles, tags and trace sample rate. Any
+// other changes are ignored, and a changed listener address is logged, since
+// it needs a restart. If any reloadable field is invalid, nothing changes.
+//
+// A new interval takes effect after the next flush, so that the rates of that
+// flush still cover the interval its data was collected over.
+func (s *Server) ReloadConfig(conf Config) error {
+	percentiles := conf.Percentiles
+	if percentiles == nil {
+		percentiles = samplers.DefaultPercentiles
+	}
+	if err := checkPercentiles(percentiles); err != nil {
+		return err
+	}
+	interval, err := conf.ParseInterval()
+	if err != nil {
+		return err
+	}
+	if interval <= 0 {
+		return fmt.Errorf("interval %v must be positive", interval)
+	}
+	if interval != s.flushInterval() {
+		if s.rollup != nil {
+			return fmt.Errorf("interval cannot be reloaded while rollup_interval is set")
+		}
+		if s.rateSmoother != nil && s.rateSmoother.window < interval {
+			return fmt.Errorf("smoothed_rate_window %v must be at least the interval %v", s.rateSmoother.window, interval)
+		}
+	}
+	if conf.TraceSampleRate != nil {
+		rate := *conf.TraceSampleRate
+		if rate < 0 || rate > 1 {
+			return fmt.Errorf("trace_sample_rate %v is outside [0, 1]", rate)
+		}
+		if s.spanSampler == nil {
+			log.Warn("trace_sample_rate cannot be enabled by reloading; restart Veneur to sample spans")
+		}
+	}
+
+	for _, option := range s.listenAddresses.changed(conf.listenAddresses()) {
+		log.WithField("option", option).Warn("Ignoring a changed listener address; restart Veneur to apply it")
+	}
+
+	s.configMtx.Lock()
+	s.histogramPercentiles = percentiles
+	s.tags = conf.Tags
+	if interval != s.interval {
+		s.pendingInterval = interval
+	} else {
+		s.pendingInterval = 0
+	}
+	s.configMtx.Unlock()
+
+	if s.spanSampler != nil {
+		rate := 1.0
+		if conf.TraceSampleRate != nil {
+			rate = *conf.TraceSampleRate
+		}
+		s.spanSampler.SetRate(rate)
+	}
+
+	log.WithFields(logrus.Fields{
+		"interval":    interval,
+		"percentiles": percentiles,
+		"tags":        conf.Tags,
+	}).Info("Reloaded config")
+	return nil
+}
+
+// reloadConfigFile reads ConfigFile again and reloads it.
+func (s *Server) reloadConfigFile() error {
+	if s.ConfigFile == "" {
+		return fmt.Errorf("no config file to reload")
+	}
+	conf, err := ReadConfig(s.ConfigFile)
+	if err != nil {
+		return err
+	}
+	return s.ReloadConfig(conf)
+}
+
+// reloadOnSignal reloads the config file and the metadata tags file, if
+// each is set, every time a signal arrives on sighup, until the server shuts
+// down.
+func (s *Server) reloadOnSignal(sighup chan os.Signal) {
+	defer func() {
+		ConsumePanic(s.Sentry, s.Statsd, s.Hostname, recover())
+	}()
+	for {
+		select {
+		case <-sighup:
+			if s.ConfigFile != "" {
+				if err := s.reloadConfigFile(); err != nil {
+					s.Statsd.Count("config.reload_error_total", 1, nil, 1.0)
+					log.WithError(err).Error("Could not reload the config, keeping the previous one")
+				}
+			}
+			if s.metadataTags != nil {
+				if err := s.metadataTags.Reload(); err != nil {
+					s.Statsd.Count("metadata_tags.reload_error_total", 1, nil, 1.0)
+					log.WithError(err).Error("Could not reload metadata tags, keeping the previous ones")
+					continue
+				}
+				log.WithField("path", s.metadataTags.path).Info("Reloaded metadata tags")
+			}
+		case <-s.shutdown:
+			signal.Stop(sighup)
+			return
+		}
+	}
+}
+
+// reloadsOnSignal reports whether SIGHUP reloads files instead of triggering
+// a graceful restart. That is only the case with reload_on_sighup, so that
+// SIGHUP keeps meaning the same thing to veneur and veneur-proxy unless it is
+// asked not to.
+func (s *Server) reloadsOnSignal() bool {
+	return s.reloadOnSighup
+}
+
+// flushInterval returns the interval that the current flush covers.
+func (s *Server) flushInterval() time.Duration {
+	s.configMtx.RLock()
+	defer s.configMtx.RUnlock()
+	return s.interval
+}
+
+// applyPendingInterval makes a reloaded interval take effect, and returns it.
+// It returns 0 if the interval has not been reloaded since the last call.
+func (s *Server) applyPendingInterval() time.Duration {
+	s.configMtx.Lock()
+	defer s.configMtx.Unlock()
+	interval := s.pendingInterval
+	if interval == 0 {
+		return 0
+	}
+	s.interval = interval
+	s.pendingInterval = 0
+	// the health check allows two intervals, as in NewFromConfig
+	s.health.SetMaxAge(2 * interval)
+	return interval
+}
+
+// HistogramPercentiles returns the percentiles that histograms and timers
+// flush. It's safe to call while the config is being reloaded.
+func (s *Server) HistogramPercentiles() []float64 {
+	s.configMtx.RLock()
+	defer s.configMtx.RUnlock()
+	return s.histogramPercentiles
+}
+
+// Tags returns the tags added to everything Veneur flushes. It's safe to
+// call while the config is being reloaded.
+func (s *Server) Tags() []string {
+	s.configMtx.RLock()
+	defer s.configMtx.RUnlock()
+	return s.tags
+}
+
+// checkPercentiles returns an error if any percentile is outside (0, 1).
+func checkPercentiles(percentiles []float64) error {
+	for _, p := range percentiles {
+		if !(p > 0 && p < 1) {
+			return fmt.Errorf("percentiles must be between 0 and 1, exclusive, got %v", p)
+		}
+	}
+	return nil
+}
+
+// listenerAddresses are the configured listener addresses, by option.
+type listenerAddresses map[string]string
+
+// listenAddresses returns every listener address in the config, by option.
+func (c Config) listenAddresses() listenerAddresses {
+	return listenerAddresses{
+		"udp_address":     c.UdpAddress,
+		"udp_addresses":   strings.Join(c.UdpAddresses, ","),
+		"tcp_address":     c.TcpAddress,
+		"ssf_tcp_address": c.SsfTcpAddress,
+		"socket_address":  c.SocketAddress,
+		"trace_address":   c.TraceAddress,
+		"http_address":    c.HTTPAddress,
+		"grpc_address":    c.GRPCAddress,
+	}
+}
+
+// changed returns the options, sorted, whose addresses differ in other.
+func (la listenerAddresses) changed(other listenerAddresses) []string {
+	var options []string
+	for option, address := range other {
+		if la[option] != address {
+			options = append(options, option)
+		}
+	}
+	sort.Strings(options)
+	return options
+}
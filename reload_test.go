@@ -0,0 +1,103 @@
+package veneur
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stripe/veneur/samplers"
+	"gopkg.in/yaml.v2"
+)
+
+func writeConfigFile(t *testing.T, path string, config Config) {
+	bts, err := yaml.Marshal(config)
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(path, bts, 0644))
+}
+
+// TestReloadPercentiles tests that percentiles reloaded over HTTP are used by
+// the next flush.
+func TestReloadPercentiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "veneur-reload")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "veneur.yaml")
+
+	config := globalConfig()
+	config.Percentiles = []float64{0.5}
+	f := newFixture(t, config)
+	defer f.Close()
+	f.server.ConfigFile = path
+
+	flushedNames := func() map[string]bool {
+		f.server.Workers[0].ProcessMetric(&samplers.UDPMetric{
+			MetricKey: samplers.MetricKey{
+				Name: "a.b.c",
+				Type: "histogram",
+			},
+			Value:      1.0,
+			Digest:     12345,
+			SampleRate: 1.0,
+			Scope:      samplers.MixedScope,
+		})
+		f.server.Flush()
+		names := map[string]bool{}
+		for _, metric := range (<-f.ddmetrics).Series {
+			names[metric.Name] = true
+		}
+		return names
+	}
+
+	names := flushedNames()
+	assert.True(t, names["a.b.c.50percentile"])
+	assert.False(t, names["a.b.c.90percentile"])
+
+	config.Percentiles = []float64{0.9}
+	writeConfigFile(t, path, config)
+	w := httptest.NewRecorder()
+	f.server.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/reload", nil))
+	assert.Equal(t, http.StatusOK, w.Code, "reload failed: %s", w.Body)
+
+	names = flushedNames()
+	assert.False(t, names["a.b.c.50percentile"], "the old percentiles should no longer be flushed")
+	assert.True(t, names["a.b.c.90percentile"], "the reloaded percentiles should be flushed")
+}
+
+func TestReloadConfig(t *testing.T) {
+	config := globalConfig()
+	config.Tags = []string{"env:test"}
+	s, err := NewFromConfig(config)
+	assert.NoError(t, err)
+
+	reloaded := config
+	reloaded.Percentiles = []float64{1.5}
+	reloaded.Tags = []string{"env:prod"}
+	assert.Error(t, s.ReloadConfig(reloaded), "an invalid percentile should fail the reload")
+	assert.Equal(t, []string{"env:test"}, s.Tags(), "a failed reload should change nothing")
+
+	reloaded = config
+	reloaded.Tags = []string{"env:prod"}
+	reloaded.UdpAddress = "127.0.0.1:1"
+	reloaded.Interval = "1m"
+	assert.NoError(t, s.ReloadConfig(reloaded), "a changed listener address should only be ignored")
+	assert.Equal(t, []string{"env:prod"}, s.Tags())
+
+	assert.Equal(t, DefaultFlushInterval, s.flushInterval(), "the interval should change after the next flush")
+	assert.Equal(t, time.Minute, s.applyPendingInterval())
+	assert.Equal(t, time.Minute, s.flushInterval())
+	assert.Equal(t, time.Duration(0), s.applyPendingInterval(), "the interval should only change once")
+}
+
+func TestReloadWithoutConfigFile(t *testing.T) {
+	s, err := NewFromConfig(globalConfig())
+	assert.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/reload", nil))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
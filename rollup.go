@@ -0,0 +1,209 @@
+package veneur
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/stripe/veneur/plugins"
+	"github.com/stripe/veneur/samplers"
+)
+
+// rollup re-aggregates the samplers of every flush into a coarser window, eg
+// 5 minutes for long-term storage, and flushes them to a single plugin at the
+// end of each window. Counters are summed, gauges keep their last value, and
+// the digests of histograms and timers and the registers of sets are merged.
+// Top-K counters aren't rolled up.
+type rollup struct {
+	interval time.Duration
+	sink     string
+	// the number of primary intervals in a window
+	intervals int
+
+	mtx sync.Mutex
+	wm  WorkerMetrics
+	// the number of primary intervals added to the current window
+	added int
+}
+
+// newRollup creates a rollup over windows of interval, which must be a
+// multiple of the primary interval, flushing to the plugin named sink.
+func newRollup(interval, primary time.Duration, sink string) (*rollup, error) {
+	if interval <= primary || interval%primary != 0 {
+		return nil, fmt.Errorf("rollup_interval %v must be a multiple of the interval %v", interval, primary)
+	}
+	if sink == "" {
+		return nil, fmt.Errorf("rollup_interval requires a rollup_sink")
+	}
+	return &rollup{
+		interval:  interval,
+		sink:      sink,
+		intervals: int(interval / primary),
+		wm:        NewWorkerMetrics(),
+	}, nil
+}
+
+// Add merges the samplers of one flush, which covered the given number of
+// primary intervals, into the current window. The samplers are copied, not
+// retained. It reports whether the window is complete, and should be flushed.
+func (r *rollup) Add(wms []WorkerMetrics, intervals int) bool {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	for _, wm := range wms {
+		for key, c := range wm.counters {
+			rollupCounter(r.wm.counters, key, c)
+		}
+		for key, c := range wm.globalCounters {
+			rollupCounter(r.wm.globalCounters, key, c)
+		}
+		for key, g := range wm.gauges {
+			rolled, ok := r.wm.gauges[key]
+			if !ok {
+				rolled = samplers.NewGauge(g.Name, g.Tags)
+				r.wm.gauges[key] = rolled
+			}
+			rolled.Merge(g)
+		}
+		for key, h := range wm.histograms {
+			rollupHisto(r.wm.histograms, key, h)
+		}
+		for key, h := range wm.timers {
+			rollupHisto(r.wm.timers, key, h)
+		}
+		for key, h := range wm.localHistograms {
+			rollupHisto(r.wm.localHistograms, key, h)
+		}
+		for key, h := range wm.localTimers {
+			rollupHisto(r.wm.localTimers, key, h)
+		}
+		for key, set := range wm.sets {
+			rollupSet(r.wm.sets, key, set)
+		}
+		for key, set := range wm.localSets {
+			rollupSet(r.wm.localSets, key, set)
+		}
+	}
+	r.added += intervals
+	return r.added >= r.intervals
+}
+
+func rollupCounter(rolled map[samplers.MetricKey]*samplers.Counter, key samplers.MetricKey, c *samplers.Counter) {
+	if _, ok := rolled[key]; !ok {
+		rolled[key] = samplers.NewCounter(c.Name, c.Tags)
+	}
+	rolled[key].Merge(c)
+}
+
+func rollupHisto(rolled map[samplers.MetricKey]*samplers.Histo, key samplers.MetricKey, h *samplers.Histo) {
+	if _, ok := rolled[key]; !ok {
+		rolled[key] = samplers.NewHistWithCompression(h.Name, h.Tags, h.Value.Compression())
+	}
+	rolled[key].Merge(h)
+}
+
+func rollupSet(rolled map[samplers.MetricKey]*samplers.Set, key samplers.MetricKey, set *samplers.Set) {
+	if _, ok := rolled[key]; !ok {
+		// the precision is valid, since set has it
+		rolled[key], _ = samplers.NewSetWithPrecision(set.Name, set.Tags, set.Precision())
+	}
+	if err := rolled[key].Merge(set); err != nil {
+		log.WithError(err).WithField("name", set.Name).Error("Could not roll up set")
+	}
+}
+
+// Flush generates metrics for the window, following the same rules as the
+// primary flush: forwarded histograms and timers only have their
+// percentiles, sets and global counters are only flushed at all by a global
+// Veneur, and suffix applies unit_suffixes. Rates are over the intervals
+// that were added, so a partial window, flushed at shutdown, has correct
+// rates too. It starts a new window, and returns nil if nothing was added.
+func (r *rollup) Flush(percentiles []float64, aggregates samplers.HistogramAggregates, isLocal bool, suffix func(metricType, name string, metrics []samplers.DDMetric) []samplers.DDMetric) []samplers.DDMetric {
+	r.mtx.Lock()
+	wm := r.wm
+	added := r.added
+	r.wm = NewWorkerMetrics()
+	r.added = 0
+	r.mtx.Unlock()
+	if added == 0 {
+		return nil
+	}
+	interval := time.Duration(added) * (r.interval / time.Duration(r.intervals))
+
+	var forwardedPercentiles []float64
+	if !isLocal {
+		forwardedPercentiles = percentiles
+	}
+	var metrics []samplers.DDMetric
+	for _, c := range wm.counters {
+		metrics = append(metrics, suffix("c", c.Name, c.Flush(interval))...)
+	}
+	for _, g := range wm.gauges {
+		metrics = append(metrics, suffix("g", g.Name, g.Flush())...)
+	}
+	for _, h := range wm.histograms {
+		metrics = append(metrics, suffix("h", h.Name, h.Flush(interval, forwardedPercentiles, aggregates))...)
+	}
+	for _, t := range wm.timers {
+		metrics = append(metrics, suffix("ms", t.Name, t.Flush(interval, forwardedPercentiles, aggregates))...)
+	}
+	for _, h := range wm.localHistograms {
+		metrics = append(metrics, suffix("h", h.Name, h.Flush(interval, percentiles, aggregates))...)
+	}
+	for _, t := range wm.localTimers {
+		metrics = append(metrics, suffix("ms", t.Name, t.Flush(interval, percentiles, aggregates))...)
+	}
+	for _, set := range wm.localSets {
+		metrics = append(metrics, suffix("s", set.Name, set.Flush())...)
+	}
+	if !isLocal {
+		for _, set := range wm.sets {
+			metrics = append(metrics, suffix("s", set.Name, set.Flush())...)
+		}
+		for _, c := range wm.globalCounters {
+			metrics = append(metrics, suffix("c", c.Name, c.Flush(interval))...)
+		}
+	}
+	return metrics
+}
+
+// flushRollup adds the samplers of a flush covering the given number of
+// intervals to the rollup, and flushes the rollup to its sink in the
+// background if its window is complete.
+func (s *Server) flushRollup(tempMetrics []WorkerMetrics, intervals int) {
+	if s.rollup.Add(tempMetrics, intervals) {
+		s.flushRollupWindow()
+	}
+}
+
+// flushRollupWindow flushes the rollup's window to its sink in the
+// background, whether or not it is complete.
+func (s *Server) flushRollupWindow() {
+	metrics := s.rollup.Flush(s.HistogramPercentiles(), s.HistogramAggregates, s.IsLocal(), s.suffixUnit)
+	if metrics == nil {
+		return
+	}
+	s.tagSanitizer.SanitizeTags(metrics)
+	finalizeMetrics(s.Hostname, s.Tags(), s.metadataTags, s.metricPrefix, metrics)
+
+	var sink plugins.Plugin
+	for _, p := range s.getPlugins() {
+		if p.Name() == s.rollup.sink {
+			sink = p
+		}
+	}
+	if sink == nil {
+		log.WithField("sink", s.rollup.sink).Error("Rollup sink doesn't exist, dropping the rollup")
+		return
+	}
+
+	metrics = metricsForSink(s.checkSinks(metrics), sink.Name())
+	metrics = s.transformValues(metrics, sink.Name())
+
+	done := s.sinkFlushStarted()
+	s.goFlush("rollup", func() {
+		defer done()
+		if err := s.flushPlugin(sink, metrics, nil, nil); err != nil {
+			log.WithError(err).WithField("sink", sink.Name()).Warn("Could not flush the rollup")
+		}
+	})
+}
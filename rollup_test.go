@@ -0,0 +1,167 @@
+package veneur
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stripe/veneur/samplers"
+)
+
+func TestRollup(t *testing.T) {
+	r, err := newRollup(30*time.Second, 10*time.Second, "archive")
+	assert.NoError(t, err)
+	s := &Server{
+		interval:             10 * time.Second,
+		Hostname:             "localhost",
+		Workers:              []*Worker{NewWorker(1, nil, nil)},
+		histogramPercentiles: []float64{0.5},
+		HistogramAggregates:  samplers.HistogramAggregates{Value: samplers.AggregateMax | samplers.AggregateCount, Count: 2},
+		rollup:               r,
+	}
+	rollups := make(chan []samplers.DDMetric, 1)
+	s.registerPlugin(&dummyPlugin{name: "archive", flush: func(metrics []samplers.DDMetric, hostname string) error {
+		rollups <- metrics
+		return nil
+	}})
+	primary := make(chan []samplers.DDMetric, 1)
+	s.registerPlugin(&dummyPlugin{name: "primary", flush: func(metrics []samplers.DDMetric, hostname string) error {
+		primary <- metrics
+		return nil
+	}})
+
+	process := func(name, typ string, value interface{}) {
+		s.Workers[0].ProcessMetric(&samplers.UDPMetric{
+			MetricKey:  samplers.MetricKey{Name: name, Type: typ},
+			Value:      value,
+			SampleRate: 1.0,
+			Scope:      samplers.MixedScope,
+		})
+	}
+	interval := func(i int, members ...string) {
+		process("a.counter", "counter", float64(10*i))
+		process("a.gauge", "gauge", float64(i))
+		for v := 10*i - 9; v <= 10*i; v++ {
+			process("a.histogram", "histogram", float64(v))
+		}
+		for _, member := range members {
+			process("a.set", "set", member)
+		}
+		// routed to the primary sink only, so it isn't rolled up
+		s.Workers[0].ProcessMetric(&samplers.UDPMetric{
+			MetricKey:  samplers.MetricKey{Name: "a.routed", Type: "gauge"},
+			Value:      1.0,
+			Tags:       []string{"_veneur_sink:primary"},
+			SampleRate: 1.0,
+			Scope:      samplers.MixedScope,
+		})
+		tempMetrics, ms := s.tallyMetrics(s.histogramPercentiles)
+		finalMetrics := s.generateDDMetrics(context.Background(), s.histogramPercentiles, tempMetrics, ms)
+		s.flushRollup(tempMetrics, 1)
+		assert.NoError(t, s.flushPlugins(finalMetrics, nil))
+		assert.NotEmpty(t, <-primary)
+	}
+
+	interval(1, "a", "b")
+	interval(2, "b", "c")
+	select {
+	case <-rollups:
+		t.Fatal("the rollup should not be flushed before its window is complete")
+	default:
+	}
+	interval(3, "d")
+
+	values := map[string]float64{}
+	for _, m := range <-rollups {
+		values[m.Name] = m.Value[0][1]
+		assert.Equal(t, "localhost", m.Hostname)
+	}
+	assert.Equal(t, 2.0, values["a.counter"], "60 counts over 30s")
+	assert.Equal(t, 3.0, values["a.gauge"], "the last gauge value")
+	assert.Equal(t, 30.0, values["a.histogram.max"])
+	assert.Equal(t, 1.0, values["a.histogram.count"], "30 samples over 30s")
+	assert.InDelta(t, 15.5, values["a.histogram.50percentile"], 1, "the median of all 30 samples")
+	assert.InDelta(t, 4, values["a.set"], 0.01, "4 distinct members")
+	assert.NotContains(t, values, "a.routed", "metrics routed to another sink should not be rolled up")
+	assert.Len(t, values, 6)
+
+	assert.Equal(t, 0, r.added, "a new window should have started")
+	assert.Len(t, r.wm.counters, 0)
+}
+
+// TestRollupPartialWindow tests that the part of a window flushed at
+// shutdown has rates over the intervals it covers, and that the rollup's
+// names get unit suffixes like the primary flush's.
+func TestRollupPartialWindow(t *testing.T) {
+	r, err := newRollup(30*time.Second, 10*time.Second, "archive")
+	assert.NoError(t, err)
+	s := &Server{
+		interval:            10 * time.Second,
+		Workers:             []*Worker{NewWorker(1, nil, nil)},
+		HistogramAggregates: samplers.HistogramAggregates{Value: samplers.AggregateMax, Count: 1},
+		unitSuffixes:        defaultUnitSuffixes,
+		rollup:              r,
+	}
+	rollups := make(chan []samplers.DDMetric, 1)
+	s.registerPlugin(&dummyPlugin{name: "archive", flush: func(metrics []samplers.DDMetric, hostname string) error {
+		rollups <- metrics
+		return nil
+	}})
+
+	s.Workers[0].ProcessMetric(&samplers.UDPMetric{
+		MetricKey:  samplers.MetricKey{Name: "a.counter", Type: "counter"},
+		Value:      20.0,
+		SampleRate: 1.0,
+		Scope:      samplers.MixedScope,
+	})
+	s.Workers[0].ProcessMetric(&samplers.UDPMetric{
+		MetricKey:  samplers.MetricKey{Name: "a.timer", Type: "timer"},
+		Value:      5.0,
+		SampleRate: 1.0,
+		Scope:      samplers.MixedScope,
+	})
+	tempMetrics, _ := s.tallyMetrics(nil)
+	s.flushRollup(tempMetrics, 1)
+	select {
+	case <-rollups:
+		t.Fatal("the rollup should not be flushed before its window is complete")
+	default:
+	}
+
+	s.flushRollupWindow()
+	values := map[string]float64{}
+	for _, m := range <-rollups {
+		values[m.Name] = m.Value[0][1]
+	}
+	assert.Equal(t, 2.0, values["a.counter"], "the rate should be over the one interval in the window")
+	assert.Equal(t, 5.0, values["a.timer.milliseconds.max"], "timers should get the default unit suffix")
+	assert.Len(t, values, 2)
+
+	s.flushRollupWindow()
+	select {
+	case <-rollups:
+		t.Fatal("an empty window should not be flushed")
+	default:
+	}
+}
+
+func TestRollupConfig(t *testing.T) {
+	_, err := newRollup(25*time.Second, 10*time.Second, "archive")
+	assert.Error(t, err, "the window must be a multiple of the interval")
+	_, err = newRollup(10*time.Second, 10*time.Second, "archive")
+	assert.Error(t, err, "the window must be longer than the interval")
+	_, err = newRollup(30*time.Second, 10*time.Second, "")
+	assert.Error(t, err, "a sink is required")
+
+	config := globalConfig()
+	config.RollupInterval = "5m"
+	config.RollupSink = "localfile"
+	_, err = NewFromConfig(config)
+	assert.Error(t, err, "the sink must be a configured plugin")
+
+	config.FlushFile = "/dev/null"
+	s, err := NewFromConfig(config)
+	assert.NoError(t, err)
+	assert.Equal(t, "localfile", s.rollup.sink)
+}
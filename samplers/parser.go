@@ -10,6 +10,8 @@ import (
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/stripe/veneur/ssf"
 )
 
 // UDPMetric is a representation of the sample provided by a client. The tag list
@@ -31,6 +33,42 @@ const (
 	GlobalOnly
 )
 
+// ErrEmptyName is returned for a metric whose name is empty or only
+// whitespace, which is never a valid name.
+var ErrEmptyName = errors.New("Invalid metric, name cannot be empty or whitespace")
+
+// ParseError is returned for a metric that can't be parsed. Its Reason
+// classifies what is wrong with it, for counting malformed metrics:
+//
+//   - missing_value: there is no value, or no colon before it
+//   - bad_value: the value is not a finite number
+//   - missing_type: there is no type, or no pipe before it
+//   - bad_type: the type is not one Veneur knows
+//   - bad_sample_rate: the sample rate is not a number in (0, 1], or there
+//     is more than one
+//   - malformed: anything else, like an unknown or empty section
+type ParseError struct {
+	Reason  string
+	Message string
+}
+
+func (e *ParseError) Error() string {
+	return e.Message
+}
+
+func parseError(reason, format string, args ...interface{}) error {
+	return &ParseError{Reason: reason, Message: fmt.Sprintf(format, args...)}
+}
+
+// ParseErrorReason returns the Reason of a ParseError, or "parse" for any
+// other error, such as one from ParseEvent.
+func ParseErrorReason(err error) string {
+	if pe, ok := err.(*ParseError); ok {
+		return pe.Reason
+	}
+	return "parse"
+}
+
 // MetricKey is a struct used to key the metrics into the worker's map. All fields must be comparable types.
 type MetricKey struct {
 	Name       string `json:"name"`
@@ -47,6 +85,105 @@ func (m *MetricKey) String() string {
 	return buff.String()
 }
 
+// TrimTags keeps only the first n of the metric's tags, which are sorted, and
+// updates its key and digest to match.
+func (m *UDPMetric) TrimTags(n int) {
+	if len(m.Tags) <= n {
+		return
+	}
+	m.Tags = m.Tags[:n]
+	m.JoinedTags = strings.Join(m.Tags, ",")
+	m.updateDigest()
+}
+
+// Rename changes the metric's name and updates its key and digest to match.
+func (m *UDPMetric) Rename(name string) {
+	m.Name = name
+	m.updateDigest()
+}
+
+// SetTags replaces the metric's tags, and updates its key and digest to
+// match.
+func (m *UDPMetric) SetTags(tags []string) {
+	sort.Strings(tags)
+	m.Tags = tags
+	m.JoinedTags = strings.Join(tags, ",")
+	m.updateDigest()
+}
+
+// dogStatsDTypes are the DogStatsD type codes of each metric type.
+var dogStatsDTypes = map[string]string{
+	"counter":      "c",
+	"gauge":        "g",
+	"histogram":    "h",
+	"distribution": "d",
+	"timer":        "ms",
+	"set":          "s",
+}
+
+// DogStatsD encodes the metric as a DogStatsD line, which ParseMetric
+// parses back into the same metric, including its scope. It's an error if
+// a part of the metric, eg a name from SSF, contains a character that would
+// change the line's meaning.
+func (m *UDPMetric) DogStatsD() ([]byte, error) {
+	typeCode, ok := dogStatsDTypes[m.Type]
+	if !ok {
+		return nil, fmt.Errorf("metric %q has type %q, which DogStatsD can't encode", m.Name, m.Type)
+	}
+	if strings.ContainsAny(m.Name, ":|\n") {
+		return nil, fmt.Errorf("metric name %q can't be encoded for DogStatsD", m.Name)
+	}
+	var value string
+	switch v := m.Value.(type) {
+	case float64:
+		value = strconv.FormatFloat(v, 'g', -1, 64)
+	case string:
+		value = v
+	default:
+		return nil, fmt.Errorf("metric %q has a value of type %T, which DogStatsD can't encode", m.Name, m.Value)
+	}
+	if strings.ContainsAny(value, "|\n") {
+		return nil, fmt.Errorf("value %q of metric %q can't be encoded for DogStatsD", value, m.Name)
+	}
+
+	line := bytes.NewBufferString(m.Name)
+	line.WriteByte(':')
+	line.WriteString(value)
+	line.WriteByte('|')
+	line.WriteString(typeCode)
+	if m.SampleRate != 1 {
+		line.WriteString("|@")
+		line.WriteString(strconv.FormatFloat(float64(m.SampleRate), 'g', -1, 32))
+	}
+	tags := m.Tags
+	switch m.Scope {
+	case LocalOnly:
+		tags = append(tags[:len(tags):len(tags)], "veneurlocalonly")
+	case GlobalOnly:
+		tags = append(tags[:len(tags):len(tags)], "veneurglobalonly")
+	}
+	for i, tag := range tags {
+		if strings.ContainsAny(tag, ",|\n") {
+			return nil, fmt.Errorf("tag %q of metric %q can't be encoded for DogStatsD", tag, m.Name)
+		}
+		if i == 0 {
+			line.WriteString("|#")
+		} else {
+			line.WriteByte(',')
+		}
+		line.WriteString(tag)
+	}
+	return line.Bytes(), nil
+}
+
+func (m *UDPMetric) updateDigest() {
+	h := fnv.New32a()
+	h.Write([]byte(m.Name))
+	h.Write([]byte(m.Type))
+	h.Write([]byte(m.JoinedTags))
+	m.Digest = h.Sum32()
+}
+
 // ParseMetric converts the incoming packet from Datadog DogStatsD
 // Datagram format in to a Metric. http://docs.datadoghq.com/guides/dogstatsd/#datagram-format
 func ParseMetric(packet []byte) (*UDPMetric, error) {
@@ -58,22 +195,22 @@ func ParseMetric(packet []byte) (*UDPMetric, error) {
 
 	startingColon := bytes.IndexByte(pipeSplitter.Chunk(), ':')
 	if startingColon == -1 {
-		return nil, errors.New("Invalid metric packet, need at least 1 colon")
+		return nil, parseError("missing_value", "Invalid metric packet, need at least 1 colon")
 	}
 	nameChunk := pipeSplitter.Chunk()[:startingColon]
 	valueChunk := pipeSplitter.Chunk()[startingColon+1:]
-	if len(nameChunk) == 0 {
-		return nil, errors.New("Invalid metric packet, name cannot be empty")
+	if len(bytes.TrimSpace(nameChunk)) == 0 {
+		return nil, ErrEmptyName
 	}
 
 	if !pipeSplitter.Next() {
-		return nil, errors.New("Invalid metric packet, need at least 1 pipe for type")
+		return nil, parseError("missing_type", "Invalid metric packet, need at least 1 pipe for type")
 	}
 	typeChunk := pipeSplitter.Chunk()
 	if len(typeChunk) == 0 {
 		// avoid panicking on malformed packets missing a type
 		// (eg "foo:1||")
-		return nil, errors.New("Invalid metric packet, metric type not specified")
+		return nil, parseError("missing_type", "Invalid metric packet, metric type not specified")
 	}
 
 	h := fnv.New32a()
@@ -88,12 +225,14 @@ func ParseMetric(packet []byte) (*UDPMetric, error) {
 		ret.Type = "gauge"
 	case 'h':
 		ret.Type = "histogram"
+	case 'd':
+		ret.Type = "distribution"
 	case 'm': // We can ignore the s in "ms"
 		ret.Type = "timer"
 	case 's':
 		ret.Type = "set"
 	default:
-		return nil, errors.New("Invalid type for metric")
+		return nil, parseError("bad_type", "Invalid type for metric")
 	}
 	// Add the type to the digest
 	h.Write([]byte(ret.Type))
@@ -102,9 +241,12 @@ func ParseMetric(packet []byte) (*UDPMetric, error) {
 	if ret.Type == "set" {
 		ret.Value = string(valueChunk)
 	} else {
+		if len(valueChunk) == 0 {
+			return nil, parseError("missing_value", "Invalid metric packet, metric value not specified")
+		}
 		v, err := strconv.ParseFloat(string(valueChunk), 64)
 		if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
-			return nil, fmt.Errorf("Invalid number for metric value: %s", valueChunk)
+			return nil, parseError("bad_value", "Invalid number for metric value: %s", valueChunk)
 		}
 		ret.Value = v
 	}
@@ -115,21 +257,21 @@ func ParseMetric(packet []byte) (*UDPMetric, error) {
 		if len(pipeSplitter.Chunk()) == 0 {
 			// avoid panicking on malformed packets that have too many pipes
 			// (eg "foo:1|g|" or "foo:1|c||@0.1")
-			return nil, errors.New("Invalid metric packet, empty string after/between pipes")
+			return nil, parseError("malformed", "Invalid metric packet, empty string after/between pipes")
 		}
 		switch pipeSplitter.Chunk()[0] {
 		case '@':
 			if foundSampleRate {
-				return nil, errors.New("Invalid metric packet, multiple sample rates specified")
+				return nil, parseError("bad_sample_rate", "Invalid metric packet, multiple sample rates specified")
 			}
 			// sample rate!
 			sr := string(pipeSplitter.Chunk()[1:])
 			sampleRate, err := strconv.ParseFloat(sr, 32)
 			if err != nil {
-				return nil, fmt.Errorf("Invalid float for sample rate: %s", sr)
+				return nil, parseError("bad_sample_rate", "Invalid float for sample rate: %s", sr)
 			}
 			if sampleRate <= 0 || sampleRate > 1 {
-				return nil, fmt.Errorf("Sample rate %f must be >0 and <=1", sampleRate)
+				return nil, parseError("bad_sample_rate", "Sample rate %f must be >0 and <=1", sampleRate)
 			}
 			ret.SampleRate = float32(sampleRate)
 			foundSampleRate = true
@@ -137,7 +279,7 @@ func ParseMetric(packet []byte) (*UDPMetric, error) {
 		case '#':
 			// tags!
 			if ret.Tags != nil {
-				return nil, errors.New("Invalid metric packet, multiple tag sections specified")
+				return nil, parseError("malformed", "Invalid metric packet, multiple tag sections specified")
 			}
 			tags := strings.Split(string(pipeSplitter.Chunk()[1:]), ",")
 			sort.Strings(tags)
@@ -163,8 +305,158 @@ func ParseMetric(packet []byte) (*UDPMetric, error) {
 			h.Write([]byte(ret.JoinedTags))
 
 		default:
-			return nil, fmt.Errorf("Invalid metric packet, contains unknown section %q", pipeSplitter.Chunk())
+			return nil, parseError("malformed", "Invalid metric packet, contains unknown section %q", pipeSplitter.Chunk())
+		}
+	}
+
+	ret.Digest = h.Sum32()
+
+	return ret, nil
+}
+
+// ParseMetricStatsD converts a plain StatsD line, name:value|type[|@rate],
+// into a Metric. It is more lenient than ParseMetric, to accept legacy
+// clients that never spoke DogStatsD:
+//
+//   - surrounding whitespace is ignored
+//   - the name ends at the last colon, so names may contain colons
+//   - empty and unknown sections, including DogStatsD tags, are ignored
+//
+// The resulting metric has no tags.
+func ParseMetricStatsD(packet []byte) (*UDPMetric, error) {
+	ret := &UDPMetric{
+		SampleRate: 1.0,
+	}
+	sections := bytes.Split(bytes.TrimSpace(packet), []byte{'|'})
+	if len(sections) < 2 {
+		return nil, parseError("missing_type", "Invalid StatsD metric, need at least 1 pipe for type")
+	}
+
+	colon := bytes.LastIndexByte(sections[0], ':')
+	if colon == -1 {
+		return nil, parseError("missing_value", "Invalid StatsD metric, need at least 1 colon")
+	}
+	nameChunk := bytes.TrimSpace(sections[0][:colon])
+	valueChunk := bytes.TrimSpace(sections[0][colon+1:])
+	if len(nameChunk) == 0 {
+		return nil, ErrEmptyName
+	}
+	ret.Name = string(nameChunk)
+
+	typeChunk := bytes.TrimSpace(sections[1])
+	if len(typeChunk) == 0 {
+		return nil, parseError("missing_type", "Invalid StatsD metric, metric type not specified")
+	}
+	switch typeChunk[0] {
+	case 'c':
+		ret.Type = "counter"
+	case 'g':
+		ret.Type = "gauge"
+	case 'h':
+		ret.Type = "histogram"
+	case 'm':
+		ret.Type = "timer"
+	case 's':
+		ret.Type = "set"
+	default:
+		return nil, parseError("bad_type", "Invalid type for metric")
+	}
+
+	if ret.Type == "set" {
+		ret.Value = string(valueChunk)
+	} else {
+		if len(valueChunk) == 0 {
+			return nil, parseError("missing_value", "Invalid metric packet, metric value not specified")
+		}
+		v, err := strconv.ParseFloat(string(valueChunk), 64)
+		if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+			return nil, parseError("bad_value", "Invalid number for metric value: %s", valueChunk)
+		}
+		ret.Value = v
+	}
+
+	for _, section := range sections[2:] {
+		section = bytes.TrimSpace(section)
+		if len(section) == 0 || section[0] != '@' {
+			continue
+		}
+		sampleRate, err := strconv.ParseFloat(string(section[1:]), 32)
+		if err != nil {
+			return nil, parseError("bad_sample_rate", "Invalid float for sample rate: %s", section[1:])
+		}
+		if sampleRate <= 0 || sampleRate > 1 {
+			return nil, parseError("bad_sample_rate", "Sample rate %f must be >0 and <=1", sampleRate)
+		}
+		ret.SampleRate = float32(sampleRate)
+	}
+
+	ret.updateDigest()
+	return ret, nil
+}
+
+// ParseMetricSSF converts an SSF sample into a Metric. COUNTER, GAUGE and
+// HISTOGRAM samples use the Value field, and SET samples use the Message.
+func ParseMetricSSF(sample *ssf.SSFSample) (*UDPMetric, error) {
+	ret := &UDPMetric{
+		SampleRate: 1.0,
+	}
+	if strings.TrimSpace(sample.Name) == "" {
+		return nil, ErrEmptyName
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(sample.Name))
+	ret.Name = sample.Name
+
+	switch sample.Metric {
+	case ssf.SSFSample_COUNTER:
+		ret.Type = "counter"
+	case ssf.SSFSample_GAUGE:
+		ret.Type = "gauge"
+	case ssf.SSFSample_HISTOGRAM:
+		ret.Type = "histogram"
+	case ssf.SSFSample_SET:
+		ret.Type = "set"
+	default:
+		return nil, parseError("bad_type", "Invalid type for SSF metric: %s", sample.Metric)
+	}
+	h.Write([]byte(ret.Type))
+
+	if ret.Type == "set" {
+		ret.Value = sample.Message
+	} else {
+		v := float64(sample.Value)
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return nil, parseError("bad_value", "Invalid number for SSF metric value: %f", v)
+		}
+		ret.Value = v
+	}
+
+	if sample.SampleRate != 0 {
+		if sample.SampleRate < 0 || sample.SampleRate > 1 {
+			return nil, parseError("bad_sample_rate", "Sample rate %f must be >0 and <=1", sample.SampleRate)
+		}
+		ret.SampleRate = sample.SampleRate
+	}
+
+	if len(sample.Tags) > 0 {
+		tags := make([]string, 0, len(sample.Tags))
+		for _, tag := range sample.Tags {
+			switch {
+			case tag.Name == "veneurlocalonly" && tag.Value == "":
+				ret.Scope = LocalOnly
+			case tag.Name == "veneurglobalonly" && tag.Value == "":
+				ret.Scope = GlobalOnly
+			case tag.Value == "":
+				tags = append(tags, tag.Name)
+			default:
+				tags = append(tags, tag.Name+":"+tag.Value)
+			}
 		}
+		sort.Strings(tags)
+		ret.Tags = tags
+		ret.JoinedTags = strings.Join(tags, ",")
+		h.Write([]byte(ret.JoinedTags))
 	}
 
 	ret.Digest = h.Sum32()
@@ -3,9 +3,12 @@ package samplers
 import (
 	"bytes"
 	"encoding/binary"
+	"encoding/json"
 	"fmt"
 	"hash/fnv"
 	"math"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
@@ -23,6 +26,99 @@ type DDMetric struct {
 	Hostname   string        `json:"host,omitempty"`
 	DeviceName string        `json:"device_name,omitempty"`
 	Interval   int32         `json:"interval,omitempty"`
+	// Sinks restricts the metric to the named sinks, if set. It comes from
+	// the metric's _veneur_sink tags, and is never sent anywhere.
+	Sinks []string `json:"-"`
+}
+
+// DDDistribution is a point for the Datadog distribution intake, which
+// computes percentiles from the raw values across all hosts.
+type DDDistribution struct {
+	Name     string                 `json:"metric"`
+	Points   [1]DDDistributionPoint `json:"points"`
+	Tags     []string               `json:"tags,omitempty"`
+	Hostname string                 `json:"host,omitempty"`
+	// Sinks restricts the distribution to the named sinks, like
+	// DDMetric.Sinks.
+	Sinks []string `json:"-"`
+}
+
+// DDDistributionPoint is a timestamp and the values observed at that time,
+// which marshals as [timestamp, [values...]]. Each value stands for the
+// number of samples in Weights at the same index, or one sample if Weights is
+// nil, so that sampled values aren't copied until they are sent.
+type DDDistributionPoint struct {
+	Timestamp float64
+	Values    []float64
+	Weights   []float64
+}
+
+// MaxDistributionValues is the most values that Expand repeats weighted
+// values into, unless there are more distinct values than that.
+const MaxDistributionValues = 10000
+
+// Count returns the number of samples the point stands for.
+func (p DDDistributionPoint) Count() float64 {
+	if p.Weights == nil {
+		return float64(len(p.Values))
+	}
+	var count float64
+	for _, w := range p.Weights {
+		count += w
+	}
+	return count
+}
+
+// Expand returns the point's values, each repeated once per unit of its
+// weight, for the distribution intake, which has no notion of weight. If
+// that would be more than MaxDistributionValues, the weights are scaled
+// down so that it isn't, which keeps the shape of the distribution but not
+// its count.
+func (p DDDistributionPoint) Expand() []float64 {
+	if p.Weights == nil {
+		return p.Values
+	}
+	limit := float64(MaxDistributionValues)
+	if float64(len(p.Values)) > limit {
+		limit = float64(len(p.Values))
+	}
+	scale := 1.0
+	if count := p.Count(); count > limit {
+		scale = limit / count
+	}
+	values := make([]float64, 0, int(math.Min(p.Count()*scale, limit)+0.5))
+	// the running total is rounded rather than each weight, since sampled
+	// values have fractional weights, eg 3.33 at a rate of 0.3, which would
+	// otherwise be lost from every small centroid
+	var weightSoFar float64
+	for i, value := range p.Values {
+		weightSoFar += p.Weights[i] * scale
+		for n := int(weightSoFar+0.5) - len(values); n > 0; n-- {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// MarshalJSON renders the point in the form the distribution intake expects.
+func (p DDDistributionPoint) MarshalJSON() ([]byte, error) {
+	return json.Marshal([2]interface{}{p.Timestamp, p.Expand()})
+}
+
+// DDSummary is the percentiles of a histogram as a single metric, for sinks
+// with a native summary type.
+type DDSummary struct {
+	Name      string
+	Timestamp float64
+	Quantiles []SummaryQuantile
+	Tags      []string
+	Hostname  string
+}
+
+// SummaryQuantile is the value of a histogram at one quantile, eg 0.99.
+type SummaryQuantile struct {
+	Quantile float64
+	Value    float64
 }
 
 type Aggregate int
@@ -50,6 +146,28 @@ type HistogramAggregates struct {
 	Count int
 }
 
+// DefaultAggregates are flushed for histograms and timers when no
+// aggregates are configured.
+var DefaultAggregates = []string{"min", "max", "count"}
+
+// ParseAggregates converts the names of aggregates, as in AggregatesLookup,
+// to a HistogramAggregates. Repeated names are only counted once.
+func ParseAggregates(names []string) (HistogramAggregates, error) {
+	var ha HistogramAggregates
+	for _, name := range names {
+		agg, ok := AggregatesLookup[name]
+		if !ok {
+			return HistogramAggregates{}, fmt.Errorf("unknown aggregate %q, must be one of min, max, median, avg, count or sum", name)
+		}
+		if ha.Value&agg != 0 {
+			continue
+		}
+		ha.Value |= agg
+		ha.Count++
+	}
+	return ha, nil
+}
+
 var aggregates = [...]string{
 	AggregateMin:     "min",
 	AggregateMax:     "max",
@@ -59,6 +177,39 @@ var aggregates = [...]string{
 	AggregateSum:     "sum",
 }
 
+// DefaultPercentiles are the percentiles flushed for histograms and timers
+// when none are configured.
+var DefaultPercentiles = []float64{0.5, 0.9, 0.95, 0.99}
+
+// percentileSuffix matches the suffix of a percentile gauge, eg ".99percentile"
+// or ".99_9percentile".
+var percentileSuffix = regexp.MustCompile(`\.(\d+(?:_\d+)?)percentile$`)
+
+// PercentileName returns the name of the gauge for quantile p of the
+// histogram name, eg "a.b.c.99percentile" for 0.99. Fractional percents are
+// written with an underscore, eg "a.b.c.99_9percentile" for 0.999.
+func PercentileName(name string, p float64) string {
+	// round off the error in p*100, eg 0.29*100 = 28.999999999999996
+	percent := math.Floor(p*100*1e4+0.5) / 1e4
+	suffix := strings.Replace(strconv.FormatFloat(percent, 'f', -1, 64), ".", "_", 1)
+	return name + "." + suffix + "percentile"
+}
+
+// ParsePercentileName reverses PercentileName, returning the histogram's name
+// and the quantile. ok is false if name isn't a percentile gauge's.
+func ParsePercentileName(name string) (histogram string, quantile float64, ok bool) {
+	match := percentileSuffix.FindStringSubmatch(name)
+	if match == nil || len(match[0]) == len(name) {
+		return "", 0, false
+	}
+	percent, err := strconv.ParseFloat(strings.Replace(match[1], "_", ".", 1), 64)
+	if err != nil {
+		return "", 0, false
+	}
+	// round off the error in percent/100, eg 99.9/100 = 0.9990000000000001
+	return name[:len(name)-len(match[0])], math.Floor(percent/100*1e6+0.5) / 1e6, true
+}
+
 // JSONMetric is used to represent a metric that can be remarshaled with its
 // internal state intact. It is used to send metrics from one Veneur to another.
 type JSONMetric struct {
@@ -67,6 +218,9 @@ type JSONMetric struct {
 	// the Value is an internal representation of the metric's contents, eg a
 	// gob-encoded histogram or hyperloglog.
 	Value []byte `json:"value"`
+	// the Unix time at which the sending Veneur flushed the metric, or 0 if
+	// it is unknown
+	Timestamp int64 `json:"timestamp,omitempty"`
 }
 
 // Counter is an accumulator
@@ -94,6 +248,20 @@ func (c *Counter) Flush(interval time.Duration) []DDMetric {
 	}}
 }
 
+// FlushCount generates a DDMetric named "<name>.count" with the raw count
+// accumulated by this Counter, rather than its rate.
+func (c *Counter) FlushCount(interval time.Duration) DDMetric {
+	tags := make([]string, len(c.Tags))
+	copy(tags, c.Tags)
+	return DDMetric{
+		Name:       c.Name + ".count",
+		Value:      [1][2]float64{{float64(time.Now().Unix()), float64(c.value)}},
+		Tags:       tags,
+		MetricType: "count",
+		Interval:   int32(interval.Seconds()),
+	}
+}
+
 // Export converts a Counter into a JSONMetric which reports the rate.
 func (c *Counter) Export() (JSONMetric, error) {
 	buf := new(bytes.Buffer)
@@ -129,6 +297,11 @@ func (c *Counter) Combine(other []byte) error {
 	return nil
 }
 
+// Merge adds the counts of another counter to this one.
+func (c *Counter) Merge(other *Counter) {
+	c.value += other.value
+}
+
 // NewCounter generates and returns a new Counter.
 func NewCounter(Name string, Tags []string) *Counter {
 	return &Counter{Name: Name, Tags: Tags}
@@ -146,6 +319,12 @@ func (g *Gauge) Sample(sample float64, sampleRate float32) {
 	g.value = sample
 }
 
+// Merge takes on the value of another gauge, which must be the later of the
+// two.
+func (g *Gauge) Merge(other *Gauge) {
+	g.value = other.value
+}
+
 // Flush generates a DDMetric from the current state of this gauge.
 func (g *Gauge) Flush() []DDMetric {
 	tags := make([]string, len(g.Tags))
@@ -163,11 +342,18 @@ func NewGauge(Name string, Tags []string) *Gauge {
 	return &Gauge{Name: Name, Tags: Tags}
 }
 
-// Set is a list of unique values seen.
+// Set is a list of unique values seen. Small sets are kept in the
+// HyperLogLog's sparse representation, which is close to exact. When one
+// grows past the sparse limit, even in the middle of an interval, the sparse
+// entries are folded into the dense registers, so the estimate continues
+// from every value seen so far.
 type Set struct {
 	Name string
 	Tags []string
 	Hll  *hyperloglog.HyperLogLogPlus
+
+	// the HyperLogLog's precision, which it doesn't expose
+	precision uint8
 }
 
 // Sample checks if the supplied value has is already in the filter. If not, it increments
@@ -175,19 +361,70 @@ type Set struct {
 func (s *Set) Sample(sample string, sampleRate float32) {
 	hasher := fnv.New64a()
 	hasher.Write([]byte(sample))
-	s.Hll.Add(hasher)
+	s.Hll.Add(mixedHash(hasher.Sum64()))
 }
 
-// NewSet generates a new Set and returns it
+// mixedHash scrambles an FNV-1a hash with MurmurHash3's 64-bit finalizer.
+// The high bits of FNV-1a barely vary between short, similar inputs like
+// sequential IDs, and the dense HyperLogLog picks registers by the high
+// bits, so without this such a set's estimate collapses when it switches
+// from the sparse representation.
+type mixedHash uint64
+
+func (h mixedHash) Sum64() uint64 {
+	x := uint64(h)
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// DefaultSetPrecision is the precision of the HyperLogLogs that back sets
+// created by NewSet. It is the maximum, for a standard error of about 0.2%.
+const DefaultSetPrecision = 18
+
+// MinSetPrecision is the lowest precision a set can have.
+const MinSetPrecision = 4
+
+// SetDenseBytes is the size of a set's HyperLogLog registers once it
+// switches to the dense representation, at the default precision.
+const SetDenseBytes = 1 << DefaultSetPrecision
+
+// NewSet generates a new Set with the default precision and returns it
 func NewSet(Name string, Tags []string) *Set {
 	// error is only returned if precision is outside the 4-18 range
-	// TODO: this is the maximum precision, should it be configurable?
-	Hll, _ := hyperloglog.NewPlus(18)
-	return &Set{
-		Name: Name,
-		Tags: Tags,
-		Hll:  Hll,
+	s, _ := NewSetWithPrecision(Name, Tags, DefaultSetPrecision)
+	return s
+}
+
+// NewSetWithPrecision generates a new Set whose HyperLogLog has 2^precision
+// registers, for a standard error of about 1.04/sqrt(2^precision). The
+// precision must be between MinSetPrecision and DefaultSetPrecision. Sets
+// can only be merged with sets of the same precision.
+func NewSetWithPrecision(Name string, Tags []string, precision uint8) (*Set, error) {
+	Hll, err := hyperloglog.NewPlus(precision)
+	if err != nil {
+		return nil, err
 	}
+	return &Set{
+		Name:      Name,
+		Tags:      Tags,
+		Hll:       Hll,
+		precision: precision,
+	}, nil
+}
+
+// Precision returns the precision of the set's HyperLogLog.
+func (s *Set) Precision() uint8 {
+	return s.precision
+}
+
+// DenseBytes is the size of the set's HyperLogLog registers once it switches
+// to the dense representation.
+func (s *Set) DenseBytes() int64 {
+	return 1 << s.precision
 }
 
 // Flush generates a DDMetric for the state of this Set.
@@ -221,19 +458,24 @@ func (s *Set) Export() (JSONMetric, error) {
 
 // Combine merges the values seen with another set (marshalled as a byte slice)
 func (s *Set) Combine(other []byte) error {
-	otherHLL, _ := hyperloglog.NewPlus(18)
+	otherHLL, _ := hyperloglog.NewPlus(DefaultSetPrecision)
 	if err := otherHLL.GobDecode(other); err != nil {
 		return err
 	}
 	if err := s.Hll.Merge(otherHLL); err != nil {
-		// does not error unless compressions are different
-		// however, decoding the other Hll causes us to use its compression
-		// parameter, which might be different from ours
-		return err
+		// does not error unless precisions are different
+		// however, decoding the other Hll causes us to use its precision,
+		// which might be different from ours
+		return fmt.Errorf("could not merge set %s with precision %d: %v", s.Name, s.precision, err)
 	}
 	return nil
 }
 
+// Merge adds the values seen by another set to this one.
+func (s *Set) Merge(other *Set) error {
+	return s.Hll.Merge(other.Hll)
+}
+
 // Histo is a collection of values that generates max, min, count, and
 // percentiles over time.
 type Histo struct {
@@ -262,13 +504,25 @@ func (h *Histo) Sample(sample float64, sampleRate float32) {
 	h.LocalSum += sample * weight
 }
 
-// NewHist generates a new Histo and returns it.
+// DefaultHistogramCompression is the t-digest compression used by NewHist.
+// We're going to allocate a lot of histograms, so we don't want them to be
+// huge.
+const DefaultHistogramCompression = 100
+
+// NewHist generates a new Histo with the default compression and returns it.
 func NewHist(Name string, Tags []string) *Histo {
+	return NewHistWithCompression(Name, Tags, DefaultHistogramCompression)
+}
+
+// NewHistWithCompression generates a new Histo whose t-digest has the given
+// compression. A digest keeps about pi*compression/2 centroids however many
+// samples it gets, so higher compressions give more accurate percentiles,
+// especially in the tails, for more memory.
+func NewHistWithCompression(Name string, Tags []string, compression float64) *Histo {
 	return &Histo{
-		Name: Name,
-		Tags: Tags,
-		// we're going to allocate a lot of these, so we don't want them to be huge
-		Value:    tdigest.NewMerging(100, false),
+		Name:     Name,
+		Tags:     Tags,
+		Value:    tdigest.NewMerging(compression, false),
 		LocalMin: math.Inf(+1),
 		LocalMax: math.Inf(-1),
 		LocalSum: 0,
@@ -363,9 +617,8 @@ func (h *Histo) Flush(interval time.Duration, percentiles []float64, aggregates
 		copy(tags, h.Tags)
 		metrics = append(
 			metrics,
-			// TODO Fix to allow for p999, etc
 			DDMetric{
-				Name:       fmt.Sprintf("%s.%dpercentile", h.Name, int(p*100)),
+				Name:       PercentileName(h.Name, p),
 				Value:      [1][2]float64{{now, h.Value.Quantile(p)}},
 				Tags:       tags,
 				MetricType: "gauge",
@@ -376,6 +629,73 @@ func (h *Histo) Flush(interval time.Duration, percentiles []float64, aggregates
 	return metrics
 }
 
+// FlushDistribution reconstructs the values in the histogram's t-digest for
+// the Datadog distribution intake. Each centroid contributes its mean,
+// weighted by the number of samples it stands for, scaled by their sample
+// rates, including those merged from other veneur instances.
+func (h *Histo) FlushDistribution() DDDistribution {
+	var values, weights []float64
+	h.Value.ForEachCentroid(func(mean, weight float64) bool {
+		values = append(values, mean)
+		weights = append(weights, weight)
+		return true
+	})
+	tags := make([]string, len(h.Tags))
+	copy(tags, h.Tags)
+	return DDDistribution{
+		Name:   h.Name,
+		Points: [1]DDDistributionPoint{{Timestamp: float64(time.Now().Unix()), Values: values, Weights: weights}},
+		Tags:   tags,
+	}
+}
+
+// Distribution keeps every value it samples, for the Datadog distribution
+// intake, which computes percentiles across every host that reports it.
+// Since that is already global, distributions are never forwarded.
+type Distribution struct {
+	Name   string
+	Tags   []string
+	Values []float64
+	// the weight of each of Values, or nil while every weight is 1
+	Weights []float64
+}
+
+// NewDistribution generates a new Distribution and returns it.
+func NewDistribution(Name string, Tags []string) *Distribution {
+	return &Distribution{
+		Name: Name,
+		Tags: Tags,
+	}
+}
+
+// Sample adds the supplied value to the distribution, weighted by its sample
+// rate, eg 10 at a sample rate of 0.1.
+func (d *Distribution) Sample(sample float64, sampleRate float32) {
+	weight := float64(1 / sampleRate)
+	if d.Weights == nil && weight != 1 {
+		// the values so far were unsampled
+		d.Weights = make([]float64, len(d.Values), cap(d.Values))
+		for i := range d.Weights {
+			d.Weights[i] = 1
+		}
+	}
+	d.Values = append(d.Values, sample)
+	if d.Weights != nil {
+		d.Weights = append(d.Weights, weight)
+	}
+}
+
+// Flush generates a DDDistribution of the values sampled so far.
+func (d *Distribution) Flush() DDDistribution {
+	tags := make([]string, len(d.Tags))
+	copy(tags, d.Tags)
+	return DDDistribution{
+		Name:   d.Name,
+		Points: [1]DDDistributionPoint{{Timestamp: float64(time.Now().Unix()), Values: d.Values, Weights: d.Weights}},
+		Tags:   tags,
+	}
+}
+
 // Export converts a Histogram into a JSONMetric
 func (h *Histo) Export() (JSONMetric, error) {
 	val, err := h.Value.GobEncode()
@@ -396,10 +716,21 @@ func (h *Histo) Export() (JSONMetric, error) {
 // Combine merges the values of a histogram with another histogram
 // (marshalled as a byte slice)
 func (h *Histo) Combine(other []byte) error {
-	otherHistogram := tdigest.NewMerging(100, false)
+	// the compression is replaced by the encoded one
+	otherHistogram := tdigest.NewMerging(DefaultHistogramCompression, false)
 	if err := otherHistogram.GobDecode(other); err != nil {
 		return err
 	}
 	h.Value.Merge(otherHistogram)
 	return nil
 }
+
+// Merge adds the values of another histogram to this one, including its
+// local aggregates.
+func (h *Histo) Merge(other *Histo) {
+	h.Value.Merge(other.Value)
+	h.LocalWeight += other.LocalWeight
+	h.LocalMin = math.Min(h.LocalMin, other.LocalMin)
+	h.LocalMax = math.Max(h.LocalMax, other.LocalMax)
+	h.LocalSum += other.LocalSum
+}
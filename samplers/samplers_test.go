@@ -1,8 +1,10 @@
 package samplers
 
 import (
+	"fmt"
 	"math"
 	"math/rand"
+	"sort"
 	"strconv"
 	"testing"
 	"time"
@@ -42,6 +44,20 @@ func TestCounterRate(t *testing.T) {
 	assert.Equal(t, 0.5, metrics[0].Value[0][1], "Metric value")
 }
 
+func TestCounterFlushCount(t *testing.T) {
+
+	c := NewCounter("a.b.c", []string{"a:b"})
+
+	c.Sample(5, 0.5)
+
+	m := c.FlushCount(10 * time.Second)
+	assert.Equal(t, "a.b.c.count", m.Name, "Name")
+	assert.Equal(t, "count", m.MetricType, "Type")
+	assert.Equal(t, int32(10), m.Interval, "Interval")
+	assert.Equal(t, []string{"a:b"}, m.Tags, "Tags")
+	assert.Equal(t, float64(10), m.Value[0][1], "Metric value")
+}
+
 func TestCounterSampleRate(t *testing.T) {
 
 	c := NewCounter("a.b.c", []string{"a:b"})
@@ -132,6 +148,73 @@ func TestSet(t *testing.T) {
 	assert.Equal(t, float64(4), m1.Value[0][1], "Value")
 }
 
+// TestSetDenseTransition tests that a set's estimate stays consistent with
+// all the values it has seen when it switches from the sparse to the dense
+// representation in the middle of an interval.
+func TestSetDenseTransition(t *testing.T) {
+	s := NewSet("a.b.c", nil)
+	sparseBytes := 0
+	for i := 1; i <= 300000; i++ {
+		s.Sample(strconv.Itoa(i), 1.0)
+		if i%10000 != 0 {
+			continue
+		}
+		count := float64(s.Hll.Count())
+		assert.InEpsilon(t, float64(i), count, 0.02, "estimate after %d values was %v", i, count)
+
+		encoded, err := s.Hll.GobEncode()
+		assert.NoError(t, err)
+		if len(encoded) < SetDenseBytes {
+			sparseBytes = len(encoded)
+		}
+	}
+	assert.NotZero(t, sparseBytes, "the set should have started sparse")
+	encoded, err := s.Hll.GobEncode()
+	assert.NoError(t, err)
+	assert.True(t, len(encoded) >= SetDenseBytes, "the set should have switched to the dense representation")
+}
+
+// TestSetPrecisionAccuracy tests that a set's estimate of 100k distinct
+// values is within three standard errors of the HyperLogLog, at several
+// precisions, both alone and merged from sets of overlapping values.
+func TestSetPrecisionAccuracy(t *testing.T) {
+	const n = 100000
+	for _, precision := range []uint8{10, 14, DefaultSetPrecision} {
+		bound := 3 * 1.04 / math.Sqrt(float64(uint64(1)<<precision))
+
+		s, err := NewSetWithPrecision("a.b.c", nil, precision)
+		if !assert.NoError(t, err) {
+			continue
+		}
+		assert.Equal(t, precision, s.Precision())
+		for i := 0; i < n; i++ {
+			s.Sample("user-"+strconv.Itoa(i), 1.0)
+		}
+		assert.InEpsilon(t, n, float64(s.Flush()[0].Value[0][1]), bound, "estimate at precision %d", precision)
+
+		// two workers that saw overlapping halves
+		s1, _ := NewSetWithPrecision("a.b.c", nil, precision)
+		s2, _ := NewSetWithPrecision("a.b.c", nil, precision)
+		for i := 0; i < n*3/5; i++ {
+			s1.Sample("user-"+strconv.Itoa(i), 1.0)
+			s2.Sample("user-"+strconv.Itoa(n-1-i), 1.0)
+		}
+		assert.NoError(t, s1.Merge(s2))
+		assert.InEpsilon(t, n, float64(s1.Hll.Count()), bound, "merged estimate at precision %d", precision)
+	}
+}
+
+func TestSetPrecisionMismatch(t *testing.T) {
+	_, err := NewSetWithPrecision("a.b.c", nil, DefaultSetPrecision+1)
+	assert.Error(t, err)
+
+	s, _ := NewSetWithPrecision("a.b.c", nil, 12)
+	s.Sample("foo", 1.0)
+	jm, err := s.Export()
+	assert.NoError(t, err)
+	assert.Error(t, NewSet("a.b.c", nil).Combine(jm.Value), "sets of different precisions should not merge")
+}
+
 func TestSetMerge(t *testing.T) {
 	rand.Seed(time.Now().Unix())
 
@@ -283,6 +366,170 @@ func TestHistoSampleRate(t *testing.T) {
 	assert.Equal(t, float64(1), count.Value[0][1], "count value")
 }
 
+// TestHistoSampleRateWeights tests that sampled values are weighted by their
+// sample rate in the percentiles, not just the count.
+func TestHistoSampleRateWeights(t *testing.T) {
+	h := NewHist("a.b.c", nil)
+	// values are uniform over [0, 1000), but only a tenth of those over 500
+	// are sent, at a sample rate of 0.1
+	for i := 0; i < 1000; i++ {
+		if i < 500 {
+			h.Sample(float64(i), 1)
+		} else if i%10 == 0 {
+			h.Sample(float64(i), 0.1)
+		}
+	}
+
+	aggregates := HistogramAggregates{Value: AggregateCount, Count: 1}
+	metrics := h.Flush(10*time.Second, []float64{0.5, 0.9}, aggregates)
+	assert.Len(t, metrics, 3)
+	assert.Equal(t, "a.b.c.count", metrics[0].Name)
+	assert.InEpsilon(t, 100, metrics[0].Value[0][1], 0.001, "the count should be scaled to 1000 over 10s")
+	// unweighted, the median would be about 275
+	assert.InDelta(t, 500, metrics[1].Value[0][1], 10, "median")
+	assert.InDelta(t, 900, metrics[2].Value[0][1], 10, "90th percentile")
+
+	values := h.FlushDistribution().Points[0].Expand()
+	assert.Len(t, values, 1000, "the distribution should have the estimated number of values")
+	sort.Float64s(values)
+	assert.InDelta(t, 500, values[500], 10, "median of the distribution")
+}
+
+// TestHistoSampleRateDistribution tests that fractional weights aren't lost
+// when reconstructing the values for the distribution intake.
+func TestHistoSampleRateDistribution(t *testing.T) {
+	for _, n := range []int{3, 10, 100, 1000} {
+		h := NewHist("a.b.c", nil)
+		for i := 0; i < n; i++ {
+			h.Sample(float64(i), 0.3)
+		}
+		assert.Len(t, h.FlushDistribution().Points[0].Expand(), int(float64(n)/0.3+0.5), "%d samples at a rate of 0.3", n)
+	}
+}
+
+// TestHistoCompressionAccuracy tests that percentiles of a large histogram
+// are close to the exact ones, with bounded memory, for a few compressions.
+func TestHistoCompressionAccuracy(t *testing.T) {
+	const n = 1000000
+	r := rand.New(rand.NewSource(1))
+	values := make([]float64, n)
+	for i := range values {
+		// long tailed, like most latencies
+		values[i] = r.ExpFloat64() * 100
+	}
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	exactP99 := sorted[int(0.99*n)]
+	exactP50 := sorted[n/2]
+
+	for _, compression := range []float64{50, DefaultHistogramCompression, 500} {
+		h := NewHistWithCompression("a.b.c", nil, compression)
+		for _, v := range values {
+			h.Sample(v, 1)
+		}
+
+		metrics := h.Flush(10*time.Second, []float64{0.5, 0.99}, HistogramAggregates{})
+		if !assert.Len(t, metrics, 2) {
+			continue
+		}
+		assert.Equal(t, "a.b.c.99percentile", metrics[1].Name)
+		assert.InEpsilon(t, exactP50, metrics[0].Value[0][1], 0.01, "median at compression %v", compression)
+		assert.InEpsilon(t, exactP99, metrics[1].Value[0][1], 0.01, "p99 at compression %v", compression)
+		centroids := 0
+		h.Value.ForEachCentroid(func(mean, weight float64) bool {
+			centroids++
+			return true
+		})
+		assert.True(t, centroids <= int(math.Pi*compression/2+1), "%d centroids at compression %v", centroids, compression)
+	}
+}
+
+func TestParseAggregates(t *testing.T) {
+	ha, err := ParseAggregates([]string{"count", "max", "count"})
+	assert.NoError(t, err)
+	assert.Equal(t, HistogramAggregates{Value: AggregateCount | AggregateMax, Count: 2}, ha, "repeats should only count once")
+
+	ha, err = ParseAggregates(DefaultAggregates)
+	assert.NoError(t, err)
+	assert.Equal(t, HistogramAggregates{Value: AggregateMin | AggregateMax | AggregateCount, Count: 3}, ha)
+
+	_, err = ParseAggregates([]string{"min", "p99"})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), `"p99"`)
+	}
+}
+
+func TestPercentileName(t *testing.T) {
+	for _, tc := range []struct {
+		quantile float64
+		name     string
+	}{
+		{0.5, "a.b.c.50percentile"},
+		{0.25, "a.b.c.25percentile"},
+		{0.29, "a.b.c.29percentile"},
+		{0.99, "a.b.c.99percentile"},
+		{0.999, "a.b.c.99_9percentile"},
+		{0.9999, "a.b.c.99_99percentile"},
+		{0.001, "a.b.c.0_1percentile"},
+	} {
+		assert.Equal(t, tc.name, PercentileName("a.b.c", tc.quantile))
+		histogram, quantile, ok := ParsePercentileName(tc.name)
+		assert.True(t, ok, "%s should parse", tc.name)
+		assert.Equal(t, "a.b.c", histogram)
+		assert.Equal(t, tc.quantile, quantile, "quantile of %s", tc.name)
+	}
+
+	for _, name := range []string{"a.b.c", "a.b.c.max", ".99percentile", "a.b.c.99_percentile", "a.b.c.percentile"} {
+		_, _, ok := ParsePercentileName(name)
+		assert.False(t, ok, "%s should not parse", name)
+	}
+
+	h := NewHist("a.b.c", nil)
+	h.Sample(1, 1)
+	var names []string
+	for _, m := range h.Flush(10*time.Second, []float64{0.25, 0.75, 0.999}, HistogramAggregates{}) {
+		names = append(names, m.Name)
+	}
+	assert.Equal(t, []string{"a.b.c.25percentile", "a.b.c.75percentile", "a.b.c.99_9percentile"}, names)
+}
+
+func TestDistribution(t *testing.T) {
+	d := NewDistribution("a.b.c", []string{"a:b"})
+	d.Sample(1, 1.0)
+	d.Sample(2, 0.5)
+	for i := 0; i < 3; i++ {
+		d.Sample(3, 0.3)
+	}
+
+	dist := d.Flush()
+	assert.Equal(t, "a.b.c", dist.Name)
+	assert.Equal(t, []string{"a:b"}, dist.Tags)
+	// three samples at a rate of 0.3 have a weight of 10 between them
+	assert.Equal(t, []float64{1, 2, 2, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3}, dist.Points[0].Expand())
+}
+
+// TestDistributionExpandLimit tests that heavily sampled values aren't
+// repeated past MaxDistributionValues, and aren't copied before then.
+func TestDistributionExpandLimit(t *testing.T) {
+	d := NewDistribution("a.b.c", nil)
+	d.Sample(1, 1.0)
+	d.Sample(2, 0.0001)
+	d.Sample(3, 0.0001)
+	assert.Equal(t, []float64{1, 2, 3}, d.Values, "samples should be kept once each")
+
+	point := d.Flush().Points[0]
+	assert.InEpsilon(t, 20001, point.Count(), 0.001)
+	values := point.Expand()
+	assert.Len(t, values, MaxDistributionValues)
+	sort.Float64s(values)
+	assert.InDelta(t, 2, values[MaxDistributionValues/4], 0, "the weights should be scaled evenly")
+	assert.InDelta(t, 3, values[3*MaxDistributionValues/4], 0, "the weights should be scaled evenly")
+
+	unsampled := NewDistribution("a.b.c", nil)
+	unsampled.Sample(1, 1.0)
+	assert.Nil(t, unsampled.Flush().Points[0].Weights, "unsampled values shouldn't need weights")
+}
+
 func TestHistoMerge(t *testing.T) {
 	rand.Seed(time.Now().Unix())
 
@@ -321,3 +568,43 @@ func TestMetricKeyEquality(t *testing.T) {
 	assert.Equal(t, ce1.MetricKey.String(), ce2.MetricKey.String())
 	assert.NotEqual(t, ce1.MetricKey.String(), ce3.MetricKey.String())
 }
+
+func TestTopKCounter(t *testing.T) {
+	c := NewTopKCounter("a.b.c", 3)
+
+	// three heavy hitters among a long tail of tag combinations that are
+	// only seen once each
+	var total int
+	for i := 0; i < 1000; i++ {
+		c.Sample([]string{"customer:a"}, "customer:a", 1, 1.0)
+		total++
+		if i%2 == 0 {
+			c.Sample([]string{"customer:b"}, "customer:b", 1, 1.0)
+			total++
+		}
+		if i%5 == 0 {
+			c.Sample([]string{"customer:c"}, "customer:c", 2, 1.0)
+			total += 2
+		}
+		tail := fmt.Sprintf("customer:tail%d", i)
+		c.Sample([]string{tail}, tail, 1, 1.0)
+		total++
+	}
+	assert.True(t, len(c.entries) <= 30, "memory should be bounded")
+
+	metrics := c.Flush(time.Second)
+	counts := make(map[string]float64)
+	var sum float64
+	for _, m := range metrics {
+		assert.Equal(t, "a.b.c", m.Name)
+		assert.Len(t, m.Tags, 1)
+		counts[m.Tags[0]] = m.Value[0][1]
+		sum += m.Value[0][1]
+	}
+	assert.Len(t, metrics, 4, "should flush the top 3 and other")
+	assert.Equal(t, 1000.0, counts["customer:a"])
+	assert.Equal(t, 500.0, counts["customer:b"])
+	assert.Equal(t, 400.0, counts["customer:c"])
+	assert.Equal(t, 1000.0, counts[TopKOtherTag], "the tail should collapse into other")
+	assert.Equal(t, float64(total), sum, "the series should add up to the total")
+}
@@ -0,0 +1,154 @@
+package samplers
+
+import (
+	"container/heap"
+	"sort"
+	"time"
+)
+
+// TopKOtherTag is the tag on the series that a TopKCounter flushes for all
+// the tag combinations outside its top K.
+const TopKOtherTag = "topk:other"
+
+// topKCandidates is how many tag combinations a TopKCounter tracks for each
+// of the K it reports. Any combination that makes up more than 1/(K *
+// topKCandidates) of the counter's volume is guaranteed to be tracked.
+const topKCandidates = 10
+
+// TopKCounter is a counter that only reports the K tag combinations with the
+// highest counts, and one series with the sum of all the others. It uses the
+// space-saving algorithm, so its memory is bounded no matter how many tag
+// combinations it sees.
+type TopKCounter struct {
+	Name string
+	K    int
+
+	capacity int
+	entries  map[string]*topKEntry
+	// heap orders the entries by ascending count, so the one to replace is
+	// always heap[0]
+	heap  topKHeap
+	total int64
+}
+
+type topKEntry struct {
+	tags []string
+	// count is an upper bound of the entry's true count, which is at least
+	// count - overestimate
+	count        int64
+	overestimate int64
+	key          string
+	index        int
+}
+
+// topKHeap is a min-heap of entries by count.
+type topKHeap []*topKEntry
+
+func (h topKHeap) Len() int           { return len(h) }
+func (h topKHeap) Less(i, j int) bool { return h[i].count < h[j].count }
+func (h topKHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *topKHeap) Push(x interface{}) {
+	e := x.(*topKEntry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *topKHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
+
+// topKEntries sorts entries by descending count.
+type topKEntries []*topKEntry
+
+func (e topKEntries) Len() int           { return len(e) }
+func (e topKEntries) Less(i, j int) bool { return e[i].count > e[j].count }
+func (e topKEntries) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
+
+// NewTopKCounter creates a TopKCounter that reports k tag combinations.
+func NewTopKCounter(name string, k int) *TopKCounter {
+	return &TopKCounter{
+		Name:     name,
+		K:        k,
+		capacity: k * topKCandidates,
+		entries:  make(map[string]*topKEntry),
+	}
+}
+
+// Sample adds a sample for the tag combination. joinedTags must identify
+// the combination, eg by joining the sorted tags.
+func (c *TopKCounter) Sample(tags []string, joinedTags string, sample float64, sampleRate float32) {
+	value := int64(sample) * int64(1/sampleRate)
+	c.total += value
+
+	if e, ok := c.entries[joinedTags]; ok {
+		e.count += value
+		heap.Fix(&c.heap, e.index)
+		return
+	}
+	if len(c.entries) < c.capacity {
+		e := &topKEntry{tags: tags, count: value, key: joinedTags}
+		c.entries[joinedTags] = e
+		heap.Push(&c.heap, e)
+		return
+	}
+
+	// replace the entry with the lowest count; the new combination may have
+	// been seen up to that many times while it wasn't tracked
+	min := c.heap[0]
+	delete(c.entries, min.key)
+	overestimate := min.count
+	min.tags = tags
+	min.key = joinedTags
+	min.count = overestimate + value
+	min.overestimate = overestimate
+	c.entries[joinedTags] = min
+	heap.Fix(&c.heap, 0)
+}
+
+// Flush generates a rate for each of the top K tag combinations, and one
+// tagged TopKOtherTag for the rest. Each combination is reported with the
+// count it is guaranteed to have had; anything uncertain is reported in the
+// other series, so the series add up to the counter's total.
+func (c *TopKCounter) Flush(interval time.Duration) []DDMetric {
+	entries := make(topKEntries, len(c.heap))
+	copy(entries, c.heap)
+	sort.Sort(entries)
+	if len(entries) > c.K {
+		entries = entries[:c.K]
+	}
+
+	now := float64(time.Now().Unix())
+	metrics := make([]DDMetric, 0, len(entries)+1)
+	other := c.total
+	for _, e := range entries {
+		count := e.count - e.overestimate
+		other -= count
+		tags := make([]string, len(e.tags))
+		copy(tags, e.tags)
+		metrics = append(metrics, DDMetric{
+			Name:       c.Name,
+			Value:      [1][2]float64{{now, float64(count) / interval.Seconds()}},
+			Tags:       tags,
+			MetricType: "rate",
+			Interval:   int32(interval.Seconds()),
+		})
+	}
+	if other > 0 {
+		metrics = append(metrics, DDMetric{
+			Name:       c.Name,
+			Value:      [1][2]float64{{now, float64(other) / interval.Seconds()}},
+			Tags:       []string{TopKOtherTag},
+			MetricType: "rate",
+			Interval:   int32(interval.Seconds()),
+		})
+	}
+	return metrics
+}
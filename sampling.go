@@ -0,0 +1,250 @@
+package veneur
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/stripe/veneur/ssf"
+)
+
+// spanSampleRule applies a sample rate to spans that have a tag with a
+// given value.
+type spanSampleRule struct {
+	tag   string
+	value string
+	rate  float64
+}
+
+func (r spanSampleRule) String() string {
+	return fmt.Sprintf("%s:%s", r.tag, r.value)
+}
+
+func (r spanSampleRule) matches(sample *ssf.SSFSample) bool {
+	for _, tag := range sample.Tags {
+		if tag != nil && tag.Name == r.tag && tag.Value == r.value {
+			return true
+		}
+	}
+	return false
+}
+
+// spanKeepDurationRule keeps spans that took at least minDuration,
+// optionally only those of one service.
+type spanKeepDurationRule struct {
+	service     string
+	minDuration time.Duration
+}
+
+func (r spanKeepDurationRule) String() string {
+	if r.service == "" {
+		return fmt.Sprintf("duration>=%v", r.minDuration)
+	}
+	return fmt.Sprintf("service:%s,duration>=%v", r.service, r.minDuration)
+}
+
+func (r spanKeepDurationRule) matches(sample *ssf.SSFSample) bool {
+	if r.service != "" && sample.Service != r.service {
+		return false
+	}
+	return time.Duration(sample.Trace.GetDuration()) >= r.minDuration
+}
+
+// spanSampler decides which spans are kept at ingestion. The first rule
+// that matches a span determines its sample rate; spans that match no rule
+// are sampled at the base rate. Spans that match a keep duration rule are
+// always kept, since Veneur only sees spans once they've completed, and so
+// are errors if keepErrors is set.
+type spanSampler struct {
+	// the base rate, which can be changed by reloading the config
+	rateMtx sync.RWMutex
+	rate    float64
+
+	rules         []spanSampleRule
+	keepDurations []spanKeepDurationRule
+	keepErrors    bool
+
+	// records every decision if set
+	audit *samplingAudit
+}
+
+// Sample reports whether the span should be kept, along with a description
+// of the rule that made the decision. The decision is derived from the trace
+// ID, so every span in a trace sampled at the same rate gets the same
+// decision, except that slow spans kept by a duration rule are kept without
+// the rest of their trace.
+func (ss *spanSampler) Sample(sample *ssf.SSFSample) (keep bool, rule string) {
+	if prioritized(sample) {
+		if ss.audit != nil {
+			ss.audit.Record(sample, true, samplingPriorityTag, 1)
+		}
+		return true, samplingPriorityTag
+	}
+	if ss.keepErrors && failed(sample) {
+		if ss.audit != nil {
+			ss.audit.Record(sample, true, "error", 1)
+		}
+		return true, "error"
+	}
+	for _, r := range ss.keepDurations {
+		if r.matches(sample) {
+			if ss.audit != nil {
+				ss.audit.Record(sample, true, r.String(), 1)
+			}
+			return true, r.String()
+		}
+	}
+	ss.rateMtx.RLock()
+	rate, rule := ss.rate, "base_rate"
+	ss.rateMtx.RUnlock()
+	for _, r := range ss.rules {
+		if r.matches(sample) {
+			rate, rule = r.rate, r.String()
+			break
+		}
+	}
+	keep = sampleTrace(sample, rate)
+	if ss.audit != nil {
+		ss.audit.Record(sample, keep, rule, rate)
+	}
+	return keep, rule
+}
+
+// samplingPriorityTag is the tag set by trace.SetSamplingPriority.
+const samplingPriorityTag = "sampling.priority"
+
+// prioritized reports whether the span has a sampling priority that keeps
+// its trace, 1 or more.
+func prioritized(sample *ssf.SSFSample) bool {
+	for _, tag := range sample.Tags {
+		if tag != nil && tag.Name == samplingPriorityTag {
+			priority, err := strconv.ParseFloat(tag.Value, 64)
+			return err == nil && priority >= 1
+		}
+	}
+	return false
+}
+
+// failed reports whether the span is an error: its status is CRITICAL, as
+// set by trace.Error, or it has an error tag, either Datadog's "error" or
+// one named error.something, like trace.Error's error.msg.
+func failed(sample *ssf.SSFSample) bool {
+	if sample.Status == ssf.SSFSample_CRITICAL {
+		return true
+	}
+	for _, tag := range sample.Tags {
+		if tag == nil {
+			continue
+		}
+		if tag.Name == "error" && tag.Value != "false" && tag.Value != "0" {
+			return true
+		}
+		if strings.HasPrefix(tag.Name, "error.") {
+			return true
+		}
+	}
+	return false
+}
+
+// SetRate changes the base rate.
+func (ss *spanSampler) SetRate(rate float64) {
+	ss.rateMtx.Lock()
+	defer ss.rateMtx.Unlock()
+	ss.rate = rate
+}
+
+// sampleTrace makes a consistent sampling decision for the span's trace at
+// the given rate.
+func sampleTrace(sample *ssf.SSFSample, rate float64) bool {
+	if rate >= 1 {
+		return true
+	}
+	if rate <= 0 {
+		return false
+	}
+	var id int64
+	if sample.Trace != nil {
+		id = sample.Trace.TraceId
+	}
+	// trace IDs are not necessarily uniformly distributed (eg sequential),
+	// so scramble them with Knuth's multiplicative hash before comparing
+	return float64(uint64(id)*2654435761%math.MaxUint32) < rate*math.MaxUint32
+}
+
+// samplingAudit logs sampling decisions, to answer why a trace is missing.
+// Since there is a decision for every span, at most maxPerSecond records are
+// logged each second; the number of records suppressed beyond that is logged
+// when the next second begins.
+type samplingAudit struct {
+	log   *logrus.Logger
+	limit logLimit
+}
+
+func newSamplingAudit(logger *logrus.Logger, maxPerSecond int) *samplingAudit {
+	return &samplingAudit{log: logger, limit: logLimit{maxPerSecond: maxPerSecond}}
+}
+
+// Record logs the decision made for the span, unless the rate limit has been
+// reached.
+func (a *samplingAudit) Record(sample *ssf.SSFSample, keep bool, rule string, rate float64) {
+	if !a.allow(time.Now().Unix()) {
+		return
+	}
+	decision := "dropped"
+	if keep {
+		decision = "sampled"
+	}
+	a.log.WithFields(logrus.Fields{
+		"trace_id": sample.Trace.GetTraceId(),
+		"span_id":  sample.Trace.GetId(),
+		"name":     sample.Name,
+		"service":  sample.Service,
+		"rule":     rule,
+		"rate":     rate,
+		"decision": decision,
+	}).Info("Sampling decision")
+}
+
+func (a *samplingAudit) allow(second int64) bool {
+	ok, suppressed := a.limit.allow(second)
+	if suppressed > 0 {
+		a.log.WithField("suppressed", suppressed).Info("Sampling decisions were not logged because of the rate limit")
+	}
+	return ok
+}
+
+// logLimit allows at most maxPerSecond log records each second, or any
+// number if maxPerSecond is 0 or the limit is nil.
+type logLimit struct {
+	maxPerSecond int
+
+	mtx        sync.Mutex
+	second     int64
+	logged     int
+	suppressed int
+}
+
+// allow reports whether a record can be logged in the given second. When a
+// new second begins, it also returns the number of records suppressed in
+// the last one, so that they can be logged.
+func (l *logLimit) allow(second int64) (ok bool, suppressed int) {
+	if l == nil || l.maxPerSecond == 0 {
+		return true, 0
+	}
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if second != l.second {
+		suppressed = l.suppressed
+		l.second, l.logged, l.suppressed = second, 0, 0
+	}
+	if l.logged >= l.maxPerSecond {
+		l.suppressed++
+		return false, suppressed
+	}
+	l.logged++
+	return true, suppressed
+}
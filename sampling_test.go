@@ -0,0 +1,224 @@
+package veneur
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stripe/veneur/ssf"
+	"github.com/stripe/veneur/trace"
+)
+
+func sampleWithTags(traceID int64, tags map[string]string) *ssf.SSFSample {
+	sample := &ssf.SSFSample{
+		Name:  "span",
+		Trace: &ssf.SSFTrace{TraceId: traceID, Id: traceID},
+	}
+	for k, v := range tags {
+		sample.Tags = append(sample.Tags, &ssf.SSFTag{Name: k, Value: v})
+	}
+	return sample
+}
+
+func TestSpanSamplerTagRules(t *testing.T) {
+	ss := &spanSampler{
+		rate: 0.5,
+		rules: []spanSampleRule{
+			{tag: "plan", value: "premium", rate: 1.0},
+			{tag: "plan", value: "free", rate: 0.1},
+		},
+	}
+
+	const n = 10000
+	var premium, free, other int
+	for i := 0; i < n; i++ {
+		id := rand.Int63()
+		if keep, rule := ss.Sample(sampleWithTags(id, map[string]string{"plan": "premium"})); keep {
+			premium++
+		} else {
+			t.Errorf("premium span was dropped by %s", rule)
+		}
+		if keep, _ := ss.Sample(sampleWithTags(id, map[string]string{"plan": "free"})); keep {
+			free++
+		}
+		if keep, _ := ss.Sample(sampleWithTags(id, map[string]string{"plan": "enterprise"})); keep {
+			other++
+		}
+	}
+	assert.Equal(t, n, premium, "premium spans should always be kept")
+	assert.InDelta(t, 0.1, float64(free)/n, 0.02, "free spans should be sampled at their rule's rate")
+	assert.InDelta(t, 0.5, float64(other)/n, 0.02, "spans matching no rule should be sampled at the base rate")
+}
+
+func TestSpanSamplerConsistent(t *testing.T) {
+	ss := &spanSampler{rate: 0.5}
+	for i := 0; i < 100; i++ {
+		id := rand.Int63()
+		parent, _ := ss.Sample(sampleWithTags(id, nil))
+		child, _ := ss.Sample(sampleWithTags(id, map[string]string{"foo": "bar"}))
+		assert.Equal(t, parent, child, "spans in the same trace should get the same decision")
+	}
+}
+
+func TestSpanSamplerKeepDuration(t *testing.T) {
+	ss := &spanSampler{
+		rate: 0.0,
+		keepDurations: []spanKeepDurationRule{
+			{minDuration: time.Second},
+			{service: "db", minDuration: 100 * time.Millisecond},
+		},
+	}
+	span := func(service string, duration time.Duration) *ssf.SSFSample {
+		sample := sampleWithTags(rand.Int63(), nil)
+		sample.Service = service
+		sample.Trace.Duration = int64(duration)
+		return sample
+	}
+
+	keep, rule := ss.Sample(span("api", 2*time.Second))
+	assert.True(t, keep, "slow spans should be kept at a 0 sample rate")
+	assert.Equal(t, "duration>=1s", rule)
+	keep, _ = ss.Sample(span("api", 10*time.Millisecond))
+	assert.False(t, keep, "fast spans should follow the sample rate")
+	keep, _ = ss.Sample(span("api", 200*time.Millisecond))
+	assert.False(t, keep, "the db rule should only apply to db spans")
+	keep, rule = ss.Sample(span("db", 200*time.Millisecond))
+	assert.True(t, keep)
+	assert.Equal(t, "service:db,duration>=100ms", rule)
+}
+
+func TestSpanSamplerPriority(t *testing.T) {
+	ss := &spanSampler{rate: 0.0}
+	keep, rule := ss.Sample(sampleWithTags(rand.Int63(), map[string]string{"sampling.priority": "2"}))
+	assert.True(t, keep, "spans with a sampling priority should be kept at a 0 sample rate")
+	assert.Equal(t, "sampling.priority", rule)
+	keep, _ = ss.Sample(sampleWithTags(rand.Int63(), map[string]string{"sampling.priority": "0"}))
+	assert.False(t, keep, "a priority of 0 should follow the sample rate")
+}
+
+func TestSpanSamplerKeepErrors(t *testing.T) {
+	ss := &spanSampler{rate: 0.0, keepErrors: true}
+	critical := sampleWithTags(rand.Int63(), nil)
+	critical.Status = ssf.SSFSample_CRITICAL
+	keep, rule := ss.Sample(critical)
+	assert.True(t, keep, "CRITICAL spans should be kept at a 0 sample rate")
+	assert.Equal(t, "error", rule)
+	keep, _ = ss.Sample(sampleWithTags(rand.Int63(), map[string]string{"error.msg": "oops"}))
+	assert.True(t, keep, "spans with an error tag should be kept")
+	keep, _ = ss.Sample(sampleWithTags(rand.Int63(), map[string]string{"error": "true"}))
+	assert.True(t, keep, "spans with Datadog's error tag should be kept")
+	keep, _ = ss.Sample(sampleWithTags(rand.Int63(), map[string]string{"error": "false"}))
+	assert.False(t, keep, "error:false isn't an error")
+	keep, _ = ss.Sample(sampleWithTags(rand.Int63(), nil))
+	assert.False(t, keep, "OK spans should follow the sample rate")
+
+	ss.keepErrors = false
+	keep, _ = ss.Sample(critical)
+	assert.False(t, keep, "errors should follow the sample rate unless they're kept")
+}
+
+func TestTraceSampleRateValidation(t *testing.T) {
+	for _, rate := range []float64{-0.1, 1.5} {
+		config := globalConfig()
+		config.TraceAPIAddress = "http://localhost"
+		config.TraceSampleRate = &rate
+		_, err := NewFromConfig(config)
+		assert.Error(t, err, "a trace_sample_rate of %v should be rejected", rate)
+	}
+}
+
+func TestFlushTracesKeepErrors(t *testing.T) {
+	config := globalConfig()
+	traceAPI := newTraceAPI()
+	defer traceAPI.Close()
+	config.TraceAPIAddress = traceAPI.URL
+	config.TraceStdoutSink = "stderr"
+	rate := 0.0
+	config.TraceSampleRate = &rate
+	config.TraceSampleKeepErrors = true
+
+	server := setupVeneurServer(t, config, nil)
+	defer server.Shutdown()
+	lines := make(spanLines, 1)
+	server.spanWriter = lines
+
+	for i, status := range []ssf.SSFSample_Status{ssf.SSFSample_OK, ssf.SSFSample_CRITICAL, ssf.SSFSample_OK, ssf.SSFSample_CRITICAL} {
+		span := trace.StartTrace(fmt.Sprintf("span%d", i))
+		span.Name = "http.request"
+		span.Status = status
+		span.End = span.Start.Add(time.Millisecond)
+		packet, err := proto.Marshal(span.SSFSample())
+		assert.NoError(t, err)
+		server.HandleTracePacket(packet)
+	}
+	// the OK spans are dropped before they reach the worker
+	waitForSpans(t, 2, server.TraceWorker)
+	server.Flush()
+
+	select {
+	case out := <-lines:
+		printed := strings.Split(strings.TrimSpace(out), "\n")
+		if assert.Len(t, printed, 2, "only the CRITICAL spans should be flushed") {
+			assert.Contains(t, printed[0], "resource=span1")
+			assert.Contains(t, printed[1], "resource=span3")
+		}
+	case <-time.After(10 * time.Second):
+		assert.Fail(t, "no spans were flushed")
+	}
+}
+
+func TestSamplingAudit(t *testing.T) {
+	var out bytes.Buffer
+	logger := logrus.New()
+	logger.Out = &out
+	logger.Formatter = &logrus.JSONFormatter{}
+
+	ss := &spanSampler{
+		rate: 0.5,
+		rules: []spanSampleRule{
+			{tag: "plan", value: "premium", rate: 1.0},
+			{tag: "plan", value: "free", rate: 0},
+		},
+		audit: newSamplingAudit(logger, 100),
+	}
+	ss.Sample(sampleWithTags(1, map[string]string{"plan": "premium"}))
+	ss.Sample(sampleWithTags(2, map[string]string{"plan": "free"}))
+
+	var records []map[string]interface{}
+	dec := json.NewDecoder(&out)
+	for dec.More() {
+		var record map[string]interface{}
+		assert.NoError(t, dec.Decode(&record))
+		records = append(records, record)
+	}
+	if !assert.Len(t, records, 2) {
+		return
+	}
+	assert.Equal(t, float64(1), records[0]["trace_id"])
+	assert.Equal(t, "plan:premium", records[0]["rule"])
+	assert.Equal(t, "sampled", records[0]["decision"])
+	assert.Equal(t, float64(2), records[1]["trace_id"])
+	assert.Equal(t, "plan:free", records[1]["rule"])
+	assert.Equal(t, "dropped", records[1]["decision"])
+}
+
+func TestSamplingAuditRateLimit(t *testing.T) {
+	var out bytes.Buffer
+	logger := logrus.New()
+	logger.Out = &out
+
+	a := newSamplingAudit(logger, 2)
+	assert.True(t, a.allow(1))
+	assert.True(t, a.allow(1))
+	assert.False(t, a.allow(1), "should stop logging at the limit")
+	assert.Equal(t, 0, out.Len())
+	assert.True(t, a.allow(2), "should resume in the next second")
+	assert.Contains(t, out.String(), "suppressed=1")
+}
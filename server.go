@@ -8,9 +8,18 @@ import (
 	"crypto/x509/pkix"
 	"errors"
 	"fmt"
+	"io"
+	"math"
 	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -26,13 +35,23 @@ import (
 	"github.com/stripe/veneur/ssf"
 	"github.com/zenazn/goji/bind"
 	"github.com/zenazn/goji/graceful"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/grpclog"
 
 	"github.com/pkg/profile"
 
 	"github.com/stripe/veneur/plugins"
+	"github.com/stripe/veneur/plugins/cloudmonitoring"
+	"github.com/stripe/veneur/plugins/cloudwatch"
+	"github.com/stripe/veneur/plugins/graphite"
 	"github.com/stripe/veneur/plugins/influxdb"
+	"github.com/stripe/veneur/plugins/kafka"
 	localfilep "github.com/stripe/veneur/plugins/localfile"
+	"github.com/stripe/veneur/plugins/opentsdb"
+	"github.com/stripe/veneur/plugins/prometheus"
 	s3p "github.com/stripe/veneur/plugins/s3"
+	"github.com/stripe/veneur/plugins/signalfx"
+	"github.com/stripe/veneur/plugins/webhook"
 	"github.com/stripe/veneur/samplers"
 	"github.com/stripe/veneur/trace"
 )
@@ -52,6 +71,10 @@ var tracer = trace.GlobalTracer
 
 const defaultTCPReadTimeout = 10 * time.Minute
 
+// defaultShutdownTimeout bounds the final flush on shutdown if
+// shutdown_timeout is not set.
+const defaultShutdownTimeout = 10 * time.Second
+
 // A Server is the actual veneur instance that will be run.
 type Server struct {
 	Workers     []*Worker
@@ -62,62 +85,301 @@ type Server struct {
 	Sentry *raven.Client
 
 	Hostname string
-	Tags     []string
+	// the tags added to everything flushed; guarded by configMtx once the
+	// server has started, so read it with Tags
+	tags []string
 
 	DDHostname     string
 	DDAPIKey       string
 	DDTraceAddress string
 	HTTPClient     *http.Client
+	// the Datadog series payload format, datadogAPIVersion1 or 2
+	ddAPIVersion string
+	// gzip every POST to Datadog, including spans
+	ddFlushCompress bool
+	// the base URL distributions are POSTed to; api_hostname unless set
+	ddDistributionAddress string
+	// how many times to retry a POST to Datadog that failed with a 5xx or
+	// an I/O error
+	flushMaxRetries int
+	// the base URL of the Jaeger collector spans are also sent to, if any
+	jaegerCollectorAddress string
+	// the base URL of the Zipkin server spans are also sent to, if any
+	zipkinAPIAddress string
+	// publishes spans to kafka_span_topic; nil if it isn't set
+	kafkaSpans *kafka.KafkaPlugin
+	// writes flushed metrics and spans to debug_flush_file; nil if it isn't
+	// set
+	debugFile *localfilep.Plugin
+	// prints spans for people to read, to the stream named by
+	// trace_stdout_sink; nil if it isn't set
+	spanWriter     io.Writer
+	spanWriterName string
 
 	HTTPAddr string
+	// rejects imported metrics with timestamps outside it; nil accepts all
+	importWindow *importWindow
 
 	ForwardAddr string
-
-	UDPAddr     *net.UDPAddr
+	// histograms and timers with fewer local samples than this are flushed
+	// locally instead of being forwarded
+	forwardMinSamples int
+	// how long the final flush on shutdown may take
+	shutdownTimeout time.Duration
+	// sends metric lines, unaggregated, to the aggregators in
+	// forward_addresses; nil if they are aggregated here
+	packetForwarder *packetForwarder
+
+	// UDPAddr is the udp_address, the first of UDPAddrs
+	UDPAddr *net.UDPAddr
+	// the udp_address followed by any udp_addresses, each read by
+	// numReaders goroutines
+	UDPAddrs    []*net.UDPAddr
 	TraceAddr   *net.UDPAddr
 	RcvbufBytes int
 
+	// unixgram socket for DogStatsD metrics; closed and removed in Shutdown
+	SocketAddr        *net.UnixAddr
+	socketPermissions os.FileMode
+	// socketConn is replaced by the reader if it fails, so socketMtx guards
+	// it against Shutdown
+	socketConn *net.UnixConn
+	socketMtx  sync.Mutex
+	// the UDP sockets of the metric and trace readers, closed by Shutdown
+	udpConns   []net.PacketConn
+	udpConnMtx sync.Mutex
+
+	// guarded by configMtx; see reload.go
 	interval            time.Duration
 	numReaders          int
 	metricMaxLength     int
 	traceMaxLengthBytes int
 
+	traceDefaultService           string
+	traceDropMissingService       bool
+	traceKeepErrorsMissingService bool
+	traceServiceWhitelist         map[string]struct{}
+
+	// spans that failed to flush, retried on the next flush
+	spanBuffer *spanBuffer
+
+	// nil if all spans are kept
+	spanSampler *spanSampler
+
+	// drops retried spans by their idempotency key; nil if disabled
+	spanDeduper *spanDeduper
+
+	// buffers spans to keep only slow traces; nil if disabled
+	tailSampler *tailSampler
+
+	// matches in span tag values are replaced with redactedValue at flush
+	spanTagRedactions []*regexp.Regexp
+
+	// TLS for the HTTP server, and the authentication it requires; nil if
+	// not configured
+	httpTLSConfig *tls.Config
+	httpAuth      *httpAuth
+	// sent as a bearer token when forwarding to ForwardAddr, if set
+	forwardAuthToken string
+
 	TCPAddr        *net.TCPAddr
 	tlsConfig      *tls.Config
 	tcpListener    net.Listener
 	tcpReadTimeout time.Duration
+	// number of currently open TCP connections, updated atomically
+	tcpConnections int64
+
+	// accepts framed SSF metrics, see ssf_listener.go
+	SSFAddr           *net.TCPAddr
+	ssfListener       net.Listener
+	ssfMaxFrameLength int
+
+	// accepts streams of spans over gRPC, see grpc_listener.go
+	GRPCAddr   *net.TCPAddr
+	grpcServer *grpc.Server
 
 	// closed when the server is shutting down gracefully
 	shutdown chan struct{}
 
-	HistogramPercentiles []float64
+	// guarded by configMtx once the server has started, so read it with
+	// HistogramPercentiles
+	histogramPercentiles []float64
 	FlushMaxPerBody      int
+	// number of goroutines used to render each flush body as JSON
+	serializationParallelism int
+	// if set, an interval that fires while the previous flush is still
+	// running is skipped, and its data is merged into the next flush
+	flushMergeOnSkip bool
+	// 1 while a merge-on-skip flush is running, updated atomically
+	flushing int32
+	// intervals skipped since the last flush, updated atomically
+	skippedIntervals int32
+	// plugin flushes still running after Flush returns, only tracked
+	// when flushMergeOnSkip is set
+	sinkFlushes *sync.WaitGroup
+	// the parts of flushes still running in the background, so that
+	// Shutdown can wait for its final flush
+	inFlight *flushTracker
+
+	// what /healthcheck reports, updated by the listeners and flushes
+	health *healthState
+
+	// the file the config was read from; if set, it is reloaded on POST
+	// /reload, and on SIGHUP if reloadOnSighup is set
+	ConfigFile string
+	// if set, SIGHUP reloads ConfigFile and the metadata tags instead of
+	// triggering a graceful restart
+	reloadOnSighup bool
+	// guards the fields that reloading the config changes: tags,
+	// histogramPercentiles and interval
+	configMtx sync.RWMutex
+	// a reloaded interval, which takes effect after the next flush; 0 if
+	// there is none
+	pendingInterval time.Duration
+	// the listener addresses the server was started with, which can't be
+	// reloaded
+	listenAddresses listenerAddresses
 
 	plugins   []plugins.Plugin
 	pluginMtx sync.Mutex
+	// the most plugins flushed at once; 0 flushes them all at once
+	pluginFlushConcurrency int
 
 	enableProfiling bool
 
+	enableAggregationBytesEstimate bool
+
+	// unit suffixes keyed by DogStatsD type, and per-metric-name overrides;
+	// unitSuffixes is nil if suffixing is disabled
+	unitSuffixes        map[string]string
+	unitSuffixOverrides map[string]string
+
+	// histograms that are sent to the Datadog distribution intake rather
+	// than being flushed with percentiles
+	histogramsAsDistributions    map[string]struct{}
+	allHistogramsAsDistributions bool
+
+	// whether plugins that support summaries get percentiles as summaries
+	percentilesAsSummaries bool
+
+	// if set, packets that aren't valid DogStatsD are parsed as plain StatsD
+	statsdCompat bool
+
+	// K for each counter that only reports its top tag combinations, by name
+	topKCounters map[string]int
+
+	// trusted tags for metrics by source address; nil if none
+	originTags *originTagger
+
+	// computes "<name>.rate_smoothed" for selected counters; nil if none
+	rateSmoother *rateSmoother
+
+	// carries forward the percentiles of selected histograms and timers
+	// through sparse intervals; nil if none
+	percentileCarrier *percentileCarrier
+
+	// whether counters are also flushed as a raw "<name>.count"
+	emitCounterCounts bool
+
+	// metric names are lowercased and then rewritten by metricNameReplacer,
+	// if set, at ingestion and import
+	lowercaseMetricNames bool
+	metricNameReplacer   *strings.Replacer
+
+	// prepended to the name of every flushed metric, ending in a "."; empty
+	// if metric_prefix isn't set
+	metricPrefix string
+
+	// cleans the tags of flushed metrics; nil if tag_sanitization is off
+	tagSanitizer *tagSanitizer
+
+	// the most tag sets each metric name can have per interval, enforced by
+	// the worker that aggregates the name; 0 if there's no limit
+	maxTagSetsPerMetric int
+
+	// drops metric datagrams over max_packets_per_second; nil if there's
+	// no limit
+	ingestLimiter *ingestLimiter
+
+	// factors that incoming values are multiplied by, keyed by metric name
+	inputScaleFactors map[string]float64
+
+	// tags added to metrics at flush, by name; nil if not configured
+	metadataTags *metadataTags
+
+	// records what each sink flushed; nil if not configured
+	auditLog *auditLog
+
+	// re-aggregates flushes into a coarser window for a single sink; nil if
+	// not configured
+	rollup *rollup
+
+	// transforms the values of selected metrics for each sink; nil if none
+	valueTransformer *valueTransformer
+
+	// metrics with more tags than this are dropped, or trimmed if
+	// trimExcessTags is set; 0 means no limit
+	maxTagsPerMetric int
+	trimExcessTags   bool
+
+	// metrics with a tag longer than this are rejected; 0 means no limit
+	metricMaxTagLength int
+	// limits the logging of packets that couldn't be parsed
+	parseErrorLog *logLimit
+
 	HistogramAggregates samplers.HistogramAggregates
 }
 
 // NewFromConfig creates a new veneur server from a configuration specification.
 func NewFromConfig(conf Config) (ret Server, err error) {
+	// fail before anything is bound, rather than when the second listener is
+	if err = conf.checkListenAddresses(); err != nil {
+		return
+	}
+
+	ret.listenAddresses = conf.listenAddresses()
+
 	ret.Hostname = conf.Hostname
-	ret.Tags = conf.Tags
+	ret.tags = conf.Tags
 	ret.DDHostname = conf.APIHostname
+	ret.ddDistributionAddress = conf.DistributionAPIAddress
+	if ret.ddDistributionAddress == "" {
+		ret.ddDistributionAddress = conf.APIHostname
+	}
 	ret.DDAPIKey = conf.Key
+	switch conf.DatadogAPIVersion {
+	case "", datadogAPIVersion1:
+		ret.ddAPIVersion = datadogAPIVersion1
+	case datadogAPIVersion2:
+		ret.ddAPIVersion = datadogAPIVersion2
+	default:
+		err = fmt.Errorf("unsupported datadog_api_version %q, must be %q or %q", conf.DatadogAPIVersion, datadogAPIVersion1, datadogAPIVersion2)
+		return
+	}
+	ret.ddFlushCompress = conf.DatadogFlushCompress
+	if conf.FlushMaxRetries < 0 {
+		err = fmt.Errorf("flush_max_retries %d must not be negative", conf.FlushMaxRetries)
+		return
+	}
+	ret.flushMaxRetries = conf.FlushMaxRetries
 	ret.DDTraceAddress = conf.TraceAPIAddress
-	ret.HistogramPercentiles = conf.Percentiles
-	if len(conf.Aggregates) == 0 {
-		ret.HistogramAggregates.Value = samplers.AggregateMin + samplers.AggregateMax + samplers.AggregateCount
-		ret.HistogramAggregates.Count = 3
-	} else {
-		ret.HistogramAggregates.Value = 0
-		for _, agg := range conf.Aggregates {
-			ret.HistogramAggregates.Value += samplers.AggregatesLookup[agg]
-		}
-		ret.HistogramAggregates.Count = len(conf.Aggregates)
+	ret.jaegerCollectorAddress = conf.JaegerCollectorAddress
+	ret.zipkinAPIAddress = conf.ZipkinAPIAddress
+	// an explicitly empty list flushes no percentiles
+	ret.histogramPercentiles = conf.Percentiles
+	if ret.histogramPercentiles == nil {
+		ret.histogramPercentiles = samplers.DefaultPercentiles
+	}
+	if err = checkPercentiles(ret.histogramPercentiles); err != nil {
+		return
+	}
+	aggregates := conf.Aggregates
+	if len(aggregates) == 0 {
+		aggregates = samplers.DefaultAggregates
+	}
+	ret.HistogramAggregates, err = samplers.ParseAggregates(aggregates)
+	if err != nil {
+		return
 	}
 
 	ret.interval, err = time.ParseDuration(conf.Interval)
@@ -132,14 +394,22 @@ func NewFromConfig(conf Config) (ret Server, err error) {
 	// if transport != nil {
 	// 	ret.HTTPClient.Transport = transport
 	// }
+	// a flush that's due may still be running, so the primary sink has two
+	// intervals to succeed before it's unhealthy
+	ret.health = newHealthState(datadogSinkName, 2*ret.interval, time.Now())
 	ret.FlushMaxPerBody = conf.FlushMaxPerBody
+	ret.serializationParallelism = conf.FlushSerializationParallelism
+	if conf.FlushMergeOnSkip {
+		ret.flushMergeOnSkip = true
+		ret.sinkFlushes = &sync.WaitGroup{}
+	}
 
 	ret.Statsd, err = statsd.NewBuffered(conf.StatsAddress, 1024)
 	if err != nil {
 		return
 	}
 	ret.Statsd.Namespace = "veneur."
-	ret.Statsd.Tags = append(ret.Tags, "veneurlocalonly")
+	ret.Statsd.Tags = append(ret.tags, "veneurlocalonly")
 
 	// nil is a valid sentry client that noops all methods, if there is no DSN
 	// we can just leave it as nil
@@ -158,6 +428,156 @@ func NewFromConfig(conf Config) (ret Server, err error) {
 		ret.enableProfiling = true
 	}
 
+	ret.enableAggregationBytesEstimate = conf.EnableAggregationEstimate
+
+	for _, name := range conf.HistogramsAsDistributions {
+		if name == "*" {
+			ret.allHistogramsAsDistributions = true
+			continue
+		}
+		if ret.histogramsAsDistributions == nil {
+			ret.histogramsAsDistributions = make(map[string]struct{})
+		}
+		ret.histogramsAsDistributions[name] = struct{}{}
+	}
+	ret.percentilesAsSummaries = conf.PercentilesAsSummaries
+	if conf.PluginFlushConcurrency < 0 {
+		err = fmt.Errorf("plugin_flush_concurrency must not be negative, got %d", conf.PluginFlushConcurrency)
+		return
+	}
+	ret.pluginFlushConcurrency = conf.PluginFlushConcurrency
+	if len(conf.PercentileCarryForward) > 0 {
+		ret.percentileCarrier, err = newPercentileCarrier(conf.PercentileCarryForward, conf.ForwardMinSamples)
+		if err != nil {
+			return
+		}
+	}
+
+	if conf.EnableUnitSuffixes {
+		ret.unitSuffixes = conf.UnitSuffixes
+		if ret.unitSuffixes == nil {
+			ret.unitSuffixes = defaultUnitSuffixes
+		}
+		ret.unitSuffixOverrides = conf.UnitSuffixOverrides
+	}
+
+	if conf.MetadataTagsFile != "" {
+		ret.metadataTags, err = newMetadataTags(conf.MetadataTagsFile)
+		if err != nil {
+			return
+		}
+	}
+	ret.reloadOnSighup = conf.ReloadOnSighup
+
+	if conf.FlushAuditLog != "" {
+		ret.auditLog, err = newAuditLog(conf.FlushAuditLog)
+		if err != nil {
+			return
+		}
+	}
+
+	for name, factor := range conf.InputScaleFactors {
+		if factor <= 0 || math.IsInf(factor, 0) || math.IsNaN(factor) {
+			err = fmt.Errorf("input_scale_factors: factor for %q must be a positive number, got %v", name, factor)
+			return
+		}
+	}
+	if len(conf.InputScaleFactors) > 0 {
+		ret.inputScaleFactors = conf.InputScaleFactors
+	}
+
+	ret.emitCounterCounts = conf.EmitCounterCounts
+	if len(conf.SmoothedRateCounters) > 0 {
+		window := defaultSmoothedRateWindow
+		if conf.SmoothedRateWindow != "" {
+			window, err = time.ParseDuration(conf.SmoothedRateWindow)
+			if err != nil {
+				return
+			}
+		}
+		if window < ret.interval {
+			err = fmt.Errorf("smoothed_rate_window %v must be at least the interval %v", window, ret.interval)
+			return
+		}
+		ret.rateSmoother = newRateSmoother(conf.SmoothedRateCounters, window)
+	}
+	if conf.RollupInterval != "" {
+		var window time.Duration
+		window, err = time.ParseDuration(conf.RollupInterval)
+		if err != nil {
+			return
+		}
+		ret.rollup, err = newRollup(window, ret.interval, conf.RollupSink)
+		if err != nil {
+			return
+		}
+	}
+	if len(conf.ValueTransforms) > 0 {
+		ret.valueTransformer, err = newValueTransformer(conf.ValueTransforms)
+		if err != nil {
+			return
+		}
+	}
+	ret.statsdCompat = conf.StatsdCompat
+	if len(conf.OriginTags) > 0 {
+		ret.originTags, err = newOriginTagger(conf.OriginTags)
+		if err != nil {
+			return
+		}
+	}
+
+	ret.lowercaseMetricNames = conf.NormalizeMetricNames.Lowercase
+	if len(conf.NormalizeMetricNames.CharacterMap) > 0 {
+		// sort the replacements so that overlapping ones apply consistently
+		olds := make([]string, 0, len(conf.NormalizeMetricNames.CharacterMap))
+		for old := range conf.NormalizeMetricNames.CharacterMap {
+			if old == "" {
+				err = errors.New("normalize_metric_names: character_map cannot replace an empty string")
+				return
+			}
+			olds = append(olds, old)
+		}
+		sort.Strings(olds)
+		pairs := make([]string, 0, 2*len(olds))
+		for _, old := range olds {
+			pairs = append(pairs, old, conf.NormalizeMetricNames.CharacterMap[old])
+		}
+		ret.metricNameReplacer = strings.NewReplacer(pairs...)
+	}
+	if conf.MetricPrefix != "" {
+		ret.metricPrefix = strings.TrimSuffix(conf.MetricPrefix, ".") + "."
+	}
+	ret.tagSanitizer, err = newTagSanitizer(conf.TagSanitization, conf.TagSanitizationLowercase, conf.TagMaxLength)
+	if err != nil {
+		return
+	}
+
+	if conf.MaxTagSetsPerMetric < 0 {
+		err = fmt.Errorf("max_tag_sets_per_metric must not be negative, got %d", conf.MaxTagSetsPerMetric)
+		return
+	}
+	ret.maxTagSetsPerMetric = conf.MaxTagSetsPerMetric
+
+	if conf.MaxPacketsPerSecond < 0 {
+		err = fmt.Errorf("max_packets_per_second must not be negative, got %d", conf.MaxPacketsPerSecond)
+		return
+	}
+	ret.ingestLimiter = newIngestLimiter(conf.MaxPacketsPerSecond, conf.MaxPacketsPerSecondPerSource)
+
+	if conf.MaxTagsPerMetric < 0 {
+		err = fmt.Errorf("max_tags_per_metric must not be negative, got %d", conf.MaxTagsPerMetric)
+		return
+	}
+	ret.maxTagsPerMetric = conf.MaxTagsPerMetric
+	switch conf.TooManyTagsAction {
+	case "", "drop":
+	case "trim":
+		ret.trimExcessTags = true
+	default:
+		err = fmt.Errorf("too_many_tags_action must be \"drop\" or \"trim\", got %q", conf.TooManyTagsAction)
+		return
+	}
+
 	// This is a check to ensure that we don't repeatedly add a hook
 	// to the "global" log instance on repeated calls to `NewFromConfig`
 	// such as those made in testing. By skipping this we avoid a race
@@ -175,6 +595,48 @@ func NewFromConfig(conf Config) (ret Server, err error) {
 		})
 	}
 
+	if conf.WorkerChannelSize < 0 {
+		err = fmt.Errorf("worker_channel_size must not be negative, got %d", conf.WorkerChannelSize)
+		return
+	}
+	overflowPolicy := OverflowBlock
+	if conf.WorkerOverflowPolicy != "" {
+		var ok bool
+		if overflowPolicy, ok = OverflowPolicies[conf.WorkerOverflowPolicy]; !ok {
+			err = fmt.Errorf("unknown worker_overflow_policy %q", conf.WorkerOverflowPolicy)
+			return
+		}
+	}
+	if overflowPolicy == OverflowDropOldest && conf.WorkerChannelSize <= 0 {
+		err = errors.New("worker_overflow_policy drop_oldest requires a worker_channel_size")
+		return
+	}
+	var workerBlockTimeout time.Duration
+	if conf.WorkerBlockTimeout != "" {
+		workerBlockTimeout, err = time.ParseDuration(conf.WorkerBlockTimeout)
+		if err != nil {
+			return
+		}
+	}
+
+	for name, k := range conf.TopkCounters {
+		if k <= 0 {
+			err = fmt.Errorf("topk_counters: K for %q must be positive, got %d", name, k)
+			return
+		}
+	}
+	ret.topKCounters = conf.TopkCounters
+
+	if conf.HistogramCompression < 0 {
+		err = fmt.Errorf("histogram_compression must not be negative, got %v", conf.HistogramCompression)
+		return
+	}
+
+	if conf.SetPrecision != 0 && (conf.SetPrecision < samplers.MinSetPrecision || conf.SetPrecision > samplers.DefaultSetPrecision) {
+		err = fmt.Errorf("set_precision must be between %d and %d, got %d", samplers.MinSetPrecision, samplers.DefaultSetPrecision, conf.SetPrecision)
+		return
+	}
+
 	log.WithField("number", conf.NumWorkers).Info("Preparing workers")
 	// Allocate the slice, we'll fill it with workers later.
 	ret.Workers = make([]*Worker, conf.NumWorkers)
@@ -183,6 +645,11 @@ func NewFromConfig(conf Config) (ret Server, err error) {
 	// Use the pre-allocated Workers slice to know how many to start.
 	for i := range ret.Workers {
 		ret.Workers[i] = NewWorker(i+1, ret.Statsd, log)
+		ret.Workers[i].SetQueue(conf.WorkerChannelSize, overflowPolicy, workerBlockTimeout)
+		ret.Workers[i].SetTopK(conf.TopkCounters)
+		ret.Workers[i].SetHistogramCompression(conf.HistogramCompression)
+		ret.Workers[i].SetSetPrecision(uint8(conf.SetPrecision))
+		ret.Workers[i].SetMaxTagSets(conf.MaxTagSetsPerMetric)
 		// do not close over loop index
 		go func(w *Worker) {
 			defer func() {
@@ -194,62 +661,152 @@ func NewFromConfig(conf Config) (ret Server, err error) {
 
 	ret.EventWorker = NewEventWorker(ret.Statsd)
 
-	ret.UDPAddr, err = net.ResolveUDPAddr("udp", conf.UdpAddress)
-	if err != nil {
-		return
+	for _, address := range append([]string{conf.UdpAddress}, conf.UdpAddresses...) {
+		var addr *net.UDPAddr
+		addr, err = net.ResolveUDPAddr("udp", address)
+		if err != nil {
+			return
+		}
+		ret.UDPAddrs = append(ret.UDPAddrs, addr)
+	}
+	ret.UDPAddr = ret.UDPAddrs[0]
+
+	if conf.SocketAddress != "" {
+		ret.SocketAddr, err = parseSocketAddress(conf.SocketAddress)
+		if err != nil {
+			return
+		}
+		ret.socketPermissions = defaultSocketPermissions
+		if conf.SocketPermissions != "" {
+			var perm uint64
+			perm, err = strconv.ParseUint(conf.SocketPermissions, 8, 32)
+			if err != nil {
+				return
+			}
+			ret.socketPermissions = os.FileMode(perm)
+		}
 	}
 
 	ret.metricMaxLength = conf.MetricMaxLength
+	if conf.MetricMaxTagLength < 0 {
+		err = fmt.Errorf("metric_max_tag_length must not be negative, got %d", conf.MetricMaxTagLength)
+		return
+	}
+	ret.metricMaxTagLength = conf.MetricMaxTagLength
+	if conf.ParseErrorLogMaxPerSecond < 0 {
+		err = fmt.Errorf("parse_error_log_max_per_second must not be negative, got %d", conf.ParseErrorLogMaxPerSecond)
+		return
+	}
+	ret.parseErrorLog = &logLimit{maxPerSecond: conf.ParseErrorLogMaxPerSecond}
 	ret.traceMaxLengthBytes = conf.TraceMaxLengthBytes
 	ret.RcvbufBytes = conf.ReadBufferSizeBytes
+	if ret.RcvbufBytes == 0 {
+		ret.RcvbufBytes = defaultBufferSizeBytes
+	} else if ret.RcvbufBytes < 0 {
+		err = fmt.Errorf("read_buffer_size_bytes must be positive, got %d", ret.RcvbufBytes)
+		return
+	}
 	ret.HTTPAddr = conf.HTTPAddress
+	ret.importWindow, err = newImportWindow(conf.ImportMaxAge, conf.ImportMaxFuture)
+	if err != nil {
+		return
+	}
 	ret.ForwardAddr = conf.ForwardAddress
+	if len(conf.ForwardAddresses) > 0 {
+		if conf.ForwardAddress != "" {
+			err = errors.New("forward_address and forward_addresses cannot both be set")
+			return
+		}
+		ret.packetForwarder, err = newPacketForwarder(conf.ForwardAddresses)
+		if err != nil {
+			return
+		}
+	}
+	// withholding only makes sense on a local veneur, which forwards; a
+	// global one would flush percentiles for everything it has
+	if conf.ForwardMinSamples > 0 && conf.ForwardAddress == "" {
+		log.Warn("forward_min_samples has no effect without forward_address")
+	} else {
+		ret.forwardMinSamples = conf.ForwardMinSamples
+	}
+	ret.shutdownTimeout = defaultShutdownTimeout
+	if conf.ShutdownTimeout != "" {
+		ret.shutdownTimeout, err = time.ParseDuration(conf.ShutdownTimeout)
+		if err != nil {
+			return
+		}
+	}
+
+	if conf.SsfTcpAddress != "" {
+		ret.SSFAddr, err = net.ResolveTCPAddr("tcp", conf.SsfTcpAddress)
+		if err != nil {
+			return
+		}
+	}
+	if conf.GRPCAddress != "" {
+		ret.GRPCAddr, err = net.ResolveTCPAddr("tcp", conf.GRPCAddress)
+		if err != nil {
+			return
+		}
+	}
+	if conf.SsfMaxFrameLength < 0 {
+		err = fmt.Errorf("ssf_max_frame_length must not be negative, got %d", conf.SsfMaxFrameLength)
+		return
+	}
+	ret.ssfMaxFrameLength = conf.SsfMaxFrameLength
+	if ret.ssfMaxFrameLength == 0 {
+		ret.ssfMaxFrameLength = defaultSSFMaxFrameLength
+	}
 
 	if conf.TcpAddress != "" {
 		ret.TCPAddr, err = net.ResolveTCPAddr("tcp", conf.TcpAddress)
 		if err != nil {
 			return
 		}
-		if conf.TLSKey != "" {
-			if conf.TLSCertificate == "" {
-				err = errors.New("tls_key is set; must set tls_certificate")
-				return
-			}
-
-			// load the TLS key and certificate
-			var cert tls.Certificate
-			cert, err = tls.X509KeyPair([]byte(conf.TLSCertificate), []byte(conf.TLSKey))
+		if conf.TcpReadTimeout != "" {
+			ret.tcpReadTimeout, err = time.ParseDuration(conf.TcpReadTimeout)
 			if err != nil {
 				return
 			}
+		}
+	}
+	if conf.TLSKey != "" && (conf.TcpAddress != "" || conf.SsfTcpAddress != "") {
+		// require clients to present certificates signed by the
+		// authority, if there is one
+		ret.tlsConfig, err = loadTLSConfig("tls", conf.TLSCertificate, conf.TLSKey, conf.TLSAuthorityCertificate, tls.RequireAndVerifyClientCert)
+		if err != nil {
+			return
+		}
+	}
 
-			clientAuthMode := tls.NoClientCert
-			var clientCAs *x509.CertPool
-			if conf.TLSAuthorityCertificate != "" {
-				// load the authority; require clients to present certificated signed by this authority
-				clientAuthMode = tls.RequireAndVerifyClientCert
-				clientCAs = x509.NewCertPool()
-				ok := clientCAs.AppendCertsFromPEM([]byte(conf.TLSAuthorityCertificate))
-				if !ok {
-					err = errors.New("tls_authority_certificate: Could not load any certificates")
-					return
-				}
-			}
-
-			ret.tlsConfig = &tls.Config{
-				Certificates: []tls.Certificate{cert},
-				ClientAuth:   clientAuthMode,
-				ClientCAs:    clientCAs,
-			}
+	if conf.HTTPTLSKey != "" {
+		// client certificates are optional at the TLS layer, so that the
+		// healthchecks can be exempted and tokens used instead; httpAuth
+		// rejects requests without either
+		ret.httpTLSConfig, err = loadTLSConfig("http_tls", conf.HTTPTLSCertificate, conf.HTTPTLSKey, conf.HTTPTLSAuthorityCertificate, tls.VerifyClientCertIfGiven)
+		if err != nil {
+			return
 		}
+	} else if conf.HTTPTLSAuthorityCertificate != "" {
+		err = errors.New("http_tls_authority_certificate is set; must set http_tls_key and http_tls_certificate")
+		return
+	}
+	if conf.HTTPAuthToken != "" || conf.HTTPTLSAuthorityCertificate != "" {
+		ret.httpAuth = newHTTPAuth(conf.HTTPAuthToken, conf.HTTPTLSAuthorityCertificate != "", conf.HTTPAuthExemptHealthcheck, ret.Statsd)
 	}
+	ret.forwardAuthToken = conf.ForwardAuthToken
+	signalfxAPIKey := conf.SignalfxAPIKey
 
 	conf.Key = REDACTED
 	conf.SentryDsn = REDACTED
 	conf.TLSKey = REDACTED
+	conf.HTTPTLSKey = REDACTED
+	conf.HTTPAuthToken = REDACTED
+	conf.ForwardAuthToken = REDACTED
+	conf.SignalfxAPIKey = REDACTED
 	log.WithField("config", conf).Debug("Initialized server")
 
-	if len(conf.TraceAddress) > 0 && (conf.TraceAPIAddress != "") {
+	if len(conf.TraceAddress) > 0 && conf.tracingEnabled() {
 
 		ret.TraceWorker = NewTraceWorker(ret.Statsd)
 
@@ -261,9 +818,145 @@ func NewFromConfig(conf Config) (ret Server, err error) {
 		if err != nil {
 			return
 		}
+		var spanBufferMaxAge time.Duration
+		if conf.SpanBufferMaxAge != "" {
+			spanBufferMaxAge, err = time.ParseDuration(conf.SpanBufferMaxAge)
+			if err != nil {
+				return
+			}
+		}
+		spanBufferMaxSpans := defaultSpanBufferSize
+		if conf.SpanBufferMaxSpans > 0 {
+			spanBufferMaxSpans = conf.SpanBufferMaxSpans
+		}
+		switch conf.SpanBufferBackend {
+		case "", "memory":
+			ret.spanBuffer = newSpanBuffer(spanBufferMaxSpans, spanBufferMaxAge)
+		case "disk":
+			if conf.SpanBufferPath == "" {
+				err = errors.New("span_buffer_path is required for the disk span buffer")
+				return
+			}
+			ret.spanBuffer, err = newDiskSpanBuffer(conf.SpanBufferPath, spanBufferMaxSpans, spanBufferMaxAge)
+			if err != nil {
+				return
+			}
+			log.WithFields(logrus.Fields{
+				"path":  conf.SpanBufferPath,
+				"spans": len(ret.spanBuffer.spans),
+			}).Info("Loaded the span buffer")
+		default:
+			err = fmt.Errorf("span_buffer_backend must be \"memory\" or \"disk\", got %q", conf.SpanBufferBackend)
+			return
+		}
+
+		if conf.TraceSampleRate != nil || len(conf.TraceSampleRules) > 0 || len(conf.TraceKeepDurationRules) > 0 {
+			ret.spanSampler = &spanSampler{rate: 1.0}
+			if conf.TraceSampleRate != nil {
+				if rate := *conf.TraceSampleRate; rate < 0 || rate > 1 {
+					err = fmt.Errorf("trace_sample_rate %v is outside [0, 1]", rate)
+					return
+				}
+				ret.spanSampler.rate = *conf.TraceSampleRate
+			}
+			for _, rule := range conf.TraceSampleRules {
+				if rule.Rate < 0 || rule.Rate > 1 {
+					err = fmt.Errorf("trace sample rule %s:%s has rate %v outside [0, 1]", rule.Tag, rule.Value, rule.Rate)
+					return
+				}
+				ret.spanSampler.rules = append(ret.spanSampler.rules, spanSampleRule{
+					tag:   rule.Tag,
+					value: rule.Value,
+					rate:  rule.Rate,
+				})
+			}
+			for _, rule := range conf.TraceKeepDurationRules {
+				var minDuration time.Duration
+				minDuration, err = time.ParseDuration(rule.MinDuration)
+				if err != nil {
+					return
+				}
+				if minDuration <= 0 {
+					err = fmt.Errorf("trace keep duration rule min_duration must be positive, got %v", minDuration)
+					return
+				}
+				ret.spanSampler.keepDurations = append(ret.spanSampler.keepDurations, spanKeepDurationRule{
+					service:     rule.Service,
+					minDuration: minDuration,
+				})
+			}
+			ret.spanSampler.keepErrors = conf.TraceSampleKeepErrors
+			if conf.TraceSampleAuditMaxPerSecond > 0 {
+				ret.spanSampler.audit = newSamplingAudit(log, conf.TraceSampleAuditMaxPerSecond)
+			}
+		}
+
+		if conf.SpanIdempotencyWindow != "" {
+			var window time.Duration
+			window, err = time.ParseDuration(conf.SpanIdempotencyWindow)
+			if err != nil {
+				return
+			}
+			if window <= 0 {
+				err = fmt.Errorf("span_idempotency_window must be positive, got %v", window)
+				return
+			}
+			ret.spanDeduper = newSpanDeduper(window)
+		}
+
+		if conf.TailSampleLatencyThreshold != "" {
+			var threshold time.Duration
+			threshold, err = time.ParseDuration(conf.TailSampleLatencyThreshold)
+			if err != nil {
+				return
+			}
+			if threshold <= 0 {
+				err = fmt.Errorf("tail_sample_latency_threshold must be positive, got %v", threshold)
+				return
+			}
+			window := defaultTailSampleWindow
+			if conf.TailSampleWindow != "" {
+				window, err = time.ParseDuration(conf.TailSampleWindow)
+				if err != nil {
+					return
+				}
+				if window <= 0 {
+					err = fmt.Errorf("tail_sample_window must be positive, got %v", window)
+					return
+				}
+			}
+			maxSpans := defaultTailSampleMaxSpans
+			if conf.TailSampleMaxSpans > 0 {
+				maxSpans = conf.TailSampleMaxSpans
+			}
+			ret.tailSampler = newTailSampler(threshold, window, maxSpans)
+		}
+
+		ret.traceDefaultService = conf.TraceDefaultService
+		ret.traceDropMissingService = conf.TraceDropMissingService
+		ret.traceKeepErrorsMissingService = conf.TraceKeepErrorsMissingService
+		if len(conf.TraceServiceWhitelist) > 0 {
+			ret.traceServiceWhitelist = make(map[string]struct{}, len(conf.TraceServiceWhitelist))
+			for _, svc := range conf.TraceServiceWhitelist {
+				ret.traceServiceWhitelist[svc] = struct{}{}
+			}
+		}
+		for _, pattern := range conf.SpanTagRedactionPatterns {
+			var re *regexp.Regexp
+			re, err = regexp.Compile(pattern)
+			if err != nil {
+				err = fmt.Errorf("invalid span_tag_redaction_patterns pattern %q: %v", pattern, err)
+				return
+			}
+			ret.spanTagRedactions = append(ret.spanTagRedactions, re)
+		}
+
 		trace.Enable()
 	} else {
 		trace.Disable()
+		if conf.DebugFlushFile != "" || conf.TraceStdoutSink != "" {
+			log.Warn("debug_flush_file and trace_stdout_sink only receive spans if another span sink, like trace_api_address, is configured")
+		}
 	}
 
 	var svc s3iface.S3API
@@ -298,32 +991,272 @@ func NewFromConfig(conf Config) (ret Server, err error) {
 		log.Info("AWS credentials not found")
 	}
 
-	if svc == nil {
-		log.Info("S3 archives are disabled")
-	} else {
-		log.Info("S3 archives are enabled")
+	if svc == nil {
+		log.Info("S3 archives are disabled")
+	} else {
+		log.Info("S3 archives are enabled")
+	}
+
+	if conf.InfluxAddress != "" {
+		var plugin *influxdb.InfluxDBPlugin
+		plugin, err = influxdb.NewInfluxDBPlugin(
+			log, conf.InfluxAddress, conf.InfluxConsistency, conf.InfluxDBName, conf.InfluxFlushMaxPerBody, ret.HTTPClient, ret.Statsd,
+		)
+		if err != nil {
+			return
+		}
+		ret.registerPlugin(plugin)
+	}
+
+	if conf.WebhookURL != "" {
+		var plugin *webhook.WebhookPlugin
+		plugin, err = webhook.NewWebhookPlugin(
+			log, conf.WebhookURL, conf.WebhookHeaders, conf.WebhookTemplate, ret.HTTPClient, ret.Statsd,
+		)
+		if err != nil {
+			return
+		}
+		ret.registerPlugin(plugin)
+	}
+
+	if conf.OpentsdbAddress != "" {
+		var plugin *opentsdb.OpenTSDBPlugin
+		plugin, err = opentsdb.NewOpenTSDBPlugin(
+			log, conf.OpentsdbAddress, ret.HTTPClient, ret.Statsd,
+		)
+		if err != nil {
+			return
+		}
+		ret.registerPlugin(plugin)
+	}
+
+	if conf.PrometheusRemoteWriteAddress != "" {
+		var plugin *prometheus.RemoteWritePlugin
+		plugin, err = prometheus.NewRemoteWritePlugin(
+			log, conf.PrometheusRemoteWriteAddress, ret.HTTPClient, ret.Statsd,
+		)
+		if err != nil {
+			return
+		}
+		ret.registerPlugin(plugin)
+	}
+
+	if signalfxAPIKey != "" {
+		var plugin *signalfx.SignalFxPlugin
+		plugin, err = signalfx.NewSignalFxPlugin(
+			log, conf.SignalfxEndpointBase, signalfxAPIKey, conf.SignalfxFlushMaxPerBody, ret.HTTPClient, ret.Statsd,
+		)
+		if err != nil {
+			return
+		}
+		ret.registerPlugin(plugin)
+	}
+
+	if conf.GcpProject != "" {
+		var plugin *cloudmonitoring.CloudMonitoringPlugin
+		plugin, err = cloudmonitoring.NewCloudMonitoringPlugin(
+			log, conf.GcpProject, conf.GcpCredentialsFile, ret.HTTPClient, ret.Statsd,
+		)
+		if err != nil {
+			return
+		}
+		ret.registerPlugin(plugin)
+	}
+
+	if conf.CloudWatchNamespace != "" {
+		// without static credentials, the session finds them in the
+		// environment or the instance's role
+		awsConfig := &aws.Config{Region: aws.String(conf.AwsRegion)}
+		if len(awsID) > 0 && len(awsSecret) > 0 {
+			awsConfig.Credentials = credentials.NewStaticCredentials(awsID, awsSecret, "")
+		}
+		var sess *session.Session
+		sess, err = session.NewSession(awsConfig)
+		if err != nil {
+			return
+		}
+		var plugin *cloudwatch.CloudWatchPlugin
+		plugin, err = cloudwatch.NewCloudWatchPlugin(
+			log, conf.CloudWatchNamespace, cloudwatch.NewClient(sess), ret.Statsd,
+		)
+		if err != nil {
+			return
+		}
+		ret.registerPlugin(plugin)
+	}
+
+	if conf.CarbonAddress != "" {
+		var plugin *graphite.GraphitePlugin
+		plugin, err = graphite.NewGraphitePlugin(
+			log, conf.CarbonAddress, conf.CarbonTemplate, conf.CarbonMaxBufferedLines, ret.Statsd,
+		)
+		if err != nil {
+			return
+		}
+		ret.registerPlugin(plugin)
+	}
+
+	if conf.KafkaBroker != "" {
+		var plugin *kafka.KafkaPlugin
+		plugin, err = kafka.NewKafkaPlugin(
+			log, conf.KafkaBroker, conf.KafkaSpanTopic, conf.KafkaMetricTopic, conf.KafkaAcks, conf.KafkaAsync, ret.Statsd,
+		)
+		if err != nil {
+			return
+		}
+		if conf.KafkaMetricTopic != "" {
+			ret.registerPlugin(plugin)
+		}
+		if conf.KafkaSpanTopic != "" {
+			ret.kafkaSpans = plugin
+		}
+	}
+
+	if conf.DebugFlushFile != "" {
+		if conf.DebugFlushFileMaxBytes < 0 {
+			err = fmt.Errorf("debug_flush_file_max_bytes %d must not be negative", conf.DebugFlushFileMaxBytes)
+			return
+		}
+		ret.debugFile = &localfilep.Plugin{
+			FilePath:   conf.DebugFlushFile,
+			Logger:     log,
+			JSON:       true,
+			MaxBytes:   conf.DebugFlushFileMaxBytes,
+			PluginName: "debug_file",
+		}
+		if ret.debugFile.MaxBytes == 0 {
+			ret.debugFile.MaxBytes = defaultDebugFileMaxBytes
+		}
+		ret.registerPlugin(ret.debugFile)
+	}
+
+	if conf.TraceStdoutSink != "" {
+		var ok bool
+		if ret.spanWriter, ok = spanWriters[conf.TraceStdoutSink]; !ok {
+			err = fmt.Errorf("trace_stdout_sink %q must be stdout or stderr", conf.TraceStdoutSink)
+			return
+		}
+		ret.spanWriterName = conf.TraceStdoutSink
+	}
+
+	if conf.FlushFile != "" {
+		localFilePlugin := &localfilep.Plugin{
+			FilePath: conf.FlushFile,
+			Logger:   log,
+		}
+		ret.registerPlugin(localFilePlugin)
+		log.Info(fmt.Sprintf("Local file logging to %s", conf.FlushFile))
+	}
+
+	if ret.rollup != nil {
+		found := false
+		for _, p := range ret.getPlugins() {
+			found = found || p.Name() == ret.rollup.sink
+		}
+		if !found {
+			err = fmt.Errorf("rollup_sink %q is not a configured plugin", ret.rollup.sink)
+			return
+		}
+	}
+	if ret.valueTransformer != nil {
+		for sink := range ret.valueTransformer.sinks {
+			found := sink == "" || sink == datadogSinkName
+			for _, p := range ret.getPlugins() {
+				found = found || p.Name() == sink
+			}
+			if !found {
+				err = fmt.Errorf("value_transforms sink %q is not datadog or a configured plugin", sink)
+				return
+			}
+		}
+	}
+
+	// closed in Shutdown; Same approach and http.Shutdown
+	ret.shutdown = make(chan struct{})
+	ret.inFlight = newFlushTracker()
+
+	return
+}
+
+// wrapTLS wraps a TCP listener with TLS, if tls_key is set. It returns the
+// listener and a description of its mode for logging.
+func (s *Server) wrapTLS(l net.Listener) (net.Listener, string) {
+	if s.tlsConfig == nil {
+		return l, "unencrypted"
+	}
+	l = tls.NewListener(l, s.tlsConfig)
+	if s.tlsConfig.ClientAuth == tls.RequireAndVerifyClientCert {
+		return l, "authenticated"
+	}
+	return l, "encrypted"
+}
+
+// handshakeTLS completes the TLS handshake on conn, if it is a TLS
+// connection, so that a client without a valid certificate is turned away
+// before anything it sent is read. Failures are counted in
+// prefix.tls_handshake_failures. It reports whether the connection may be
+// read.
+func (s *Server) handshakeTLS(conn net.Conn, timeout time.Duration, prefix string) bool {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		log.WithFields(logrus.Fields{
+			"peer": conn.RemoteAddr(),
+		}).Debug("Starting TCP connection")
+		return true
+	}
+
+	// complete the handshake to verify the certificate
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	err := tlsConn.Handshake()
+	if err != nil {
+		// usually io.EOF or "read: connection reset by peer"; not really errors
+		// it can also be caused by certificate authentication problems
+		s.Statsd.Count(prefix+".tls_handshake_failures", 1, nil, 1.0)
+		log.WithFields(logrus.Fields{
+			logrus.ErrorKey: err,
+			"peer":          conn.RemoteAddr(),
+		}).Info("TLS Handshake failed")
+		return false
 	}
 
-	if conf.InfluxAddress != "" {
-		plugin := influxdb.NewInfluxDBPlugin(
-			log, conf.InfluxAddress, conf.InfluxConsistency, conf.InfluxDBName, ret.HTTPClient, ret.Statsd,
-		)
-		ret.registerPlugin(plugin)
+	state := tlsConn.ConnectionState()
+	var clientCert pkix.RDNSequence
+	if len(state.PeerCertificates) > 0 {
+		clientCert = state.PeerCertificates[0].Subject.ToRDNSequence()
 	}
+	log.WithFields(logrus.Fields{
+		"peer":        conn.RemoteAddr(),
+		"client_cert": clientCert,
+	}).Debug("Starting TLS connection")
+	return true
+}
 
-	if conf.FlushFile != "" {
-		localFilePlugin := &localfilep.Plugin{
-			FilePath: conf.FlushFile,
-			Logger:   log,
-		}
-		ret.registerPlugin(localFilePlugin)
-		log.Info(fmt.Sprintf("Local file logging to %s", conf.FlushFile))
+// loadTLSConfig loads a TLS key and certificate, configured by the options
+// starting with prefix. If there is an authority certificate, clients are
+// verified against it, according to clientAuth.
+func loadTLSConfig(prefix, certificate, key, authority string, clientAuth tls.ClientAuthType) (*tls.Config, error) {
+	if certificate == "" {
+		return nil, fmt.Errorf("%s_key is set; must set %s_certificate", prefix, prefix)
 	}
 
-	// closed in Shutdown; Same approach and http.Shutdown
-	ret.shutdown = make(chan struct{})
+	// load the TLS key and certificate
+	cert, err := tls.X509KeyPair([]byte(certificate), []byte(key))
+	if err != nil {
+		return nil, err
+	}
 
-	return
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.NoClientCert,
+	}
+	if authority != "" {
+		config.ClientAuth = clientAuth
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM([]byte(authority)) {
+			return nil, fmt.Errorf("%s_authority_certificate: Could not load any certificates", prefix)
+		}
+	}
+	return config, nil
 }
 
 // Start spins up the Server to do actual work, firing off goroutines for
@@ -363,12 +1296,47 @@ func (s *Server) Start() {
 	}
 
 	// Read Metrics Forever!
-	for i := 0; i < s.numReaders; i++ {
+	readers := s.numReaders
+	if readers > 1 && !reuseportSupported {
+		log.WithField("num_readers", readers).Warn("SO_REUSEPORT is not supported on this platform, so each UDP address will have a single reader")
+		readers = 1
+	}
+	for i, addr := range s.UDPAddrs {
+		// the health check names each listener by its option
+		listener := "udp_address"
+		if i > 0 {
+			listener = fmt.Sprintf("udp_addresses[%d]", i-1)
+		}
+		if readers > 0 {
+			s.health.ExpectListener(listener)
+		}
+		for j := 0; j < readers; j++ {
+			go func(addr *net.UDPAddr, listener string) {
+				defer func() {
+					ConsumePanic(s.Sentry, s.Statsd, s.Hostname, recover())
+				}()
+				s.ReadMetricSocket(addr, listener, packetPool, readers != 1)
+			}(addr, listener)
+		}
+	}
+
+	// Read Metrics from the unix socket Forever!
+	if s.SocketAddr != nil {
+		// created here rather than in the reading goroutine so that Shutdown
+		// can always find it
+		var err error
+		s.socketConn, err = s.listenUnixSocket()
+		if err != nil {
+			log.WithError(err).Fatal("Error listening for unixgram metrics")
+		}
+		log.WithField("address", s.SocketAddr).Info("Listening for unixgram metrics")
+		s.health.ListenerBound("socket_address")
+
 		go func() {
 			defer func() {
 				ConsumePanic(s.Sentry, s.Statsd, s.Hostname, recover())
 			}()
-			s.ReadMetricSocket(packetPool, s.numReaders != 1)
+			s.ReadMetricUnixSocket(packetPool)
 		}()
 	}
 
@@ -381,20 +1349,12 @@ func (s *Server) Start() {
 			logrus.WithError(err).Fatal("Error listening for TCP connections")
 		}
 
-		mode := "unencrypted"
-		if s.tlsConfig != nil {
-			// wrap the listener with TLS
-			s.tcpListener = tls.NewListener(s.tcpListener, s.tlsConfig)
-			if s.tlsConfig.ClientAuth == tls.RequireAndVerifyClientCert {
-				mode = "authenticated"
-			} else {
-				mode = "encrypted"
-			}
-		}
-
+		var mode string
+		s.tcpListener, mode = s.wrapTLS(s.tcpListener)
 		log.WithFields(logrus.Fields{
 			"address": s.TCPAddr, "mode": mode,
 		}).Info("Listening for TCP connections")
+		s.health.ListenerBound("tcp_address")
 
 		go func() {
 			defer func() {
@@ -406,8 +1366,61 @@ func (s *Server) Start() {
 		logrus.Info("TCP not configured - not reading TCP socket")
 	}
 
+	// Read framed SSF metrics from TCP Forever!
+	if s.SSFAddr != nil {
+		var err error
+		s.ssfListener, err = net.ListenTCP("tcp", s.SSFAddr)
+		if err != nil {
+			logrus.WithError(err).Fatal("Error listening for SSF connections")
+		}
+		var mode string
+		s.ssfListener, mode = s.wrapTLS(s.ssfListener)
+		log.WithFields(logrus.Fields{
+			"address": s.SSFAddr, "mode": mode,
+		}).Info("Listening for SSF metrics over TCP")
+		s.health.ListenerBound("ssf_address")
+
+		go func() {
+			defer func() {
+				ConsumePanic(s.Sentry, s.Statsd, s.Hostname, recover())
+			}()
+			s.ReadSSFSocket()
+		}()
+	}
+
+	// Read spans from gRPC streams Forever!
+	if s.GRPCAddr != nil {
+		listener, err := net.ListenTCP("tcp", s.GRPCAddr)
+		if err != nil {
+			logrus.WithError(err).Fatal("Error listening for gRPC connections")
+		}
+		// created here rather than in the serving goroutine so that
+		// Shutdown can always find it
+		grpcLogOnce.Do(func() { grpclog.SetLogger(log) })
+		s.grpcServer = grpc.NewServer()
+		ssf.RegisterSpanIngestServer(s.grpcServer, grpcSpanServer{s})
+		log.WithField("address", s.GRPCAddr).Info("Listening for spans over gRPC")
+		s.health.ListenerBound("grpc_address")
+
+		go func() {
+			defer func() {
+				ConsumePanic(s.Sentry, s.Statsd, s.Hostname, recover())
+			}()
+			if err := s.grpcServer.Serve(listener); err != nil {
+				select {
+				case <-s.shutdown:
+					// Stop closed the listener
+					return
+				default:
+				}
+				log.WithError(err).Fatal("gRPC server failed")
+			}
+		}()
+	}
+
 	// Read Traces Forever!
 	if s.TracingEnabled() {
+		s.health.ExpectListener("trace_address")
 		go func() {
 			defer func() {
 				ConsumePanic(s.Sentry, s.Statsd, s.Hostname, recover())
@@ -418,14 +1431,39 @@ func (s *Server) Start() {
 		logrus.Info("Tracing not configured - not reading trace socket")
 	}
 
+	if s.reloadsOnSignal() {
+		// register before returning, so that SIGHUP can't kill the process
+		// once Start has returned
+		sighup := make(chan os.Signal, 1)
+		signal.Notify(sighup, syscall.SIGHUP)
+		go s.reloadOnSignal(sighup)
+	}
+
 	// Flush every Interval forever!
 	go func() {
 		defer func() {
 			ConsumePanic(s.Sentry, s.Statsd, s.Hostname, recover())
 		}()
-		ticker := time.NewTicker(s.interval)
-		for range ticker.C {
-			s.Flush()
+		ticker := time.NewTicker(s.flushInterval())
+		// a reload may replace the ticker
+		defer func() { ticker.Stop() }()
+		for {
+			select {
+			case <-ticker.C:
+			case <-s.shutdown:
+				// Shutdown does the final flush
+				return
+			}
+			if s.flushMergeOnSkip {
+				s.flushOrSkip()
+			} else {
+				s.Flush()
+			}
+			if interval := s.applyPendingInterval(); interval != 0 {
+				// Ticker.Reset needs Go 1.15
+				ticker.Stop()
+				ticker = time.NewTicker(interval)
+			}
 		}
 	}()
 }
@@ -433,6 +1471,12 @@ func (s *Server) Start() {
 // HandleMetricPacket processes each packet that is sent to the server, and sends to an
 // appropriate worker (EventWorker or Worker).
 func (s *Server) HandleMetricPacket(packet []byte) error {
+	return s.handleMetricPacket(packet, nil)
+}
+
+// handleMetricPacket is HandleMetricPacket for a packet whose source matched
+// origin, which may be nil.
+func (s *Server) handleMetricPacket(packet []byte, origin *originRule) error {
 	// This is a very performance-sensitive function
 	// and packets may be dropped if it gets slowed down.
 	// Keep that in mind when modifying!
@@ -446,42 +1490,140 @@ func (s *Server) HandleMetricPacket(packet []byte) error {
 	if bytes.HasPrefix(packet, []byte{'_', 'e', '{'}) {
 		event, err := samplers.ParseEvent(packet)
 		if err != nil {
-			log.WithFields(logrus.Fields{
-				logrus.ErrorKey: err,
-				"packet":        string(packet),
-			}).Warn("Could not parse packet")
-			s.Statsd.Count("packet.error_total", 1, []string{"packet_type:event", "reason:parse"}, 1.0)
+			s.countParseError(err, "event", logrus.Fields{"packet": string(packet)}, "Could not parse packet")
 			return err
 		}
 		s.EventWorker.EventChan <- *event
 	} else if bytes.HasPrefix(packet, []byte{'_', 's', 'c'}) {
 		svcheck, err := samplers.ParseServiceCheck(packet)
 		if err != nil {
-			log.WithFields(logrus.Fields{
-				logrus.ErrorKey: err,
-				"packet":        string(packet),
-			}).Warn("Could not parse packet")
-			s.Statsd.Count("packet.error_total", 1, []string{"packet_type:service_check", "reason:parse"}, 1.0)
+			s.countParseError(err, "service_check", logrus.Fields{"packet": string(packet)}, "Could not parse packet")
 			return err
 		}
 		s.EventWorker.ServiceCheckChan <- *svcheck
 	} else {
 		metric, err := samplers.ParseMetric(packet)
+		if err != nil && s.statsdCompat {
+			// fall back to the lenient parser for legacy StatsD clients
+			metric, err = samplers.ParseMetricStatsD(packet)
+		}
+		if err == nil {
+			err = s.checkTagLengths(metric)
+		}
 		if err != nil {
-			log.WithFields(logrus.Fields{
-				logrus.ErrorKey: err,
-				"packet":        string(packet),
-			}).Warn("Could not parse packet")
-			s.Statsd.Count("packet.error_total", 1, []string{"packet_type:metric", "reason:parse"}, 1.0)
+			s.countParseError(err, "metric", logrus.Fields{"packet": string(packet)}, "Could not parse packet")
 			return err
 		}
-		s.Workers[metric.Digest%uint32(len(s.Workers))].PacketChan <- *metric
+		s.normalizeName(metric)
+		if origin != nil {
+			origin.Apply(metric)
+		}
+		if !s.limitTags(metric, origin) {
+			return nil
+		}
+		if s.forwardMetric(metric) {
+			return nil
+		}
+		s.scaleInput(metric)
+		s.workerFor(metric).Send(*metric)
 	}
 	return nil
 }
 
+// workerFor returns the worker that aggregates metric. Metrics are assigned
+// to workers by name alone, so that every series of a name is aggregated by
+// the same worker, the same one that imports it.
+func (s *Server) workerFor(metric *samplers.UDPMetric) *Worker {
+	return s.Workers[workerIndex(metric.Name, len(s.Workers))]
+}
+
+// normalizeName applies normalize_metric_names to the name of metric.
+func (s *Server) normalizeName(metric *samplers.UDPMetric) {
+	if name := s.normalizedName(metric.Name); name != metric.Name {
+		metric.Rename(name)
+	}
+}
+
+// normalizedName returns name as normalized by normalize_metric_names. It
+// is applied both at ingestion and at import, so that a global Veneur agrees
+// with its local Veneurs.
+func (s *Server) normalizedName(name string) string {
+	if s.lowercaseMetricNames {
+		name = strings.ToLower(name)
+	}
+	if s.metricNameReplacer != nil {
+		name = s.metricNameReplacer.Replace(name)
+	}
+	return name
+}
+
+// forwardMetric sends metric, as a DogStatsD line, to the aggregator in
+// forward_addresses that owns it, and reports whether it did. Metrics are
+// forwarded after their names are normalized and origin_tags and
+// max_tags_per_metric are applied, since the aggregators can't tell where
+// they came from, but before input scaling, which the aggregators do.
+// Distributions aren't forwarded, since the Datadog intake aggregates them
+// across hosts anyway, so they're handled locally. Lines that fail to send
+// are dropped, like any other UDP packet.
+func (s *Server) forwardMetric(metric *samplers.UDPMetric) bool {
+	if s.packetForwarder == nil || metric.Type == "distribution" {
+		return false
+	}
+	line, err := metric.DogStatsD()
+	if err != nil {
+		log.WithError(err).Warn("Could not encode metric to forward")
+		s.Statsd.Count("forward.packet_error_total", 1, []string{"reason:encode"}, 1.0)
+		return true
+	}
+	dest, err := s.packetForwarder.Forward(line, metric.MetricKey)
+	if err != nil {
+		log.WithError(err).WithField("destination", dest).Warn("Could not forward packet")
+		s.Statsd.Count("forward.packet_error_total", 1, []string{"destination:" + dest}, 1.0)
+		return true
+	}
+	s.Statsd.Count("forward.packets_total", 1, []string{"destination:" + dest}, 1.0)
+	return true
+}
+
+// limitTags enforces max_tags_per_metric on metric, trimming its tags if
+// configured to. It returns false if the metric should be dropped instead.
+// If the metric has been tagged by origin, the trusted tags are kept over
+// the client's when trimming.
+func (s *Server) limitTags(metric *samplers.UDPMetric, origin *originRule) bool {
+	if s.maxTagsPerMetric == 0 || len(metric.Tags) <= s.maxTagsPerMetric {
+		return true
+	}
+	if !s.trimExcessTags {
+		s.Statsd.Count("metric.too_many_tags", 1, []string{"action:drop"}, 1.0)
+		return false
+	}
+	s.Statsd.Count("metric.too_many_tags", 1, []string{"action:trim"}, 1.0)
+	if origin != nil {
+		origin.TrimTags(metric, s.maxTagsPerMetric)
+	} else {
+		metric.TrimTags(s.maxTagsPerMetric)
+	}
+	return true
+}
+
+// scaleInput converts the value of metric to its canonical unit using the
+// configured input_scale_factors, before it is aggregated.
+func (s *Server) scaleInput(metric *samplers.UDPMetric) {
+	if s.inputScaleFactors == nil {
+		return
+	}
+	factor, ok := s.inputScaleFactors[metric.Name]
+	if !ok {
+		return
+	}
+	if v, ok := metric.Value.(float64); ok {
+		metric.Value = v * factor
+	}
+}
+
 // HandleTracePacket accepts an incoming packet as bytes and sends it to the
-// appropriate worker.
+// appropriate worker. The packet is either a single SSF sample, or a batch
+// of them encoded by MarshalSSFBatch.
 func (s *Server) HandleTracePacket(packet []byte) {
 	// Unlike metrics, protobuf shouldn't have an issue with 0-length packets
 	if len(packet) == 0 {
@@ -490,26 +1632,134 @@ func (s *Server) HandleTracePacket(packet []byte) {
 		return
 	}
 
+	if packet[0] != ssfBatchMarker {
+		s.handleTraceSample(packet)
+		return
+	}
+	samples, err := splitSSFBatch(packet[1:])
+	for _, sample := range samples {
+		s.handleTraceSample(sample)
+	}
+	if err != nil {
+		// the rest of the packet can't be found without its length
+		s.Statsd.Count("packet.error_total", 1, []string{"packet_type:trace", "reason:framing"}, 1.0)
+		log.WithError(err).WithField("samples", len(samples)).Warn("Trace batch framing error")
+	}
+}
+
+// handleTraceSample unmarshals a single SSF sample and sends it to the trace
+// worker, unless it's dropped.
+func (s *Server) handleTraceSample(packet []byte) {
 	// Technically this could be anything, but we're only consuming trace spans
 	// for now.
 	newSample := &ssf.SSFSample{}
 	err := proto.Unmarshal(packet, newSample)
 	if err != nil {
-		s.Statsd.Count("packet.error_total", 1, []string{"packet_type:trace", "reaon:unmarshal"}, 1.0)
-		log.WithError(err).Warn("Trace unmarshaling error")
+		err = &samplers.ParseError{Reason: "unmarshal", Message: err.Error()}
+		s.countParseError(err, "trace", logrus.Fields{"length": len(packet)}, "Trace unmarshaling error")
+		return
+	}
+	s.handleSpan(newSample)
+}
+
+// handleSpan sends a span to the trace worker, unless it's dropped for its
+// service, by sampling, or as a duplicate. If tail sampling is enabled, the
+// span is held until its trace is known to be slow, unless it was kept by a
+// sampling priority or as an error, which keeps its whole trace.
+func (s *Server) handleSpan(newSample *ssf.SSFSample) {
+	if !s.checkSpanService(newSample) {
+		s.Statsd.Count("spans.dropped_total", 1, []string{"reason:missing_service"}, 1.0)
+		log.WithField("name", newSample.Name).Debug("Dropping span without a known service")
+		return
+	}
+
+	rule := ""
+	if s.spanSampler != nil {
+		var keep bool
+		if keep, rule = s.spanSampler.Sample(newSample); !keep {
+			s.Statsd.Count("spans.dropped_total", 1, []string{"reason:sampled"}, 1.0)
+			return
+		}
+	}
+
+	if s.spanDeduper != nil && s.spanDeduper.Duplicate(newSample, time.Now()) {
+		s.Statsd.Count("spans.dropped_total", 1, []string{"reason:duplicate"}, 1.0)
+		return
+	}
+
+	if s.tailSampler != nil && newSample.Trace != nil {
+		force := rule == samplingPriorityTag || rule == "error" || prioritized(newSample)
+		keep, evicted, expired := s.tailSampler.Add(*newSample, force, time.Now())
+		if evicted > 0 {
+			s.Statsd.Count("spans.dropped_total", int64(evicted), []string{"reason:tail_sample_full"}, 1.0)
+		}
+		if expired > 0 {
+			s.Statsd.Count("spans.dropped_total", int64(expired), []string{"reason:tail_sampled"}, 1.0)
+		}
+		for _, span := range keep {
+			s.TraceWorker.TraceChan <- span
+		}
 		return
 	}
 
 	s.TraceWorker.TraceChan <- *newSample
 }
 
-// ReadMetricSocket listens for available packets to handle.
-func (s *Server) ReadMetricSocket(packetPool *sync.Pool, reuseport bool) {
+// checkSpanService decides what to do with spans whose service is empty or
+// absent from the configured whitelist. If a default service is configured,
+// it is assigned to the span. It returns false if the span should be dropped.
+func (s *Server) checkSpanService(sample *ssf.SSFSample) bool {
+	if sample.Service != "" {
+		if s.traceServiceWhitelist == nil {
+			return true
+		}
+		if _, ok := s.traceServiceWhitelist[sample.Service]; ok {
+			return true
+		}
+	}
+
+	if s.traceDefaultService != "" {
+		sample.Service = s.traceDefaultService
+		return true
+	}
+	if !s.traceDropMissingService {
+		return true
+	}
+	// error spans are often the most interesting ones, so they can be kept
+	// even if we don't know where they came from. Only CRITICAL is an error;
+	// WARNING and UNKNOWN spans are treated like any other.
+	return s.traceKeepErrorsMissingService && sample.Status == ssf.SSFSample_CRITICAL
+}
+
+// checkReadBuffer logs a warning if the kernel gave conn a smaller receive
+// buffer than read_buffer_size_bytes, eg because it's over
+// net.core.rmem_max, since the socket will drop packets in bursts sooner
+// than expected. It returns whether the buffer was clamped.
+func (s *Server) checkReadBuffer(conn net.PacketConn, listener string) bool {
+	size, err := readBufferSize(conn)
+	if err != nil {
+		log.WithError(err).WithField("listener", listener).Debug("Could not check the receive buffer size")
+		return false
+	}
+	if size >= s.RcvbufBytes {
+		return false
+	}
+	log.WithFields(logrus.Fields{
+		"listener":  listener,
+		"requested": s.RcvbufBytes,
+		"applied":   size,
+	}).Warn("The kernel limited read_buffer_size_bytes; raise net.core.rmem_max to allow more")
+	return true
+}
+
+// ReadMetricSocket listens for available packets on addr, the config option
+// listener, and handles them.
+func (s *Server) ReadMetricSocket(addr *net.UDPAddr, listener string, packetPool *sync.Pool, reuseport bool) {
 	// each goroutine gets its own socket
 	// if the sockets support SO_REUSEPORT, then this will cause the
 	// kernel to distribute datagrams across them, for better read
 	// performance
-	serverConn, err := NewSocket(s.UDPAddr, s.RcvbufBytes, reuseport)
+	serverConn, err := NewSocket(addr, s.RcvbufBytes, reuseport)
 	if err != nil {
 		// if any goroutine fails to create the socket, we can't really
 		// recover, so we just blow up
@@ -517,35 +1767,142 @@ func (s *Server) ReadMetricSocket(packetPool *sync.Pool, reuseport bool) {
 		// SO_REUSEPORT support
 		log.WithError(err).Fatal("Error listening for UDP metrics")
 	}
-	log.WithField("address", s.UDPAddr).Info("Listening for UDP metrics")
+	if !s.trackUDPConn(serverConn) {
+		return
+	}
+	s.checkReadBuffer(serverConn, listener)
+	log.WithField("address", addr).Info("Listening for UDP metrics")
+	s.health.ListenerBound(listener)
 
 	for {
 		buf := packetPool.Get().([]byte)
-		n, _, err := serverConn.ReadFrom(buf)
+		n, addr, err := serverConn.ReadFrom(buf)
 		if err != nil {
+			packetPool.Put(buf)
+			select {
+			case <-s.shutdown:
+				return
+			default:
+			}
 			log.WithError(err).Error("Error reading from UDP metrics socket")
 			continue
 		}
-		if n > s.metricMaxLength {
-			s.Statsd.Count("packet.error_total", 1, []string{"packet_type:unknown", "reason:toolong"}, 1.0)
+		if !s.ingestLimiter.Allow(addr) {
+			packetPool.Put(buf)
+			continue
+		}
+		s.handleMetricDatagram(buf, n, s.originTags.ForAddr(addr))
+		packetPool.Put(buf)
+	}
+}
+
+// ReadMetricUnixSocket reads DogStatsD datagrams from the unixgram socket
+// until the server shuts down. Transient read errors are skipped, but any
+// other error means the socket is unusable, so reading stops.
+func (s *Server) ReadMetricUnixSocket(packetPool *sync.Pool) {
+	// the sender's credentials are only read if a rule needs them
+	var oob []byte
+	if s.originTags.HasUIDRules() {
+		oob = make([]byte, unixCredentialsSpace)
+	}
+	s.socketMtx.Lock()
+	conn := s.socketConn
+	s.socketMtx.Unlock()
+	for {
+		buf := packetPool.Get().([]byte)
+		n, uid, err := readUnixgram(conn, buf, oob)
+		if err != nil {
+			packetPool.Put(buf)
+			select {
+			case <-s.shutdown:
+				log.WithError(err).Info("Ignoring unixgram read error while shutting down")
+				return
+			default:
+			}
+			transient := isTransientReadError(err)
+			s.Statsd.Count("listener.read_error_total", 1, []string{"listener:" + s.SocketAddr.Name, fmt.Sprintf("transient:%t", transient)}, 1.0)
+			if !transient {
+				// the socket is unusable, so replace it; clients reconnect
+				// by path, so they reach the new one
+				log.WithError(err).Error("Re-creating unixgram metrics socket after read error")
+				s.health.ListenerFailed("socket_address")
+				conn, err = s.reopenUnixSocket(conn)
+				if err != nil {
+					log.WithError(err).Fatal("Error re-creating unixgram metrics socket")
+				}
+				if conn == nil {
+					return
+				}
+				s.health.ListenerBound("socket_address")
+				continue
+			}
+			log.WithError(err).Warn("Error reading from unixgram metrics socket")
+			continue
+		}
+		if !s.ingestLimiter.Allow(nil) {
+			packetPool.Put(buf)
 			continue
 		}
+		s.handleMetricDatagram(buf, n, s.originTags.ForUID(uid))
+		packetPool.Put(buf)
+	}
+}
 
-		// statsd allows multiple packets to be joined by newlines and sent as
-		// one larger packet
-		// note that spurious newlines are not allowed in this format, it has
-		// to be exactly one newline between each packet, with no leading or
-		// trailing newlines
-		splitPacket := samplers.NewSplitBytes(buf[:n], '\n')
-		for splitPacket.Next() {
-			s.HandleMetricPacket(splitPacket.Chunk())
+// listenUnixSocket creates the unixgram socket at SocketAddr, replacing any
+// stale socket file.
+func (s *Server) listenUnixSocket() (*net.UnixConn, error) {
+	conn, err := NewUnixgramSocket(s.SocketAddr, s.RcvbufBytes, s.socketPermissions)
+	if err != nil {
+		return nil, err
+	}
+	if s.originTags.HasUIDRules() {
+		if err := enablePeerCredentials(conn); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("enabling peer credentials for origin_tags: %v", err)
 		}
+	}
+	return conn, nil
+}
 
-		// the Metric struct created by HandleMetricPacket has no byte slices in it,
-		// only strings
-		// therefore there are no outstanding references to this byte slice, we
-		// can return it to the pool
-		packetPool.Put(buf)
+// reopenUnixSocket closes old, which failed, and replaces it with a new
+// socket at the same path. It returns nil without an error if the server is
+// shutting down.
+func (s *Server) reopenUnixSocket(old *net.UnixConn) (*net.UnixConn, error) {
+	s.socketMtx.Lock()
+	defer s.socketMtx.Unlock()
+	select {
+	case <-s.shutdown:
+		return nil, nil
+	default:
+	}
+	old.Close()
+	conn, err := s.listenUnixSocket()
+	if err != nil {
+		return nil, err
+	}
+	s.socketConn = conn
+	return conn, nil
+}
+
+// handleMetricDatagram parses the first n bytes of buf, which were read from
+// a datagram socket, as one or more metric packets. The Metric structs created
+// by HandleMetricPacket hold no references to buf, so the caller can reuse it
+// afterwards. origin is the origin_tags rule matching the datagram's sender,
+// if any.
+func (s *Server) handleMetricDatagram(buf []byte, n int, origin *originRule) {
+	if n > s.metricMaxLength {
+		s.Statsd.Count("packet.error_total", 1, []string{"packet_type:unknown", "reason:toolong"}, 1.0)
+		return
+	}
+
+	// statsd allows multiple packets to be joined by newlines and sent as
+	// one larger packet
+	// note that spurious newlines are not allowed in this format, it has
+	// to be exactly one newline between each packet, with no leading or
+	// trailing newlines
+	splitPacket := samplers.NewSplitBytes(buf[:n], '\n')
+	for splitPacket.Next() {
+		s.handleMetricPacket(splitPacket.Chunk(), origin)
 	}
 }
 
@@ -573,21 +1930,52 @@ func (s *Server) ReadTraceSocket(packetPool *sync.Pool) {
 		// SO_REUSEPORT support
 		log.WithError(err).Fatal("Error listening for UDP traces")
 	}
+	if !s.trackUDPConn(serverConn) {
+		return
+	}
+	s.checkReadBuffer(serverConn, "trace_address")
 	log.WithField("address", s.TraceAddr).Info("Listening for UDP traces")
+	s.health.ListenerBound("trace_address")
 
 	for {
 		buf := packetPool.Get().([]byte)
-		n, _, err := serverConn.ReadFrom(buf)
+		n, addr, err := serverConn.ReadFrom(buf)
 		if err != nil {
+			packetPool.Put(buf)
+			select {
+			case <-s.shutdown:
+				return
+			default:
+			}
 			log.WithError(err).Error("Error reading from UDP trace socket")
 			continue
 		}
+		if !s.ingestLimiter.Allow(addr) {
+			packetPool.Put(buf)
+			continue
+		}
 
 		s.HandleTracePacket(buf[:n])
 		packetPool.Put(buf)
 	}
 }
 
+// trackUDPConn records a reader's UDP socket for Shutdown to close. If the
+// server is already shutting down, it closes the socket instead and returns
+// false.
+func (s *Server) trackUDPConn(conn net.PacketConn) bool {
+	s.udpConnMtx.Lock()
+	defer s.udpConnMtx.Unlock()
+	select {
+	case <-s.shutdown:
+		conn.Close()
+		return false
+	default:
+	}
+	s.udpConns = append(s.udpConns, conn)
+	return true
+}
+
 func (s *Server) handleTCPGoroutine(conn net.Conn) {
 	defer func() {
 		ConsumePanic(s.Sentry, s.Statsd, s.Hostname, recover())
@@ -607,53 +1995,55 @@ func (s *Server) handleTCPGoroutine(conn net.Conn) {
 	}()
 	s.Statsd.Count("tcp.connects", 1, nil, 1.0)
 
+	listenerTags := []string{"listener:" + s.listenerAddress(conn)}
+	s.Statsd.Gauge("listener.connections", float64(atomic.AddInt64(&s.tcpConnections, 1)), listenerTags, 1.0)
+	defer func() {
+		s.Statsd.Gauge("listener.connections", float64(atomic.AddInt64(&s.tcpConnections, -1)), listenerTags, 1.0)
+	}()
+
 	// time out idle connections to prevent leaking memory/goroutines
 	timeout := defaultTCPReadTimeout
 	if s.tcpReadTimeout != 0 {
 		timeout = s.tcpReadTimeout
 	}
 
-	if tlsConn, ok := conn.(*tls.Conn); ok {
-		// complete the handshake to verify the certificate
-		conn.SetReadDeadline(time.Now().Add(timeout))
-		err := tlsConn.Handshake()
-		if err != nil {
-			// usually io.EOF or "read: connection reset by peer"; not really errors
-			// it can also be caused by certificate authentication problems
-			s.Statsd.Count("tcp.tls_handshake_failures", 1, nil, 1.0)
-			log.WithFields(logrus.Fields{
-				logrus.ErrorKey: err,
-				"peer":          conn.RemoteAddr(),
-			}).Info("TLS Handshake failed")
-
-			return
-		}
-
-		state := tlsConn.ConnectionState()
-		var clientCert pkix.RDNSequence
-		if len(state.PeerCertificates) > 0 {
-			clientCert = state.PeerCertificates[0].Subject.ToRDNSequence()
-		}
-		log.WithFields(logrus.Fields{
-			"peer":        conn.RemoteAddr(),
-			"client_cert": clientCert,
-		}).Debug("Starting TLS connection")
-	} else {
-		log.WithFields(logrus.Fields{
-			"peer": conn.RemoteAddr(),
-		}).Debug("Starting TCP connection")
+	if !s.handshakeTLS(conn, timeout, "tcp") {
+		return
 	}
 
 	// Scanner is nearly the same performance as a custom implementation
-	buf := bufio.NewScanner(conn)
+	counter := &countingReader{Reader: conn}
+	buf := bufio.NewScanner(counter)
+
+	// bytes and lines are reported in batches rather than per line, both
+	// when the connection closes and at most once per interval while it is open
+	var lines int64
+	lastReport := time.Now()
+	report := func() {
+		s.Statsd.Count("listener.bytes", counter.n, listenerTags, 1.0)
+		s.Statsd.Count("listener.lines", lines, listenerTags, 1.0)
+		counter.n = 0
+		lines = 0
+	}
+	defer report()
 
 	scanWithDeadline := func() bool {
-		conn.SetReadDeadline(time.Now().Add(timeout))
+		now := time.Now()
+		if interval := s.flushInterval(); interval > 0 && now.Sub(lastReport) > interval {
+			report()
+			lastReport = now
+		}
+		conn.SetReadDeadline(now.Add(timeout))
 		return buf.Scan()
 	}
+	origin := s.originTags.ForAddr(conn.RemoteAddr())
 	for scanWithDeadline() {
+		lines++
 		// treat each line as a separate packet
-		err := s.HandleMetricPacket(buf.Bytes())
+		if !s.ingestLimiter.Allow(conn.RemoteAddr()) {
+			continue
+		}
+		err := s.handleMetricPacket(buf.Bytes(), origin)
 		if err != nil {
 			// don't consume bad data from a client indefinitely
 			// HandleMetricPacket logs the err and packet, and increments error counters
@@ -671,6 +2061,27 @@ func (s *Server) handleTCPGoroutine(conn net.Conn) {
 	}
 }
 
+// listenerAddress returns the configured address of the listener that
+// accepted conn, for tagging per-listener metrics.
+func (s *Server) listenerAddress(conn net.Conn) string {
+	if s.TCPAddr != nil {
+		return s.TCPAddr.String()
+	}
+	return conn.LocalAddr().String()
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
 // ReadTCPSocket listens on Server.TCPAddr for new connections, starting a goroutine for each.
 func (s *Server) ReadTCPSocket() {
 	for {
@@ -690,6 +2101,8 @@ func (s *Server) ReadTCPSocket() {
 }
 
 // HTTPServe starts the HTTP server and listens perpetually until it encounters an unrecoverable error.
+// It also returns on SIGTERM or SIGUSR2, for a graceful restart; call Shutdown
+// then to flush the data that's left.
 func (s *Server) HTTPServe() {
 	var prf interface {
 		Stop()
@@ -710,6 +2123,9 @@ func (s *Server) HTTPServe() {
 		}()
 	}
 	httpSocket := bind.Socket(s.HTTPAddr)
+	if s.httpTLSConfig != nil {
+		httpSocket = tls.NewListener(httpSocket, s.httpTLSConfig)
+	}
 	graceful.Timeout(10 * time.Second)
 	graceful.PreHook(func() {
 
@@ -722,7 +2138,12 @@ func (s *Server) HTTPServe() {
 
 	// Ensure that the server responds to SIGUSR2 even
 	// when *not* running under einhorn.
-	graceful.AddSignal(syscall.SIGUSR2, syscall.SIGHUP)
+	if s.reloadsOnSignal() {
+		// SIGHUP reloads the config instead of restarting
+		graceful.AddSignal(syscall.SIGUSR2, syscall.SIGTERM)
+	} else {
+		graceful.AddSignal(syscall.SIGUSR2, syscall.SIGHUP, syscall.SIGTERM)
+	}
 	graceful.HandleSignals()
 	log.WithField("address", s.HTTPAddr).Info("HTTP server listening")
 	bind.Ready()
@@ -730,13 +2151,14 @@ func (s *Server) HTTPServe() {
 	if err := graceful.Serve(httpSocket, s.Handler()); err != nil {
 		log.WithError(err).Error("HTTP server shut down due to error")
 	}
-
 	graceful.Shutdown()
 }
 
-// Shutdown signals the server to shut down after closing all
-// current connections.
-func (s *Server) Shutdown() {
+// Shutdown stops accepting new data, and shuts the server down after
+// flushing what it has received to every sink one last time, so that the last
+// interval isn't lost. The final flush may take up to shutdown_timeout; if
+// some sinks haven't finished by then, the error names them.
+func (s *Server) Shutdown() error {
 	// TODO(aditya) shut down workers and socket readers
 	log.Info("Shutting down server gracefully")
 	close(s.shutdown)
@@ -749,7 +2171,46 @@ func (s *Server) Shutdown() {
 			log.WithError(err).Warn("Ignoring error closing TCP listener")
 		}
 	}
+	if s.ssfListener != nil {
+		if err := s.ssfListener.Close(); err != nil {
+			log.WithError(err).Warn("Ignoring error closing SSF listener")
+		}
+	}
+	if s.grpcServer != nil {
+		// streams still open are closed without their counts, but the spans
+		// they already sent are flushed below
+		s.grpcServer.Stop()
+	}
+	s.socketMtx.Lock()
+	if s.socketConn != nil {
+		if err := s.socketConn.Close(); err != nil {
+			log.WithError(err).Warn("Ignoring error closing unixgram socket")
+		}
+		if err := os.Remove(s.SocketAddr.Name); err != nil {
+			log.WithError(err).Warn("Ignoring error removing unixgram socket")
+		}
+	}
+	s.socketMtx.Unlock()
+	s.udpConnMtx.Lock()
+	for _, conn := range s.udpConns {
+		if err := conn.Close(); err != nil {
+			log.WithError(err).Warn("Ignoring error closing UDP socket")
+		}
+	}
+	s.udpConnMtx.Unlock()
+	// nothing new can arrive now, so flush whatever is left
+	err := s.flushRemaining()
+	if s.spanBuffer != nil {
+		s.spanBuffer.Close()
+	}
+	if s.packetForwarder != nil {
+		s.packetForwarder.Close()
+	}
+	if err := s.auditLog.Close(); err != nil {
+		log.WithError(err).Warn("Ignoring error closing the flush audit log")
+	}
 	graceful.Shutdown()
+	return err
 }
 
 // IsLocal indicates whether veneur is running as a local instance
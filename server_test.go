@@ -8,6 +8,7 @@ import (
 	"crypto/x509"
 	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -19,6 +20,11 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
@@ -26,10 +32,12 @@ import (
 	"github.com/Sirupsen/logrus"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/golang/protobuf/proto"
 	"github.com/stretchr/testify/assert"
 	s3p "github.com/stripe/veneur/plugins/s3"
 	s3Mock "github.com/stripe/veneur/plugins/s3/mock"
 	"github.com/stripe/veneur/samplers"
+	"github.com/stripe/veneur/ssf"
 	"github.com/stripe/veneur/tdigest"
 )
 
@@ -129,6 +137,61 @@ func generateMetrics() (metricValues []float64, expectedMetrics map[string]float
 	return metricValues, expectedMetrics
 }
 
+// withoutHeartbeat returns series without the veneur.heartbeat gauge, which
+// is sent in every flush.
+func withoutHeartbeat(series []samplers.DDMetric) []samplers.DDMetric {
+	filtered := make([]samplers.DDMetric, 0, len(series))
+	for _, metric := range series {
+		if metric.Name != heartbeatMetricName {
+			filtered = append(filtered, metric)
+		}
+	}
+	return filtered
+}
+
+// waitForProcessed waits for workers to process n metrics between them,
+// instead of sleeping for long enough that they probably have.
+func waitForProcessed(t *testing.T, n int64, workers ...*Worker) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var processed int64
+		for _, w := range workers {
+			processed += w.MetricsProcessedCount()
+		}
+		if processed >= n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("workers processed %d metrics, expected %d", processed, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// waitForSpans waits for the trace worker to store n spans, so that a
+// flush or shutdown that follows includes them.
+func waitForSpans(t *testing.T, n int64, tw *TraceWorker) {
+	deadline := time.Now().Add(5 * time.Second)
+	for tw.SpansProcessedCount() < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("the trace worker processed %d spans, expected %d", tw.SpansProcessedCount(), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// receiveFlush returns the next flush posted to the fixture's Datadog API,
+// failing instead of hanging if there is none.
+func receiveFlush(t *testing.T, f *fixture) DDMetricsRequest {
+	select {
+	case metrics := <-f.ddmetrics:
+		return metrics
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a flush")
+	}
+	return DDMetricsRequest{}
+}
+
 // assertMetrics checks that all expected metrics are present
 // and have the correct value
 func assertMetrics(t *testing.T, metrics DDMetricsRequest, expectedMetrics map[string]float64) {
@@ -155,7 +218,7 @@ func assertMetric(t *testing.T, metrics DDMetricsRequest, metricName string, val
 
 // setupVeneurServer creates a local server from the specified config
 // and starts listening for requests. It returns the server for inspection.
-func setupVeneurServer(t *testing.T, config Config, transport http.RoundTripper) Server {
+func setupVeneurServer(t *testing.T, config Config, transport http.RoundTripper) *Server {
 	server, err := NewFromConfig(config)
 	if transport != nil {
 		server.HTTPClient.Transport = transport
@@ -171,7 +234,17 @@ func setupVeneurServer(t *testing.T, config Config, transport http.RoundTripper)
 	server.Start()
 
 	go server.HTTPServe()
-	return server
+	// the goroutines Start launched hold a pointer to server, so hand out
+	// that pointer rather than a copy
+	return &server
+}
+
+// newTraceAPI starts a Datadog trace API that accepts every request, for
+// tests that need tracing enabled but only look at another span sink.
+func newTraceAPI() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
 }
 
 // DDMetricsRequest represents the body of the POST request
@@ -184,7 +257,7 @@ type DDMetricsRequest struct {
 // fixture sets up a mock Datadog API server and Veneur
 type fixture struct {
 	api             *httptest.Server
-	server          Server
+	server          *Server
 	ddmetrics       chan DDMetricsRequest
 	interval        time.Duration
 	flushMaxPerBody int
@@ -196,7 +269,7 @@ func newFixture(t *testing.T, config Config) *fixture {
 
 	// Set up a remote server (the API that we're sending the data to)
 	// (e.g. Datadog)
-	f := &fixture{nil, Server{}, make(chan DDMetricsRequest, 10), interval, config.FlushMaxPerBody}
+	f := &fixture{nil, nil, make(chan DDMetricsRequest, 10), interval, config.FlushMaxPerBody}
 	f.api = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		zr, err := zlib.NewReader(r.Body)
 		if err != nil {
@@ -210,7 +283,11 @@ func newFixture(t *testing.T, config Config) *fixture {
 			t.Fatal(err)
 		}
 
-		f.ddmetrics <- ddmetrics
+		// every background flush posts the heartbeat; only pass on the
+		// ones that contain metrics
+		if len(withoutHeartbeat(ddmetrics.Series)) > 0 {
+			f.ddmetrics <- ddmetrics
+		}
 		w.WriteHeader(http.StatusAccepted)
 	}))
 
@@ -257,10 +334,70 @@ func TestLocalServerUnaggregatedMetrics(t *testing.T) {
 	f.server.Flush()
 
 	ddmetrics := <-f.ddmetrics
-	assert.Equal(t, 6, len(ddmetrics.Series), "incorrect number of elements in the flushed series on the remote server")
+	assert.Equal(t, 6, len(withoutHeartbeat(ddmetrics.Series)), "incorrect number of elements in the flushed series on the remote server")
 	assertMetrics(t, ddmetrics, expectedMetrics)
 }
 
+// TestDistributionMetrics tests that |d metrics are sent, unaggregated, to
+// distribution_api_address, even by a local Veneur.
+func TestDistributionMetrics(t *testing.T) {
+	received := make(chan []byte, 1)
+	intake := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/v1/distribution_points", r.URL.Path)
+		assert.Equal(t, "deflate", r.Header.Get("Content-Encoding"))
+		zr, err := zlib.NewReader(r.Body)
+		if assert.NoError(t, err) {
+			body, err := ioutil.ReadAll(zr)
+			assert.NoError(t, err)
+			received <- body
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer intake.Close()
+
+	config := localConfig()
+	config.DistributionAPIAddress = intake.URL
+	config.Interval = "60s"
+	f := newFixture(t, config)
+	defer f.Close()
+
+	for _, packet := range []string{"a.b.c:1|d|#x:y", "a.b.c:2|d|@0.5|#x:y", "d.e.f:1|c"} {
+		assert.NoError(t, f.server.handleMetricPacket([]byte(packet), nil))
+	}
+	waitForProcessed(t, 3, f.server.Workers[0])
+	f.server.Flush()
+
+	select {
+	case body := <-received:
+		var payload struct {
+			Series []struct {
+				Metric string          `json:"metric"`
+				Points [][]interface{} `json:"points"`
+				Tags   []string        `json:"tags"`
+				Host   string          `json:"host"`
+			} `json:"series"`
+		}
+		assert.NoError(t, json.Unmarshal(body, &payload))
+		if assert.Len(t, payload.Series, 1, "payload was %s", body) {
+			series := payload.Series[0]
+			assert.Equal(t, "a.b.c", series.Metric)
+			assert.Equal(t, "localhost", series.Host)
+			assert.Equal(t, []string{"x:y"}, series.Tags)
+			if assert.Len(t, series.Points, 1) {
+				// the sample at a rate of 0.5 counts twice
+				assert.Equal(t, []interface{}{1.0, 2.0, 2.0}, series.Points[0][1])
+			}
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for distributions")
+	}
+
+	ddmetrics := receiveFlush(t, f)
+	for _, series := range withoutHeartbeat(ddmetrics.Series) {
+		assert.False(t, strings.HasPrefix(series.Name, "a.b.c"), "distribution %s was aggregated", series.Name)
+	}
+}
+
 func TestGlobalServerFlush(t *testing.T) {
 	metricValues, expectedMetrics := generateMetrics()
 	config := globalConfig()
@@ -283,7 +420,7 @@ func TestGlobalServerFlush(t *testing.T) {
 	f.server.Flush()
 
 	ddmetrics := <-f.ddmetrics
-	assert.Equal(t, len(expectedMetrics), len(ddmetrics.Series), "incorrect number of elements in the flushed series on the remote server")
+	assert.Equal(t, len(expectedMetrics), len(withoutHeartbeat(ddmetrics.Series)), "incorrect number of elements in the flushed series on the remote server")
 	assertMetrics(t, ddmetrics, expectedMetrics)
 }
 
@@ -402,6 +539,287 @@ func TestLocalServerMixedMetrics(t *testing.T) {
 	assert.Equal(t, tdExpected, td, "Underlying tdigest structure is incorrect")
 }
 
+func TestLocalServerForwardMinSamples(t *testing.T) {
+	forwarded := make(chan []string)
+	globalVeneur := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		zr, err := zlib.NewReader(r.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var metrics []samplers.JSONMetric
+		err = json.NewDecoder(zr).Decode(&metrics)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		names := make([]string, 0, len(metrics))
+		for _, m := range metrics {
+			names = append(names, m.Name)
+		}
+		forwarded <- names
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer globalVeneur.Close()
+
+	config := localConfig()
+	config.ForwardAddress = globalVeneur.URL
+	config.ForwardMinSamples = 3
+	f := newFixture(t, config)
+	defer f.Close()
+
+	// a.b.c has enough samples to be forwarded, d.e.f does not
+	for _, value := range []float64{1.0, 2.0, 7.0, 8.0, 100.0} {
+		f.server.Workers[0].ProcessMetric(&samplers.UDPMetric{
+			MetricKey: samplers.MetricKey{
+				Name: "a.b.c",
+				Type: "histogram",
+			},
+			Value:      value,
+			Digest:     12345,
+			SampleRate: 1.0,
+			Scope:      samplers.MixedScope,
+		})
+	}
+	f.server.Workers[0].ProcessMetric(&samplers.UDPMetric{
+		MetricKey: samplers.MetricKey{
+			Name: "d.e.f",
+			Type: "histogram",
+		},
+		Value:      1.0,
+		Digest:     12346,
+		SampleRate: 1.0,
+		Scope:      samplers.MixedScope,
+	})
+
+	f.server.Flush()
+
+	assert.Equal(t, []string{"a.b.c"}, <-forwarded, "histograms below the threshold should not be forwarded")
+
+	// the withheld histogram is flushed locally, percentiles included
+	ddmetrics := <-f.ddmetrics
+	names := make(map[string]bool)
+	for _, m := range ddmetrics.Series {
+		names[m.Name] = true
+	}
+	assert.True(t, names["d.e.f.50percentile"], "withheld histogram should be flushed with percentiles")
+	assert.False(t, names["a.b.c.50percentile"], "forwarded histogram should not be flushed with percentiles")
+}
+
+// TestForwardMinSamplesNeedsForwarding tests that forward_min_samples is
+// ignored by a veneur that doesn't forward.
+func TestForwardMinSamplesNeedsForwarding(t *testing.T) {
+	config := globalConfig()
+	config.ForwardMinSamples = 3
+	s, err := NewFromConfig(config)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, s.forwardMinSamples, "a global veneur should not withhold anything")
+}
+
+// TestLocalServerForwardOnShutdown tests that a metric ingested just before
+// a local server shuts down is forwarded to the global server, and flushed
+// from there.
+func TestLocalServerForwardOnShutdown(t *testing.T) {
+	global := newFixture(t, globalConfig())
+	defer global.Close()
+	globalVeneur := httptest.NewServer(global.server.Handler())
+	defer globalVeneur.Close()
+
+	config := localConfig()
+	config.Interval = "60s"
+	config.ForwardAddress = globalVeneur.URL
+	config.ShutdownTimeout = "5s"
+	local := newFixture(t, config)
+	defer local.Close()
+
+	for _, value := range []float64{1.0, 2.0, 3.0} {
+		local.server.Workers[0].ProcessMetric(&samplers.UDPMetric{
+			MetricKey: samplers.MetricKey{
+				Name: "a.b.c",
+				Type: "histogram",
+			},
+			Value:      value,
+			Digest:     12345,
+			SampleRate: 1.0,
+			Scope:      samplers.MixedScope,
+		})
+	}
+	local.Close()
+
+	// imports are merged asynchronously
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		w := global.server.Workers[0]
+		w.mutex.Lock()
+		imported := w.imported
+		w.mutex.Unlock()
+		if imported > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the global server never received the forwarded metric")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	global.server.Flush()
+	values := map[string]float64{}
+	for _, metric := range (<-global.ddmetrics).Series {
+		values[metric.Name] = metric.Value[0][1]
+	}
+	assert.Equal(t, 2.0, values["a.b.c.50percentile"], "the forwarded histogram should be flushed by the global server")
+}
+
+// TestShutdownFlushesSpans tests that a span ingested just before shutting
+// down reaches the sink in the final flush, without waiting for the interval.
+func TestShutdownFlushesSpans(t *testing.T) {
+	config := globalConfig()
+	config.Interval = "60s"
+	traceAPI := newTraceAPI()
+	defer traceAPI.Close()
+	config.TraceAPIAddress = traceAPI.URL
+	config.TraceStdoutSink = "stdout"
+	server := setupVeneurServer(t, config, nil)
+	lines := make(spanLines, 1)
+	server.spanWriter = lines
+
+	packet, err := proto.Marshal(&ssf.SSFSample{
+		Name:      "http.request",
+		Timestamp: time.Now().UnixNano(),
+		Trace:     &ssf.SSFTrace{TraceId: 1, Id: 1, Resource: "GET /cart", Duration: int64(time.Millisecond)},
+	})
+	assert.NoError(t, err)
+	server.HandleTracePacket(packet)
+	waitForSpans(t, 1, server.TraceWorker)
+	assert.NoError(t, server.Shutdown())
+
+	select {
+	case line := <-lines:
+		assert.Contains(t, line, `resource="GET /cart"`)
+	default:
+		assert.Fail(t, "the span should be flushed before Shutdown returns")
+	}
+}
+
+// TestShutdownTimeout tests that Shutdown gives up on a sink that doesn't
+// finish the final flush in time, and names it.
+func TestShutdownTimeout(t *testing.T) {
+	config := globalConfig()
+	config.Interval = "60s"
+	traceAPI := newTraceAPI()
+	defer traceAPI.Close()
+	config.TraceAPIAddress = traceAPI.URL
+	config.TraceStdoutSink = "stderr"
+	config.ShutdownTimeout = "100ms"
+	server := setupVeneurServer(t, config, nil)
+	// nothing reads the span, so the sink never finishes
+	lines := make(spanLines)
+	server.spanWriter = lines
+
+	packet, err := proto.Marshal(&ssf.SSFSample{
+		Name:  "http.request",
+		Trace: &ssf.SSFTrace{TraceId: 1, Id: 1, Resource: "GET /cart"},
+	})
+	assert.NoError(t, err)
+	server.HandleTracePacket(packet)
+
+	err = server.Shutdown()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "traces:stderr")
+	}
+	<-lines
+}
+
+// TestShutdownClosesUDPSockets tests that Shutdown closes the UDP metric
+// and trace sockets, so nothing arrives during the final flush.
+func TestShutdownClosesUDPSockets(t *testing.T) {
+	config := globalConfig()
+	traceAPI := newTraceAPI()
+	defer traceAPI.Close()
+	config.TraceAPIAddress = traceAPI.URL
+	server := setupVeneurServer(t, config, nil)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		listeners := server.health.Check(time.Now()).Listeners
+		if listeners["udp_address"] && listeners["trace_address"] {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the UDP listeners weren't bound: %v", listeners)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	assert.NoError(t, server.Shutdown())
+
+	for _, addr := range []*net.UDPAddr{server.UDPAddr, server.TraceAddr} {
+		conn, err := net.ListenUDP("udp", addr)
+		if assert.NoError(t, err, "%s should have been closed", addr) {
+			conn.Close()
+		}
+	}
+}
+
+// TestMetadataTags tests that registered metrics get their metadata tags at
+// flush, that unregistered ones don't, and that a reload signal reloads the
+// mapping.
+func TestMetadataTags(t *testing.T) {
+	dir, err := ioutil.TempDir("", "veneur-metadata")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "tags.yaml")
+	assert.NoError(t, ioutil.WriteFile(path, []byte("api.requests:\n  - team:payments\n"), 0644))
+
+	config := globalConfig()
+	config.MetadataTagsFile = path
+	f := newFixture(t, config)
+	defer f.Close()
+
+	flushedTags := func() map[string][]string {
+		for _, name := range []string{"api.requests", "api.requests.errors", "other.requests"} {
+			f.server.Workers[0].ProcessMetric(&samplers.UDPMetric{
+				MetricKey: samplers.MetricKey{
+					Name: name,
+					Type: "counter",
+				},
+				Value:      1.0,
+				Digest:     12345,
+				SampleRate: 1.0,
+				Scope:      samplers.MixedScope,
+			})
+		}
+		f.server.Flush()
+		tags := map[string][]string{}
+		for _, metric := range (<-f.ddmetrics).Series {
+			tags[metric.Name] = metric.Tags
+		}
+		return tags
+	}
+
+	tags := flushedTags()
+	assert.Equal(t, []string{"team:payments"}, tags["api.requests"], "a registered metric should get its team tag")
+	assert.Equal(t, []string{"team:payments"}, tags["api.requests.errors"], "metrics beneath a registered name should get its tags")
+	assert.Empty(t, tags["other.requests"], "an unregistered metric should pass through unchanged")
+
+	assert.NoError(t, ioutil.WriteFile(path, []byte("other.requests:\n  - team:search\n"), 0644))
+	// deliver the signal to the reload loop directly, rather than to the
+	// whole test process
+	sighup := make(chan os.Signal)
+	go f.server.reloadOnSignal(sighup)
+	sighup <- syscall.SIGHUP
+	deadline := time.Now().Add(5 * time.Second)
+	for f.server.metadataTags.Lookup("other.requests") == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("metadata tags were not reloaded on SIGHUP")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	tags = flushedTags()
+	assert.Empty(t, tags["api.requests"], "removed entries should no longer apply")
+	assert.Equal(t, []string{"team:search"}, tags["other.requests"])
+}
+
 func TestSplitBytes(t *testing.T) {
 	rand.Seed(time.Now().Unix())
 	buf := make([]byte, 1000)
@@ -441,67 +859,633 @@ type dummyPlugin struct {
 	logger *logrus.Logger
 	statsd *statsd.Client
 	flush  func([]samplers.DDMetric, string) error
+	// defaults to "dummy_plugin"
+	name string
 }
 
 func (dp *dummyPlugin) Flush(metrics []samplers.DDMetric, hostname string) error {
 	return dp.flush(metrics, hostname)
 }
 
-func (dp *dummyPlugin) Name() string {
-	return "dummy_plugin"
-}
+func (dp *dummyPlugin) Name() string {
+	if dp.name != "" {
+		return dp.name
+	}
+	return "dummy_plugin"
+}
+
+// TestFlushMergeOnSkip tests that when a slow plugin is still flushing at the
+// next interval, that interval is skipped and its counters are included in
+// the following flush instead.
+func TestFlushMergeOnSkip(t *testing.T) {
+	config := globalConfig()
+	config.FlushMergeOnSkip = true
+	// only flush when the test does
+	config.Interval = "60s"
+	f := newFixture(t, config)
+	defer f.Close()
+
+	release := make(chan struct{})
+	flushed := make(chan []samplers.DDMetric, 2)
+	dp := &dummyPlugin{logger: log, statsd: f.server.Statsd}
+	dp.flush = func(metrics []samplers.DDMetric, hostname string) error {
+		<-release
+		flushed <- metrics
+		return nil
+	}
+	f.server.registerPlugin(dp)
+
+	incr := func(n int) {
+		for i := 0; i < n; i++ {
+			f.server.Workers[0].ProcessMetric(&samplers.UDPMetric{
+				MetricKey: samplers.MetricKey{
+					Name: "a.b.c",
+					Type: "counter",
+				},
+				Value:      1.0,
+				Digest:     12345,
+				SampleRate: 1.0,
+				Scope:      samplers.MixedScope,
+			})
+		}
+	}
+	counterValue := func(metrics []samplers.DDMetric) float64 {
+		if !assert.Len(t, metrics, 1) {
+			t.FailNow()
+		}
+		return metrics[0].Value[0][1]
+	}
+	pluginFlush := func() []samplers.DDMetric {
+		select {
+		case metrics := <-flushed:
+			return metrics
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for the plugin to flush")
+		}
+		return nil
+	}
+
+	incr(1)
+	if !f.server.flushOrSkip() {
+		t.Fatal("first flush should start")
+	}
+	first := receiveFlush(t, f)
+
+	// the plugin is still blocked, so this interval is skipped
+	incr(2)
+	assert.False(t, f.server.flushOrSkip(), "flush should be skipped while the plugin is running")
+
+	close(release)
+	assert.InEpsilon(t, 1.0, counterValue(pluginFlush())*f.interval.Seconds(), 0.001)
+	assert.InEpsilon(t, 1.0, counterValue(withoutHeartbeat(first.Series))*f.interval.Seconds(), 0.001)
+
+	incr(3)
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&f.server.flushing) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("previous flush never completed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if !f.server.flushOrSkip() {
+		t.Fatal("flush should start once the previous one completed")
+	}
+	// the second flush covers two intervals, so its rate is over both
+	second := receiveFlush(t, f)
+	assert.InEpsilon(t, 5.0, counterValue(withoutHeartbeat(second.Series))*2*f.interval.Seconds(), 0.001,
+		"the skipped interval's counts should be merged into the next flush")
+	assert.InEpsilon(t, 5.0, counterValue(pluginFlush())*2*f.interval.Seconds(), 0.001)
+}
+
+// TestInputScaleFactors tests that a timer sent in nanoseconds is converted
+// to milliseconds before it is aggregated.
+func TestInputScaleFactors(t *testing.T) {
+	config := globalConfig()
+	config.InputScaleFactors = map[string]float64{"a.b.c": 1e-6}
+	f := newFixture(t, config)
+	defer f.Close()
+
+	for _, packet := range []string{"a.b.c:2500000|ms", "a.b.c:1000000|ms", "d.e.f:2500000|ms"} {
+		assert.NoError(t, f.server.HandleMetricPacket([]byte(packet)))
+	}
+	waitForProcessed(t, 3, f.server.Workers[0])
+
+	f.server.Flush()
+	values := map[string]float64{}
+	for _, metric := range (<-f.ddmetrics).Series {
+		values[metric.Name] = metric.Value[0][1]
+	}
+	assert.InEpsilon(t, 2.5, values["a.b.c.max"], 1e-9, "scaled timer should aggregate as milliseconds")
+	assert.InEpsilon(t, 1.0, values["a.b.c.min"], 1e-9, "scaled timer should aggregate as milliseconds")
+	assert.Equal(t, 2500000.0, values["d.e.f.max"], "other metrics should not be scaled")
+}
+
+func TestEmitCounterCounts(t *testing.T) {
+	config := globalConfig()
+	config.EmitCounterCounts = true
+	f := newFixture(t, config)
+	defer f.Close()
+
+	assert.NoError(t, f.server.HandleMetricPacket([]byte("a.b.c:5|c")))
+	waitForProcessed(t, 1, f.server.Workers[0])
+
+	f.server.Flush()
+	flushed := map[string]samplers.DDMetric{}
+	for _, metric := range (<-f.ddmetrics).Series {
+		flushed[metric.Name] = metric
+	}
+	if assert.Contains(t, flushed, "a.b.c", "the rate should still be flushed") {
+		assert.Equal(t, "rate", flushed["a.b.c"].MetricType)
+		assert.Equal(t, 5/f.server.interval.Seconds(), flushed["a.b.c"].Value[0][1])
+	}
+	if assert.Contains(t, flushed, "a.b.c.count", "the raw count should be flushed too") {
+		assert.Equal(t, "count", flushed["a.b.c.count"].MetricType)
+		assert.Equal(t, 5.0, flushed["a.b.c.count"].Value[0][1])
+	}
+}
+
+func TestNormalizeMetricNames(t *testing.T) {
+	config := globalConfig()
+	config.NormalizeMetricNames.Lowercase = true
+	config.NormalizeMetricNames.CharacterMap = map[string]string{"-": "_"}
+	f := newFixture(t, config)
+	defer f.Close()
+
+	for _, packet := range []string{"HTTP.Requests:1|c", "http.requests:2|c", "http.Status-Codes:1|g"} {
+		assert.NoError(t, f.server.HandleMetricPacket([]byte(packet)))
+	}
+	waitForProcessed(t, 3, f.server.Workers[0])
+
+	f.server.Flush()
+	series := withoutHeartbeat((<-f.ddmetrics).Series)
+	names := make([]string, 0, len(series))
+	values := map[string]float64{}
+	for _, metric := range series {
+		names = append(names, metric.Name)
+		values[metric.Name] = metric.Value[0][1]
+	}
+	assert.Len(t, names, 2, "differently-cased names should aggregate into one series: %v", names)
+	assert.Equal(t, 3/f.server.interval.Seconds(), values["http.requests"])
+	assert.Contains(t, values, "http.status_codes")
+}
+
+func TestStatsdCompat(t *testing.T) {
+	config := globalConfig()
+	config.StatsdCompat = true
+	f := newFixture(t, config)
+	defer f.Close()
+
+	assert.NoError(t, f.server.HandleMetricPacket([]byte("web01:8080.requests:3|g|")))
+	assert.NoError(t, f.server.HandleMetricPacket([]byte("a.b.c:1|g|#foo:bar")))
+	waitForProcessed(t, 2, f.server.Workers[0])
+
+	f.server.Flush()
+	flushed := map[string]samplers.DDMetric{}
+	for _, metric := range (<-f.ddmetrics).Series {
+		flushed[metric.Name] = metric
+	}
+	assert.Equal(t, 3.0, flushed["web01:8080.requests"].Value[0][1], "legacy StatsD lines should be accepted")
+	assert.Contains(t, flushed["a.b.c"].Tags, "foo:bar", "DogStatsD lines should keep their tags")
+}
+
+func TestTopKCounters(t *testing.T) {
+	config := globalConfig()
+	config.NumWorkers = 4
+	config.TopkCounters = map[string]int{"a.b.c": 2}
+	f := newFixture(t, config)
+	defer f.Close()
+
+	packets := []string{"a.b.c:10|c|#customer:a", "a.b.c:5|c|#customer:b", "a.b.c:1|c|#customer:c", "a.b.c:1|c|#customer:d"}
+	for _, packet := range packets {
+		assert.NoError(t, f.server.HandleMetricPacket([]byte(packet)))
+	}
+	waitForProcessed(t, int64(len(packets)), f.server.Workers...)
+
+	f.server.Flush()
+	counts := map[string]float64{}
+	for _, metric := range (<-f.ddmetrics).Series {
+		for _, tag := range metric.Tags {
+			if strings.HasPrefix(tag, "customer:") || tag == samplers.TopKOtherTag {
+				counts[tag] = metric.Value[0][1] * f.interval.Seconds()
+			}
+		}
+	}
+	assert.Len(t, counts, 3, "every tag combination should reach the same top-K counter: %v", counts)
+	assert.InEpsilon(t, 10, counts["customer:a"], 1e-9)
+	assert.InEpsilon(t, 5, counts["customer:b"], 1e-9)
+	assert.InEpsilon(t, 2, counts[samplers.TopKOtherTag], 1e-9)
+}
+
+func TestWorkerSharding(t *testing.T) {
+	config := globalConfig()
+	config.NumWorkers = 4
+	config.Interval = "60s" // only flush when the test does
+	f := newFixture(t, config)
+	defer f.Close()
+
+	packets := []string{"a.b.c:1|c|#foo:bar", "a.b.c:2|c|#foo:bar", "a.b.c:4|c|#foo:baz"}
+	for _, packet := range packets {
+		assert.NoError(t, f.server.HandleMetricPacket([]byte(packet)))
+	}
+	w := f.server.Workers[workerIndex("a.b.c", len(f.server.Workers))]
+	waitForProcessed(t, int64(len(packets)), w)
+
+	f.server.Flush()
+	counts := map[string]float64{}
+	for _, metric := range (<-f.ddmetrics).Series {
+		if metric.Name == "a.b.c" {
+			counts[strings.Join(metric.Tags, ",")] += metric.Value[0][1] * f.interval.Seconds()
+		}
+	}
+	assert.Len(t, counts, 2, "samples from different packets should aggregate together: %v", counts)
+	assert.InEpsilon(t, 3, counts["foo:bar"], 1e-9)
+	assert.InEpsilon(t, 4, counts["foo:baz"], 1e-9)
+}
+
+func TestMaxTagsPerMetric(t *testing.T) {
+	tags := make([]string, 30)
+	for i := range tags {
+		tags[i] = fmt.Sprintf("tag%02d:value", 29-i)
+	}
+	packet := "a.b.c:1|g|#" + strings.Join(tags, ",")
+
+	for _, action := range []string{"drop", "trim"} {
+		t.Run(action, func(t *testing.T) {
+			config := globalConfig()
+			config.MaxTagsPerMetric = 10
+			config.TooManyTagsAction = action
+			f := newFixture(t, config)
+			defer f.Close()
+
+			assert.NoError(t, f.server.HandleMetricPacket([]byte(packet)))
+			assert.NoError(t, f.server.HandleMetricPacket([]byte("d.e.f:1|g|#foo:bar")))
+			processed := int64(2)
+			if action == "drop" {
+				processed = 1
+			}
+			waitForProcessed(t, processed, f.server.Workers[0])
+
+			f.server.Flush()
+			flushed := map[string][]string{}
+			for _, metric := range (<-f.ddmetrics).Series {
+				flushed[metric.Name] = metric.Tags
+			}
+			assert.Contains(t, flushed, "d.e.f", "metrics under the limit should be kept")
+			if action == "drop" {
+				assert.NotContains(t, flushed, "a.b.c")
+				return
+			}
+			for i := 0; i < 10; i++ {
+				assert.Contains(t, flushed["a.b.c"], fmt.Sprintf("tag%02d:value", i), "should keep the first tags in sorted order")
+			}
+			assert.NotContains(t, flushed["a.b.c"], "tag10:value")
+		})
+	}
+
+	config := localConfig()
+	config.MaxTagsPerMetric = -1
+	_, err := NewFromConfig(config)
+	assert.Error(t, err, "a negative limit should be a config error")
+}
+
+func TestMaxTagSetsPerMetric(t *testing.T) {
+	config := globalConfig()
+	config.NumWorkers = 4
+	config.MaxTagSetsPerMetric = 100
+	config.Interval = "60s" // only flush when the test does
+	addr, stats := listenStatsd(t)
+	config.StatsAddress = addr
+	f := newFixture(t, config)
+	defer f.Close()
+
+	packets := []string{"d.e.f:1|g|#foo:bar"}
+	for i := 0; i < 1000; i++ {
+		packets = append(packets, fmt.Sprintf("a.b.c:1|g|#request:%d", i))
+	}
+	for i := 0; i < 150; i++ {
+		packets = append(packets, fmt.Sprintf("g.h.i:1|g|#request:%d", i))
+	}
+	for _, packet := range packets {
+		assert.NoError(t, f.server.HandleMetricPacket([]byte(packet)))
+	}
+	waitForProcessed(t, int64(len(packets)), f.server.Workers...)
+
+	f.server.Flush()
+	flushed := map[string]int{}
+	for _, metric := range (<-f.ddmetrics).Series {
+		flushed[metric.Name]++
+	}
+	assert.Equal(t, 100, flushed["a.b.c"], "the limit should hold for every series of the name")
+	assert.Equal(t, 100, flushed["g.h.i"], "the limit should hold for every series of the name")
+	assert.Equal(t, 1, flushed["d.e.f"], "other metrics should be unaffected")
+	// the drops of both names are summed into one untagged count
+	waitForStat(t, stats, "veneur.metric.tag_sets_dropped:950|c|#veneurlocalonly")
+}
+
+// TestGlobalServerPluginFlush tests that we are able to
+// register a dummy plugin on the server, and that when we do,
+// flushing on the server causes the plugin to flush
+func TestGlobalServerPluginFlush(t *testing.T) {
+
+	RemoteResponseChan := make(chan struct{}, 1)
+	defer func() {
+		select {
+		case <-RemoteResponseChan:
+			// all is safe
+			return
+		case <-time.After(DefaultServerTimeout):
+			assert.Fail(t, "Global server did not complete all responses before test terminated!")
+		}
+	}()
+
+	metricValues, expectedMetrics := generateMetrics()
+	config := globalConfig()
+	f := newFixture(t, config)
+	defer f.Close()
+
+	dp := &dummyPlugin{logger: log, statsd: f.server.Statsd}
+
+	dp.flush = func(metrics []samplers.DDMetric, hostname string) error {
+		if len(metrics) == 0 {
+			// the final flush on shutdown
+			return nil
+		}
+		assert.Equal(t, len(expectedMetrics), len(metrics))
+
+		firstName := metrics[0].Name
+		assert.Equal(t, expectedMetrics[firstName], metrics[0].Value[0][1])
+
+		assert.Equal(t, hostname, f.server.Hostname)
+
+		RemoteResponseChan <- struct{}{}
+		return nil
+	}
+
+	f.server.registerPlugin(dp)
+
+	for _, value := range metricValues {
+		f.server.Workers[0].ProcessMetric(&samplers.UDPMetric{
+			MetricKey: samplers.MetricKey{
+				Name: "a.b.c",
+				Type: "histogram",
+			},
+			Value:      value,
+			Digest:     12345,
+			SampleRate: 1.0,
+			Scope:      samplers.LocalOnly,
+		})
+	}
+
+	f.server.Flush()
+}
+
+type dummySummaryPlugin struct {
+	dummyPlugin
+	flushSummaries func([]samplers.DDSummary, string) error
+}
+
+func (dp *dummySummaryPlugin) FlushSummaries(summaries []samplers.DDSummary, hostname string) error {
+	return dp.flushSummaries(summaries, hostname)
+}
+
+// TestPercentilesAsSummaries tests that a plugin that supports summaries gets
+// one summary for a histogram, where Datadog gets a gauge per percentile.
+func TestPercentilesAsSummaries(t *testing.T) {
+	metricValues, _ := generateMetrics()
+	config := globalConfig()
+	config.PercentilesAsSummaries = true
+	f := newFixture(t, config)
+	defer f.Close()
+
+	type flush struct {
+		metrics   []samplers.DDMetric
+		summaries []samplers.DDSummary
+	}
+	flushed := make(chan flush, 10)
+	var metrics []samplers.DDMetric
+	dp := &dummySummaryPlugin{dummyPlugin: dummyPlugin{logger: log, statsd: f.server.Statsd}}
+	// Flush is always called before FlushSummaries
+	dp.flush = func(m []samplers.DDMetric, hostname string) error {
+		metrics = m
+		return nil
+	}
+	dp.flushSummaries = func(summaries []samplers.DDSummary, hostname string) error {
+		flushed <- flush{metrics, summaries}
+		return nil
+	}
+	f.server.registerPlugin(dp)
+
+	for _, value := range metricValues {
+		f.server.Workers[0].ProcessMetric(&samplers.UDPMetric{
+			MetricKey:  samplers.MetricKey{Name: "a.b.c", Type: "histogram"},
+			Value:      value,
+			Digest:     12345,
+			SampleRate: 1.0,
+			Scope:      samplers.LocalOnly,
+		})
+	}
+	f.server.Flush()
+
+	percentiles := map[string]float64{}
+	for _, metric := range (<-f.ddmetrics).Series {
+		if strings.HasSuffix(metric.Name, "percentile") {
+			percentiles[metric.Name] = metric.Value[0][1]
+		}
+	}
+	assert.Len(t, percentiles, 3, "Datadog should get a gauge per percentile")
+
+	var summary flush
+	select {
+	case summary = <-flushed:
+	case <-time.After(DefaultServerTimeout):
+		t.Fatal("timed out waiting for summaries")
+	}
+	if assert.Len(t, summary.summaries, 1, "the plugin should get one summary") {
+		s := summary.summaries[0]
+		assert.Equal(t, "a.b.c", s.Name)
+		assert.Equal(t, f.server.Hostname, s.Hostname)
+		assert.Equal(t, []samplers.SummaryQuantile{
+			{Quantile: 0.5, Value: percentiles["a.b.c.50percentile"]},
+			{Quantile: 0.75, Value: percentiles["a.b.c.75percentile"]},
+			{Quantile: 0.99, Value: percentiles["a.b.c.99percentile"]},
+		}, s.Quantiles)
+	}
+	for _, metric := range summary.metrics {
+		assert.False(t, strings.HasSuffix(metric.Name, "percentile"), "%s should be in the summary instead", metric.Name)
+	}
+	assert.Len(t, summary.metrics, f.server.HistogramAggregates.Count, "the aggregates should still be flushed")
+}
+
+func TestPercentilesConfig(t *testing.T) {
+	config := localConfig()
+	config.Percentiles = nil
+	s, err := NewFromConfig(config)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []float64{0.5, 0.9, 0.95, 0.99}, s.histogramPercentiles, "unset percentiles should default")
+	}
 
-// TestGlobalServerPluginFlush tests that we are able to
-// register a dummy plugin on the server, and that when we do,
-// flushing on the server causes the plugin to flush
-func TestGlobalServerPluginFlush(t *testing.T) {
+	config.Percentiles = []float64{}
+	s, err = NewFromConfig(config)
+	if assert.NoError(t, err) {
+		assert.Empty(t, s.histogramPercentiles, "an empty list should disable percentiles")
+	}
 
-	RemoteResponseChan := make(chan struct{}, 1)
-	defer func() {
-		select {
-		case <-RemoteResponseChan:
-			// all is safe
-			return
-		case <-time.After(DefaultServerTimeout):
-			assert.Fail(t, "Global server did not complete all responses before test terminated!")
-		}
-	}()
+	config.Percentiles = []float64{0.25, 0.75, 0.999}
+	s, err = NewFromConfig(config)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []float64{0.25, 0.75, 0.999}, s.histogramPercentiles)
+	}
 
-	metricValues, expectedMetrics := generateMetrics()
-	config := globalConfig()
+	for _, p := range []float64{0, 1, -0.5, 99} {
+		config.Percentiles = []float64{0.5, p}
+		_, err = NewFromConfig(config)
+		assert.Error(t, err, "percentile %v should be rejected", p)
+	}
+}
+
+// TestAggregatesConfig tests that only the configured aggregates of a
+// histogram are flushed.
+func TestAggregatesConfig(t *testing.T) {
+	config := localConfig()
+	config.Aggregates = []string{"count", "sum"}
+	// only flush when the test does
+	config.Interval = "60s"
+	config.Percentiles = []float64{0.99}
 	f := newFixture(t, config)
 	defer f.Close()
 
-	dp := &dummyPlugin{logger: log, statsd: f.server.Statsd}
-
-	dp.flush = func(metrics []samplers.DDMetric, hostname string) error {
-		assert.Equal(t, len(expectedMetrics), len(metrics))
+	for _, value := range []float64{1, 2, 3} {
+		f.server.Workers[0].ProcessMetric(&samplers.UDPMetric{
+			MetricKey:  samplers.MetricKey{Name: "a.b.c", Type: "histogram"},
+			Value:      value,
+			SampleRate: 1.0,
+			Scope:      samplers.LocalOnly,
+		})
+	}
+	f.server.Flush()
 
-		firstName := metrics[0].Name
-		assert.Equal(t, expectedMetrics[firstName], metrics[0].Value[0][1])
+	var names []string
+	for _, metric := range withoutHeartbeat(receiveFlush(t, f).Series) {
+		names = append(names, metric.Name)
+	}
+	sort.Strings(names)
+	assert.Equal(t, []string{"a.b.c.99percentile", "a.b.c.count", "a.b.c.sum"}, names)
 
-		assert.Equal(t, hostname, f.server.Hostname)
+	config.Aggregates = []string{"min", "maximum"}
+	_, err := NewFromConfig(config)
+	assert.Error(t, err, "unknown aggregates should be rejected")
 
-		RemoteResponseChan <- struct{}{}
-		return nil
+	config.Aggregates = nil
+	s, err := NewFromConfig(config)
+	if assert.NoError(t, err) {
+		assert.Equal(t, samplers.AggregateMin|samplers.AggregateMax|samplers.AggregateCount, s.HistogramAggregates.Value, "unset aggregates should default")
 	}
+}
 
-	f.server.registerPlugin(dp)
+// TestMetricPrefix tests that every series a histogram flushes is prefixed
+// exactly once, and that the heartbeat isn't.
+func TestMetricPrefix(t *testing.T) {
+	config := localConfig()
+	// only flush when the test does
+	config.Interval = "60s"
+	config.MetricPrefix = "team"
+	config.Aggregates = []string{"min", "max", "count"}
+	config.Percentiles = []float64{0.5, 0.99}
+	f := newFixture(t, config)
+	defer f.Close()
 
-	for _, value := range metricValues {
+	for _, name := range []string{"a.b.c", "team.d.e.f"} {
 		f.server.Workers[0].ProcessMetric(&samplers.UDPMetric{
-			MetricKey: samplers.MetricKey{
-				Name: "a.b.c",
-				Type: "histogram",
-			},
-			Value:      value,
-			Digest:     12345,
+			MetricKey:  samplers.MetricKey{Name: name, Type: "histogram"},
+			Value:      1.0,
 			SampleRate: 1.0,
 			Scope:      samplers.LocalOnly,
 		})
 	}
-
 	f.server.Flush()
+
+	var names []string
+	for _, metric := range receiveFlush(t, f).Series {
+		names = append(names, metric.Name)
+	}
+	sort.Strings(names)
+	assert.Equal(t, []string{
+		"team.a.b.c.50percentile",
+		"team.a.b.c.99percentile",
+		"team.a.b.c.count",
+		"team.a.b.c.max",
+		"team.a.b.c.min",
+		"team.d.e.f.50percentile",
+		"team.d.e.f.99percentile",
+		"team.d.e.f.count",
+		"team.d.e.f.max",
+		"team.d.e.f.min",
+		"veneur.heartbeat",
+	}, names)
+}
+
+// TestFlushPluginsConcurrently tests that plugins are flushed at the same
+// time, so a slow plugin doesn't hold up the others, and that their errors
+// are collected.
+func TestFlushPluginsConcurrently(t *testing.T) {
+	s, err := NewFromConfig(globalConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := []samplers.DDMetric{{Name: "a.b.c", Tags: []string{"foo:bar"}}}
+
+	// each plugin blocks until the test releases it, so the test can see
+	// which are flushing at the same time
+	started := make(chan string, 2)
+	release := make(chan struct{})
+	plugin := func(name string, err error) *dummyPlugin {
+		return &dummyPlugin{name: name, flush: func(m []samplers.DDMetric, hostname string) error {
+			// each plugin gets its own copy to modify
+			m[0].Tags[0] = name
+			started <- name
+			<-release
+			return err
+		}}
+	}
+	s.registerPlugin(plugin("slow", nil))
+	s.registerPlugin(plugin("fast", errors.New("boom")))
+	flush := func() <-chan error {
+		result := make(chan error, 1)
+		go func() { result <- s.flushPlugins(metrics, nil) }()
+		return result
+	}
+	next := func() string {
+		select {
+		case name := <-started:
+			return name
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for a plugin to start flushing")
+			return ""
+		}
+	}
+
+	result := flush()
+	names := []string{next(), next()}
+	sort.Strings(names)
+	assert.Equal(t, []string{"fast", "slow"}, names, "both plugins should flush at the same time")
+	close(release)
+	err = <-result
+	assert.Equal(t, []string{"foo:bar"}, metrics[0].Tags, "plugins should not modify the flushed metrics")
+	if assert.IsType(t, pluginErrors{}, err) {
+		assert.Len(t, err.(pluginErrors), 1)
+		assert.EqualError(t, err.(pluginErrors)["fast"], "boom")
+	}
+
+	// with a concurrency of 1, the plugins are flushed one at a time
+	s.pluginFlushConcurrency = 1
+	release = make(chan struct{})
+	result = flush()
+	assert.Equal(t, "slow", next())
+	assert.Len(t, started, 0, "the second plugin shouldn't start until the first finishes")
+	release <- struct{}{}
+	assert.Equal(t, "fast", next())
+	release <- struct{}{}
+	<-result
 }
 
 // TestLocalFilePluginRegister tests that we are able to register
@@ -547,6 +1531,10 @@ func TestGlobalServerS3PluginFlush(t *testing.T) {
 
 		records, err := parseGzipTSV(input.Body)
 		assert.NoError(t, err)
+		if len(records) == 0 {
+			// the final flush on shutdown
+			return &s3.PutObjectOutput{}, nil
+		}
 
 		expectedRecords, err := parseGzipTSV(f)
 		assert.NoError(t, err)
@@ -613,24 +1601,25 @@ func assertCSVFieldsMatch(t *testing.T, expected, actual [][]string, columns []i
 
 func readTestKeysCerts() (map[string]string, error) {
 	// reads the insecure test keys and certificates in fixtures generated with:
-	// # Generate the authority key and certificate (512-bit RSA signed using SHA-256)
-	// openssl genrsa -out cakey.pem 512
-	// openssl req -new -x509 -key cakey.pem -out cacert.pem -days 1095 -subj "/O=Example Inc/CN=Example Certificate Authority"
+	// # Generate the authority key and certificate (2048-bit RSA signed using SHA-256)
+	// openssl genrsa -out cakey.pem 2048
+	// openssl req -new -x509 -key cakey.pem -out cacert.pem -days 36500 -subj "/O=Example Inc/CN=Example Certificate Authority"
 
 	// # Generate the server key and certificate, signed by the authority
-	// openssl genrsa -out serverkey.pem 512
-	// openssl req -new -key serverkey.pem -out serverkey.csr -days 1095 -subj "/O=Example Inc/CN=localhost"
-	// openssl x509 -req -in serverkey.csr -CA cacert.pem -CAkey cakey.pem -CAcreateserial -out servercert.pem -days 1095
+	// openssl genrsa -out serverkey.pem 2048
+	// openssl req -new -key serverkey.pem -out serverkey.csr -subj "/O=Example Inc/CN=localhost"
+	// echo subjectAltName=DNS:localhost,IP:127.0.0.1 > san.ext
+	// openssl x509 -req -in serverkey.csr -CA cacert.pem -CAkey cakey.pem -CAcreateserial -out servercert.pem -days 36500 -extfile san.ext
 
 	// # Generate a client key and certificate, signed by the authority
-	// openssl genrsa -out clientkey.pem 512
-	// openssl req -new -key clientkey.pem -out clientkey.csr -days 1095 -subj "/O=Example Inc/CN=Veneur client key"
-	// openssl x509 -req -in clientkey.csr -CA cacert.pem -CAkey cakey.pem -CAcreateserial -out clientcert.pem -days 1095
+	// openssl genrsa -out clientkey.pem 2048
+	// openssl req -new -key clientkey.pem -out clientkey.csr -subj "/O=Example Inc/CN=Veneur client key"
+	// openssl x509 -req -in clientkey.csr -CA cacert.pem -CAkey cakey.pem -CAcreateserial -out clientcert.pem -days 36500
 
 	// # Generate another ca and sign the client key
-	// openssl genrsa -out wrongcakey.pem 512
-	// openssl req -new -x509 -key wrongcakey.pem -out wrongcacert.pem -days 1095 -subj "/O=Wrong Inc/CN=Wrong Certificate Authority"
-	// openssl x509 -req -in clientkey.csr -CA wrongcacert.pem -CAkey wrongcakey.pem -CAcreateserial -out wrongclientcert.pem -days 1095
+	// openssl genrsa -out wrongcakey.pem 2048
+	// openssl req -new -x509 -key wrongcakey.pem -out wrongcacert.pem -days 36500 -subj "/O=Wrong Inc/CN=Wrong Certificate Authority"
+	// openssl x509 -req -in clientkey.csr -CA wrongcacert.pem -CAkey wrongcakey.pem -CAcreateserial -out wrongclientcert.pem -days 36500
 
 	pems := map[string]string{}
 	pemFileNames := []string{
@@ -691,6 +1680,42 @@ func TestTCPConfig(t *testing.T) {
 	}
 }
 
+// TestTCPNewlineDelimited sends two metrics on one plain TCP connection,
+// without TLS, and checks that both are parsed.
+func TestTCPNewlineDelimited(t *testing.T) {
+	config := localConfig()
+	config.NumWorkers = 1
+	config.Interval = "60s"
+	config.TcpAddress = fmt.Sprintf("localhost:%d", HTTPAddrPort)
+	HTTPAddrPort++
+	config.TcpReadTimeout = "soon"
+	_, err := NewFromConfig(config)
+	assert.Error(t, err, "an invalid read timeout is a config error")
+
+	config.TcpReadTimeout = "5m"
+	f := newFixture(t, config)
+	defer f.Close()
+	assert.Equal(t, 5*time.Minute, f.server.tcpReadTimeout)
+
+	conn, err := net.Dial("tcp", config.TcpAddress)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte("page.views:1|c\nqueue.depth:3|g\n"))
+	assert.NoError(t, err)
+
+	waitForProcessed(t, 2, f.server.Workers[0])
+	f.server.Flush()
+	series := withoutHeartbeat(receiveFlush(t, f).Series)
+	names := make([]string, len(series))
+	for i, metric := range series {
+		names[i] = metric.Name
+	}
+	sort.Strings(names)
+	assert.Equal(t, []string{"page.views", "queue.depth"}, names)
+}
+
 func sendTCPMetrics(addr string, tlsConfig *tls.Config, f *fixture) error {
 	// TODO: attempt to ensure the accept goroutine opens the port before we attempt to connect
 	// connect and send stats in two parts
@@ -720,11 +1745,12 @@ func sendTCPMetrics(addr string, tlsConfig *tls.Config, f *fixture) error {
 	f.server.Flush()
 	select {
 	case ddmetrics := <-f.ddmetrics:
-		if len(ddmetrics.Series) != 1 {
-			return fmt.Errorf("unexpected Series: %v", ddmetrics.Series)
+		series := withoutHeartbeat(ddmetrics.Series)
+		if len(series) != 1 {
+			return fmt.Errorf("unexpected Series: %v", series)
 		}
-		if !(ddmetrics.Series[0].Name == "page.views" && ddmetrics.Series[0].Value[0][1] == 40) {
-			return fmt.Errorf("unexpected metric: %v", ddmetrics.Series[0])
+		if !(series[0].Name == "page.views" && series[0].Value[0][1] == 40) {
+			return fmt.Errorf("unexpected metric: %v", series[0])
 		}
 
 	case <-time.After(100 * time.Millisecond):
@@ -755,6 +1781,165 @@ func TestUDPMetrics(t *testing.T) {
 	assert.Equal(t, int64(1), f.server.Workers[0].MetricsProcessedCount(), "worker processed metric")
 }
 
+func TestUnixgramMetrics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "veneur-unixgram")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "statsd.sock")
+
+	config := localConfig()
+	config.NumWorkers = 1
+	config.Interval = "60s"
+	config.SocketAddress = "unixgram://" + path
+	config.SocketPermissions = "0660"
+	f := newFixture(t, config)
+	defer f.Close()
+
+	fi, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0660), fi.Mode().Perm(), "socket should have the configured permissions")
+
+	conn, err := net.Dial("unixgram", path)
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("foo.bar:1|c|#baz:gorch\nfoo.baz:2|g"))
+	assert.NoError(t, err)
+	waitForProcessed(t, 2, f.server.Workers[0])
+
+	f.Close()
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err), "socket should be removed on shutdown")
+}
+
+func TestUnixgramSocketRecreated(t *testing.T) {
+	dir, err := ioutil.TempDir("", "veneur-unixgram")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "statsd.sock")
+
+	config := localConfig()
+	config.NumWorkers = 1
+	config.Interval = "60s"
+	config.SocketAddress = "unixgram://" + path
+	f := newFixture(t, config)
+	defer f.Close()
+
+	// a closed socket fails every read, like one that broke
+	f.server.socketMtx.Lock()
+	broken := f.server.socketConn
+	f.server.socketMtx.Unlock()
+	broken.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		f.server.socketMtx.Lock()
+		recreated := f.server.socketConn != broken
+		f.server.socketMtx.Unlock()
+		if recreated && f.server.health.Check(time.Now()).Listeners["socket_address"] {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("The socket was not re-created and marked healthy")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	conn, err := net.Dial("unixgram", path)
+	assert.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("foo.bar:1|c"))
+	assert.NoError(t, err)
+	waitForProcessed(t, 1, f.server.Workers[0])
+}
+
+func TestOriginTags(t *testing.T) {
+	config := localConfig()
+	config.NumWorkers = 1
+	config.Interval = "60s"
+	config.UdpAddress = fmt.Sprintf("127.0.0.1:%d", HTTPAddrPort)
+	HTTPAddrPort++
+	config.OriginTags = []OriginTagRule{
+		{Source: "10.0.0.0/8", Tags: []string{"service:other"}},
+		{Source: "127.0.0.0/8", Tags: []string{"service:trusted"}, Override: true},
+	}
+	f := newFixture(t, config)
+	defer f.Close()
+	// Add a bit of delay to ensure things get listening
+	time.Sleep(20 * time.Millisecond)
+
+	conn, err := net.Dial("udp", config.UdpAddress)
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	conn.Write([]byte("foo.bar:1|c|#baz:gorch,service:impostor"))
+	waitForProcessed(t, 1, f.server.Workers[0])
+	f.server.Flush()
+	series := withoutHeartbeat(receiveFlush(t, f).Series)
+	assert.Len(t, series, 1)
+	assert.Equal(t, []string{"baz:gorch", "service:trusted"}, series[0].Tags, "the client's service tag should be overridden")
+}
+
+func TestOriginTagsMaxTagsPerMetric(t *testing.T) {
+	config := globalConfig()
+	config.MaxTagsPerMetric = 2
+	config.TooManyTagsAction = "trim"
+	config.OriginTags = []OriginTagRule{
+		{Source: "127.0.0.0/8", Tags: []string{"service:trusted"}},
+	}
+	f := newFixture(t, config)
+	defer f.Close()
+
+	origin := f.server.originTags.ForAddr(&net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	assert.NoError(t, f.server.handleMetricPacket([]byte("foo.bar:1|c|#a:1,b:2,z:3"), origin))
+	waitForProcessed(t, 1, f.server.Workers[0])
+	f.server.Flush()
+	series := withoutHeartbeat(receiveFlush(t, f).Series)
+	assert.Len(t, series, 1)
+	assert.Equal(t, []string{"a:1", "service:trusted"}, series[0].Tags, "the limit should apply to the trusted tags too, and keep them over the client's")
+}
+
+func TestOriginTagsUnixgramUID(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("unixgram peer credentials are only supported on linux")
+	}
+	dir, err := ioutil.TempDir("", "veneur-unixgram")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "statsd.sock")
+
+	config := localConfig()
+	config.NumWorkers = 1
+	config.Interval = "60s"
+	config.SocketAddress = "unixgram://" + path
+	config.OriginTags = []OriginTagRule{
+		{Source: fmt.Sprintf("uid:%d", os.Getuid()), Tags: []string{"service:trusted"}},
+	}
+	f := newFixture(t, config)
+	defer f.Close()
+
+	conn, err := net.Dial("unixgram", path)
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("foo.bar:1|c|#service:client"))
+	assert.NoError(t, err)
+	waitForProcessed(t, 1, f.server.Workers[0])
+	f.server.Flush()
+	series := withoutHeartbeat(receiveFlush(t, f).Series)
+	assert.Len(t, series, 1)
+	assert.Equal(t, []string{"service:client", "service:trusted"}, series[0].Tags, "the trusted tag should supplement the client's")
+}
+
+func TestOriginTagsValidation(t *testing.T) {
+	for _, source := range []string{"", "10.0.0.0/33", "uid:root", "example.com"} {
+		config := localConfig()
+		config.OriginTags = []OriginTagRule{{Source: source, Tags: []string{"service:trusted"}}}
+		_, err := NewFromConfig(config)
+		assert.Error(t, err, "source %q should be rejected", source)
+	}
+}
+
 func TestIgnoreLongUDPMetrics(t *testing.T) {
 	config := localConfig()
 	config.NumWorkers = 1
@@ -874,6 +2059,72 @@ func TestTCPMetrics(t *testing.T) {
 	}
 }
 
+// TestTCPMetricsRefusedBeforeParsing checks that with
+// tls_authority_certificate set, nothing a client without a certificate
+// signed by the authority sends is parsed.
+func TestTCPMetricsRefusedBeforeParsing(t *testing.T) {
+	pems, err := readTestKeysCerts()
+	if err != nil {
+		t.Fatal("could not read test keys/certs:", err)
+	}
+	config := localConfig()
+	config.NumWorkers = 1
+	config.Interval = "60s"
+	config.TcpAddress = fmt.Sprintf("127.0.0.1:%d", HTTPAddrPort)
+	HTTPAddrPort++
+	config.TLSKey = pems["serverkey.pem"]
+	config.TLSCertificate = pems["servercert.pem"]
+	config.TLSAuthorityCertificate = pems["cacert.pem"]
+	f := newFixture(t, config)
+	defer f.Close()
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM([]byte(pems["cacert.pem"]))
+	clientConfig := func(certName string) *tls.Config {
+		config := &tls.Config{RootCAs: roots, ServerName: "localhost"}
+		if certName != "" {
+			cert, err := tls.X509KeyPair([]byte(pems[certName]), []byte(pems["clientkey.pem"]))
+			if err != nil {
+				t.Fatal(err)
+			}
+			config.Certificates = []tls.Certificate{cert}
+		}
+		return config
+	}
+
+	for _, certName := range []string{"", "clientcert_wrong.pem"} {
+		conn, err := tls.Dial("tcp", config.TcpAddress, clientConfig(certName))
+		if err != nil {
+			// the client may see the rejection during the handshake
+			continue
+		}
+		conn.Write([]byte("refused.metric:1|c\n"))
+		// the server closes the connection without reading anything
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err = conn.Read(make([]byte, 1))
+		if assert.Error(t, err, "the client with %q should be refused", certName) {
+			netErr, ok := err.(net.Error)
+			assert.False(t, ok && netErr.Timeout(), "the client with %q should be refused, not left open", certName)
+		}
+		conn.Close()
+	}
+
+	conn, err := tls.Dial("tcp", config.TcpAddress, clientConfig("clientcert_correct.pem"))
+	if !assert.NoError(t, err, "an authenticated client should connect") {
+		return
+	}
+	defer conn.Close()
+	conn.Write([]byte("accepted.metric:1|c\n"))
+	waitForProcessed(t, 1, f.server.Workers[0])
+
+	f.server.Flush()
+	var names []string
+	for _, metric := range withoutHeartbeat(receiveFlush(t, f).Series) {
+		names = append(names, metric.Name)
+	}
+	assert.Equal(t, []string{"accepted.metric"}, names, "only the authenticated client's metric should be parsed")
+}
+
 // TestHandleTCPGoroutineTimeout verifies that an idle TCP connection doesn't block forever.
 func TestHandleTCPGoroutineTimeout(t *testing.T) {
 	const readTimeout = 30 * time.Millisecond
@@ -923,3 +2174,155 @@ func TestHandleTCPGoroutineTimeout(t *testing.T) {
 		t.Error("Expected packet for metric:", packet)
 	}
 }
+
+// newStatsdCapture returns a statsd client whose packets are delivered, one
+// metric per string, on the returned channel.
+func newStatsdCapture(t *testing.T) (*statsd.Client, <-chan string) {
+	addr, packets := listenStatsd(t)
+	client, err := statsd.New(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Namespace = "veneur."
+	return client, packets
+}
+
+// listenStatsd listens for statsd packets, and delivers them one metric per
+// string on the returned channel. Set a server's StatsAddress to the
+// returned address to read its own metrics.
+func listenStatsd(t *testing.T) (string, <-chan string) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	packets := make(chan string, 100)
+	go func() {
+		defer conn.Close()
+		buf := make([]byte, 65536)
+		for {
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				close(packets)
+				return
+			}
+			for _, line := range strings.Split(string(buf[:n]), "\n") {
+				packets <- line
+			}
+		}
+	}()
+	return conn.LocalAddr().String(), packets
+}
+
+// waitForStat consumes packets until one equal to want arrives.
+func waitForStat(t *testing.T, packets <-chan string, want string) {
+	for packet := range packets {
+		if packet == want {
+			return
+		}
+	}
+	t.Errorf("never received %q", want)
+}
+
+func TestListenerConnectionMetrics(t *testing.T) {
+	stats, packets := newStatsdCapture(t)
+	s := &Server{Statsd: stats, tcpReadTimeout: time.Second, Workers: []*Worker{
+		&Worker{PacketChan: make(chan samplers.UDPMetric, 10)},
+	}}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	s.TCPAddr = listener.Addr().(*net.TCPAddr)
+	tag := "#listener:" + listener.Addr().String()
+
+	var clients []net.Conn
+	done := make(chan struct{}, 2)
+	for i := 0; i < 2; i++ {
+		client, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		clients = append(clients, client)
+		conn, err := listener.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			s.handleTCPGoroutine(conn)
+			done <- struct{}{}
+		}()
+		waitForStat(t, packets, fmt.Sprintf("veneur.listener.connections:%d.000000|g|%s", i+1, tag))
+	}
+
+	_, err = clients[0].Write([]byte("a:1|c\nb:2|g\n"))
+	assert.NoError(t, err)
+	<-s.Workers[0].PacketChan
+	<-s.Workers[0].PacketChan
+
+	clients[0].Close()
+	<-done
+	waitForStat(t, packets, "veneur.listener.bytes:12|c|"+tag)
+	waitForStat(t, packets, "veneur.listener.lines:2|c|"+tag)
+	waitForStat(t, packets, "veneur.listener.connections:1.000000|g|"+tag)
+
+	clients[1].Close()
+	<-done
+	waitForStat(t, packets, "veneur.listener.connections:0.000000|g|"+tag)
+}
+
+// TestTraceMissingService checks that spans without a (whitelisted) service
+// are dropped or assigned the default service, depending on configuration.
+func TestTraceMissingService(t *testing.T) {
+	cases := []struct {
+		name        string
+		server      *Server
+		service     string
+		status      ssf.SSFSample_Status
+		kept        bool
+		wantService string
+	}{
+		{"permissive by default", &Server{}, "", ssf.SSFSample_OK, true, ""},
+		{"dropped", &Server{traceDropMissingService: true}, "", ssf.SSFSample_OK, false, ""},
+		{"defaulted", &Server{traceDropMissingService: true, traceDefaultService: "unknown"},
+			"", ssf.SSFSample_OK, true, "unknown"},
+		{"error kept", &Server{traceDropMissingService: true, traceKeepErrorsMissingService: true},
+			"", ssf.SSFSample_CRITICAL, true, ""},
+		{"warning dropped", &Server{traceDropMissingService: true, traceKeepErrorsMissingService: true},
+			"", ssf.SSFSample_WARNING, false, ""},
+		{"not whitelisted", &Server{traceDropMissingService: true,
+			traceServiceWhitelist: map[string]struct{}{"veneur": {}}},
+			"farts", ssf.SSFSample_OK, false, ""},
+		{"whitelisted", &Server{traceDropMissingService: true,
+			traceServiceWhitelist: map[string]struct{}{"veneur": {}}},
+			"veneur", ssf.SSFSample_OK, true, "veneur"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := tc.server
+			s.TraceWorker = &TraceWorker{TraceChan: make(chan ssf.SSFSample, 1)}
+
+			packet, err := proto.Marshal(&ssf.SSFSample{
+				Metric:  ssf.SSFSample_TRACE,
+				Name:    "veneur.trace.test",
+				Status:  tc.status,
+				Service: tc.service,
+				Trace:   &ssf.SSFTrace{TraceId: 1, Id: 1},
+			})
+			assert.NoError(t, err)
+
+			s.HandleTracePacket(packet)
+			select {
+			case span := <-s.TraceWorker.TraceChan:
+				assert.True(t, tc.kept, "span should have been dropped")
+				assert.Equal(t, tc.wantService, span.Service)
+			default:
+				assert.False(t, tc.kept, "span should have been kept")
+			}
+		})
+	}
+}
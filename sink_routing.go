@@ -0,0 +1,183 @@
+package veneur
+
+import (
+	"strings"
+
+	"github.com/stripe/veneur/samplers"
+)
+
+// sinkTagPrefix starts the "magic" tag with which clients route a metric to
+// only the named sink, eg "_veneur_sink:opentsdb". A metric may have several.
+const sinkTagPrefix = "_veneur_sink:"
+
+// datadogSinkName names the Datadog API in sink tags. The plugins are named
+// by their Name.
+const datadogSinkName = "datadog"
+
+// extractSinks removes the sink tags from m, recording the sinks they name
+// in m.Sinks instead.
+func extractSinks(m *samplers.DDMetric) {
+	m.Tags, m.Sinks = splitSinkTags(m.Tags, m.Sinks)
+}
+
+// extractDistributionSinks is extractSinks for a distribution.
+func extractDistributionSinks(d *samplers.DDDistribution) {
+	d.Tags, d.Sinks = splitSinkTags(d.Tags, d.Sinks)
+}
+
+// splitSinkTags returns tags without the sink tags, and sinks with the names
+// of the sinks they route to appended.
+func splitSinkTags(tags, sinks []string) ([]string, []string) {
+	var kept []string
+	for i, tag := range tags {
+		if !strings.HasPrefix(tag, sinkTagPrefix) {
+			if kept != nil {
+				kept = append(kept, tag)
+			}
+			continue
+		}
+		if kept == nil {
+			// the tags may be shared with other metrics of the same sampler,
+			// so they're copied rather than modified in place
+			kept = make([]string, i, len(tags)-1)
+			copy(kept, tags[:i])
+		}
+		sinks = append(sinks, tag[len(sinkTagPrefix):])
+	}
+	if kept == nil {
+		return tags, sinks
+	}
+	return kept, sinks
+}
+
+// knownSinks returns the names of the sinks that metrics can be routed to.
+func (s *Server) knownSinks() map[string]struct{} {
+	known := map[string]struct{}{datadogSinkName: struct{}{}}
+	for _, p := range s.getPlugins() {
+		known[p.Name()] = struct{}{}
+	}
+	return known
+}
+
+// checkSinkNames returns the sinks of the named metric that are known, and
+// how many were not.
+func checkSinkNames(known map[string]struct{}, name string, sinks []string) ([]string, int) {
+	checked := make([]string, 0, len(sinks))
+	unknown := 0
+	for _, sink := range sinks {
+		if _, ok := known[sink]; ok {
+			checked = append(checked, sink)
+		} else {
+			log.WithField("sink", sink).WithField("metric", name).Debug("Metric is routed to a sink that doesn't exist")
+			unknown++
+		}
+	}
+	return checked, unknown
+}
+
+// checkSinks removes the names of sinks that don't exist from the metrics
+// routed by sink tags. Metrics that named no existing sink are dropped, as
+// they can't be delivered where they were meant to go.
+func (s *Server) checkSinks(metrics []samplers.DDMetric) []samplers.DDMetric {
+	known := s.knownSinks()
+	checked := metrics[:0]
+	unknown := 0
+	for _, m := range metrics {
+		if m.Sinks != nil {
+			var n int
+			m.Sinks, n = checkSinkNames(known, m.Name, m.Sinks)
+			unknown += n
+			if len(m.Sinks) == 0 {
+				s.Statsd.Count("flush.sink_routing.dropped_total", 1, nil, 1.0)
+				continue
+			}
+		}
+		checked = append(checked, m)
+	}
+	if unknown > 0 {
+		s.Statsd.Count("flush.sink_routing.unknown_sink_total", int64(unknown), nil, 1.0)
+	}
+	return checked
+}
+
+// checkDistributionSinks is checkSinks for distributions.
+func (s *Server) checkDistributionSinks(distributions []samplers.DDDistribution) []samplers.DDDistribution {
+	known := s.knownSinks()
+	checked := distributions[:0]
+	unknown := 0
+	for _, d := range distributions {
+		if d.Sinks != nil {
+			var n int
+			d.Sinks, n = checkSinkNames(known, d.Name, d.Sinks)
+			unknown += n
+			if len(d.Sinks) == 0 {
+				s.Statsd.Count("flush.sink_routing.dropped_total", 1, nil, 1.0)
+				continue
+			}
+		}
+		checked = append(checked, d)
+	}
+	if unknown > 0 {
+		s.Statsd.Count("flush.sink_routing.unknown_sink_total", int64(unknown), nil, 1.0)
+	}
+	return checked
+}
+
+// metricsForSink returns the metrics that the named sink should flush: those
+// without sink tags, and those routed to it.
+func metricsForSink(metrics []samplers.DDMetric, sink string) []samplers.DDMetric {
+	routed := false
+	for _, m := range metrics {
+		if m.Sinks != nil {
+			routed = true
+			break
+		}
+	}
+	if !routed {
+		return metrics
+	}
+
+	forSink := make([]samplers.DDMetric, 0, len(metrics))
+	for _, m := range metrics {
+		if m.Sinks == nil {
+			forSink = append(forSink, m)
+			continue
+		}
+		for _, name := range m.Sinks {
+			if name == sink {
+				forSink = append(forSink, m)
+				break
+			}
+		}
+	}
+	return forSink
+}
+
+// distributionsForSink is metricsForSink for distributions.
+func distributionsForSink(distributions []samplers.DDDistribution, sink string) []samplers.DDDistribution {
+	routed := false
+	for _, d := range distributions {
+		if d.Sinks != nil {
+			routed = true
+			break
+		}
+	}
+	if !routed {
+		return distributions
+	}
+
+	forSink := make([]samplers.DDDistribution, 0, len(distributions))
+	for _, d := range distributions {
+		if d.Sinks == nil {
+			forSink = append(forSink, d)
+			continue
+		}
+		for _, name := range d.Sinks {
+			if name == sink {
+				forSink = append(forSink, d)
+				break
+			}
+		}
+	}
+	return forSink
+}
@@ -0,0 +1,92 @@
+package veneur
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stripe/veneur/samplers"
+)
+
+func TestSinkTagRouting(t *testing.T) {
+	f := newFixture(t, globalConfig())
+	defer f.Close()
+
+	flushed := make(chan []samplers.DDMetric, 1)
+	f.server.registerPlugin(&dummyPlugin{logger: log, statsd: f.server.Statsd, flush: func(metrics []samplers.DDMetric, hostname string) error {
+		flushed <- metrics
+		return nil
+	}})
+
+	gauge := func(name string, tags ...string) {
+		f.server.Workers[0].ProcessMetric(&samplers.UDPMetric{
+			MetricKey:  samplers.MetricKey{Name: name, Type: "gauge"},
+			Value:      1.0,
+			Tags:       tags,
+			SampleRate: 1.0,
+			Scope:      samplers.MixedScope,
+		})
+	}
+	gauge("everywhere", "foo:bar")
+	gauge("plugin.only", "foo:bar", "_veneur_sink:dummy_plugin")
+	gauge("datadog.only", "_veneur_sink:datadog", "foo:bar")
+	gauge("nowhere", "_veneur_sink:nonexistent")
+	f.server.Flush()
+
+	names := func(metrics []samplers.DDMetric) []string {
+		var names []string
+		for _, m := range metrics {
+			names = append(names, m.Name)
+			assert.Equal(t, []string{"foo:bar"}, m.Tags, "%s should only have its own tags", m.Name)
+		}
+		sort.Strings(names)
+		return names
+	}
+	assert.Equal(t, []string{"datadog.only", "everywhere"}, names(withoutHeartbeat(receiveFlush(t, f).Series)))
+	assert.Equal(t, []string{"everywhere", "plugin.only"}, names(<-flushed))
+}
+
+func TestExtractSinks(t *testing.T) {
+	tags := []string{"_veneur_sink:a", "foo:bar", "_veneur_sink:b", "baz:qux"}
+	m := samplers.DDMetric{Tags: tags}
+	extractSinks(&m)
+	assert.Equal(t, []string{"foo:bar", "baz:qux"}, m.Tags)
+	assert.Equal(t, []string{"a", "b"}, m.Sinks)
+	assert.Equal(t, "_veneur_sink:a", tags[0], "the original tags should not be modified")
+
+	m = samplers.DDMetric{Tags: []string{"foo:bar"}}
+	extractSinks(&m)
+	assert.Equal(t, []string{"foo:bar"}, m.Tags)
+	assert.Nil(t, m.Sinks)
+}
+
+func TestDistributionSinkRouting(t *testing.T) {
+	config := localConfig()
+	config.NumWorkers = 1
+	f := newFixture(t, config)
+	defer f.Close()
+	f.server.registerPlugin(&dummyPlugin{flush: func([]samplers.DDMetric, string) error { return nil }})
+
+	for _, packet := range []string{
+		"everywhere:1|d|#foo:bar",
+		"plugin.only:1|d|#foo:bar,_veneur_sink:dummy_plugin",
+		"datadog.only:1|d|#_veneur_sink:datadog,foo:bar",
+		"nowhere:1|d|#_veneur_sink:nonexistent",
+	} {
+		assert.NoError(t, f.server.handleMetricPacket([]byte(packet), nil))
+	}
+	waitForProcessed(t, 4, f.server.Workers[0])
+	distributions := f.server.generateDistributions([]WorkerMetrics{f.server.Workers[0].Flush()})
+
+	names := func(distributions []samplers.DDDistribution) []string {
+		var names []string
+		for _, d := range distributions {
+			names = append(names, d.Name)
+			assert.Equal(t, []string{"foo:bar"}, d.Tags, "%s should only have its own tags", d.Name)
+		}
+		sort.Strings(names)
+		return names
+	}
+	assert.Equal(t, []string{"datadog.only", "everywhere"}, names(distributionsForSink(distributions, datadogSinkName)))
+	assert.Equal(t, []string{"everywhere", "plugin.only"}, names(distributionsForSink(distributions, "dummy_plugin")))
+}
@@ -3,13 +3,17 @@
 package veneur
 
 import (
+	"errors"
 	"net"
 )
 
+// reuseportSupported is false since SO_REUSEPORT is only used on linux.
+const reuseportSupported = false
+
 // NewSocket creates a socket which is intended for use by a single goroutine.
 func NewSocket(addr *net.UDPAddr, recvBuf int, reuseport bool) (net.PacketConn, error) {
 	if reuseport {
-		panic("SO_REUSEPORT not supported on this platform")
+		return nil, errors.New("SO_REUSEPORT is not supported on this platform")
 	}
 	serverConn, err := net.ListenUDP("udp", addr)
 	if err != nil {
@@ -20,3 +24,24 @@ func NewSocket(addr *net.UDPAddr, recvBuf int, reuseport bool) (net.PacketConn,
 	}
 	return serverConn, nil
 }
+
+// readBufferSize is only supported on linux.
+func readBufferSize(conn net.PacketConn) (int, error) {
+	return 0, errors.New("reading the receive buffer size is not supported on this platform")
+}
+
+// unixCredentialsSpace is unused on this platform, which cannot read the
+// credentials of a unixgram sender.
+const unixCredentialsSpace = 0
+
+// enablePeerCredentials is only supported on linux.
+func enablePeerCredentials(conn *net.UnixConn) error {
+	return errors.New("unixgram peer credentials are not supported on this platform")
+}
+
+// readUnixgram reads one datagram from conn into buf. The sender's uid is
+// always unknown, -1, on this platform.
+func readUnixgram(conn *net.UnixConn, buf, oob []byte) (n int, uid int, err error) {
+	n, _, err = conn.ReadFrom(buf)
+	return n, -1, err
+}
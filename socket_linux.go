@@ -1,6 +1,7 @@
 package veneur
 
 import (
+	"fmt"
 	"net"
 	"os"
 	"syscall"
@@ -8,6 +9,10 @@ import (
 	"golang.org/x/sys/unix"
 )
 
+// reuseportSupported reports whether NewSocket can share an address between
+// several sockets with SO_REUSEPORT.
+const reuseportSupported = true
+
 // see also https://github.com/jbenet/go-reuseport/blob/master/impl_unix.go#L279
 func NewSocket(addr *net.UDPAddr, recvBuf int, reuseport bool) (net.PacketConn, error) {
 	// default to AF_INET6 to be equivalent to net.ListenUDP()
@@ -69,3 +74,76 @@ func NewSocket(addr *net.UDPAddr, recvBuf int, reuseport bool) (net.PacketConn,
 	}
 	return ret, nil
 }
+
+// readBufferSize returns the size of conn's receive buffer as the kernel
+// applied it, which can be less than was asked for if that's over
+// net.core.rmem_max. Linux doubles the size it's given, to leave room for
+// its own bookkeeping, and reports the doubled size, so it's halved here.
+func readBufferSize(conn net.PacketConn) (int, error) {
+	fc, ok := conn.(interface {
+		File() (*os.File, error)
+	})
+	if !ok {
+		return 0, fmt.Errorf("can't read the receive buffer size of a %T", conn)
+	}
+	f, err := fc.File()
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	fd := int(f.Fd())
+	size, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_RCVBUF)
+	if err != nil {
+		return 0, err
+	}
+	// File puts the duplicated descriptor in blocking mode, which is shared
+	// with conn's, so switch it back for the runtime's poller
+	if err := unix.SetNonblock(fd, true); err != nil {
+		return 0, err
+	}
+	return size / 2, nil
+}
+
+// unixCredentialsSpace is the size of the control message buffer needed to
+// receive the credentials of a unixgram sender.
+var unixCredentialsSpace = unix.CmsgSpace(unix.SizeofUcred)
+
+// enablePeerCredentials makes the kernel attach the sender's credentials to
+// every datagram received on conn.
+func enablePeerCredentials(conn *net.UnixConn) error {
+	f, err := conn.File()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fd := int(f.Fd())
+	if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_PASSCRED, 1); err != nil {
+		return err
+	}
+	// File puts the duplicated descriptor in blocking mode, which is shared
+	// with conn's, so switch it back for the runtime's poller
+	return unix.SetNonblock(fd, true)
+}
+
+// readUnixgram reads one datagram from conn into buf. If oob is not nil, it
+// also returns the uid of the sender, or -1 if it is unknown.
+func readUnixgram(conn *net.UnixConn, buf, oob []byte) (n int, uid int, err error) {
+	if oob == nil {
+		n, _, err = conn.ReadFrom(buf)
+		return n, -1, err
+	}
+	n, oobn, _, _, err := conn.ReadMsgUnix(buf, oob)
+	if err != nil {
+		return n, -1, err
+	}
+	msgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return n, -1, nil
+	}
+	for i := range msgs {
+		if cred, err := unix.ParseUnixCredentials(&msgs[i]); err == nil {
+			return n, int(cred.Uid), nil
+		}
+	}
+	return n, -1, nil
+}
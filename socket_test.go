@@ -1,9 +1,15 @@
 package veneur
 
 import (
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"net"
+	"os"
+	"path/filepath"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -71,3 +77,121 @@ func TestSocket(t *testing.T) {
 		assert.NoError(t, err, "close should not fail")
 	}
 }
+
+// serverUDPConn waits for server to bind its metrics socket, and returns it.
+func serverUDPConn(t *testing.T, server *Server) net.PacketConn {
+	deadline := time.Now().Add(5 * time.Second)
+	for !server.health.Check(time.Now()).Listeners["udp_address"] {
+		if time.Now().After(deadline) {
+			t.Fatal("the metrics socket wasn't bound")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	server.udpConnMtx.Lock()
+	defer server.udpConnMtx.Unlock()
+	return server.udpConns[0]
+}
+
+// TestReadBufferSize tests that a server's sockets get
+// read_buffer_size_bytes, and that it notices when the kernel clamps it.
+func TestReadBufferSize(t *testing.T) {
+	config := globalConfig()
+	config.ReadBufferSizeBytes = 256 * 1024
+	server := setupVeneurServer(t, config, nil)
+	defer server.Shutdown()
+	conn := serverUDPConn(t, server)
+	size, err := readBufferSize(conn)
+	if err != nil {
+		t.Skipf("can't read the receive buffer size: %s", err)
+	}
+	assert.Equal(t, config.ReadBufferSizeBytes, size, "the requested buffer size should be applied")
+	assert.False(t, server.checkReadBuffer(conn, "udp_address"))
+
+	// far more than any net.core.rmem_max, which unprivileged sockets can't
+	// exceed
+	config = globalConfig()
+	config.ReadBufferSizeBytes = 1 << 30
+	// setting the log level again would race with the first server's logs
+	config.Debug = false
+	clamped := setupVeneurServer(t, config, nil)
+	defer clamped.Shutdown()
+	conn = serverUDPConn(t, clamped)
+	size, err = readBufferSize(conn)
+	assert.NoError(t, err)
+	assert.True(t, size < config.ReadBufferSizeBytes, "the kernel should have clamped the buffer size")
+	assert.True(t, clamped.checkReadBuffer(conn, "udp_address"), "a clamped buffer should be reported")
+
+	config = localConfig()
+	config.ReadBufferSizeBytes = -1
+	_, err = NewFromConfig(config)
+	assert.Error(t, err)
+}
+
+func TestSocketReuseport(t *testing.T) {
+	if !reuseportSupported {
+		t.Skip("SO_REUSEPORT is not supported on this platform")
+	}
+	addr, err := net.ResolveUDPAddr("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	first, err := NewSocket(addr, 2*1024*1024, true)
+	if err != nil {
+		t.Fatalf("could not create a SO_REUSEPORT socket: %s", err)
+	}
+	defer first.Close()
+	second, err := NewSocket(first.LocalAddr().(*net.UDPAddr), 2*1024*1024, true)
+	if err != nil {
+		t.Fatalf("could not share the address with a second socket: %s", err)
+	}
+	defer second.Close()
+
+	// the kernel picks a socket by hashing the sender's address, so send from
+	// many clients, and count what each reader receives
+	const clients = 64
+	received := make(chan int, 2*clients)
+	for i, sock := range []net.PacketConn{first, second} {
+		go func(reader int, sock net.PacketConn) {
+			b := make([]byte, 32)
+			for {
+				if _, _, err := sock.ReadFrom(b); err != nil {
+					return
+				}
+				received <- reader
+			}
+		}(i, sock)
+	}
+	for i := 0; i < clients; i++ {
+		client, err := net.Dial("udp", first.LocalAddr().String())
+		assert.NoError(t, err)
+		_, err = client.Write([]byte("a.b.c:1|c"))
+		assert.NoError(t, err)
+		client.Close()
+	}
+
+	counts := make([]int, 2)
+	for i := 0; i < clients; i++ {
+		select {
+		case reader := <-received:
+			counts[reader]++
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only received %d of %d packets", i, clients)
+		}
+	}
+	assert.NotZero(t, counts[0], "the first reader should have received traffic")
+	assert.NotZero(t, counts[1], "the second reader should have received traffic")
+}
+
+func TestIsTransientReadError(t *testing.T) {
+	refused := &net.OpError{Op: "read", Net: "unixgram", Err: os.NewSyscallError("recvmsg", syscall.ECONNREFUSED)}
+	assert.True(t, isTransientReadError(refused), "ECONNREFUSED should be transient")
+	assert.True(t, isTransientReadError(&net.OpError{Op: "read", Err: syscall.ENOBUFS}), "ENOBUFS should be transient")
+	assert.False(t, isTransientReadError(errors.New("use of closed network connection")))
+
+	dir, err := ioutil.TempDir("", "veneur-unixgram")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	conn, err := NewUnixgramSocket(&net.UnixAddr{Name: filepath.Join(dir, "statsd.sock"), Net: "unixgram"}, 2*1024*1024, defaultSocketPermissions)
+	assert.NoError(t, err)
+	conn.Close()
+	_, _, err = conn.ReadFrom(make([]byte, 1))
+	assert.False(t, isTransientReadError(err), "reading from a closed socket shouldn't be transient")
+}
@@ -0,0 +1,80 @@
+package veneur
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"syscall"
+)
+
+// defaultSocketPermissions are applied to a unixgram socket file if no
+// permissions are configured. Any local user may write metrics to it.
+const defaultSocketPermissions os.FileMode = 0666
+
+// parseSocketAddress parses a listen address of the form
+// unixgram:///path/to/socket.
+func parseSocketAddress(addr string) (*net.UnixAddr, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "unixgram" {
+		return nil, fmt.Errorf("unsupported socket address scheme %q in %q", u.Scheme, addr)
+	}
+	path := u.Host + u.Path
+	if path == "" {
+		return nil, fmt.Errorf("missing socket path in %q", addr)
+	}
+	return &net.UnixAddr{Name: path, Net: "unixgram"}, nil
+}
+
+// NewUnixgramSocket creates a SOCK_DGRAM unix socket at addr, replacing any
+// stale socket file left behind by a previous process, and sets the file's
+// permissions so that clients can write to it.
+func NewUnixgramSocket(addr *net.UnixAddr, recvBuf int, perm os.FileMode) (*net.UnixConn, error) {
+	if fi, err := os.Lstat(addr.Name); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", addr.Name)
+		}
+		if err := os.Remove(addr.Name); err != nil {
+			return nil, err
+		}
+	}
+
+	conn, err := net.ListenUnixgram("unixgram", addr)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(addr.Name, perm); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := conn.SetReadBuffer(recvBuf); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// isTransientReadError reports whether an error reading from a datagram
+// socket may go away by itself, so that the reader should carry on. Besides
+// timeouts and interruptions, this includes ECONNREFUSED, which a socket
+// can report after a peer goes away, and ENOBUFS. Anything else, such as
+// reading from a closed socket, means the socket is unusable.
+func isTransientReadError(err error) bool {
+	if opErr, ok := err.(*net.OpError); ok {
+		err = opErr.Err
+	}
+	if sysErr, ok := err.(*os.SyscallError); ok {
+		err = sysErr.Err
+	}
+	switch err {
+	case syscall.EAGAIN, syscall.EINTR, syscall.ECONNREFUSED, syscall.ECONNRESET, syscall.ENOBUFS, syscall.ENOMEM:
+		return true
+	}
+	if netErr, ok := err.(net.Error); ok {
+		return netErr.Timeout()
+	}
+	return false
+}
@@ -0,0 +1,197 @@
+package veneur
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// defaultSpanBufferSize is the maximum number of spans held for retry after
+// a failed trace flush.
+const defaultSpanBufferSize = 16384
+
+// spanBuffer holds spans that could not be flushed so that they can be
+// retried on the next flush. When the buffer is full, the oldest spans are
+// discarded first.
+type spanBuffer struct {
+	mtx      sync.Mutex
+	spans    []*DatadogTraceSpan
+	maxSpans int
+	// spans that ended longer than maxAge ago are stale and are dropped
+	// instead of being retried; 0 means no limit
+	maxAge time.Duration
+	// if set, the buffered spans are persisted to this file after every
+	// change, so that they survive a restart
+	path string
+	// signalled when the spans have changed, so that persistLoop writes them
+	// out; nil if there is no path
+	dirty chan struct{}
+	// closed once persistLoop has returned
+	persisted chan struct{}
+	// set by Close, after which changes are no longer persisted
+	closed bool
+}
+
+func newSpanBuffer(maxSpans int, maxAge time.Duration) *spanBuffer {
+	return &spanBuffer{maxSpans: maxSpans, maxAge: maxAge}
+}
+
+// newDiskSpanBuffer returns a spanBuffer that is persisted to the file at
+// path, starting with any spans that a previous process left there. If the
+// file is corrupt, the spans before the corruption are kept.
+func newDiskSpanBuffer(path string, maxSpans int, maxAge time.Duration) (*spanBuffer, error) {
+	b := &spanBuffer{
+		maxSpans:  maxSpans,
+		maxAge:    maxAge,
+		path:      path,
+		dirty:     make(chan struct{}, 1),
+		persisted: make(chan struct{}),
+	}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		go b.persistLoop()
+		return b, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	dec := json.NewDecoder(bufio.NewReader(f))
+	for dec.More() {
+		span := &DatadogTraceSpan{}
+		if err := dec.Decode(span); err != nil {
+			log.WithError(err).WithField("path", path).Warn("Span buffer file is corrupt, discarding the rest of it")
+			break
+		}
+		b.spans = append(b.spans, span)
+	}
+	if len(b.spans) > b.maxSpans {
+		b.spans = b.spans[len(b.spans)-b.maxSpans:]
+	}
+	go b.persistLoop()
+	return b, nil
+}
+
+// changed schedules the buffered spans to be persisted, if the buffer has a
+// file. The write happens in persistLoop, so that neither the flush nor the
+// lock waits for the disk; a change while a write is pending is covered by
+// that write. The caller must hold the lock.
+func (b *spanBuffer) changed() {
+	if b.dirty == nil || b.closed {
+		return
+	}
+	select {
+	case b.dirty <- struct{}{}:
+	default:
+	}
+}
+
+// persistLoop persists the buffer every time it changes, until it is closed.
+func (b *spanBuffer) persistLoop() {
+	defer close(b.persisted)
+	for range b.dirty {
+		b.mtx.Lock()
+		spans := append([]*DatadogTraceSpan(nil), b.spans...)
+		b.mtx.Unlock()
+		if err := writeSpanFile(b.path, spans); err != nil {
+			log.WithError(err).WithField("path", b.path).Warn("Could not persist the span buffer")
+		}
+	}
+}
+
+// Close waits for the buffer to be persisted one last time. Later changes
+// are only kept in memory.
+func (b *spanBuffer) Close() {
+	if b.dirty == nil {
+		return
+	}
+	b.mtx.Lock()
+	if !b.closed {
+		b.closed = true
+		close(b.dirty)
+	}
+	b.mtx.Unlock()
+	<-b.persisted
+}
+
+// writeSpanFile writes spans to the file at path. They are written to a
+// temporary file that then replaces the old one, so a crash never leaves a
+// partially written buffer behind.
+func writeSpanFile(path string, spans []*DatadogTraceSpan) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, span := range spans {
+		if err = enc.Encode(span); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Add buffers spans for retry. It returns the number of spans that were
+// discarded because the buffer was full.
+func (b *spanBuffer) Add(spans []*DatadogTraceSpan) (overflow int) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	b.spans = append(b.spans, spans...)
+	if len(b.spans) > b.maxSpans {
+		overflow = len(b.spans) - b.maxSpans
+		b.spans = append([]*DatadogTraceSpan(nil), b.spans[overflow:]...)
+	}
+	b.changed()
+	return overflow
+}
+
+// Take empties the buffer, returning the spans that are still fresh as of
+// now and the number of stale spans that were dropped. The buffer's file
+// keeps the spans until they are sent, when Delivered is called, or are
+// buffered again by Add, so that a crash in between doesn't lose them.
+func (b *spanBuffer) Take(now time.Time) (spans []*DatadogTraceSpan, stale int) {
+	b.mtx.Lock()
+	buffered := b.spans
+	b.spans = nil
+	b.mtx.Unlock()
+
+	if b.maxAge <= 0 {
+		return buffered, 0
+	}
+	cutoff := now.Add(-b.maxAge).UnixNano()
+	spans = buffered[:0]
+	for _, span := range buffered {
+		if span.Start+span.Duration < cutoff {
+			stale++
+			continue
+		}
+		spans = append(spans, span)
+	}
+	return spans, stale
+}
+
+// Delivered records that the spans last taken were sent, so that they are no
+// longer persisted.
+func (b *spanBuffer) Delivered() {
+	b.mtx.Lock()
+	b.changed()
+	b.mtx.Unlock()
+}
@@ -0,0 +1,70 @@
+package veneur
+
+import (
+	"sync"
+	"time"
+
+	"github.com/stripe/veneur/ssf"
+)
+
+// idempotencyKeyTag is the span tag that clients set to the same value on
+// every retry of a span, so that only one copy is kept.
+const idempotencyKeyTag = "idempotency_key"
+
+// spanDeduper drops spans whose idempotency key was already seen within a
+// window. Trace and span IDs can't be used for this, since a span may
+// legitimately be sent in several parts with the same IDs.
+type spanDeduper struct {
+	window time.Duration
+
+	mtx  sync.Mutex
+	seen map[string]time.Time
+	// the last time expired keys were removed from seen
+	swept time.Time
+}
+
+func newSpanDeduper(window time.Duration) *spanDeduper {
+	return &spanDeduper{
+		window: window,
+		seen:   make(map[string]time.Time),
+		swept:  time.Now(),
+	}
+}
+
+// Duplicate removes the idempotency key tag from sample, and reports whether
+// a span with the same key was already seen within the window. Spans
+// without a key are never duplicates.
+func (d *spanDeduper) Duplicate(sample *ssf.SSFSample, now time.Time) bool {
+	key, ok := removeIdempotencyKey(sample)
+	if !ok {
+		return false
+	}
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if now.Sub(d.swept) >= d.window {
+		for k, at := range d.seen {
+			if now.Sub(at) >= d.window {
+				delete(d.seen, k)
+			}
+		}
+		d.swept = now
+	}
+	if at, ok := d.seen[key]; ok && now.Sub(at) < d.window {
+		return true
+	}
+	d.seen[key] = now
+	return false
+}
+
+// removeIdempotencyKey removes the idempotency key tag from sample, which
+// would otherwise give every span a unique tag, and returns its value.
+func removeIdempotencyKey(sample *ssf.SSFSample) (string, bool) {
+	for i, tag := range sample.Tags {
+		if tag != nil && tag.Name == idempotencyKeyTag && tag.Value != "" {
+			sample.Tags = append(sample.Tags[:i:i], sample.Tags[i+1:]...)
+			return tag.Value, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,61 @@
+package veneur
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stripe/veneur/ssf"
+)
+
+func TestSpanIdempotencyKey(t *testing.T) {
+	s := &Server{
+		TraceWorker: &TraceWorker{TraceChan: make(chan ssf.SSFSample, 10)},
+		spanDeduper: newSpanDeduper(time.Minute),
+	}
+	send := func(id int64, key string) {
+		sample := &ssf.SSFSample{
+			Metric:  ssf.SSFSample_TRACE,
+			Name:    "veneur.trace.test",
+			Service: "veneur",
+			Trace:   &ssf.SSFTrace{TraceId: 1, Id: id},
+			Tags:    []*ssf.SSFTag{{Name: "foo", Value: "bar"}},
+		}
+		if key != "" {
+			sample.Tags = append(sample.Tags, &ssf.SSFTag{Name: idempotencyKeyTag, Value: key})
+		}
+		packet, err := proto.Marshal(sample)
+		assert.NoError(t, err)
+		s.HandleTracePacket(packet)
+	}
+
+	// a retry of the first span, with the same key
+	send(1, "abc")
+	send(1, "abc")
+	// a different span with its own key
+	send(2, "def")
+	// parts of a span without keys are all kept, despite sharing IDs
+	send(3, "")
+	send(3, "")
+	close(s.TraceWorker.TraceChan)
+
+	var ids []int64
+	for span := range s.TraceWorker.TraceChan {
+		ids = append(ids, span.Trace.Id)
+		assert.Equal(t, []*ssf.SSFTag{{Name: "foo", Value: "bar"}}, span.Tags, "the idempotency key should be removed")
+	}
+	assert.Equal(t, []int64{1, 2, 3, 3}, ids, "only one span with each idempotency key should be delivered")
+}
+
+func TestSpanDeduperWindow(t *testing.T) {
+	d := newSpanDeduper(time.Minute)
+	sample := func() *ssf.SSFSample {
+		return &ssf.SSFSample{Tags: []*ssf.SSFTag{{Name: idempotencyKeyTag, Value: "abc"}}}
+	}
+	start := time.Now()
+	assert.False(t, d.Duplicate(sample(), start))
+	assert.True(t, d.Duplicate(sample(), start.Add(59*time.Second)))
+	assert.False(t, d.Duplicate(sample(), start.Add(2*time.Minute)), "keys should be forgotten after the window")
+	assert.Len(t, d.seen, 1, "expired keys should be removed")
+}
@@ -11,6 +11,8 @@ It has these top-level messages:
 	SSFTag
 	SSFTrace
 	SSFSample
+	SSFLog
+	SSFSpanCounts
 */
 package ssf
 
@@ -18,6 +20,11 @@ import proto "github.com/golang/protobuf/proto"
 import fmt "fmt"
 import math "math"
 
+import (
+	context "golang.org/x/net/context"
+	grpc "google.golang.org/grpc"
+)
+
 // Reference imports to suppress errors if they are not otherwise used.
 var _ = proto.Marshal
 var _ = fmt.Errorf
@@ -29,6 +36,34 @@ var _ = math.Inf
 // proto package needs to be updated.
 const _ = proto.ProtoPackageIsVersion2 // please upgrade the proto package
 
+// How a tag's value, which is always a string, should be interpreted
+type SSFTag_Type int32
+
+const (
+	SSFTag_STRING SSFTag_Type = 0
+	SSFTag_INT    SSFTag_Type = 1
+	SSFTag_FLOAT  SSFTag_Type = 2
+	SSFTag_BOOL   SSFTag_Type = 3
+)
+
+var SSFTag_Type_name = map[int32]string{
+	0: "STRING",
+	1: "INT",
+	2: "FLOAT",
+	3: "BOOL",
+}
+var SSFTag_Type_value = map[string]int32{
+	"STRING": 0,
+	"INT":    1,
+	"FLOAT":  2,
+	"BOOL":   3,
+}
+
+func (x SSFTag_Type) String() string {
+	return proto.EnumName(SSFTag_Type_name, int32(x))
+}
+func (SSFTag_Type) EnumDescriptor() ([]byte, []int) { return fileDescriptor0, []int{0, 0} }
+
 type SSFSample_Metric int32
 
 const (
@@ -95,6 +130,9 @@ func (SSFSample_Status) EnumDescriptor() ([]byte, []int) { return fileDescriptor
 type SSFTag struct {
 	Name  string `protobuf:"bytes,1,opt,name=name" json:"name,omitempty"`
 	Value string `protobuf:"bytes,2,opt,name=value" json:"value,omitempty"`
+	// the type of the value, so that numbers and booleans
+	// can be told apart from strings
+	Type SSFTag_Type `protobuf:"varint,3,opt,name=type,enum=ssf.SSFTag_Type" json:"type,omitempty"`
 }
 
 func (m *SSFTag) Reset()                    { *m = SSFTag{} }
@@ -116,6 +154,13 @@ func (m *SSFTag) GetValue() string {
 	return ""
 }
 
+func (m *SSFTag) GetType() SSFTag_Type {
+	if m != nil {
+		return m.Type
+	}
+	return SSFTag_STRING
+}
+
 type SSFTrace struct {
 	// the trace_id is the (span) id of the root span
 	TraceId int64 `protobuf:"varint,1,opt,name=trace_id,json=traceId" json:"trace_id,omitempty"`
@@ -131,6 +176,8 @@ type SSFTrace struct {
 	// See https://godoc.org/github.com/DataDog/dd-trace-go/tracer#Span
 	Resource string `protobuf:"bytes,4,opt,name=resource" json:"resource,omitempty"`
 	Duration int64  `protobuf:"varint,5,opt,name=duration" json:"duration,omitempty"`
+	// timestamped events within the span, in the order they happened
+	Logs []*SSFLog `protobuf:"bytes,6,rep,name=logs" json:"logs,omitempty"`
 }
 
 func (m *SSFTrace) Reset()                    { *m = SSFTrace{} }
@@ -173,6 +220,13 @@ func (m *SSFTrace) GetDuration() int64 {
 	return 0
 }
 
+func (m *SSFTrace) GetLogs() []*SSFLog {
+	if m != nil {
+		return m.Logs
+	}
+	return nil
+}
+
 type SSFSample struct {
 	// The underlying type of the metric
 	Metric SSFSample_Metric `protobuf:"varint,1,opt,name=metric,enum=ssf.SSFSample_Metric" json:"metric,omitempty"`
@@ -189,6 +243,9 @@ type SSFSample struct {
 	// the name of the service
 	// e.g. "veneur"
 	Service string `protobuf:"bytes,10,opt,name=service" json:"service,omitempty"`
+	// the value of a COUNTER, GAUGE or HISTOGRAM sample; SET samples
+	// carry their member in the message instead
+	Value float32 `protobuf:"fixed32,11,opt,name=value" json:"value,omitempty"`
 }
 
 func (m *SSFSample) Reset()                    { *m = SSFSample{} }
@@ -266,45 +323,237 @@ func (m *SSFSample) GetService() string {
 	return ""
 }
 
+func (m *SSFSample) GetValue() float32 {
+	if m != nil {
+		return m.Value
+	}
+	return 0
+}
+
+// An event logged within a span, eg a cache miss or a retry
+type SSFLog struct {
+	// nanoseconds since the epoch
+	Timestamp int64     `protobuf:"varint,1,opt,name=timestamp" json:"timestamp,omitempty"`
+	Event     string    `protobuf:"bytes,2,opt,name=event" json:"event,omitempty"`
+	Fields    []*SSFTag `protobuf:"bytes,3,rep,name=fields" json:"fields,omitempty"`
+}
+
+func (m *SSFLog) Reset()                    { *m = SSFLog{} }
+func (m *SSFLog) String() string            { return proto.CompactTextString(m) }
+func (*SSFLog) ProtoMessage()               {}
+func (*SSFLog) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{3} }
+
+func (m *SSFLog) GetTimestamp() int64 {
+	if m != nil {
+		return m.Timestamp
+	}
+	return 0
+}
+
+func (m *SSFLog) GetEvent() string {
+	if m != nil {
+		return m.Event
+	}
+	return ""
+}
+
+func (m *SSFLog) GetFields() []*SSFTag {
+	if m != nil {
+		return m.Fields
+	}
+	return nil
+}
+
+// The spans that a SpanIngest.SendSpans stream delivered
+type SSFSpanCounts struct {
+	// spans passed on to be flushed, though they may still be sampled out
+	Accepted int64 `protobuf:"varint,1,opt,name=accepted" json:"accepted,omitempty"`
+	// spans refused, eg over the rate limit or while tracing is disabled
+	Rejected int64 `protobuf:"varint,2,opt,name=rejected" json:"rejected,omitempty"`
+}
+
+func (m *SSFSpanCounts) Reset()                    { *m = SSFSpanCounts{} }
+func (m *SSFSpanCounts) String() string            { return proto.CompactTextString(m) }
+func (*SSFSpanCounts) ProtoMessage()               {}
+func (*SSFSpanCounts) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{4} }
+
+func (m *SSFSpanCounts) GetAccepted() int64 {
+	if m != nil {
+		return m.Accepted
+	}
+	return 0
+}
+
+func (m *SSFSpanCounts) GetRejected() int64 {
+	if m != nil {
+		return m.Rejected
+	}
+	return 0
+}
+
 func init() {
 	proto.RegisterType((*SSFTag)(nil), "ssf.SSFTag")
 	proto.RegisterType((*SSFTrace)(nil), "ssf.SSFTrace")
 	proto.RegisterType((*SSFSample)(nil), "ssf.SSFSample")
+	proto.RegisterType((*SSFLog)(nil), "ssf.SSFLog")
+	proto.RegisterType((*SSFSpanCounts)(nil), "ssf.SSFSpanCounts")
+	proto.RegisterEnum("ssf.SSFTag_Type", SSFTag_Type_name, SSFTag_Type_value)
 	proto.RegisterEnum("ssf.SSFSample_Metric", SSFSample_Metric_name, SSFSample_Metric_value)
 	proto.RegisterEnum("ssf.SSFSample_Status", SSFSample_Status_name, SSFSample_Status_value)
 }
 
 func init() { proto.RegisterFile("ssf/sample.proto", fileDescriptor0) }
 
+// Reference imports to suppress errors if they are not otherwise used.
+var _ context.Context
+var _ grpc.ClientConn
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+const _ = grpc.SupportPackageIsVersion4
+
+// Client API for SpanIngest service
+
+type SpanIngestClient interface {
+	// Sends a stream of spans. When the client closes it, Veneur replies
+	// with how many it accepted and rejected.
+	SendSpans(ctx context.Context, opts ...grpc.CallOption) (SpanIngest_SendSpansClient, error)
+}
+
+type spanIngestClient struct {
+	cc *grpc.ClientConn
+}
+
+func NewSpanIngestClient(cc *grpc.ClientConn) SpanIngestClient {
+	return &spanIngestClient{cc}
+}
+
+func (c *spanIngestClient) SendSpans(ctx context.Context, opts ...grpc.CallOption) (SpanIngest_SendSpansClient, error) {
+	stream, err := grpc.NewClientStream(ctx, &_SpanIngest_serviceDesc.Streams[0], c.cc, "/ssf.SpanIngest/SendSpans", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &spanIngestSendSpansClient{stream}
+	return x, nil
+}
+
+type SpanIngest_SendSpansClient interface {
+	Send(*SSFSample) error
+	CloseAndRecv() (*SSFSpanCounts, error)
+	grpc.ClientStream
+}
+
+type spanIngestSendSpansClient struct {
+	grpc.ClientStream
+}
+
+func (x *spanIngestSendSpansClient) Send(m *SSFSample) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *spanIngestSendSpansClient) CloseAndRecv() (*SSFSpanCounts, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(SSFSpanCounts)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Server API for SpanIngest service
+
+type SpanIngestServer interface {
+	// Sends a stream of spans. When the client closes it, Veneur replies
+	// with how many it accepted and rejected.
+	SendSpans(SpanIngest_SendSpansServer) error
+}
+
+func RegisterSpanIngestServer(s *grpc.Server, srv SpanIngestServer) {
+	s.RegisterService(&_SpanIngest_serviceDesc, srv)
+}
+
+func _SpanIngest_SendSpans_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(SpanIngestServer).SendSpans(&spanIngestSendSpansServer{stream})
+}
+
+type SpanIngest_SendSpansServer interface {
+	SendAndClose(*SSFSpanCounts) error
+	Recv() (*SSFSample, error)
+	grpc.ServerStream
+}
+
+type spanIngestSendSpansServer struct {
+	grpc.ServerStream
+}
+
+func (x *spanIngestSendSpansServer) SendAndClose(m *SSFSpanCounts) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *spanIngestSendSpansServer) Recv() (*SSFSample, error) {
+	m := new(SSFSample)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+var _SpanIngest_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "ssf.SpanIngest",
+	HandlerType: (*SpanIngestServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "SendSpans",
+			Handler:       _SpanIngest_SendSpans_Handler,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "ssf/sample.proto",
+}
+
 var fileDescriptor0 = []byte{
-	// 463 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x64, 0x52, 0x4f, 0x8b, 0xdb, 0x3e,
-	0x10, 0x5d, 0xdb, 0x89, 0x63, 0x4f, 0x7e, 0xbb, 0x88, 0xe1, 0x57, 0x50, 0xff, 0xc0, 0x06, 0xf7,
-	0x92, 0x4b, 0x53, 0x48, 0x2f, 0xbd, 0x9a, 0xe0, 0x4d, 0xcd, 0x76, 0x1d, 0x90, 0x94, 0x2e, 0xf4,
-	0xb2, 0xa8, 0xb1, 0x12, 0x0c, 0xeb, 0x24, 0x58, 0xf2, 0x7e, 0x88, 0x7e, 0xca, 0x7e, 0x94, 0x22,
-	0x29, 0x49, 0x0b, 0xbd, 0xcd, 0x7b, 0x6f, 0xc6, 0xf3, 0xde, 0x58, 0x40, 0xb4, 0xde, 0x7e, 0xd4,
-	0xb2, 0x3d, 0x3e, 0xab, 0xd9, 0xb1, 0x3b, 0x98, 0x03, 0x46, 0x5a, 0x6f, 0xb3, 0x39, 0xc4, 0x9c,
-	0xdf, 0x09, 0xb9, 0x43, 0x84, 0xc1, 0x5e, 0xb6, 0x8a, 0x06, 0x93, 0x60, 0x9a, 0x32, 0x57, 0xe3,
-	0xff, 0x30, 0x7c, 0x91, 0xcf, 0xbd, 0xa2, 0xa1, 0x23, 0x3d, 0xc8, 0x7e, 0x06, 0x90, 0xd8, 0xa1,
-	0x4e, 0x6e, 0x14, 0xbe, 0x86, 0xc4, 0xd8, 0xe2, 0xa9, 0xa9, 0xdd, 0x68, 0xc4, 0x46, 0x0e, 0x97,
-	0x35, 0xde, 0x40, 0xd8, 0xd4, 0x6e, 0x34, 0x62, 0x61, 0x53, 0xe3, 0x5b, 0x48, 0x8f, 0xb2, 0x53,
-	0x7b, 0x63, 0x7b, 0x23, 0x47, 0x27, 0x9e, 0x28, 0x6b, 0x7c, 0x03, 0x49, 0xa7, 0xf4, 0xa1, 0xef,
-	0x36, 0x8a, 0x0e, 0xdc, 0xb6, 0x0b, 0xb6, 0x5a, 0xdd, 0x77, 0xd2, 0x34, 0x87, 0x3d, 0x1d, 0xfa,
-	0xb9, 0x33, 0xce, 0x7e, 0x45, 0x90, 0x72, 0x7e, 0xc7, 0x5d, 0x32, 0xfc, 0x00, 0x71, 0xab, 0x4c,
-	0xd7, 0x6c, 0x9c, 0x97, 0x9b, 0xf9, 0xab, 0x99, 0xd6, 0xdb, 0xd9, 0x45, 0x9f, 0x3d, 0x38, 0x91,
-	0x9d, 0x9a, 0x2e, 0x99, 0xc3, 0xbf, 0x32, 0xbf, 0x83, 0xd4, 0x34, 0xad, 0xd2, 0x46, 0xb6, 0xc7,
-	0x93, 0xcb, 0x3f, 0x04, 0x52, 0x18, 0xb5, 0x4a, 0x6b, 0xb9, 0x3b, 0xbb, 0x3c, 0x43, 0xbb, 0x5a,
-	0x1b, 0x69, 0x7a, 0xed, 0x2c, 0xfe, 0xbb, 0x9a, 0x3b, 0x91, 0x9d, 0x9a, 0xf0, 0x16, 0xc6, 0xfe,
-	0x6f, 0x3c, 0x75, 0xd2, 0x28, 0x1a, 0x4f, 0x82, 0x69, 0xc8, 0xc0, 0x53, 0x4c, 0x1a, 0x85, 0xb7,
-	0x30, 0x30, 0x72, 0xa7, 0xe9, 0x68, 0x12, 0x4d, 0xc7, 0xf3, 0xf1, 0xf9, 0x6b, 0x42, 0xee, 0x98,
-	0x13, 0xac, 0xf9, 0x7e, 0xdf, 0x18, 0x9a, 0x78, 0xf3, 0xb6, 0xc6, 0xf7, 0x30, 0x74, 0xd7, 0xa7,
-	0xe9, 0x24, 0x98, 0x8e, 0xe7, 0xd7, 0x97, 0x29, 0x4b, 0x32, 0xaf, 0xd9, 0x0c, 0x5a, 0x75, 0x2f,
-	0xcd, 0x46, 0x51, 0xf0, 0x19, 0x4e, 0x30, 0xfb, 0x0e, 0xb1, 0xbf, 0x10, 0x8e, 0x61, 0xb4, 0x58,
-	0xad, 0x2b, 0x51, 0x30, 0x72, 0x85, 0x29, 0x0c, 0x97, 0xf9, 0x7a, 0x59, 0x90, 0x00, 0xaf, 0x21,
-	0xfd, 0x52, 0x72, 0xb1, 0x5a, 0xb2, 0xfc, 0x81, 0x84, 0x38, 0x82, 0x88, 0x17, 0x82, 0x44, 0x08,
-	0x10, 0x73, 0x91, 0x8b, 0x35, 0x27, 0x03, 0xdb, 0x5e, 0x7c, 0x2b, 0x2a, 0x41, 0x86, 0xb6, 0x14,
-	0x2c, 0x5f, 0x14, 0x24, 0xce, 0x3e, 0x43, 0xec, 0x4f, 0x80, 0x31, 0x84, 0xab, 0x7b, 0x72, 0x65,
-	0x77, 0x3c, 0xe6, 0xac, 0x2a, 0xab, 0x25, 0x09, 0xf0, 0x3f, 0x48, 0x16, 0xac, 0x14, 0xe5, 0x22,
-	0xff, 0x4a, 0x42, 0x2b, 0xad, 0xab, 0xfb, 0x6a, 0xf5, 0x58, 0x91, 0xe8, 0x47, 0xec, 0xde, 0xeb,
-	0xa7, 0xdf, 0x01, 0x00, 0x00, 0xff, 0xff, 0xde, 0xf2, 0x50, 0x4c, 0xc3, 0x02, 0x00, 0x00,
+	// 639 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x6c, 0x54, 0x51, 0x6f, 0xd3, 0x3c,
+	0x14, 0x5d, 0x92, 0x36, 0x6d, 0x6e, 0xbf, 0x55, 0x96, 0xb5, 0x4f, 0x32, 0x03, 0x69, 0x55, 0xc6,
+	0x43, 0x5f, 0x28, 0x50, 0x5e, 0x78, 0x43, 0xa5, 0xea, 0x4a, 0xb4, 0x2e, 0x95, 0x9c, 0x94, 0x49,
+	0xbc, 0x4c, 0x26, 0x71, 0xa3, 0xa0, 0x36, 0x89, 0x62, 0x77, 0xd2, 0xfe, 0x02, 0x7f, 0x85, 0xff,
+	0xc7, 0x33, 0xb2, 0xdd, 0x64, 0x0c, 0x78, 0xf3, 0xb9, 0xc7, 0xf1, 0xbd, 0xe7, 0xde, 0x73, 0x03,
+	0x48, 0x88, 0xed, 0x6b, 0xc1, 0xf6, 0xd5, 0x8e, 0x4f, 0xaa, 0xba, 0x94, 0x25, 0x76, 0x84, 0xd8,
+	0xfa, 0xdf, 0x2d, 0x70, 0xa3, 0xe8, 0x2a, 0x66, 0x19, 0xc6, 0xd0, 0x29, 0xd8, 0x9e, 0x13, 0x6b,
+	0x64, 0x8d, 0x3d, 0xaa, 0xcf, 0xf8, 0x0c, 0xba, 0xf7, 0x6c, 0x77, 0xe0, 0xc4, 0xd6, 0x41, 0x03,
+	0xf0, 0x4b, 0xe8, 0xc8, 0x87, 0x8a, 0x13, 0x67, 0x64, 0x8d, 0x87, 0x53, 0x34, 0x11, 0x62, 0x3b,
+	0x31, 0x8f, 0x4c, 0xe2, 0x87, 0x8a, 0x53, 0xcd, 0xfa, 0x6f, 0xa0, 0xa3, 0x10, 0x06, 0x70, 0xa3,
+	0x98, 0x06, 0xe1, 0x12, 0x9d, 0xe0, 0x1e, 0x38, 0x41, 0x18, 0x23, 0x0b, 0x7b, 0xd0, 0xbd, 0x5a,
+	0xad, 0x67, 0x31, 0xb2, 0x71, 0x1f, 0x3a, 0x1f, 0xd7, 0xeb, 0x15, 0x72, 0xfc, 0x1f, 0x16, 0xf4,
+	0xd5, 0x3b, 0x35, 0x4b, 0x38, 0x7e, 0x06, 0x7d, 0xa9, 0x0e, 0x77, 0x79, 0xaa, 0x4b, 0x72, 0x68,
+	0x4f, 0xe3, 0x20, 0xc5, 0x43, 0xb0, 0xf3, 0x54, 0x97, 0xe4, 0x50, 0x3b, 0x4f, 0xf1, 0x73, 0xf0,
+	0x2a, 0x56, 0xf3, 0x42, 0xaa, 0xbb, 0x8e, 0x0e, 0xf7, 0x4d, 0x20, 0x48, 0xf1, 0x39, 0xf4, 0x6b,
+	0x2e, 0xca, 0x43, 0x9d, 0x70, 0xd2, 0xd1, 0x2a, 0x5a, 0xac, 0xb8, 0xf4, 0x50, 0x33, 0x99, 0x97,
+	0x05, 0xe9, 0x9a, 0xef, 0x1a, 0x8c, 0x2f, 0xa0, 0xb3, 0x2b, 0x33, 0x41, 0xdc, 0x91, 0x33, 0x1e,
+	0x4c, 0x07, 0x8d, 0xc8, 0x55, 0x99, 0x51, 0x4d, 0xf8, 0x3f, 0x1d, 0xf0, 0xa2, 0xe8, 0x2a, 0xd2,
+	0x3d, 0xc5, 0xaf, 0xc0, 0xdd, 0x73, 0x59, 0xe7, 0x89, 0x2e, 0x76, 0x38, 0xfd, 0xbf, 0xf9, 0xc0,
+	0xf0, 0x93, 0x1b, 0x4d, 0xd2, 0xe3, 0xa5, 0xb6, 0xd9, 0xf6, 0x6f, 0xcd, 0x7e, 0x01, 0x9e, 0xcc,
+	0xf7, 0x5c, 0x48, 0xb6, 0xaf, 0x8e, 0x32, 0x1e, 0x03, 0x98, 0x40, 0x6f, 0xcf, 0x85, 0x60, 0x59,
+	0x23, 0xa3, 0x81, 0x2a, 0xb5, 0x90, 0x4c, 0x1e, 0x04, 0xe9, 0xfe, 0x33, 0x75, 0xa4, 0x49, 0x7a,
+	0xbc, 0x84, 0x2f, 0x60, 0x60, 0x7c, 0x70, 0x57, 0x33, 0xc9, 0x89, 0x3b, 0xb2, 0xc6, 0x36, 0x05,
+	0x13, 0xa2, 0x4c, 0x72, 0xa5, 0x5c, 0xb2, 0x4c, 0x90, 0xde, 0x53, 0xe5, 0x31, 0xcb, 0xa8, 0x26,
+	0x54, 0xf1, 0x87, 0x22, 0x97, 0xa4, 0x6f, 0x8a, 0x57, 0x67, 0x7c, 0x09, 0x5d, 0x3d, 0x1e, 0xe2,
+	0x8d, 0xac, 0xf1, 0x60, 0x7a, 0xda, 0x7e, 0xa5, 0x82, 0xd4, 0x70, 0x4a, 0x83, 0xe0, 0xf5, 0x7d,
+	0x9e, 0x70, 0x02, 0x46, 0xc3, 0x11, 0x3e, 0x1a, 0x6d, 0xa0, 0xcb, 0x31, 0xc0, 0xff, 0x02, 0xae,
+	0xe9, 0x1b, 0x1e, 0x40, 0x6f, 0xbe, 0xde, 0x84, 0xf1, 0x82, 0xa2, 0x13, 0x65, 0x9e, 0xe5, 0x6c,
+	0xb3, 0x5c, 0x20, 0x0b, 0x9f, 0x82, 0xf7, 0x29, 0x88, 0xe2, 0xf5, 0x92, 0xce, 0x6e, 0x90, 0xad,
+	0xfc, 0x15, 0x2d, 0x62, 0xe4, 0x18, 0xd3, 0xcd, 0xe2, 0x4d, 0x84, 0x3a, 0xea, 0xfa, 0xe2, 0xf3,
+	0x22, 0x8c, 0x51, 0x57, 0x1d, 0x63, 0x3a, 0x9b, 0x2f, 0x90, 0xeb, 0xbf, 0x07, 0xd7, 0x34, 0x06,
+	0xbb, 0x60, 0xaf, 0xaf, 0xd1, 0x89, 0xca, 0x71, 0x3b, 0xa3, 0xa1, 0x72, 0xaa, 0x85, 0xff, 0x83,
+	0xfe, 0x9c, 0x06, 0x71, 0x30, 0x9f, 0xad, 0x90, 0xad, 0xa8, 0x4d, 0x78, 0x1d, 0xae, 0x6f, 0x43,
+	0xe4, 0xf8, 0x4c, 0xaf, 0xcc, 0xaa, 0xcc, 0x9e, 0x4e, 0xcc, 0xfa, 0x73, 0x62, 0x67, 0xd0, 0xe5,
+	0xf7, 0xbc, 0x90, 0xcd, 0xf2, 0x68, 0x80, 0x2f, 0xc1, 0xdd, 0xe6, 0x7c, 0x97, 0x0a, 0xe2, 0xfc,
+	0xdd, 0xdf, 0x23, 0xe5, 0x2f, 0xe1, 0x54, 0xcd, 0xaf, 0x62, 0xc5, 0xbc, 0x3c, 0x14, 0x52, 0x28,
+	0xa7, 0xb2, 0x24, 0xe1, 0x95, 0xe4, 0xcd, 0x36, 0xb4, 0xd8, 0x38, 0xfc, 0x1b, 0x4f, 0x14, 0x67,
+	0x96, 0xa2, 0xc5, 0xd3, 0x0f, 0x00, 0xea, 0x95, 0xa0, 0xc8, 0xb8, 0x90, 0xf8, 0x2d, 0x78, 0x11,
+	0x2f, 0x52, 0x15, 0x11, 0x78, 0xf8, 0xd4, 0x26, 0xe7, 0xb8, 0xc5, 0x6d, 0xda, 0xb1, 0xf5, 0xd5,
+	0xd5, 0x3f, 0x8b, 0x77, 0xbf, 0x06, 0x00, 0x34, 0x1b, 0xae, 0x1b, 0x40, 0x04, 0x00, 0x00,
 }
@@ -0,0 +1,220 @@
+package veneur
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/golang/protobuf/proto"
+	"github.com/stripe/veneur/samplers"
+	"github.com/stripe/veneur/ssf"
+)
+
+// defaultSSFMaxFrameLength is the largest SSF frame accepted over TCP when
+// ssf_max_frame_length is not set.
+const defaultSSFMaxFrameLength = 64 * 1024
+
+// ssfFrameHeaderLength is the size of the big-endian length prefix in front
+// of every SSF frame.
+const ssfFrameHeaderLength = 4
+
+// ErrFrameTooLarge is returned when an SSF frame's length prefix exceeds the
+// maximum frame length.
+var ErrFrameTooLarge = errors.New("SSF frame exceeds the maximum frame length")
+
+// WriteSSFFrame writes a single SSF sample to w as a frame: a 4-byte
+// big-endian length, followed by that many bytes of protobuf. Clients batch
+// metrics by writing many frames on one connection.
+func WriteSSFFrame(w io.Writer, sample *ssf.SSFSample) error {
+	packet, err := proto.Marshal(sample)
+	if err != nil {
+		return err
+	}
+	frame := make([]byte, ssfFrameHeaderLength+len(packet))
+	binary.BigEndian.PutUint32(frame, uint32(len(packet)))
+	copy(frame[ssfFrameHeaderLength:], packet)
+	_, err = w.Write(frame)
+	return err
+}
+
+// ssfBatchMarker is the first byte of a trace packet holding several SSF
+// samples. No protobuf message starts with it, since 0 isn't a valid field
+// number, so packets of a single sample are read as before.
+const ssfBatchMarker = 0x00
+
+// errSSFBatchFraming is returned for a batched trace packet whose lengths
+// don't match its contents.
+var errSSFBatchFraming = errors.New("SSF batch has a malformed length prefix")
+
+// MarshalSSFBatch encodes several SSF samples into one trace packet: the
+// batch marker, then each sample's protobuf prefixed with its length as a
+// varint. Clients batch spans this way to send fewer datagrams.
+func MarshalSSFBatch(samples []*ssf.SSFSample) ([]byte, error) {
+	packet := []byte{ssfBatchMarker}
+	var length [binary.MaxVarintLen64]byte
+	for _, sample := range samples {
+		encoded, err := proto.Marshal(sample)
+		if err != nil {
+			return nil, err
+		}
+		n := binary.PutUvarint(length[:], uint64(len(encoded)))
+		packet = append(packet, length[:n]...)
+		packet = append(packet, encoded...)
+	}
+	return packet, nil
+}
+
+// splitSSFBatch returns the samples in a batched trace packet, after its
+// marker. If the framing is malformed, it returns the samples before the
+// malformed one, and errSSFBatchFraming.
+func splitSSFBatch(batch []byte) ([][]byte, error) {
+	var samples [][]byte
+	for len(batch) > 0 {
+		length, n := binary.Uvarint(batch)
+		if n <= 0 || length == 0 || length > uint64(len(batch)-n) {
+			return samples, errSSFBatchFraming
+		}
+		samples = append(samples, batch[n:n+int(length)])
+		batch = batch[n+int(length):]
+	}
+	return samples, nil
+}
+
+// readSSFFrame reads the next frame from r into buf, growing it if needed,
+// and returns the frame's payload. It returns io.EOF if r ends cleanly
+// between frames.
+func readSSFFrame(r io.Reader, buf []byte, maxLength int) ([]byte, error) {
+	var header [ssfFrameHeaderLength]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	length := int(binary.BigEndian.Uint32(header[:]))
+	if length > maxLength {
+		return nil, ErrFrameTooLarge
+	}
+	if cap(buf) < length {
+		buf = make([]byte, length)
+	}
+	buf = buf[:length]
+	if _, err := io.ReadFull(r, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return buf, nil
+}
+
+// HandleSSFMetric processes a single SSF sample containing a metric and
+// sends it to the appropriate worker.
+func (s *Server) HandleSSFMetric(sample *ssf.SSFSample) error {
+	metric, err := samplers.ParseMetricSSF(sample)
+	if err == nil {
+		err = s.checkTagLengths(metric)
+	}
+	if err != nil {
+		s.countParseError(err, "ssf_metric", logrus.Fields{"name": sample.Name}, "Could not parse SSF metric")
+		return err
+	}
+	s.normalizeName(metric)
+	if !s.limitTags(metric, nil) {
+		return nil
+	}
+	if s.forwardMetric(metric) {
+		return nil
+	}
+	s.scaleInput(metric)
+	s.workerFor(metric).Send(*metric)
+	return nil
+}
+
+func (s *Server) handleSSFConnection(conn net.Conn) {
+	defer func() {
+		ConsumePanic(s.Sentry, s.Statsd, s.Hostname, recover())
+	}()
+	defer func() {
+		log.WithField("peer", conn.RemoteAddr()).Debug("Closing SSF connection")
+		if err := conn.Close(); err != nil {
+			log.WithFields(logrus.Fields{
+				logrus.ErrorKey: err,
+				"peer":          conn.RemoteAddr(),
+			}).Info("SSF connection close failed")
+		}
+	}()
+	s.Statsd.Count("ssf.connects", 1, nil, 1.0)
+
+	// time out idle connections to prevent leaking memory/goroutines
+	timeout := defaultTCPReadTimeout
+	if s.tcpReadTimeout != 0 {
+		timeout = s.tcpReadTimeout
+	}
+	if !s.handshakeTLS(conn, timeout, "ssf") {
+		return
+	}
+
+	var buf []byte
+	for {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		frame, err := readSSFFrame(conn, buf, s.ssfMaxFrameLength)
+		if err != nil {
+			if err == ErrFrameTooLarge {
+				// we can't skip the frame without reading it, so give up
+				// on the connection rather than buffer it
+				s.Statsd.Count("packet.error_total", 1, []string{"packet_type:ssf_metric", "reason:too_large"}, 1.0)
+			}
+			if err != io.EOF {
+				// usually "read: connection reset by peer" or "i/o timeout"
+				log.WithFields(logrus.Fields{
+					logrus.ErrorKey: err,
+					"peer":          conn.RemoteAddr(),
+				}).Info("Error reading from SSF client")
+			}
+			return
+		}
+		buf = frame
+		if !s.ingestLimiter.Allow(conn.RemoteAddr()) {
+			continue
+		}
+
+		sample := &ssf.SSFSample{}
+		if err := proto.Unmarshal(frame, sample); err != nil {
+			// the framing is still intact, so only this frame is lost
+			s.Statsd.Count("packet.error_total", 1, []string{"packet_type:ssf_metric", "reason:unmarshal"}, 1.0)
+			log.WithError(err).Warn("SSF metric unmarshaling error")
+			continue
+		}
+		if sample.Metric == ssf.SSFSample_TRACE {
+			// spans sent over TCP aren't lost like UDP packets can be
+			if !s.TracingEnabled() {
+				s.Statsd.Count("packet.error_total", 1, []string{"packet_type:trace", "reason:tracing_disabled"}, 1.0)
+				continue
+			}
+			s.handleSpan(sample)
+			continue
+		}
+		s.HandleSSFMetric(sample)
+	}
+}
+
+// ReadSSFSocket listens on Server.SSFAddr for new connections carrying
+// framed SSF metrics, starting a goroutine for each.
+func (s *Server) ReadSSFSocket() {
+	for {
+		conn, err := s.ssfListener.Accept()
+		if err != nil {
+			select {
+			case <-s.shutdown:
+				// occurs when cleanly shutting down the server e.g. in tests; ignore errors
+				log.WithError(err).Info("Ignoring SSF Accept error while shutting down")
+				return
+			default:
+			}
+			log.WithError(err).Fatal("SSF accept failed")
+		}
+
+		go s.handleSSFConnection(conn)
+	}
+}
@@ -0,0 +1,263 @@
+package veneur
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stripe/veneur/ssf"
+)
+
+func TestReadSSFFrame(t *testing.T) {
+	sample := &ssf.SSFSample{Metric: ssf.SSFSample_GAUGE, Name: "a.b.c", Value: 3}
+	var stream bytes.Buffer
+	assert.NoError(t, WriteSSFFrame(&stream, sample))
+	assert.NoError(t, WriteSSFFrame(&stream, sample))
+	frameLength := stream.Len() / 2
+
+	var buf []byte
+	for i := 0; i < 2; i++ {
+		frame, err := readSSFFrame(&stream, buf, frameLength)
+		assert.NoError(t, err)
+		assert.Len(t, frame, frameLength-ssfFrameHeaderLength)
+		buf = frame
+	}
+	_, err := readSSFFrame(&stream, buf, frameLength)
+	assert.Equal(t, io.EOF, err, "a stream ending between frames is a clean EOF")
+
+	assert.NoError(t, WriteSSFFrame(&stream, sample))
+	_, err = readSSFFrame(&stream, buf, frameLength-ssfFrameHeaderLength-1)
+	assert.Equal(t, ErrFrameTooLarge, err)
+
+	stream.Reset()
+	assert.NoError(t, WriteSSFFrame(&stream, sample))
+	stream.Truncate(stream.Len() - 1)
+	_, err = readSSFFrame(&stream, buf, frameLength)
+	assert.Equal(t, io.ErrUnexpectedEOF, err, "a stream ending inside a frame is an error")
+}
+
+// TestSSFMetricsOverTCP streams several batches of framed SSF metrics over
+// one connection and checks that they are aggregated.
+func TestSSFMetricsOverTCP(t *testing.T) {
+	config := localConfig()
+	config.Interval = "60s"
+	config.SsfTcpAddress = fmt.Sprintf("127.0.0.1:%d", HTTPAddrPort)
+	HTTPAddrPort++
+	f := newFixture(t, config)
+	defer f.Close()
+
+	conn, err := net.Dial("tcp", config.SsfTcpAddress)
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	tags := []*ssf.SSFTag{{Name: "baz", Value: "gorch"}}
+	const batches = 3
+	for i := 0; i < batches; i++ {
+		var batch bytes.Buffer
+		for j := 0; j < 4; j++ {
+			assert.NoError(t, WriteSSFFrame(&batch, &ssf.SSFSample{
+				Metric: ssf.SSFSample_COUNTER,
+				Name:   "ssf.counter",
+				Value:  1,
+				Tags:   tags,
+			}))
+		}
+		assert.NoError(t, WriteSSFFrame(&batch, &ssf.SSFSample{
+			Metric: ssf.SSFSample_GAUGE,
+			Name:   "ssf.gauge",
+			Value:  float32(i),
+		}))
+		_, err = conn.Write(batch.Bytes())
+		assert.NoError(t, err)
+	}
+
+	waitForProcessed(t, batches*5, f.server.Workers[0])
+
+	f.server.Flush()
+	values := map[string]float64{}
+	for _, metric := range (<-f.ddmetrics).Series {
+		values[metric.Name] = metric.Value[0][1]
+		if metric.Name == "ssf.counter" {
+			assert.Equal(t, []string{"baz:gorch"}, metric.Tags)
+		}
+	}
+	assert.InEpsilon(t, batches*4, values["ssf.counter"]*f.interval.Seconds(), 0.001)
+	assert.Equal(t, float64(batches-1), values["ssf.gauge"], "gauges keep the last value")
+}
+
+// TestSSFMetricsOverTLS checks that with tls_authority_certificate set, the
+// SSF listener only reads from clients with a certificate it signed.
+func TestSSFMetricsOverTLS(t *testing.T) {
+	pems, err := readTestKeysCerts()
+	if err != nil {
+		t.Fatal("could not read test keys/certs:", err)
+	}
+	config := localConfig()
+	config.NumWorkers = 1
+	config.Interval = "60s"
+	config.SsfTcpAddress = fmt.Sprintf("127.0.0.1:%d", HTTPAddrPort)
+	HTTPAddrPort++
+	config.TLSKey = pems["serverkey.pem"]
+	config.TLSCertificate = pems["servercert.pem"]
+	config.TLSAuthorityCertificate = pems["cacert.pem"]
+	f := newFixture(t, config)
+	defer f.Close()
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM([]byte(pems["cacert.pem"]))
+	clientConfig := func(certName string) *tls.Config {
+		config := &tls.Config{RootCAs: roots, ServerName: "localhost"}
+		if certName != "" {
+			cert, err := tls.X509KeyPair([]byte(pems[certName]), []byte(pems["clientkey.pem"]))
+			if err != nil {
+				t.Fatal(err)
+			}
+			config.Certificates = []tls.Certificate{cert}
+		}
+		return config
+	}
+	send := func(name string, config *tls.Config) net.Conn {
+		conn, err := tls.Dial("tcp", f.server.SSFAddr.String(), config)
+		if err != nil {
+			// the client may see the rejection during the handshake
+			return nil
+		}
+		WriteSSFFrame(conn, &ssf.SSFSample{Metric: ssf.SSFSample_GAUGE, Name: name, Value: 1})
+		return conn
+	}
+
+	for name, certName := range map[string]string{"ssf.anonymous": "", "ssf.wrong": "clientcert_wrong.pem"} {
+		conn := send(name, clientConfig(certName))
+		if conn == nil {
+			continue
+		}
+		// the server closes the connection without reading anything
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err := conn.Read(make([]byte, 1))
+		if assert.Error(t, err, "%s should be refused", name) {
+			netErr, ok := err.(net.Error)
+			assert.False(t, ok && netErr.Timeout(), "%s should be refused, not left open", name)
+		}
+		conn.Close()
+	}
+
+	conn := send("ssf.authenticated", clientConfig("clientcert_correct.pem"))
+	if !assert.NotNil(t, conn, "an authenticated client should connect") {
+		return
+	}
+	defer conn.Close()
+	waitForProcessed(t, 1, f.server.Workers[0])
+
+	f.server.Flush()
+	var names []string
+	for _, metric := range withoutHeartbeat((<-f.ddmetrics).Series) {
+		names = append(names, metric.Name)
+	}
+	assert.Equal(t, []string{"ssf.authenticated"}, names, "only the authenticated client's metric should be read")
+}
+
+func TestHandleTracePacketBatch(t *testing.T) {
+	s := &Server{TraceWorker: &TraceWorker{TraceChan: make(chan ssf.SSFSample, 10)}}
+	span := func(id int64) *ssf.SSFSample {
+		return &ssf.SSFSample{
+			Metric:  ssf.SSFSample_TRACE,
+			Name:    "veneur.trace.test",
+			Service: "veneur",
+			Trace:   &ssf.SSFTrace{TraceId: 1, Id: id},
+		}
+	}
+	received := func() []int64 {
+		var ids []int64
+		for {
+			select {
+			case sample := <-s.TraceWorker.TraceChan:
+				ids = append(ids, sample.Trace.Id)
+			default:
+				return ids
+			}
+		}
+	}
+
+	packet, err := MarshalSSFBatch([]*ssf.SSFSample{span(1), span(2), span(3)})
+	assert.NoError(t, err)
+	s.HandleTracePacket(packet)
+	assert.Equal(t, []int64{1, 2, 3}, received(), "every span in the batch should be ingested")
+
+	single, err := proto.Marshal(span(4))
+	assert.NoError(t, err)
+	s.HandleTracePacket(single)
+	assert.Equal(t, []int64{4}, received(), "unbatched packets should still be read")
+
+	// a length longer than the rest of the packet loses the spans after it
+	truncated := append(packet[:len(packet):len(packet)], 0x7f, 0x08)
+	s.HandleTracePacket(truncated)
+	assert.Equal(t, []int64{1, 2, 3}, received(), "spans before a malformed length should be ingested")
+}
+
+func TestSSFSpansOverTCP(t *testing.T) {
+	s := &Server{
+		TraceWorker:       &TraceWorker{TraceChan: make(chan ssf.SSFSample, 10)},
+		ssfMaxFrameLength: defaultSSFMaxFrameLength,
+	}
+	client, conn := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		s.handleSSFConnection(conn)
+		close(done)
+	}()
+
+	for id := int64(1); id <= 3; id++ {
+		assert.NoError(t, WriteSSFFrame(client, &ssf.SSFSample{
+			Metric:  ssf.SSFSample_TRACE,
+			Name:    "veneur.trace.test",
+			Service: "veneur",
+			Trace:   &ssf.SSFTrace{TraceId: 1, Id: id},
+		}))
+	}
+	client.Close()
+	<-done
+
+	close(s.TraceWorker.TraceChan)
+	var ids []int64
+	for span := range s.TraceWorker.TraceChan {
+		ids = append(ids, span.Trace.Id)
+	}
+	assert.Equal(t, []int64{1, 2, 3}, ids, "spans should be sent to the trace worker")
+}
+
+func TestSSFRateLimited(t *testing.T) {
+	s := &Server{
+		TraceWorker:       &TraceWorker{TraceChan: make(chan ssf.SSFSample, 10)},
+		ssfMaxFrameLength: defaultSSFMaxFrameLength,
+		ingestLimiter:     newIngestLimiter(2, false),
+	}
+	now := time.Now()
+	s.ingestLimiter.now = func() time.Time { return now }
+	client, conn := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		s.handleSSFConnection(conn)
+		close(done)
+	}()
+
+	for id := int64(1); id <= 3; id++ {
+		assert.NoError(t, WriteSSFFrame(client, &ssf.SSFSample{
+			Metric:  ssf.SSFSample_TRACE,
+			Name:    "veneur.trace.test",
+			Service: "veneur",
+			Trace:   &ssf.SSFTrace{TraceId: 1, Id: id},
+		}))
+	}
+	client.Close()
+	<-done
+
+	assert.Len(t, s.TraceWorker.TraceChan, 2, "frames over max_packets_per_second should be dropped")
+	assert.Equal(t, int64(1), s.ingestLimiter.Dropped())
+}
@@ -0,0 +1,80 @@
+package veneur
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/stripe/veneur/ssf"
+	"github.com/stripe/veneur/trace"
+)
+
+// spanWriters are the streams that trace_stdout_sink can print spans to.
+var spanWriters = map[string]io.Writer{
+	"stdout": os.Stdout,
+	"stderr": os.Stderr,
+}
+
+// flushSpansStdout prints each span as a line for people to read, to the
+// stream named by trace_stdout_sink.
+func (s *Server) flushSpansStdout(ctx context.Context, samples []ssf.SSFSample) error {
+	span, _ := trace.StartSpanFromContext(ctx, "flush", trace.NameTag("veneur.opentracing.flush.flushSpansStdout"))
+	defer span.Finish()
+
+	// one write per flush, so that flushes that overlap don't interleave
+	buf := bytes.Buffer{}
+	for _, sample := range samples {
+		buf.WriteString(s.formatSpan(sample))
+		buf.WriteByte('\n')
+	}
+	_, err := s.spanWriter.Write(buf.Bytes())
+	return err
+}
+
+// formatSpan renders a span on one line: when it started, its trace, span
+// and parent IDs, service, name, resource, duration and status, followed by
+// its tags sorted by name, eg
+//
+//   2016-10-10T17:04:18.000Z trace=1 span=2 parent=0 service=veneur name=http.request resource="GET /cart" duration=1.5ms status=OK route=/cart
+//
+// Values with spaces or quotes are quoted. Tags are redacted as they are
+// for Datadog.
+func (s *Server) formatSpan(sample ssf.SSFSample) string {
+	t := sample.Trace
+	if t == nil {
+		t = &ssf.SSFTrace{}
+	}
+	fields := []string{
+		time.Unix(0, sample.Timestamp).UTC().Format("2006-01-02T15:04:05.000Z07:00"),
+		fmt.Sprintf("trace=%d", t.TraceId),
+		fmt.Sprintf("span=%d", t.Id),
+		fmt.Sprintf("parent=%d", t.ParentId),
+		"service=" + quoteSpanField(sample.Service),
+		"name=" + quoteSpanField(sample.Name),
+		"resource=" + quoteSpanField(t.Resource),
+		"duration=" + time.Duration(t.Duration).String(),
+		"status=" + sample.Status.String(),
+	}
+
+	tags := make([]string, 0, len(sample.Tags))
+	for _, tag := range sample.Tags {
+		tags = append(tags, quoteSpanField(tag.Name)+"="+quoteSpanField(s.redactSpanTag(tag.Value)))
+	}
+	sort.Strings(tags)
+	return strings.Join(append(fields, tags...), " ")
+}
+
+// quoteSpanField quotes value if it is empty, or would otherwise be hard to
+// tell apart from the fields around it.
+func quoteSpanField(value string) string {
+	if value == "" || strings.ContainsAny(value, " \t\n\"=") {
+		return strconv.Quote(value)
+	}
+	return value
+}
@@ -0,0 +1,91 @@
+package veneur
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stripe/veneur/ssf"
+	"github.com/stripe/veneur/trace"
+)
+
+// spanLines sends every write on it.
+type spanLines chan string
+
+func (sl spanLines) Write(p []byte) (int, error) {
+	sl <- string(p)
+	return len(p), nil
+}
+
+func TestFormatSpan(t *testing.T) {
+	s := &Server{}
+	sample := ssf.SSFSample{
+		Name:      "http.request",
+		Service:   "veneur",
+		Timestamp: 1476119058000000000,
+		Status:    ssf.SSFSample_CRITICAL,
+		Trace: &ssf.SSFTrace{
+			TraceId:  1,
+			Id:       2,
+			ParentId: 1,
+			Resource: "GET /cart",
+			Duration: int64(1500 * time.Microsecond),
+		},
+		Tags: []*ssf.SSFTag{{Name: "route", Value: "/cart"}, {Name: "error.msg", Value: `bad "thing"`}},
+	}
+	assert.Equal(t,
+		`2016-10-10T17:04:18.000Z trace=1 span=2 parent=1 service=veneur name=http.request resource="GET /cart" duration=1.5ms status=CRITICAL error.msg="bad \"thing\"" route=/cart`,
+		s.formatSpan(sample))
+}
+
+func TestFlushSpansStdout(t *testing.T) {
+	lines := make(spanLines, 1)
+	s := &Server{spanWriter: lines}
+	sample := ssf.SSFSample{
+		Name:  "http.request",
+		Trace: &ssf.SSFTrace{TraceId: 1, Id: 1, Resource: "GET /cart", Duration: int64(time.Second)},
+	}
+	assert.NoError(t, s.flushSpansStdout(context.Background(), []ssf.SSFSample{sample, sample}))
+	assert.Equal(t, s.formatSpan(sample)+"\n"+s.formatSpan(sample)+"\n", <-lines, "every span should be written at once")
+}
+
+func TestFlushTracesStdout(t *testing.T) {
+	config := globalConfig()
+	config.TraceAPIAddress = ""
+	config.TraceStdoutSink = "stderr"
+	unstarted, err := NewFromConfig(config)
+	assert.NoError(t, err)
+	assert.False(t, unstarted.TracingEnabled(), "the stdout sink shouldn't enable tracing by itself")
+
+	traceAPI := newTraceAPI()
+	defer traceAPI.Close()
+	config.TraceAPIAddress = traceAPI.URL
+	server := setupVeneurServer(t, config, nil)
+	defer server.Shutdown()
+	lines := make(spanLines, 1)
+	server.spanWriter = lines
+
+	span := trace.StartTrace("GET /cart")
+	span.Name = "http.request"
+	span.Start = span.Start.Add(-250 * time.Millisecond)
+	span.End = span.Start.Add(250 * time.Millisecond)
+	sample := span.SSFSample()
+	packet, err := proto.Marshal(sample)
+	assert.NoError(t, err)
+	server.HandleTracePacket(packet)
+	server.Flush()
+
+	select {
+	case line := <-lines:
+		assert.Contains(t, line, `resource="GET /cart"`)
+		assert.Contains(t, line, "duration=250ms")
+	case <-time.After(10 * time.Second):
+		assert.Fail(t, "no spans were printed")
+	}
+
+	config.TraceStdoutSink = "stdlog"
+	_, err = NewFromConfig(config)
+	assert.Error(t, err, "only stdout and stderr can be printed to")
+}
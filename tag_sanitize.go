@@ -0,0 +1,113 @@
+package veneur
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/stripe/veneur/samplers"
+)
+
+// defaultTagMaxLength is Datadog's limit on the length of a tag, used if
+// tag_max_length isn't set.
+const defaultTagMaxLength = 200
+
+// tagSanitizer cleans up the tags of flushed metrics, so that a tag value
+// with a comma, pipe or newline in it can't break a sink's protocol, or be
+// read as more than one tag. Datadog allows letters, digits, "_", "-", ":",
+// ".", and "/" in tags; anything else is stripped or replaced with "_".
+type tagSanitizer struct {
+	replace   bool
+	lowercase bool
+	maxLength int
+}
+
+// newTagSanitizer parses tag_sanitization, which is "off", "strip" or
+// "replace". It returns nil if sanitization is off.
+func newTagSanitizer(mode string, lowercase bool, maxLength int) (*tagSanitizer, error) {
+	ts := &tagSanitizer{lowercase: lowercase, maxLength: maxLength}
+	switch mode {
+	case "", "off":
+		return nil, nil
+	case "strip":
+	case "replace":
+		ts.replace = true
+	default:
+		return nil, fmt.Errorf("tag_sanitization must be off, strip or replace, got %q", mode)
+	}
+	if maxLength < 0 {
+		return nil, fmt.Errorf("tag_max_length must not be negative, got %d", maxLength)
+	}
+	if maxLength == 0 {
+		ts.maxLength = defaultTagMaxLength
+	}
+	return ts, nil
+}
+
+func tagCharAllowed(r rune) bool {
+	switch r {
+	case '_', '-', ':', '.', '/':
+		return true
+	}
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// Sanitize returns tag with its disallowed characters stripped or replaced,
+// lowercased if configured to, and truncated to the maximum length.
+func (ts *tagSanitizer) Sanitize(tag string) string {
+	if ts.lowercase {
+		tag = strings.ToLower(tag)
+	}
+	tag = strings.Map(func(r rune) rune {
+		if tagCharAllowed(r) {
+			return r
+		}
+		if ts.replace {
+			return '_'
+		}
+		return -1
+	}, tag)
+	if len(tag) > ts.maxLength {
+		// don't cut a character in half
+		end := ts.maxLength
+		for end > 0 && !utf8.RuneStart(tag[end]) {
+			end--
+		}
+		tag = tag[:end]
+	}
+	return tag
+}
+
+// SanitizeTags sanitizes the tags of each metric in place, dropping tags
+// that are left empty. It does nothing if the sanitizer is nil.
+func (ts *tagSanitizer) SanitizeTags(metrics []samplers.DDMetric) {
+	if ts == nil {
+		return
+	}
+	for i := range metrics {
+		metrics[i].Tags = ts.sanitize(metrics[i].Tags)
+	}
+}
+
+// SanitizeDistributionTags is SanitizeTags for distributions.
+func (ts *tagSanitizer) SanitizeDistributionTags(distributions []samplers.DDDistribution) {
+	if ts == nil {
+		return
+	}
+	for i := range distributions {
+		distributions[i].Tags = ts.sanitize(distributions[i].Tags)
+	}
+}
+
+func (ts *tagSanitizer) sanitize(tags []string) []string {
+	// the tags may be shared with the sampler, so they're copied rather than
+	// changed in place
+	sanitized := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		if tag = ts.Sanitize(tag); tag != "" {
+			sanitized = append(sanitized, tag)
+		}
+	}
+	return sanitized
+}
@@ -0,0 +1,90 @@
+package veneur
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stripe/veneur/samplers"
+)
+
+func TestTagSanitizerModes(t *testing.T) {
+	strip, err := newTagSanitizer("strip", false, 0)
+	assert.NoError(t, err)
+	replace, err := newTagSanitizer("replace", false, 0)
+	assert.NoError(t, err)
+
+	for _, tc := range []struct {
+		tag, stripped, replaced string
+	}{
+		{"a:b", "a:b", "a:b"},
+		{"url:http://example.com/x.y", "url:http://example.com/x.y", "url:http://example.com/x.y"},
+		{"host:abc,123", "host:abc123", "host:abc_123"},
+		{"k:a|b\nc d", "k:abcd", "k:a_b_c_d"},
+		{"Mixed_Case-ok", "Mixed_Case-ok", "Mixed_Case-ok"},
+		{"city:zürich", "city:zürich", "city:zürich"},
+		{"#,|", "", "___"},
+	} {
+		assert.Equal(t, tc.stripped, strip.Sanitize(tc.tag), "stripping %q", tc.tag)
+		assert.Equal(t, tc.replaced, replace.Sanitize(tc.tag), "replacing %q", tc.tag)
+	}
+}
+
+func TestTagSanitizerLowercaseAndLength(t *testing.T) {
+	ts, err := newTagSanitizer("strip", true, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, "env:prod", ts.Sanitize("Env:PROD"))
+	assert.Len(t, ts.Sanitize(strings.Repeat("x", 300)), defaultTagMaxLength)
+
+	ts, err = newTagSanitizer("replace", false, 5)
+	assert.NoError(t, err)
+	assert.Equal(t, "a:bcd", ts.Sanitize("a:bcdefg"))
+	// "ü" is two bytes, and would be cut in half at 5
+	assert.Equal(t, "a:bc", ts.Sanitize("a:bcü"))
+}
+
+func TestTagSanitizerConfig(t *testing.T) {
+	for _, mode := range []string{"", "off"} {
+		ts, err := newTagSanitizer(mode, true, 10)
+		assert.NoError(t, err)
+		assert.Nil(t, ts, "%q should disable sanitization", mode)
+	}
+	_, err := newTagSanitizer("scrub", false, 0)
+	assert.Error(t, err)
+	_, err = newTagSanitizer("strip", false, -1)
+	assert.Error(t, err)
+
+	// a nil sanitizer leaves tags alone
+	metrics := []samplers.DDMetric{{Name: "a.b.c", Tags: []string{"a:b,c"}}}
+	var ts *tagSanitizer
+	ts.SanitizeTags(metrics)
+	assert.Equal(t, []string{"a:b,c"}, metrics[0].Tags)
+}
+
+// TestTagSanitizerMagicTags tests that a host tag with a comma in it becomes
+// the metric's host, without corrupting the tags around it.
+func TestTagSanitizerMagicTags(t *testing.T) {
+	ts, err := newTagSanitizer("replace", false, 0)
+	assert.NoError(t, err)
+
+	metrics := []samplers.DDMetric{{
+		Name:       "a.b.c",
+		Value:      [1][2]float64{{1476119058, 1}},
+		Tags:       []string{"a:b", "host:abc,123", "c:d|e\nf", ",,,"},
+		MetricType: "gauge",
+	}}
+	original := metrics[0].Tags
+	ts.SanitizeTags(metrics)
+	finalizeMetrics("localhost", []string{"x:y"}, nil, "", metrics)
+
+	assert.Equal(t, "abc_123", metrics[0].Hostname)
+	assert.Equal(t, []string{"a:b", "c:d_e_f", "___", "x:y"}, metrics[0].Tags)
+	assert.Equal(t, "host:abc,123", original[1], "the sampler's tags should be left alone")
+
+	ts, _ = newTagSanitizer("strip", false, 0)
+	metrics[0].Tags = []string{"a:b", "device:sda,1", ",,,"}
+	ts.SanitizeTags(metrics)
+	finalizeMetrics("localhost", nil, nil, "", metrics)
+	assert.Equal(t, "sda1", metrics[0].DeviceName)
+	assert.Equal(t, []string{"a:b"}, metrics[0].Tags, "tags left empty should be dropped")
+}
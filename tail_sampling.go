@@ -0,0 +1,173 @@
+package veneur
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/stripe/veneur/ssf"
+)
+
+// defaultTailSampleWindow is how long a trace's spans are buffered after
+// its last span arrives when tail_sample_window is not set.
+const defaultTailSampleWindow = 10 * time.Second
+
+// defaultTailSampleMaxSpans is the most spans buffered when
+// tail_sample_max_spans is not set.
+const defaultTailSampleMaxSpans = 16384
+
+// tailSampler keeps only slow traces. The spans of each trace are buffered
+// until the trace has lasted at least threshold, from the earliest start to
+// the latest end of its spans, when they are released, along with every
+// later span of the trace. A trace whose last span arrived window ago
+// without reaching the threshold is dropped. When more than maxSpans are
+// buffered, the least recently seen traces are dropped to make room; at
+// most maxSpans slow traces are remembered, too.
+type tailSampler struct {
+	threshold time.Duration
+	window    time.Duration
+	maxSpans  int
+
+	mtx sync.Mutex
+	// undecided traces, by trace ID
+	pending map[int64]*tailTrace
+	// the pending traces, least recently seen first
+	order *list.List
+	// the number of spans in pending
+	spans int
+	// traces known to be slow, by trace ID, with their elements in
+	// keptOrder
+	kept map[int64]*list.Element
+	// the kept traces, least recently seen first
+	keptOrder *list.List
+}
+
+// tailTrace is the buffered spans of an undecided trace.
+type tailTrace struct {
+	id    int64
+	spans []ssf.SSFSample
+	// the earliest start and latest end of the spans, in Unix nanoseconds
+	start, end int64
+	lastSeen   time.Time
+	elem       *list.Element
+}
+
+// keptTrace is a trace known to be slow.
+type keptTrace struct {
+	id       int64
+	lastSeen time.Time
+}
+
+func newTailSampler(threshold, window time.Duration, maxSpans int) *tailSampler {
+	return &tailSampler{
+		threshold: threshold,
+		window:    window,
+		maxSpans:  maxSpans,
+		pending:   make(map[int64]*tailTrace),
+		order:     list.New(),
+		kept:      make(map[int64]*list.Element),
+		keptOrder: list.New(),
+	}
+}
+
+// Add buffers the span, which must have a Trace, and returns the spans that
+// should be kept now: the span itself if its trace is known to be slow, or
+// all of the trace's buffered spans if this span makes it slow. If force is
+// set, the trace is kept whatever its duration, as for a span kept by a
+// sampling rule. It also returns the number of spans of other traces
+// dropped to make room, and the number dropped because their window has
+// passed.
+func (ts *tailSampler) Add(sample ssf.SSFSample, force bool, now time.Time) (keep []ssf.SSFSample, evicted, expired int) {
+	id := sample.Trace.TraceId
+
+	ts.mtx.Lock()
+	defer ts.mtx.Unlock()
+	// both lists are ordered by when traces were last seen, so expiring
+	// them only looks at the traces that are due
+	expired = ts.expire(now)
+
+	if elem, ok := ts.kept[id]; ok {
+		elem.Value.(*keptTrace).lastSeen = now
+		ts.keptOrder.MoveToBack(elem)
+		return []ssf.SSFSample{sample}, 0, expired
+	}
+
+	tt, ok := ts.pending[id]
+	start := sample.Timestamp
+	end := start + sample.Trace.Duration
+	if !ok {
+		tt = &tailTrace{id: id, start: start, end: end}
+		tt.elem = ts.order.PushBack(tt)
+		ts.pending[id] = tt
+	} else {
+		ts.order.MoveToBack(tt.elem)
+	}
+	if start < tt.start {
+		tt.start = start
+	}
+	if end > tt.end {
+		tt.end = end
+	}
+	tt.spans = append(tt.spans, sample)
+	tt.lastSeen = now
+	ts.spans++
+
+	if force || time.Duration(tt.end-tt.start) >= ts.threshold {
+		ts.remove(tt)
+		ts.keep(id, now)
+		return tt.spans, 0, expired
+	}
+
+	for ts.spans > ts.maxSpans {
+		oldest := ts.order.Front().Value.(*tailTrace)
+		evicted += len(oldest.spans)
+		ts.remove(oldest)
+	}
+	return nil, evicted, expired
+}
+
+// Expire drops the traces whose last span arrived at least window before
+// now without becoming slow, and forgets slow traces that haven't had a
+// span for as long. It returns the number of spans dropped.
+func (ts *tailSampler) Expire(now time.Time) (dropped int) {
+	ts.mtx.Lock()
+	defer ts.mtx.Unlock()
+	return ts.expire(now)
+}
+
+func (ts *tailSampler) expire(now time.Time) (dropped int) {
+	for elem := ts.order.Front(); elem != nil; elem = ts.order.Front() {
+		tt := elem.Value.(*tailTrace)
+		if now.Sub(tt.lastSeen) < ts.window {
+			break
+		}
+		dropped += len(tt.spans)
+		ts.remove(tt)
+	}
+	for elem := ts.keptOrder.Front(); elem != nil; elem = ts.keptOrder.Front() {
+		kt := elem.Value.(*keptTrace)
+		if now.Sub(kt.lastSeen) < ts.window {
+			break
+		}
+		delete(ts.kept, kt.id)
+		ts.keptOrder.Remove(elem)
+	}
+	return dropped
+}
+
+// keep remembers that the trace with this ID is slow, forgetting the least
+// recently seen slow trace if there are more than maxSpans.
+func (ts *tailSampler) keep(id int64, now time.Time) {
+	ts.kept[id] = ts.keptOrder.PushBack(&keptTrace{id: id, lastSeen: now})
+	if ts.keptOrder.Len() > ts.maxSpans {
+		oldest := ts.keptOrder.Remove(ts.keptOrder.Front()).(*keptTrace)
+		delete(ts.kept, oldest.id)
+	}
+}
+
+// remove stops buffering the pending trace.
+func (ts *tailSampler) remove(tt *tailTrace) {
+	delete(ts.pending, tt.id)
+	ts.order.Remove(tt.elem)
+	ts.spans -= len(tt.spans)
+}
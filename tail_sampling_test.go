@@ -0,0 +1,124 @@
+package veneur
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stripe/veneur/ssf"
+)
+
+func tailSampleSpan(traceID, id int64, start time.Time, duration time.Duration) *ssf.SSFSample {
+	return &ssf.SSFSample{
+		Metric:    ssf.SSFSample_TRACE,
+		Name:      "veneur.trace.test",
+		Service:   "veneur",
+		Timestamp: start.UnixNano(),
+		Trace: &ssf.SSFTrace{
+			TraceId:  traceID,
+			Id:       id,
+			Duration: duration.Nanoseconds(),
+		},
+	}
+}
+
+func TestTailSampling(t *testing.T) {
+	s := &Server{
+		TraceWorker: &TraceWorker{TraceChan: make(chan ssf.SSFSample, 10)},
+		tailSampler: newTailSampler(100*time.Millisecond, time.Minute, 100),
+	}
+	send := func(sample *ssf.SSFSample) {
+		packet, err := proto.Marshal(sample)
+		assert.NoError(t, err)
+		s.HandleTracePacket(packet)
+	}
+	received := func() []int64 {
+		var ids []int64
+		for {
+			select {
+			case span := <-s.TraceWorker.TraceChan:
+				ids = append(ids, span.Trace.Id)
+			default:
+				return ids
+			}
+		}
+	}
+
+	start := time.Now()
+	// a fast trace, whose root span took 20ms
+	send(tailSampleSpan(1, 11, start.Add(5*time.Millisecond), 10*time.Millisecond))
+	send(tailSampleSpan(1, 12, start, 20*time.Millisecond))
+	// a slow trace, whose spans cover 150ms between them
+	send(tailSampleSpan(2, 21, start, 50*time.Millisecond))
+	assert.Empty(t, received(), "spans should be held until their trace is slow")
+	send(tailSampleSpan(2, 22, start.Add(100*time.Millisecond), 50*time.Millisecond))
+	assert.Equal(t, []int64{21, 22}, received(), "the slow trace should be released")
+	send(tailSampleSpan(2, 23, start, 10*time.Millisecond))
+	assert.Equal(t, []int64{23}, received(), "later spans of a slow trace should be kept at once")
+
+	assert.Equal(t, 2, s.tailSampler.Expire(time.Now().Add(time.Minute)), "the fast trace should be dropped")
+	assert.Empty(t, received(), "only the slow trace should reach the sinks")
+	assert.Empty(t, s.tailSampler.pending)
+	assert.Empty(t, s.tailSampler.kept, "slow traces should be forgotten after the window")
+}
+
+func TestTailSamplerMaxSpans(t *testing.T) {
+	ts := newTailSampler(time.Second, time.Minute, 2)
+	now := time.Now()
+
+	keep, evicted, _ := ts.Add(*tailSampleSpan(1, 11, now, time.Millisecond), false, now)
+	assert.Empty(t, keep)
+	assert.Equal(t, 0, evicted)
+	ts.Add(*tailSampleSpan(2, 21, now, time.Millisecond), false, now)
+	_, evicted, _ = ts.Add(*tailSampleSpan(2, 22, now, time.Millisecond), false, now)
+	assert.Equal(t, 1, evicted, "the least recently seen trace should be dropped to make room")
+	assert.NotContains(t, ts.pending, int64(1))
+	assert.Equal(t, 2, ts.spans)
+
+	keep, _, _ = ts.Add(*tailSampleSpan(2, 23, now.Add(2*time.Second), time.Millisecond), false, now)
+	assert.Len(t, keep, 3, "every buffered span of a slow trace should be kept")
+	assert.Equal(t, 0, ts.spans)
+	assert.Equal(t, 0, ts.order.Len())
+
+	for id := int64(3); id < 6; id++ {
+		ts.Add(*tailSampleSpan(id, id*10, now, time.Millisecond), true, now)
+	}
+	assert.Len(t, ts.kept, 2, "at most maxSpans slow traces should be remembered")
+	assert.NotContains(t, ts.kept, int64(2), "the least recently seen slow trace should be forgotten")
+}
+
+func TestTailSamplerExpiresOnAdd(t *testing.T) {
+	ts := newTailSampler(time.Second, time.Minute, 10)
+	now := time.Now()
+
+	ts.Add(*tailSampleSpan(1, 11, now, time.Millisecond), false, now)
+	ts.Add(*tailSampleSpan(2, 21, now, 2*time.Second), false, now)
+	_, _, expired := ts.Add(*tailSampleSpan(3, 31, now, time.Millisecond), false, now.Add(time.Minute))
+	assert.Equal(t, 1, expired, "traces past their window should be dropped without waiting for a flush")
+	assert.NotContains(t, ts.pending, int64(1))
+	assert.NotContains(t, ts.kept, int64(2))
+	assert.Equal(t, 1, ts.spans)
+}
+
+func TestTailSamplingKeptByRule(t *testing.T) {
+	s := &Server{
+		TraceWorker: &TraceWorker{TraceChan: make(chan ssf.SSFSample, 10)},
+		spanSampler: &spanSampler{rate: 1, keepErrors: true},
+		tailSampler: newTailSampler(time.Second, time.Minute, 100),
+	}
+	start := time.Now()
+
+	s.handleSpan(tailSampleSpan(1, 11, start, time.Millisecond))
+	assert.Len(t, s.TraceWorker.TraceChan, 0)
+	failed := tailSampleSpan(1, 12, start, time.Millisecond)
+	failed.Status = ssf.SSFSample_CRITICAL
+	s.handleSpan(failed)
+	assert.Len(t, s.TraceWorker.TraceChan, 2, "an error should keep its fast trace")
+
+	prioritized := tailSampleSpan(2, 21, start, time.Millisecond)
+	prioritized.Tags = []*ssf.SSFTag{{Name: "sampling.priority", Value: "1"}}
+	s.handleSpan(prioritized)
+	s.handleSpan(tailSampleSpan(2, 22, start, time.Millisecond))
+	assert.Len(t, s.TraceWorker.TraceChan, 4, "a sampling priority should keep its fast trace")
+}
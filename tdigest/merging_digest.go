@@ -13,6 +13,7 @@ import (
 	"math"
 	"math/rand"
 	"sort"
+	"unsafe"
 )
 
 // A t-digest using the merging implementation. MergingDigest is not safe for
@@ -322,6 +323,12 @@ func (td *MergingDigest) Count() float64 {
 	return td.mainWeight + td.tempWeight
 }
 
+// Compression returns the compression parameter the digest was created
+// with, or decoded with.
+func (td *MergingDigest) Compression() float64 {
+	return td.compression
+}
+
 // we assume each centroid contains a uniform distribution of values
 // the lower bound of the distribution is the midpoint between this centroid and
 // the previous one (or the minimum, if this is the lowest centroid)
@@ -411,6 +418,29 @@ func (td *MergingDigest) GobDecode(b []byte) error {
 	return nil
 }
 
+// SizeBytes estimates the memory used by this t-digest's centroid lists.
+func (td *MergingDigest) SizeBytes() int {
+	size := int(unsafe.Sizeof(*td)) + (cap(td.mainCentroids)+cap(td.tempCentroids))*int(unsafe.Sizeof(Centroid{}))
+	if td.debug {
+		for _, c := range td.mainCentroids {
+			size += cap(c.Samples) * 8
+		}
+	}
+	return size
+}
+
+// ForEachCentroid calls f with the mean and weight of each centroid in this
+// t-digest, in ascending order of mean, until f returns false. Unlike
+// Centroids, it does not require debug to be enabled.
+func (td *MergingDigest) ForEachCentroid(f func(mean, weight float64) bool) {
+	td.mergeAllTemps()
+	for _, c := range td.mainCentroids {
+		if !f(c.Mean, c.Weight) {
+			return
+		}
+	}
+}
+
 // This function provides direct access to the internal list of centroids in
 // this t-digest. Having access to this list is very important for analyzing the
 // t-digest's statistical properties. However, since it violates the encapsulation
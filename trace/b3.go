@@ -0,0 +1,103 @@
+package trace
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// The headers used by Zipkin's B3 propagation
+const (
+	B3TraceIDHeader      = "X-B3-TraceId"
+	B3SpanIDHeader       = "X-B3-SpanId"
+	B3ParentSpanIDHeader = "X-B3-ParentSpanId"
+	B3SampledHeader      = "X-B3-Sampled"
+	B3FlagsHeader        = "X-B3-Flags"
+)
+
+// InjectB3 writes the trace's TraceID, SpanID, ParentID and
+// sampling decision into the headers as B3 headers, so that
+// Zipkin-instrumented services can continue the trace.
+// The IDs are written as 16 hex digits. Root spans have no
+// parent, so they don't get a parent span ID header.
+func InjectB3(t *Trace, h http.Header) {
+	h.Set(B3TraceIDHeader, formatB3ID(t.TraceID))
+	h.Set(B3SpanIDHeader, formatB3ID(t.SpanID))
+	if t.ParentID != 0 {
+		h.Set(B3ParentSpanIDHeader, formatB3ID(t.ParentID))
+	} else {
+		h.Del(B3ParentSpanIDHeader)
+	}
+	if t.Sampled {
+		h.Set(B3SampledHeader, "1")
+	} else {
+		h.Set(B3SampledHeader, "0")
+	}
+}
+
+// ExtractB3 reads the span described by B3 headers, as sent by
+// Zipkin-instrumented services. Like Extract, the returned Trace
+// represents the caller's span: use StartChildSpan, or Attach and
+// SpanFromContext, to continue the trace. The trace and span IDs
+// are required. If X-B3-Sampled and X-B3-Flags are absent, the
+// decision is made as StartTrace would.
+// It returns an error, and no Trace, if any header is malformed.
+func ExtractB3(h http.Header) (*Trace, error) {
+	traceID, err := parseB3ID(h, B3TraceIDHeader, true)
+	if err != nil {
+		return nil, err
+	}
+	spanID, err := parseB3ID(h, B3SpanIDHeader, true)
+	if err != nil {
+		return nil, err
+	}
+	parentID, err := parseB3ID(h, B3ParentSpanIDHeader, false)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &Trace{
+		TraceID:  traceID,
+		SpanID:   spanID,
+		ParentID: parentID,
+	}
+	switch sampled := h.Get(B3SampledHeader); sampled {
+	case "1", "true":
+		t.Sampled = true
+	case "0", "false":
+		t.Sampled = false
+	case "":
+		t.Sampled = sampleTraceID(traceID, HeadSampleRate())
+	default:
+		return nil, fmt.Errorf("%s header %q must be 1 or 0", B3SampledHeader, sampled)
+	}
+	// the debug flag forces the trace to be sampled
+	if h.Get(B3FlagsHeader) == "1" {
+		t.Sampled = true
+	}
+	return t, nil
+}
+
+func formatB3ID(id int64) string {
+	return fmt.Sprintf("%016x", uint64(id))
+}
+
+// parseB3ID parses the 64-bit hex ID in the header, which
+// may be absent if it isn't required.
+func parseB3ID(h http.Header, header string, required bool) (int64, error) {
+	value := h.Get(header)
+	if value == "" {
+		if required {
+			return 0, fmt.Errorf("%s header is missing", header)
+		}
+		return 0, nil
+	}
+	if len(value) > 16 {
+		return 0, fmt.Errorf("%s header %q is longer than 16 hex digits; only 64-bit IDs are supported", header, value)
+	}
+	id, err := strconv.ParseUint(value, 16, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s header %q is not a hex ID", header, value)
+	}
+	return int64(id), nil
+}
@@ -0,0 +1,88 @@
+package trace
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExtractB3(t *testing.T) {
+	h := http.Header{}
+	h.Set("X-B3-TraceId", "80f198ee56343ba8")
+	h.Set("X-B3-SpanId", "e457b5a2e4d86bd1")
+	h.Set("X-B3-ParentSpanId", "05e3ac9a4f6e3b90")
+	h.Set("X-B3-Sampled", "1")
+
+	trace, err := ExtractB3(h)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(-0x7f0e6711a9cbc458), trace.TraceID, "IDs with the high bit set should be kept")
+	assert.Equal(t, int64(-0x1ba84a5d1b27942f), trace.SpanID)
+	assert.Equal(t, int64(0x05e3ac9a4f6e3b90), trace.ParentID)
+	assert.True(t, trace.Sampled)
+
+	// the trace can be continued through the context
+	child := SpanFromContext(trace.Attach(context.Background()))
+	assert.Equal(t, trace.TraceID, child.TraceID)
+	assert.Equal(t, trace.SpanID, child.ParentID)
+	assert.True(t, child.Sampled)
+
+	out := http.Header{}
+	InjectB3(trace, out)
+	assert.Equal(t, "80f198ee56343ba8", out.Get("X-B3-TraceId"))
+	assert.Equal(t, "e457b5a2e4d86bd1", out.Get("X-B3-SpanId"))
+	assert.Equal(t, "05e3ac9a4f6e3b90", out.Get("X-B3-ParentSpanId"))
+	assert.Equal(t, "1", out.Get("X-B3-Sampled"))
+}
+
+func TestInjectExtractB3(t *testing.T) {
+	root := StartTrace("resource")
+	root.Sampled = false
+	h := http.Header{}
+	InjectB3(root, h)
+	assert.Equal(t, "", h.Get("X-B3-ParentSpanId"), "root spans have no parent")
+	assert.Equal(t, "0", h.Get("X-B3-Sampled"))
+
+	trace, err := ExtractB3(h)
+	assert.NoError(t, err)
+	assert.Equal(t, root.TraceID, trace.TraceID)
+	assert.Equal(t, root.SpanID, trace.SpanID)
+	assert.Equal(t, int64(0), trace.ParentID)
+	assert.False(t, trace.Sampled)
+
+	h.Set("X-B3-Flags", "1")
+	trace, err = ExtractB3(h)
+	assert.NoError(t, err)
+	assert.True(t, trace.Sampled, "the debug flag should force sampling")
+}
+
+func TestExtractB3Malformed(t *testing.T) {
+	valid := map[string]string{
+		"X-B3-TraceId": "80f198ee56343ba8",
+		"X-B3-SpanId":  "e457b5a2e4d86bd1",
+	}
+	cases := []struct {
+		name    string
+		headers map[string]string
+	}{
+		{"missing trace ID", map[string]string{"X-B3-TraceId": ""}},
+		{"missing span ID", map[string]string{"X-B3-SpanId": ""}},
+		{"non-hex trace ID", map[string]string{"X-B3-TraceId": "not-hex"}},
+		{"128-bit trace ID", map[string]string{"X-B3-TraceId": "463ac35c9f6413ad48485a3953bb6124"}},
+		{"non-hex parent ID", map[string]string{"X-B3-ParentSpanId": "xyz"}},
+		{"bad sampled", map[string]string{"X-B3-Sampled": "maybe"}},
+	}
+	for _, c := range cases {
+		h := http.Header{}
+		for k, v := range valid {
+			h.Set(k, v)
+		}
+		for k, v := range c.headers {
+			h.Set(k, v)
+		}
+		trace, err := ExtractB3(h)
+		assert.Error(t, err, c.name)
+		assert.Nil(t, trace, c.name)
+	}
+}
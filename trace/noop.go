@@ -0,0 +1,107 @@
+package trace
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	opentracinglog "github.com/opentracing/opentracing-go/log"
+)
+
+var _ opentracing.Tracer = NoopTracer{}
+var _ opentracing.Span = noopSpan{}
+
+// noopActive is 1 while NoopTracer is the active tracer, updated atomically.
+var noopActive int32
+
+// NoopTracer is a Tracer whose spans do nothing, for compiling the same
+// tracing calls into paths that can't afford them. Starting, tagging and
+// finishing its spans don't allocate. Spans started from a context holding
+// one of them, or as their children, are never sent.
+type NoopTracer struct{}
+
+// discardSpan is the span returned by StartSpanFromContext and
+// ExtractRequestChild when it would never be sent. It's shared, so that
+// starting it doesn't allocate, and the methods of discarded spans leave
+// them unchanged. It isn't sampled, so that children started from its
+// propagated context aren't sent either.
+var discardSpan = &Span{Trace: &Trace{discard: true}}
+
+// StartSpan returns a span that does nothing.
+func (NoopTracer) StartSpan(operationName string, opts ...opentracing.StartSpanOption) opentracing.Span {
+	return noopSpan{}
+}
+
+// Inject propagates nothing.
+func (NoopTracer) Inject(sm opentracing.SpanContext, format interface{}, carrier interface{}) error {
+	return nil
+}
+
+// Extract never finds a span context.
+func (NoopTracer) Extract(format interface{}, carrier interface{}) (opentracing.SpanContext, error) {
+	return nil, opentracing.ErrSpanContextNotFound
+}
+
+// InjectRequest propagates nothing.
+func (NoopTracer) InjectRequest(t *Trace, req *http.Request) error {
+	return nil
+}
+
+// ExtractRequestChild returns a span that is never sent.
+func (NoopTracer) ExtractRequestChild(resource string, req *http.Request, name string) (*Span, error) {
+	return discardSpan, nil
+}
+
+// UseNoopTracer makes NoopTracer the active tracer if noop is true, or
+// GlobalTracer if it's false, as it is by default. The active tracer starts
+// the spans of StartSpanFromContext, and is opentracing's global tracer.
+func UseNoopTracer(noop bool) {
+	if noop {
+		atomic.StoreInt32(&noopActive, 1)
+		opentracing.SetGlobalTracer(NoopTracer{})
+		return
+	}
+	atomic.StoreInt32(&noopActive, 0)
+	opentracing.SetGlobalTracer(GlobalTracer)
+}
+
+// ActiveTracer returns the tracer chosen by UseNoopTracer.
+func ActiveTracer() opentracing.Tracer {
+	if atomic.LoadInt32(&noopActive) == 1 {
+		return NoopTracer{}
+	}
+	return GlobalTracer
+}
+
+// attachDiscardSpan returns ctx with discardSpan attached both ways, or
+// ctx itself if it's already attached, so that starting spans beneath it
+// doesn't allocate.
+func attachDiscardSpan(ctx context.Context) context.Context {
+	if opentracing.SpanFromContext(ctx) == opentracing.Span(discardSpan) && ctx.Value(traceKey) == discardSpan.Trace {
+		return ctx
+	}
+	return discardSpan.Trace.Attach(discardSpan.Attach(ctx))
+}
+
+// noopSpan is the span that NoopTracer starts. Its methods do nothing.
+type noopSpan struct{}
+
+// noopSpanContext is the context of a noopSpan.
+type noopSpanContext struct{}
+
+func (noopSpanContext) ForeachBaggageItem(handler func(k, v string) bool) {}
+
+func (s noopSpan) Finish()                                               {}
+func (s noopSpan) FinishWithOptions(opts opentracing.FinishOptions)      {}
+func (s noopSpan) Context() opentracing.SpanContext                      { return noopSpanContext{} }
+func (s noopSpan) SetOperationName(name string) opentracing.Span         { return s }
+func (s noopSpan) SetTag(key string, value interface{}) opentracing.Span { return s }
+func (s noopSpan) LogFields(fields ...opentracinglog.Field)              {}
+func (s noopSpan) LogKV(alternatingKeyValues ...interface{})             {}
+func (s noopSpan) SetBaggageItem(key, value string) opentracing.Span     { return s }
+func (s noopSpan) BaggageItem(key string) string                         { return "" }
+func (s noopSpan) Tracer() opentracing.Tracer                            { return NoopTracer{} }
+func (s noopSpan) LogEvent(event string)                                 {}
+func (s noopSpan) LogEventWithPayload(event string, payload interface{}) {}
+func (s noopSpan) Log(data opentracing.LogData)                          {}
@@ -0,0 +1,89 @@
+package trace
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNoopTracer(t *testing.T) {
+	span := NoopTracer{}.StartSpan("resource", NameTag("a.b.c"))
+	assert.Equal(t, span, span.SetTag("foo", "bar"))
+	assert.Equal(t, span, span.SetOperationName("other"))
+	assert.Equal(t, span, span.SetBaggageItem("tenant", "1"))
+	span.LogEvent("cache.miss")
+	span.LogKV("event", "retry")
+	span.Finish()
+
+	assert.Equal(t, noopSpan{}, span)
+	assert.Equal(t, "", span.BaggageItem("tenant"))
+	assert.Equal(t, NoopTracer{}, span.Tracer())
+
+	child := GlobalTracer.StartSpan("child", opentracing.ChildOf(span.Context())).(*Span)
+	assert.True(t, child.discard, "the children of noop spans should never be sent")
+	child.Error(localError{"boom"})
+	assert.True(t, StartChildSpan(child.Trace).discard, "their children should never be sent either")
+}
+
+func TestUseNoopTracer(t *testing.T) {
+	UseNoopTracer(true)
+	defer UseNoopTracer(false)
+	assert.Equal(t, NoopTracer{}, ActiveTracer())
+	assert.Equal(t, NoopTracer{}, opentracing.GlobalTracer())
+
+	span, ctx := StartSpanFromContext(context.Background(), "resource")
+	assert.True(t, span.discard)
+	assert.True(t, SpanFromContext(ctx).discard, "a discarded span's context should start discarded spans")
+
+	UseNoopTracer(false)
+	assert.Equal(t, GlobalTracer, ActiveTracer())
+	child, _ := StartSpanFromContext(ctx, "child")
+	assert.True(t, child.discard, "spans started under a discarded span should stay discarded")
+	span, _ = StartSpanFromContext(context.Background(), "resource")
+	assert.False(t, span.discard)
+
+	child, _ = StartSpanFromContext(opentracing.ContextWithSpan(context.Background(), noopSpan{}), "child")
+	assert.True(t, child.discard, "spans started under a noop span should be discarded")
+}
+
+// useNoopSpan starts, tags and finishes a span.
+func useNoopSpan(tracer NoopTracer) {
+	span := tracer.StartSpan("resource")
+	span.SetTag("foo", "bar")
+	span.Finish()
+}
+
+func TestNoopTracerAllocations(t *testing.T) {
+	allocs := testing.AllocsPerRun(100, func() { useNoopSpan(NoopTracer{}) })
+	assert.Equal(t, 0.0, allocs, "noop spans should not allocate")
+
+	UseNoopTracer(true)
+	defer UseNoopTracer(false)
+	_, ctx := StartSpanFromContext(context.Background(), "resource")
+	allocs = testing.AllocsPerRun(100, func() {
+		span, _ := StartSpanFromContext(ctx, "resource")
+		span.SetTag("foo", "bar")
+		span.Error(localError{"boom"})
+		span.Finish()
+	})
+	assert.Equal(t, 0.0, allocs, "spans started from a discarded span's context should not allocate")
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	allocs = testing.AllocsPerRun(100, func() {
+		span, _ := NoopTracer{}.ExtractRequestChild("resource", req, "a.b.c")
+		span.Finish()
+	})
+	assert.Equal(t, 0.0, allocs, "spans extracted by NoopTracer should not allocate")
+}
+
+func BenchmarkNoopTracer(b *testing.B) {
+	tracer := NoopTracer{}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		useNoopSpan(tracer)
+	}
+}
@@ -26,6 +26,10 @@ const SpanIDHeader = "Spanid"
 // ParentIDHeader is the header for the parent id field
 const ParentIDHeader = "Parentid"
 
+// baggagePrefix is prepended to the keys of a span's baggage
+// items in its spanContext, and so to their header names.
+const baggagePrefix = "baggage-"
+
 // GlobalTracer is the… global tracer!
 var GlobalTracer = Tracer{}
 
@@ -143,6 +147,73 @@ func (c *spanContext) parseBaggageInt64(key string) int64 {
 	return val
 }
 
+// SampleRate extracts the sample rate from the BaggageItems.
+// It returns 0 if it is absent or invalid.
+func (c *spanContext) SampleRate() float64 {
+	var rate float64
+	c.ForeachBaggageItem(func(k, v string) bool {
+		if strings.ToLower(k) == "samplerate" {
+			r, err := strconv.ParseFloat(v, 64)
+			if err == nil && validSampleRate(r) {
+				rate = r
+			}
+			return false
+		}
+		return true
+	})
+	return rate
+}
+
+// SamplingPriority extracts the trace's sampling priority from the
+// BaggageItems, and whether it has one.
+func (c *spanContext) SamplingPriority() (int, bool) {
+	var priority int
+	var ok bool
+	c.ForeachBaggageItem(func(k, v string) bool {
+		if strings.ToLower(k) == "samplingpriority" {
+			var err error
+			priority, err = strconv.Atoi(v)
+			ok = err == nil
+			return false
+		}
+		return true
+	})
+	return priority, ok
+}
+
+// Sampled extracts the sampling decision from the BaggageItems.
+// Traces are sampled unless it says otherwise, for compatibility
+// with contexts that don't include it.
+func (c *spanContext) Sampled() bool {
+	sampled := true
+	c.ForeachBaggageItem(func(k, v string) bool {
+		if strings.ToLower(k) == "sampled" {
+			if b, err := strconv.ParseBool(v); err == nil {
+				sampled = b
+			}
+			return false
+		}
+		return true
+	})
+	return sampled
+}
+
+// baggage returns the baggage items of the span, without
+// baggagePrefix, or nil if there are none.
+func (c *spanContext) baggage() map[string]string {
+	var baggage map[string]string
+	c.ForeachBaggageItem(func(k, v string) bool {
+		if strings.HasPrefix(strings.ToLower(k), baggagePrefix) {
+			if baggage == nil {
+				baggage = map[string]string{}
+			}
+			baggage[strings.ToLower(k[len(baggagePrefix):])] = v
+		}
+		return true
+	})
+	return baggage
+}
+
 // Resource returns the resource assocaited with the spanContext
 func (c *spanContext) Resource() string {
 	var resource string
@@ -161,9 +232,6 @@ type Span struct {
 	tracer Tracer
 
 	*Trace
-
-	// These are currently ignored
-	logLines []opentracinglog.Field
 }
 
 // Finish ends a trace end records it.
@@ -183,8 +251,9 @@ func (s *Span) Finish() {
 }
 
 // FinishWithOptions finishes the span, but with explicit
-// control over timestamps and log data.
-// The BulkLogData field is deprecated and ignored.
+// control over its end timestamp, which defaults to now if
+// FinishTime is zero. The LogRecords and BulkLogData fields
+// are ignored.
 func (s *Span) FinishWithOptions(opts opentracing.FinishOptions) {
 	// This should never happen,
 	// but calling defer span.FinishWithOptions() should always be
@@ -193,9 +262,14 @@ func (s *Span) FinishWithOptions(opts opentracing.FinishOptions) {
 		return
 	}
 
+	end := opts.FinishTime
+	if end.IsZero() {
+		end = time.Now()
+	}
+
 	// TODO remove the name tag from the slice of tags
 
-	s.Record(s.Name, s.Tags)
+	s.RecordAt(end, s.Name, s.Tags)
 }
 
 func (s *Span) Context() opentracing.SpanContext {
@@ -215,23 +289,45 @@ func (s *Span) contextAsParent() *spanContext {
 	c.baggageItems["traceid"] = strconv.FormatInt(s.TraceID, 10)
 	c.baggageItems["parentid"] = strconv.FormatInt(s.ParentID, 10)
 	c.baggageItems["resource"] = s.Resource
+	s.setSamplingBaggage(c)
 	return c
 }
 
 // SetOperationName sets the name of the operation being performed
 // in this span.
 func (s *Span) SetOperationName(name string) opentracing.Span {
+	if s.discard {
+		return s
+	}
 	s.Trace.Resource = name
 	return s
 }
 
-// SetTag sets the tags on the underlying span
+// SetTag sets the tags on the underlying span.
+// Integers, floats and booleans are recorded with their
+// type, so that they can be flushed as numbers; other
+// values are recorded as strings.
 func (s *Span) SetTag(key string, value interface{}) opentracing.Span {
+	if s.discard {
+		return s
+	}
 	tag := ssf.SSFTag{Name: key}
 	// TODO mutex
 	switch v := value.(type) {
 	case string:
 		tag.Value = v
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		tag.Value = fmt.Sprintf("%d", v)
+		tag.Type = ssf.SSFTag_INT
+	case float32:
+		tag.Value = strconv.FormatFloat(float64(v), 'g', -1, 32)
+		tag.Type = ssf.SSFTag_FLOAT
+	case float64:
+		tag.Value = strconv.FormatFloat(v, 'g', -1, 64)
+		tag.Type = ssf.SSFTag_FLOAT
+	case bool:
+		tag.Value = strconv.FormatBool(v)
+		tag.Type = ssf.SSFTag_BOOL
 	case fmt.Stringer:
 		tag.Value = v.String()
 	default:
@@ -242,34 +338,66 @@ func (s *Span) SetTag(key string, value interface{}) opentracing.Span {
 	return s
 }
 
+// SetIntTag sets a tag with an integer value on the underlying span
+func (s *Span) SetIntTag(key string, value int64) opentracing.Span {
+	return s.SetTag(key, value)
+}
+
+// SetFloatTag sets a tag with a float value on the underlying span
+func (s *Span) SetFloatTag(key string, value float64) opentracing.Span {
+	return s.SetTag(key, value)
+}
+
+// SetBoolTag sets a tag with a boolean value on the underlying span
+func (s *Span) SetBoolTag(key string, value bool) opentracing.Span {
+	return s.SetTag(key, value)
+}
+
 // Attach attaches the span to the context.
 // It delegates to opentracing.ContextWithSpan
 func (s *Span) Attach(ctx context.Context) context.Context {
 	return opentracing.ContextWithSpan(ctx, s)
 }
 
-// LogFields sets log fields on the underlying span.
-// Currently these are ignored, but they can be fun to set anyway!
+// LogFields records an event on the underlying span, like
+// Trace.Log. The "event" field names the event, and the other
+// fields are recorded as strings.
 func (s *Span) LogFields(fields ...opentracinglog.Field) {
+	if s.discard {
+		return
+	}
 	// TODO mutex this
-	s.logLines = append(s.logLines, fields...)
+	event := "log"
+	values := map[string]string{}
+	for _, f := range fields {
+		if f.Key() == "event" {
+			event = fmt.Sprint(f.Value())
+			continue
+		}
+		values[f.Key()] = fmt.Sprint(f.Value())
+	}
+	s.Trace.Log(event, values)
 }
 
 func (s *Span) LogKV(alternatingKeyValues ...interface{}) {
+	if s.discard {
+		return
+	}
 	// TODO handle error
 	fs, _ := opentracinglog.InterleavedKVToFields(alternatingKeyValues...)
 	s.LogFields(fs...)
 }
 
-// SetBaggageItem sets the value of a baggage in the span.
+// SetBaggageItem sets the value of a baggage in the span,
+// like Trace.SetBaggageItem.
 func (s *Span) SetBaggageItem(restrictedKey, value string) opentracing.Span {
-	s.contextAsParent().baggageItems[restrictedKey] = value
+	s.Trace.SetBaggageItem(restrictedKey, value)
 	return s
 }
 
 // BaggageItem fetches the value of a baggage item in the span.
 func (s *Span) BaggageItem(restrictedKey string) string {
-	return s.contextAsParent().baggageItems[restrictedKey]
+	return s.Trace.BaggageItem(restrictedKey)
 }
 
 // Tracer returns the tracer that created this Span
@@ -277,9 +405,10 @@ func (s *Span) Tracer() opentracing.Tracer {
 	return s.tracer
 }
 
-// LogEvent is deprecated and unimplemented.
-// It is included only to satisfy the opentracing.Span interface.
+// LogEvent records an event without fields on the underlying
+// span, like Trace.LogEvent.
 func (s *Span) LogEvent(event string) {
+	s.Trace.LogEvent(event)
 }
 
 // LogEventWithPayload is deprecated and unimplemented.
@@ -294,6 +423,23 @@ func (s *Span) Log(data opentracing.LogData) {
 
 // Tracer is a tracer
 type Tracer struct {
+	// DefaultTags are added to every span the Tracer starts, eg the
+	// service's env and version. A tag given when starting the span
+	// replaces the default with the same name.
+	DefaultTags []*ssf.SSFTag
+}
+
+// addDefaultTags adds a copy of each of the tracer's DefaultTags to the
+// span, except those named in tags.
+func (t Tracer) addDefaultTags(span *Span, tags map[string]interface{}) {
+	for _, tag := range t.DefaultTags {
+		if _, ok := tags[tag.Name]; ok {
+			continue
+		}
+		// copied, since spans can change their tags
+		dup := *tag
+		span.Tags = append(span.Tags, &dup)
+	}
 }
 
 type spanOption struct {
@@ -346,6 +492,8 @@ func NameTag(name string) opentracing.StartSpanOption {
 // root trace will be used.
 // The tag "name" will be used as the SSF Name field - this can be set using the NameTag
 // convenience function.
+// The tracer's DefaultTags are added to the span, unless the options set a
+// tag with the same name.
 // The value returned is always a concrete Span (which satisfies the opentracing.Span interface)
 func (t Tracer) StartSpan(operationName string, opts ...opentracing.StartSpanOption) opentracing.Span {
 	// TODO implement References
@@ -368,8 +516,9 @@ func (t Tracer) StartSpan(operationName string, opts ...opentracing.StartSpanOpt
 		}
 	} else {
 
-		// First, let's extract the parent's information
-		parent := Trace{}
+		// First, let's extract the parent's information. Without a
+		// spanContext there's no decision to inherit, so it's sampled.
+		parent := Trace{Sampled: true}
 
 		// TODO don't assume that the ReferencedContext is a concrete spanContext
 		for _, ref := range sso.References {
@@ -379,6 +528,11 @@ func (t Tracer) StartSpan(operationName string, opts ...opentracing.StartSpanOpt
 			case opentracing.FollowsFromRef:
 				fallthrough
 			case opentracing.ChildOfRef:
+				if _, ok := ref.ReferencedContext.(noopSpanContext); ok {
+					// the children of NoopTracer spans are never sent
+					parent.discard = true
+					continue
+				}
 				ctx, ok := ref.ReferencedContext.(*spanContext)
 				if !ok {
 					continue
@@ -386,6 +540,12 @@ func (t Tracer) StartSpan(operationName string, opts ...opentracing.StartSpanOpt
 				parent.TraceID = ctx.TraceID()
 				parent.SpanID = ctx.SpanID()
 				parent.Resource = ctx.Resource()
+				parent.Sampled = ctx.Sampled()
+				parent.sampleRate = float32(ctx.SampleRate())
+				parent.baggage = ctx.baggage()
+				if priority, ok := ctx.SamplingPriority(); ok {
+					parent.SetSamplingPriority(priority)
+				}
 
 			default:
 				// TODO handle error
@@ -396,10 +556,6 @@ func (t Tracer) StartSpan(operationName string, opts ...opentracing.StartSpanOpt
 		// to prevent measurement error in timing
 		trace := StartChildSpan(&parent)
 
-		if !sso.StartTime.IsZero() {
-			trace.Start = sso.StartTime
-		}
-
 		span = &Span{
 			Trace:  trace,
 			tracer: t,
@@ -407,6 +563,11 @@ func (t Tracer) StartSpan(operationName string, opts ...opentracing.StartSpanOpt
 
 	}
 
+	if !sso.StartTime.IsZero() {
+		span.Start = sso.StartTime
+	}
+
+	t.addDefaultTags(span, sso.Tags)
 	for k, v := range sso.Tags {
 		span.SetTag(k, v)
 		if k == "name" {
@@ -436,24 +597,35 @@ func (tracer Tracer) ExtractRequestChild(resource string, req *http.Request, nam
 
 	parent := parentSpan.(*spanContext)
 
-	t := StartChildSpan(&Trace{
-		SpanID:   parent.SpanID(),
-		TraceID:  parent.TraceID(),
-		ParentID: parent.ParentID(),
-		Resource: resource,
-	})
+	parentTrace := &Trace{
+		SpanID:     parent.SpanID(),
+		TraceID:    parent.TraceID(),
+		ParentID:   parent.ParentID(),
+		Resource:   resource,
+		Sampled:    parent.Sampled(),
+		sampleRate: float32(parent.SampleRate()),
+		baggage:    parent.baggage(),
+	}
+	if priority, ok := parent.SamplingPriority(); ok {
+		parentTrace.SetSamplingPriority(priority)
+	}
+	t := StartChildSpan(parentTrace)
 
 	t.Name = name
-	return &Span{
+	span := &Span{
 		tracer: tracer,
 		Trace:  t,
-	}, nil
+	}
+	tracer.addDefaultTags(span, nil)
+	return span, nil
 }
 
 // Inject injects the provided SpanContext into the carrier for propagation.
-// It will return opentracing.ErrUnsupportedFormat if the format is not supported.
+// The Binary format needs an io.Writer carrier, and the TextMap and
+// HTTPHeaders formats need an opentracing.TextMapWriter, or for HTTPHeaders an
+// http.Header; other carriers return opentracing.ErrInvalidCarrier. It will
+// return opentracing.ErrUnsupportedFormat if the format is not supported.
 // TODO support other SpanContext implementations
-// TODO support all the BuiltinFormats
 func (t Tracer) Inject(sm opentracing.SpanContext, format interface{}, carrier interface{}) (err error) {
 	defer func() {
 		if r := recover(); r != nil {
@@ -467,23 +639,34 @@ func (t Tracer) Inject(sm opentracing.SpanContext, format interface{}, carrier i
 		return ErrUnsupportedSpanContext
 	}
 
-	if format == opentracing.Binary {
-		// carrier is guaranteed to be an io.Writer by contract
-		w := carrier.(io.Writer)
+	switch format {
+	case opentracing.Binary:
+		w, ok := carrier.(io.Writer)
+		if !ok {
+			return opentracing.ErrInvalidCarrier
+		}
 
 		trace := &Trace{
-			TraceID:  sc.TraceID(),
-			ParentID: sc.ParentID(),
-			SpanID:   sc.SpanID(),
-			Resource: sc.Resource(),
+			TraceID:    sc.TraceID(),
+			ParentID:   sc.ParentID(),
+			SpanID:     sc.SpanID(),
+			Resource:   sc.Resource(),
+			Sampled:    sc.Sampled(),
+			sampleRate: float32(sc.SampleRate()),
 		}
 
 		return trace.ProtoMarshalTo(w)
+	case opentracing.TextMap, opentracing.HTTPHeaders:
+		w, ok := textMapCarrier(format, carrier).(opentracing.TextMapWriter)
+		if !ok {
+			return opentracing.ErrInvalidCarrier
+		}
+		textMapReaderWriter(sc.baggageItems).CloneTo(w)
+		return nil
 	}
 
-	// If the carrier is a TextMapWriter, treat it as one, regardless of what the format is
+	// For compatibility, a TextMapWriter is used as one, regardless of what the format is
 	if w, ok := carrier.(opentracing.TextMapWriter); ok {
-
 		textMapReaderWriter(sc.baggageItems).CloneTo(w)
 		return nil
 	}
@@ -493,7 +676,8 @@ func (t Tracer) Inject(sm opentracing.SpanContext, format interface{}, carrier i
 
 // Extract returns a SpanContext given the format and the carrier.
 // The SpanContext returned represents the parent span (ie, SpanId refers to the parent span's own SpanId).
-// TODO support all the BuiltinFormats
+// The carriers accepted are the same as for Inject. If the carrier has no
+// trace ID, it returns opentracing.ErrSpanContextNotFound.
 func (t Tracer) Extract(format interface{}, carrier interface{}) (ctx opentracing.SpanContext, err error) {
 	defer func() {
 		if r := recover(); r != nil {
@@ -502,9 +686,12 @@ func (t Tracer) Extract(format interface{}, carrier interface{}) (ctx opentracin
 		}
 	}()
 
-	if format == opentracing.Binary {
-		// carrier is guaranteed to be an io.Reader by contract
-		r := carrier.(io.Reader)
+	switch format {
+	case opentracing.Binary:
+		r, ok := carrier.(io.Reader)
+		if !ok {
+			return nil, opentracing.ErrInvalidCarrier
+		}
 		packet, err := ioutil.ReadAll(r)
 		if err != nil {
 			return nil, err
@@ -516,38 +703,81 @@ func (t Tracer) Extract(format interface{}, carrier interface{}) (ctx opentracin
 			return nil, err
 		}
 
+		// the binary format doesn't carry the sampling decision,
+		// so the span is sampled, as it was when it was injected
 		trace := &Trace{
 			TraceID:  sample.Trace.TraceId,
 			ParentID: sample.Trace.ParentId,
 			SpanID:   sample.Trace.Id,
 			Resource: sample.Trace.Resource,
+			Sampled:  true,
+		}
+		if validSampleRate(float64(sample.SampleRate)) {
+			trace.sampleRate = sample.SampleRate
 		}
 
 		return trace.context(), nil
+	case opentracing.TextMap, opentracing.HTTPHeaders:
+		tm, ok := textMapCarrier(format, carrier).(opentracing.TextMapReader)
+		if !ok {
+			return nil, opentracing.ErrInvalidCarrier
+		}
+		return extractTextMap(tm)
 	}
 
+	// For compatibility, a TextMapReader is used as one, regardless of what the format is
 	if tm, ok := carrier.(opentracing.TextMapReader); ok {
+		return extractTextMap(tm)
+	}
 
-		// carrier is guaranteed to be an opentracing.TextMapReader by contract
-		// TODO support other TextMapReader implementations
-		traceID, err := strconv.ParseInt(textMapReaderGet(tm, TraceIDHeader), 10, 64)
-		spanID, err2 := strconv.ParseInt(textMapReaderGet(tm, SpanIDHeader), 10, 64)
-		parentID, err3 := strconv.ParseInt(textMapReaderGet(tm, ParentIDHeader), 10, 64)
-		if !(err == nil && err2 == nil && err3 == nil) {
-			return nil, errors.New("error parsing fields from TextMapReader")
-		}
+	return nil, opentracing.ErrUnsupportedFormat
+}
 
-		trace := &Trace{
-			TraceID:  traceID,
-			SpanID:   spanID,
-			ParentID: parentID,
-			Resource: textMapReaderGet(tm, "resource"),
-		}
-		return trace.context(), nil
+// textMapCarrier returns the carrier of a TextMap or HTTPHeaders Inject or
+// Extract, converting an http.Header to an opentracing.HTTPHeadersCarrier.
+func textMapCarrier(format interface{}, carrier interface{}) interface{} {
+	if h, ok := carrier.(http.Header); ok && format == opentracing.HTTPHeaders {
+		return opentracing.HTTPHeadersCarrier(h)
+	}
+	return carrier
+}
 
+// extractTextMap reads the spanContext that Inject wrote to tm.
+func extractTextMap(tm opentracing.TextMapReader) (opentracing.SpanContext, error) {
+	traceIDValue := textMapReaderGet(tm, TraceIDHeader)
+	if traceIDValue == "" {
+		return nil, opentracing.ErrSpanContextNotFound
+	}
+	traceID, err := strconv.ParseInt(traceIDValue, 10, 64)
+	spanID, err2 := strconv.ParseInt(textMapReaderGet(tm, SpanIDHeader), 10, 64)
+	parentID, err3 := strconv.ParseInt(textMapReaderGet(tm, ParentIDHeader), 10, 64)
+	if !(err == nil && err2 == nil && err3 == nil) {
+		return nil, opentracing.ErrSpanContextCorrupted
 	}
 
-	return nil, opentracing.ErrUnsupportedFormat
+	trace := &Trace{
+		TraceID:  traceID,
+		SpanID:   spanID,
+		ParentID: parentID,
+		Resource: textMapReaderGet(tm, "resource"),
+		Sampled:  true,
+	}
+	tm.ForeachKey(func(k, v string) error {
+		if strings.HasPrefix(strings.ToLower(k), baggagePrefix) {
+			trace.SetBaggageItem(k[len(baggagePrefix):], v)
+		}
+		return nil
+	})
+	if sampled, err := strconv.ParseBool(textMapReaderGet(tm, "sampled")); err == nil {
+		trace.Sampled = sampled
+	}
+	if rate, err := strconv.ParseFloat(textMapReaderGet(tm, "samplerate"), 64); err == nil && validSampleRate(rate) {
+		trace.sampleRate = float32(rate)
+	}
+	if priority, err := strconv.Atoi(textMapReaderGet(tm, "samplingpriority")); err == nil {
+		trace.SetSamplingPriority(priority)
+	}
+	return trace.context(), nil
 }
 
 func textMapReaderGet(tmr opentracing.TextMapReader, key string) (value string) {
@@ -92,6 +92,51 @@ func TestTracerChildSpan(t *testing.T) {
 	}
 }
 
+func TestSpanTypedTags(t *testing.T) {
+	tracer := Tracer{}
+	span := tracer.StartSpan("resource", NameTag("my.name")).(*Span)
+	span.SetTag("str", "value")
+	span.SetTag("int", 42)
+	span.SetIntTag("int64", -7)
+	span.SetTag("uint", uint8(3))
+	span.SetFloatTag("float", 0.25)
+	span.SetTag("float32", float32(1.5))
+	span.SetBoolTag("bool", false)
+	span.SetTag("duration", time.Second)
+
+	expected := []*ssf.SSFTag{
+		{Name: "name", Value: "my.name", Type: ssf.SSFTag_STRING},
+		{Name: "str", Value: "value", Type: ssf.SSFTag_STRING},
+		{Name: "int", Value: "42", Type: ssf.SSFTag_INT},
+		{Name: "int64", Value: "-7", Type: ssf.SSFTag_INT},
+		{Name: "uint", Value: "3", Type: ssf.SSFTag_INT},
+		{Name: "float", Value: "0.25", Type: ssf.SSFTag_FLOAT},
+		{Name: "float32", Value: "1.5", Type: ssf.SSFTag_FLOAT},
+		{Name: "bool", Value: "false", Type: ssf.SSFTag_BOOL},
+		{Name: "duration", Value: "1s", Type: ssf.SSFTag_STRING},
+	}
+	assert.Equal(t, expected, span.Tags)
+	assert.Equal(t, "my.name", span.Name)
+}
+
+func TestSpanLogFields(t *testing.T) {
+	tracer := Tracer{}
+	span := tracer.StartSpan("resource").(*Span)
+	span.LogKV("event", "cache.miss", "key", "user:1", "size", 3)
+	span.LogKV("bytes", 10)
+	span.LogEvent("done")
+	span.Finish()
+
+	if assert.Len(t, span.Logs, 3) {
+		assert.Equal(t, "cache.miss", span.Logs[0].Event)
+		assert.Equal(t, map[string]string{"key": "user:1", "size": "3"}, span.Logs[0].Fields)
+		assert.Equal(t, "log", span.Logs[1].Event, "events without an event field should have a default name")
+		assert.Equal(t, map[string]string{"bytes": "10"}, span.Logs[1].Fields)
+		assert.Equal(t, "done", span.Logs[2].Event)
+		assert.Empty(t, span.Logs[2].Fields)
+	}
+}
+
 // DummySpan is a helper function that gives
 // a simple Span to use in tests
 func DummySpan() *Span {
@@ -244,6 +289,76 @@ func TestTracerInjectExtractHeader(t *testing.T) {
 
 }
 
+// TestTracerSampleRate tests that spans started through the Tracer,
+// in process and from an HTTP request, inherit their parent's sample rate.
+func TestTracerSampleRate(t *testing.T) {
+	tracer := Tracer{}
+	root := tracer.StartSpan("resource").(*Span)
+	assert.NoError(t, root.SetSampleRate(0.5))
+
+	child := tracer.StartSpan("resource", opentracing.ChildOf(root.Context())).(*Span)
+	assert.InEpsilon(t, 0.5, child.SampleRate(), ε)
+
+	req, err := http.NewRequest(http.MethodPost, "/test", bytes.NewBuffer(nil))
+	assert.NoError(t, err)
+	assert.NoError(t, tracer.InjectRequest(child.Trace, req))
+	remote, err := tracer.ExtractRequestChild("resource", req, "remote.child")
+	assert.NoError(t, err)
+	assert.InEpsilon(t, 0.5, remote.SSFSample().SampleRate, ε)
+
+	unset := tracer.StartSpan("resource", opentracing.ChildOf(tracer.StartSpan("resource").Context())).(*Span)
+	assert.InEpsilon(t, DefaultSampleRate, unset.SampleRate(), ε)
+}
+
+// TestTracerSamplingPriority tests that spans started through the
+// Tracer, in process and from an HTTP request, inherit their trace's
+// sampling priority.
+func TestTracerSamplingPriority(t *testing.T) {
+	tracer := Tracer{}
+	root := tracer.StartSpan("resource").(*Span)
+	root.SetSamplingPriority(2)
+
+	child := tracer.StartSpan("resource", opentracing.ChildOf(root.Context())).(*Span)
+	priority, ok := child.samplingPriority()
+	assert.True(t, ok, "a child should inherit the priority")
+	assert.Equal(t, 2, priority)
+
+	req, err := http.NewRequest(http.MethodPost, "/test", bytes.NewBuffer(nil))
+	assert.NoError(t, err)
+	assert.NoError(t, tracer.InjectRequest(child.Trace, req))
+	remote, err := tracer.ExtractRequestChild("resource", req, "remote.child")
+	assert.NoError(t, err)
+	priority, ok = remote.samplingPriority()
+	assert.True(t, ok, "a remote child should inherit the priority")
+	assert.Equal(t, 2, priority)
+
+	unset := tracer.StartSpan("resource", opentracing.ChildOf(tracer.StartSpan("resource").Context())).(*Span)
+	_, ok = unset.samplingPriority()
+	assert.False(t, ok)
+}
+
+// TestTracerSampled tests that spans started through the Tracer,
+// in process and from an HTTP request, share their trace's
+// sampling decision.
+func TestTracerSampled(t *testing.T) {
+	tracer := Tracer{}
+	root := tracer.StartSpan("resource").(*Span)
+	assert.True(t, root.Sampled)
+	child := tracer.StartSpan("resource", opentracing.ChildOf(root.Context())).(*Span)
+	assert.True(t, child.Sampled)
+
+	root.Sampled = false
+	child = tracer.StartSpan("resource", opentracing.ChildOf(root.Context())).(*Span)
+	assert.False(t, child.Sampled)
+
+	req, err := http.NewRequest(http.MethodPost, "/test", bytes.NewBuffer(nil))
+	assert.NoError(t, err)
+	assert.NoError(t, tracer.InjectRequest(child.Trace, req))
+	remote, err := tracer.ExtractRequestChild("resource", req, "remote.child")
+	assert.NoError(t, err)
+	assert.False(t, remote.Sampled, "the decision should be propagated to remote children")
+}
+
 // assertContextUnmarshalEqual is a helper that asserts that the given SSFSample
 // matches the expected *Trace on all fields that are passed through a SpanContext.
 // Since a SpanContext doesn't pass fields like tags, this function will not cause
@@ -256,7 +371,7 @@ func assertContextUnmarshalEqual(t *testing.T, expected *Trace, sample *ssf.SSFS
 	// but we don't support units at all.
 	assert.Equal(t, expected.SSFSample().Unit, sample.Unit)
 
-	// The sample rate is hard-coded
+	// The sample rate is DefaultSampleRate unless it was set
 	assert.Equal(t, expected.SSFSample().SampleRate, sample.SampleRate)
 
 	// The TraceId, ParentId, and Resource should all be the same.
@@ -288,3 +403,94 @@ func TestInjectRequestExtractRequestChild(t *testing.T) {
 	assert.Equal(t, trace.SpanID, span.ParentID, "child should have the original trace's SpanId as its ParentId")
 	assert.Equal(t, trace.TraceID, span.TraceID)
 }
+
+// TestTracerInjectExtractHTTPHeader tests that a span injected into a bare
+// http.Header can be extracted back, including its sampling baggage.
+func TestTracerInjectExtractHTTPHeader(t *testing.T) {
+	trace := DummySpan().Trace
+	trace.finish()
+	trace.Sampled = false
+	assert.NoError(t, trace.SetSampleRate(0.25))
+	tracer := Tracer{}
+
+	h := http.Header{}
+	assert.NoError(t, tracer.Inject(trace.context(), opentracing.HTTPHeaders, h))
+	assert.Equal(t, strconv.FormatInt(trace.TraceID, 10), h.Get(TraceIDHeader))
+
+	c, err := tracer.Extract(opentracing.HTTPHeaders, h)
+	assert.NoError(t, err)
+	ctx := c.(*spanContext)
+	assert.Equal(t, trace.TraceID, ctx.TraceID())
+	assert.Equal(t, trace.SpanID, ctx.SpanID())
+	assert.Equal(t, trace.ParentID, ctx.ParentID())
+	assert.Equal(t, trace.Resource, ctx.Resource())
+	assert.False(t, ctx.Sampled())
+	assert.InEpsilon(t, 0.25, ctx.SampleRate(), ε)
+}
+
+// TestTracerInvalidCarrier tests that carriers of the wrong type for
+// their format are rejected rather than panicking.
+func TestTracerInvalidCarrier(t *testing.T) {
+	trace := DummySpan().Trace
+	trace.finish()
+	tracer := Tracer{}
+
+	for _, format := range []opentracing.BuiltinFormat{opentracing.Binary, opentracing.TextMap, opentracing.HTTPHeaders} {
+		assert.Equal(t, opentracing.ErrInvalidCarrier, tracer.Inject(trace.context(), format, 42), "format %v", format)
+		_, err := tracer.Extract(format, 42)
+		assert.Equal(t, opentracing.ErrInvalidCarrier, err, "format %v", format)
+	}
+}
+
+func TestTracerExtractMissingContext(t *testing.T) {
+	tracer := Tracer{}
+
+	c, err := tracer.Extract(opentracing.HTTPHeaders, http.Header{})
+	assert.Equal(t, opentracing.ErrSpanContextNotFound, err)
+	assert.Nil(t, c)
+
+	h := http.Header{}
+	h.Set(TraceIDHeader, "1")
+	h.Set(SpanIDHeader, "not a number")
+	h.Set(ParentIDHeader, "0")
+	_, err = tracer.Extract(opentracing.HTTPHeaders, h)
+	assert.Equal(t, opentracing.ErrSpanContextCorrupted, err)
+}
+
+// TestSpanFinishWithOptions tests that a span finished with
+// an explicit FinishTime is recorded as ending then.
+func TestSpanFinishWithOptions(t *testing.T) {
+	start := time.Date(2017, 1, 2, 3, 4, 5, 6, time.UTC)
+	tracer := Tracer{}
+	span := tracer.StartSpan("resource", customSpanStart(start)).(*Span)
+	span.ForceSample()
+
+	sample := recordedSample(t, func() {
+		span.FinishWithOptions(opentracing.FinishOptions{
+			FinishTime: start.Add(250 * time.Millisecond),
+		})
+	})
+	if assert.NotNil(t, sample) {
+		assert.Equal(t, (250 * time.Millisecond).Nanoseconds(), sample.Trace.Duration)
+	}
+}
+
+// TestBaggageAcrossProcesses tests that baggage is propagated
+// through StartSpan and the HTTP request helpers.
+func TestBaggageAcrossProcesses(t *testing.T) {
+	tracer := Tracer{}
+	root := tracer.StartSpan("resource").(*Span)
+	root.SetBaggageItem("tenant_id", "42")
+	child := tracer.StartSpan("resource", opentracing.ChildOf(root.Context())).(*Span)
+	assert.Equal(t, "42", child.BaggageItem("tenant_id"))
+
+	req, err := http.NewRequest(http.MethodPost, "/test", bytes.NewBuffer(nil))
+	assert.NoError(t, err)
+	assert.NoError(t, tracer.InjectRequest(child.Trace, req))
+
+	remote, err := tracer.ExtractRequestChild("remote resource", req, "remote.name")
+	assert.NoError(t, err)
+	assert.Equal(t, child.SpanID, remote.ParentID)
+	assert.Equal(t, "42", remote.BaggageItem("tenant_id"))
+	assert.Equal(t, "42", StartChildSpan(remote.Trace).BaggageItem("tenant_id"))
+}
@@ -7,13 +7,21 @@
 package trace
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"fmt"
 	"io"
+	"math"
 	"math/rand"
 	"net"
 	"reflect"
+	"runtime"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/stripe/veneur/ssf"
@@ -35,6 +43,11 @@ var disabled bool = false
 
 var enabledMtx sync.RWMutex
 
+// headSampleRate is the fraction of traces that StartTrace samples.
+var headSampleRate = 1.0
+
+var headSampleRateMtx sync.RWMutex
+
 // Make an unexported `key` type that we use as a String such
 // that we don't get lint warnings from using it as a key in
 // Context. See https://blog.golang.org/context#TOC_3.2.
@@ -48,12 +61,30 @@ var Service = ""
 
 const localVeneurAddress = "127.0.0.1:8128"
 
+// DefaultSampleRate is the sample rate recorded for spans
+// that haven't set one with SetSampleRate.
+const DefaultSampleRate = 0.1
+
+// ErrInvalidSampleRate is returned by SetSampleRate
+// for rates outside (0, 1].
+var ErrInvalidSampleRate = errors.New("sample rate must be greater than 0 and at most 1")
+
 // For an error to be recorded correctly in DataDog, these three tags
 // need to be set
 const errorMessageTag = "error.msg"
 const errorTypeTag = "error.type"
 const errorStackTag = "error.stack"
 
+// samplingPriorityTag records a span's sampling priority,
+// like OpenTracing's standard tag
+const samplingPriorityTag = "sampling.priority"
+
+// ErrorStackDepth is the most stack frames that Error records, and
+// ErrorStackSize the most bytes of a stack. They should be set at startup;
+// if either is 0 or negative, Error records no stack.
+var ErrorStackDepth = 32
+var ErrorStackSize = 4096
+
 // Trace is a convenient structural representation
 // of a TraceSpan. It is intended to map transparently
 // to the more general type SSFSample.
@@ -82,14 +113,68 @@ type Trace struct {
 
 	Tags []*ssf.SSFTag
 
+	// Timestamped events within the span, in the
+	// order they were logged
+	Logs []SpanLog
+
 	// Unlike the Resource, this should not contain spaces
 	// It should be of the format foo.bar.baz
 	Name string
+
+	// Whether the span is sent, instead of dropped, when it is
+	// recorded. The decision is made once per trace, by
+	// StartTrace or when a propagated trace is extracted, and
+	// copied to every child, so that a trace is kept or dropped
+	// as a whole. A Trace built by hand must set it to be sent.
+	Sampled bool
+
+	// The sample rate recorded for the span,
+	// or 0 for DefaultSampleRate
+	sampleRate float32
+
+	// The high 64 bits of a W3C trace ID, if the trace
+	// was extracted from one, so that they can be
+	// propagated by InjectTraceContext
+	traceIDHigh uint64
+
+	// Baggage items, by lowercased key, which are copied
+	// to children and propagated with the span's context
+	baggage map[string]string
+
+	// Whether the span is never sent, even if it's forced,
+	// because it was started under NoopTracer. It is
+	// copied to every child. The methods that change a
+	// span do nothing to a discarded one, which may be
+	// shared.
+	discard bool
+}
+
+// SpanLog is an event logged within a span, eg a
+// cache miss or a retry, with optional fields.
+type SpanLog struct {
+	Timestamp time.Time
+	Event     string
+	Fields    map[string]string
 }
 
 // Set the end timestamp and finalize Span state
 func (t *Trace) finish() {
-	t.End = time.Now()
+	t.finishAt(time.Now())
+}
+
+// finishAt is like finish, but the span ends at end. An end
+// before the span's start is clamped to the start, so that the
+// duration is never negative.
+func (t *Trace) finishAt(end time.Time) {
+	if end.Before(t.Start) {
+		logrus.WithFields(logrus.Fields{
+			"resource": t.Resource,
+			"start":    t.Start,
+			"end":      end,
+		}).Warn("Span ends before it starts, recording a duration of 0")
+		end = t.Start
+	}
+	t.End = end
 }
 
 // (Experimental)
@@ -117,6 +202,189 @@ func Disabled() bool {
 	return disabled
 }
 
+// SetHeadSampleRate sets the fraction of traces that
+// StartTrace samples, which must be greater than 0 and
+// at most 1. It defaults to 1, sampling every trace.
+// Traces that are already started keep their decision.
+func SetHeadSampleRate(rate float64) error {
+	if !validSampleRate(rate) {
+		return ErrInvalidSampleRate
+	}
+	headSampleRateMtx.Lock()
+	defer headSampleRateMtx.Unlock()
+
+	headSampleRate = rate
+	return nil
+}
+
+// HeadSampleRate returns the fraction of traces that
+// StartTrace samples.
+func HeadSampleRate() float64 {
+	headSampleRateMtx.RLock()
+	defer headSampleRateMtx.RUnlock()
+
+	return headSampleRate
+}
+
+// sampleTraceID makes a consistent sampling decision for
+// the trace at the given rate.
+func sampleTraceID(traceID int64, rate float64) bool {
+	if rate >= 1 {
+		return true
+	}
+	// trace IDs are not necessarily uniformly distributed,
+	// so scramble them with Knuth's multiplicative hash first
+	return float64(uint64(traceID)*2654435761%math.MaxUint32) < rate*math.MaxUint32
+}
+
+// SetBaggageItem sets a baggage item, which is copied to the
+// span's children and propagated with its context, eg by
+// InjectRequest, so that it reaches every span beneath it in the
+// trace. Keys are case-insensitive. Baggage isn't recorded with the
+// span: to search for spans by it, tag them with it too.
+func (t *Trace) SetBaggageItem(key, value string) {
+	if t.discard {
+		return
+	}
+	if t.baggage == nil {
+		t.baggage = map[string]string{}
+	}
+	t.baggage[strings.ToLower(key)] = value
+}
+
+// BaggageItem returns the value of a baggage item, or "" if it
+// is not set.
+func (t *Trace) BaggageItem(key string) string {
+	return t.baggage[strings.ToLower(key)]
+}
+
+// ForceSample marks the span as sampled, overriding the
+// decision made for its trace, so that it is sent when it
+// is recorded. Children started afterwards are sampled too.
+// Spans are forced by Error.
+func (t *Trace) ForceSample() {
+	if t.discard {
+		return
+	}
+	t.Sampled = true
+}
+
+// SetSamplingPriority sets the sampling priority of the span's
+// trace, which Veneur passes on to Datadog when it's set on
+// the root span. As with Datadog, a priority of 1 or more
+// keeps the trace: it forces the span to be sampled, like
+// ForceSample, and Veneur keeps it whatever its sample rate.
+// Datadog uses 2 for traces kept by the user. Children started
+// afterwards, in this process or from its propagated context,
+// inherit the priority, so the whole trace is kept.
+func (t *Trace) SetSamplingPriority(priority int) {
+	if t.discard {
+		return
+	}
+	value := strconv.Itoa(priority)
+	if priority >= 1 {
+		t.ForceSample()
+	}
+	for _, tag := range t.Tags {
+		if tag.Name == samplingPriorityTag {
+			tag.Value = value
+			return
+		}
+	}
+	t.Tags = append(t.Tags, &ssf.SSFTag{
+		Name:  samplingPriorityTag,
+		Value: value,
+		Type:  ssf.SSFTag_INT,
+	})
+}
+
+// samplingPriority returns the span's sampling priority, and
+// whether it has one.
+func (t *Trace) samplingPriority() (int, bool) {
+	for _, tag := range t.Tags {
+		if tag.Name == samplingPriorityTag {
+			priority, err := strconv.Atoi(tag.Value)
+			return priority, err == nil
+		}
+	}
+	return 0, false
+}
+
+// Log records an event within the span, with optional
+// fields describing it. Events are timestamped when they
+// are logged, and sent with the span when it's recorded.
+func (t *Trace) Log(event string, fields map[string]string) {
+	if t.discard {
+		return
+	}
+	now := time.Now()
+	// time.Now is monotonic, but the wall clock can be set
+	// backwards, so keep the events in order
+	if len(t.Logs) > 0 && now.Before(t.Logs[len(t.Logs)-1].Timestamp) {
+		now = t.Logs[len(t.Logs)-1].Timestamp
+	}
+	t.Logs = append(t.Logs, SpanLog{Timestamp: now, Event: event, Fields: fields})
+}
+
+// LogEvent records an event without fields within the span.
+func (t *Trace) LogEvent(event string) {
+	t.Log(event, nil)
+}
+
+// ssfLogs converts the span's logs for an SSFSample.
+// The fields are sorted by name, so that the sample
+// is the same every time.
+func (t *Trace) ssfLogs() []*ssf.SSFLog {
+	if len(t.Logs) == 0 {
+		return nil
+	}
+	logs := make([]*ssf.SSFLog, len(t.Logs))
+	for i, l := range t.Logs {
+		names := make([]string, 0, len(l.Fields))
+		for name := range l.Fields {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		fields := make([]*ssf.SSFTag, len(names))
+		for j, name := range names {
+			fields[j] = &ssf.SSFTag{Name: name, Value: l.Fields[name]}
+		}
+		logs[i] = &ssf.SSFLog{
+			Timestamp: l.Timestamp.UnixNano(),
+			Event:     l.Event,
+			Fields:    fields,
+		}
+	}
+	return logs
+}
+
+// SetSampleRate sets the sample rate recorded for the span,
+// which must be greater than 0 and at most 1. Child spans
+// started afterwards inherit it, so that the whole trace is
+// sampled consistently.
+func (t *Trace) SetSampleRate(rate float64) error {
+	if !validSampleRate(rate) {
+		return ErrInvalidSampleRate
+	}
+	if t.discard {
+		return nil
+	}
+	t.sampleRate = float32(rate)
+	return nil
+}
+
+// SampleRate returns the sample rate recorded for the span.
+func (t *Trace) SampleRate() float64 {
+	if t.sampleRate == 0 {
+		return DefaultSampleRate
+	}
+	return float64(t.sampleRate)
+}
+
+func validSampleRate(rate float64) bool {
+	return rate > 0 && rate <= 1
+}
+
 // Duration is a convenience function for
 // the difference between the Start and End timestamps.
 // It assumes the span has already ended.
@@ -146,8 +414,9 @@ func (t *Trace) SSFSample() *ssf.SSFSample {
 			ParentId: t.ParentID,
 			Duration: duration,
 			Resource: t.Resource,
+			Logs:     t.ssfLogs(),
 		},
-		SampleRate: *proto.Float32(.10),
+		SampleRate: float32(t.SampleRate()),
 		Tags:       t.Tags,
 		Service:    Service,
 	}
@@ -166,9 +435,23 @@ func (t *Trace) ProtoMarshalTo(w io.Writer) error {
 
 // Record sends a trace to the (local) veneur instance,
 // which will pass it on to the tracing agent running on the
-// global veneur instance.
+// global veneur instance. Spans that aren't sampled are
+// not sent, unless their status is critical.
 func (t *Trace) Record(name string, tags []*ssf.SSFTag) error {
-	t.finish()
+	return t.RecordAt(time.Now(), name, tags)
+}
+
+// RecordAt is like Record, but the span ends at end rather
+// than now, eg when replaying historical events, or when
+// the span is recorded some time after its work completed.
+func (t *Trace) RecordAt(end time.Time, name string, tags []*ssf.SSFTag) error {
+	if t.discard {
+		return nil
+	}
+	t.finishAt(end)
+	if !t.Sampled && t.Status != ssf.SSFSample_CRITICAL {
+		return nil
+	}
 	duration := t.Duration().Nanoseconds()
 
 	t.Tags = append(t.Tags, tags...)
@@ -188,8 +471,9 @@ func (t *Trace) Record(name string, tags []*ssf.SSFTag) error {
 			ParentId: t.ParentID,
 			Duration: duration,
 			Resource: t.Resource,
+			Logs:     t.ssfLogs(),
 		},
-		SampleRate: *proto.Float32(.10),
+		SampleRate: float32(t.SampleRate()),
 		Tags:       t.Tags,
 		Service:    Service,
 	}
@@ -201,8 +485,16 @@ func (t *Trace) Record(name string, tags []*ssf.SSFTag) error {
 	return err
 }
 
+// Error marks the span as failed with err, and forces it to be sampled. It
+// records err's message, type and stack trace in tags: the stack that err
+// carries if it prints one with %+v, like the errors of
+// github.com/pkg/errors, or else the stack that Error was called from.
 func (t *Trace) Error(err error) {
+	if t.discard {
+		return
+	}
 	t.Status = ssf.SSFSample_CRITICAL
+	t.ForceSample()
 
 	errorType := reflect.TypeOf(err).Name()
 	if errorType == "" {
@@ -218,15 +510,56 @@ func (t *Trace) Error(err error) {
 			Name:  errorTypeTag,
 			Value: errorType,
 		},
-		{
-			Name:  errorStackTag,
-			Value: err.Error(),
-		},
+	}
+	if stack := errorStack(err, 1); stack != "" {
+		tags = append(tags, &ssf.SSFTag{Name: errorStackTag, Value: stack})
 	}
 
 	t.Tags = append(t.Tags, tags...)
 }
 
+// errorStack returns the stack trace that err carries, or else the stack of
+// the function skip calls above errorStack's caller, cut to ErrorStackDepth
+// frames and ErrorStackSize bytes. It returns "" if either limit isn't
+// positive.
+func errorStack(err error, skip int) string {
+	if ErrorStackDepth <= 0 || ErrorStackSize <= 0 {
+		return ""
+	}
+	if _, ok := err.(fmt.Formatter); ok {
+		if stack := fmt.Sprintf("%+v", err); stack != err.Error() && strings.Contains(stack, "\n") {
+			return truncateStack(stack)
+		}
+	}
+
+	pcs := make([]uintptr, ErrorStackDepth)
+	// skip runtime.Callers and errorStack itself, then skip more
+	n := runtime.Callers(skip+2, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+	buf := bytes.Buffer{}
+	for n > 0 {
+		frame, more := frames.Next()
+		fmt.Fprintf(&buf, "%s\n\t%s:%d\n", frame.Function, frame.File, frame.Line)
+		if !more {
+			break
+		}
+	}
+	return truncateStack(buf.String())
+}
+
+// truncateStack cuts stack to the last whole line within ErrorStackSize.
+func truncateStack(stack string) string {
+	stack = strings.TrimSuffix(stack, "\n")
+	if len(stack) <= ErrorStackSize {
+		return stack
+	}
+	stack = stack[:ErrorStackSize]
+	if i := strings.LastIndexByte(stack, '\n'); i > 0 {
+		stack = stack[:i]
+	}
+	return stack
+}
+
 // Attach attaches the current trace to the context
 // and returns a copy of the context with that trace
 // stored under the key "trace".
@@ -244,27 +577,59 @@ func SpanFromContext(c context.Context) *Trace {
 	return StartChildSpan(parent)
 }
 
-// StartSpanFromContext is used to create a child span
-// when the parent trace is in the context
-func StartSpanFromContext(ctx context.Context, name string, opts ...opentracing.StartSpanOption) (s *Span, c context.Context) {
-	defer func() {
-		if r := recover(); r != nil {
-			s = nil
-			c = ctx
-		}
-	}()
-	sp, c := opentracing.StartSpanFromContext(ctx, name, opts...)
+// StartSpanFromContext starts a span that is a child of the span in ctx,
+// if there is one, and otherwise the root of a new trace for resource. The
+// parent can have been attached with Span.Attach, which is
+// opentracing.ContextWithSpan, or with Trace.Attach. It returns the span and
+// a copy of ctx with the span attached both ways, so that it is the parent
+// of spans started from the copy with either API. While NoopTracer is
+// active, or if ctx holds a NoopTracer span or one that is never sent, the
+// span is a shared one that is never sent, and starting it from a context
+// it's already attached to doesn't allocate.
+func StartSpanFromContext(ctx context.Context, resource string, opts ...opentracing.StartSpanOption) (*Span, context.Context) {
+	parent := parentFromContext(ctx)
+	_, noopParent := opentracing.SpanFromContext(ctx).(noopSpan)
+	if noopParent || parent != nil && parent.discard || atomic.LoadInt32(&noopActive) == 1 {
+		return discardSpan, attachDiscardSpan(ctx)
+	}
+	if parent != nil {
+		opts = append(opts, customSpanParent(parent))
+	}
+	span := GlobalTracer.StartSpan(resource, opts...).(*Span)
+	return span, span.Trace.Attach(span.Attach(ctx))
+}
 
-	s = sp.(*Span)
-	return s, c
+// parentFromContext returns the span attached to ctx, preferring one
+// attached as an opentracing.Span, or nil if there is none.
+func parentFromContext(ctx context.Context) *Trace {
+	if span, ok := opentracing.SpanFromContext(ctx).(*Span); ok && span != nil {
+		return span.Trace
+	}
+	if t, ok := ctx.Value(traceKey).(*Trace); ok && t != nil {
+		return t
+	}
+	return nil
 }
 
-// SetParent updates the ParentId, TraceId, and Resource of a trace
-// based on the parent's values (SpanId, TraceId, Resource).
+// SetParent updates the ParentId, TraceId, Resource, sampling decision,
+// sample rate, sampling priority and baggage of a trace based on the
+// parent's values (SpanId, TraceId, Resource, Sampled, sample rate,
+// sampling.priority tag, baggage).
 func (t *Trace) SetParent(parent *Trace) {
 	t.ParentID = parent.SpanID
 	t.TraceID = parent.TraceID
 	t.Resource = parent.Resource
+	t.Sampled = parent.Sampled
+	t.discard = parent.discard
+	t.sampleRate = parent.sampleRate
+	t.traceIDHigh = parent.traceIDHigh
+	t.baggage = nil
+	for k, v := range parent.baggage {
+		t.SetBaggageItem(k, v)
+	}
+	if priority, ok := parent.samplingPriority(); ok {
+		t.SetSamplingPriority(priority)
+	}
 }
 
 // context returns a spanContext representing the trace
@@ -278,6 +643,7 @@ func (t *Trace) context() *spanContext {
 	c.baggageItems["parentid"] = strconv.FormatInt(t.ParentID, 10)
 	c.baggageItems["spanid"] = strconv.FormatInt(t.SpanID, 10)
 	c.baggageItems["resource"] = t.Resource
+	t.setSamplingBaggage(c)
 	return c
 }
 
@@ -291,11 +657,31 @@ func (t *Trace) contextAsParent() *spanContext {
 	c.baggageItems["traceid"] = strconv.FormatInt(t.TraceID, 10)
 	c.baggageItems["parentid"] = strconv.FormatInt(t.SpanID, 10)
 	c.baggageItems["resource"] = t.Resource
+	t.setSamplingBaggage(c)
 	return c
 }
 
+// setSamplingBaggage adds the trace's sampling decision, if it
+// isn't sampled, its sample rate, if it was set, and its baggage
+// items to the spanContext, so that children inherit them.
+func (t *Trace) setSamplingBaggage(c *spanContext) {
+	if !t.Sampled {
+		c.baggageItems["sampled"] = "false"
+	}
+	if t.sampleRate != 0 {
+		c.baggageItems["samplerate"] = strconv.FormatFloat(float64(t.sampleRate), 'g', -1, 32)
+	}
+	if priority, ok := t.samplingPriority(); ok {
+		c.baggageItems["samplingpriority"] = strconv.Itoa(priority)
+	}
+	for k, v := range t.baggage {
+		c.baggageItems[baggagePrefix+k] = v
+	}
+}
+
 // StartTrace is called by to create the root-level span
-// for a trace
+// for a trace. It decides whether the trace is sampled,
+// at the rate set by SetHeadSampleRate.
 func StartTrace(resource string) *Trace {
 	traceID := proto.Int64(rand.Int63())
 
@@ -304,6 +690,7 @@ func StartTrace(resource string) *Trace {
 		SpanID:   *traceID,
 		ParentID: 0,
 		Resource: resource,
+		Sampled:  sampleTraceID(*traceID, HeadSampleRate()),
 	}
 
 	t.Start = time.Now()
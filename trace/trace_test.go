@@ -2,11 +2,15 @@ package trace
 
 import (
 	"context"
+	"fmt"
+	"io"
 	"net"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/golang/protobuf/proto"
+	"github.com/opentracing/opentracing-go"
 	"github.com/stretchr/testify/assert"
 	"github.com/stripe/veneur/ssf"
 )
@@ -41,6 +45,7 @@ func TestRecord(t *testing.T) {
 	assert.NoError(t, err)
 	serverConn, err := net.ListenUDP("udp", traceAddr)
 	assert.NoError(t, err)
+	defer serverConn.Close()
 
 	err = serverConn.SetReadBuffer(BufferSize)
 	assert.NoError(t, err)
@@ -115,6 +120,80 @@ func TestRecord(t *testing.T) {
 
 }
 
+// recordedSample returns the sample that record sends to
+// the local veneur.
+func recordedSample(t *testing.T, record func()) *ssf.SSFSample {
+	traceAddr, err := net.ResolveUDPAddr("udp", localVeneurAddress)
+	assert.NoError(t, err)
+	serverConn, err := net.ListenUDP("udp", traceAddr)
+	if !assert.NoError(t, err) {
+		return nil
+	}
+	defer serverConn.Close()
+
+	record()
+
+	buf := make([]byte, 65536)
+	assert.NoError(t, serverConn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	n, _, err := serverConn.ReadFrom(buf)
+	if !assert.NoError(t, err, "timed out waiting for socket read") {
+		return nil
+	}
+	sample := &ssf.SSFSample{}
+	assert.NoError(t, proto.Unmarshal(buf[:n], sample))
+	return sample
+}
+
+// TestRecordAt tests that a span recorded with an explicit
+// end time has exactly the duration up to it.
+func TestRecordAt(t *testing.T) {
+	trace := StartTrace("resource")
+	trace.ForceSample()
+	trace.Start = time.Date(2017, 1, 2, 3, 4, 5, 6, time.UTC)
+	end := trace.Start.Add(1500 * time.Millisecond)
+
+	sample := recordedSample(t, func() {
+		assert.NoError(t, trace.RecordAt(end, "veneur.trace.test", nil))
+	})
+	if assert.NotNil(t, sample) {
+		assert.Equal(t, (1500 * time.Millisecond).Nanoseconds(), sample.Trace.Duration)
+		assert.Equal(t, trace.Start.UnixNano(), sample.Timestamp)
+	}
+	assert.Equal(t, end, trace.End)
+}
+
+// TestRecordAtBeforeStart tests that a span that ends before
+// it starts is recorded with a duration of zero.
+func TestRecordAtBeforeStart(t *testing.T) {
+	trace := StartTrace("resource")
+	trace.ForceSample()
+
+	sample := recordedSample(t, func() {
+		assert.NoError(t, trace.RecordAt(trace.Start.Add(-time.Second), "veneur.trace.test", nil))
+	})
+	if assert.NotNil(t, sample) {
+		assert.Equal(t, int64(0), sample.Trace.Duration)
+	}
+	assert.Equal(t, time.Duration(0), trace.Duration())
+}
+
+// TestBaggage tests that baggage set on a root span reaches its
+// grandchildren, and that children's baggage doesn't leak upwards.
+func TestBaggage(t *testing.T) {
+	root := StartTrace("resource")
+	root.SetBaggageItem("tenant_id", "42")
+
+	child := StartChildSpan(root)
+	grandchild := SpanFromContext(child.Attach(context.Background()))
+	assert.Equal(t, "42", grandchild.BaggageItem("tenant_id"))
+	assert.Equal(t, "42", grandchild.BaggageItem("Tenant_ID"), "keys should be case-insensitive")
+
+	child.SetBaggageItem("tenant_id", "43")
+	assert.Equal(t, "42", root.BaggageItem("tenant_id"), "a child's baggage shouldn't change its parent's")
+	assert.Equal(t, "42", grandchild.BaggageItem("tenant_id"))
+	assert.Equal(t, "", root.BaggageItem("missing"))
+}
+
 func TestAttach(t *testing.T) {
 	const resource = "Robert'); DROP TABLE students;"
 	ctx := context.Background()
@@ -147,6 +226,37 @@ func TestSpanFromContext(t *testing.T) {
 	assert.Equal(t, grandchild.TraceID, trace.SpanID)
 }
 
+func TestStartSpanFromContext(t *testing.T) {
+	const resource = "Robert'); DROP TABLE students;"
+	root := StartTrace(resource)
+	root.SetBaggageItem("tenant", "a")
+
+	child, ctx := StartSpanFromContext(root.Attach(context.Background()), "ignored", NameTag("child"))
+	assert.Equal(t, root.TraceID, child.TraceID)
+	assert.Equal(t, root.SpanID, child.ParentID)
+	assert.Equal(t, resource, child.Resource, "the resource should be the root's")
+	assert.Equal(t, "child", child.Name)
+	assert.Equal(t, "a", child.BaggageItem("tenant"))
+	assert.Equal(t, child.Trace, ctx.Value(traceKey), "the child should be attached to the context")
+
+	grandchild, _ := StartSpanFromContext(ctx, "ignored")
+	assert.Equal(t, root.TraceID, grandchild.TraceID)
+	assert.Equal(t, child.SpanID, grandchild.ParentID)
+
+	// a parent attached with the OpenTracing API is found too
+	otChild, _ := StartSpanFromContext(opentracing.ContextWithSpan(context.Background(), child), "ignored")
+	assert.Equal(t, child.SpanID, otChild.ParentID)
+}
+
+func TestStartSpanFromContextNoParent(t *testing.T) {
+	const resource = "GET /cart"
+	span, ctx := StartSpanFromContext(context.Background(), resource)
+	assert.Equal(t, span.SpanID, span.TraceID, "the span should start a trace")
+	assert.Equal(t, int64(0), span.ParentID)
+	assert.Equal(t, resource, span.Resource)
+	assert.Equal(t, span, opentracing.SpanFromContext(ctx))
+}
+
 func TestStartChildSpan(t *testing.T) {
 	const resource = "Robert'); DROP TABLE students;"
 	root := StartTrace(resource)
@@ -164,6 +274,116 @@ func TestStartChildSpan(t *testing.T) {
 	assert.Equal(t, child.SpanID, grandchild.ParentID)
 }
 
+func TestSetSampleRate(t *testing.T) {
+	const resource = "Robert'); DROP TABLE students;"
+	root := StartTrace(resource)
+	assert.InEpsilon(t, DefaultSampleRate, root.SampleRate(), ε)
+	assert.InEpsilon(t, DefaultSampleRate, root.SSFSample().SampleRate, ε)
+
+	for _, rate := range []float64{0, -0.5, 1.5} {
+		assert.Equal(t, ErrInvalidSampleRate, root.SetSampleRate(rate), "rate %v should be rejected", rate)
+	}
+	assert.InEpsilon(t, DefaultSampleRate, root.SampleRate(), ε, "invalid rates should leave the rate unchanged")
+
+	assert.NoError(t, root.SetSampleRate(1))
+	assert.InEpsilon(t, 1, root.SSFSample().SampleRate, ε)
+
+	child := StartChildSpan(root)
+	grandchild := StartChildSpan(child)
+	assert.InEpsilon(t, 1, child.SSFSample().SampleRate, ε, "children should inherit the sample rate")
+	assert.InEpsilon(t, 1, grandchild.SSFSample().SampleRate, ε)
+}
+
+func TestHeadSampling(t *testing.T) {
+	const resource = "Robert'); DROP TABLE students;"
+	assert.Equal(t, ErrInvalidSampleRate, SetHeadSampleRate(0))
+	assert.Equal(t, ErrInvalidSampleRate, SetHeadSampleRate(2))
+	assert.Equal(t, 1.0, HeadSampleRate())
+	assert.True(t, StartTrace(resource).Sampled, "every trace should be sampled by default")
+
+	assert.NoError(t, SetHeadSampleRate(0.5))
+	defer SetHeadSampleRate(1)
+
+	const n = 1000
+	sampled := 0
+	for i := 0; i < n; i++ {
+		root := StartTrace(resource)
+		child := StartChildSpan(root)
+		grandchild := StartChildSpan(child)
+		assert.Equal(t, root.Sampled, child.Sampled, "children should share the trace's decision")
+		assert.Equal(t, root.Sampled, grandchild.Sampled, "grandchildren should share the trace's decision")
+		assert.Equal(t, sampleTraceID(root.TraceID, 0.5), root.Sampled, "the decision should be derived from the trace ID")
+		if root.Sampled {
+			sampled++
+		}
+	}
+	assert.InDelta(t, 0.5, float64(sampled)/n, 0.1)
+}
+
+func TestForceSample(t *testing.T) {
+	root := &Trace{TraceID: 1, SpanID: 1, Sampled: false}
+	root.ForceSample()
+	assert.True(t, root.Sampled)
+	assert.True(t, StartChildSpan(root).Sampled, "children started after forcing should be sampled")
+
+	errored := StartChildSpan(&Trace{TraceID: 1, SpanID: 1, Sampled: false})
+	assert.False(t, errored.Sampled)
+	errored.Error(localError{"boom"})
+	assert.True(t, errored.Sampled, "error spans should always be sampled")
+}
+
+func TestSetSamplingPriority(t *testing.T) {
+	root := &Trace{TraceID: 1, SpanID: 1, Sampled: false}
+	root.SetSamplingPriority(0)
+	assert.False(t, root.Sampled, "a priority of 0 shouldn't force sampling")
+	root.SetSamplingPriority(2)
+	assert.True(t, root.Sampled, "a priority of 1 or more should force sampling")
+	if assert.Len(t, root.Tags, 1, "the priority should be replaced") {
+		assert.Equal(t, &ssf.SSFTag{Name: samplingPriorityTag, Value: "2", Type: ssf.SSFTag_INT}, root.Tags[0])
+	}
+
+	child := StartChildSpan(&Trace{TraceID: 1, SpanID: 1, Sampled: false, Tags: root.Tags})
+	assert.True(t, child.Sampled, "a child should be kept with its trace")
+	if assert.Len(t, child.Tags, 1, "a child should inherit its trace's priority") {
+		assert.Equal(t, root.Tags[0], child.Tags[0])
+		assert.False(t, root.Tags[0] == child.Tags[0], "the child should have its own tag")
+	}
+}
+
+func TestSpanLogs(t *testing.T) {
+	span := StartTrace("checkout")
+	span.LogEvent("cache.miss")
+	span.Log("retry", map[string]string{"attempt": "2", "error": "timeout"})
+	span.LogEvent("done")
+	span.finish()
+
+	if assert.Len(t, span.Logs, 3) {
+		assert.Equal(t, []string{"cache.miss", "retry", "done"}, []string{span.Logs[0].Event, span.Logs[1].Event, span.Logs[2].Event})
+		for i, l := range span.Logs {
+			assert.False(t, l.Timestamp.Before(span.Start), "event %d should be after the span started", i)
+			assert.False(t, l.Timestamp.After(span.End), "event %d should be before the span ended", i)
+			if i > 0 {
+				assert.False(t, l.Timestamp.Before(span.Logs[i-1].Timestamp), "event %d should be after the one before it", i)
+			}
+		}
+	}
+
+	packet, err := proto.Marshal(span.SSFSample())
+	assert.NoError(t, err)
+	sample := &ssf.SSFSample{}
+	assert.NoError(t, proto.Unmarshal(packet, sample))
+	if assert.Len(t, sample.Trace.Logs, 3) {
+		retry := sample.Trace.Logs[1]
+		assert.Equal(t, "retry", retry.Event)
+		assert.Equal(t, span.Logs[1].Timestamp.UnixNano(), retry.Timestamp)
+		assert.Equal(t, []*ssf.SSFTag{
+			{Name: "attempt", Value: "2"},
+			{Name: "error", Value: "timeout"},
+		}, retry.Fields, "fields should be sorted by name")
+		assert.Empty(t, sample.Trace.Logs[0].Fields)
+	}
+}
+
 // Test that a Trace is correctly able to generate
 // its spanContext representation from the point of view
 // of its children
@@ -188,6 +408,26 @@ func TestNameTag(t *testing.T) {
 
 }
 
+func TestTracerDefaultTags(t *testing.T) {
+	const name = "my.name.tag"
+	tracer := Tracer{DefaultTags: []*ssf.SSFTag{
+		{Name: "env", Value: "prod"},
+		{Name: "name", Value: "default.name"},
+	}}
+	span := tracer.StartSpan("resource", NameTag(name)).(*Span)
+	assert.Equal(t, name, span.Name)
+
+	tags := map[string]string{}
+	for _, tag := range span.Tags {
+		tags[tag.Name] = tag.Value
+	}
+	assert.Equal(t, map[string]string{"env": "prod", "name": name}, tags,
+		"the span's own tags should replace the defaults")
+
+	span.Tags[0].Value = "dev"
+	assert.Equal(t, "prod", tracer.DefaultTags[0].Value, "spans should get copies of the defaults")
+}
+
 type localError struct {
 	message string
 }
@@ -214,8 +454,54 @@ func TestError(t *testing.T) {
 		case errorTypeTag:
 			assert.Equal(t, tag.Value, "localError")
 		case errorStackTag:
-			assert.Equal(t, tag.Value, err.Error())
+			lines := strings.Split(tag.Value, "\n")
+			assert.True(t, len(lines) > 2, "the stack should have more than one frame")
+			assert.Contains(t, lines[0], "trace.TestError", "the stack should start where Error was called")
 		}
 	}
 
 }
+
+// stackError prints a stack with %+v, like the errors of github.com/pkg/errors.
+type stackError struct{}
+
+func (stackError) Error() string {
+	return "oops"
+}
+
+func (e stackError) Format(s fmt.State, verb rune) {
+	if s.Flag('+') {
+		io.WriteString(s, "oops\nmain.handler\n\t/src/main.go:10")
+		return
+	}
+	io.WriteString(s, e.Error())
+}
+
+func TestErrorStack(t *testing.T) {
+	assert.Equal(t, "oops\nmain.handler\n\t/src/main.go:10", errorStack(stackError{}, 0), "an error's own stack should be used")
+
+	defer func(depth, size int) {
+		ErrorStackDepth = depth
+		ErrorStackSize = size
+	}(ErrorStackDepth, ErrorStackSize)
+
+	ErrorStackDepth = 1
+	stack := errorStack(localError{"oops"}, 0)
+	assert.Len(t, strings.Split(stack, "\n"), 2, "one frame is a function and its file")
+
+	ErrorStackDepth = 32
+	ErrorStackSize = 30
+	stack = errorStack(stackError{}, 0)
+	assert.Equal(t, "oops\nmain.handler", stack, "the stack should be cut to whole lines")
+
+	for _, limits := range [][2]int{{-1, 4096}, {32, -1}, {0, 4096}} {
+		ErrorStackDepth, ErrorStackSize = limits[0], limits[1]
+		assert.Equal(t, "", errorStack(localError{"oops"}, 0), "limits of %v should record no stack", limits)
+		assert.Equal(t, "", errorStack(stackError{}, 0), "limits of %v should record no stack", limits)
+	}
+	span := StartTrace("GET /cart")
+	span.Error(localError{"oops"})
+	for _, tag := range span.Tags {
+		assert.NotEqual(t, errorStackTag, tag.Name, "a disabled stack shouldn't be tagged")
+	}
+}
@@ -0,0 +1,93 @@
+package trace
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// TraceParentHeader is the W3C Trace Context header
+const TraceParentHeader = "traceparent"
+
+// traceContextSampled is the sampled bit of the traceparent flags
+const traceContextSampled = 0x01
+
+// InjectTraceContext writes the trace into the headers as a W3C
+// Trace Context traceparent header, so that OpenTelemetry and
+// other W3C-compatible services can continue the trace.
+//
+// W3C trace IDs are 128 bits, and Veneur's are 64: the TraceID
+// is written as the low 64 bits. The high 64 bits are zero,
+// unless the trace was continued from one extracted with
+// ExtractTraceContext, in which case the original high bits are
+// written, so the trace ID is preserved.
+func InjectTraceContext(t *Trace, h http.Header) {
+	flags := 0
+	if t.Sampled {
+		flags |= traceContextSampled
+	}
+	h.Set(TraceParentHeader, fmt.Sprintf("00-%016x%016x-%016x-%02x", t.traceIDHigh, uint64(t.TraceID), uint64(t.SpanID), flags))
+}
+
+// ExtractTraceContext reads the span described by a W3C Trace
+// Context traceparent header. Like Extract, the returned Trace
+// represents the caller's span: use StartChildSpan, or Attach and
+// SpanFromContext, to continue the trace. Its TraceID is the low
+// 64 bits of the W3C trace ID, and it is sampled if the sampled
+// flag is set.
+// It returns an error, and no Trace, if the header is missing or
+// malformed.
+func ExtractTraceContext(h http.Header) (*Trace, error) {
+	header := h.Get(TraceParentHeader)
+	if header == "" {
+		return nil, fmt.Errorf("%s header is missing", TraceParentHeader)
+	}
+	parts := strings.Split(header, "-")
+	if len(parts) < 4 {
+		return nil, fmt.Errorf("%s header %q must have the format version-traceid-parentid-flags", TraceParentHeader, header)
+	}
+	version, traceID, spanID, flags := parts[0], parts[1], parts[2], parts[3]
+	if !isLowerHex(version, 2) || version == "ff" {
+		return nil, fmt.Errorf("%s header %q has an invalid version", TraceParentHeader, header)
+	}
+	// later versions may append fields, but version 00 has exactly four
+	if version == "00" && len(parts) != 4 {
+		return nil, fmt.Errorf("%s header %q has too many fields for version 00", TraceParentHeader, header)
+	}
+	if !isLowerHex(traceID, 32) || traceID == strings.Repeat("0", 32) {
+		return nil, fmt.Errorf("%s header %q has an invalid trace ID", TraceParentHeader, header)
+	}
+	if !isLowerHex(spanID, 16) || spanID == strings.Repeat("0", 16) {
+		return nil, fmt.Errorf("%s header %q has an invalid parent ID", TraceParentHeader, header)
+	}
+	if !isLowerHex(flags, 2) {
+		return nil, fmt.Errorf("%s header %q has invalid flags", TraceParentHeader, header)
+	}
+
+	// the fields are validated as hex, so these can't fail
+	high, _ := strconv.ParseUint(traceID[:16], 16, 64)
+	low, _ := strconv.ParseUint(traceID[16:], 16, 64)
+	span, _ := strconv.ParseUint(spanID, 16, 64)
+	flagBits, _ := strconv.ParseUint(flags, 16, 8)
+	return &Trace{
+		TraceID:     int64(low),
+		SpanID:      int64(span),
+		Sampled:     flagBits&traceContextSampled != 0,
+		traceIDHigh: high,
+	}, nil
+}
+
+// isLowerHex reports whether s is n lowercase hex digits,
+// as required by Trace Context.
+func isLowerHex(s string, n int) bool {
+	if len(s) != n {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
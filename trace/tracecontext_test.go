@@ -0,0 +1,78 @@
+package trace
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExtractTraceContext(t *testing.T) {
+	const traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	h := http.Header{}
+	h.Set("traceparent", traceparent)
+
+	trace, err := ExtractTraceContext(h)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(-0x5c316d62f1f1b8ca), trace.TraceID, "the TraceID should be the low 64 bits")
+	assert.Equal(t, int64(0x00f067aa0ba902b7), trace.SpanID)
+	assert.True(t, trace.Sampled)
+
+	// round trip
+	out := http.Header{}
+	InjectTraceContext(trace, out)
+	assert.Equal(t, traceparent, out.Get("traceparent"))
+
+	// children keep the whole trace ID
+	child := SpanFromContext(trace.Attach(context.Background()))
+	InjectTraceContext(child, out)
+	extracted, err := ExtractTraceContext(out)
+	assert.NoError(t, err)
+	assert.Equal(t, trace.TraceID, extracted.TraceID)
+	assert.Equal(t, child.SpanID, extracted.SpanID)
+	assert.Equal(t, "4bf92f3577b34da6", out.Get("traceparent")[3:19], "the high 64 bits should be preserved")
+}
+
+func TestInjectExtractTraceContext(t *testing.T) {
+	for _, sampled := range []bool{true, false} {
+		root := StartTrace("resource")
+		root.Sampled = sampled
+		h := http.Header{}
+		InjectTraceContext(root, h)
+		assert.Equal(t, "0000000000000000", h.Get("traceparent")[3:19], "local trace IDs should be extended with zeros")
+
+		trace, err := ExtractTraceContext(h)
+		assert.NoError(t, err)
+		assert.Equal(t, root.TraceID, trace.TraceID)
+		assert.Equal(t, root.SpanID, trace.SpanID)
+		assert.Equal(t, sampled, trace.Sampled)
+	}
+}
+
+func TestExtractTraceContextMalformed(t *testing.T) {
+	for _, traceparent := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-1",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba9zzzz-01",
+	} {
+		h := http.Header{}
+		h.Set("traceparent", traceparent)
+		trace, err := ExtractTraceContext(h)
+		assert.Error(t, err, traceparent)
+		assert.Nil(t, trace, traceparent)
+	}
+
+	// later versions may add fields
+	h := http.Header{}
+	h.Set("traceparent", "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra")
+	_, err := ExtractTraceContext(h)
+	assert.NoError(t, err)
+}
@@ -0,0 +1,112 @@
+package veneur
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/stripe/veneur/samplers"
+)
+
+// valueTransformer rewrites the values of selected metrics on their way to
+// a sink, eg to convert bytes to bits or correct a miscalibrated sensor.
+// Only the copy of the metrics given to that sink is changed.
+type valueTransformer struct {
+	// the transforms of each sink, by metric name; the "" sink applies to
+	// every sink
+	sinks map[string]map[string]valueTransform
+}
+
+type valueTransform struct {
+	operation string
+	operand   float64
+}
+
+// newValueTransformer parses the value_transforms rules. A metric may have
+// one transform per sink.
+func newValueTransformer(rules []ValueTransformRule) (*valueTransformer, error) {
+	t := &valueTransformer{sinks: map[string]map[string]valueTransform{}}
+	for _, rule := range rules {
+		if rule.Name == "" {
+			return nil, fmt.Errorf("value_transforms rule has no name")
+		}
+		switch rule.Operation {
+		case "multiply", "add":
+		case "log":
+			if rule.Value != 0 {
+				return nil, fmt.Errorf("value_transforms log rule for %q doesn't take a value", rule.Name)
+			}
+		default:
+			return nil, fmt.Errorf("value_transforms operation for %q must be multiply, add or log, got %q", rule.Name, rule.Operation)
+		}
+		transforms, ok := t.sinks[rule.Sink]
+		if !ok {
+			transforms = map[string]valueTransform{}
+			t.sinks[rule.Sink] = transforms
+		}
+		if _, ok := transforms[rule.Name]; ok {
+			return nil, fmt.Errorf("value_transforms has more than one rule for %q and sink %q", rule.Name, rule.Sink)
+		}
+		transforms[rule.Name] = valueTransform{operation: rule.Operation, operand: rule.Value}
+	}
+	return t, nil
+}
+
+// apply returns the transformed value, and false if it has none, ie the
+// logarithm of a value that isn't positive.
+func (t valueTransform) apply(value float64) (float64, bool) {
+	switch t.operation {
+	case "multiply":
+		return value * t.operand, true
+	case "add":
+		return value + t.operand, true
+	case "log":
+		if value <= 0 {
+			return 0, false
+		}
+		return math.Log(value), true
+	}
+	return value, true
+}
+
+// Transform returns the metrics for sink with their values transformed. If
+// any are, the metrics are copied first, so that other sinks are unaffected;
+// metrics whose transformed value isn't a number are dropped. It returns the
+// metrics as they are if the transformer is nil.
+func (t *valueTransformer) Transform(metrics []samplers.DDMetric, sink string) ([]samplers.DDMetric, int) {
+	if t == nil {
+		return metrics, 0
+	}
+	all, specific := t.sinks[""], t.sinks[sink]
+	if len(all) == 0 && len(specific) == 0 {
+		return metrics, 0
+	}
+
+	transformed := make([]samplers.DDMetric, 0, len(metrics))
+	dropped := 0
+	for _, m := range metrics {
+		transform, ok := specific[m.Name]
+		if !ok {
+			transform, ok = all[m.Name]
+		}
+		if ok {
+			value, valid := transform.apply(m.Value[0][1])
+			if !valid {
+				dropped++
+				continue
+			}
+			m.Value[0][1] = value
+		}
+		transformed = append(transformed, m)
+	}
+	return transformed, dropped
+}
+
+// transformValues applies the value transforms for sink to metrics, counting
+// the metrics dropped because their transformed value isn't a number.
+func (s *Server) transformValues(metrics []samplers.DDMetric, sink string) []samplers.DDMetric {
+	metrics, dropped := s.valueTransformer.Transform(metrics, sink)
+	if dropped > 0 {
+		s.Statsd.Count("flush.value_transforms.dropped_total", int64(dropped), []string{"sink:" + sink}, 1.0)
+	}
+	return metrics
+}
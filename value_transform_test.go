@@ -0,0 +1,84 @@
+package veneur
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stripe/veneur/samplers"
+)
+
+func TestValueTransforms(t *testing.T) {
+	transformer, err := newValueTransformer([]ValueTransformRule{
+		{Name: "network.sent", Operation: "multiply", Value: 8, Sink: "bits"},
+		{Name: "sensor.temp", Operation: "add", Value: -1.5},
+		{Name: "sensor.temp", Operation: "log", Sink: "bits"},
+	})
+	assert.NoError(t, err)
+	s := &Server{valueTransformer: transformer}
+
+	flushed := map[string]chan []samplers.DDMetric{}
+	for _, name := range []string{"bits", "bytes"} {
+		ch := make(chan []samplers.DDMetric, 1)
+		flushed[name] = ch
+		s.registerPlugin(&dummyPlugin{name: name, flush: func(metrics []samplers.DDMetric, hostname string) error {
+			ch <- metrics
+			return nil
+		}})
+	}
+
+	metric := func(name string, value float64) samplers.DDMetric {
+		return samplers.DDMetric{
+			Name:       name,
+			Value:      [1][2]float64{{1, value}},
+			Tags:       []string{"a:b"},
+			MetricType: "gauge",
+		}
+	}
+	metrics := []samplers.DDMetric{
+		metric("network.sent", 100),
+		metric("sensor.temp", 0),
+		metric("other", 7),
+	}
+	assert.NoError(t, s.flushPlugins(metrics, nil))
+
+	values := func(metrics []samplers.DDMetric) map[string]float64 {
+		byName := map[string]float64{}
+		for _, m := range metrics {
+			byName[m.Name] = m.Value[0][1]
+		}
+		return byName
+	}
+	assert.Equal(t, map[string]float64{
+		"network.sent": 800,
+		"other":        7,
+	}, values(<-flushed["bits"]), "the log of 0 should be dropped, and the rule for the sink used over the one for every sink")
+	assert.Equal(t, map[string]float64{
+		"network.sent": 100,
+		"sensor.temp":  -1.5,
+		"other":        7,
+	}, values(<-flushed["bytes"]))
+	assert.Equal(t, 100.0, metrics[0].Value[0][1], "the original metrics should be unchanged")
+}
+
+func TestValueTransformsConfig(t *testing.T) {
+	_, err := newValueTransformer([]ValueTransformRule{{Name: "a.b.c", Operation: "divide", Value: 2}})
+	assert.Error(t, err, "only multiply, add and log are allowed")
+	_, err = newValueTransformer([]ValueTransformRule{{Operation: "multiply", Value: 2}})
+	assert.Error(t, err, "a name is required")
+	_, err = newValueTransformer([]ValueTransformRule{{Name: "a.b.c", Operation: "log", Value: 10}})
+	assert.Error(t, err, "log doesn't take a value")
+	_, err = newValueTransformer([]ValueTransformRule{
+		{Name: "a.b.c", Operation: "multiply", Value: 2},
+		{Name: "a.b.c", Operation: "add", Value: 2},
+	})
+	assert.Error(t, err, "one rule per name and sink")
+
+	config := localConfig()
+	config.ValueTransforms = []ValueTransformRule{{Name: "a.b.c", Operation: "multiply", Value: 8, Sink: "localfile"}}
+	_, err = NewFromConfig(config)
+	assert.Error(t, err, "the sink must exist")
+
+	config.FlushFile = "/dev/null"
+	_, err = NewFromConfig(config)
+	assert.NoError(t, err)
+}
@@ -2,6 +2,7 @@ package veneur
 
 import (
 	"container/ring"
+	"hash/fnv"
 	"sync"
 	"time"
 
@@ -23,6 +24,54 @@ type Worker struct {
 	stats      *statsd.Client
 	logger     *logrus.Logger
 	wm         WorkerMetrics
+
+	// what Send does when PacketChan is full, and how long it blocks for
+	// under OverflowBlock; 0 means forever
+	overflowPolicy OverflowPolicy
+	blockTimeout   time.Duration
+
+	// K for each counter aggregated as a TopKCounter, by name
+	topK map[string]int
+
+	// t-digest compression of new histograms and timers; 0 for the default
+	histogramCompression float64
+	// HyperLogLog precision of new sets; 0 for the default
+	setPrecision uint8
+
+	// limits the tag sets of each metric name this worker aggregates; nil
+	// if max_tag_sets_per_metric isn't set
+	cardinality *cardinalityLimiter
+}
+
+// OverflowPolicy decides what happens to a metric sent to a worker whose
+// PacketChan is full.
+type OverflowPolicy int
+
+const (
+	// OverflowBlock waits for room in the channel, for up to the worker's
+	// block timeout, and then drops the metric.
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDropNewest drops the metric being sent.
+	OverflowDropNewest
+	// OverflowDropOldest drops the oldest metric in the channel to make room.
+	OverflowDropOldest
+)
+
+// OverflowPolicies maps the names used in worker_overflow_policy to
+// policies.
+var OverflowPolicies = map[string]OverflowPolicy{
+	"block":       OverflowBlock,
+	"drop_newest": OverflowDropNewest,
+	"drop_oldest": OverflowDropOldest,
+}
+
+func (p OverflowPolicy) String() string {
+	for name, policy := range OverflowPolicies {
+		if policy == p {
+			return name
+		}
+	}
+	return "unknown"
 }
 
 // WorkerMetrics is just a plain struct bundling together the flushed contents of a worker
@@ -39,10 +88,27 @@ type WorkerMetrics struct {
 	// this is for counters which are globally aggregated
 	globalCounters map[samplers.MetricKey]*samplers.Counter
 
+	// these are sent to the distribution intake by every veneur
+	distributions map[samplers.MetricKey]*samplers.Distribution
+
 	// these are used for metrics that shouldn't be forwarded
 	localHistograms map[samplers.MetricKey]*samplers.Histo
 	localSets       map[samplers.MetricKey]*samplers.Set
 	localTimers     map[samplers.MetricKey]*samplers.Histo
+
+	// counters that only report their top tag combinations, by name
+	topKCounters map[string]*samplers.TopKCounter
+
+	// samples dropped by max_tag_sets_per_metric, by metric name; only set
+	// by Flush
+	tagSetsDropped map[string]int64
+
+	// t-digest compression of histograms and timers created by Upsert; 0 for
+	// samplers.DefaultHistogramCompression
+	histogramCompression float64
+	// HyperLogLog precision of sets created by Upsert; 0 for
+	// samplers.DefaultSetPrecision
+	setPrecision uint8
 }
 
 // NewWorkerMetrics initializes a WorkerMetrics struct
@@ -57,6 +123,8 @@ func NewWorkerMetrics() WorkerMetrics {
 		localHistograms: make(map[samplers.MetricKey]*samplers.Histo),
 		localSets:       make(map[samplers.MetricKey]*samplers.Set),
 		localTimers:     make(map[samplers.MetricKey]*samplers.Histo),
+		distributions:   make(map[samplers.MetricKey]*samplers.Distribution),
+		topKCounters:    make(map[string]*samplers.TopKCounter),
 	}
 }
 
@@ -83,31 +151,35 @@ func (wm WorkerMetrics) Upsert(mk samplers.MetricKey, Scope samplers.MetricScope
 	case "histogram":
 		if Scope == samplers.LocalOnly {
 			if _, present = wm.localHistograms[mk]; !present {
-				wm.localHistograms[mk] = samplers.NewHist(mk.Name, tags)
+				wm.localHistograms[mk] = wm.newHist(mk.Name, tags)
 			}
 		} else {
 			if _, present = wm.histograms[mk]; !present {
-				wm.histograms[mk] = samplers.NewHist(mk.Name, tags)
+				wm.histograms[mk] = wm.newHist(mk.Name, tags)
 			}
 		}
+	case "distribution":
+		if _, present = wm.distributions[mk]; !present {
+			wm.distributions[mk] = samplers.NewDistribution(mk.Name, tags)
+		}
 	case "set":
 		if Scope == samplers.LocalOnly {
 			if _, present = wm.localSets[mk]; !present {
-				wm.localSets[mk] = samplers.NewSet(mk.Name, tags)
+				wm.localSets[mk] = wm.newSet(mk.Name, tags)
 			}
 		} else {
 			if _, present = wm.sets[mk]; !present {
-				wm.sets[mk] = samplers.NewSet(mk.Name, tags)
+				wm.sets[mk] = wm.newSet(mk.Name, tags)
 			}
 		}
 	case "timer":
 		if Scope == samplers.LocalOnly {
 			if _, present = wm.localTimers[mk]; !present {
-				wm.localTimers[mk] = samplers.NewHist(mk.Name, tags)
+				wm.localTimers[mk] = wm.newHist(mk.Name, tags)
 			}
 		} else {
 			if _, present = wm.timers[mk]; !present {
-				wm.timers[mk] = samplers.NewHist(mk.Name, tags)
+				wm.timers[mk] = wm.newHist(mk.Name, tags)
 			}
 		}
 		// no need to raise errors on unknown types
@@ -116,6 +188,59 @@ func (wm WorkerMetrics) Upsert(mk samplers.MetricKey, Scope samplers.MetricScope
 	return !present
 }
 
+// contains reports whether the WorkerMetrics already has an entry for the
+// given metric key, in the map that Upsert would put it in.
+func (wm WorkerMetrics) contains(mk samplers.MetricKey, Scope samplers.MetricScope) bool {
+	present := false
+	switch mk.Type {
+	case "counter":
+		if Scope == samplers.GlobalOnly {
+			_, present = wm.globalCounters[mk]
+		} else {
+			_, present = wm.counters[mk]
+		}
+	case "gauge":
+		_, present = wm.gauges[mk]
+	case "histogram":
+		if Scope == samplers.LocalOnly {
+			_, present = wm.localHistograms[mk]
+		} else {
+			_, present = wm.histograms[mk]
+		}
+	case "distribution":
+		_, present = wm.distributions[mk]
+	case "set":
+		if Scope == samplers.LocalOnly {
+			_, present = wm.localSets[mk]
+		} else {
+			_, present = wm.sets[mk]
+		}
+	case "timer":
+		if Scope == samplers.LocalOnly {
+			_, present = wm.localTimers[mk]
+		} else {
+			_, present = wm.timers[mk]
+		}
+	}
+	return present
+}
+
+func (wm WorkerMetrics) newHist(name string, tags []string) *samplers.Histo {
+	if wm.histogramCompression > 0 {
+		return samplers.NewHistWithCompression(name, tags, wm.histogramCompression)
+	}
+	return samplers.NewHist(name, tags)
+}
+
+func (wm WorkerMetrics) newSet(name string, tags []string) *samplers.Set {
+	if wm.setPrecision > 0 {
+		if s, err := samplers.NewSetWithPrecision(name, tags, wm.setPrecision); err == nil {
+			return s
+		}
+	}
+	return samplers.NewSet(name, tags)
+}
+
 // NewWorker creates, and returns a new Worker object.
 func NewWorker(id int, stats *statsd.Client, logger *logrus.Logger) *Worker {
 	return &Worker{
@@ -132,6 +257,92 @@ func NewWorker(id int, stats *statsd.Client, logger *logrus.Logger) *Worker {
 	}
 }
 
+// SetQueue replaces the worker's PacketChan with one buffering size metrics,
+// handled by the given overflow policy. It must be called before Work.
+func (w *Worker) SetQueue(size int, policy OverflowPolicy, blockTimeout time.Duration) {
+	w.PacketChan = make(chan samplers.UDPMetric, size)
+	w.overflowPolicy = policy
+	w.blockTimeout = blockTimeout
+}
+
+// SetTopK configures counters that are aggregated as a TopKCounter, mapping
+// their names to the number of tag combinations to report. It must be called
+// before Work.
+func (w *Worker) SetTopK(topK map[string]int) {
+	w.topK = topK
+}
+
+// SetHistogramCompression sets the t-digest compression of the histograms
+// and timers the worker creates, or the default if it is 0. It must be
+// called before Work.
+func (w *Worker) SetHistogramCompression(compression float64) {
+	w.histogramCompression = compression
+	w.wm.histogramCompression = compression
+}
+
+// SetSetPrecision sets the HyperLogLog precision of the sets the worker
+// creates, or the default if it is 0. It must be called before Work.
+func (w *Worker) SetSetPrecision(precision uint8) {
+	w.setPrecision = precision
+	w.wm.setPrecision = precision
+}
+
+// SetMaxTagSets limits each metric name to limit tag sets per interval, or
+// removes the limit if it is 0. It must be called before Work.
+func (w *Worker) SetMaxTagSets(limit int) {
+	w.cardinality = newCardinalityLimiter(limit)
+}
+
+// workerIndex returns which of numWorkers workers aggregates the metric
+// called name, from the FNV-1a hash of the name.
+func workerIndex(name string, numWorkers int) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return h.Sum32() % uint32(numWorkers)
+}
+
+// Send queues a metric for the worker to process, applying the worker's
+// overflow policy if its PacketChan is full. It reports whether the metric
+// was queued.
+func (w *Worker) Send(m samplers.UDPMetric) bool {
+	select {
+	case w.PacketChan <- m:
+		return true
+	default:
+	}
+
+	switch w.overflowPolicy {
+	case OverflowDropNewest:
+	case OverflowDropOldest:
+		for {
+			select {
+			case <-w.PacketChan:
+				w.stats.Count("worker.dropped_total", 1, []string{"policy:drop_oldest"}, 1.0)
+			default:
+			}
+			select {
+			case w.PacketChan <- m:
+				return true
+			default:
+			}
+		}
+	default:
+		if w.blockTimeout == 0 {
+			w.PacketChan <- m
+			return true
+		}
+		timer := time.NewTimer(w.blockTimeout)
+		defer timer.Stop()
+		select {
+		case w.PacketChan <- m:
+			return true
+		case <-timer.C:
+		}
+	}
+	w.stats.Count("worker.dropped_total", 1, []string{"policy:" + w.overflowPolicy.String()}, 1.0)
+	return false
+}
+
 // Work will start the worker listening for metrics to process or import.
 // It will not return until the worker is sent a message to terminate using Stop()
 func (w *Worker) Work() {
@@ -168,6 +379,21 @@ func (w *Worker) ProcessMetric(m *samplers.UDPMetric) {
 	defer w.mutex.Unlock()
 
 	w.processed++
+	if m.Type == "counter" {
+		if k, ok := w.topK[m.Name]; ok {
+			counter, ok := w.wm.topKCounters[m.Name]
+			if !ok {
+				counter = samplers.NewTopKCounter(m.Name, k)
+				w.wm.topKCounters[m.Name] = counter
+			}
+			counter.Sample(m.Tags, m.JoinedTags, m.Value.(float64), m.SampleRate)
+			return
+		}
+	}
+	if w.cardinality != nil && !w.wm.contains(m.MetricKey, m.Scope) &&
+		!w.cardinality.Allow(m.Name, m.JoinedTags) {
+		return
+	}
 	w.wm.Upsert(m.MetricKey, m.Scope, m.Tags)
 
 	switch m.Type {
@@ -185,6 +411,8 @@ func (w *Worker) ProcessMetric(m *samplers.UDPMetric) {
 		} else {
 			w.wm.histograms[m.MetricKey].Sample(m.Value.(float64), m.SampleRate)
 		}
+	case "distribution":
+		w.wm.distributions[m.MetricKey].Sample(m.Value.(float64), m.SampleRate)
 	case "set":
 		if m.Scope == samplers.LocalOnly {
 			w.wm.localSets[m.MetricKey].Sample(m.Value.(string), m.SampleRate)
@@ -210,12 +438,16 @@ func (w *Worker) ImportMetric(other samplers.JSONMetric) {
 	// we don't increment the processed metric counter here, it was already
 	// counted by the original veneur that sent this to us
 	w.imported++
+	scope := samplers.MixedScope
 	if other.Type == "counter" {
 		// this is an odd special case -- counters that are imported are global
-		w.wm.Upsert(other.MetricKey, samplers.GlobalOnly, other.Tags)
-	} else {
-		w.wm.Upsert(other.MetricKey, samplers.MixedScope, other.Tags)
+		scope = samplers.GlobalOnly
+	}
+	if w.cardinality != nil && !w.wm.contains(other.MetricKey, scope) &&
+		!w.cardinality.Allow(other.Name, other.JoinedTags) {
+		return
 	}
+	w.wm.Upsert(other.MetricKey, scope, other.Tags)
 
 	switch other.Type {
 	case "counter":
@@ -247,10 +479,13 @@ func (w *Worker) Flush() WorkerMetrics {
 	// and assigning new ones.
 	w.mutex.Lock()
 	ret := w.wm
+	ret.tagSetsDropped = w.cardinality.Reset()
 	processed := w.processed
 	imported := w.imported
 
 	w.wm = NewWorkerMetrics()
+	w.wm.histogramCompression = w.histogramCompression
+	w.wm.setPrecision = w.setPrecision
 	w.processed = 0
 	w.imported = 0
 	w.mutex.Unlock()
@@ -336,6 +571,7 @@ type TraceWorker struct {
 	mutex     *sync.Mutex
 	traces    *ring.Ring
 	stats     *statsd.Client
+	processed int64
 }
 
 // NewTraceWorker creates an TraceWorker ready to collect events and service checks.
@@ -355,10 +591,21 @@ func (tw *TraceWorker) Work() {
 		tw.mutex.Lock()
 		tw.traces.Value = m
 		tw.traces = tw.traces.Next()
+		tw.processed++
 		tw.mutex.Unlock()
 	}
 }
 
+// SpansProcessedCount is a convenience method for testing
+// that returns how many spans the TraceWorker has stored
+// since it started, so that tests can wait for them before
+// flushing.
+func (tw *TraceWorker) SpansProcessedCount() int64 {
+	tw.mutex.Lock()
+	defer tw.mutex.Unlock()
+	return tw.processed
+}
+
 // Flush returns the TraceWorker's stored spans and
 // resets the stored contents.
 func (tw *TraceWorker) Flush() *ring.Ring {
@@ -1,7 +1,9 @@
 package veneur
 
 import (
+	"fmt"
 	"testing"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
@@ -49,6 +51,61 @@ func TestWorkerLocal(t *testing.T) {
 	assert.Len(t, wm.histograms, 0, "number of global histograms")
 }
 
+func TestWorkerHistogramCompression(t *testing.T) {
+	w := NewWorker(1, nil, logrus.New())
+	w.SetHistogramCompression(500)
+
+	// the last histogram is created after a flush has reset the worker
+	for _, typ := range []string{"histogram", "timer", "histogram"} {
+		m := samplers.UDPMetric{
+			MetricKey:  samplers.MetricKey{Name: "a.b.c", Type: typ},
+			Value:      1.0,
+			SampleRate: 1.0,
+		}
+		w.ProcessMetric(&m)
+		wm := w.Flush()
+		for _, h := range wm.histograms {
+			assert.Equal(t, float64(500), h.Value.Compression(), "histogram compression")
+		}
+		for _, h := range wm.timers {
+			assert.Equal(t, float64(500), h.Value.Compression(), "timer compression")
+		}
+		assert.Equal(t, 1, len(wm.histograms)+len(wm.timers), "flushed %ss", typ)
+	}
+
+	w = NewWorker(1, nil, logrus.New())
+	m := samplers.UDPMetric{
+		MetricKey:  samplers.MetricKey{Name: "a.b.c", Type: "histogram"},
+		Value:      1.0,
+		SampleRate: 1.0,
+	}
+	w.ProcessMetric(&m)
+	for _, h := range w.Flush().histograms {
+		assert.Equal(t, float64(samplers.DefaultHistogramCompression), h.Value.Compression(), "default compression")
+	}
+}
+
+func TestWorkerSetPrecision(t *testing.T) {
+	w := NewWorker(1, nil, logrus.New())
+	w.SetSetPrecision(12)
+
+	// the second set is created after a flush has reset the worker
+	for i := 0; i < 2; i++ {
+		m := samplers.UDPMetric{
+			MetricKey:  samplers.MetricKey{Name: "a.b.c", Type: "set"},
+			Value:      "foo",
+			SampleRate: 1.0,
+		}
+		w.ProcessMetric(&m)
+		wm := w.Flush()
+		if assert.Len(t, wm.sets, 1) {
+			for _, s := range wm.sets {
+				assert.Equal(t, uint8(12), s.Precision())
+			}
+		}
+	}
+}
+
 func TestWorkerImportSet(t *testing.T) {
 	w := NewWorker(1, nil, logrus.New())
 	testset := samplers.NewSet("a.b.c", nil)
@@ -78,3 +135,79 @@ func TestWorkerImportHistogram(t *testing.T) {
 	wm := w.Flush()
 	assert.Len(t, wm.histograms, 1, "number of flushed histograms")
 }
+
+func TestWorkerImportMaxTagSets(t *testing.T) {
+	w := NewWorker(1, nil, logrus.New())
+	w.SetMaxTagSets(2)
+	for i := 0; i < 5; i++ {
+		testhisto := samplers.NewHist("a.b.c", []string{fmt.Sprintf("x:%d", i)})
+		testhisto.Sample(1.0, 1.0)
+		jsonMetric, err := testhisto.Export()
+		assert.NoError(t, err, "should have exported successfully")
+		w.ImportMetric(jsonMetric)
+		// imports of a tag set already seen aren't limited
+		w.ImportMetric(jsonMetric)
+	}
+
+	wm := w.Flush()
+	assert.Len(t, wm.histograms, 2, "imports over the limit should be dropped")
+	assert.Equal(t, map[string]int64{"a.b.c": 6}, wm.tagSetsDropped)
+}
+
+func TestWorkerOverflowPolicies(t *testing.T) {
+	metric := func(value float64) samplers.UDPMetric {
+		return samplers.UDPMetric{
+			MetricKey:  samplers.MetricKey{Name: "a.b.c", Type: "counter"},
+			Value:      value,
+			SampleRate: 1.0,
+		}
+	}
+	// the workers aren't running, so their channels fill up after 2 metrics
+	queued := func(w *Worker) []float64 {
+		var values []float64
+		for len(w.PacketChan) > 0 {
+			values = append(values, (<-w.PacketChan).Value.(float64))
+		}
+		return values
+	}
+
+	w := NewWorker(1, nil, logrus.New())
+	w.SetQueue(2, OverflowDropNewest, 0)
+	assert.True(t, w.Send(metric(1)))
+	assert.True(t, w.Send(metric(2)))
+	assert.False(t, w.Send(metric(3)), "drop_newest should drop the metric being sent")
+	assert.Equal(t, []float64{1, 2}, queued(w))
+
+	w = NewWorker(1, nil, logrus.New())
+	w.SetQueue(2, OverflowDropOldest, 0)
+	assert.True(t, w.Send(metric(1)))
+	assert.True(t, w.Send(metric(2)))
+	assert.True(t, w.Send(metric(3)), "drop_oldest should make room for the metric being sent")
+	assert.Equal(t, []float64{2, 3}, queued(w))
+
+	w = NewWorker(1, nil, logrus.New())
+	w.SetQueue(2, OverflowBlock, 20*time.Millisecond)
+	assert.True(t, w.Send(metric(1)))
+	assert.True(t, w.Send(metric(2)))
+	start := time.Now()
+	assert.False(t, w.Send(metric(3)), "block should give up after the timeout")
+	assert.True(t, time.Since(start) >= 20*time.Millisecond, "block should wait for the timeout")
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		<-w.PacketChan
+	}()
+	assert.True(t, w.Send(metric(4)), "block should succeed once there is room")
+	assert.Equal(t, []float64{2, 4}, queued(w))
+}
+
+func TestWorkerQueueConfig(t *testing.T) {
+	config := globalConfig()
+	config.WorkerChannelSize = -1
+	_, err := NewFromConfig(config)
+	assert.Error(t, err, "a negative worker_channel_size should be rejected")
+
+	config = globalConfig()
+	config.WorkerOverflowPolicy = "drop_oldest"
+	_, err = NewFromConfig(config)
+	assert.Error(t, err, "drop_oldest without a worker_channel_size should be rejected")
+}
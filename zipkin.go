@@ -0,0 +1,112 @@
+package veneur
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/stripe/veneur/ssf"
+	"github.com/stripe/veneur/trace"
+)
+
+// zipkinSpansPath is where a Zipkin server takes spans as v2 JSON.
+const zipkinSpansPath = "/api/v2/spans"
+
+// zipkinSpan represents a trace span as JSON for Zipkin's v2 API.
+// Timestamps and durations are in microseconds.
+type zipkinSpan struct {
+	TraceID       string             `json:"traceId"`
+	ID            string             `json:"id"`
+	ParentID      string             `json:"parentId,omitempty"`
+	Name          string             `json:"name"`
+	Timestamp     int64              `json:"timestamp"`
+	Duration      int64              `json:"duration,omitempty"`
+	LocalEndpoint zipkinEndpoint     `json:"localEndpoint"`
+	Annotations   []zipkinAnnotation `json:"annotations,omitempty"`
+	Tags          map[string]string  `json:"tags,omitempty"`
+}
+
+type zipkinEndpoint struct {
+	ServiceName string `json:"serviceName"`
+}
+
+type zipkinAnnotation struct {
+	Timestamp int64  `json:"timestamp"`
+	Value     string `json:"value"`
+}
+
+// zipkinSpanFor converts a span for Zipkin. Its resource is the Zipkin
+// name, critical spans are tagged error, and span logs become annotations
+// of the event and its fields.
+func (s *Server) zipkinSpanFor(sample ssf.SSFSample) zipkinSpan {
+	span := zipkinSpan{
+		TraceID:       formatZipkinID(sample.Trace.TraceId),
+		ID:            formatZipkinID(sample.Trace.Id),
+		Name:          sample.Trace.Resource,
+		Timestamp:     sample.Timestamp / int64(time.Microsecond),
+		Duration:      sample.Trace.Duration / int64(time.Microsecond),
+		LocalEndpoint: zipkinEndpoint{ServiceName: sample.Service},
+	}
+	if sample.Trace.ParentId > 0 {
+		span.ParentID = formatZipkinID(sample.Trace.ParentId)
+	}
+	// Zipkin requires a duration to be positive, so don't round spans
+	// shorter than a microsecond to nothing
+	if span.Duration == 0 && sample.Trace.Duration > 0 {
+		span.Duration = 1
+	}
+
+	for _, tag := range sample.Tags {
+		if span.Tags == nil {
+			span.Tags = map[string]string{}
+		}
+		span.Tags[tag.Name] = s.redactSpanTag(tag.Value)
+	}
+	if sample.Status == ssf.SSFSample_CRITICAL {
+		if span.Tags == nil {
+			span.Tags = map[string]string{}
+		}
+		span.Tags["error"] = "true"
+	}
+
+	for _, l := range sample.Trace.GetLogs() {
+		value := l.Event
+		for _, field := range l.Fields {
+			value += fmt.Sprintf(" %s=%s", field.Name, s.redactSpanTag(field.Value))
+		}
+		span.Annotations = append(span.Annotations, zipkinAnnotation{
+			Timestamp: l.Timestamp / int64(time.Microsecond),
+			Value:     value,
+		})
+	}
+	return span
+}
+
+// formatZipkinID formats an ID as the 16 hex digits Zipkin expects.
+func formatZipkinID(id int64) string {
+	return fmt.Sprintf("%016x", uint64(id))
+}
+
+// flushSpansZipkin sends spans to the Zipkin server at zipkin_api_address.
+// Unlike spans sent to Datadog, spans that fail to send are not buffered.
+func (s *Server) flushSpansZipkin(ctx context.Context, samples []ssf.SSFSample) error {
+	span, _ := trace.StartSpanFromContext(ctx, "flush", trace.NameTag("veneur.opentracing.flush.flushSpansZipkin"))
+	defer span.Finish()
+
+	spans := make([]zipkinSpan, len(samples))
+	for i, sample := range samples {
+		spans[i] = s.zipkinSpanFor(sample)
+	}
+	// like the Jaeger sink, return the status of a refused POST, so that it's
+	// counted as the sink's error
+	err := postHelperWithRetries(span.Attach(ctx), s.HTTPClient, s.Statsd, s.zipkinAPIAddress+zipkinSpansPath, nil, spans, "flush_traces_zipkin", encodingIdentity, 0)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"traces":        len(spans),
+			logrus.ErrorKey: err}).Warn("Error flushing traces to Zipkin")
+		return err
+	}
+	log.WithField("traces", len(spans)).Info("Completed flushing traces to Zipkin")
+	return nil
+}